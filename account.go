@@ -0,0 +1,413 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// users download all their data from /settings/account as JSON, and can have their account
+// deleted. A deletion waits for the grace period of ACCOUNT_DELETION_GRACE_DAYS, during which
+// logging in again and cancelling keeps the account. Then the posts of the user are given to the
+// "deleted" user, so that threads still read well, and the rest of their data is removed. The
+// audit log keeps its entries, as it is append-only
+
+// days an account deletion waits, unless ACCOUNT_DELETION_GRACE_DAYS says otherwise
+const defaultDeletionGraceDays = 14
+
+// deletedUserName is the author of the posts of deleted accounts. It is a reserved name, so no
+// one can register it, and the account has no password, so no one can log in
+const deletedUserName = "deleted"
+
+func init() {
+	jobHandlers["delete-account"] = deleteAccountJob
+}
+
+// deletionGracePeriod is how long an account deletion waits
+func deletionGracePeriod() time.Duration {
+	days := defaultDeletionGraceDays
+	if n, err := strconv.Atoi(os.Getenv("ACCOUNT_DELETION_GRACE_DAYS")); err == nil && n >= 0 {
+		days = n
+	}
+	return time.Duration(days) * 24 * time.Hour
+}
+
+// personalExport is the data of a user, as they download it
+type personalExport struct {
+	ExportedAt      string                `json:"exported_at"`
+	Profile         exportUser            `json:"profile"`
+	UsernameHistory []exportRename        `json:"username_history"`
+	Questions       []exportQuestion      `json:"questions"`
+	Answers         []exportAnswer        `json:"answers"`
+	Comments        []exportComment       `json:"comments"`
+	Votes           []exportVote          `json:"votes"`
+	Bookmarks       []exportBookmark      `json:"bookmarks"`
+	Subscriptions   []exportSubscription  `json:"subscriptions"`
+	Messages        []exportMessage       `json:"messages"`
+	Courses         []course              `json:"courses"`
+	Deletion        *exportDeletionStatus `json:"deletion,omitempty"`
+}
+
+type exportRename struct {
+	OldName   string `json:"old_name"`
+	NewName   string `json:"new_name"`
+	ChangedAt string `json:"changed_at"`
+}
+
+type exportComment struct {
+	ID       int    `json:"id"`
+	PostType string `json:"post_type"`
+	PostID   int    `json:"post_id"`
+	Body     string `json:"body"`
+	Date     string `json:"date"`
+	Time     string `json:"time"`
+	EditedAt string `json:"edited_at,omitempty"`
+	HiddenAt string `json:"hidden_at,omitempty"`
+}
+
+type exportBookmark struct {
+	QuestionID int    `json:"question_id"`
+	CreatedAt  string `json:"created_at"`
+}
+
+type exportSubscription struct {
+	TargetType string `json:"target_type"`
+	Target     string `json:"target"`
+	Email      bool   `json:"email"`
+	CreatedAt  string `json:"created_at"`
+}
+
+// exportMessage is a private message the user sent or received
+type exportMessage struct {
+	With      string `json:"with"` // username of the other user
+	Sent      bool   `json:"sent"`
+	Body      string `json:"body"`
+	CreatedAt string `json:"created_at"`
+}
+
+// exportDeletionStatus is the pending deletion of the account
+type exportDeletionStatus struct {
+	RequestedAt string `json:"requested_at"`
+	DeleteAt    string `json:"delete_at"`
+}
+
+// exportPersonalData reads all the data of the user, in one transaction
+func exportPersonalData(ctx context.Context, user *User) (*personalExport, error) {
+	data := &personalExport{ExportedAt: time.Now().Format(timestampLayout)}
+	err := db.WithTx(ctx, func(ctx context.Context) error {
+		p := &data.Profile
+		err := db.QueryRowContext(ctx, `select id, coalesce(username, ''), coalesce(first_name, ''), coalesce(last_name, ''), coalesce(email, ''),
+			coalesce(user_type, ''), coalesce(user_image, ''), coalesce(super_user, false), coalesce(language, '')
+			from users where id = ?`, user.UniqueID).Scan(&p.ID, &p.Username, &p.FirstName, &p.LastName, &p.Email, &p.Type, &p.Image, &p.SuperUser, &p.Language)
+		if err != nil {
+			return err
+		}
+		if err := queryList(ctx, "select badge_id, awarded_at from user_badges where user_id = ? order by awarded_at", []interface{}{user.UniqueID}, func(rows *sql.Rows) error {
+			var a exportAward
+			err := rows.Scan(&a.BadgeID, &a.AwardedAt)
+			p.Badges = append(p.Badges, a)
+			return err
+		}); err != nil {
+			return err
+		}
+		data.UsernameHistory = []exportRename{}
+		if err := queryList(ctx, "select old_name, new_name, changed_at from username_history where user_id = ? order by id", []interface{}{user.UniqueID}, func(rows *sql.Rows) error {
+			var h exportRename
+			err := rows.Scan(&h.OldName, &h.NewName, &h.ChangedAt)
+			data.UsernameHistory = append(data.UsernameHistory, h)
+			return err
+		}); err != nil {
+			return err
+		}
+		if data.Questions, err = exportQuestions(ctx, "user = ?", user.UserName); err != nil {
+			return err
+		}
+		if data.Answers, err = exportAnswers(ctx, "user = ?", user.UserName); err != nil {
+			return err
+		}
+		data.Comments = []exportComment{}
+		if err := queryList(ctx, `select id, post_type, post_id, body, coalesce(date, ''), coalesce(time, ''), coalesce(edited_at, ''), coalesce(hidden_at, '')
+			from comments where user = ? order by id`, []interface{}{user.UserName}, func(rows *sql.Rows) error {
+			var c exportComment
+			err := rows.Scan(&c.ID, &c.PostType, &c.PostID, &c.Body, &c.Date, &c.Time, &c.EditedAt, &c.HiddenAt)
+			data.Comments = append(data.Comments, c)
+			return err
+		}); err != nil {
+			return err
+		}
+		if data.Votes, err = exportVotes(ctx, "user_id = ?", user.UniqueID); err != nil {
+			return err
+		}
+		data.Bookmarks = []exportBookmark{}
+		if err := queryList(ctx, "select question_id, created_at from bookmarks where user_id = ? order by created_at", []interface{}{user.UniqueID}, func(rows *sql.Rows) error {
+			var b exportBookmark
+			err := rows.Scan(&b.QuestionID, &b.CreatedAt)
+			data.Bookmarks = append(data.Bookmarks, b)
+			return err
+		}); err != nil {
+			return err
+		}
+		data.Subscriptions = []exportSubscription{}
+		if err := queryList(ctx, "select target_type, target, email, created_at from subscriptions where user_id = ? order by created_at", []interface{}{user.UniqueID}, func(rows *sql.Rows) error {
+			var s exportSubscription
+			err := rows.Scan(&s.TargetType, &s.Target, &s.Email, &s.CreatedAt)
+			data.Subscriptions = append(data.Subscriptions, s)
+			return err
+		}); err != nil {
+			return err
+		}
+		data.Messages = []exportMessage{}
+		if err := queryList(ctx, `select users.username, messages.sender_id = ?1, messages.body, messages.created_at
+			from messages join conversations on conversations.id = messages.conversation_id
+			join users on users.id = case conversations.user_a when ?1 then conversations.user_b else conversations.user_a end
+			where ?1 in (conversations.user_a, conversations.user_b) order by messages.id`, []interface{}{user.UniqueID}, func(rows *sql.Rows) error {
+			var m exportMessage
+			err := rows.Scan(&m.With, &m.Sent, &m.Body, &m.CreatedAt)
+			data.Messages = append(data.Messages, m)
+			return err
+		}); err != nil {
+			return err
+		}
+		if data.Courses, err = userCourses(ctx, user); err != nil {
+			return err
+		}
+		if data.Courses == nil {
+			data.Courses = []course{}
+		}
+		data.Deletion, err = pendingDeletion(ctx, user.UniqueID)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+// queryList runs the query, calling scan on each row
+func queryList(ctx context.Context, query string, args []interface{}, scan func(*sql.Rows) error) error {
+	rows, err := db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		if err := scan(rows.Rows); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+// pendingDeletion is the deletion the user asked for, nil if there is none
+func pendingDeletion(ctx context.Context, userID int) (*exportDeletionStatus, error) {
+	var d exportDeletionStatus
+	err := db.QueryRowContext(ctx, "select requested_at, delete_at from account_deletions where user_id = ?", userID).Scan(&d.RequestedAt, &d.DeleteAt)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &d, nil
+}
+
+// requestDeletion schedules the deletion of the account after the grace period, and logs the
+// user out everywhere
+func requestDeletion(ctx context.Context, userID int) error {
+	now := time.Now()
+	deleteAt := now.Add(deletionGracePeriod())
+	err := db.WithTx(ctx, func(ctx context.Context) error {
+		_, err := db.ExecContext(ctx, "insert or replace into account_deletions (user_id, requested_at, delete_at) values (?, ?, ?)",
+			userID, now.Format(timestampLayout), deleteAt.Format(timestampLayout))
+		if err != nil {
+			return err
+		}
+		if err := revokeRememberTokens(ctx, userID); err != nil {
+			return err
+		}
+		return enqueueJobAt(ctx, "delete-account", userID, deleteAt)
+	})
+	if err != nil {
+		return err
+	}
+	return sessions.DeleteUser(ctx, userID)
+}
+
+// deleteAccountJob deletes an account whose grace period is over, unless the deletion was
+// cancelled
+func deleteAccountJob(ctx context.Context, payload []byte) error {
+	var userID int
+	if err := json.Unmarshal(payload, &userID); err != nil {
+		return err
+	}
+	var n int
+	err := db.QueryRowContext(ctx, "select count(*) from account_deletions where user_id = ? and delete_at <= ?",
+		userID, time.Now().Format(timestampLayout)).Scan(&n)
+	if err != nil || n == 0 {
+		return err
+	}
+	return deleteAccount(ctx, userID)
+}
+
+// deletedUser is the id of the "deleted" user, created the first time it is needed
+func deletedUser(ctx context.Context) (int, error) {
+	_, err := db.ExecContext(ctx, `insert into users (username, first_name, last_name, password, user_type, super_user)
+		select ?, 'Deleted', 'user', '', 'student', false where not exists (select 1 from users where username = ?)`,
+		deletedUserName, deletedUserName)
+	if err != nil {
+		return 0, err
+	}
+	var id int
+	err = db.QueryRowContext(ctx, "select id from users where username = ?", deletedUserName).Scan(&id)
+	return id, err
+}
+
+// deleteAccount removes the personal data of the user. Their posts, images, attachments, bounties
+// and tag wiki edits go to the "deleted" user, with their votes, so that scores don't change
+func deleteAccount(ctx context.Context, userID int) error {
+	err := db.WithTx(ctx, func(ctx context.Context) error {
+		var name, email string
+		err := db.QueryRowContext(ctx, "select username, coalesce(email, '') from users where id = ?", userID).Scan(&name, &email)
+		if err == sql.ErrNoRows {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		ghost, err := deletedUser(ctx)
+		if err != nil {
+			return err
+		}
+		for _, table := range []string{"questions", "answers", "comments"} {
+			if _, err := db.ExecContext(ctx, "update "+table+" set user = ? where user = ?", deletedUserName, name); err != nil {
+				return err
+			}
+		}
+		reassign := []string{
+			"update images set user_id = ? where user_id = ?",
+			"update attachments set user_id = ? where user_id = ?",
+			"update bounties set user_id = ? where user_id = ?",
+			"update bounties set awarded_to = ? where awarded_to = ?",
+			"update tag_revisions set user_id = ? where user_id = ?",
+			"update announcements set user_id = ? where user_id = ?",
+			"update courses set user_id = ? where user_id = ?",
+			"update question_templates set user_id = ? where user_id = ?",
+			// the votes the deleted user already has on the same posts are lost
+			"update or ignore votes set user_id = ? where user_id = ?",
+		}
+		for _, stmt := range reassign {
+			if _, err := db.ExecContext(ctx, stmt, ghost, userID); err != nil {
+				return err
+			}
+		}
+		remove := []string{
+			"delete from username_history where user_id = ?",
+			"delete from changelog_reads where user_id = ?",
+			"update changelog set user_id = null where user_id = ?",
+			"delete from bookmarks where user_id = ?",
+			"delete from notifications where user_id = ?",
+			"delete from subscriptions where user_id = ?",
+			"delete from course_members where user_id = ?",
+			"delete from user_mutes where user_id = ? or muted_id = ?1",
+			"delete from sanctions where user_id = ?",
+			"update sanctions set created_by = null where created_by = ?",
+			"delete from flags where user_id = ?",
+			"update flags set resolved_by = null where resolved_by = ?",
+			"delete from drafts where user_id = ?",
+			"delete from edit_leases where user_id = ?",
+			"delete from held_emails where user_id = ?",
+			"delete from activity where user_id = ?",
+			"delete from user_preferences where user_id = ?",
+			"delete from question_views where viewer = 'user:' || ?",
+			// the rest goes with the user: badges, mentions, signups, two-factor and remember-me
+			// secrets, invite codes, welcome links, LMS and single sign-on identities, conversations and the deletion itself
+			"delete from users where id = ?",
+		}
+		for _, stmt := range remove {
+			if _, err := db.ExecContext(ctx, stmt, userID); err != nil {
+				return fmt.Errorf("%s: %w", stmt, err)
+			}
+		}
+		if email != "" {
+			if _, err := db.ExecContext(ctx, "delete from email_suppressions where email = ?", email); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	// the name is on the pages of every thread the user took part in
+	questionCache.clear()
+	return sessions.DeleteUser(ctx, userID)
+}
+
+// accountPage is the data of the account settings page
+type accountPage struct {
+	Deletion  *exportDeletionStatus // pending deletion, nil if there is none
+	GraceDays int
+	Error     string
+}
+
+// serve /settings/account, where users download their data and delete their account
+func serveAccountSettings(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	user := requireUser(w, r)
+	if user == nil {
+		return
+	}
+	p := accountPage{GraceDays: int(deletionGracePeriod() / (24 * time.Hour))}
+	if r.Method == http.MethodPost {
+		switch r.FormValue("action") {
+		case "delete":
+			if bcrypt.CompareHashAndPassword([]byte(user.Password), []byte(r.FormValue("password"))) != nil {
+				p.Error = "wrong password"
+				break
+			}
+			if err := requestDeletion(ctx, user.UniqueID); err != nil {
+				serverError(w, r, err)
+				return
+			}
+			http.SetCookie(w, &http.Cookie{Name: sessionCookie, Value: "", Path: "/", MaxAge: -1})
+			http.SetCookie(w, &http.Cookie{Name: rememberCookie, Value: "", Path: "/", MaxAge: -1})
+			http.Redirect(w, r, "/", http.StatusSeeOther)
+			return
+		case "cancel":
+			if _, err := db.ExecContext(ctx, "delete from account_deletions where user_id = ?", user.UniqueID); err != nil {
+				serverError(w, r, err)
+				return
+			}
+			http.Redirect(w, r, "/settings/account", http.StatusSeeOther)
+			return
+		}
+	}
+	var err error
+	if p.Deletion, err = pendingDeletion(ctx, user.UniqueID); err != nil {
+		serverError(w, r, err)
+		return
+	}
+	render(w, r, "account.html", p)
+}
+
+// serve /settings/account/export, all the data of the user as a download
+func serveAccountExport(w http.ResponseWriter, r *http.Request) {
+	user := requireUser(w, r)
+	if user == nil {
+		return
+	}
+	data, err := exportPersonalData(r.Context(), user)
+	if err != nil {
+		serverError(w, r, err)
+		return
+	}
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s-%s.json"`, user.UserName, time.Now().Format(dateLayout)))
+	writeJSON(w, http.StatusOK, data)
+}
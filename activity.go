@@ -0,0 +1,117 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// what users do is recorded in the activity table: asking, answering, editing and voting.
+// the global /activity stream and the activity tab of profiles show it, leaving out the posts
+// the viewer can't see. Votes stay private, only their author sees them
+
+// kinds of activity
+const (
+	activityAsked    = "asked"
+	activityAnswered = "answered"
+	activityEdited   = "edited"
+	activityVoted    = "voted"
+)
+
+// number of events on a page of activity
+const activityPerPage = 30
+
+// activityEvent is an entry of an activity stream
+type activityEvent struct {
+	Kind       string
+	PostType   string
+	PostID     int
+	QuestionID int
+	Detail     string // "up" or "down" for votes
+	Created    string
+	User       string
+	Heading    string // of the question of the post
+}
+
+// recordActivity adds an event of the user on a post of the question
+func recordActivity(ctx context.Context, userID int, kind, postType string, postID, questionID int, detail string) error {
+	_, err := db.ExecContext(ctx, "insert into activity (user_id, kind, post_type, post_id, question_id, detail, created_at) values (?, ?, ?, ?, ?, ?, ?)",
+		userID, kind, postType, postID, questionID, detail, time.Now().Format(timestampLayout))
+	return err
+}
+
+// activityOf loads a page of the events the viewer can see, newest first, of everyone when member is nil
+func activityOf(ctx context.Context, viewer, member *User, limit, offset int) ([]activityEvent, error) {
+	filter, args, err := questionFilter(ctx, viewer)
+	if err != nil {
+		return nil, err
+	}
+	viewerID := 0
+	if viewer != nil {
+		viewerID = viewer.UniqueID
+	}
+	query := `select activity.kind, activity.post_type, activity.post_id, activity.question_id, activity.detail,
+		activity.created_at, users.username, questions.heading
+		from activity join users on users.id = activity.user_id join questions on questions.id = activity.question_id
+		where ` + filter + ` and (activity.kind != ? or activity.user_id = ?)
+		and (? or activity.post_type != ? or activity.post_id not in (select id from answers where hidden_at is not null))
+		and (? or activity.user_id = ? or activity.post_type != ? or not questions.is_anonymous or lower(users.username) != lower(questions.user))`
+	args = append(args, activityVoted, viewerID, isModerator(viewer), postAnswer, seesAnonymousAuthors(viewer), viewerID, postQuestion)
+	if member != nil {
+		query += " and activity.user_id = ?"
+		args = append(args, member.UniqueID)
+	} else {
+		// the activity of everyone leaves out the users the viewer muted
+		query += " and activity.user_id not in (select muted_id from user_mutes where user_id = ?)"
+		args = append(args, viewerID)
+	}
+	rows, err := db.QueryContext(ctx, query+" order by activity.id desc limit ? offset ?", append(args, limit, offset)...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var events []activityEvent
+	for rows.Next() {
+		var e activityEvent
+		if err := rows.Scan(&e.Kind, &e.PostType, &e.PostID, &e.QuestionID, &e.Detail, &e.Created, &e.User, &e.Heading); err != nil {
+			return nil, err
+		}
+		events = append(events, e)
+	}
+	return events, rows.Err()
+}
+
+// activityPage is the data of the activity page, of everyone or of a member
+type activityPage struct {
+	Member   *User // nil for the activity of everyone
+	Events   []activityEvent
+	PrevPage int // 0 on the first page
+	NextPage int // 0 on the last page
+}
+
+// serveActivityPage renders a page of activity, of everyone when member is nil, paginated with the page parameter
+func serveActivityPage(w http.ResponseWriter, r *http.Request, member *User) {
+	ctx := r.Context()
+	pageNum, err := strconv.Atoi(r.URL.Query().Get("page"))
+	if err != nil || pageNum < 1 {
+		pageNum = 1
+	}
+	// one more event than shown tells if there is a next page
+	events, err := activityOf(ctx, currentUser(r), member, activityPerPage+1, (pageNum-1)*activityPerPage)
+	if err != nil {
+		serverError(w, r, err)
+		return
+	}
+	p := activityPage{Member: member, Events: events, PrevPage: pageNum - 1}
+	if len(events) > activityPerPage {
+		p.Events = events[:activityPerPage]
+		p.NextPage = pageNum + 1
+	}
+	render(w, r, "activity.html", p)
+}
+
+// serve /activity, what everyone did lately
+func serveActivity(w http.ResponseWriter, r *http.Request) {
+	serveActivityPage(w, r, nil)
+}
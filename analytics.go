@@ -0,0 +1,434 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// teachers follow their courses on /dashboard: what each student asked, answered and commented,
+// and the endorsements they received, upvotes and accepted answers, then the questions still
+// waiting for an answer, the tags students struggle with and the activity day by day. Teachers
+// see the courses they teach, moderators any course and the whole site. Everything is counted in
+// SQL and drawn here, the charts being plain SVG
+
+// periods of the dashboard, in days
+var dashboardPeriods = []int{7, 30, 90, 365}
+
+// analyticsScope is what the dashboard counts: the questions of a course, or of the whole site
+// when Course is 0, and what happened on them between From and To, both included
+type analyticsScope struct {
+	Course int
+	From   string // in dateLayout
+	To     string
+}
+
+// questions is a condition on the questions table keeping those of the scope
+func (s analyticsScope) questions() (string, []interface{}) {
+	if s.Course == 0 {
+		return "true", nil
+	}
+	return "questions.course_id = ?", []interface{}{s.Course}
+}
+
+// students is a query of the ids and usernames of the students of the scope
+func (s analyticsScope) students() (string, []interface{}) {
+	if s.Course == 0 {
+		return `select id, username from users where (',' || replace(lower(coalesce(user_type, '')), ' ', '') || ',') like '%,student,%'`, nil
+	}
+	return `select users.id, users.username from course_members join users on users.id = course_members.user_id
+		where course_members.course_id = ? and course_members.role = 'student'`, []interface{}{s.Course}
+}
+
+// participation is what a student did in the scope
+type participation struct {
+	UserName   string
+	Name       string
+	Email      string
+	Questions  int
+	Answers    int
+	Comments   int
+	Upvotes    int // on their questions and answers
+	Accepted   int // of their answers
+	LastActive string
+}
+
+// participationOf counts what each student of the scope did, the most active first
+func participationOf(ctx context.Context, s analyticsScope) ([]participation, error) {
+	students, studentArgs := s.students()
+	scope, scopeArgs := s.questions()
+	byName := map[string]*participation{}
+	var list []*participation
+	err := queryList(ctx, `select users.username, trim(coalesce(users.first_name, '') || ' ' || coalesce(users.last_name, '')), coalesce(users.email, '')
+		from users where users.id in (select id from (`+students+`))`, studentArgs, func(rows *sql.Rows) error {
+		p := &participation{}
+		if err := rows.Scan(&p.UserName, &p.Name, &p.Email); err != nil {
+			return err
+		}
+		byName[p.UserName] = p
+		list = append(list, p)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// each metric is counted by username, with the dates of the period, then the scope
+	period := []interface{}{s.From, s.To}
+	args := append(append(append([]interface{}{}, studentArgs...), period...), scopeArgs...)
+	metrics := []struct {
+		query string
+		count func(p *participation, n int, last string)
+	}{
+		{`select questions.user, count(*), max(questions.date) from questions
+			where questions.user in (select username from (` + students + `)) and questions.date between ? and ? and ` + scope + `
+			group by questions.user`,
+			func(p *participation, n int, last string) {
+				p.Questions = n
+				p.LastActive = maxString(p.LastActive, last)
+			}},
+		{`select answers.user, count(*), max(answers.date) from answers join questions on questions.id = answers.question_id
+			where answers.user in (select username from (` + students + `)) and answers.date between ? and ? and ` + scope + `
+			group by answers.user`,
+			func(p *participation, n int, last string) {
+				p.Answers = n
+				p.LastActive = maxString(p.LastActive, last)
+			}},
+		{`select comments.user, count(*), max(comments.date) from comments
+			left join answers on comments.post_type = 'answer' and answers.id = comments.post_id
+			join questions on questions.id = case comments.post_type when 'question' then comments.post_id else answers.question_id end
+			where comments.user in (select username from (` + students + `)) and comments.date between ? and ? and ` + scope + `
+			group by comments.user`,
+			func(p *participation, n int, last string) {
+				p.Comments = n
+				p.LastActive = maxString(p.LastActive, last)
+			}},
+		{`select coalesce(answers.user, questions.user), count(*), '' from votes
+			left join answers on votes.post_type = 'answer' and answers.id = votes.post_id
+			join questions on questions.id = case votes.post_type when 'question' then votes.post_id else answers.question_id end
+			where votes.post_type in ('question', 'answer') and votes.value > 0
+				and coalesce(answers.user, questions.user) in (select username from (` + students + `))
+				and substr(votes.voted_at, 1, 10) between ? and ? and ` + scope + `
+			group by coalesce(answers.user, questions.user)`,
+			func(p *participation, n int, _ string) { p.Upvotes = n }},
+		{`select answers.user, count(*), '' from answers join questions on questions.accepted_id = answers.id
+			where answers.user in (select username from (` + students + `)) and substr(questions.accepted_at, 1, 10) between ? and ? and ` + scope + `
+			group by answers.user`,
+			func(p *participation, n int, _ string) { p.Accepted = n }},
+	}
+	for _, m := range metrics {
+		err := queryList(ctx, m.query, args, func(rows *sql.Rows) error {
+			var name, last string
+			var n int
+			if err := rows.Scan(&name, &n, &last); err != nil {
+				return err
+			}
+			if p := byName[name]; p != nil {
+				m.count(p, n, last)
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	sort.SliceStable(list, func(i, j int) bool {
+		a, b := list[i], list[j]
+		if a.Questions+a.Answers+a.Comments != b.Questions+b.Answers+b.Comments {
+			return a.Questions+a.Answers+a.Comments > b.Questions+b.Answers+b.Comments
+		}
+		return strings.ToLower(a.UserName) < strings.ToLower(b.UserName)
+	})
+	result := make([]participation, len(list))
+	for i, p := range list {
+		result[i] = *p
+	}
+	return result, nil
+}
+
+func maxString(a, b string) string {
+	if b > a {
+		return b
+	}
+	return a
+}
+
+// tagConfusion is how a tag fares in the scope, the tags whose questions stay unanswered first
+type tagConfusion struct {
+	Tag        string
+	Questions  int
+	Unanswered int
+}
+
+// unansweredQuestion is a question of the scope without any answer
+type unansweredQuestion struct {
+	ID      int
+	Heading string
+	Date    string
+}
+
+// chartBar is a bar of a chart, in the coordinates of its SVG
+type chartBar struct {
+	X, Y, Width, Height int
+	Title               string
+}
+
+// activityChart is the activity of a period, a group of bars for each day or week
+type activityChart struct {
+	Width, Height int
+	Questions     []chartBar
+	Answers       []chartBar
+	Comments      []chartBar
+	Labels        []chartBar // the first bucket and then every few, Title being the date
+	Max           int
+}
+
+// size of the activity chart
+const (
+	chartWidth  = 720
+	chartHeight = 160
+)
+
+// activityOverTime counts the questions, answers and comments of the scope by day, or by week
+// over more than 60 days, and draws them as bars
+func activityOverTime(ctx context.Context, s analyticsScope) (activityChart, error) {
+	from, err := time.ParseInLocation(dateLayout, s.From, time.Local)
+	if err != nil {
+		return activityChart{}, err
+	}
+	to, err := time.ParseInLocation(dateLayout, s.To, time.Local)
+	if err != nil {
+		return activityChart{}, err
+	}
+	step := 1
+	if to.Sub(from) > 60*24*time.Hour {
+		step = 7
+	}
+	var buckets []string // first day of each
+	for d := from; !d.After(to); d = d.AddDate(0, 0, step) {
+		buckets = append(buckets, d.Format(dateLayout))
+	}
+	bucketOf := func(date string) int {
+		i := sort.SearchStrings(buckets, date)
+		if i == len(buckets) || buckets[i] != date {
+			i--
+		}
+		return i
+	}
+
+	scope, scopeArgs := s.questions()
+	args := append([]interface{}{s.From, s.To}, scopeArgs...)
+	counts := make([][3]int, len(buckets))
+	queries := []string{
+		"select questions.date, count(*) from questions where questions.date between ? and ? and " + scope + " group by questions.date",
+		"select answers.date, count(*) from answers join questions on questions.id = answers.question_id where answers.date between ? and ? and " + scope + " group by answers.date",
+		`select comments.date, count(*) from comments left join answers on comments.post_type = 'answer' and answers.id = comments.post_id
+			join questions on questions.id = case comments.post_type when 'question' then comments.post_id else answers.question_id end
+			where comments.date between ? and ? and ` + scope + " group by comments.date",
+	}
+	for kind, query := range queries {
+		err := queryList(ctx, query, args, func(rows *sql.Rows) error {
+			var date string
+			var n int
+			if err := rows.Scan(&date, &n); err != nil {
+				return err
+			}
+			if i := bucketOf(date); i >= 0 {
+				counts[i][kind] += n
+			}
+			return nil
+		})
+		if err != nil {
+			return activityChart{}, err
+		}
+	}
+
+	chart := activityChart{Width: chartWidth, Height: chartHeight + 20, Max: 1}
+	for _, c := range counts {
+		for _, n := range c {
+			if n > chart.Max {
+				chart.Max = n
+			}
+		}
+	}
+	slot := chartWidth / len(buckets)
+	bar := slot / 3
+	if bar < 1 {
+		bar = 1
+	}
+	unit := "day"
+	if step == 7 {
+		unit = "week of"
+	}
+	for i, c := range counts {
+		x := i * slot
+		for kind, series := range []*[]chartBar{&chart.Questions, &chart.Answers, &chart.Comments} {
+			h := c[kind] * chartHeight / chart.Max
+			title := fmt.Sprintf("%s %s: %d %s", unit, buckets[i], c[kind], []string{"questions", "answers", "comments"}[kind])
+			*series = append(*series, chartBar{X: x + kind*bar, Y: chartHeight - h, Width: bar, Height: h, Title: title})
+		}
+		if i%(len(buckets)/6+1) == 0 {
+			chart.Labels = append(chart.Labels, chartBar{X: x, Y: chartHeight + 14, Title: buckets[i][5:]})
+		}
+	}
+	return chart, nil
+}
+
+// dashboardPage is the data of the dashboard
+type dashboardPage struct {
+	Courses      []course // those the user can look at
+	Course       int      // 0 for the whole site
+	SiteWide     bool     // the user can look at the whole site
+	Days         int
+	Periods      []int
+	From, To     string
+	Students     []participation
+	Unanswered   []unansweredQuestion
+	Tags         []tagConfusion
+	Activity     activityChart
+	TotalAsked   int
+	TotalAnswers int
+	Columns      []string // of the CSV export, see participation.go
+}
+
+// dashboardDays is the length of the period of a request, 30 days by default
+func dashboardDays(r *http.Request) int {
+	days, _ := strconv.Atoi(r.FormValue("days"))
+	if days <= 0 || days > 366 {
+		return 30
+	}
+	return days
+}
+
+// dashboardScope reads the course and the period of a request, checking the user may look at
+// them. The courses the user can look at are returned with it, nil when they can look at none
+func dashboardScope(ctx context.Context, r *http.Request, user *User) (analyticsScope, []course, bool, error) {
+	var courses []course
+	var err error
+	if isModerator(user) {
+		err = queryList(ctx, "select id, name from courses order by name, id", nil, func(rows *sql.Rows) error {
+			var c course
+			err := rows.Scan(&c.ID, &c.Name)
+			courses = append(courses, c)
+			return err
+		})
+	} else {
+		var all []course
+		all, err = userCourses(ctx, user)
+		for _, c := range all {
+			if c.Role == courseTeacher {
+				courses = append(courses, c)
+			}
+		}
+	}
+	if err != nil {
+		return analyticsScope{}, nil, false, err
+	}
+
+	s := analyticsScope{}
+	s.Course, _ = strconv.Atoi(r.FormValue("course"))
+	allowed := s.Course == 0 && isModerator(user)
+	for _, c := range courses {
+		allowed = allowed || c.ID == s.Course
+	}
+	if !allowed {
+		if len(courses) == 0 || r.FormValue("course") != "" {
+			return s, courses, false, nil
+		}
+		s.Course = courses[0].ID
+	}
+
+	now := time.Now()
+	s.From, s.To = now.AddDate(0, 0, 1-dashboardDays(r)).Format(dateLayout), now.Format(dateLayout)
+	if from := r.FormValue("from"); from != "" {
+		if _, err := time.Parse(dateLayout, from); err == nil {
+			s.From = from
+		}
+	}
+	if to := r.FormValue("to"); to != "" {
+		if _, err := time.Parse(dateLayout, to); err == nil {
+			s.To = to
+		}
+	}
+	if s.To < s.From {
+		s.From, s.To = s.To, s.From
+	}
+	return s, courses, true, nil
+}
+
+// serve /dashboard, the participation of the students of a course over a period
+func serveDashboard(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	user := requireUser(w, r)
+	if user == nil {
+		return
+	}
+	if !staff(user) {
+		http.Error(w, "the dashboard is for teachers", http.StatusForbidden)
+		return
+	}
+	s, courses, ok, err := dashboardScope(ctx, r, user)
+	if err != nil {
+		serverError(w, r, err)
+		return
+	}
+	if !ok {
+		if len(courses) == 0 {
+			http.Error(w, "you don't teach any course yet, create one on /courses", http.StatusForbidden)
+		} else {
+			http.Error(w, "you don't teach this course", http.StatusForbidden)
+		}
+		return
+	}
+	p := dashboardPage{Courses: courses, Course: s.Course, SiteWide: isModerator(user), Days: dashboardDays(r), Periods: dashboardPeriods, From: s.From, To: s.To}
+
+	if p.Students, err = participationOf(ctx, s); err != nil {
+		serverError(w, r, err)
+		return
+	}
+	scope, scopeArgs := s.questions()
+	err = queryList(ctx, `select questions.id, questions.heading, questions.date from questions
+		where questions.hidden_at is null and `+scope+` and not exists (select 1 from answers where answers.question_id = questions.id)
+		order by questions.date, questions.id limit 20`, scopeArgs, func(rows *sql.Rows) error {
+		var q unansweredQuestion
+		err := rows.Scan(&q.ID, &q.Heading, &q.Date)
+		p.Unanswered = append(p.Unanswered, q)
+		return err
+	})
+	if err != nil {
+		serverError(w, r, err)
+		return
+	}
+	err = queryList(ctx, `select tags.name, count(*),
+			sum(not exists (select 1 from answers where answers.question_id = questions.id))
+		from questions join question_tags on question_tags.question_id = questions.id join tags on tags.id = question_tags.tag_id
+		where questions.date between ? and ? and `+scope+`
+		group by tags.name order by 3 desc, 2 desc, tags.name limit 10`, append([]interface{}{s.From, s.To}, scopeArgs...), func(rows *sql.Rows) error {
+		var t tagConfusion
+		err := rows.Scan(&t.Tag, &t.Questions, &t.Unanswered)
+		p.Tags = append(p.Tags, t)
+		return err
+	})
+	if err != nil {
+		serverError(w, r, err)
+		return
+	}
+	if p.Activity, err = activityOverTime(ctx, s); err != nil {
+		serverError(w, r, err)
+		return
+	}
+	for _, c := range participationColumns {
+		p.Columns = append(p.Columns, c.Name)
+	}
+	for _, st := range p.Students {
+		p.TotalAsked += st.Questions
+		p.TotalAnswers += st.Answers
+	}
+	render(w, r, "dashboard.html", p)
+}
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// teachers and moderators post announcements on /announcements, pinned on top of the question
+// list, or of the page of a tag, until they expire. Each user can dismiss an announcement, which
+// is kept in the database so it stays dismissed on their other devices
+
+// longest title and body of an announcement, in bytes
+const (
+	maxAnnouncementTitle  = 200
+	maxAnnouncementLength = 5000
+)
+
+// furthest an announcement can expire, in days
+const maxAnnouncementDays = 365
+
+// announcement is an announcement pinned on the question list, or on the page of its tag
+type announcement struct {
+	ID      int
+	Title   string
+	Body    string
+	Tag     string // empty on the question list
+	Author  string
+	Created string
+	Expires string
+	CanEdit bool // the user can delete it
+}
+
+// announcementColumns are the columns scanned by scanAnnouncement
+const announcementColumns = `announcements.id, announcements.title, announcements.body, announcements.tag,
+	users.username, announcements.created_at, announcements.expires_at, announcements.user_id`
+
+// scanAnnouncement scans an announcement, which the user can delete if they wrote it or moderate
+func scanAnnouncement(row scanner, user *User) (announcement, error) {
+	var a announcement
+	var authorID int
+	err := row.Scan(&a.ID, &a.Title, &a.Body, &a.Tag, &a.Author, &a.Created, &a.Expires, &authorID)
+	a.CanEdit = user != nil && (user.UniqueID == authorID || isModerator(user))
+	return a, err
+}
+
+// activeAnnouncements are the announcements of the tag, or of the question list when the tag is
+// empty, that haven't expired nor been dismissed by the user, the latest first
+func activeAnnouncements(ctx context.Context, user *User, tag string) ([]announcement, error) {
+	userID := 0
+	if user != nil {
+		userID = user.UniqueID
+	}
+	rows, err := db.QueryContext(ctx, `select `+announcementColumns+`
+		from announcements join users on users.id = announcements.user_id
+		where announcements.tag = ? and announcements.expires_at > ?
+			and not exists (select 1 from announcement_dismissals where announcement_id = announcements.id and user_id = ?)
+		order by announcements.id desc`, tag, time.Now().Format(timestampLayout), userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var list []announcement
+	for rows.Next() {
+		a, err := scanAnnouncement(rows, user)
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, a)
+	}
+	return list, rows.Err()
+}
+
+// announcementsPage is the data of the announcements page
+type announcementsPage struct {
+	Announcements []announcement
+	Title         string
+	Body          string
+	Tag           string
+	Expires       string
+	Error         string
+}
+
+// serve /announcements, where teachers and moderators post announcements and see the ones that
+// haven't expired
+func serveAnnouncements(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	user := requireUser(w, r)
+	if user == nil {
+		return
+	}
+	if !staff(user) {
+		http.Error(w, "only teachers and moderators can post announcements", http.StatusForbidden)
+		return
+	}
+	p := announcementsPage{Expires: time.Now().AddDate(0, 0, 7).Format(dateLayout)}
+
+	if r.Method == http.MethodPost {
+		p.Title = strings.TrimSpace(r.FormValue("title"))
+		p.Body = strings.TrimSpace(r.FormValue("body"))
+		p.Tag = strings.ToLower(strings.TrimSpace(r.FormValue("tag")))
+		p.Expires = r.FormValue("expires")
+		expires, err := time.ParseInLocation(dateLayout, p.Expires, time.Local)
+		today := time.Now().Format(dateLayout)
+		switch {
+		case p.Title == "":
+			p.Error = "the title is missing"
+		case len(p.Title) > maxAnnouncementTitle || len(p.Body) > maxAnnouncementLength:
+			p.Error = "the announcement is too long"
+		case err != nil:
+			p.Error = "the expiry date isn't a date"
+		case p.Expires < today:
+			p.Error = "the expiry date is in the past"
+		case expires.After(time.Now().AddDate(0, 0, maxAnnouncementDays)):
+			p.Error = "announcements last at most a year"
+		}
+		if p.Error == "" && p.Tag != "" {
+			if p.Tag, err = canonicalTag(ctx, p.Tag); err != nil {
+				serverError(w, r, err)
+				return
+			}
+		}
+		if p.Error == "" {
+			// the announcement shows until the end of its expiry date
+			_, err := db.ExecContext(ctx, "insert into announcements (title, body, tag, user_id, created_at, expires_at) values (?, ?, ?, ?, ?, ?)",
+				p.Title, p.Body, p.Tag, user.UniqueID, time.Now().Format(timestampLayout), expires.AddDate(0, 0, 1).Add(-time.Second).Format(timestampLayout))
+			if err != nil {
+				serverError(w, r, err)
+				return
+			}
+			http.Redirect(w, r, "/announcements", http.StatusSeeOther)
+			return
+		}
+	}
+
+	rows, err := db.QueryContext(ctx, `select `+announcementColumns+`
+		from announcements join users on users.id = announcements.user_id
+		where announcements.expires_at > ? order by announcements.expires_at`, time.Now().Format(timestampLayout))
+	if err != nil {
+		serverError(w, r, err)
+		return
+	}
+	defer rows.Close()
+	for rows.Next() {
+		a, err := scanAnnouncement(rows, user)
+		if err != nil {
+			serverError(w, r, err)
+			return
+		}
+		p.Announcements = append(p.Announcements, a)
+	}
+	if err := rows.Err(); err != nil {
+		serverError(w, r, err)
+		return
+	}
+	render(w, r, "announcements.html", p)
+}
+
+// serve /announcements/{id}/dismiss, hiding an announcement from the user, and
+// /announcements/{id}/delete, removing it for everyone
+func serveAnnouncementAction(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	rawID, action, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/announcements/"), "/")
+	id, err := strconv.Atoi(rawID)
+	if err != nil || (action != "dismiss" && action != "delete") {
+		http.NotFound(w, r)
+		return
+	}
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	user := requireUser(w, r)
+	if user == nil {
+		return
+	}
+	row := db.QueryRowContext(ctx, `select `+announcementColumns+`
+		from announcements join users on users.id = announcements.user_id where announcements.id = ?`, id)
+	a, err := scanAnnouncement(row, user)
+	if err == sql.ErrNoRows {
+		http.NotFound(w, r)
+		return
+	}
+	if err != nil {
+		serverError(w, r, err)
+		return
+	}
+
+	if action == "delete" {
+		if !a.CanEdit {
+			http.Error(w, "you can't delete this announcement", http.StatusForbidden)
+			return
+		}
+		if _, err := db.ExecContext(ctx, "delete from announcements where id = ?", id); err != nil {
+			serverError(w, r, err)
+			return
+		}
+		http.Redirect(w, r, "/announcements", http.StatusSeeOther)
+		return
+	}
+
+	_, err = db.ExecContext(ctx, "insert or ignore into announcement_dismissals (announcement_id, user_id) values (?, ?)", id, user.UniqueID)
+	if err != nil {
+		serverError(w, r, err)
+		return
+	}
+	back := "/questions"
+	if a.Tag != "" {
+		back = "/tags/" + url.PathEscape(a.Tag)
+	}
+	http.Redirect(w, r, back, http.StatusSeeOther)
+}
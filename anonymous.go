@@ -0,0 +1,117 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// students can ask anonymously in the tags whose policy allows it, like the tag of a class: other
+// students see the question as asked by Anonymous, while its author, teachers and moderators still
+// see who asked. Pages, feeds, search, the API and notifications all hide the author, and the
+// profile and the activity of the author leave the question out
+
+// name shown for the author of an anonymous question
+const anonymousName = "Anonymous"
+
+// hasUserType tells if the user is of the type, like teacher
+func hasUserType(user *User, userType string) bool {
+	if user == nil {
+		return false
+	}
+	for _, t := range user.UserType {
+		if strings.EqualFold(t, userType) {
+			return true
+		}
+	}
+	return false
+}
+
+// seesAnonymousAuthors tells if the user sees who asked the anonymous questions
+func seesAnonymousAuthors(user *User) bool {
+	return isModerator(user) || hasUserType(user, "teacher")
+}
+
+// maskAuthor empties the author of an anonymous question the user can't know the author of
+func maskAuthor(q *Question, user *User) {
+	if q.QnAnonymous && !seesAnonymousAuthors(user) && (user == nil || !strings.EqualFold(user.UserName, q.QnUser)) {
+		q.QnUser = ""
+	}
+}
+
+// anonymousFilter is a condition on questions leaving out the anonymous questions whose author the
+// user can't know, for lists of the questions of an author
+func anonymousFilter(user *User) (string, []interface{}) {
+	if seesAnonymousAuthors(user) {
+		return "true", nil
+	}
+	if user == nil {
+		return "not questions.is_anonymous", nil
+	}
+	return "(not questions.is_anonymous or lower(questions.user) = lower(?))", []interface{}{user.UserName}
+}
+
+// authorName is the name of the author of a question to tell others, like in notifications
+func authorName(user *User, anonymous bool) string {
+	if anonymous {
+		return anonymousName
+	}
+	return user.UserName
+}
+
+// anonymousAllowed tells if one of the tags lets students ask anonymously
+func anonymousAllowed(ctx context.Context, tags []string) (bool, error) {
+	if len(tags) == 0 {
+		return false, nil
+	}
+	args := make([]interface{}, len(tags))
+	for i, t := range tags {
+		args[i] = strings.ToLower(t)
+	}
+	var n int
+	err := db.QueryRowContext(ctx, "select count(*) from tags where allow_anonymous and name in ("+placeholders(len(args))+")", args...).Scan(&n)
+	return n > 0, err
+}
+
+// tagAllowsAnonymous tells if the policy of the tag lets students ask anonymously
+func tagAllowsAnonymous(ctx context.Context, tag string) (bool, error) {
+	return anonymousAllowed(ctx, []string{tag})
+}
+
+// handle the anonymous policy form of a tag page, for teachers and moderators
+func serveTagAnonymous(w http.ResponseWriter, r *http.Request, tag string) {
+	ctx := r.Context()
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	user := requireUser(w, r)
+	if user == nil {
+		return
+	}
+	if !seesAnonymousAuthors(user) {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+	allow := r.FormValue("allow") == "1"
+	// the tag may only exist on its questions yet
+	err := db.WithTx(ctx, func(ctx context.Context) error {
+		before, err := tagAllowsAnonymous(ctx, tag)
+		if err != nil {
+			return err
+		}
+		if _, err := db.ExecContext(ctx, "insert or ignore into tags (name, desc) values (?, '')", tag); err != nil {
+			return err
+		}
+		if _, err := db.ExecContext(ctx, "update tags set allow_anonymous = ? where name = ?", allow, tag); err != nil {
+			return err
+		}
+		return recordAudit(ctx, user, auditTagAnonymous, "tag", tag, map[string]bool{"allow_anonymous": before}, map[string]bool{"allow_anonymous": allow})
+	})
+	if err != nil {
+		serverError(w, r, err)
+		return
+	}
+	http.Redirect(w, r, "/tags/"+url.PathEscape(tag), http.StatusSeeOther)
+}
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// columns selected for an answer, in the order expected by scanAnswer
+const answerColumns = "answers.id, body, date, time, user, views, question_id, edited_at, " + answerScoreSQL + ", answers.hidden_at is not null, " + answerWilsonSQL
+
+// score of an answer, from the votes table
+const answerScoreSQL = "(select coalesce(sum(value), 0) from votes where votes.post_type = 'answer' and votes.post_id = answers.id)"
+
+// Wilson score of an answer, from the votes table
+const answerWilsonSQL = "(select wilson(coalesce(sum(value > 0), 0), coalesce(sum(value < 0), 0)) from votes where votes.post_type = 'answer' and votes.post_id = answers.id)"
+
+// scan a row selected with answerColumns into an Answer
+func scanAnswer(row scanner) (Answer, error) {
+	var a Answer
+	var date, clock, user, edited sql.NullString
+	var views, qn sql.NullInt64
+	err := row.Scan(&a.AnsID, &a.AnsBody, &date, &clock, &user, &views, &qn, &edited, &a.AnsScore, &a.AnsHidden, &a.AnsWilson)
+	if err != nil {
+		return a, err
+	}
+	a.AnsDate = date.String
+	a.AnsTime = clock.String
+	a.AnsUser = user.String
+	a.AnsViews = int(views.Int64)
+	a.AnsQn = int(qn.Int64)
+	a.AnsEdited = edited.String
+	return a, nil
+}
+
+// load the answers of a question, best scored first
+func answersOf(ctx context.Context, questionID int) ([]Answer, error) {
+	rows, err := db.QueryContext(ctx, "select "+answerColumns+" from answers where question_id = ? order by "+answerScoreSQL+" desc, answers.id", questionID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var answers []Answer
+	for rows.Next() {
+		a, err := scanAnswer(rows)
+		if err != nil {
+			return nil, err
+		}
+		answers = append(answers, a)
+	}
+	return answers, rows.Err()
+}
+
+// load an answer by id, nil if there is none
+func answerByID(ctx context.Context, id int) (*Answer, error) {
+	a, err := scanAnswer(db.QueryRowContext(ctx, "select "+answerColumns+" from answers where answers.id = ?", id))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &a, nil
+}
+
+// acceptedAnswer returns the id of the answer accepted by the author of the question, 0 if none
+func acceptedAnswer(ctx context.Context, questionID int) (int, error) {
+	var id sql.NullInt64
+	err := db.QueryRowContext(ctx, "select accepted_id from questions where id = ?", questionID).Scan(&id)
+	if err == sql.ErrNoRows {
+		return 0, nil
+	}
+	return int(id.Int64), err
+}
+
+// handle POST /answers/{id}/accept, where the author of the question accepts the answer,
+// or takes the accept back with action=unaccept
+func serveAcceptAnswer(w http.ResponseWriter, r *http.Request, a *Answer) {
+	ctx := r.Context()
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	user := requireUser(w, r)
+	if user == nil {
+		return
+	}
+	q, err := questionByID(ctx, a.AnsQn)
+	if err != nil {
+		serverError(w, r, err)
+		return
+	}
+	if q == nil {
+		http.NotFound(w, r)
+		return
+	}
+	if q.QnUser != user.UserName {
+		http.Error(w, "only the author of the question can accept an answer", http.StatusForbidden)
+		return
+	}
+	if r.FormValue("action") == "unaccept" {
+		_, err = db.ExecContext(ctx, "update questions set accepted_id = null, accepted_at = null where id = ? and accepted_id = ?", q.QnID, a.AnsID)
+	} else {
+		_, err = db.ExecContext(ctx, "update questions set accepted_id = ?, accepted_at = ? where id = ?", a.AnsID, time.Now().Format(timestampLayout), q.QnID)
+		if err == nil {
+			err = recordAccept(ctx, q.QnID)
+		}
+		if err == nil {
+			err = emitAnswer(ctx, eventAnswerAccepted, a.AnsUser, q.QnID, a.AnsID)
+		}
+	}
+	if err != nil {
+		serverError(w, r, err)
+		return
+	}
+	http.Redirect(w, r, fmt.Sprintf("/questions/%d#answer-%d", q.QnID, a.AnsID), http.StatusSeeOther)
+}
+
+// handle POST /questions/{id}/answer
+func serveNewAnswer(w http.ResponseWriter, r *http.Request, questionID int) {
+	ctx := r.Context()
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	user := requireUser(w, r)
+	if user == nil || !requireOpenThread(w, r, user, questionID) || !requireUnclosed(w, r, questionID) ||
+		!requireAnswerable(w, r, user, questionID) {
+		return
+	}
+	q, err := questionByID(ctx, questionID)
+	if err != nil {
+		serverError(w, r, err)
+		return
+	}
+	if q == nil {
+		http.NotFound(w, r)
+		return
+	}
+	body := strings.TrimSpace(r.FormValue("body"))
+	if body == "" {
+		http.Error(w, "the answer can't be empty", http.StatusBadRequest)
+		return
+	}
+	check, ok := checkNewPost(w, r, draftPost{Type: postAnswer, User: user, Body: body})
+	if !ok {
+		return
+	}
+	files, err := saveAttachments(r, "attachments")
+	if _, ok := err.(uploadError); ok {
+		http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+		return
+	}
+	if err != nil {
+		serverError(w, r, err)
+		return
+	}
+	now := time.Now()
+	var id int64
+	// the answer is saved with its activity and the notifications about it, or not at all
+	err = db.WithTx(ctx, func(ctx context.Context) error {
+		res, err := db.ExecContext(ctx, "insert into answers (body, date, time, user, views, question_id) values (?, ?, ?, ?, 0, ?)",
+			body, now.Format(dateLayout), now.Format(timeLayout), user.UserName, questionID)
+		if err != nil {
+			return err
+		}
+		id, _ = res.LastInsertId()
+		if err := attachFiles(ctx, user, postAnswer, int(id), files); err != nil {
+			return err
+		}
+		if err := deleteDraft(ctx, user.UniqueID, draftAnswer, questionID); err != nil {
+			return err
+		}
+		if err := recordActivity(ctx, user.UniqueID, activityAnswered, postAnswer, int(id), questionID, ""); err != nil {
+			return err
+		}
+		link := fmt.Sprintf("/questions/%d#answer-%d", questionID, id)
+		if err := recordMentions(ctx, user, postAnswer, int(id), link, body, check.Verdict == filterReview); err != nil {
+			return err
+		}
+		if check.Verdict == filterReview {
+			if err := holdForReview(ctx, postAnswer, int(id), check.Reason); err != nil {
+				return err
+			}
+		} else if err := notifyNewAnswer(ctx, r, user, questionID, int(id), q.QnHeading); err != nil {
+			return err
+		} else if err := emitAnswer(ctx, eventAnswerCreated, user.UserName, questionID, int(id)); err != nil {
+			return err
+		}
+		// the answerer follows the question, to hear about the other answers
+		return autoFollow(ctx, user.UniqueID, followQuestion, strconv.Itoa(questionID))
+	})
+	if err != nil {
+		removeAttachments(files)
+		serverError(w, r, err)
+		return
+	}
+	http.Redirect(w, r, fmt.Sprintf("/questions/%d#answer-%d", questionID, id), http.StatusSeeOther)
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"mime"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// the JSON API lives under /api/v1/. Changes to v1 are additive: new endpoints, new fields in
+// responses and new optional fields in requests can appear, so clients ignore what they don't
+// know. Removing or renaming a field, or changing what it means, waits for /api/v2/.
+// errors have the same envelope everywhere, with a code for programs and a message for people:
+//
+//	{"error": {"code": "invalid", "message": "invalid preferences", "fields": {"theme": "unknown theme"}}}
+//
+// internal errors carry the id of their log line. The API only speaks JSON: a request accepting
+// no JSON gets 406, and a request body that isn't JSON gets 415
+
+// version of the API, sent in the API-Version header of its responses
+const apiVersion = "1"
+
+// apiError is the error of an API response
+type apiError struct {
+	Code    string            `json:"code"`
+	Message string            `json:"message"`
+	Fields  map[string]string `json:"fields,omitempty"` // what is wrong with the fields of the request, by name
+	ID      string            `json:"id,omitempty"`     // of the log line of an internal error
+}
+
+// codes of the errors, by status
+var apiErrorCodes = map[int]string{
+	http.StatusBadRequest:            "bad_request",
+	http.StatusUnauthorized:          "unauthorized",
+	http.StatusForbidden:             "forbidden",
+	http.StatusNotFound:              "not_found",
+	http.StatusMethodNotAllowed:      "method_not_allowed",
+	http.StatusNotAcceptable:         "not_acceptable",
+	http.StatusConflict:              "conflict",
+	http.StatusRequestEntityTooLarge: "too_large",
+	http.StatusUnsupportedMediaType:  "unsupported_media_type",
+	http.StatusUnprocessableEntity:   "invalid",
+	http.StatusTooManyRequests:       "rate_limited",
+	http.StatusInternalServerError:   "internal",
+	http.StatusServiceUnavailable:    "unavailable",
+}
+
+// fieldErrors tells what is wrong with the fields of a request, by name
+type fieldErrors map[string]string
+
+func (f fieldErrors) Error() string {
+	names := make([]string, 0, len(f))
+	for name := range f {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	messages := make([]string, len(names))
+	for i, name := range names {
+		messages[i] = f[name]
+	}
+	return strings.Join(messages, "; ")
+}
+
+// writeJSON answers with v encoded as JSON
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		// the status is already sent, nothing else can be done
+		return
+	}
+}
+
+// writeJSONError answers with an error of the code of the status
+func writeJSONError(w http.ResponseWriter, status int, message string) {
+	writeAPIError(w, status, apiError{Message: message})
+}
+
+// writeAPIError answers with the error, coded after the status unless it has a code
+func writeAPIError(w http.ResponseWriter, status int, e apiError) {
+	if e.Code == "" {
+		e.Code = apiErrorCodes[status]
+	}
+	if e.Code == "" {
+		e.Code = "error"
+	}
+	writeJSON(w, status, apiErrorResponse{Error: e})
+}
+
+// writeInternalError logs the error and answers with the id of its log line
+func writeInternalError(w http.ResponseWriter, r *http.Request, err error) {
+	// the client went away, there is no one to answer
+	if errors.Is(err, context.Canceled) && r.Context().Err() != nil {
+		return
+	}
+	writeAPIError(w, http.StatusInternalServerError, apiError{Message: "internal error", ID: logError(r, err)})
+}
+
+// serveAPINotFound answers the paths of the API that aren't endpoints
+func serveAPINotFound(w http.ResponseWriter, r *http.Request) {
+	writeJSONError(w, http.StatusNotFound, "no such endpoint")
+}
+
+// negotiateAPI checks that the request takes JSON and that its body is JSON
+func negotiateAPI(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("API-Version", apiVersion)
+		if !acceptsJSON(r.Header.Get("Accept")) {
+			writeJSONError(w, http.StatusNotAcceptable, "the API only answers with application/json")
+			return
+		}
+		if r.ContentLength != 0 && r.Method != http.MethodGet && r.Method != http.MethodHead {
+			if media, _, err := mime.ParseMediaType(r.Header.Get("Content-Type")); err != nil || media != "application/json" {
+				writeJSONError(w, http.StatusUnsupportedMediaType, "the body must be application/json")
+				return
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// acceptsJSON tells if an Accept header allows JSON, which a missing header does
+func acceptsJSON(accept string) bool {
+	if strings.TrimSpace(accept) == "" {
+		return true
+	}
+	for _, part := range strings.Split(accept, ",") {
+		media, params, err := mime.ParseMediaType(strings.TrimSpace(part))
+		if err != nil {
+			continue
+		}
+		// a quality of 0 refuses the type
+		if q, err := strconv.ParseFloat(params["q"], 64); err == nil && q == 0 {
+			continue
+		}
+		if media == "application/json" || media == "application/*" || media == "*/*" {
+			return true
+		}
+	}
+	return false
+}
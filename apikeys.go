@@ -0,0 +1,280 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// users make API keys at /settings/api-keys for their scripts and integrations, and send them to
+// /api/v1/ as Authorization: Bearer <key>. A key acts as its user, with the read scope for GET
+// requests only, or the write scope for any. Keys follow the selector/validator pattern of the
+// remember-me tokens, qa_<selector>_<validator>: the validator is only kept hashed, so a key is
+// shown once, when it is made. Each key may make API_KEY_QUOTA requests an hour, 1000 by default,
+// counted by each instance of the app; its responses tell what is left in X-RateLimit-* headers.
+// A revoked key stops working at once, and the settings show when each key was last used
+
+// scopes of a key
+const (
+	scopeRead  = "read"
+	scopeWrite = "write"
+)
+
+const (
+	apiKeyPrefix         = "qa_"
+	maxAPIKeys           = 20 // active keys a user may have
+	maxAPIKeyName        = 60
+	defaultAPIKeyQuota   = 1000 // requests an hour
+	apiKeyQuotaWindow    = time.Hour
+	apiKeyUsedResolution = time.Minute // how often the last use of a key is written
+)
+
+var (
+	errAPIKeyName  = errors.New("a key has a name of 1 to 60 characters")
+	errAPIKeyScope = errors.New("a key has the read or the write scope")
+	errAPIKeyLimit = errors.New("you have too many keys, revoke some first")
+)
+
+// apiKey is a key, as listed in the settings of its user
+type apiKey struct {
+	ID       int
+	Name     string
+	Selector string
+	Scope    string
+	Quota    int
+	Created  string
+	LastUsed string // empty if never used
+	Revoked  string // empty while the key works
+}
+
+// apiKeyQuota is the quota of new keys, from API_KEY_QUOTA
+func apiKeyQuota() int {
+	if n, err := strconv.Atoi(os.Getenv("API_KEY_QUOTA")); err == nil && n > 0 {
+		return n
+	}
+	return defaultAPIKeyQuota
+}
+
+// createAPIKey makes a key for the user, returning it in full, the only time it is known
+func createAPIKey(ctx context.Context, user *User, name, scope string) (string, error) {
+	name = strings.TrimSpace(name)
+	if name == "" || len(name) > maxAPIKeyName {
+		return "", errAPIKeyName
+	}
+	if scope != scopeRead && scope != scopeWrite {
+		return "", errAPIKeyScope
+	}
+	var n int
+	if err := db.QueryRowContext(ctx, "select count(*) from api_keys where user_id = ? and revoked_at is null", user.UniqueID).Scan(&n); err != nil {
+		return "", err
+	}
+	if n >= maxAPIKeys {
+		return "", errAPIKeyLimit
+	}
+	selector, validator := newToken()[:16], newToken()
+	_, err := db.ExecContext(ctx, `insert into api_keys (user_id, name, selector, validator_hash, scope, quota, created_at)
+		values (?, ?, ?, ?, ?, ?, ?)`, user.UniqueID, name, selector, hashValidator(validator), scope, apiKeyQuota(), time.Now().Format(timestampLayout))
+	if err != nil {
+		return "", err
+	}
+	return apiKeyPrefix + selector + "_" + validator, nil
+}
+
+// userAPIKeys lists the keys of the user, the working ones first
+func userAPIKeys(ctx context.Context, userID int) ([]apiKey, error) {
+	var keys []apiKey
+	err := queryList(ctx, `select id, name, selector, scope, quota, created_at, coalesce(last_used_at, ''), coalesce(revoked_at, '')
+		from api_keys where user_id = ? order by revoked_at is not null, id desc`, []interface{}{userID}, func(rows *sql.Rows) error {
+		var k apiKey
+		err := rows.Scan(&k.ID, &k.Name, &k.Selector, &k.Scope, &k.Quota, &k.Created, &k.LastUsed, &k.Revoked)
+		keys = append(keys, k)
+		return err
+	})
+	return keys, err
+}
+
+// keyUse is a key found for a request
+type keyUse struct {
+	id    int
+	user  *User
+	scope string
+	quota int
+}
+
+// lookupAPIKey finds the key and its user, nil when the key is wrong, revoked or of a banned user
+func lookupAPIKey(ctx context.Context, key string) (*keyUse, error) {
+	selector, validator, ok := strings.Cut(strings.TrimPrefix(key, apiKeyPrefix), "_")
+	if !ok || !strings.HasPrefix(key, apiKeyPrefix) {
+		return nil, nil
+	}
+	var k keyUse
+	var hash string
+	var userID int
+	err := db.QueryRowContext(ctx, "select id, user_id, validator_hash, scope, quota from api_keys where selector = ? and revoked_at is null", selector).
+		Scan(&k.id, &userID, &hash, &k.scope, &k.quota)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if subtle.ConstantTimeCompare([]byte(hash), []byte(hashValidator(validator))) != 1 {
+		return nil, nil
+	}
+	k.user, err = scanUser(db.QueryRowContext(ctx, "select "+userColumns+" from users where id = ?", userID))
+	if err == sql.ErrNoRows || (err == nil && k.user.Banned) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &k, nil
+}
+
+// keyWindows counts the requests of each key in the current window, by key id
+var keyWindows = struct {
+	sync.Mutex
+	windows map[int]*keyWindow
+}{windows: map[int]*keyWindow{}}
+
+type keyWindow struct {
+	start    time.Time
+	requests int
+	used     time.Time // when the last use was written
+}
+
+// takeQuota counts a request of the key, telling how many are left in the window and when it ends,
+// and if the last use of the key is due to be written
+func takeQuota(k *keyUse, now time.Time) (left int, reset time.Time, touch bool) {
+	keyWindows.Lock()
+	defer keyWindows.Unlock()
+	w, ok := keyWindows.windows[k.id]
+	if !ok {
+		w = &keyWindow{start: now}
+		keyWindows.windows[k.id] = w
+	}
+	if now.Sub(w.start) >= apiKeyQuotaWindow {
+		w.start, w.requests = now, 0
+	}
+	w.requests++
+	if now.Sub(w.used) >= apiKeyUsedResolution {
+		w.used, touch = now, true
+	}
+	return k.quota - w.requests, w.start.Add(apiKeyQuotaWindow), touch
+}
+
+// authenticateAPIKeys makes the requests with an API key act as its user, within the scope and the
+// quota of the key. Requests without one go on with their session
+func authenticateAPIKeys(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := r.Context()
+		auth := r.Header.Get("Authorization")
+		if auth == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		key := strings.TrimSpace(strings.TrimPrefix(auth, "Bearer "))
+		if key == auth {
+			writeJSONError(w, http.StatusUnauthorized, "the Authorization header is Bearer followed by an API key")
+			return
+		}
+		k, err := lookupAPIKey(ctx, key)
+		if err != nil {
+			writeInternalError(w, r, err)
+			return
+		}
+		if k == nil {
+			writeJSONError(w, http.StatusUnauthorized, "this API key is wrong or revoked")
+			return
+		}
+		now := time.Now()
+		left, reset, touch := takeQuota(k, now)
+		w.Header().Set("X-RateLimit-Limit", strconv.Itoa(k.quota))
+		w.Header().Set("X-RateLimit-Remaining", strconv.Itoa(max0(left)))
+		w.Header().Set("X-RateLimit-Reset", strconv.FormatInt(reset.Unix(), 10))
+		if touch {
+			if _, err := db.ExecContext(ctx, "update api_keys set last_used_at = ? where id = ?", now.Format(timestampLayout), k.id); err != nil {
+				fmt.Println(err)
+			}
+		}
+		if left < 0 {
+			w.Header().Set("Retry-After", strconv.Itoa(int(reset.Sub(now).Seconds())+1))
+			writeJSONError(w, http.StatusTooManyRequests, "this API key used its quota of requests for the hour")
+			return
+		}
+		if k.scope == scopeRead && r.Method != http.MethodGet && r.Method != http.MethodHead {
+			writeJSONError(w, http.StatusForbidden, "this API key can only read")
+			return
+		}
+		// the key stands for the user of the request, whatever its cookies say
+		s := &session{}
+		s.once.Do(func() { s.user = k.user })
+		next.ServeHTTP(w, r.WithContext(context.WithValue(ctx, sessionKey{}, s)))
+	})
+}
+
+// max0 is n, or 0 when it is negative
+func max0(n int) int {
+	if n < 0 {
+		return 0
+	}
+	return n
+}
+
+type apiKeysPage struct {
+	Keys   []apiKey
+	NewKey string // the key just made, shown once
+	Quota  int
+	Error  string
+}
+
+// serve /settings/api-keys, where users make, list and revoke their API keys
+func serveAPIKeySettings(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	user := requireUser(w, r)
+	if user == nil {
+		return
+	}
+	p := apiKeysPage{Quota: apiKeyQuota()}
+	if r.Method == http.MethodPost {
+		switch r.FormValue("action") {
+		case "create":
+			key, err := createAPIKey(ctx, user, r.FormValue("name"), r.FormValue("scope"))
+			switch err {
+			case nil:
+				p.NewKey = key
+			case errAPIKeyName, errAPIKeyScope, errAPIKeyLimit:
+				p.Error = err.Error()
+			default:
+				serverError(w, r, err)
+				return
+			}
+		case "revoke":
+			_, err := db.ExecContext(ctx, "update api_keys set revoked_at = ? where id = ? and user_id = ? and revoked_at is null",
+				time.Now().Format(timestampLayout), r.FormValue("id"), user.UniqueID)
+			if err != nil {
+				serverError(w, r, err)
+				return
+			}
+			http.Redirect(w, r, "/settings/api-keys", http.StatusSeeOther)
+			return
+		default:
+			http.Error(w, "Bad Request", http.StatusBadRequest)
+			return
+		}
+	}
+	var err error
+	if p.Keys, err = userAPIKeys(ctx, user.UniqueID); err != nil {
+		serverError(w, r, err)
+		return
+	}
+	render(w, r, "api-keys.html", p)
+}
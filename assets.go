@@ -0,0 +1,134 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"io/fs"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// the files of public are served on /static/. Pages link them with the asset function, which puts
+// a hash of the content in the name, like /static/stylesheets/main.3f2a9c1b0d.css: such a url
+// always has the same content, so browsers keep it for a year without asking again. Other urls
+// are checked again on each use, and answered with 304 Not Modified while their ETag matches.
+// uploads get random names and never change, so they are kept for a year too
+
+// length of the hashes in the names of the assets
+const assetHashLength = 10
+
+// assetManifest knows the hashes of the static files, computed when the server starts
+type assetManifest struct {
+	dev    bool              // files may change while the server runs, they aren't hashed
+	hashes map[string]string // by path under public, like stylesheets/main.css
+}
+
+// the static files of the running server, set by newServer, see Server
+var siteAssets = &assetManifest{hashes: map[string]string{}}
+
+// loadAssets hashes the files of the directory, except the uploads. With dev nothing is hashed,
+// so that edits show on the next reload
+func loadAssets(dir string, dev bool) (*assetManifest, error) {
+	m := &assetManifest{dev: dev, hashes: map[string]string{}}
+	if dev {
+		return m, nil
+	}
+	err := filepath.WalkDir(dir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(dir, p)
+		if err != nil {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+		if d.IsDir() {
+			if rel == "uploads" {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		hash, err := hashFile(p)
+		if err != nil {
+			return err
+		}
+		m.hashes[rel] = hash
+		return nil
+	})
+	return m, err
+}
+
+// hashFile returns the start of the sha256 of the content of the file
+func hashFile(name string) (string, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil))[:assetHashLength], nil
+}
+
+// url returns the url of a static file with the hash of its content, like /static/scripts/tags.1a2b3c4d5e.js.
+// files that weren't hashed keep their url
+func (m *assetManifest) url(u string) string {
+	name := strings.TrimPrefix(u, "/static/")
+	hash, ok := m.hashes[name]
+	if !ok {
+		return u
+	}
+	ext := path.Ext(name)
+	return "/static/" + strings.TrimSuffix(name, ext) + "." + hash + ext
+}
+
+// resolve finds the file of a path under /static/, telling if the path has the current hash of the file
+func (m *assetManifest) resolve(name string) (file string, current bool) {
+	ext := path.Ext(name)
+	base := strings.TrimSuffix(name, ext)
+	dot := strings.LastIndex(base, ".")
+	if dot < 0 || len(base)-dot-1 != assetHashLength {
+		return name, false
+	}
+	hash := base[dot+1:]
+	if _, err := hex.DecodeString(hash); err != nil {
+		return name, false
+	}
+	file = base[:dot] + ext
+	// an old hash, from a page cached before a deploy, still gets the file as it is now
+	return file, m.hashes[file] == hash
+}
+
+// serve serves the files of the directory, with their cache headers
+func (m *assetManifest) serve(dir string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		file, current := m.resolve(strings.TrimPrefix(path.Clean("/"+r.URL.Path), "/"))
+		f, err := http.Dir(dir).Open("/" + file)
+		if err != nil {
+			http.NotFound(w, r)
+			return
+		}
+		defer f.Close()
+		info, err := f.Stat()
+		if err != nil || info.IsDir() {
+			http.NotFound(w, r)
+			return
+		}
+		if current || strings.HasPrefix(file, "uploads/") {
+			w.Header().Set("Cache-Control", "public, max-age=31536000, immutable")
+		} else {
+			w.Header().Set("Cache-Control", "no-cache")
+		}
+		if hash, ok := m.hashes[file]; ok {
+			w.Header().Set("ETag", `"`+hash+`"`)
+		}
+		// answers conditional requests on the ETag, or on the modification time
+		http.ServeContent(w, r, info.Name(), info.ModTime(), f)
+	})
+}
@@ -0,0 +1,327 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// files attached to questions and answers, beyond their image. Only the extensions of
+// attachmentTypes are accepted, each with its size limit, and the content must match the
+// extension. Uploads go through scanAttachment before they are kept, outside of public, and are
+// downloaded from /attachments/{id}/{name} with the headers of a download
+
+// attached files are stored in this directory, only served by serveAttachment
+const attachmentDir = "attachments"
+
+// most files a post can have attached
+const maxAttachments = 5
+
+// attachmentType is an accepted kind of file
+type attachmentType struct {
+	ContentType string // served content type
+	MaxSize     int64  // largest accepted file, in bytes
+	Detected    string // prefix of the content type detected from the start of the file
+}
+
+var (
+	textAttachment = attachmentType{"text/plain; charset=utf-8", 1 << 20, "text/plain"}
+	pdfAttachment  = attachmentType{"application/pdf", 10 << 20, "application/pdf"}
+	zipAttachment  = attachmentType{"application/zip", 20 << 20, "application/zip"}
+)
+
+// attachmentTypes are the accepted files, by extension. Source code is served as plain text,
+// never run by the browser
+var attachmentTypes = map[string]attachmentType{
+	".txt":  textAttachment,
+	".md":   textAttachment,
+	".csv":  textAttachment,
+	".json": textAttachment,
+	".go":   textAttachment,
+	".py":   textAttachment,
+	".java": textAttachment,
+	".c":    textAttachment,
+	".h":    textAttachment,
+	".cpp":  textAttachment,
+	".js":   textAttachment,
+	".ts":   textAttachment,
+	".rs":   textAttachment,
+	".sql":  textAttachment,
+	".pdf":  pdfAttachment,
+	".zip":  zipAttachment,
+}
+
+// attachmentExtensions lists the accepted extensions, like .go,.pdf
+func attachmentExtensions() string {
+	exts := make([]string, 0, len(attachmentTypes))
+	for ext := range attachmentTypes {
+		exts = append(exts, ext)
+	}
+	sort.Strings(exts)
+	return strings.Join(exts, ",")
+}
+
+var errAttachmentRejected = errors.New("the virus scan rejected the file")
+
+// scanAttachment is called with every uploaded file before it is kept, an error rejecting the
+// upload. errAttachmentRejected tells the file is infected, other errors are server errors
+var scanAttachment = scanWithCommand
+
+// scanWithCommand runs the command of ATTACHMENT_SCAN_COMMAND, like "clamdscan --no-summary",
+// with the path of the file, a failing exit status rejecting it. Without the variable files
+// aren't scanned
+func scanWithCommand(ctx context.Context, path string) error {
+	args := strings.Fields(os.Getenv("ATTACHMENT_SCAN_COMMAND"))
+	if len(args) == 0 {
+		return nil
+	}
+	out, err := exec.CommandContext(ctx, args[0], append(args[1:], path)...).CombinedOutput()
+	var exit *exec.ExitError
+	if errors.As(err, &exit) {
+		fmt.Printf("attachment scan: %s", out)
+		return errAttachmentRejected
+	}
+	return err
+}
+
+// Attachment is a file attached to a post
+type Attachment struct {
+	ID   int
+	Name string // name of the file uploaded, given back on download
+	Path string // path of the file in attachmentDir
+	Type string // content type
+	Size int64
+}
+
+// URL is where the attachment is downloaded from
+func (a Attachment) URL() string {
+	return fmt.Sprintf("/attachments/%d/%s", a.ID, url.PathEscape(a.Name))
+}
+
+// SizeText is the size of the file for people, like 12 KB
+func (a Attachment) SizeText() string {
+	switch {
+	case a.Size >= 1<<20:
+		return fmt.Sprintf("%.1f MB", float64(a.Size)/(1<<20))
+	case a.Size >= 1<<10:
+		return fmt.Sprintf("%d KB", a.Size>>10)
+	}
+	return fmt.Sprintf("%d bytes", a.Size)
+}
+
+// saveAttachments checks and stores the files uploaded in the form field of the request. The
+// error of a file the user can fix, like a wrong type, is an uploadError. The files are linked to
+// their post by attachFiles
+func saveAttachments(r *http.Request, field string) ([]Attachment, error) {
+	if r.MultipartForm == nil {
+		if err := r.ParseMultipartForm(32 << 20); err == http.ErrNotMultipart {
+			return nil, nil
+		} else if err != nil {
+			return nil, err
+		}
+	}
+	headers := r.MultipartForm.File[field]
+	// browsers send an empty file when none was chosen
+	files := headers[:0]
+	for _, h := range headers {
+		if h.Filename != "" {
+			files = append(files, h)
+		}
+	}
+	if len(files) > maxAttachments {
+		return nil, uploadError(fmt.Sprintf("a post can have at most %d files attached", maxAttachments))
+	}
+	var saved []Attachment
+	for _, h := range files {
+		a, err := saveAttachment(r.Context(), h)
+		if err != nil {
+			removeAttachments(saved)
+			return nil, err
+		}
+		saved = append(saved, a)
+	}
+	return saved, nil
+}
+
+// uploadError is an upload refused for what the user sent
+type uploadError string
+
+func (e uploadError) Error() string { return string(e) }
+
+// saveAttachment checks and stores one uploaded file
+func saveAttachment(ctx context.Context, h *multipart.FileHeader) (Attachment, error) {
+	name := filepath.Base(strings.ReplaceAll(h.Filename, `\`, "/"))
+	ext := strings.ToLower(filepath.Ext(name))
+	t, ok := attachmentTypes[ext]
+	if !ok {
+		return Attachment{}, uploadError(fmt.Sprintf("%s: files of this type can't be attached", name))
+	}
+	if h.Size > t.MaxSize {
+		return Attachment{}, uploadError(fmt.Sprintf("%s: %s files can't be larger than %s", name, ext, Attachment{Size: t.MaxSize}.SizeText()))
+	}
+	file, err := h.Open()
+	if err != nil {
+		return Attachment{}, err
+	}
+	defer file.Close()
+	head := make([]byte, 512)
+	n, _ := io.ReadFull(file, head)
+	if !strings.HasPrefix(http.DetectContentType(head[:n]), t.Detected) || (t == textAttachment && !utf8.Valid(trimRune(head[:n]))) {
+		return Attachment{}, uploadError(fmt.Sprintf("%s: the content of the file doesn't match its extension", name))
+	}
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return Attachment{}, err
+	}
+
+	if err := os.MkdirAll(attachmentDir, 0755); err != nil {
+		return Attachment{}, err
+	}
+	a := Attachment{Name: name, Path: newToken()[:24] + ext, Type: t.ContentType, Size: h.Size}
+	path := filepath.Join(attachmentDir, a.Path)
+	out, err := os.Create(path)
+	if err != nil {
+		return Attachment{}, err
+	}
+	if _, err := io.Copy(out, file); err != nil {
+		out.Close()
+		os.Remove(path)
+		return Attachment{}, err
+	}
+	if err := out.Close(); err != nil {
+		os.Remove(path)
+		return Attachment{}, err
+	}
+	if err := scanAttachment(ctx, path); err != nil {
+		os.Remove(path)
+		if err == errAttachmentRejected {
+			return Attachment{}, uploadError(name + ": " + err.Error())
+		}
+		return Attachment{}, err
+	}
+	return a, nil
+}
+
+// trimRune drops the end of the text cut in the middle of a rune
+func trimRune(b []byte) []byte {
+	for i := 0; i < utf8.UTFMax && len(b) > 0; i++ {
+		if utf8.Valid(b) {
+			break
+		}
+		b = b[:len(b)-1]
+	}
+	return b
+}
+
+// removeAttachments deletes the stored files of attachments that won't be kept
+func removeAttachments(files []Attachment) {
+	for _, a := range files {
+		if err := os.Remove(filepath.Join(attachmentDir, a.Path)); err != nil {
+			fmt.Println(err)
+		}
+	}
+}
+
+// attachFiles links saved files to their post, in the transaction saving the post
+func attachFiles(ctx context.Context, user *User, postType string, postID int, files []Attachment) error {
+	now := time.Now().Format(timestampLayout)
+	for _, a := range files {
+		_, err := db.ExecContext(ctx, `insert into attachments (post_type, post_id, user_id, name, path, content_type, size, created_at)
+			values (?, ?, ?, ?, ?, ?, ?, ?)`, postType, postID, user.UniqueID, a.Name, a.Path, a.Type, a.Size, now)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// postAttachments are the files attached to posts, by post type and id
+type postAttachments map[string]map[int][]Attachment
+
+// threadAttachments loads the files attached to the question and its answers
+func threadAttachments(ctx context.Context, questionID int) (postAttachments, error) {
+	rows, err := db.QueryContext(ctx, `select post_type, post_id, id, name, path, content_type, size from attachments
+		where (post_type = 'question' and post_id = ?) or (post_type = 'answer' and post_id in (select id from answers where question_id = ?))
+		order by id`, questionID, questionID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	files := postAttachments{postQuestion: {}, postAnswer: {}}
+	for rows.Next() {
+		var postType string
+		var postID int
+		var a Attachment
+		if err := rows.Scan(&postType, &postID, &a.ID, &a.Name, &a.Path, &a.Type, &a.Size); err != nil {
+			return nil, err
+		}
+		files[postType][postID] = append(files[postType][postID], a)
+	}
+	return files, rows.Err()
+}
+
+// serve /attachments/{id}/{name}, the download of an attached file. The name is only there for
+// the url to read well, the file is found by its id
+func serveAttachment(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	idPart, _, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/attachments/"), "/")
+	id, err := strconv.Atoi(idPart)
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	var a Attachment
+	var questionID int
+	var created string
+	err = db.QueryRowContext(ctx, `select attachments.name, attachments.path, attachments.content_type, attachments.created_at,
+			case attachments.post_type when 'question' then attachments.post_id else answers.question_id end
+		from attachments left join answers on attachments.post_type = 'answer' and answers.id = attachments.post_id
+		where attachments.id = ?`, id).Scan(&a.Name, &a.Path, &a.Type, &created, &questionID)
+	if err == sql.ErrNoRows {
+		http.NotFound(w, r)
+		return
+	}
+	if err != nil {
+		serverError(w, r, err)
+		return
+	}
+	// the files of hidden questions are hidden with them
+	if hidden, err := questionHidden(ctx, currentUser(r), questionID); err != nil {
+		serverError(w, r, err)
+		return
+	} else if hidden {
+		http.NotFound(w, r)
+		return
+	}
+	file, err := os.Open(filepath.Join(attachmentDir, a.Path))
+	if err != nil {
+		serverError(w, r, err)
+		return
+	}
+	defer file.Close()
+	modified, _ := time.Parse(timestampLayout, created)
+	h := w.Header()
+	h.Set("Content-Type", a.Type)
+	h.Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": a.Name}))
+	h.Set("X-Content-Type-Options", "nosniff")
+	h.Set("Content-Security-Policy", "sandbox")
+	h.Set("Cache-Control", "private, max-age=86400")
+	http.ServeContent(w, r, "", modified, file)
+}
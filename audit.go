@@ -0,0 +1,231 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// privileged actions, those of moderators and super-users on the posts and the users of others,
+// are recorded in audit_log with who did them, on what, and snapshots of the target before and
+// after. Triggers keep the log append-only. Super-users read it on /admin/audit, and download it
+// as CSV from /admin/audit.csv
+
+// actions of the audit log
+const (
+	auditHidePost        = "hide post"
+	auditShowPost        = "show post"
+	auditConvertComment  = "convert comment"
+	auditConvertAnswer   = "convert answer"
+	auditSuspend         = "suspend"
+	auditBan             = "ban"
+	auditLiftSanctions   = "lift sanctions"
+	auditMergeTags       = "merge tags"
+	auditTagSynonym      = "declare tag synonym"
+	auditRemoveSynonym   = "remove tag synonym"
+	auditTagAnonymous    = "set anonymous policy"
+	auditImportUser      = "import user"
+	auditMergeQuestion   = "merge question"
+	auditRollbackTagWiki = "roll back tag wiki"
+	auditProtectQuestion = "protect question"
+	auditCloseQuestion   = "close question"
+	auditRenameTag       = "rename tag"
+	auditMoveQuestion    = "move question"
+)
+
+// auditActions lists the actions, to filter the log by
+var auditActions = []string{
+	auditHidePost, auditShowPost, auditConvertComment, auditConvertAnswer, auditSuspend, auditBan, auditLiftSanctions,
+	auditMergeTags, auditRenameTag, auditTagSynonym, auditRemoveSynonym, auditTagAnonymous,
+	auditImportUser, auditMergeQuestion, auditRollbackTagWiki, auditProtectQuestion, auditCloseQuestion,
+	auditMoveQuestion,
+}
+
+// entries of the audit log per page
+const auditPerPage = 50
+
+// recordAudit appends a privileged action of the actor on a target, like a post or a user, to the
+// audit log. before and after are snapshots of the target, saved as JSON, nil for none
+func recordAudit(ctx context.Context, actor *User, action, targetType, target string, before, after interface{}) error {
+	snapshot := func(v interface{}) (sql.NullString, error) {
+		b, err := json.Marshal(v)
+		// a nil snapshot, like a deleted post, is none
+		return sql.NullString{String: string(b), Valid: string(b) != "null"}, err
+	}
+	b, err := snapshot(before)
+	if err != nil {
+		return err
+	}
+	a, err := snapshot(after)
+	if err != nil {
+		return err
+	}
+	_, err = db.ExecContext(ctx, `insert into audit_log (actor_id, actor, action, target_type, target, before, after, created_at)
+		values (?, ?, ?, ?, ?, ?, ?, ?)`, actor.UniqueID, actor.UserName, action, targetType, target, b, a, time.Now().Format(timestampLayout))
+	return err
+}
+
+// postSnapshot is the state of a post kept in the audit log
+type postSnapshot struct {
+	Author  string `json:"author"`
+	Heading string `json:"heading,omitempty"`
+	Body    string `json:"body"`
+	Hidden  bool   `json:"hidden"`
+}
+
+// snapshotPost loads the state of a post for the audit log, nil if there is none
+func snapshotPost(ctx context.Context, postType string, postID int) (*postSnapshot, error) {
+	table, ok := postTables[postType]
+	if !ok {
+		return nil, errPostNotFound
+	}
+	heading := "''"
+	if postType == postQuestion {
+		heading = "heading"
+	}
+	var p postSnapshot
+	err := db.QueryRowContext(ctx, "select user, "+heading+", body, hidden_at is not null from "+table+" where id = ?", postID).
+		Scan(&p.Author, &p.Heading, &p.Body, &p.Hidden)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	return &p, err
+}
+
+// sanctionSnapshot is the state of the sanctions of a user kept in the audit log
+type sanctionSnapshot struct {
+	Banned     bool   `json:"banned"`
+	Suspension string `json:"suspended_until,omitempty"`
+	Reason     string `json:"reason,omitempty"`
+}
+
+// auditEntry is an entry of the audit log
+type auditEntry struct {
+	ID         int
+	Actor      string
+	Action     string
+	TargetType string
+	Target     string
+	Before     string
+	After      string
+	Created    string
+}
+
+// auditFilter selects entries of the audit log, by actor and action
+type auditFilter struct {
+	Actor  string
+	Action string
+}
+
+// where is the condition of the filter, with its arguments
+func (f auditFilter) where() (string, []interface{}) {
+	conds := []string{"true"}
+	var args []interface{}
+	if f.Actor != "" {
+		conds = append(conds, "lower(actor) = lower(?)")
+		args = append(args, f.Actor)
+	}
+	if f.Action != "" {
+		conds = append(conds, "action = ?")
+		args = append(args, f.Action)
+	}
+	return strings.Join(conds, " and "), args
+}
+
+// queryAudit lists the entries of the filter, the latest first, all of them when limit is 0
+func queryAudit(ctx context.Context, f auditFilter, limit, offset int) ([]auditEntry, error) {
+	where, args := f.where()
+	query := `select id, actor, action, target_type, target, coalesce(before, ''), coalesce(after, ''), created_at
+		from audit_log where ` + where + " order by id desc"
+	if limit > 0 {
+		query += " limit ? offset ?"
+		args = append(args, limit, offset)
+	}
+	rows, err := db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var entries []auditEntry
+	for rows.Next() {
+		var e auditEntry
+		if err := rows.Scan(&e.ID, &e.Actor, &e.Action, &e.TargetType, &e.Target, &e.Before, &e.After, &e.Created); err != nil {
+			return nil, err
+		}
+		entries = append(entries, e)
+	}
+	return entries, rows.Err()
+}
+
+// auditPage is the data of the audit log page
+type auditPage struct {
+	Filter  auditFilter
+	Actions []string
+	Entries []auditEntry
+	CSV     string // url of the CSV of the filtered log
+
+	PrevPage, NextPage int // 0 when there is none
+}
+
+// PageURL is the url of another page of the filtered log
+func (p auditPage) PageURL(page int) string {
+	q := url.Values{"page": {strconv.Itoa(page)}}
+	if p.Filter.Actor != "" {
+		q.Set("actor", p.Filter.Actor)
+	}
+	if p.Filter.Action != "" {
+		q.Set("action", p.Filter.Action)
+	}
+	return "/admin/audit?" + q.Encode()
+}
+
+// serve /admin/audit and /admin/audit.csv, the audit log of the privileged actions
+func serveAuditLog(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	if requireSuperUser(w, r) == nil {
+		return
+	}
+	f := auditFilter{Actor: strings.TrimSpace(r.FormValue("actor")), Action: r.FormValue("action")}
+	if r.URL.Path == "/admin/audit.csv" {
+		entries, err := queryAudit(ctx, f, 0, 0)
+		if err != nil {
+			serverError(w, r, err)
+			return
+		}
+		w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+		w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="audit-%s.csv"`, time.Now().Format("2006-01-02")))
+		out := csv.NewWriter(w)
+		out.Write([]string{"id", "created_at", "actor", "action", "target_type", "target", "before", "after"})
+		for _, e := range entries {
+			out.Write([]string{strconv.Itoa(e.ID), e.Created, e.Actor, e.Action, e.TargetType, e.Target, e.Before, e.After})
+		}
+		out.Flush()
+		if err := out.Error(); err != nil {
+			fmt.Println(err)
+		}
+		return
+	}
+
+	p := auditPage{Filter: f, Actions: auditActions, CSV: "/admin/audit.csv?" + r.URL.RawQuery}
+	page := 1
+	if n, err := strconv.Atoi(r.FormValue("page")); err == nil && n > 1 {
+		page = n
+	}
+	entries, err := queryAudit(ctx, f, auditPerPage+1, (page-1)*auditPerPage)
+	if err != nil {
+		serverError(w, r, err)
+		return
+	}
+	if len(entries) > auditPerPage {
+		entries, p.NextPage = entries[:auditPerPage], page+1
+	}
+	p.Entries, p.PrevPage = entries, page-1
+	render(w, r, "audit-admin.html", p)
+}
@@ -0,0 +1,414 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// name of the cookie holding the session token
+const sessionCookie = "session"
+
+// how long a login lasts
+const sessionDuration = 30 * 24 * time.Hour
+
+// minimum length of a password
+const minPasswordLength = 8
+
+// columns selected for a user, in the order expected by scanUser
+const userColumns = "users.id, first_name, last_name, username, password, user_type, super_user, email, coalesce(language, ''), " + sanctionColumns
+
+// scan a row selected with userColumns into a User
+func scanUser(row scanner) (*User, error) {
+	var u User
+	var first, last, password, userType, email sql.NullString
+	var super sql.NullBool
+	if err := row.Scan(&u.UniqueID, &first, &last, &u.UserName, &password, &userType, &super, &email, &u.Language, &u.Banned, &u.Suspension); err != nil {
+		return nil, err
+	}
+	u.FirstName = first.String
+	u.LastName = last.String
+	u.Password = password.String
+	u.UserType = splitTags(userType.String)
+	u.SuperUser = super.Bool
+	u.Email = email.String
+	if u.Suspension <= time.Now().Format(timestampLayout) {
+		u.Suspension = ""
+	}
+	return &u, nil
+}
+
+// load the user with the given username, nil if there is none
+func userByName(ctx context.Context, name string) (*User, error) {
+	row := db.QueryRowContext(ctx, "select "+userColumns+" from users where lower(username) = lower(?)", name)
+	u, err := scanUser(row)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	return u, err
+}
+
+// hash a password with bcrypt
+func hashPassword(password string) (string, error) {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	return string(hash), err
+}
+
+// make a random token for sessions and links
+func newToken() string {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b)
+}
+
+// start a session for the user and set its cookie
+func startSession(ctx context.Context, w http.ResponseWriter, userID int) error {
+	token := newToken()
+	expires := time.Now().Add(sessionDuration)
+	if err := sessions.Create(ctx, token, userID, expires); err != nil {
+		return err
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     sessionCookie,
+		Value:    token,
+		Path:     "/",
+		Expires:  expires,
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+	return nil
+}
+
+// currentUser returns the logged in user of the request, nil for visitors
+func currentUser(r *http.Request) *User {
+	if s, ok := r.Context().Value(sessionKey{}).(*session); ok {
+		s.once.Do(func() { s.user = sessionUser(r) })
+		return s.user
+	}
+	return sessionUser(r)
+}
+
+// the context key of the session of a request
+type sessionKey struct{}
+
+// session is the user of a request, looked up the first time it is needed
+type session struct {
+	once sync.Once
+	user *User
+}
+
+// loadSession gives each request a session, so that its user is looked up once, however many
+// times the handler and its page ask for it. Handlers changing the user change the one it holds.
+// Requests without a session cookie start a new session from their remember-me token, if any
+func loadSession(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s := &session{}
+		if _, err := r.Cookie(sessionCookie); err == http.ErrNoCookie {
+			if user, err := restoreSession(w, r); err != nil {
+				fmt.Println(err)
+			} else if user != nil {
+				s.once.Do(func() { s.user = user })
+			}
+		}
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), sessionKey{}, s)))
+	})
+}
+
+// sessionUser looks up the logged in user of the session cookie, nil if there is none
+func sessionUser(r *http.Request) *User {
+	ctx := r.Context()
+	cookie, err := r.Cookie(sessionCookie)
+	if err != nil {
+		return nil
+	}
+	userID, err := sessions.Lookup(ctx, cookie.Value)
+	if err != nil {
+		fmt.Println(err)
+		return nil
+	}
+	if userID == 0 {
+		return nil
+	}
+	u, err := scanUser(db.QueryRowContext(ctx, "select "+userColumns+" from users where id = ?", userID))
+	if err != nil || u.Banned {
+		return nil
+	}
+	return u
+}
+
+// requireUser returns the logged in user, or redirects to the login page and returns nil
+func requireUser(w http.ResponseWriter, r *http.Request) *User {
+	user := currentUser(r)
+	if user == nil {
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+	}
+	return user
+}
+
+// requireSuperUser returns the logged in super-user, or answers with an error and returns nil
+func requireSuperUser(w http.ResponseWriter, r *http.Request) *User {
+	user := requireUser(w, r)
+	if user != nil && !user.SuperUser {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return nil
+	}
+	if user != nil {
+		required, err := twoFactorRequired(r.Context(), user)
+		if err != nil {
+			serverError(w, r, err)
+			return nil
+		}
+		if required {
+			http.Redirect(w, r, "/settings/2fa", http.StatusSeeOther)
+			return nil
+		}
+	}
+	return user
+}
+
+// isModerator tells if the user can moderate content: super-users and moderators
+func isModerator(user *User) bool {
+	if user == nil {
+		return false
+	}
+	if user.SuperUser {
+		return true
+	}
+	for _, t := range user.UserType {
+		if t == "moderator" {
+			return true
+		}
+	}
+	return false
+}
+
+// authForm is the data of the register and login pages
+type authForm struct {
+	Error     string
+	UserName  string
+	FirstName string
+	LastName  string
+	Email     string
+	// registering takes an invite code, see registration.go
+	InviteOnly bool
+	InviteCode string
+	Captcha    bool   // the form asks a CAPTCHA, see captcha.go
+	SSO        string // name of the identity provider to log in with, empty without single sign-on, see sso.go
+}
+
+// serve /register, creating a student account and logging in
+func serveRegister(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	if sso := ssoSettings(); sso != nil && sso.Required {
+		http.Redirect(w, r, "/sso/login", http.StatusSeeOther)
+		return
+	}
+	inviteOnly, err := featureEnabled(ctx, featureInviteOnly)
+	if err != nil {
+		serverError(w, r, err)
+		return
+	}
+	if r.Method != http.MethodPost {
+		render(w, r, "register.html", authForm{InviteOnly: inviteOnly, InviteCode: r.FormValue("invite"), Captcha: true})
+		return
+	}
+	form := authForm{
+		UserName:   strings.ToLower(strings.TrimSpace(r.FormValue("username"))),
+		FirstName:  strings.TrimSpace(r.FormValue("first_name")),
+		LastName:   strings.TrimSpace(r.FormValue("last_name")),
+		Email:      strings.TrimSpace(r.FormValue("email")),
+		InviteOnly: inviteOnly,
+		InviteCode: strings.ToUpper(strings.TrimSpace(r.FormValue("invite"))),
+		Captcha:    true,
+	}
+	password := r.FormValue("password")
+	if err := checkCaptcha(r); err == errCaptcha {
+		form.Error = err.Error()
+		render(w, r, "register.html", form)
+		return
+	} else if err != nil {
+		serverError(w, r, err)
+		return
+	}
+	if inviteOnly && form.InviteCode == "" {
+		form.Error = "registering takes an invite code, ask your teacher for one"
+		render(w, r, "register.html", form)
+		return
+	}
+	if err := validateUsername(ctx, form.UserName, 0); err != nil {
+		form.Error = err.Error()
+		render(w, r, "register.html", form)
+		return
+	}
+	if form.Email != "" && !validEmail(form.Email) {
+		form.Error = "this email address isn't valid"
+		render(w, r, "register.html", form)
+		return
+	}
+	if form.Email != "" {
+		disposable, err := disposableEmail(ctx, form.Email)
+		if err != nil {
+			serverError(w, r, err)
+			return
+		}
+		if disposable {
+			form.Error = "addresses of disposable email providers can't be used"
+			render(w, r, "register.html", form)
+			return
+		}
+	}
+	if len(password) < minPasswordLength {
+		form.Error = "the password must have at least 8 characters"
+		render(w, r, "register.html", form)
+		return
+	}
+	ip := clientIP(r)
+	if n, err := signupsFrom(ctx, ip); err != nil {
+		serverError(w, r, err)
+		return
+	} else if n >= signupLimit() {
+		form.Error = "too many accounts were registered from your network today, try again tomorrow"
+		render(w, r, "register.html", form)
+		return
+	}
+	hash, err := hashPassword(password)
+	if err != nil {
+		serverError(w, r, err)
+		return
+	}
+	var id int64
+	err = db.WithTx(ctx, func(ctx context.Context) error {
+		res, err := db.ExecContext(ctx, `insert into users (first_name, last_name, username, password, user_type, super_user, email)
+			values (?, ?, ?, ?, 'student', false, ?)`, form.FirstName, form.LastName, form.UserName, hash, form.Email)
+		if err != nil {
+			return err
+		}
+		id, _ = res.LastInsertId()
+		code := ""
+		if inviteOnly {
+			code = form.InviteCode
+			if err := useInvite(ctx, code); err != nil {
+				return err
+			}
+		}
+		if err := recordSignup(ctx, int(id), ip, code); err != nil {
+			return err
+		}
+		return emitUserRegistered(ctx, int(id), form.UserName)
+	})
+	if err == errInvalidInvite {
+		form.Error = err.Error()
+		render(w, r, "register.html", form)
+		return
+	}
+	if err != nil {
+		serverError(w, r, err)
+		return
+	}
+	if err := startSession(ctx, w, int(id)); err != nil {
+		serverError(w, r, err)
+		return
+	}
+	http.Redirect(w, r, "/", http.StatusSeeOther)
+}
+
+// serve /login
+func serveLogin(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	sso := ssoSettings()
+	ssoName := ""
+	if sso != nil {
+		ssoName = sso.Name
+	}
+	if r.Method != http.MethodPost {
+		render(w, r, "login.html", authForm{Captcha: loginNeedsCaptcha(r, ""), SSO: ssoName})
+		return
+	}
+	form := authForm{UserName: strings.TrimSpace(r.FormValue("username")), SSO: ssoName}
+	// after repeated failures, logging in takes a CAPTCHA
+	if loginNeedsCaptcha(r, form.UserName) {
+		form.Captcha = true
+		if err := checkCaptcha(r); err == errCaptcha {
+			form.Error = err.Error()
+			render(w, r, "login.html", form)
+			return
+		} else if err != nil {
+			serverError(w, r, err)
+			return
+		}
+	}
+	user, err := userByName(ctx, form.UserName)
+	if err != nil {
+		serverError(w, r, err)
+		return
+	}
+	if user == nil || bcrypt.CompareHashAndPassword([]byte(user.Password), []byte(r.FormValue("password"))) != nil {
+		recordLoginFailure(r, form.UserName)
+		form.Error = "wrong username or password"
+		form.Captcha = loginNeedsCaptcha(r, form.UserName)
+		render(w, r, "login.html", form)
+		return
+	}
+	if user.Banned {
+		form.Error = "this account is banned"
+		render(w, r, "login.html", form)
+		return
+	}
+	// with single sign-on required, passwords are only kept for the super-users, not to be locked out
+	if sso != nil && sso.Required && !user.SuperUser {
+		form.Error = "log in with " + sso.Name
+		render(w, r, "login.html", form)
+		return
+	}
+	// accounts with two-factor authentication give a code next
+	twoFactor, err := twoFactorEnabled(ctx, user.UniqueID)
+	if err != nil {
+		serverError(w, r, err)
+		return
+	}
+	remember := r.FormValue("remember") != ""
+	if twoFactor {
+		if err := startPendingLogin(ctx, w, user.UniqueID, remember); err != nil {
+			serverError(w, r, err)
+			return
+		}
+		http.Redirect(w, r, "/login/2fa", http.StatusSeeOther)
+		return
+	}
+	if remember {
+		if err := rememberUser(ctx, w, user.UniqueID); err != nil {
+			serverError(w, r, err)
+			return
+		}
+	}
+	if err := startSession(ctx, w, user.UniqueID); err != nil {
+		serverError(w, r, err)
+		return
+	}
+	http.Redirect(w, r, "/", http.StatusSeeOther)
+}
+
+// serve /logout, ending the session
+func serveLogout(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	if cookie, err := r.Cookie(sessionCookie); err == nil {
+		if err := sessions.Delete(ctx, cookie.Value); err != nil {
+			fmt.Println(err)
+		}
+	}
+	if err := forgetUser(ctx, w, r); err != nil {
+		fmt.Println(err)
+	}
+	http.SetCookie(w, &http.Cookie{Name: sessionCookie, Value: "", Path: "/", MaxAge: -1})
+	http.Redirect(w, r, "/", http.StatusSeeOther)
+}
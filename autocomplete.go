@@ -0,0 +1,121 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+// the search box suggests titles, tags and usernames starting with what is typed, the most
+// popular first, on each key press. Every lookup walks an index: the full-text index of the
+// headings for titles, and the indexes on the names of tags and users, so a suggestion takes a
+// few milliseconds. Popularity is only computed for a bounded number of candidates, which the
+// cross joins keep driving the queries
+
+// most suggestions of each type, and candidates ranked by popularity among those matching
+const (
+	autocompletePerType    = 5
+	autocompleteCandidates = 50
+	maxAutocompleteQuery   = 100
+)
+
+// suggestion is a suggestion of the search box
+type suggestion struct {
+	Type string `json:"type"` // question, tag or user
+	Text string `json:"text"`
+	URL  string `json:"url"`
+}
+
+// suggestions is the answer of /api/v1/autocomplete
+type suggestions struct {
+	Suggestions []suggestion `json:"suggestions"`
+}
+
+// ftsWord is a word of the full-text index
+var ftsWord = regexp.MustCompile(`[\pL\pN]+`)
+
+// globPrefix is the GLOB pattern of the names starting with the prefix. GLOB is case sensitive, so
+// unlike LIKE it walks the index of a lowercase column
+func globPrefix(prefix string) string {
+	return strings.NewReplacer("*", "[*]", "?", "[?]", "[", "[[]").Replace(prefix) + "*"
+}
+
+// autocomplete suggests what the user can open starting with the text
+func autocomplete(ctx context.Context, user *User, text string) ([]suggestion, error) {
+	text = strings.ToLower(strings.TrimSpace(text))
+	results := []suggestion{}
+	if text == "" || len(text) > maxAutocompleteQuery {
+		return results, nil
+	}
+	filter, args, err := questionFilter(ctx, user)
+	if err != nil {
+		return nil, err
+	}
+
+	// the headings with words starting with each of the words typed, among the latest matching
+	if words := ftsWord.FindAllString(text, 8); len(words) > 0 {
+		match := "heading:" + strings.Join(words, "* heading:") + "*"
+		err := queryList(ctx, `select questions.id, questions.heading
+			from (select docid from questions_fts where questions_fts match ? order by docid desc limit ?) m
+			cross join questions on questions.id = m.docid where `+filter+` order by questions.views + 10 * `+questionScoreSQL+` desc, questions.id desc limit ?`,
+			append(append([]interface{}{match, autocompleteCandidates}, args...), autocompletePerType), func(rows *sql.Rows) error {
+				var id int
+				var heading string
+				err := rows.Scan(&id, &heading)
+				results = append(results, suggestion{"question", heading, fmt.Sprintf("/questions/%d", id)})
+				return err
+			})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// the tags starting with the text, by the questions the user can see
+	err = queryList(ctx, `select t.name from (select id, name from tags where name glob ? limit ?) t
+		cross join question_tags on question_tags.tag_id = t.id cross join questions on questions.id = question_tags.question_id
+		where `+filter+` group by t.id, t.name order by count(*) desc, t.name limit ?`,
+		append(append([]interface{}{globPrefix(text), autocompleteCandidates}, args...), autocompletePerType), func(rows *sql.Rows) error {
+			var name string
+			err := rows.Scan(&name)
+			results = append(results, suggestion{"tag", name, "/tags/" + url.PathEscape(name)})
+			return err
+		})
+	if err != nil {
+		return nil, err
+	}
+
+	// the users starting with the text, by their answers
+	err = queryList(ctx, `select u.username from (select username from users where username glob ? limit ?) u
+		order by (select count(*) from answers where answers.user = u.username) desc, u.username limit ?`,
+		[]interface{}{globPrefix(text), autocompleteCandidates, autocompletePerType}, func(rows *sql.Rows) error {
+			var name string
+			err := rows.Scan(&name)
+			results = append(results, suggestion{"user", name, "/users/" + url.PathEscape(name)})
+			return err
+		})
+	if err != nil {
+		return nil, err
+	}
+	return results, nil
+}
+
+// serve /api/v1/autocomplete?q=..., the suggestions of the search box for the caller
+func serveAutocomplete(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	if r.Method != http.MethodGet {
+		writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	results, err := autocomplete(ctx, currentUser(r), r.URL.Query().Get("q"))
+	if err != nil {
+		writeInternalError(w, r, err)
+		return
+	}
+	// the same letters are typed again after a correction
+	w.Header().Set("Cache-Control", "private, max-age=30")
+	writeJSON(w, http.StatusOK, suggestions{Suggestions: results})
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// number of bookmarks of a question
+const bookmarkCountSQL = "(select count(*) from bookmarks where bookmarks.question_id = questions.id)"
+
+// isBookmarked tells if the user bookmarked the question
+func isBookmarked(ctx context.Context, user *User, questionID int) (bool, error) {
+	if user == nil {
+		return false, nil
+	}
+	var n int
+	err := db.QueryRowContext(ctx, "select count(*) from bookmarks where user_id = ? and question_id = ?", user.UniqueID, questionID).Scan(&n)
+	return n > 0, err
+}
+
+// toggleBookmark adds the question to the bookmarks of the user, or removes it if it is there
+func toggleBookmark(ctx context.Context, user *User, questionID int) error {
+	res, err := db.ExecContext(ctx, "delete from bookmarks where user_id = ? and question_id = ?", user.UniqueID, questionID)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil || n > 0 {
+		return err
+	}
+	_, err = db.ExecContext(ctx, "insert into bookmarks (user_id, question_id, created_at) values (?, ?, ?)",
+		user.UniqueID, questionID, time.Now().Format(timestampLayout))
+	return err
+}
+
+// handle the bookmark button of a question
+func serveBookmark(w http.ResponseWriter, r *http.Request, questionID int) {
+	ctx := r.Context()
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	user := requireUser(w, r)
+	if user == nil {
+		return
+	}
+	var exists int
+	err := db.QueryRowContext(ctx, "select count(*) from questions where id = ?", questionID).Scan(&exists)
+	if err != nil {
+		serverError(w, r, err)
+		return
+	}
+	if exists == 0 {
+		http.NotFound(w, r)
+		return
+	}
+	if err := toggleBookmark(ctx, user, questionID); err != nil {
+		serverError(w, r, err)
+		return
+	}
+	http.Redirect(w, r, fmt.Sprintf("/questions/%d", questionID), http.StatusSeeOther)
+}
+
+// serve /bookmarks, the questions bookmarked by the user, last bookmarked first
+func serveBookmarks(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	user := requireUser(w, r)
+	if user == nil {
+		return
+	}
+	filter, args, err := questionFilter(ctx, user)
+	if err != nil {
+		serverError(w, r, err)
+		return
+	}
+	rows, err := db.QueryContext(ctx, "select "+questionColumns+", "+answerCountSQL+`
+		from bookmarks join questions on questions.id = bookmarks.question_id
+		where bookmarks.user_id = ? and `+filter+` order by bookmarks.created_at desc`, append([]interface{}{user.UniqueID}, args...)...)
+	if err != nil {
+		serverError(w, r, err)
+		return
+	}
+	defer rows.Close()
+	var questions []questionSummary
+	for rows.Next() {
+		var answers int
+		q, err := scanQuestion(scanFunc(func(dest ...interface{}) error {
+			return rows.Scan(append(dest, &answers)...)
+		}))
+		if err != nil {
+			serverError(w, r, err)
+			return
+		}
+		maskAuthor(&q, user)
+		questions = append(questions, questionSummary{Question: q, AnswerCount: answers})
+	}
+	render(w, r, "bookmarks.html", questions)
+}
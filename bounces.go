@@ -0,0 +1,185 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/textproto"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+// emails stop going to addresses that bounce, that complained about spam, or that unsubscribed
+// from the link in an email. The mail provider reports bounces and complaints to /webhooks/email,
+// authenticated by EMAIL_WEBHOOK_SECRET. Without a provider, permanent SMTP errors count as bounces
+
+// reasons an address is suppressed
+const (
+	suppressBounce      = "bounce"
+	suppressComplaint   = "complaint"
+	suppressUnsubscribe = "unsubscribe"
+)
+
+// emailSuppression tells why emails to an address stopped
+type emailSuppression struct {
+	Reason  string
+	Detail  string // what the provider or the SMTP server said
+	Created string
+}
+
+// suppressEmail stops sending emails to the address
+func suppressEmail(ctx context.Context, address, reason, detail string) error {
+	_, err := db.ExecContext(ctx, "insert or replace into email_suppressions (email, reason, detail, created_at) values (?, ?, ?, ?)",
+		strings.ToLower(address), reason, detail, time.Now().Format(timestampLayout))
+	return err
+}
+
+// liftSuppression sends emails to the address again
+func liftSuppression(ctx context.Context, address string) error {
+	_, err := db.ExecContext(ctx, "delete from email_suppressions where email = ?", strings.ToLower(address))
+	return err
+}
+
+// suppressionOf loads why emails to the address stopped, nil when they are sent
+func suppressionOf(ctx context.Context, address string) (*emailSuppression, error) {
+	var s emailSuppression
+	err := db.QueryRowContext(ctx, "select reason, detail, created_at from email_suppressions where email = ?",
+		strings.ToLower(address)).Scan(&s.Reason, &s.Detail, &s.Created)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &s, nil
+}
+
+// permanentFailure tells if the SMTP server refused the address for good, like 550 no such user.
+// 4xx errors are temporary and retried by the job worker
+func permanentFailure(err error) bool {
+	var smtpErr *textproto.Error
+	return errors.As(err, &smtpErr) && smtpErr.Code >= 550 && smtpErr.Code <= 553
+}
+
+// unsubscribeToken signs the address for its unsubscribe link, which works without logging in
+func unsubscribeToken(ctx context.Context, address string) (string, error) {
+	secret, err := appSecret(ctx, "unsubscribe")
+	if err != nil {
+		return "", err
+	}
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte("unsubscribe:" + strings.ToLower(address)))
+	return hex.EncodeToString(mac.Sum(nil)), nil
+}
+
+// unsubscribeURL is the link of the List-Unsubscribe header of emails to the address
+func unsubscribeURL(ctx context.Context, address string) (string, error) {
+	token, err := unsubscribeToken(ctx, address)
+	if err != nil {
+		return "", err
+	}
+	return siteURL() + "/unsubscribe?" + url.Values{"email": {address}, "token": {token}}.Encode(), nil
+}
+
+// unsubscribePage is the data of the unsubscribe page
+type unsubscribePage struct {
+	Email string
+	Token string
+	Done  bool
+}
+
+// serve /unsubscribe, the link of the List-Unsubscribe header. Mail apps POST to it for a one-click
+// unsubscribe (RFC 8058); opening it in a browser asks first, as link scanners follow links too
+func serveUnsubscribe(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	p := unsubscribePage{Email: r.FormValue("email"), Token: r.FormValue("token")}
+	want, err := unsubscribeToken(ctx, p.Email)
+	if err != nil {
+		serverError(w, r, err)
+		return
+	}
+	if p.Email == "" || !hmac.Equal([]byte(p.Token), []byte(want)) {
+		http.NotFound(w, r)
+		return
+	}
+	if r.Method == http.MethodPost {
+		if err := suppressEmail(ctx, p.Email, suppressUnsubscribe, "unsubscribe link"); err != nil {
+			serverError(w, r, err)
+			return
+		}
+		p.Done = true
+	}
+	render(w, r, "unsubscribe.html", p)
+}
+
+// emailEvent is a bounce or complaint reported by the mail provider
+type emailEvent struct {
+	Type   string `json:"type"` // "bounce" or "complaint", others are ignored
+	Email  string `json:"email"`
+	Detail string `json:"detail"`
+}
+
+// serve /webhooks/email, where the mail provider posts a JSON list of email events.
+// the secret is given as ?token= or in the X-Webhook-Token header
+func serveEmailWebhook(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	secret := os.Getenv("EMAIL_WEBHOOK_SECRET")
+	if secret == "" {
+		writeJSONError(w, http.StatusNotFound, "not found")
+		return
+	}
+	if r.Method != http.MethodPost {
+		writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	token := r.Header.Get("X-Webhook-Token")
+	if token == "" {
+		token = r.URL.Query().Get("token")
+	}
+	if subtle.ConstantTimeCompare([]byte(token), []byte(secret)) != 1 {
+		writeJSONError(w, http.StatusUnauthorized, "bad token")
+		return
+	}
+	var events []emailEvent
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<20)).Decode(&events); err != nil {
+		writeJSONError(w, http.StatusBadRequest, "the body must be a JSON list of events")
+		return
+	}
+	suppressed := 0
+	for _, e := range events {
+		if (e.Type != suppressBounce && e.Type != suppressComplaint) || !validEmail(e.Email) {
+			continue
+		}
+		if err := suppressEmail(ctx, e.Email, e.Type, e.Detail); err != nil {
+			writeInternalError(w, r, err)
+			return
+		}
+		suppressed++
+	}
+	writeJSON(w, http.StatusOK, map[string]int{"suppressed": suppressed})
+}
+
+// serve /users/{name}/email, where super-users send emails to a suppressed address again
+func serveEmailSuppression(w http.ResponseWriter, r *http.Request, member *User) {
+	ctx := r.Context()
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if requireSuperUser(w, r) == nil {
+		return
+	}
+	if err := liftSuppression(ctx, member.Email); err != nil {
+		serverError(w, r, err)
+		return
+	}
+	http.Redirect(w, r, "/users/"+url.PathEscape(member.UserName), http.StatusSeeOther)
+}
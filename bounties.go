@@ -0,0 +1,186 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// users spend reputation to put a bounty on a question without an accepted answer.
+// the question is featured while the bounty is open, then the bounty goes to the accepted answer,
+// or else to the best voted one. When no answer qualifies, the reputation is lost
+
+// limits of the amount of a bounty
+const (
+	minBounty = 50
+	maxBounty = 500
+)
+
+// how long a bounty stays open
+const bountyDuration = 7 * 24 * time.Hour
+
+var (
+	errBountyOpen       = errors.New("this question already has a bounty")
+	errBountyAccepted   = errors.New("this question already has an accepted answer")
+	errBountyAmount     = fmt.Errorf("a bounty is between %d and %d reputation", minBounty, maxBounty)
+	errBountyReputation = errors.New("you don't have enough reputation for this bounty")
+)
+
+// amount of the open bounty of a question, 0 if there is none
+const bountySQL = "(select coalesce(sum(amount), 0) from bounties where bounties.question_id = questions.id and bounties.closed_at is null)"
+
+func init() {
+	jobHandlers["bounty"] = awardBountyJob
+}
+
+// bounty is an open bounty
+type bounty struct {
+	ID      int
+	Amount  int
+	User    string // who offered the bounty
+	Expires string
+}
+
+// openBounty loads the open bounty of a question, nil if there is none
+func openBounty(ctx context.Context, questionID int) (*bounty, error) {
+	var b bounty
+	err := db.QueryRowContext(ctx, `select bounties.id, amount, users.username, expires_at from bounties
+		join users on users.id = bounties.user_id where question_id = ? and closed_at is null`, questionID).Scan(&b.ID, &b.Amount, &b.User, &b.Expires)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &b, nil
+}
+
+// offerBounty spends reputation of the user on a bounty on the question, and schedules its award
+func offerBounty(ctx context.Context, user *User, questionID, amount int) error {
+	if amount < minBounty || amount > maxBounty {
+		return errBountyAmount
+	}
+	accepted, err := acceptedAnswer(ctx, questionID)
+	if err != nil {
+		return err
+	}
+	if accepted != 0 {
+		return errBountyAccepted
+	}
+	rep, err := reputation(ctx, user)
+	if err != nil {
+		return err
+	}
+	if rep < amount {
+		return errBountyReputation
+	}
+
+	now := time.Now()
+	expires := now.Add(bountyDuration)
+	// the bounty is awarded by a job once it expires, queued with it
+	return db.WithTx(ctx, func(ctx context.Context) error {
+		var open int
+		if err := db.QueryRowContext(ctx, "select count(*) from bounties where question_id = ? and closed_at is null", questionID).Scan(&open); err != nil {
+			return err
+		}
+		if open > 0 {
+			return errBountyOpen
+		}
+		res, err := db.ExecContext(ctx, "insert into bounties (question_id, user_id, amount, created_at, expires_at) values (?, ?, ?, ?, ?)",
+			questionID, user.UniqueID, amount, now.Format(timestampLayout), expires.Format(timestampLayout))
+		if err != nil {
+			return err
+		}
+		id, err := res.LastInsertId()
+		if err != nil {
+			return err
+		}
+		db.AfterCommit(ctx, func() { forgetData("reputation:" + strings.ToLower(user.UserName)) })
+		return enqueueJobAt(ctx, "bounty", id, expires)
+	})
+}
+
+// awardBountyJob awards the bounty whose id is the payload, once it expired
+func awardBountyJob(ctx context.Context, payload []byte) error {
+	var id int
+	if err := json.Unmarshal(payload, &id); err != nil {
+		return err
+	}
+	return awardBounty(ctx, id)
+}
+
+// awardBounty closes the bounty, giving it to the accepted answer, or else to the best voted answer
+// with a positive score. Answers of the user who offered the bounty and hidden answers can't win it
+func awardBounty(ctx context.Context, id int) error {
+	var questionID, ownerID, amount int
+	var closed sql.NullString
+	err := db.QueryRowContext(ctx, "select question_id, user_id, amount, closed_at from bounties where id = ?", id).
+		Scan(&questionID, &ownerID, &amount, &closed)
+	if err == sql.ErrNoRows || closed.Valid {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	accepted, err := acceptedAnswer(ctx, questionID)
+	if err != nil {
+		return err
+	}
+	var answerID, winnerID sql.NullInt64
+	err = db.QueryRowContext(ctx, `select answers.id, users.id from answers join users on users.username = answers.user
+		where answers.question_id = ? and answers.hidden_at is null and users.id != ? and (answers.id = ? or `+answerScoreSQL+` > 0)
+		order by answers.id = ? desc, `+answerScoreSQL+` desc, answers.id limit 1`,
+		questionID, ownerID, accepted, accepted).Scan(&answerID, &winnerID)
+	if err != nil && err != sql.ErrNoRows {
+		return err
+	}
+	_, err = db.ExecContext(ctx, "update bounties set closed_at = ?, answer_id = ?, awarded_to = ? where id = ? and closed_at is null",
+		time.Now().Format(timestampLayout), answerID, winnerID, id)
+	if err != nil {
+		return err
+	}
+	questionCache.invalidate(questionID)
+	forgetDataPrefix("reputation:")
+	if winnerID.Valid {
+		err = notify(ctx, int(winnerID.Int64), fmt.Sprintf("Your answer won a bounty of %d reputation", amount),
+			fmt.Sprintf("/questions/%d#answer-%d", questionID, answerID.Int64))
+	}
+	return err
+}
+
+// handle POST /questions/{id}/bounty, which offers a bounty of the given amount on the question
+func serveBounty(w http.ResponseWriter, r *http.Request, questionID int) {
+	ctx := r.Context()
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	user := requireUser(w, r)
+	if user == nil {
+		return
+	}
+	amount, err := strconv.Atoi(r.FormValue("amount"))
+	if err != nil {
+		http.Error(w, errBountyAmount.Error(), http.StatusBadRequest)
+		return
+	}
+	switch err := offerBounty(ctx, user, questionID, amount); err {
+	case nil:
+	case errBountyAmount, errBountyAccepted, errBountyOpen:
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	case errBountyReputation:
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	default:
+		serverError(w, r, err)
+		return
+	}
+	http.Redirect(w, r, fmt.Sprintf("/questions/%d", questionID), http.StatusSeeOther)
+}
@@ -0,0 +1,389 @@
+package main
+
+import (
+	"container/list"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// the reads every render of a popular page repeats are kept in memory in front of the store:
+// the question, answers and comments of threads, the wiki and related tags of tags and the
+// reputation shown on profiles. Entries are dropped by the writes changing them: threads with
+// their cached page, see pagecache.go, tag wikis when saved, reputations on votes and bounties.
+// Related tags and reputations also expire, as they add up writes spread over many pages.
+// Removals are events, see events.go, so every instance of the app drops its entries.
+// The rendered pages are kept in a CacheStore: in memory by default, or with CACHE_STORE=redis
+// in the Redis server of REDIS_URL, shared by the instances
+
+// entries kept at most, and the longest an entry is kept
+const (
+	dataCacheSize = 5000
+	dataCacheTTL  = 5 * time.Minute
+)
+
+// lruCache is an LRU cache of values by key, whose entries also expire
+type lruCache struct {
+	mu      sync.Mutex
+	max     int
+	ttl     time.Duration
+	order   *list.List               // most recently used first
+	entries map[string]*list.Element // elements hold a *cacheEntry
+	// bumped by every removal, so a value loaded before one isn't stored
+	generation int
+}
+
+type cacheEntry struct {
+	key     string
+	value   interface{}
+	expires time.Time
+}
+
+var dataCache = newLRUCache(dataCacheSize, dataCacheTTL)
+
+func newLRUCache(max int, ttl time.Duration) *lruCache {
+	return &lruCache{max: max, ttl: ttl, order: list.New(), entries: map[string]*list.Element{}}
+}
+
+// get returns the value of the key, if it is cached and fresh
+func (c *lruCache) get(key string) (interface{}, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.entries[key]
+	if !ok {
+		return nil, false
+	}
+	entry := e.Value.(*cacheEntry)
+	if time.Now().After(entry.expires) {
+		c.order.Remove(e)
+		delete(c.entries, key)
+		return nil, false
+	}
+	c.order.MoveToFront(e)
+	return entry.value, true
+}
+
+// put caches the value of the key for ttl
+func (c *lruCache) put(key string, value interface{}, ttl time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.store(&cacheEntry{key, value, time.Now().Add(ttl)})
+}
+
+// store adds an entry, dropping the least recently used one when the cache is full
+func (c *lruCache) store(entry *cacheEntry) {
+	if e, ok := c.entries[entry.key]; ok {
+		e.Value = entry
+		c.order.MoveToFront(e)
+		return
+	}
+	c.entries[entry.key] = c.order.PushFront(entry)
+	if c.order.Len() > c.max {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(*cacheEntry).key)
+	}
+}
+
+// load returns the value of the key, loading and caching it when it isn't cached
+func (c *lruCache) load(key string, load func() (interface{}, error)) (interface{}, error) {
+	if v, ok := c.get(key); ok {
+		return v, nil
+	}
+	c.mu.Lock()
+	generation := c.generation
+	c.mu.Unlock()
+	v, err := load()
+	if err != nil {
+		return nil, err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.generation == generation {
+		c.store(&cacheEntry{key, v, time.Now().Add(c.ttl)})
+	}
+	return v, nil
+}
+
+// remove drops the keys, after a write changing their values
+func (c *lruCache) remove(keys ...string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.generation++
+	for _, key := range keys {
+		if e, ok := c.entries[key]; ok {
+			c.order.Remove(e)
+			delete(c.entries, key)
+		}
+	}
+}
+
+// removePrefix drops the keys starting with prefix
+func (c *lruCache) removePrefix(prefix string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.generation++
+	for key, e := range c.entries {
+		if strings.HasPrefix(key, prefix) {
+			c.order.Remove(e)
+			delete(c.entries, key)
+		}
+	}
+}
+
+// clear drops every entry
+func (c *lruCache) clear() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.generation++
+	c.order.Init()
+	c.entries = map[string]*list.Element{}
+}
+
+// cacheEvent is a removal from a cache, published to every instance
+type cacheEvent struct {
+	Cache  string   `json:"cache"` // data or pages
+	Keys   []string `json:"keys,omitempty"`
+	Prefix string   `json:"prefix,omitempty"`
+	Thread int      `json:"thread,omitempty"` // a question of the page cache
+	Clear  bool     `json:"clear,omitempty"`
+}
+
+func init() {
+	eventHandlers["cache"] = append(eventHandlers["cache"], func(payload []byte) {
+		var e cacheEvent
+		if err := json.Unmarshal(payload, &e); err != nil {
+			fmt.Println(err)
+			return
+		}
+		switch {
+		case e.Cache == "pages":
+			questionCache.apply(e)
+		case e.Clear:
+			dataCache.clear()
+		case e.Prefix != "":
+			dataCache.removePrefix(e.Prefix)
+		default:
+			dataCache.remove(e.Keys...)
+		}
+	})
+}
+
+// publishCacheEvent publishes a removal from a cache
+func publishCacheEvent(e cacheEvent) {
+	payload, err := json.Marshal(e)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	publish("cache", payload)
+}
+
+// forgetData drops the keys from the data cache of every instance, after a write changing them
+func forgetData(keys ...string) {
+	publishCacheEvent(cacheEvent{Cache: "data", Keys: keys})
+}
+
+// forgetDataPrefix drops the keys starting with prefix from the data cache of every instance
+func forgetDataPrefix(prefix string) {
+	publishCacheEvent(cacheEvent{Cache: "data", Prefix: prefix})
+}
+
+// CacheStore keeps cached bytes by key
+type CacheStore interface {
+	// Get returns the value of the key, false when it isn't cached or expired
+	Get(ctx context.Context, key string) ([]byte, bool, error)
+	// Set caches the value of the key for ttl
+	Set(ctx context.Context, key string, value []byte, ttl time.Duration) error
+	// Delete drops the keys
+	Delete(ctx context.Context, keys ...string) error
+	// Clear drops every key
+	Clear(ctx context.Context) error
+}
+
+// openCache sets the store of the page cache of CACHE_STORE
+func openCache() error {
+	switch name := os.Getenv("CACHE_STORE"); name {
+	case "", "memory":
+	case "redis":
+		client, err := newRedisClient(os.Getenv("REDIS_URL"))
+		if err != nil {
+			return err
+		}
+		questionCache.store = redisCache{client}
+	default:
+		return fmt.Errorf("CACHE_STORE: unknown cache store %q, use memory or redis", name)
+	}
+	return nil
+}
+
+// memoryCache keeps the values in an LRU cache of this instance
+type memoryCache struct {
+	cache *lruCache
+}
+
+func (m memoryCache) Get(ctx context.Context, key string) ([]byte, bool, error) {
+	v, ok := m.cache.get(key)
+	if !ok {
+		return nil, false, nil
+	}
+	return v.([]byte), true, nil
+}
+
+func (m memoryCache) Set(ctx context.Context, key string, value []byte, ttl time.Duration) error {
+	m.cache.put(key, value, ttl)
+	return nil
+}
+
+func (m memoryCache) Delete(ctx context.Context, keys ...string) error {
+	m.cache.remove(keys...)
+	return nil
+}
+
+func (m memoryCache) Clear(ctx context.Context) error {
+	m.cache.clear()
+	return nil
+}
+
+// redisCache keeps each value in a key expiring with it
+type redisCache struct {
+	client *redisClient
+}
+
+// prefix of the keys of the cache
+const redisCachePrefix = "qaapp:cache:"
+
+func (c redisCache) Get(ctx context.Context, key string) ([]byte, bool, error) {
+	reply, err := c.client.do(ctx, "GET", redisCachePrefix+key)
+	v, ok := reply.(string)
+	if err != nil || !ok {
+		return nil, false, err
+	}
+	return []byte(v), true, nil
+}
+
+func (c redisCache) Set(ctx context.Context, key string, value []byte, ttl time.Duration) error {
+	_, err := c.client.do(ctx, "SET", redisCachePrefix+key, string(value), "PX", strconv.FormatInt(ttl.Milliseconds(), 10))
+	return err
+}
+
+func (c redisCache) Delete(ctx context.Context, keys ...string) error {
+	args := []string{"DEL"}
+	for _, key := range keys {
+		args = append(args, redisCachePrefix+key)
+	}
+	_, err := c.client.do(ctx, args...)
+	return err
+}
+
+// Clear deletes the keys of the cache a page of the scan at a time, as keys can't be deleted by prefix
+func (c redisCache) Clear(ctx context.Context) error {
+	cursor := "0"
+	for {
+		reply, err := c.client.do(ctx, "SCAN", cursor, "MATCH", redisCachePrefix+"*", "COUNT", "100")
+		if err != nil {
+			return err
+		}
+		page, _ := reply.([]interface{})
+		if len(page) != 2 {
+			return errors.New("redis: unexpected reply to SCAN")
+		}
+		if keys := redisStrings(page[1]); len(keys) > 0 {
+			if _, err := c.client.do(ctx, append([]string{"DEL"}, keys...)...); err != nil {
+				return err
+			}
+		}
+		if cursor, _ = page[0].(string); cursor == "0" || cursor == "" {
+			return nil
+		}
+	}
+}
+
+// errNotFound stands for a missing row in a load, which isn't cached: it may be created any time
+var errNotFound = errors.New("not found")
+
+// threadKeys are the keys of the data of a thread
+func threadKeys(questionID int) []string {
+	return []string{fmt.Sprintf("question:%d", questionID), fmt.Sprintf("answers:%d", questionID), fmt.Sprintf("comments:%d", questionID)}
+}
+
+// cachedQuestion is questionByID through the cache, a copy the caller may change
+func cachedQuestion(ctx context.Context, id int) (*Question, error) {
+	v, err := dataCache.load(fmt.Sprintf("question:%d", id), func() (interface{}, error) {
+		q, err := questionByID(ctx, id)
+		if err == nil && q == nil {
+			err = errNotFound
+		}
+		return q, err
+	})
+	if err == errNotFound {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	q := *v.(*Question)
+	return &q, nil
+}
+
+// cachedAnswers is answersOf through the cache, a copy the caller may sort
+func cachedAnswers(ctx context.Context, questionID int) ([]Answer, error) {
+	v, err := dataCache.load(fmt.Sprintf("answers:%d", questionID), func() (interface{}, error) {
+		return answersOf(ctx, questionID)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return append([]Answer(nil), v.([]Answer)...), nil
+}
+
+// cachedComments is commentsOfQuestion through the cache
+func cachedComments(ctx context.Context, questionID int) ([]Comment, error) {
+	v, err := dataCache.load(fmt.Sprintf("comments:%d", questionID), func() (interface{}, error) {
+		return commentsOfQuestion(ctx, questionID)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return append([]Comment(nil), v.([]Comment)...), nil
+}
+
+// cachedTagWiki is loadTagWiki through the cache
+func cachedTagWiki(ctx context.Context, tag string) (tagWiki, error) {
+	v, err := dataCache.load("tag-wiki:"+strings.ToLower(tag), func() (interface{}, error) {
+		return loadTagWiki(ctx, tag)
+	})
+	if err != nil {
+		return tagWiki{}, err
+	}
+	return v.(tagWiki), nil
+}
+
+// cachedRelatedTags is findRelatedTags of a tag through the cache
+func cachedRelatedTags(ctx context.Context, tag string) ([]relatedTag, error) {
+	v, err := dataCache.load("related-tags:"+tag, func() (interface{}, error) {
+		return findRelatedTags(ctx, []string{tag}, maxRelatedTags)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return v.([]relatedTag), nil
+}
+
+// cachedReputation is the reputation of a user through the cache, for display only:
+// what reputation allows is checked with reputation
+func cachedReputation(ctx context.Context, user *User) (int, error) {
+	v, err := dataCache.load("reputation:"+strings.ToLower(user.UserName), func() (interface{}, error) {
+		return reputation(ctx, user)
+	})
+	if err != nil {
+		return 0, err
+	}
+	return v.(int), nil
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// users subscribe to their calendar from calendar apps, which can't log in,
+// so the url of the calendar carries a token signed with a secret of the site
+
+// layout of the dates of iCalendar, in UTC. See RFC 5545
+const icsTimeLayout = "20060102T150405Z"
+
+// appSecret loads the named secret of the site, generating it the first time
+func appSecret(ctx context.Context, name string) ([]byte, error) {
+	var value string
+	err := db.QueryRowContext(ctx, "select value from app_secrets where name = ?", name).Scan(&value)
+	if err == sql.ErrNoRows {
+		if _, err := db.ExecContext(ctx, "insert or ignore into app_secrets (name, value) values (?, ?)", name, newToken()); err != nil {
+			return nil, err
+		}
+		err = db.QueryRowContext(ctx, "select value from app_secrets where name = ?", name).Scan(&value)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return []byte(value), nil
+}
+
+// calendarToken signs the id of the user for the url of their calendar
+func calendarToken(ctx context.Context, userID int) (string, error) {
+	secret, err := appSecret(ctx, "calendar")
+	if err != nil {
+		return "", err
+	}
+	mac := hmac.New(sha256.New, secret)
+	fmt.Fprintf(mac, "calendar:%d", userID)
+	return hex.EncodeToString(mac.Sum(nil)), nil
+}
+
+// calendarURL is the path of the calendar of the user
+func calendarURL(ctx context.Context, user *User) (string, error) {
+	token, err := calendarToken(ctx, user.UniqueID)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("/calendar.ics?user=%d&token=%s", user.UniqueID, token), nil
+}
+
+// icsText escapes a value of iCalendar text
+var icsText = strings.NewReplacer(`\`, `\\`, ";", `\;`, ",", `\,`, "\r\n", `\n`, "\n", `\n`)
+
+// writeICSLine writes a content line, folded to 75 octets as RFC 5545 asks
+func writeICSLine(b *strings.Builder, line string) {
+	for len(line) > 75 {
+		cut := 75
+		// don't split a multi-byte character
+		for cut > 0 && line[cut]&0xC0 == 0x80 {
+			cut--
+		}
+		b.WriteString(line[:cut] + "\r\n ")
+		line = line[cut:]
+	}
+	b.WriteString(line + "\r\n")
+}
+
+// serve /calendar.ics, the scheduled exams as an iCalendar feed for the user of the token
+func serveCalendar(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	userID, err := strconv.Atoi(r.FormValue("user"))
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	token, err := calendarToken(ctx, userID)
+	if err != nil {
+		serverError(w, r, err)
+		return
+	}
+	if !hmac.Equal([]byte(token), []byte(r.FormValue("token"))) {
+		http.NotFound(w, r)
+		return
+	}
+	windows, err := examWindows(ctx, false)
+	if err != nil {
+		serverError(w, r, err)
+		return
+	}
+
+	var b strings.Builder
+	now := time.Now().UTC().Format(icsTimeLayout)
+	writeICSLine(&b, "BEGIN:VCALENDAR")
+	writeICSLine(&b, "VERSION:2.0")
+	writeICSLine(&b, "PRODID:-//QA Learning//Calendar//EN")
+	writeICSLine(&b, "X-WR-CALNAME:QA Learning")
+	for _, e := range windows {
+		starts, err1 := time.ParseInLocation(timestampLayout, e.Starts, time.Local)
+		ends, err2 := time.ParseInLocation(timestampLayout, e.Ends, time.Local)
+		if err1 != nil || err2 != nil {
+			continue
+		}
+		description := "Questions are hidden during the exam."
+		if len(e.Tags) > 0 {
+			description = "Questions tagged " + strings.Join(e.Tags, ", ") + " are hidden during the exam."
+		}
+		writeICSLine(&b, "BEGIN:VEVENT")
+		writeICSLine(&b, fmt.Sprintf("UID:exam-%d@%s", e.ID, r.Host))
+		writeICSLine(&b, "DTSTAMP:"+now)
+		writeICSLine(&b, "DTSTART:"+starts.UTC().Format(icsTimeLayout))
+		writeICSLine(&b, "DTEND:"+ends.UTC().Format(icsTimeLayout))
+		writeICSLine(&b, "SUMMARY:"+icsText.Replace(e.Title))
+		writeICSLine(&b, "DESCRIPTION:"+icsText.Replace(description))
+		writeICSLine(&b, "END:VEVENT")
+	}
+	writeICSLine(&b, "END:VCALENDAR")
+
+	w.Header().Set("Content-Type", "text/calendar; charset=utf-8")
+	w.Write([]byte(b.String()))
+}
@@ -0,0 +1,339 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html/template"
+	"math/big"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// a CAPTCHA is asked on registration, on login after repeated failures, and when flagging.
+// CAPTCHA_PROVIDER chooses the provider: hcaptcha or recaptcha, with CAPTCHA_SITE_KEY and
+// CAPTCHA_SECRET, or altcha, a proof of work checked here without any third party. Without it
+// no CAPTCHA is asked
+
+// captchaProvider checks that a form was sent by a person
+type captchaProvider interface {
+	// Script loads the widget, once per page
+	Script() template.HTML
+	// Widget is put in the forms to check
+	Widget() template.HTML
+	// Verify tells if the response of the widget in the form is right
+	Verify(ctx context.Context, r *http.Request) (bool, error)
+}
+
+// captchaProviders make the providers by name, with the site key and the secret
+var captchaProviders = map[string]func(siteKey, secret string) captchaProvider{
+	"hcaptcha": func(siteKey, secret string) captchaProvider {
+		return &siteVerifyCaptcha{
+			script:   "https://js.hcaptcha.com/1/api.js",
+			class:    "h-captcha",
+			field:    "h-captcha-response",
+			endpoint: "https://api.hcaptcha.com/siteverify",
+			siteKey:  siteKey,
+			secret:   secret,
+		}
+	},
+	"recaptcha": func(siteKey, secret string) captchaProvider {
+		return &siteVerifyCaptcha{
+			script:   "https://www.google.com/recaptcha/api.js",
+			class:    "g-recaptcha",
+			field:    "g-recaptcha-response",
+			endpoint: "https://www.google.com/recaptcha/api/siteverify",
+			siteKey:  siteKey,
+			secret:   secret,
+		}
+	},
+	"altcha": func(_, _ string) captchaProvider { return newAltcha() },
+}
+
+var (
+	captchaOnce sync.Once
+	captcha     captchaProvider // nil when disabled
+)
+
+// currentCaptcha is the provider of CAPTCHA_PROVIDER, nil when no CAPTCHA is asked
+func currentCaptcha() captchaProvider {
+	captchaOnce.Do(func() {
+		name := strings.ToLower(os.Getenv("CAPTCHA_PROVIDER"))
+		if name == "" || name == "none" {
+			return
+		}
+		newProvider, ok := captchaProviders[name]
+		if !ok {
+			fmt.Printf("CAPTCHA_PROVIDER: unknown provider %q, no CAPTCHA is asked\n", name)
+			return
+		}
+		captcha = newProvider(os.Getenv("CAPTCHA_SITE_KEY"), os.Getenv("CAPTCHA_SECRET"))
+	})
+	return captcha
+}
+
+var errCaptcha = errors.New("please confirm you are not a robot")
+
+// checkCaptcha verifies the CAPTCHA of the form, errCaptcha when it is wrong or missing
+func checkCaptcha(r *http.Request) error {
+	c := currentCaptcha()
+	if c == nil {
+		return nil
+	}
+	ok, err := c.Verify(r.Context(), r)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return errCaptcha
+	}
+	return nil
+}
+
+// captchaScript and captchaWidget are the template functions of the CAPTCHA, empty when disabled
+func captchaScript() template.HTML {
+	if c := currentCaptcha(); c != nil {
+		return c.Script()
+	}
+	return ""
+}
+
+func captchaWidget() template.HTML {
+	if c := currentCaptcha(); c != nil {
+		return c.Widget()
+	}
+	return ""
+}
+
+// siteVerifyCaptcha is a provider verifying the responses with its siteverify API, like
+// hCaptcha and reCAPTCHA
+type siteVerifyCaptcha struct {
+	script, class, field, endpoint string
+	siteKey, secret                string
+}
+
+var captchaClient = &http.Client{Timeout: 10 * time.Second}
+
+func (c *siteVerifyCaptcha) Script() template.HTML {
+	return template.HTML(`<script src="` + template.HTMLEscapeString(c.script) + `" async defer></script>`)
+}
+
+func (c *siteVerifyCaptcha) Widget() template.HTML {
+	return template.HTML(fmt.Sprintf(`<div class="%s" data-sitekey="%s"></div>`, c.class, template.HTMLEscapeString(c.siteKey)))
+}
+
+func (c *siteVerifyCaptcha) Verify(ctx context.Context, r *http.Request) (bool, error) {
+	response := r.FormValue(c.field)
+	if response == "" {
+		return false, nil
+	}
+	form := url.Values{"secret": {c.secret}, "response": {response}, "remoteip": {clientIP(r)}}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.endpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	resp, err := captchaClient.Do(req)
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+	var result struct {
+		Success bool `json:"success"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return false, fmt.Errorf("%s: %v", c.endpoint, err)
+	}
+	return result.Success, nil
+}
+
+// altcha is a self-hosted proof of work: the browser finds the number whose hash with a random
+// salt is the challenge, signed here so the server keeps nothing until the answer comes back.
+// Answered challenges are kept until they expire, so each can only be used once
+type altcha struct {
+	mu   sync.Mutex
+	used map[string]time.Time // answered challenges, until they expire
+}
+
+// how hard the challenges are, and how long they can be answered
+const (
+	altchaMaxNumber = 100000
+	altchaTTL       = 10 * time.Minute
+)
+
+func newAltcha() *altcha {
+	return &altcha{used: map[string]time.Time{}}
+}
+
+func (a *altcha) Script() template.HTML {
+	return `<script type="module" src="https://cdn.jsdelivr.net/npm/altcha@0.9/dist/altcha.min.js" async defer></script>`
+}
+
+func (a *altcha) Widget() template.HTML {
+	return `<altcha-widget challengeurl="/captcha/challenge" hidefooter></altcha-widget>`
+}
+
+// altchaChallenge is a challenge, and with number the answer of the widget
+type altchaChallenge struct {
+	Algorithm string `json:"algorithm"`
+	Challenge string `json:"challenge"`
+	MaxNumber int    `json:"maxnumber,omitempty"`
+	Number    int    `json:"number,omitempty"`
+	Salt      string `json:"salt"`
+	Signature string `json:"signature"`
+}
+
+// sign signs the challenge with the secret of the app
+func (a *altcha) sign(ctx context.Context, challenge string) (string, error) {
+	secret, err := appSecret(ctx, "altcha")
+	if err != nil {
+		return "", err
+	}
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(challenge))
+	return hex.EncodeToString(mac.Sum(nil)), nil
+}
+
+// hash is the challenge of the salt and the number
+func (a *altcha) hash(salt string, number int) string {
+	sum := sha256.Sum256([]byte(salt + strconv.Itoa(number)))
+	return hex.EncodeToString(sum[:])
+}
+
+// newChallenge makes a challenge, expiring after altchaTTL
+func (a *altcha) newChallenge(ctx context.Context) (altchaChallenge, error) {
+	n, err := rand.Int(rand.Reader, big.NewInt(altchaMaxNumber))
+	if err != nil {
+		return altchaChallenge{}, err
+	}
+	salt := newToken()[:24] + "?expires=" + strconv.FormatInt(time.Now().Add(altchaTTL).Unix(), 10)
+	c := altchaChallenge{Algorithm: "SHA-256", Challenge: a.hash(salt, int(n.Int64())), MaxNumber: altchaMaxNumber, Salt: salt}
+	c.Signature, err = a.sign(ctx, c.Challenge)
+	return c, err
+}
+
+func (a *altcha) Verify(ctx context.Context, r *http.Request) (bool, error) {
+	payload, err := base64.StdEncoding.DecodeString(r.FormValue("altcha"))
+	if err != nil {
+		return false, nil
+	}
+	var c altchaChallenge
+	if err := json.Unmarshal(payload, &c); err != nil || c.Algorithm != "SHA-256" {
+		return false, nil
+	}
+	_, params, _ := strings.Cut(c.Salt, "?")
+	values, _ := url.ParseQuery(params)
+	expires, err := strconv.ParseInt(values.Get("expires"), 10, 64)
+	if err != nil || time.Now().Unix() > expires {
+		return false, nil
+	}
+	signature, err := a.sign(ctx, c.Challenge)
+	if err != nil {
+		return false, err
+	}
+	if !hmac.Equal([]byte(signature), []byte(c.Signature)) || a.hash(c.Salt, c.Number) != c.Challenge {
+		return false, nil
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	now := time.Now()
+	for challenge, until := range a.used {
+		if now.After(until) {
+			delete(a.used, challenge)
+		}
+	}
+	if _, ok := a.used[c.Challenge]; ok {
+		return false, nil
+	}
+	a.used[c.Challenge] = time.Unix(expires, 0)
+	return true, nil
+}
+
+// serve /captcha/challenge, the challenges of the altcha widget
+func serveCaptchaChallenge(w http.ResponseWriter, r *http.Request) {
+	a, ok := currentCaptcha().(*altcha)
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	c, err := a.newChallenge(r.Context())
+	if err != nil {
+		writeInternalError(w, r, err)
+		return
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	writeJSON(w, http.StatusOK, c)
+}
+
+// failed logins are counted by address and by username. After loginFailureLimit failures in
+// loginFailureWindow, logging in takes a CAPTCHA
+const (
+	loginFailureLimit  = 3
+	loginFailureWindow = 15 * time.Minute
+)
+
+// loginFailures are the recent failed logins, by key
+var loginFailures = struct {
+	sync.Mutex
+	times map[string][]time.Time
+}{times: map[string][]time.Time{}}
+
+// loginFailureKeys are the keys a failed login is counted under
+func loginFailureKeys(r *http.Request, username string) []string {
+	return []string{"ip:" + clientIP(r), "user:" + strings.ToLower(username)}
+}
+
+// recordLoginFailure counts a failed login
+func recordLoginFailure(r *http.Request, username string) {
+	loginFailures.Lock()
+	defer loginFailures.Unlock()
+	now := time.Now()
+	for _, key := range loginFailureKeys(r, username) {
+		loginFailures.times[key] = append(recentFailures(key, now), now)
+	}
+	// forget the keys that have nothing recent once in a while
+	if len(loginFailures.times) > 10000 {
+		for key := range loginFailures.times {
+			if len(recentFailures(key, now)) == 0 {
+				delete(loginFailures.times, key)
+			}
+		}
+	}
+}
+
+// recentFailures are the failures of the key in the window, loginFailures being locked
+func recentFailures(key string, now time.Time) []time.Time {
+	times := loginFailures.times[key]
+	for len(times) > 0 && now.Sub(times[0]) > loginFailureWindow {
+		times = times[1:]
+	}
+	return times
+}
+
+// loginNeedsCaptcha tells if logging in takes a CAPTCHA, after repeated failures
+func loginNeedsCaptcha(r *http.Request, username string) bool {
+	if currentCaptcha() == nil {
+		return false
+	}
+	loginFailures.Lock()
+	defer loginFailures.Unlock()
+	now := time.Now()
+	for _, key := range loginFailureKeys(r, username) {
+		if len(recentFailures(key, now)) >= loginFailureLimit {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// changelogEntry is an announcement of the what's new page
+type changelogEntry struct {
+	ID        int
+	Title     string
+	Body      string
+	Published string
+	Author    string
+}
+
+// load the changelog, newest first
+func changelogEntries(ctx context.Context) ([]changelogEntry, error) {
+	rows, err := db.QueryContext(ctx, `select changelog.id, title, body, published_at, coalesce(users.username, '')
+		from changelog left join users on users.id = changelog.user_id order by changelog.id desc`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var entries []changelogEntry
+	for rows.Next() {
+		var e changelogEntry
+		if err := rows.Scan(&e.ID, &e.Title, &e.Body, &e.Published, &e.Author); err != nil {
+			return nil, err
+		}
+		entries = append(entries, e)
+	}
+	return entries, rows.Err()
+}
+
+// unreadChanges counts the changelog entries published since the user last opened the what's new page
+func unreadChanges(ctx context.Context, user *User) int {
+	if user == nil {
+		return 0
+	}
+	var n int
+	err := db.QueryRowContext(ctx, `select count(*) from changelog where id > coalesce(
+		(select last_entry_id from changelog_reads where user_id = ?), 0)`, user.UniqueID).Scan(&n)
+	if err != nil {
+		return 0
+	}
+	return n
+}
+
+// serve /whats-new, marking the changelog as read for the user
+func serveWhatsNew(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	entries, err := changelogEntries(ctx)
+	if err != nil {
+		serverError(w, r, err)
+		return
+	}
+	if user := currentUser(r); user != nil && len(entries) > 0 {
+		_, err := db.ExecContext(ctx, "insert or replace into changelog_reads (user_id, last_entry_id) values (?, ?)", user.UniqueID, entries[0].ID)
+		if err != nil {
+			serverError(w, r, err)
+			return
+		}
+	}
+	render(w, r, "whats-new.html", entries)
+}
+
+// serve /admin/changelog, where super-users publish and remove announcements
+func serveChangelogAdmin(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	user := requireSuperUser(w, r)
+	if user == nil {
+		return
+	}
+	if r.Method == http.MethodPost {
+		var err error
+		if r.FormValue("action") == "remove" {
+			id, _ := strconv.Atoi(r.FormValue("id"))
+			_, err = db.ExecContext(ctx, "delete from changelog where id = ?", id)
+		} else {
+			title := strings.TrimSpace(r.FormValue("title"))
+			body := strings.TrimSpace(r.FormValue("body"))
+			if title == "" {
+				http.Error(w, "the title can't be empty", http.StatusBadRequest)
+				return
+			}
+			_, err = db.ExecContext(ctx, "insert into changelog (title, body, published_at, user_id) values (?, ?, ?, ?)",
+				title, body, time.Now().Format(timestampLayout), user.UniqueID)
+		}
+		if err != nil {
+			serverError(w, r, err)
+			return
+		}
+		http.Redirect(w, r, "/admin/changelog", http.StatusSeeOther)
+		return
+	}
+	entries, err := changelogEntries(ctx)
+	if err != nil {
+		serverError(w, r, err)
+		return
+	}
+	render(w, r, "changelog-admin.html", entries)
+}
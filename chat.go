@@ -0,0 +1,244 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// new questions are posted to Slack or Discord channels through their incoming webhooks, so a class
+// channel sees the activity of the site. Super-users add channels at /admin/channels, for the
+// questions outside of courses or for those of a course, and teachers add the channels of their
+// courses on the page of the course. A channel may only want the questions of some tags. Questions
+// of a course only go to its channels, and questions held for review to none
+
+// kinds of channel, by the service of its webhook
+const (
+	chatSlack   = "slack"
+	chatDiscord = "discord"
+)
+
+var chatKinds = []string{chatSlack, chatDiscord}
+
+var errChatChannel = errors.New("a channel has a kind, slack or discord, and the https URL of an incoming webhook")
+
+func init() {
+	jobHandlers["chat"] = sendChatJob
+}
+
+// chatChannel is a channel new questions are posted to
+type chatChannel struct {
+	ID         int
+	Kind       string
+	URL        string   // of the incoming webhook, a secret
+	Tags       []string // empty for all
+	CourseID   int      // 0 for the questions outside of courses
+	CourseName string
+}
+
+// wants tells if the channel takes a question with the tags
+func (c chatChannel) wants(tags []string) bool {
+	if len(c.Tags) == 0 {
+		return true
+	}
+	for _, want := range c.Tags {
+		for _, t := range tags {
+			if strings.EqualFold(want, t) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+const chatChannelColumns = `chat_channels.id, chat_channels.kind, chat_channels.url, chat_channels.tags,
+	coalesce(chat_channels.course_id, 0), coalesce(courses.name, '')`
+
+// chatChannels lists the channels, of a course or with courseID -1 all of them
+func chatChannels(ctx context.Context, courseID int) ([]chatChannel, error) {
+	var channels []chatChannel
+	err := queryList(ctx, "select "+chatChannelColumns+` from chat_channels left join courses on courses.id = chat_channels.course_id
+		where ? < 0 or coalesce(chat_channels.course_id, 0) = ? order by chat_channels.id`, []interface{}{courseID, courseID}, func(rows *sql.Rows) error {
+		var c chatChannel
+		var tags string
+		err := rows.Scan(&c.ID, &c.Kind, &c.URL, &tags, &c.CourseID, &c.CourseName)
+		c.Tags = splitTags(tags)
+		channels = append(channels, c)
+		return err
+	})
+	return channels, err
+}
+
+// addChatChannel registers a channel for the questions of a course, or outside of courses with courseID 0
+func addChatChannel(ctx context.Context, user *User, kind, url, tags string, courseID int) error {
+	url = strings.TrimSpace(url)
+	if (kind != chatSlack && kind != chatDiscord) || !httpsURL(url) {
+		return errChatChannel
+	}
+	_, err := db.ExecContext(ctx, "insert into chat_channels (kind, url, tags, course_id, user_id, created_at) values (?, ?, ?, ?, ?, ?)",
+		kind, url, strings.Join(splitTags(strings.ToLower(tags)), ","), sql.NullInt64{Int64: int64(courseID), Valid: courseID != 0},
+		user.UniqueID, time.Now().Format(timestampLayout))
+	return err
+}
+
+// chatMessage is the payload of the chat job: a new question to post to a channel
+type chatMessage struct {
+	Channel int
+	Heading string
+	Author  string // empty for an anonymous question
+	Tags    []string
+	URL     string
+}
+
+// postToChannels queues the post of a new question to the channels wanting it
+func postToChannels(ctx context.Context, author *User, anonymous bool, questionID int, heading string, tags []string) error {
+	var courseID sql.NullInt64
+	if err := db.QueryRowContext(ctx, "select course_id from questions where id = ?", questionID).Scan(&courseID); err != nil {
+		return err
+	}
+	channels, err := chatChannels(ctx, int(courseID.Int64))
+	if err != nil {
+		return err
+	}
+	m := chatMessage{Heading: heading, Tags: tags, URL: fmt.Sprintf("%s/questions/%d", siteURL(), questionID)}
+	if !anonymous {
+		m.Author = author.UserName
+	}
+	for _, c := range channels {
+		if !c.wants(tags) {
+			continue
+		}
+		m.Channel = c.ID
+		if err := enqueueJob(ctx, "chat", m); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// chatText is the line announcing the question, before its link
+func (m *chatMessage) chatText() string {
+	author := m.Author
+	if author == "" {
+		author = "anonymous"
+	}
+	text := "New question by " + author
+	if len(m.Tags) > 0 {
+		text += " in " + strings.Join(m.Tags, ", ")
+	}
+	return text
+}
+
+// slackEscaper escapes the characters Slack reads as markup, see api.slack.com/reference/surfaces/formatting
+var slackEscaper = strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;")
+
+// sendChatJob posts a new question to its channel, in the format of the service
+func sendChatJob(ctx context.Context, payload []byte) error {
+	var m chatMessage
+	if err := json.Unmarshal(payload, &m); err != nil {
+		return err
+	}
+	var kind, url string
+	err := db.QueryRowContext(ctx, "select kind, url from chat_channels where id = ?", m.Channel).Scan(&kind, &url)
+	if err == sql.ErrNoRows {
+		// removed since
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var body interface{}
+	switch kind {
+	case chatSlack:
+		body = map[string]string{"text": slackEscaper.Replace(m.chatText()) + ": <" + m.URL + "|" + slackEscaper.Replace(m.Heading) + ">"}
+	case chatDiscord:
+		// the text of a question mentions no one on the server
+		body = map[string]interface{}{
+			"content":          m.chatText() + ": " + m.Heading + "\n" + m.URL,
+			"allowed_mentions": map[string][]string{"parse": {}},
+		}
+	default:
+		return fmt.Errorf("unknown chat kind %q", kind)
+	}
+	data, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := webhookClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("%s answered %s", kind, resp.Status)
+	}
+	return nil
+}
+
+type channelsPage struct {
+	Channels []chatChannel
+	Courses  []course
+	Kinds    []string
+	Error    string
+}
+
+// serve /admin/channels, where super-users add and remove the channels of any course, or of none
+func serveChannelsAdmin(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	user := requireSuperUser(w, r)
+	if user == nil {
+		return
+	}
+	p := channelsPage{Kinds: chatKinds}
+	if r.Method == http.MethodPost {
+		var err error
+		switch r.FormValue("action") {
+		case "add":
+			courseID, _ := strconv.Atoi(r.FormValue("course"))
+			err = addChatChannel(ctx, user, r.FormValue("kind"), r.FormValue("url"), r.FormValue("tags"), courseID)
+		case "remove":
+			_, err = db.ExecContext(ctx, "delete from chat_channels where id = ?", r.FormValue("id"))
+		default:
+			http.Error(w, "Bad Request", http.StatusBadRequest)
+			return
+		}
+		if err == errChatChannel {
+			p.Error = err.Error()
+		} else if err != nil {
+			serverError(w, r, err)
+			return
+		} else {
+			http.Redirect(w, r, "/admin/channels", http.StatusSeeOther)
+			return
+		}
+	}
+	var err error
+	if p.Channels, err = chatChannels(ctx, -1); err != nil {
+		serverError(w, r, err)
+		return
+	}
+	if err := queryList(ctx, "select id, name from courses order by name, id", nil, func(rows *sql.Rows) error {
+		var c course
+		err := rows.Scan(&c.ID, &c.Name)
+		p.Courses = append(p.Courses, c)
+		return err
+	}); err != nil {
+		serverError(w, r, err)
+		return
+	}
+	render(w, r, "channels-admin.html", p)
+}
@@ -0,0 +1,286 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// users with CLOSE_VOTE_REPUTATION reputation, 250 by default, vote to close a question, giving
+// a reason, and to reopen a closed one. The question closes, or reopens, with CLOSE_VOTES votes,
+// 3 by default, the vote of a moderator being enough alone. Closed questions take no new answers.
+// Votes count for CLOSE_VOTE_LIFETIME, 96h by default, and the close-votes maintenance task
+// deletes the older ones, so a question doesn't close on votes gathered over months
+
+const (
+	defaultCloseVotes          = 3
+	defaultCloseVoteReputation = 250
+	defaultCloseVoteLifetime   = 96 * time.Hour
+)
+
+// kinds of close votes
+const (
+	voteClose  = "close"
+	voteReopen = "reopen"
+)
+
+// closeReasons are the reasons to close a question
+var closeReasons = []string{"duplicate", "off-topic", "unclear", "too broad", "opinion-based"}
+
+var (
+	errCloseVoted  = errors.New("you already voted on this")
+	errCloseState  = errors.New("the question was closed or reopened meanwhile")
+	errCloseReason = errors.New("choose a reason among " + strings.Join(closeReasons, ", "))
+)
+
+// closeVotesNeeded is the number of votes closing or reopening a question
+func closeVotesNeeded() int {
+	if n, err := strconv.Atoi(os.Getenv("CLOSE_VOTES")); err == nil && n > 0 {
+		return n
+	}
+	return defaultCloseVotes
+}
+
+// closeVoteReputation is the reputation needed to vote to close or reopen questions
+func closeVoteReputation() int {
+	if n, err := strconv.Atoi(os.Getenv("CLOSE_VOTE_REPUTATION")); err == nil && n >= 0 {
+		return n
+	}
+	return defaultCloseVoteReputation
+}
+
+// closeVoteLifetime is how long close and reopen votes count
+func closeVoteLifetime() time.Duration {
+	if d, err := time.ParseDuration(os.Getenv("CLOSE_VOTE_LIFETIME")); err == nil && d > 0 {
+		return d
+	}
+	return defaultCloseVoteLifetime
+}
+
+// closure is the closing of a question
+type closure struct {
+	At     string
+	Reason string
+}
+
+// questionClosure is the closing of the question, nil if it is open
+func questionClosure(ctx context.Context, questionID int) (*closure, error) {
+	var at, reason sql.NullString
+	err := db.QueryRowContext(ctx, "select closed_at, close_reason from questions where id = ?", questionID).Scan(&at, &reason)
+	if err == sql.ErrNoRows || (err == nil && !at.Valid) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &closure{At: at.String, Reason: reason.String}, nil
+}
+
+// closeVoting is where the votes on closing or reopening a question stand, for the user
+type closeVoting struct {
+	Kind    string // voteClose for an open question, voteReopen for a closed one
+	Votes   int    // counting
+	Needed  int
+	Voted   bool
+	Allowed bool // the user may vote
+	Reasons []string
+}
+
+// questionCloseVoting loads the votes on closing the question, or reopening it when closed
+func questionCloseVoting(ctx context.Context, user *User, questionID int, closed bool) (closeVoting, error) {
+	v := closeVoting{Kind: voteClose, Needed: closeVotesNeeded(), Reasons: closeReasons}
+	if closed {
+		v.Kind = voteReopen
+	}
+	if user == nil {
+		return v, nil
+	}
+	err := db.QueryRowContext(ctx, `select count(*), coalesce(sum(user_id = ?), 0) from close_votes
+		where question_id = ? and kind = ? and created_at >= ?`,
+		user.UniqueID, questionID, v.Kind, time.Now().Add(-closeVoteLifetime()).Format(timestampLayout)).Scan(&v.Votes, &v.Voted)
+	if err != nil {
+		return v, err
+	}
+	v.Allowed, err = canCloseVote(ctx, user)
+	return v, err
+}
+
+// canCloseVote tells if the user may vote to close and reopen questions
+func canCloseVote(ctx context.Context, user *User) (bool, error) {
+	if user == nil {
+		return false, nil
+	}
+	if isModerator(user) {
+		return true, nil
+	}
+	rep, err := reputation(ctx, user)
+	return rep >= closeVoteReputation(), err
+}
+
+// castCloseVote records the vote of the user to close the question, for a reason, or to reopen
+// it. It tells if the vote closed or reopened the question
+func castCloseVote(ctx context.Context, user *User, questionID int, kind, reason string) (done bool, err error) {
+	now := time.Now()
+	err = db.WithTx(ctx, func(ctx context.Context) error {
+		var closedAt sql.NullString
+		if err := db.QueryRowContext(ctx, "select closed_at from questions where id = ?", questionID).Scan(&closedAt); err != nil {
+			return err
+		}
+		if closedAt.Valid != (kind == voteReopen) {
+			return errCloseState
+		}
+		// a vote older than the lifetime is cast anew
+		cutoff := now.Add(-closeVoteLifetime()).Format(timestampLayout)
+		if _, err := db.ExecContext(ctx, "delete from close_votes where question_id = ? and user_id = ? and kind = ? and created_at < ?",
+			questionID, user.UniqueID, kind, cutoff); err != nil {
+			return err
+		}
+		res, err := db.ExecContext(ctx, "insert or ignore into close_votes (question_id, user_id, kind, reason, created_at) values (?, ?, ?, ?, ?)",
+			questionID, user.UniqueID, kind, reason, now.Format(timestampLayout))
+		if err != nil {
+			return err
+		}
+		if n, err := res.RowsAffected(); err != nil {
+			return err
+		} else if n == 0 {
+			return errCloseVoted
+		}
+		var votes int
+		if err := db.QueryRowContext(ctx, "select count(*) from close_votes where question_id = ? and kind = ? and created_at >= ?",
+			questionID, kind, cutoff).Scan(&votes); err != nil {
+			return err
+		}
+		if votes < closeVotesNeeded() && !isModerator(user) {
+			return nil
+		}
+		done = true
+		if kind == voteReopen {
+			_, err = db.ExecContext(ctx, "update questions set closed_at = null, close_reason = null where id = ?", questionID)
+		} else {
+			// the question closes for the reason most voters gave, the earliest given on a tie.
+			// A moderator closes it for theirs
+			if !isModerator(user) {
+				err = db.QueryRowContext(ctx, `select reason from close_votes where question_id = ? and kind = ? and created_at >= ?
+					group by reason order by count(*) desc, min(id) limit 1`, questionID, kind, cutoff).Scan(&reason)
+				if err != nil {
+					return err
+				}
+			}
+			_, err = db.ExecContext(ctx, "update questions set closed_at = ?, close_reason = ? where id = ?",
+				now.Format(timestampLayout), reason, questionID)
+		}
+		if err != nil {
+			return err
+		}
+		// the votes were counted, the next ones start over
+		_, err = db.ExecContext(ctx, "delete from close_votes where question_id = ?", questionID)
+		return err
+	})
+	return done, err
+}
+
+// requireUnclosed answers 403 and returns false when the question is closed
+func requireUnclosed(w http.ResponseWriter, r *http.Request, questionID int) bool {
+	c, err := questionClosure(r.Context(), questionID)
+	if err != nil {
+		serverError(w, r, err)
+		return false
+	}
+	if c != nil {
+		http.Error(w, "this question is closed as "+c.Reason+", it takes no new answers", http.StatusForbidden)
+		return false
+	}
+	return true
+}
+
+// handle POST /questions/{id}/close, a vote to close the question for the reason of the form, and
+// /questions/{id}/reopen, a vote to reopen it
+func serveCloseVote(w http.ResponseWriter, r *http.Request, questionID int, kind string) {
+	ctx := r.Context()
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	user := requireUser(w, r)
+	if user == nil {
+		return
+	}
+	if ok, err := canCloseVote(ctx, user); err != nil {
+		serverError(w, r, err)
+		return
+	} else if !ok {
+		http.Error(w, fmt.Sprintf("voting to close and reopen questions takes %d reputation", closeVoteReputation()), http.StatusForbidden)
+		return
+	}
+	reason := ""
+	if kind == voteClose {
+		reason = r.FormValue("reason")
+		valid := false
+		for _, c := range closeReasons {
+			valid = valid || c == reason
+		}
+		if !valid {
+			http.Error(w, errCloseReason.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	done, err := castCloseVote(ctx, user, questionID, kind, reason)
+	switch err {
+	case nil:
+	case sql.ErrNoRows:
+		http.NotFound(w, r)
+		return
+	case errCloseVoted, errCloseState:
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	default:
+		serverError(w, r, err)
+		return
+	}
+	if done {
+		if isModerator(user) {
+			err = recordAudit(ctx, user, auditCloseQuestion, postQuestion, strconv.Itoa(questionID),
+				map[string]bool{"closed": kind == voteReopen}, map[string]interface{}{"closed": kind == voteClose, "reason": reason})
+		}
+		if err == nil {
+			err = notifyClosure(ctx, user, questionID, kind)
+		}
+		if err != nil {
+			serverError(w, r, err)
+			return
+		}
+	}
+	http.Redirect(w, r, fmt.Sprintf("/questions/%d", questionID), http.StatusSeeOther)
+}
+
+// notifyClosure tells the author of the question it was closed or reopened, unless they did it
+func notifyClosure(ctx context.Context, user *User, questionID int, kind string) error {
+	var authorID int
+	var heading string
+	err := db.QueryRowContext(ctx, `select users.id, questions.heading from questions
+		join users on lower(users.username) = lower(questions.user) where questions.id = ?`, questionID).Scan(&authorID, &heading)
+	if err == sql.ErrNoRows || (err == nil && authorID == user.UniqueID) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	msg := "Your question \"" + heading + "\" was closed"
+	if kind == voteReopen {
+		msg = "Your question \"" + heading + "\" was reopened"
+	}
+	return notify(ctx, authorID, msg, fmt.Sprintf("/questions/%d", questionID))
+}
+
+// expireCloseVotes deletes the close and reopen votes older than CLOSE_VOTE_LIFETIME
+func expireCloseVotes(ctx context.Context) error {
+	_, err := db.ExecContext(ctx, "delete from close_votes where created_at < ?",
+		time.Now().Add(-closeVoteLifetime()).Format(timestampLayout))
+	return err
+}
@@ -1,15 +1,17 @@
 package main
 
 import (
-	"database/sql"
+	"bytes"
+	"context"
+	"flag"
 	"fmt"
 	"html/template"
 	"log"
+	"net"
 	"net/http"
 	"os"
 	"path/filepath"
-
-	_ "github.com/mattn/go-sqlite3"
+	"time"
 )
 
 type User struct {
@@ -20,7 +22,11 @@ type User struct {
 	Questions     []Question // array containing history of questions posted by the user
 	Answers       []Answer   // array containing history of answers posted by the user
 	Notifications []string   // array containing notifications accumulated for the user since last login
-	Password      string     // need to encrypt this with bcrypt
+	Password      string     // bcrypt hash of the password
+	Email         string     // email address for notifications, optional
+	Language      string     // code of the language the user chose for the pages, empty to follow the browser
+	Banned        bool       // banned users can't log in
+	Suspension    string     // end of the suspension in force, suspended users can't post
 	UserTags      []string   // array containing tags associated with the user
 	UserType      []string   // array containing the type of user = "student" or "teacher"
 	UserImage     string     // image associated with the user = this contains the path to the image
@@ -31,29 +37,50 @@ type User struct {
 }
 
 type Question struct {
-	QnID      int      // unique id for the question. This auto-increments on adding a question
-	QnHeading string   // question heading
-	QnBody    string   // question body
-	QnTags    []string // array containing tags associated with the question
-	QnImage   []string // image associated with the question = this contains the path to the image
-	QnDate    string   // date of the question
-	QnTime    string   // time of the question
-	QnUser    string   // user who posted the question
-	QnAnswers []Answer // array containing answers associated with the question
-	QnVotes   []string // array containing votes associated with the question
-	QnViews   int      // number of views on the question
-	QnOpen    bool     // status of the question = "open" or "closed" = one can post answers to closed questions also, but closed questions have been successfully answered
+	QnID        int      // unique id for the question. This auto-increments on adding a question
+	QnHeading   string   // question heading
+	QnBody      string   // question body
+	QnTags      []string // array containing tags associated with the question
+	QnImage     []string // image associated with the question = this contains the path to the image
+	QnDate      string   // date of the question
+	QnTime      string   // time of the question
+	QnUser      string   // user who posted the question
+	QnAnswers   []Answer // array containing answers associated with the question
+	QnVotes     []string // array containing votes associated with the question
+	QnViews     int      // number of views on the question
+	QnOpen      bool     // status of the question = "open" or "closed" = one can post answers to closed questions also, but closed questions have been successfully answered
+	QnEdited    string   // date and time of the last edit, empty if the question was never edited
+	QnScore     int      // sum of the up and down votes on the question
+	QnBookmarks int      // number of users who bookmarked the question
+	QnHidden    bool     // hidden after too many flags, until a moderator reviews it
+	QnAnonymous bool     // asked anonymously, see anonymous.go
 }
 
 type Answer struct {
-	AnsID    int      // unique id for the answer. This auto-increments on adding a answer
-	AnsBody  string   // answer body
-	AnsDate  string   // date of the answer
-	AnsTime  string   // time of the answer
-	AnsUser  string   // user who posted the answer
-	AnsVotes []string // array containing votes associated with the answer
-	AnsViews int      // number of views on the answer
-	AnsQn    int      // question id of the answer
+	AnsID     int      // unique id for the answer. This auto-increments on adding a answer
+	AnsBody   string   // answer body
+	AnsDate   string   // date of the answer
+	AnsTime   string   // time of the answer
+	AnsUser   string   // user who posted the answer
+	AnsVotes  []string // array containing votes associated with the answer
+	AnsViews  int      // number of views on the answer
+	AnsQn     int      // question id of the answer
+	AnsEdited string   // date and time of the last edit, empty if the answer was never edited
+	AnsScore  int      // sum of the up and down votes on the answer
+	AnsHidden bool     // hidden after too many flags, until a moderator reviews it
+	AnsWilson float64  // lower bound of the share of up votes, which doesn't overrate answers with few votes
+}
+
+type Comment struct {
+	CmtID       int    // unique id for the comment. This auto-increments on adding a comment
+	CmtBody     string // comment body
+	CmtDate     string // date of the comment
+	CmtTime     string // time of the comment
+	CmtUser     string // user who posted the comment
+	CmtPostType string // type of the post the comment is on = "question" or "answer"
+	CmtPostID   int    // id of the question or answer the comment is on
+	CmtScore    int    // number of up votes on the comment
+	CmtHidden   bool   // hidden after too many flags, until a moderator reviews it
 }
 
 type Badge struct {
@@ -69,123 +96,1152 @@ type Tag struct {
 	TagDesc string // description of the tag
 }
 
-// create an sqlite database named 'qaApp' if it doesn't exist
-func createDatabase() {
-	if _, err := os.Stat("qaApp.db"); os.IsNotExist(err) {
-		db, err := sql.Open("sqlite3", "qaApp.db")
-		if err != nil {
+// db is the shared handle to the database, opened once in main
+var db *store
+
+// schema for the database. Every statement is safe to run on an existing database
+var schema = []string{
+	`
+	create table if not exists users (
+		id integer not null primary key autoincrement,
+		first_name text,
+		last_name text,
+		username text,
+		unique_id int,
+		password text,
+		user_tags text,
+		user_type text,
+		user_image text,
+		super_user bool,
+		mod_tags text,
+		mod_questions text,
+		badges text
+	);
+	`,
+	`
+	create table if not exists sessions (
+		token text not null primary key,
+		user_id integer not null,
+		expires text not null
+	);
+	`,
+	`
+	create table if not exists reserved_names (
+		name text not null primary key,
+		reason text
+	);
+	`,
+	`
+	create table if not exists username_history (
+		id integer not null primary key autoincrement,
+		user_id integer not null,
+		old_name text not null,
+		new_name text not null,
+		changed_at text not null
+	);
+	`,
+	`
+	create table if not exists votes (
+		id integer not null primary key autoincrement,
+		user_id integer not null,
+		post_type text not null,
+		post_id integer not null,
+		value int not null,
+		voted_at text not null,
+		unique (user_id, post_type, post_id)
+	);
+	`,
+	`
+	create table if not exists jobs (
+		id integer not null primary key autoincrement,
+		kind text not null,
+		payload text not null,
+		run_at text not null,
+		attempts int not null default 0,
+		last_error text,
+		done_at text
+	);
+	`,
+	`
+	create table if not exists images (
+		id integer not null primary key autoincrement,
+		path text not null unique,
+		user_id integer not null,
+		width int not null,
+		height int not null,
+		created_at text not null
+	);
+	`,
+	`
+	create table if not exists image_sizes (
+		image_id integer not null,
+		width int not null,
+		path text not null,
+		primary key (image_id, width)
+	);
+	`,
+	`
+	create table if not exists comments (
+		id integer not null primary key autoincrement,
+		post_type text not null,
+		post_id integer not null,
+		body text not null,
+		date text,
+		time text,
+		user text,
+		edited_at text
+	);
+	`,
+	`
+	create table if not exists changelog (
+		id integer not null primary key autoincrement,
+		title text not null,
+		body text,
+		published_at text not null,
+		user_id integer
+	);
+	`,
+	`
+	create table if not exists changelog_reads (
+		user_id integer not null primary key,
+		last_entry_id integer not null
+	);
+	`,
+	`
+	create table if not exists question_views (
+		question_id integer not null,
+		viewer text not null,
+		day text not null,
+		primary key (question_id, viewer, day)
+	);
+	`,
+	`
+	create table if not exists bookmarks (
+		user_id integer not null,
+		question_id integer not null,
+		created_at text not null,
+		primary key (user_id, question_id)
+	);
+	`,
+	`
+	create table if not exists questions (
+		id integer not null primary key autoincrement,
+		heading text,
+		body text,
+		tags text,
+		image text,
+		date text,
+		time text,
+		user text,
+		answers text,
+		votes text,
+		views int,
+		open bool
+	);
+	`,
+	`
+	create table if not exists answers (
+		id integer not null primary key autoincrement,
+		body text,
+		date text,
+		time text,
+		user text,
+		votes text,
+		views int,
+		qn int
+	);
+	`,
+	`
+	create table if not exists tags (
+		id integer not null primary key autoincrement,
+		name text,
+		desc text
+	);
+	`,
+	`
+	create table if not exists badges (
+		id integer not null primary key autoincrement,
+		name text,
+		description text,
+		users text
+	);
+	`,
+	`
+	create table if not exists notifications (
+		id integer not null primary key autoincrement,
+		user_id integer not null,
+		message text not null,
+		link text,
+		created_at text not null,
+		read_at text
+	);
+	`,
+	`
+	create table if not exists subscriptions (
+		user_id integer not null,
+		target_type text not null,
+		target text not null,
+		email bool not null default false,
+		created_at text not null,
+		primary key (user_id, target_type, target)
+	);
+	`,
+	`
+	create table if not exists exam_windows (
+		id integer not null primary key autoincrement,
+		title text not null,
+		starts_at text not null,
+		ends_at text not null,
+		tags text not null default '',
+		created_at text not null
+	);
+	`,
+	`
+	create table if not exists user_mutes (
+		user_id integer not null,
+		muted_id integer not null,
+		created_at text not null,
+		primary key (user_id, muted_id)
+	);
+	`,
+	`
+	create table if not exists sanctions (
+		id integer not null primary key autoincrement,
+		user_id integer not null,
+		kind text not null,
+		reason text not null,
+		until text,
+		created_by integer,
+		created_at text not null,
+		lifted_at text
+	);
+	`,
+	`
+	create table if not exists flags (
+		id integer not null primary key autoincrement,
+		user_id integer not null,
+		post_type text not null,
+		post_id integer not null,
+		reason text not null,
+		created_at text not null,
+		resolved_at text,
+		resolved_by integer,
+		unique (user_id, post_type, post_id)
+	);
+	`,
+	`
+	create table if not exists blocked_words (
+		word text not null primary key,
+		severity text not null
+	);
+	`,
+	`
+	create table if not exists app_secrets (
+		name text not null primary key,
+		value text not null
+	);
+	`,
+	`
+	create table if not exists feature_flags (
+		name text not null primary key,
+		enabled integer not null default 0,
+		updated_at text
+	);
+	`,
+	`
+	create table if not exists experiment_exposures (
+		experiment text not null,
+		question_id integer not null,
+		arm text not null,
+		exposed_at text not null,
+		accepted_at text,
+		primary key (experiment, question_id)
+	);
+	`,
+	`
+	create table if not exists bounties (
+		id integer not null primary key autoincrement,
+		question_id integer not null,
+		user_id integer not null,
+		amount integer not null,
+		created_at text not null,
+		expires_at text not null,
+		closed_at text,
+		answer_id integer,
+		awarded_to integer
+	);
+	`,
+	`
+	create table if not exists drafts (
+		user_id integer not null,
+		kind text not null,
+		question_id integer not null default 0,
+		heading text not null default '',
+		body text not null default '',
+		tags text not null default '',
+		updated_at text not null,
+		primary key (user_id, kind, question_id)
+	);
+	`,
+	`
+	create table if not exists edit_leases (
+		post_type text not null,
+		post_id integer not null,
+		user_id integer not null,
+		expires_at text not null,
+		primary key (post_type, post_id)
+	);
+	`,
+	`
+	create table if not exists held_emails (
+		id integer not null primary key autoincrement,
+		user_id integer not null,
+		subject text not null,
+		body text not null,
+		created_at text not null
+	);
+	`,
+	`
+	create table if not exists tag_synonyms (
+		synonym text not null primary key,
+		tag text not null
+	);
+	`,
+	`
+	create table if not exists tag_revisions (
+		id integer not null primary key autoincrement,
+		tag text not null,
+		user_id integer not null,
+		excerpt text not null,
+		body text not null,
+		created_at text not null
+	);
+	`,
+	`
+	create table if not exists email_suppressions (
+		email text not null primary key,
+		reason text not null,
+		detail text not null,
+		created_at text not null
+	);
+	`,
+	`
+	create table if not exists activity (
+		id integer not null primary key autoincrement,
+		user_id integer not null,
+		kind text not null,
+		post_type text not null,
+		post_id integer not null,
+		question_id integer not null,
+		detail text not null,
+		created_at text not null
+	);
+	`,
+	`
+	create table if not exists user_preferences (
+		user_id integer not null primary key,
+		email_opt_in bool not null,
+		question_sort text not null,
+		answers_per_page integer not null,
+		theme text not null,
+		updated_at text not null
+	);
+	`,
+	`
+	create table if not exists question_tags (
+		question_id integer not null references questions (id) on delete cascade,
+		tag_id integer not null references tags (id) on delete cascade,
+		position int not null,
+		primary key (question_id, tag_id)
+	);
+	`,
+	`
+	create table if not exists user_badges (
+		user_id integer not null references users (id) on delete cascade,
+		badge_id integer not null references badges (id) on delete cascade,
+		awarded_at text not null,
+		primary key (user_id, badge_id)
+	);
+	`,
+	`
+	create table if not exists question_moderators (
+		user_id integer not null references users (id) on delete cascade,
+		question_id integer not null references questions (id) on delete cascade,
+		primary key (user_id, question_id)
+	);
+	`,
+	`
+	create table if not exists mentions (
+		post_type text not null,
+		post_id integer not null,
+		user_id integer not null references users (id) on delete cascade,
+		created_at text not null,
+		primary key (post_type, post_id, user_id)
+	);
+	`,
+	"create index if not exists mentions_user on mentions (user_id)",
+	`
+	create table if not exists attachments (
+		id integer not null primary key autoincrement,
+		post_type text not null,
+		post_id integer not null,
+		user_id integer not null references users (id) on delete cascade,
+		name text not null,
+		path text not null unique,
+		content_type text not null,
+		size integer not null,
+		created_at text not null
+	);
+	`,
+	"create index if not exists attachments_post on attachments (post_type, post_id)",
+	`
+	create table if not exists audit_log (
+		id integer not null primary key autoincrement,
+		actor_id integer not null,
+		actor text not null,
+		action text not null,
+		target_type text not null,
+		target text not null,
+		before text,
+		after text,
+		created_at text not null
+	);
+	`,
+	"create index if not exists audit_log_actor on audit_log (lower(actor))",
+	// the log is append-only
+	`create trigger if not exists audit_log_no_update before update on audit_log begin
+		select raise(abort, 'the audit log is append-only');
+	end`,
+	`create trigger if not exists audit_log_no_delete before delete on audit_log begin
+		select raise(abort, 'the audit log is append-only');
+	end`,
+	`
+	create table if not exists signups (
+		user_id integer not null primary key references users (id) on delete cascade,
+		ip text not null,
+		invite_code text,
+		created_at text not null
+	);
+	`,
+	"create index if not exists signups_ip on signups (ip, created_at)",
+	`
+	create table if not exists blocked_email_domains (
+		domain text not null primary key
+	);
+	`,
+	`
+	create table if not exists user_totp (
+		user_id integer not null primary key references users (id) on delete cascade,
+		secret text not null,
+		last_step integer not null,
+		enabled_at text
+	);
+	`,
+	`
+	create table if not exists recovery_codes (
+		id integer not null primary key autoincrement,
+		user_id integer not null references users (id) on delete cascade,
+		code_hash text not null,
+		used_at text
+	);
+	`,
+	`
+	create table if not exists remember_tokens (
+		selector text not null primary key,
+		validator_hash text not null,
+		user_id integer not null references users (id) on delete cascade,
+		expires text not null
+	);
+	`,
+	`
+	create table if not exists pending_logins (
+		token text not null primary key,
+		user_id integer not null references users (id) on delete cascade,
+		attempts integer not null,
+		expires text not null
+	);
+	`,
+	`
+	create table if not exists account_deletions (
+		user_id integer not null primary key references users (id) on delete cascade,
+		requested_at text not null,
+		delete_at text not null
+	);
+	`,
+	`
+	create table if not exists conversations (
+		id integer not null primary key autoincrement,
+		user_a integer not null references users (id) on delete cascade,
+		user_b integer not null references users (id) on delete cascade,
+		created_at text not null,
+		updated_at text not null,
+		unique (user_a, user_b)
+	);
+	`,
+	`create index if not exists conversations_user_b on conversations (user_b)`,
+	`
+	create table if not exists messages (
+		id integer not null primary key autoincrement,
+		conversation_id integer not null references conversations (id) on delete cascade,
+		sender_id integer not null references users (id) on delete cascade,
+		body text not null,
+		created_at text not null,
+		read_at text
+	);
+	`,
+	`create index if not exists messages_conversation on messages (conversation_id, id)`,
+	`create index if not exists messages_sender on messages (sender_id, created_at)`,
+	`
+	create table if not exists announcements (
+		id integer not null primary key autoincrement,
+		title text not null,
+		body text not null,
+		tag text not null default '',
+		user_id integer not null references users (id) on delete cascade,
+		created_at text not null,
+		expires_at text not null
+	);
+	`,
+	`create index if not exists announcements_expires on announcements (expires_at)`,
+	`
+	create table if not exists announcement_dismissals (
+		announcement_id integer not null references announcements (id) on delete cascade,
+		user_id integer not null references users (id) on delete cascade,
+		primary key (announcement_id, user_id)
+	);
+	`,
+	`
+	create table if not exists courses (
+		id integer not null primary key autoincrement,
+		name text not null,
+		code text not null unique,
+		user_id integer not null references users (id),
+		created_at text not null
+	);
+	`,
+	`
+	create table if not exists course_members (
+		course_id integer not null references courses (id) on delete cascade,
+		user_id integer not null references users (id) on delete cascade,
+		role text not null,
+		joined_at text not null,
+		primary key (course_id, user_id)
+	);
+	`,
+	`create index if not exists course_members_user on course_members (user_id)`,
+	`
+	create table if not exists question_templates (
+		id integer not null primary key autoincrement,
+		name text not null,
+		description text not null,
+		sections text not null,
+		require_code bool not null default false,
+		user_id integer not null references users (id),
+		created_at text not null
+	);
+	`,
+	`
+	create table if not exists welcome_links (
+		token text not null primary key,
+		user_id integer not null references users (id) on delete cascade,
+		expires_at text not null
+	);
+	`,
+	`
+	create table if not exists lti_platforms (
+		id integer not null primary key autoincrement,
+		name text not null,
+		issuer text not null,
+		client_id text not null,
+		deployment_id text not null default '',
+		auth_url text not null,
+		keyset_url text not null,
+		created_at text not null,
+		unique (issuer, client_id)
+	);
+	`,
+	`
+	create table if not exists lti_states (
+		state text not null primary key,
+		nonce text not null,
+		platform_id integer not null references lti_platforms (id) on delete cascade,
+		created_at text not null
+	);
+	`,
+	`
+	create table if not exists lti_users (
+		platform_id integer not null references lti_platforms (id) on delete cascade,
+		subject text not null,
+		user_id integer not null references users (id) on delete cascade,
+		primary key (platform_id, subject)
+	);
+	`,
+	`
+	create table if not exists lti_contexts (
+		platform_id integer not null references lti_platforms (id) on delete cascade,
+		context_id text not null,
+		course_id integer not null references courses (id) on delete cascade,
+		primary key (platform_id, context_id)
+	);
+	`,
+	`
+	create table if not exists sso_states (
+		state text not null primary key,
+		nonce text not null,
+		verifier text not null,
+		next text not null,
+		created_at text not null
+	);
+	`,
+	`
+	create table if not exists sso_users (
+		subject text not null primary key,
+		user_id integer not null references users (id) on delete cascade
+	);
+	`,
+	`
+	create table if not exists invite_codes (
+		code text not null primary key,
+		label text not null,
+		created_by integer not null references users (id) on delete cascade,
+		max_uses integer not null,
+		uses integer not null,
+		expires_at text,
+		revoked bool not null,
+		created_at text not null
+	);
+	`,
+}
+
+// splitList is a recursive query naming split the rows (id, position, item, created) of the entries
+// of a comma separated column, with the id of their row, their position from 1 and, for posts, the
+// date and time of the post. It starts a statement, with an extra row of position 0 to skip
+func splitList(table, column string) string {
+	created := "''"
+	if table == "questions" || table == "answers" {
+		created = "date || ' ' || time"
+	}
+	return `with recursive split (id, position, item, rest, created) as (
+		select id, 0, '', coalesce(` + column + `, '') || ',', ` + created + ` from ` + table + `
+		union all
+		select id, position + 1, trim(substr(rest, 1, instr(rest, ',') - 1)), substr(rest, instr(rest, ',') + 1), created
+			from split where rest != ''
+	)
+	`
+}
+
+// migrations change the tables created by schema. They run once each, in order,
+// and the number of migrations applied is kept in the user_version pragma.
+// these are the migrations of sqlite: postgres and mysql start at schemaBaseline, and have their
+// own versions of those after it, see store_postgres.go and store_mysql.go
+var migrations = []string{
+	"alter table questions add column edited_at text",
+	"alter table answers add column edited_at text",
+	// full text index of the questions, kept in sync by triggers
+	`create virtual table questions_fts using fts4(content="questions", heading, body, tokenize=porter)`,
+	`create trigger questions_fts_before_update before update on questions begin
+		delete from questions_fts where docid = old.id;
+	end`,
+	`create trigger questions_fts_before_delete before delete on questions begin
+		delete from questions_fts where docid = old.id;
+	end`,
+	`create trigger questions_fts_after_update after update on questions begin
+		insert into questions_fts (docid, heading, body) values (new.id, new.heading, new.body);
+	end`,
+	`create trigger questions_fts_after_insert after insert on questions begin
+		insert into questions_fts (docid, heading, body) values (new.id, new.heading, new.body);
+	end`,
+	"insert into questions_fts (questions_fts) values ('rebuild')",
+	// only reindex a question when its text changes, not on every view
+	"drop trigger questions_fts_before_update",
+	"drop trigger questions_fts_after_update",
+	`create trigger questions_fts_before_update before update of heading, body on questions begin
+		delete from questions_fts where docid = old.id;
+	end`,
+	`create trigger questions_fts_after_update after update of heading, body on questions begin
+		insert into questions_fts (docid, heading, body) values (new.id, new.heading, new.body);
+	end`,
+	"alter table users add column email text",
+	"alter table users add column digest text",
+	"alter table users add column digest_sent_at text",
+	"alter table questions add column hidden_at text",
+	"alter table answers add column hidden_at text",
+	"alter table comments add column hidden_at text",
+	"alter table questions add column accepted_id integer",
+	"alter table questions add column accepted_at text",
+	"alter table users add column quiet_start text",
+	"alter table users add column quiet_end text",
+	"alter table users add column timezone text",
+	// the desc of a tag is its excerpt, and wiki its Markdown description
+	"alter table tags add column wiki text",
+	// the leaderboard counts votes, answers and accepts by date
+	"create index if not exists votes_voted_at on votes (voted_at)",
+	"create index if not exists answers_date on answers (date)",
+	"create index if not exists questions_accepted_at on questions (accepted_at)",
+	// activity tabs of profiles
+	"create index if not exists activity_user on activity (user_id, id)",
+	"alter table users add column language text",
+	// lists kept in comma separated columns move to tables with foreign keys. Each one is first
+	// split with a recursive query, and the column dropped once converted. Entries naming users,
+	// tags or badges that don't exist are dropped, and listed, see legacydrops.go
+	"update tags set name = lower(trim(name))",
+	"delete from tags where id not in (select min(id) from tags group by name)",
+	"create unique index if not exists tags_name on tags (name)",
+	splitList("questions", "tags") + `
+	insert or ignore into tags (name, desc) select distinct lower(item), '' from split where item != ''`,
+	splitList("questions", "tags") + `
+	insert or ignore into question_tags (question_id, tag_id, position)
+		select split.id, tags.id, min(split.position) from split join tags on tags.name = lower(split.item)
+		where split.item != '' group by split.id, tags.id`,
+	"alter table questions drop column tags",
+	// answers listed by their question
+	splitList("questions", "answers") + `
+	update answers set qn = (select min(split.id) from split where split.item = cast(answers.id as text))
+		where coalesce(qn, 0) = 0 and cast(id as text) in (select item from split)`,
+	// voters, with a - for down votes and an optional + for up votes. Authors can't vote on their posts
+	splitList("questions", "votes") + `
+	insert or ignore into votes (user_id, post_type, post_id, value, voted_at)
+		select users.id, 'question', split.id, case when split.item like '-%' then -1 else 1 end, coalesce(split.created, '')
+		from split join users on lower(users.username) = lower(trim(ltrim(split.item, '+-')))
+		where split.item != '' and lower(users.username) is not (select lower(user) from questions where questions.id = split.id)`,
+	splitList("answers", "votes") + `
+	insert or ignore into votes (user_id, post_type, post_id, value, voted_at)
+		select users.id, 'answer', split.id, case when split.item like '-%' then -1 else 1 end, coalesce(split.created, '')
+		from split join users on lower(users.username) = lower(trim(ltrim(split.item, '+-')))
+		where split.item != '' and lower(users.username) is not (select lower(user) from answers where answers.id = split.id)`,
+	"alter table questions drop column answers",
+	"alter table questions drop column votes",
+	// foreign keys can't be added to a table, so answers and votes are rebuilt
+	`create table answers_new (
+		id integer not null primary key autoincrement,
+		body text,
+		date text,
+		time text,
+		user text,
+		views int,
+		question_id integer references questions (id) on delete cascade,
+		edited_at text,
+		hidden_at text
+	)`,
+	`insert into answers_new (id, body, date, time, user, views, question_id, edited_at, hidden_at)
+		select id, body, date, time, user, views, (select id from questions where questions.id = answers.qn), edited_at, hidden_at from answers`,
+	"drop table answers",
+	"alter table answers_new rename to answers",
+	"create index if not exists answers_date on answers (date)",
+	"create index if not exists answers_question on answers (question_id)",
+	`create table votes_new (
+		id integer not null primary key autoincrement,
+		user_id integer not null references users (id) on delete cascade,
+		post_type text not null,
+		post_id integer not null,
+		value int not null,
+		voted_at text not null,
+		unique (user_id, post_type, post_id)
+	)`,
+	"insert into votes_new select id, user_id, post_type, post_id, value, voted_at from votes where user_id in (select id from users)",
+	"drop table votes",
+	"alter table votes_new rename to votes",
+	"create index if not exists votes_voted_at on votes (voted_at)",
+	// badges were listed both in badges.users, by username, and in users.badges, by name
+	splitList("badges", "users") + `
+	insert or ignore into user_badges (user_id, badge_id, awarded_at)
+		select users.id, split.id, '' from split join users on lower(users.username) = lower(split.item)`,
+	splitList("users", "badges") + `
+	insert or ignore into user_badges (user_id, badge_id, awarded_at)
+		select split.id, badges.id, '' from split join badges on lower(badges.name) = lower(split.item)`,
+	"alter table badges drop column users",
+	"alter table users drop column badges",
+	splitList("users", "mod_questions") + `
+	insert or ignore into question_moderators (user_id, question_id)
+		select split.id, questions.id from split join questions on cast(questions.id as text) = split.item`,
+	"alter table users drop column mod_questions",
+	// anonymous questions, in the tags that allow them
+	"alter table questions add column is_anonymous bool not null default false",
+	"alter table tags add column allow_anonymous bool not null default false",
+	// logins waiting for their two-factor code keep "remember me"
+	"alter table pending_logins add column remember bool not null default false",
+	// questions asked in a course are only seen by its members
+	"alter table questions add column course_id integer references courses (id) on delete set null",
+	"create index questions_course on questions (course_id)",
+	// deadlines after which threads are read-only for students
+	"alter table questions add column deadline text",
+	"alter table tags add column deadline text",
+	// the suggestions of the search box walk the names of tags and users, and count their uses
+	"create index users_username on users (username)",
+	"create index question_tags_tag on question_tags (tag_id)",
+	"create index answers_user on answers (user)",
+	// and rank questions by their score
+	"create index votes_post on votes (post_type, post_id)",
+	// and the Hot tab, recomputed by a job from the recent votes, answers and views
+	"alter table questions add column hot_score real not null default 0",
+	"create index questions_hot on questions (hot_score)",
+	"create index question_views_day on question_views (day)",
+	// pairs of tags with the number of questions they tag together, kept by triggers, see relatedtags.go
+	`create table tag_pairs (
+		tag_id integer not null references tags (id) on delete cascade,
+		related_id integer not null references tags (id) on delete cascade,
+		questions int not null,
+		primary key (tag_id, related_id)
+	)`,
+	`insert into tag_pairs (tag_id, related_id, questions)
+		select a.tag_id, b.tag_id, count(*) from question_tags a join question_tags b on b.question_id = a.question_id and b.tag_id != a.tag_id
+		group by a.tag_id, b.tag_id`,
+	`create trigger tag_pairs_after_insert after insert on question_tags begin
+		insert into tag_pairs (tag_id, related_id, questions)
+			select new.tag_id, tag_id, 1 from question_tags where question_id = new.question_id and tag_id != new.tag_id
+			union all select tag_id, new.tag_id, 1 from question_tags where question_id = new.question_id and tag_id != new.tag_id
+			on conflict (tag_id, related_id) do update set questions = questions + 1;
+	end`,
+	`create trigger tag_pairs_after_delete after delete on question_tags begin
+		update tag_pairs set questions = questions - 1
+			where tag_id = old.tag_id and related_id in (select tag_id from question_tags where question_id = old.question_id);
+		update tag_pairs set questions = questions - 1
+			where tag_id in (select tag_id from question_tags where question_id = old.question_id) and related_id = old.tag_id;
+		delete from tag_pairs where questions <= 0 and (tag_id = old.tag_id
+			or tag_id in (select tag_id from question_tags where question_id = old.question_id) and related_id = old.tag_id);
+	end`,
+	// merging tags moves their questions to another tag, the row moved being the only one of the new tag
+	`create trigger tag_pairs_after_update after update of tag_id on question_tags begin
+		update tag_pairs set questions = questions - 1
+			where tag_id = old.tag_id and related_id in (select tag_id from question_tags where question_id = old.question_id and tag_id != new.tag_id);
+		update tag_pairs set questions = questions - 1
+			where tag_id in (select tag_id from question_tags where question_id = old.question_id and tag_id != new.tag_id) and related_id = old.tag_id;
+		delete from tag_pairs where questions <= 0 and (tag_id = old.tag_id
+			or tag_id in (select tag_id from question_tags where question_id = old.question_id) and related_id = old.tag_id);
+		insert into tag_pairs (tag_id, related_id, questions)
+			select new.tag_id, tag_id, 1 from question_tags where question_id = new.question_id and tag_id != new.tag_id
+			union all select tag_id, new.tag_id, 1 from question_tags where question_id = new.question_id and tag_id != new.tag_id
+			on conflict (tag_id, related_id) do update set questions = questions + 1;
+	end`,
+	// outgoing webhooks and the log of their deliveries, see webhooks.go
+	`create table webhooks (
+		id integer not null primary key autoincrement,
+		url text not null,
+		secret text not null,
+		events text not null,
+		active boolean not null,
+		created_at text not null
+	)`,
+	`create table webhook_deliveries (
+		id integer not null primary key autoincrement,
+		webhook_id integer not null references webhooks (id) on delete cascade,
+		event text not null,
+		payload text not null,
+		status text not null,
+		attempts integer not null default 0,
+		response_code integer,
+		last_error text,
+		created_at text not null,
+		delivered_at text
+	)`,
+	"create index webhook_deliveries_webhook on webhook_deliveries (webhook_id)",
+	// slack and discord channels new questions are posted to, see chat.go
+	`create table chat_channels (
+		id integer not null primary key autoincrement,
+		kind text not null,
+		url text not null,
+		tags text not null,
+		course_id integer references courses (id) on delete cascade,
+		user_id integer not null references users (id),
+		created_at text not null
+	)`,
+	// API keys of the users, see apikeys.go
+	`create table api_keys (
+		id integer not null primary key autoincrement,
+		user_id integer not null references users (id) on delete cascade,
+		name text not null,
+		selector text not null unique,
+		validator_hash text not null,
+		scope text not null,
+		quota integer not null,
+		created_at text not null,
+		last_used_at text,
+		revoked_at text
+	)`,
+	"create index api_keys_user on api_keys (user_id)",
+	// questions merged into another one, whose urls redirect to it, see merges.go
+	`create table question_merges (
+		question_id integer not null primary key,
+		target_id integer not null references questions (id) on delete cascade,
+		user_id integer not null,
+		merged_at text not null
+	)`,
+	"create index question_merges_target on question_merges (target_id)",
+	// questions only users with some reputation answer, see protection.go
+	"alter table questions add column protected_at text",
+	"alter table questions add column protected_by integer references users (id) on delete set null",
+	// reviews of the posts of the review queues, see reviews.go
+	`create table reviews (
+		id integer not null primary key autoincrement,
+		queue text not null,
+		post_type text not null,
+		post_id integer not null,
+		user_id integer not null references users (id) on delete cascade,
+		action text not null,
+		created_at text not null,
+		unique (queue, post_type, post_id, user_id)
+	)`,
+	"create index reviews_post on reviews (post_type, post_id)",
+	// questions closed by the votes of users, see closing.go
+	"alter table questions add column closed_at text",
+	"alter table questions add column close_reason text",
+	`create table close_votes (
+		id integer not null primary key autoincrement,
+		question_id integer not null references questions (id) on delete cascade,
+		user_id integer not null references users (id) on delete cascade,
+		kind text not null,
+		reason text not null,
+		created_at text not null,
+		unique (question_id, user_id, kind)
+	)`,
+	"create index close_votes_created on close_votes (created_at)",
+	// where votes come from, and the votes found fraudulent, see votefraud.go
+	"alter table votes add column ip text",
+	`create table vote_fraud_reports (
+		id integer not null primary key autoincrement,
+		kind text not null,
+		voter_id integer references users (id) on delete set null,
+		ip text,
+		author text not null,
+		votes integer not null,
+		points integer not null,
+		first_at text not null,
+		last_at text not null,
+		created_at text not null,
+		resolved_at text,
+		resolved_by integer references users (id) on delete set null
+	)`,
+	// indexes of the common access paths, found with SLOW_QUERY_LOG, see store.go. answers_question
+	// already finds the answers of a question. The questions of a tag are read from the index alone,
+	// and so are the scores of posts
+	"drop index question_tags_tag",
+	"create index question_tags_tag on question_tags (tag_id, question_id)",
+	"drop index votes_post",
+	"create index votes_post on votes (post_type, post_id, value)",
+	// the notifications of a user, the latest first, and the count of those unread on every page
+	"create index notifications_user on notifications (user_id, id)",
+	"create index notifications_unread on notifications (user_id, id) where read_at is null",
+	// the comments and flags of a post, and the questions of a profile
+	"create index comments_post on comments (post_type, post_id)",
+	"create index flags_post on flags (post_type, post_id)",
+	"create index questions_user on questions (user)",
+	// the wrong codes of a user in a row, whatever pending login they came with, and the lockout they earned
+	"alter table user_totp add column failed_attempts integer not null default 0",
+	"alter table user_totp add column locked_until text",
+}
+
+// open the database of DATABASE_URL, by default the sqlite database named 'qaApp', see store.go
+func openDatabase() {
+	var err error
+	db, err = openStore(databaseURL())
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+// create the tables of the database if they don't exist.
+// statements are executed one by one, as Exec only binds arguments and doesn't run extra statements.
+// they run once, so they go straight to the database instead of being kept prepared
+func createDatabase(ctx context.Context) {
+	for _, stmt := range db.backend.schema() {
+		if _, err := db.execOnce(ctx, stmt); err != nil {
 			fmt.Println(err)
 		}
-		defer db.Close()
-		sqlStmt := `
-		create table users (
-			id integer not null primary key autoincrement,
-			first_name text,
-			last_name text,
-			username text,
-			unique_id int,
-			password text,
-			user_tags text,
-			user_type text,
-			user_image text,
-			super_user bool,
-			mod_tags text,
-			mod_questions text,
-			badges text
-		);
-		`
-		// create table questions, answers, tags, badges
-		sqlStmt2 := `
-		create table questions (
-			id integer not null primary key autoincrement,
-			heading text,
-			body text,
-			tags text,
-			image text,
-			date text,
-			time text,
-			user text,
-			answers text,
-			votes text,
-			views int,
-			open bool
-		);
-		`
-		sqlStmt3 := `
-		create table answers (
-			id integer not null primary key autoincrement,
-			body text,
-			date text,
-			time text,
-			user text,
-			votes text,
-			views int,
-			qn int
-		);
-		`
-		sqlStmt4 := `
-		create table tags (
-			id integer not null primary key autoincrement,
-			name text
-			desc text
-		);
-		`
-		sqlStmt5 := `
-		create table badges (
-			id integer not null primary key autoincrement,
-			name text,
-			description text,
-			users text
-		);
-		`
-		_, err = db.Exec(sqlStmt, sqlStmt2, sqlStmt3, sqlStmt4, sqlStmt5)
+	}
+	migrateDatabase(ctx)
+}
+
+// apply the migrations the database hasn't seen yet, each in a transaction of its own
+func migrateDatabase(ctx context.Context) {
+	version, err := db.schemaVersion(ctx)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	// rebuilding a big table can take longer than the query timeout
+	ctx = unbounded(ctx)
+	for ; version < len(migrations); version++ {
+		err := db.WithTx(ctx, func(ctx context.Context) error {
+			// the legacy entries a conversion can't carry are listed before they go, see legacydrops.go
+			if err := reportLegacyDrops(ctx, version, os.Stdout); err != nil {
+				return err
+			}
+			migration, err := db.backend.migration(version)
+			if err != nil {
+				return err
+			}
+			if _, err := db.execOnce(ctx, migration); err != nil {
+				return err
+			}
+			return db.setSchemaVersion(ctx, version+1)
+		})
 		if err != nil {
 			fmt.Println(err)
+			return
 		}
 	}
 }
 
-// create sample data for the database
-func createSampleData() {
-	db, err := sql.Open("sqlite3", "qaApp.db")
+// create sample data for the database, only when the database is empty
+func createSampleData(ctx context.Context) {
+	var users int
+	if err := db.QueryRowContext(ctx, "select count(*) from users").Scan(&users); err != nil {
+		fmt.Println(err)
+		return
+	}
+	if users > 0 {
+		return
+	}
+	now := time.Now()
+	password, err := hashPassword("password")
 	if err != nil {
 		fmt.Println(err)
+		return
 	}
-	defer db.Close()
-	sqlStmt := `
-	insert into users (first_name, last_name, username, unique_id, password, user_tags, user_type, user_image, super_user, mod_tags, mod_questions, badges)
-	values ("Sagar", "Yadav", "sagaryadav", 1, "password", "", "", "", false, "", "", "");
-	`
-	sqlStmt2 := `
-	insert into questions (heading, body, tags, image, date, time, user, answers, votes, views, open)
-	values ("How to use Go", "Go is a programming language", "go, programming", "", "", "", "sagaryadav", "", "", 0, true);
-	`
-	sqlStmt3 := `
-	insert into answers (body, date, time, user, votes, views, qn)
-	values ("Go is a programming language", "", "", "sagaryadav", "", 0, 1);
-	`
-	sqlStmt4 := `
-	insert into tags (name, desc)
-	values ("Go", "Go is a programming language made by Google");
-	`
-	sqlStmt5 := `
-	insert into badges (name, description, users)
-	values ("Curious", "Asks questions", "sagaryadav");
-	`
-	_, err = db.Exec(sqlStmt, sqlStmt2, sqlStmt3, sqlStmt4, sqlStmt5)
+	date, clock, timestamp := now.Format(dateLayout), now.Format(timeLayout), now.Format(timestampLayout)
+	// each insert is prepared once and run with its rows bound to the placeholders
+	inserts := []struct {
+		query string
+		rows  [][]interface{}
+	}{
+		{`insert into users (first_name, last_name, username, unique_id, password, user_tags, user_type, user_image, super_user, mod_tags)
+			values (?, ?, ?, ?, ?, '', ?, '', false, '')`,
+			[][]interface{}{{"Sagar", "Yadav", "sagaryadav", 1, password, "student"}}},
+		{`insert into questions (heading, body, image, date, time, user, views, open) values (?, ?, '', ?, ?, ?, 0, true)`,
+			[][]interface{}{{"How to use Go", "Go is a programming language", date, clock, "sagaryadav"}}},
+		{`insert into answers (body, date, time, user, views, question_id) values (?, ?, ?, ?, 0, ?)`,
+			[][]interface{}{{"Go is a programming language", date, clock, "sagaryadav", 1}}},
+		{`insert into tags (name, desc) values (?, ?)`,
+			[][]interface{}{{"go", "Go is a programming language made by Google"}, {"programming", ""}}},
+		{`insert into question_tags (question_id, tag_id, position) values (?, ?, ?)`,
+			[][]interface{}{{1, 1, 1}, {1, 2, 2}}},
+		{`insert into badges (name, description) values (?, ?)`,
+			[][]interface{}{{"Curious", "Asks questions"}}},
+		{`insert into user_badges (user_id, badge_id, awarded_at) values (?, ?, ?)`,
+			[][]interface{}{{1, 1, timestamp}}},
+	}
+	err = db.WithTx(ctx, func(ctx context.Context) error {
+		for _, insert := range inserts {
+			for _, row := range insert.rows {
+				if _, err := db.ExecContext(ctx, insert.query, row...); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
 	if err != nil {
 		fmt.Println(err)
 	}
 }
 
-func serveTemplate(w http.ResponseWriter, r *http.Request) {
-	p := struct {
-		Logged bool
-		User   *User
-	}{
-		Logged: true,
-		User:   &User{FirstName: "Mario", LastName: "Rossi", UserName: "mario", UniqueID: 1},
+// page is the data passed to every template. Data holds what is specific to the page
+type page struct {
+	Logged        bool
+	User          *User
+	UnreadChanges int // changelog entries the user hasn't seen yet
+	UnreadNotes   int // notifications the user hasn't read yet
+	UnreadMsgs    int // messages the user hasn't read yet
+	Data          interface{}
+	Lang          string // language the page is shown in
+	Prefs         preferences
+}
+
+// functions available in the templates. T and img are replaced on each render, by a translator
+// to the language of the page and by an img that looks the image up in the context of the request
+var templateFuncs = template.FuncMap{
+	"img": func(url, alt string) template.HTML {
+		return imgTag(context.Background(), url, alt)
+	},
+	"asset":     func(u string) string { return siteAssets.url(u) },
+	"comments":  makeCommentList,
+	"markdown":  renderMarkdown,
+	"mentions":  linkMentions,
+	"date":      formatDate,
+	"pluralize": pluralize,
+	// the extensions of the files that can be attached, for the accept of file inputs
+	"attachmentTypes": attachmentExtensions,
+	"captchaScript":   captchaScript,
+	"captchaWidget":   captchaWidget,
+	"T": func(text string, args ...interface{}) string {
+		return translate(defaultLanguage, text, args...)
+	},
+}
+
+// render the named template, with the header and footer, for the user of the request
+func render(w http.ResponseWriter, r *http.Request, name string, data interface{}) {
+	renderBlock(w, r, name, "", data)
+}
+
+// renderBlock renders only the named block of a template, like a part of a page
+// refreshed by a script. An empty block renders the whole template
+func renderBlock(w http.ResponseWriter, r *http.Request, name, block string, data interface{}) {
+	ctx := r.Context()
+	user := currentUser(r)
+	prefs, err := loadPreferences(ctx, user)
+	if err != nil {
+		serverError(w, r, err)
+		return
+	}
+	p := page{
+		Logged:        user != nil,
+		User:          user,
+		UnreadChanges: unreadChanges(ctx, user),
+		UnreadNotes:   unreadNotifications(ctx, user),
+		UnreadMsgs:    unreadMessages(ctx, user),
+		Data:          data,
+		Lang:          requestLanguage(r, user),
+		Prefs:         prefs,
+	}
+	tmpl, err := pageTemplate(name)
+	if err != nil {
+		serverError(w, r, err)
+		return
 	}
+	if tmpl == nil {
+		serverError(w, r, fmt.Errorf("no template %s", name))
+		return
+	}
+
+	// a copy of the template gets the T of the language of the page, and the img of the request
+	tmpl, err = tmpl.Clone()
+	if err != nil {
+		serverError(w, r, err)
+		return
+	}
+	tmpl.Funcs(template.FuncMap{
+		"T": func(text string, args ...interface{}) string {
+			return translate(p.Lang, text, args...)
+		},
+		"img": func(url, alt string) template.HTML {
+			return imgTag(ctx, url, alt)
+		},
+	})
+
+	// execute the template, buffered so that a failure shows the error page instead of half a page
+	var buf bytes.Buffer
+	if block == "" {
+		err = tmpl.Execute(&buf, p)
+	} else {
+		err = tmpl.ExecuteTemplate(&buf, block, p)
+	}
+	if err != nil {
+		serverError(w, r, err)
+		return
+	}
+	w.Header().Set("Content-Language", p.Lang)
+	buf.WriteTo(w)
+}
+
+// serve /admin, the list of the admin tools
+func serveAdmin(w http.ResponseWriter, r *http.Request) {
+	if requireSuperUser(w, r) == nil {
+		return
+	}
+	render(w, r, "admin.html", nil)
+}
+
+func serveTemplate(w http.ResponseWriter, r *http.Request) {
 	// get the name of the template from the request
 	// the template name is the path after the slash
 	templateName := filepath.Base(r.URL.Path)
@@ -193,34 +1249,85 @@ func serveTemplate(w http.ResponseWriter, r *http.Request) {
 	if templateName == "/" {
 		templateName = "index.html"
 	}
-	// join the template directory and the template name
-	templatePath := filepath.Join("templates", templateName)
-
-	// make the final template and include the footer
-	tmpl, err := template.ParseFiles(templatePath, "templates/footer.gohtml", "templates/header.gohtml")
+	tmpl, err := pageTemplate(templateName)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		serverError(w, r, err)
 		return
 	}
-
-	// execute the template
-	err = tmpl.Execute(w, p)
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+	if tmpl == nil {
+		http.NotFound(w, r)
+		return
 	}
+	render(w, r, templateName, nil)
 }
 
 func main() {
+	flag.BoolVar(&devTemplates, "dev", false, "parse the templates on every request, for development")
+	flag.Usage = usage
+	flag.Parse()
+	// the context of the work done outside of requests
+	ctx := context.Background()
 
-	createDatabase()
-	createSampleData()
+	// without a command, the server runs
+	name, args := "serve", flag.Args()
+	if len(args) > 0 {
+		name, args = args[0], args[1:]
+	}
+	command, ok := commands[name]
+	if !ok {
+		flag.Usage()
+		os.Exit(2)
+	}
+	openDatabase()
+	defer db.Close()
+	if err := openSessions(); err != nil {
+		log.Fatal(err)
+	}
+	if err := openCache(); err != nil {
+		log.Fatal(err)
+	}
+	if err := openEvents(ctx); err != nil {
+		log.Fatal(err)
+	}
+	if err := command.run(ctx, args); err != nil {
+		log.Fatal(err)
+	}
+}
 
-	fs := http.FileServer(http.Dir("./public"))
-	http.Handle("/static/", http.StripPrefix("/static/", fs))
+// runServe runs the serve command: the web server
+func runServe(ctx context.Context, args []string) error {
+	flags := flag.NewFlagSet("serve", flag.ExitOnError)
+	flags.BoolVar(&devTemplates, "dev", devTemplates, "parse the templates on every request, for development")
+	addr := flags.String("addr", ":8080", "address to listen on, without -domain")
+	domains := flags.String("domain", "", "serve HTTPS on :443 for these comma separated domains, with certificates from Let's Encrypt")
+	certCache := flags.String("cert-cache", "certs", "directory keeping the certificates, with -domain")
+	acmeEmail := flags.String("acme-email", "", "address Let's Encrypt writes to about the certificates, optional")
+	flags.Parse(args)
 
-	http.HandleFunc("/", serveTemplate)
+	srv, err := newServer(ctx, db, devTemplates)
+	if err != nil {
+		return err
+	}
+	createSampleData(ctx)
+	startWorker(ctx)
+	if err := scheduleDigests(ctx); err != nil {
+		fmt.Println(err)
+	}
+	if err := scheduleHotScores(ctx); err != nil {
+		fmt.Println(err)
+	}
+	if err := scheduleMaintenance(ctx); err != nil {
+		return err
+	}
 
-	// write listen and then run the server on port 8080
-	fmt.Println("Click on http://localhost:8080")
-	log.Fatal(http.ListenAndServe(":8080", nil))
+	if *domains != "" {
+		return serveTLS(srv.Routes(), splitTags(*domains), *certCache, *acmeEmail)
+	}
+	// write listen and then run the server, on port 8080 by default
+	host, port, _ := net.SplitHostPort(*addr)
+	if host == "" {
+		host = "localhost"
+	}
+	fmt.Println("Click on http://" + net.JoinHostPort(host, port))
+	return http.ListenAndServe(*addr, srv.Routes())
 }
@@ -0,0 +1,246 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+)
+
+// the app runs a command named after its flags, like qaapp reset-password sagaryadav, and the server
+// without one. Passwords are read from the standard input, so that they can be piped in
+
+// command is a subcommand of the app
+type command struct {
+	help string
+	run  func(ctx context.Context, args []string) error
+}
+
+// commands of the app, by name
+var commands = map[string]command{
+	"serve":            {"run the web server, the default", runServe},
+	"migrate":          {"create the tables and apply the migrations the database hasn't seen", runMigrate},
+	"create-superuser": {"create a super user, or make an existing user one", migrated(runCreateSuperuser)},
+	"reset-password":   {"set a new password for a user, ending their sessions", migrated(runResetPassword)},
+	"stats":            {"count the users, posts and pending work", migrated(runStats)},
+	"export":           {"write the content of the database as JSON", migrated(runExport)},
+	"import":           {"restore a JSON export into an empty database", migrated(runImport)},
+	"participation":    {"write the participation of the students of a course as CSV", migrated(runParticipation)},
+	"maintenance":      {"list the maintenance tasks and their next run, or run the named ones now", migrated(runMaintenance)},
+}
+
+// usage lists the commands and the flags of the app
+func usage() {
+	out := flag.CommandLine.Output()
+	fmt.Fprintln(out, "usage: qaapp [-dev] [command] [arguments]")
+	fmt.Fprintln(out, "\ncommands:")
+	names := make([]string, 0, len(commands))
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Fprintf(out, "  %-18s %s\n", name, commands[name].help)
+	}
+	fmt.Fprintln(out, "\nflags:")
+	flag.PrintDefaults()
+	fmt.Fprintln(out, "\nqaapp command -h shows the arguments of a command")
+}
+
+// migrated runs a command once the database is up to date
+func migrated(run func(ctx context.Context, args []string) error) func(ctx context.Context, args []string) error {
+	return func(ctx context.Context, args []string) error {
+		createDatabase(ctx)
+		return run(ctx, args)
+	}
+}
+
+// runMigrate runs the migrate command
+func runMigrate(ctx context.Context, args []string) error {
+	flags := flag.NewFlagSet("migrate", flag.ExitOnError)
+	dryRun := flags.Bool("dry-run", false, "list what the pending migrations would drop, without writing")
+	flags.Parse(args)
+	before, err := db.schemaVersion(ctx)
+	if err != nil {
+		return err
+	}
+	if *dryRun {
+		after, err := dryRunMigrations(ctx, os.Stdout)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("dry run, nothing was written: the database would go from version %d to %d\n", before, after)
+		return nil
+	}
+	createDatabase(ctx)
+	after, err := db.schemaVersion(ctx)
+	if err != nil {
+		return err
+	}
+	if after < len(migrations) {
+		return fmt.Errorf("migration %d failed, the database stays at version %d", after+1, after)
+	}
+	if before == after {
+		fmt.Printf("the database is up to date, at version %d\n", after)
+		return nil
+	}
+	fmt.Printf("migrated the database from version %d to %d\n", before, after)
+	return nil
+}
+
+// runCreateSuperuser runs the create-superuser command
+func runCreateSuperuser(ctx context.Context, args []string) error {
+	flags := flag.NewFlagSet("create-superuser", flag.ExitOnError)
+	username := flags.String("username", "", "name of the user, required")
+	email := flags.String("email", "", "email address, optional")
+	first := flags.String("first-name", "", "first name")
+	last := flags.String("last-name", "", "last name")
+	flags.Parse(args)
+	name := strings.ToLower(strings.TrimSpace(*username))
+	if name == "" {
+		flags.Usage()
+		os.Exit(2)
+	}
+	user, err := userByName(ctx, name)
+	if err != nil {
+		return err
+	}
+	if user != nil {
+		if _, err := db.ExecContext(ctx, "update users set super_user = true where id = ?", user.UniqueID); err != nil {
+			return err
+		}
+		fmt.Printf("%s already exists and is now a super user\n", user.UserName)
+		return nil
+	}
+	if err := validateUsername(ctx, name, 0); err != nil {
+		return err
+	}
+	if *email != "" && !validEmail(*email) {
+		return errors.New("this email address isn't valid")
+	}
+	hash, err := readPassword()
+	if err != nil {
+		return err
+	}
+	_, err = db.ExecContext(ctx, `insert into users (first_name, last_name, username, password, user_type, super_user, email)
+		values (?, ?, ?, ?, 'student', true, nullif(?, ''))`, *first, *last, name, hash, *email)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("created the super user %s\n", name)
+	return nil
+}
+
+// runResetPassword runs the reset-password command
+func runResetPassword(ctx context.Context, args []string) error {
+	flags := flag.NewFlagSet("reset-password", flag.ExitOnError)
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "usage: qaapp reset-password username")
+	}
+	flags.Parse(args)
+	if flags.NArg() != 1 {
+		flags.Usage()
+		os.Exit(2)
+	}
+	user, err := userByName(ctx, flags.Arg(0))
+	if err != nil {
+		return err
+	}
+	if user == nil {
+		return fmt.Errorf("there is no user named %s", flags.Arg(0))
+	}
+	hash, err := readPassword()
+	if err != nil {
+		return err
+	}
+	// the old sessions and remember-me tokens may be in the wrong hands
+	err = db.WithTx(ctx, func(ctx context.Context) error {
+		if _, err := db.ExecContext(ctx, "update users set password = ? where id = ?", hash, user.UniqueID); err != nil {
+			return err
+		}
+		if err := sessions.DeleteUser(ctx, user.UniqueID); err != nil {
+			return err
+		}
+		return revokeRememberTokens(ctx, user.UniqueID)
+	})
+	if err != nil {
+		return err
+	}
+	fmt.Printf("changed the password of %s and logged them out\n", user.UserName)
+	return nil
+}
+
+// readPassword reads a new password from the standard input and hashes it.
+// on a terminal it is asked twice, to catch typos
+func readPassword() (string, error) {
+	in := bufio.NewReader(os.Stdin)
+	stat, err := os.Stdin.Stat()
+	terminal := err == nil && stat.Mode()&os.ModeCharDevice != 0
+	read := func(prompt string) (string, error) {
+		if terminal {
+			fmt.Fprint(os.Stderr, prompt)
+		}
+		line, err := in.ReadString('\n')
+		if err != nil && line == "" {
+			return "", errors.New("no password given on the standard input")
+		}
+		return strings.TrimRight(line, "\r\n"), nil
+	}
+	password, err := read("new password: ")
+	if err != nil {
+		return "", err
+	}
+	if len(password) < minPasswordLength {
+		return "", fmt.Errorf("the password must have at least %d characters", minPasswordLength)
+	}
+	if terminal {
+		again, err := read("again: ")
+		if err != nil {
+			return "", err
+		}
+		if again != password {
+			return "", errors.New("the passwords don't match")
+		}
+	}
+	return hashPassword(password)
+}
+
+// counts shown by the stats command
+var statsQueries = []struct {
+	label string
+	query string
+}{
+	{"users", "select count(*) from users"},
+	{"super users", "select count(*) from users where super_user"},
+	{"questions", "select count(*) from questions"},
+	{"hidden questions", "select count(*) from questions where hidden_at is not null"},
+	{"answers", "select count(*) from answers"},
+	{"comments", "select count(*) from comments"},
+	{"votes", "select count(*) from votes"},
+	{"tags", "select count(*) from tags"},
+	{"open flags", "select count(*) from flags where resolved_at is null"},
+	{"pending jobs", "select count(*) from jobs where done_at is null"},
+}
+
+// runStats runs the stats command
+func runStats(ctx context.Context, args []string) error {
+	flags := flag.NewFlagSet("stats", flag.ExitOnError)
+	flags.Parse(args)
+	for _, s := range statsQueries {
+		var n int
+		if err := db.QueryRowContext(ctx, s.query).Scan(&n); err != nil {
+			return fmt.Errorf("%s: %w", s.label, err)
+		}
+		fmt.Printf("%-18s %d\n", s.label, n)
+	}
+	version, err := db.schemaVersion(ctx)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("%-18s %d of %d\n", "schema version", version, len(migrations))
+	return nil
+}
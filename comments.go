@@ -0,0 +1,364 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// a comment on a question with at least this many up votes, and more than any answer,
+// probably answers the question and is proposed to be converted into an answer
+const commentAnswerThreshold = 3
+
+// longest comment, in characters
+const maxCommentLength = 600
+
+// columns selected for a comment, in the order expected by scanComment
+const commentColumns = "comments.id, body, date, time, user, post_type, post_id, " + commentScoreSQL + ", comments.hidden_at is not null"
+
+// score of a comment, from the votes table
+const commentScoreSQL = "(select coalesce(sum(value), 0) from votes where votes.post_type = 'comment' and votes.post_id = comments.id)"
+
+// scan a row selected with commentColumns into a Comment
+func scanComment(row scanner) (Comment, error) {
+	var c Comment
+	var date, clock, user sql.NullString
+	err := row.Scan(&c.CmtID, &c.CmtBody, &date, &clock, &user, &c.CmtPostType, &c.CmtPostID, &c.CmtScore, &c.CmtHidden)
+	c.CmtDate = date.String
+	c.CmtTime = clock.String
+	c.CmtUser = user.String
+	return c, err
+}
+
+// load a comment by id, nil if there is none
+func commentByID(ctx context.Context, id int) (*Comment, error) {
+	c, err := scanComment(db.QueryRowContext(ctx, "select "+commentColumns+" from comments where comments.id = ?", id))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &c, nil
+}
+
+// load the comments of a question and of its answers, oldest first
+func commentsOfQuestion(ctx context.Context, questionID int) ([]Comment, error) {
+	rows, err := db.QueryContext(ctx, "select "+commentColumns+` from comments
+		where (post_type = 'question' and post_id = ?)
+		or (post_type = 'answer' and post_id in (select id from answers where question_id = ?))
+		order by comments.id`, questionID, questionID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var comments []Comment
+	for rows.Next() {
+		c, err := scanComment(rows)
+		if err != nil {
+			return nil, err
+		}
+		comments = append(comments, c)
+	}
+	return comments, rows.Err()
+}
+
+// answeredInComment tells if a comment on a question looks like the answer to it:
+// it is well up voted and scores better than every answer
+func answeredInComment(c Comment, answers []Answer) bool {
+	if c.CmtPostType != postQuestion || c.CmtScore < commentAnswerThreshold {
+		return false
+	}
+	for _, a := range answers {
+		if a.AnsScore >= c.CmtScore {
+			return false
+		}
+	}
+	return true
+}
+
+// handle a comment posted on a question or an answer
+func serveNewComment(w http.ResponseWriter, r *http.Request, postType string, postID, questionID int) {
+	ctx := r.Context()
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	user := requireUser(w, r)
+	if user == nil || !requireOpenThread(w, r, user, questionID) {
+		return
+	}
+	body := strings.TrimSpace(r.FormValue("body"))
+	if body == "" || len([]rune(body)) > maxCommentLength {
+		http.Error(w, fmt.Sprintf("comments have 1 to %d characters", maxCommentLength), http.StatusBadRequest)
+		return
+	}
+	check, ok := checkNewPost(w, r, draftPost{Type: postComment, User: user, Body: body})
+	if !ok {
+		return
+	}
+	now := time.Now()
+	res, err := db.ExecContext(ctx, "insert into comments (post_type, post_id, body, date, time, user) values (?, ?, ?, ?, ?, ?)",
+		postType, postID, body, now.Format(dateLayout), now.Format(timeLayout), user.UserName)
+	if err != nil {
+		serverError(w, r, err)
+		return
+	}
+	id, _ := res.LastInsertId()
+	if check.Verdict == filterReview {
+		if err := holdForReview(ctx, postComment, int(id), check.Reason); err != nil {
+			fmt.Println(err)
+		}
+	}
+	link := fmt.Sprintf("/questions/%d#comment-%d", questionID, id)
+	if err := recordMentions(ctx, user, postComment, int(id), link, body, check.Verdict == filterReview); err != nil {
+		fmt.Println(err)
+	}
+	http.Redirect(w, r, fmt.Sprintf("/questions/%d#comment-%d", questionID, id), http.StatusSeeOther)
+}
+
+// convertCommentToAnswer turns a comment on a question into an answer by the same author,
+// keeping its date and moving its votes to the answer. It returns the id of the answer
+func convertCommentToAnswer(ctx context.Context, c *Comment) (int, error) {
+	var id int64
+	err := db.WithTx(ctx, func(ctx context.Context) error {
+		res, err := db.ExecContext(ctx, `insert into answers (body, date, time, user, views, question_id, edited_at, hidden_at)
+			select body, date, time, user, 0, post_id, edited_at, hidden_at from comments where id = ?`, c.CmtID)
+		if err != nil {
+			return err
+		}
+		if id, err = res.LastInsertId(); err != nil {
+			return err
+		}
+		if err := movePost(ctx, postComment, c.CmtID, postAnswer, int(id)); err != nil {
+			return err
+		}
+		_, err = db.ExecContext(ctx, "delete from comments where id = ?", c.CmtID)
+		return err
+	})
+	return int(id), err
+}
+
+var (
+	errConvertAccepted = errors.New("the accepted answer can't become a comment")
+	errConvertBounty   = errors.New("an answer awarded a bounty can't become a comment")
+	errConvertFiles    = errors.New("an answer with attached files can't become a comment")
+	errConvertLength   = fmt.Errorf("comments have at most %d characters, this answer is longer", maxCommentLength)
+)
+
+// convertAnswerToComment turns an answer into a comment on its question by the same author,
+// keeping its date and its up votes, as comments can't be down voted. The comments on the answer
+// move to the question. It returns the id of the comment
+func convertAnswerToComment(ctx context.Context, a *Answer) (int, error) {
+	if len([]rune(strings.TrimSpace(a.AnsBody))) > maxCommentLength {
+		return 0, errConvertLength
+	}
+	var id int64
+	err := db.WithTx(ctx, func(ctx context.Context) error {
+		var accepted, awarded, files int
+		err := db.QueryRowContext(ctx, `select
+			(select count(*) from questions where accepted_id = ?1),
+			(select count(*) from bounties where answer_id = ?1),
+			(select count(*) from attachments where post_type = ?2 and post_id = ?1)`, a.AnsID, postAnswer).Scan(&accepted, &awarded, &files)
+		if err != nil {
+			return err
+		}
+		switch {
+		case accepted > 0:
+			return errConvertAccepted
+		case awarded > 0:
+			return errConvertBounty
+		case files > 0:
+			return errConvertFiles
+		}
+		res, err := db.ExecContext(ctx, `insert into comments (post_type, post_id, body, date, time, user, edited_at, hidden_at)
+			select ?, question_id, trim(body), date, time, user, edited_at, hidden_at from answers where id = ?`, postQuestion, a.AnsID)
+		if err != nil {
+			return err
+		}
+		if id, err = res.LastInsertId(); err != nil {
+			return err
+		}
+		if _, err := db.ExecContext(ctx, "delete from votes where post_type = ? and post_id = ? and value < 0", postAnswer, a.AnsID); err != nil {
+			return err
+		}
+		if err := movePost(ctx, postAnswer, a.AnsID, postComment, int(id)); err != nil {
+			return err
+		}
+		_, err = db.ExecContext(ctx, "update comments set post_type = ?, post_id = ? where post_type = ? and post_id = ?", postQuestion, a.AnsQn, postAnswer, a.AnsID)
+		if err != nil {
+			return err
+		}
+		_, err = db.ExecContext(ctx, "delete from answers where id = ?", a.AnsID)
+		return err
+	})
+	return int(id), err
+}
+
+// movePost points the votes, mentions, flags and activity of a converted post at the post it became
+func movePost(ctx context.Context, fromType string, fromID int, toType string, toID int) error {
+	for _, table := range []string{"votes", "mentions", "flags", "activity"} {
+		_, err := db.ExecContext(ctx, "update "+table+" set post_type = ?, post_id = ? where post_type = ? and post_id = ?", toType, toID, fromType, fromID)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// serve /comments/{id}/vote and /comments/{id}/convert
+func serveComment(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	id, action, ok := parseIDPath(r.URL.Path, "/comments/")
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	c, err := commentByID(ctx, id)
+	if err != nil {
+		serverError(w, r, err)
+		return
+	}
+	if c == nil {
+		http.NotFound(w, r)
+		return
+	}
+	questionID := c.CmtPostID
+	if c.CmtPostType == postAnswer {
+		a, err := answerByID(ctx, c.CmtPostID)
+		if err != nil {
+			serverError(w, r, err)
+			return
+		}
+		if a == nil {
+			http.NotFound(w, r)
+			return
+		}
+		questionID = a.AnsQn
+	}
+	if r.Method == http.MethodPost {
+		defer questionCache.invalidate(questionID)
+	}
+
+	switch action {
+	case "vote":
+		serveVote(w, r, postComment, id, questionID)
+	case "flag":
+		serveFlag(w, r, postComment, id, questionID)
+	case "convert":
+		serveConvertComment(w, r, c)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// serve /comments/{id}/convert, where the author of a comment on a question,
+// or a moderator, turns it into an answer
+func serveConvertComment(w http.ResponseWriter, r *http.Request, c *Comment) {
+	ctx := r.Context()
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	user := requireUser(w, r)
+	if user == nil {
+		return
+	}
+	if user.UserName != c.CmtUser && !isModerator(user) {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+	if c.CmtPostType != postQuestion {
+		http.Error(w, "only comments on a question can become answers", http.StatusBadRequest)
+		return
+	}
+	// the comment becomes an answer of its author, who must be allowed to answer
+	if !requireOpenThread(w, r, user, c.CmtPostID) {
+		return
+	}
+	if user.UserName == c.CmtUser && (!requireUnclosed(w, r, c.CmtPostID) || !requireAnswerable(w, r, user, c.CmtPostID)) {
+		return
+	}
+	id, err := convertCommentToAnswer(ctx, c)
+	if err != nil {
+		serverError(w, r, err)
+		return
+	}
+	forgetData("reputation:" + strings.ToLower(c.CmtUser))
+	// moderators converting the comment of someone else leave a trace
+	if user.UserName != c.CmtUser {
+		after, err := snapshotPost(ctx, postAnswer, id)
+		if err != nil {
+			serverError(w, r, err)
+			return
+		}
+		before := postSnapshot{Author: c.CmtUser, Body: c.CmtBody}
+		if err := recordAudit(ctx, user, auditConvertComment, postComment, strconv.Itoa(c.CmtID), before, after); err != nil {
+			serverError(w, r, err)
+			return
+		}
+	}
+	http.Redirect(w, r, fmt.Sprintf("/questions/%d#answer-%d", c.CmtPostID, id), http.StatusSeeOther)
+}
+
+// serve /answers/{id}/convert, where moderators turn a misplaced answer into a comment on the question
+func serveConvertAnswer(w http.ResponseWriter, r *http.Request, a *Answer) {
+	ctx := r.Context()
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	user := requireUser(w, r)
+	if user == nil {
+		return
+	}
+	if !isModerator(user) {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+	before, err := snapshotPost(ctx, postAnswer, a.AnsID)
+	if err != nil {
+		serverError(w, r, err)
+		return
+	}
+	id, err := convertAnswerToComment(ctx, a)
+	switch err {
+	case nil:
+	case errConvertAccepted, errConvertBounty, errConvertFiles, errConvertLength:
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	default:
+		serverError(w, r, err)
+		return
+	}
+	// votes on comments earn no reputation
+	forgetData("reputation:" + strings.ToLower(a.AnsUser))
+	after, err := snapshotPost(ctx, postComment, id)
+	if err != nil {
+		serverError(w, r, err)
+		return
+	}
+	if err := recordAudit(ctx, user, auditConvertAnswer, postAnswer, strconv.Itoa(a.AnsID), before, after); err != nil {
+		serverError(w, r, err)
+		return
+	}
+	http.Redirect(w, r, fmt.Sprintf("/questions/%d#comment-%d", a.AnsQn, id), http.StatusSeeOther)
+}
+
+// commentList is the data of the comments sub-template of the question page
+type commentList struct {
+	Page      page
+	Comments  []Comment
+	Action    string // url new comments are posted to
+	Moderator bool
+}
+
+// makeCommentList is the comments template function, building the data of the comments sub-template
+func makeCommentList(p page, comments []Comment, action string) commentList {
+	return commentList{Page: p, Comments: comments, Action: action, Moderator: isModerator(p.User)}
+}
@@ -0,0 +1,232 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// new posts go through a chain of content filters. Each filter can let a post through,
+// hold it for review, which hides it and puts it in the moderation queue, or reject it
+
+// what a filter decides for a post, from the mildest to the most severe
+type filterVerdict int
+
+const (
+	filterAllow filterVerdict = iota
+	filterReview
+	filterReject
+)
+
+// filterResult is the decision of a filter, with the reason shown to moderators or to the author
+type filterResult struct {
+	Verdict filterVerdict
+	Reason  string
+}
+
+// draftPost is a post about to be saved
+type draftPost struct {
+	Type    string // postQuestion, postAnswer or postComment
+	User    *User
+	Heading string // questions only
+	Body    string
+}
+
+// contentFilter checks a post
+type contentFilter func(ctx context.Context, post draftPost) (filterResult, error)
+
+// the filters run on every new post, in order
+var contentFilters = []contentFilter{filterLinks, filterBlockedWords, filterRepeats}
+
+// checkContent runs the filters, returning the most severe result. It stops at the first rejection
+func checkContent(ctx context.Context, post draftPost) (filterResult, error) {
+	var worst filterResult
+	for _, filter := range contentFilters {
+		res, err := filter(ctx, post)
+		if err != nil {
+			return res, err
+		}
+		if res.Verdict > worst.Verdict {
+			worst = res
+		}
+		if worst.Verdict == filterReject {
+			break
+		}
+	}
+	return worst, nil
+}
+
+// holdForReview hides a post that was just saved and puts it in the moderation queue.
+// the flag is recorded under user 0, which no account has
+func holdForReview(ctx context.Context, postType string, postID int, reason string) error {
+	now := time.Now().Format(timestampLayout)
+	_, err := db.ExecContext(ctx, "insert or replace into flags (user_id, post_type, post_id, reason, created_at) values (0, ?, ?, ?, ?)",
+		postType, postID, "filter: "+reason, now)
+	if err != nil {
+		return err
+	}
+	_, err = db.ExecContext(ctx, "update "+postTables[postType]+" set hidden_at = ? where id = ?", now, postID)
+	return err
+}
+
+// recordDuplicateOverride queues the question for moderators, as its author confirmed it is different
+// from another one with a near-identical title. It adds to the reason of a filter hold on the question
+func recordDuplicateOverride(ctx context.Context, questionID, similarID int) error {
+	_, err := db.ExecContext(ctx, `insert into flags (user_id, post_type, post_id, reason, created_at) values (0, ?, ?, ?, ?)
+		on conflict (user_id, post_type, post_id) do update set reason = flags.reason || '; ' || excluded.reason`,
+		postQuestion, questionID, fmt.Sprintf("asked as different from #%d", similarID), time.Now().Format(timestampLayout))
+	return err
+}
+
+// checkNewPost runs the filters on a post from a form, answering with an error when it is rejected.
+// it returns the result to hand to holdForReview once saved, or false when the handler must stop
+func checkNewPost(w http.ResponseWriter, r *http.Request, post draftPost) (filterResult, bool) {
+	ctx := r.Context()
+	res, err := checkContent(ctx, post)
+	if err != nil {
+		serverError(w, r, err)
+		return res, false
+	}
+	if res.Verdict == filterReject {
+		http.Error(w, "your post was rejected: "+res.Reason, http.StatusUnprocessableEntity)
+		return res, false
+	}
+	return res, true
+}
+
+// links in a post beyond which it is held for review, and rejected
+const (
+	reviewLinks = 3
+	rejectLinks = 8
+)
+
+var linkPattern = regexp.MustCompile(`(?i)https?://|www\.`)
+
+// filterLinks catches posts made of links, as spam often is
+func filterLinks(ctx context.Context, post draftPost) (filterResult, error) {
+	n := len(linkPattern.FindAllString(post.Heading+" "+post.Body, -1))
+	switch {
+	case n > rejectLinks:
+		return filterResult{filterReject, "too many links"}, nil
+	case n > reviewLinks:
+		return filterResult{filterReview, "many links"}, nil
+	}
+	return filterResult{}, nil
+}
+
+// filterBlockedWords catches the words blocked by super-users
+func filterBlockedWords(ctx context.Context, post draftPost) (filterResult, error) {
+	rows, err := db.QueryContext(ctx, "select word, severity from blocked_words")
+	if err != nil {
+		return filterResult{}, err
+	}
+	defer rows.Close()
+	blocked := map[string]string{}
+	for rows.Next() {
+		var word, severity string
+		if err := rows.Scan(&word, &severity); err != nil {
+			return filterResult{}, err
+		}
+		blocked[word] = severity
+	}
+	if err := rows.Err(); err != nil || len(blocked) == 0 {
+		return filterResult{}, err
+	}
+
+	var res filterResult
+	words := strings.FieldsFunc(strings.ToLower(post.Heading+" "+post.Body), func(c rune) bool {
+		return !unicode.IsLetter(c) && !unicode.IsDigit(c)
+	})
+	for _, w := range words {
+		switch blocked[w] {
+		case "reject":
+			return filterResult{filterReject, "it contains a blocked word"}, nil
+		case "review":
+			res = filterResult{filterReview, "blocked word"}
+		}
+	}
+	return res, nil
+}
+
+// a post repeating one of the last day is rejected when it comes from the same user,
+// and held for review when other users posted it this many times
+const repeatsForReview = 2
+
+// filterRepeats catches the same text posted again and again
+func filterRepeats(ctx context.Context, post draftPost) (filterResult, error) {
+	since := time.Now().AddDate(0, 0, -1).Format(dateLayout)
+	var own, others int
+	for _, table := range postTables {
+		var o, n int
+		err := db.QueryRowContext(ctx, `select coalesce(sum(user = ?), 0), coalesce(sum(user != ?), 0) from `+table+`
+			where date >= ? and lower(trim(body)) = lower(?)`, post.User.UserName, post.User.UserName, since, post.Body).Scan(&o, &n)
+		if err != nil {
+			return filterResult{}, err
+		}
+		own += o
+		others += n
+	}
+	switch {
+	case own > 0:
+		return filterResult{filterReject, "you already posted this"}, nil
+	case others >= repeatsForReview:
+		return filterResult{filterReview, "repeated post"}, nil
+	}
+	return filterResult{}, nil
+}
+
+// blockedWord is a row of the blocked words page
+type blockedWord struct {
+	Word     string
+	Severity string
+}
+
+// serve /admin/blocked-words, where super-users block words in posts
+func serveBlockedWords(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	if requireSuperUser(w, r) == nil {
+		return
+	}
+	if r.Method == http.MethodPost {
+		word := strings.ToLower(strings.TrimSpace(r.FormValue("word")))
+		severity := r.FormValue("severity")
+		if severity != "reject" {
+			severity = "review"
+		}
+		var err error
+		switch {
+		case word == "":
+		case r.FormValue("action") == "remove":
+			_, err = db.ExecContext(ctx, "delete from blocked_words where word = ?", word)
+		default:
+			_, err = db.ExecContext(ctx, "insert or replace into blocked_words (word, severity) values (?, ?)", word, severity)
+		}
+		if err != nil {
+			serverError(w, r, err)
+			return
+		}
+		http.Redirect(w, r, "/admin/blocked-words", http.StatusSeeOther)
+		return
+	}
+
+	rows, err := db.QueryContext(ctx, "select word, severity from blocked_words order by word")
+	if err != nil {
+		serverError(w, r, err)
+		return
+	}
+	defer rows.Close()
+	var words []blockedWord
+	for rows.Next() {
+		var b blockedWord
+		if err := rows.Scan(&b.Word, &b.Severity); err != nil {
+			serverError(w, r, err)
+			return
+		}
+		words = append(words, b)
+	}
+	render(w, r, "blocked-words.html", words)
+}
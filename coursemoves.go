@@ -0,0 +1,150 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// moderators move a question asked in the wrong place to the course it fits, or out of any course,
+// from the page of the question. Its answers, comments and votes hang on the question and go with
+// it. Its tags are given anew, or kept and mapped to their canonical names, and the people who took
+// part in the thread are told where it went: the members of the old course may not see it anymore
+
+var (
+	errMoveSame   = errors.New("the question is already there")
+	errMoveCourse = errors.New("there is no such course")
+)
+
+// allCourses lists every course, by name, for the moderators moving questions between them
+func allCourses(ctx context.Context) ([]course, error) {
+	var courses []course
+	err := queryList(ctx, `select courses.id, courses.name, '', '', (select count(*) from course_members where course_id = courses.id)
+		from courses order by courses.name, courses.id`, nil, func(rows *sql.Rows) error {
+		c, err := scanCourse(rows)
+		courses = append(courses, c)
+		return err
+	})
+	return courses, err
+}
+
+// questionMove is a question moved between courses, for the audit log
+type questionMove struct {
+	Course string   `json:"course"` // empty outside of any course
+	Tags   []string `json:"tags"`
+}
+
+// moveQuestion moves the question into the course of id courseID, or out of any course for 0,
+// with the tags given, or its own when none are, and notifies the participants of the thread
+func moveQuestion(ctx context.Context, user *User, questionID, courseID int, tags string) error {
+	return db.WithTx(ctx, func(ctx context.Context) error {
+		var heading string
+		var from sql.NullInt64
+		var before questionMove
+		err := db.QueryRowContext(ctx, "select heading, course_id, coalesce(courses.name, '') from questions left join courses on courses.id = questions.course_id where questions.id = ?",
+			questionID).Scan(&heading, &from, &before.Course)
+		if err != nil {
+			return err
+		}
+		if int(from.Int64) == courseID {
+			return errMoveSame
+		}
+		after := questionMove{}
+		if courseID != 0 {
+			if err := db.QueryRowContext(ctx, "select name from courses where id = ?", courseID).Scan(&after.Course); err == sql.ErrNoRows {
+				return errMoveCourse
+			} else if err != nil {
+				return err
+			}
+		}
+		var current string
+		if err := db.QueryRowContext(ctx, "select coalesce("+questionTagsSQL+", '') from questions where id = ?", questionID).Scan(&current); err != nil {
+			return err
+		}
+		before.Tags = splitTags(current)
+		if strings.TrimSpace(tags) == "" {
+			tags = current
+		}
+		if tags, err = cleanTags(ctx, tags); err != nil {
+			return err
+		}
+		after.Tags = splitTags(strings.ToLower(tags))
+		course := sql.NullInt64{Int64: int64(courseID), Valid: courseID != 0}
+		if _, err := db.ExecContext(ctx, "update questions set course_id = ? where id = ?", course, questionID); err != nil {
+			return err
+		}
+		if err := setQuestionTags(ctx, questionID, tags); err != nil {
+			return err
+		}
+		if err := recordAudit(ctx, user, auditMoveQuestion, postQuestion, strconv.Itoa(questionID), before, after); err != nil {
+			return err
+		}
+		// the author, and those who answered or commented
+		var participants []int
+		err = queryList(ctx, `select distinct users.id from users where lower(users.username) in (
+				select lower(user) from questions where id = ?1
+				union select lower(user) from answers where question_id = ?1
+				union select lower(user) from comments where (post_type = ?2 and post_id = ?1)
+					or (post_type = ?3 and post_id in (select id from answers where question_id = ?1)))
+			and users.id != ?4`, []interface{}{questionID, postQuestion, postAnswer, user.UniqueID}, func(rows *sql.Rows) error {
+			var id int
+			err := rows.Scan(&id)
+			participants = append(participants, id)
+			return err
+		})
+		if err != nil {
+			return err
+		}
+		msg := "The question \"" + heading + "\" was moved out of its course"
+		if after.Course != "" {
+			msg = "The question \"" + heading + "\" was moved to the course " + after.Course
+		}
+		for _, id := range participants {
+			if err := notify(ctx, id, msg, fmt.Sprintf("/questions/%d", questionID)); err != nil {
+				return err
+			}
+		}
+		// the tags counted together changed
+		db.AfterCommit(ctx, func() { forgetDataPrefix("related-tags:") })
+		return nil
+	})
+}
+
+// handle POST /questions/{id}/move, where moderators move the question to the course of the course
+// field, none for 0, with the tags of the tags field if given
+func serveMoveQuestion(w http.ResponseWriter, r *http.Request, id int) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	user := requireUser(w, r)
+	if user == nil {
+		return
+	}
+	if !isModerator(user) {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+	courseID, err := strconv.Atoi(r.FormValue("course"))
+	if err != nil || courseID < 0 {
+		http.Error(w, "choose a course, or none", http.StatusBadRequest)
+		return
+	}
+	switch err := moveQuestion(r.Context(), user, id, courseID, r.FormValue("tags")); err {
+	case nil:
+	case sql.ErrNoRows:
+		http.NotFound(w, r)
+		return
+	case errMoveSame, errMoveCourse:
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	default:
+		serverError(w, r, err)
+		return
+	}
+	http.Redirect(w, r, fmt.Sprintf("/questions/%d", id), http.StatusSeeOther)
+}
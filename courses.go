@@ -0,0 +1,393 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// teachers group their students in courses on /courses, so that several classes share the site
+// without seeing each other's questions. A teacher creates a course and gives its code to the
+// students, who join with it. Questions asked in a course are only seen by its members and by
+// moderators, everywhere questions are listed, searched or notified; those asked outside of any
+// course stay seen by everyone
+
+// course member roles
+const (
+	courseTeacher = "teacher"
+	courseStudent = "student"
+)
+
+// longest name of a course, in bytes
+const maxCourseName = 100
+
+// course is a course, as seen by a user
+type course struct {
+	ID      int    `json:"id"`
+	Name    string `json:"name"`
+	Code    string `json:"code,omitempty"` // only shown to the teachers of the course
+	Role    string `json:"role,omitempty"` // of the user in the course, empty when not a member
+	Members int    `json:"members"`
+}
+
+// courseList is the answer of /api/v1/courses
+type courseList struct {
+	Courses []course `json:"courses"`
+}
+
+// courseFilter is a condition on questions leaving out those of the courses the user isn't in
+func courseFilter(user *User) (string, []interface{}) {
+	userID := 0
+	if user != nil {
+		userID = user.UniqueID
+	}
+	return "(questions.course_id is null or questions.course_id in (select course_id from course_members where user_id = ?))", []interface{}{userID}
+}
+
+// courseColumns are the columns scanned by scanCourse, the role being of the user of the first argument
+const courseColumns = `courses.id, courses.name, courses.code, coalesce(course_members.role, ''),
+	(select count(*) from course_members where course_id = courses.id)`
+
+// scanCourse scans a course, hiding its code from those who don't teach it
+func scanCourse(row scanner) (course, error) {
+	var c course
+	err := row.Scan(&c.ID, &c.Name, &c.Code, &c.Role, &c.Members)
+	if c.Role != courseTeacher {
+		c.Code = ""
+	}
+	return c, err
+}
+
+// userCourses are the courses the user is a member of, by name
+func userCourses(ctx context.Context, user *User) ([]course, error) {
+	if user == nil {
+		return nil, nil
+	}
+	rows, err := db.QueryContext(ctx, `select `+courseColumns+`
+		from courses join course_members on course_members.course_id = courses.id and course_members.user_id = ?
+		order by courses.name, courses.id`, user.UniqueID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var courses []course
+	for rows.Next() {
+		c, err := scanCourse(rows)
+		if err != nil {
+			return nil, err
+		}
+		courses = append(courses, c)
+	}
+	return courses, rows.Err()
+}
+
+// courseByID loads a course with the role of the user in it, nil if there is no such course
+func courseByID(ctx context.Context, user *User, id int) (*course, error) {
+	userID := 0
+	if user != nil {
+		userID = user.UniqueID
+	}
+	c, err := scanCourse(db.QueryRowContext(ctx, `select `+courseColumns+`
+		from courses left join course_members on course_members.course_id = courses.id and course_members.user_id = ?
+		where courses.id = ?`, userID, id))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &c, nil
+}
+
+// questionCourse loads the course a question was asked in, nil if it wasn't
+func questionCourse(ctx context.Context, user *User, questionID int) (*course, error) {
+	var id sql.NullInt64
+	if err := db.QueryRowContext(ctx, "select course_id from questions where id = ?", questionID).Scan(&id); err != nil {
+		return nil, err
+	}
+	if !id.Valid {
+		return nil, nil
+	}
+	return courseByID(ctx, user, int(id.Int64))
+}
+
+// courseMembers are the ids of the members of a course
+func courseMembers(ctx context.Context, courseID int) (map[int]bool, error) {
+	members := map[int]bool{}
+	err := queryList(ctx, "select user_id from course_members where course_id = ?", []interface{}{courseID}, func(rows *sql.Rows) error {
+		var id int
+		err := rows.Scan(&id)
+		members[id] = true
+		return err
+	})
+	return members, err
+}
+
+// joinCourse adds the user to the course of the code, as a teacher if they teach. 0 when no
+// course has this code
+func joinCourse(ctx context.Context, user *User, code string) (int, error) {
+	var id int
+	err := db.QueryRowContext(ctx, "select id from courses where code = ?", strings.ToUpper(strings.TrimSpace(code))).Scan(&id)
+	if err == sql.ErrNoRows {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	role := courseStudent
+	if staff(user) {
+		role = courseTeacher
+	}
+	_, err = db.ExecContext(ctx, "insert or ignore into course_members (course_id, user_id, role, joined_at) values (?, ?, ?, ?)",
+		id, user.UniqueID, role, time.Now().Format(timestampLayout))
+	return id, err
+}
+
+// createCourse makes a course taught by the user, with a new code
+func createCourse(ctx context.Context, user *User, name string) (int, error) {
+	var id int64
+	err := db.WithTx(ctx, func(ctx context.Context) error {
+		now := time.Now().Format(timestampLayout)
+		res, err := db.ExecContext(ctx, "insert into courses (name, code, user_id, created_at) values (?, ?, ?, ?)",
+			name, strings.ToUpper(newToken()[:8]), user.UniqueID, now)
+		if err != nil {
+			return err
+		}
+		id, _ = res.LastInsertId()
+		_, err = db.ExecContext(ctx, "insert into course_members (course_id, user_id, role, joined_at) values (?, ?, ?, ?)",
+			id, user.UniqueID, courseTeacher, now)
+		return err
+	})
+	return int(id), err
+}
+
+// coursesPage is the data of the courses page
+type coursesPage struct {
+	Courses   []course
+	CanCreate bool // the user can create courses
+	Error     string
+}
+
+// serve /courses, the courses of the user, where they join one with its code and teachers create them
+func serveCourses(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	user := requireUser(w, r)
+	if user == nil {
+		return
+	}
+	p := coursesPage{CanCreate: staff(user)}
+	if r.Method == http.MethodPost {
+		switch r.FormValue("action") {
+		case "create":
+			name := strings.TrimSpace(r.FormValue("name"))
+			switch {
+			case !p.CanCreate:
+				http.Error(w, "only teachers and moderators can create courses", http.StatusForbidden)
+				return
+			case name == "" || len(name) > maxCourseName:
+				p.Error = "the name of a course is 1 to 100 characters"
+			default:
+				id, err := createCourse(ctx, user, name)
+				if err != nil {
+					serverError(w, r, err)
+					return
+				}
+				http.Redirect(w, r, "/courses/"+strconv.Itoa(id), http.StatusSeeOther)
+				return
+			}
+		case "join":
+			id, err := joinCourse(ctx, user, r.FormValue("code"))
+			if err != nil {
+				serverError(w, r, err)
+				return
+			}
+			if id != 0 {
+				http.Redirect(w, r, "/courses/"+strconv.Itoa(id), http.StatusSeeOther)
+				return
+			}
+			p.Error = "no course has this code"
+		default:
+			http.Error(w, "Bad Request", http.StatusBadRequest)
+			return
+		}
+	}
+	var err error
+	if p.Courses, err = userCourses(ctx, user); err != nil {
+		serverError(w, r, err)
+		return
+	}
+	render(w, r, "courses.html", p)
+}
+
+// courseMember is a member of a course
+type courseMember struct {
+	UserName string
+	Role     string
+}
+
+// coursePage is the data of the page of a course
+type coursePage struct {
+	Course    course
+	Members   []courseMember
+	Questions []Question
+	CanManage bool          // the user teaches the course, or moderates
+	Channels  []chatChannel // where its new questions are posted, shown to those managing it
+	ChatKinds []string
+	Error     string
+}
+
+// serve /courses/{id}, the questions and members of a course, /courses/{id}/leave,
+// /courses/{id}/remove, where its teachers take a member out, and /courses/{id}/channels,
+// where they add and remove the chat channels of the course
+func serveCourse(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	id, action, ok := parseIDPath(r.URL.Path, "/courses/")
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	user := requireUser(w, r)
+	if user == nil {
+		return
+	}
+	c, err := courseByID(ctx, user, id)
+	if err != nil {
+		serverError(w, r, err)
+		return
+	}
+	// those outside of a course don't learn it exists
+	if c == nil || (c.Role == "" && !isModerator(user)) {
+		http.NotFound(w, r)
+		return
+	}
+	p := coursePage{Course: *c, CanManage: c.Role == courseTeacher || isModerator(user)}
+
+	switch action {
+	case "":
+	case "leave", "remove":
+		if r.Method != http.MethodPost {
+			http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		memberID := user.UniqueID
+		back := "/courses"
+		if action == "remove" {
+			if !p.CanManage {
+				http.Error(w, "Forbidden", http.StatusForbidden)
+				return
+			}
+			member, err := userByName(ctx, r.FormValue("username"))
+			if err != nil {
+				serverError(w, r, err)
+				return
+			}
+			if member == nil {
+				http.NotFound(w, r)
+				return
+			}
+			memberID, back = member.UniqueID, "/courses/"+strconv.Itoa(id)
+		}
+		if _, err := db.ExecContext(ctx, "delete from course_members where course_id = ? and user_id = ?", id, memberID); err != nil {
+			serverError(w, r, err)
+			return
+		}
+		http.Redirect(w, r, back, http.StatusSeeOther)
+		return
+	case "channels":
+		if r.Method != http.MethodPost {
+			http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if !p.CanManage {
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+		if r.FormValue("action") == "remove" {
+			_, err = db.ExecContext(ctx, "delete from chat_channels where id = ? and course_id = ?", r.FormValue("id"), id)
+		} else {
+			err = addChatChannel(ctx, user, r.FormValue("kind"), r.FormValue("url"), r.FormValue("tags"), id)
+		}
+		if err == errChatChannel {
+			p.Error = err.Error()
+			break
+		}
+		if err != nil {
+			serverError(w, r, err)
+			return
+		}
+		http.Redirect(w, r, "/courses/"+strconv.Itoa(id), http.StatusSeeOther)
+		return
+	default:
+		http.NotFound(w, r)
+		return
+	}
+
+	if err := queryList(ctx, `select users.username, course_members.role from course_members join users on users.id = course_members.user_id
+		where course_members.course_id = ? order by course_members.role = 'student', users.username`, []interface{}{id}, func(rows *sql.Rows) error {
+		var m courseMember
+		err := rows.Scan(&m.UserName, &m.Role)
+		p.Members = append(p.Members, m)
+		return err
+	}); err != nil {
+		serverError(w, r, err)
+		return
+	}
+	if p.CanManage {
+		if p.Channels, err = chatChannels(ctx, id); err != nil {
+			serverError(w, r, err)
+			return
+		}
+		p.ChatKinds = chatKinds
+	}
+	filter, args, err := questionFilter(ctx, user)
+	if err != nil {
+		serverError(w, r, err)
+		return
+	}
+	rows, err := db.QueryContext(ctx, "select "+questionColumns+" from questions where "+filter+" and questions.course_id = ? order by date desc, time desc, id desc limit ?",
+		append(args, id, questionsPerPage)...)
+	if err != nil {
+		serverError(w, r, err)
+		return
+	}
+	defer rows.Close()
+	for rows.Next() {
+		q, err := scanQuestion(rows)
+		if err != nil {
+			serverError(w, r, err)
+			return
+		}
+		maskAuthor(&q, user)
+		p.Questions = append(p.Questions, q)
+	}
+	if err := rows.Err(); err != nil {
+		serverError(w, r, err)
+		return
+	}
+	render(w, r, "course.html", p)
+}
+
+// serve /api/v1/courses, the courses of the user
+func serveCoursesAPI(w http.ResponseWriter, r *http.Request) {
+	user := currentUser(r)
+	if user == nil {
+		writeJSONError(w, http.StatusUnauthorized, "log in to see your courses")
+		return
+	}
+	if r.Method != http.MethodGet {
+		writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	courses, err := userCourses(r.Context(), user)
+	if err != nil {
+		writeInternalError(w, r, err)
+		return
+	}
+	if courses == nil {
+		courses = []course{}
+	}
+	writeJSON(w, http.StatusOK, courseList{Courses: courses})
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// teachers set a deadline on a question, or on a tag for all of its questions, like the
+// discussion of a homework closing on Friday at 18:00. Once the earliest deadline of a question
+// passes, its thread is read-only for students: no new answers or comments, no edits. Teachers
+// and moderators still post. The question page counts down to the deadline
+
+// layout of the datetime-local inputs
+const deadlineInputLayout = "2006-01-02T15:04"
+
+// deadline is when a thread closes for students
+type deadline struct {
+	At     string // in timestampLayout
+	ISO    string // RFC 3339, for the countdown script
+	Input  string // in deadlineInputLayout, for the forms
+	Tag    string // tag the deadline is set on, empty when set on the question
+	Passed bool
+}
+
+// makeDeadline makes the deadline of a time stored in timestampLayout
+func makeDeadline(at, tag string) (*deadline, error) {
+	t, err := time.ParseInLocation(timestampLayout, at, time.Local)
+	if err != nil {
+		return nil, err
+	}
+	return &deadline{At: at, ISO: t.Format(time.RFC3339), Input: t.Format(deadlineInputLayout), Tag: tag, Passed: !time.Now().Before(t)}, nil
+}
+
+// questionDeadline is the earliest of the deadlines of the question and of its tags, nil if
+// there is none
+func questionDeadline(ctx context.Context, questionID int) (*deadline, error) {
+	var at, tag string
+	err := db.QueryRowContext(ctx, `select deadline, '' from questions where id = ?1 and deadline is not null
+		union all
+		select tags.deadline, tags.name from question_tags join tags on tags.id = question_tags.tag_id
+			where question_tags.question_id = ?1 and tags.deadline is not null
+		order by 1 limit 1`, questionID).Scan(&at, &tag)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return makeDeadline(at, tag)
+}
+
+// tagDeadline is the deadline set on the tag, nil if there is none
+func tagDeadline(ctx context.Context, tag string) (*deadline, error) {
+	var at sql.NullString
+	err := db.QueryRowContext(ctx, "select deadline from tags where name = ?", tag).Scan(&at)
+	if err == sql.ErrNoRows || !at.Valid {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return makeDeadline(at.String, tag)
+}
+
+// threadClosed tells if the thread of the question is closed to the user, a student past its deadline
+func threadClosed(ctx context.Context, user *User, questionID int) (bool, error) {
+	if staff(user) {
+		return false, nil
+	}
+	d, err := questionDeadline(ctx, questionID)
+	return d != nil && d.Passed, err
+}
+
+// requireOpenThread answers 403 and returns false when the thread of the question is closed to the user
+func requireOpenThread(w http.ResponseWriter, r *http.Request, user *User, questionID int) bool {
+	closed, err := threadClosed(r.Context(), user, questionID)
+	if err != nil {
+		serverError(w, r, err)
+		return false
+	}
+	if closed {
+		http.Error(w, "this discussion is closed, its deadline has passed", http.StatusForbidden)
+		return false
+	}
+	return true
+}
+
+// parseDeadline reads the deadline of a form, nil to remove it
+func parseDeadline(r *http.Request) (interface{}, error) {
+	value := r.FormValue("deadline")
+	if value == "" || r.FormValue("action") == "remove" {
+		return nil, nil
+	}
+	t, err := time.ParseInLocation(deadlineInputLayout, value, time.Local)
+	if err != nil {
+		return nil, fmt.Errorf("%q isn't a date and time", value)
+	}
+	return t.Format(timestampLayout), nil
+}
+
+// handle POST /questions/{id}/deadline and /tags/{name}/deadline, where teachers and moderators
+// set or remove the deadline of a question or of a tag. The tag is empty for a question
+func serveDeadline(w http.ResponseWriter, r *http.Request, questionID int, tag string) {
+	ctx := r.Context()
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	user := requireUser(w, r)
+	if user == nil {
+		return
+	}
+	if !staff(user) {
+		http.Error(w, "only teachers and moderators set deadlines", http.StatusForbidden)
+		return
+	}
+	at, err := parseDeadline(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if tag == "" {
+		if _, err := db.ExecContext(ctx, "update questions set deadline = ? where id = ?", at, questionID); err != nil {
+			serverError(w, r, err)
+			return
+		}
+		http.Redirect(w, r, fmt.Sprintf("/questions/%d", questionID), http.StatusSeeOther)
+		return
+	}
+	// the tag may only exist on its questions yet
+	err = db.WithTx(ctx, func(ctx context.Context) error {
+		if _, err := db.ExecContext(ctx, "insert or ignore into tags (name, desc) values (?, '')", tag); err != nil {
+			return err
+		}
+		_, err := db.ExecContext(ctx, "update tags set deadline = ? where name = ?", at, tag)
+		return err
+	})
+	if err != nil {
+		serverError(w, r, err)
+		return
+	}
+	// the pages of the questions of the tag show the deadline
+	questionCache.clear()
+	http.Redirect(w, r, "/tags/"+url.PathEscape(tag), http.StatusSeeOther)
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"strings"
+	"unicode"
+)
+
+// revisions are compared word by word: the texts are split into words and the spaces between
+// them, and the longest common sequence of those is kept, the rest being removed or added.
+// Texts too long to compare word by word are compared line by line
+
+// texts whose comparison would take more cells than this, once their common start and end are
+// set aside, are compared line by line, and shown as all removed then all added when the lines
+// take more cells still
+const maxDiffCells = 256 << 10
+
+// kinds of the parts of a diff
+const (
+	diffSame    = "same"
+	diffAdded   = "added"
+	diffRemoved = "removed"
+)
+
+// diffPart is a run of text of a diff, kept, added or removed
+type diffPart struct {
+	Kind string
+	Text string
+}
+
+// diffTokens splits text into words and runs of spaces, which joined give the text back
+func diffTokens(text string) []string {
+	var tokens []string
+	start, space := 0, false
+	for i, r := range text {
+		if i > start && unicode.IsSpace(r) != space {
+			tokens = append(tokens, text[start:i])
+			start = i
+		}
+		space = unicode.IsSpace(r)
+	}
+	if start < len(text) {
+		tokens = append(tokens, text[start:])
+	}
+	return tokens
+}
+
+// diffLines splits text into lines, each with its line break, which joined give the text back
+func diffLines(text string) []string {
+	lines := strings.SplitAfter(text, "\n")
+	if n := len(lines); lines[n-1] == "" {
+		lines = lines[:n-1]
+	}
+	return lines
+}
+
+// wordDiff compares two versions of a text word by word, or line by line when they are too long
+func wordDiff(before, after string) []diffPart {
+	parts, ok := tokenDiff(diffTokens(before), diffTokens(after))
+	if !ok {
+		parts, _ = tokenDiff(diffLines(before), diffLines(after))
+	}
+	return groupChanges(parts)
+}
+
+// tokenDiff compares two lists of tokens. When that would take more than maxDiffCells, it tells so,
+// with the tokens between the common start and end all removed then all added
+func tokenDiff(a, b []string) ([]diffPart, bool) {
+	prefix := 0
+	for prefix < len(a) && prefix < len(b) && a[prefix] == b[prefix] {
+		prefix++
+	}
+	suffix := 0
+	for suffix < len(a)-prefix && suffix < len(b)-prefix && a[len(a)-1-suffix] == b[len(b)-1-suffix] {
+		suffix++
+	}
+	var parts []diffPart
+	add := func(kind, text string) {
+		if text == "" {
+			return
+		}
+		if n := len(parts); n > 0 && parts[n-1].Kind == kind {
+			parts[n-1].Text += text
+			return
+		}
+		parts = append(parts, diffPart{Kind: kind, Text: text})
+	}
+	add(diffSame, strings.Join(a[:prefix], ""))
+	end := strings.Join(a[len(a)-suffix:], "")
+	a, b = a[prefix:len(a)-suffix], b[prefix:len(b)-suffix]
+	ok := len(a)*len(b) <= maxDiffCells
+	if !ok {
+		add(diffRemoved, strings.Join(a, ""))
+		add(diffAdded, strings.Join(b, ""))
+	} else {
+		// lengths[i][j] is the length of the longest common sequence of a[i:] and b[j:]
+		lengths := make([][]int, len(a)+1)
+		for i := range lengths {
+			lengths[i] = make([]int, len(b)+1)
+		}
+		for i := len(a) - 1; i >= 0; i-- {
+			for j := len(b) - 1; j >= 0; j-- {
+				if a[i] == b[j] {
+					lengths[i][j] = lengths[i+1][j+1] + 1
+				} else if lengths[i+1][j] >= lengths[i][j+1] {
+					lengths[i][j] = lengths[i+1][j]
+				} else {
+					lengths[i][j] = lengths[i][j+1]
+				}
+			}
+		}
+		i, j := 0, 0
+		for i < len(a) || j < len(b) {
+			switch {
+			case i < len(a) && j < len(b) && a[i] == b[j]:
+				add(diffSame, a[i])
+				i++
+				j++
+			case j == len(b) || (i < len(a) && lengths[i+1][j] >= lengths[i][j+1]):
+				add(diffRemoved, a[i])
+				i++
+			default:
+				add(diffAdded, b[j])
+				j++
+			}
+		}
+	}
+	add(diffSame, end)
+	return parts, ok
+}
+
+// groupChanges joins the changes only split by spaces into one removal followed by one addition,
+// which reads better than words removed and added in turn
+func groupChanges(parts []diffPart) []diffPart {
+	var grouped []diffPart
+	for i := 0; i < len(parts); {
+		if parts[i].Kind == diffSame {
+			grouped = append(grouped, parts[i])
+			i++
+			continue
+		}
+		var removed, added strings.Builder
+		j := i
+		for ; j < len(parts); j++ {
+			p := parts[j]
+			if p.Kind == diffSame {
+				// only spaces with more changes after them belong to the change
+				if strings.TrimSpace(p.Text) != "" || j+1 == len(parts) {
+					break
+				}
+				removed.WriteString(p.Text)
+				added.WriteString(p.Text)
+			} else if p.Kind == diffRemoved {
+				removed.WriteString(p.Text)
+			} else {
+				added.WriteString(p.Text)
+			}
+		}
+		if removed.Len() > 0 {
+			grouped = append(grouped, diffPart{Kind: diffRemoved, Text: removed.String()})
+		}
+		if added.Len() > 0 {
+			grouped = append(grouped, diffPart{Kind: diffAdded, Text: added.String()})
+		}
+		i = j
+	}
+	return grouped
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestWordDiff(t *testing.T) {
+	tests := []struct {
+		before, after string
+		want          []diffPart
+	}{
+		{"", "", nil},
+		{"same text", "same text", []diffPart{{diffSame, "same text"}}},
+		{"", "new", []diffPart{{diffAdded, "new"}}},
+		{"the quick fox", "the slow fox", []diffPart{{diffSame, "the "}, {diffRemoved, "quick"}, {diffAdded, "slow"}, {diffSame, " fox"}}},
+		{"a b c d", "a x y d", []diffPart{{diffSame, "a "}, {diffRemoved, "b c"}, {diffAdded, "x y"}, {diffSame, " d"}}},
+	}
+	for _, tt := range tests {
+		if got := wordDiff(tt.before, tt.after); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("wordDiff(%q, %q) = %v, want %v", tt.before, tt.after, got, tt.want)
+		}
+	}
+}
+
+// TestWordDiffLong checks that texts too long to compare word by word are compared line by line
+func TestWordDiffLong(t *testing.T) {
+	var before, after strings.Builder
+	for i := 0; i < 200; i++ {
+		line := fmt.Sprintf("line %d %s\n", i, strings.Repeat("word ", 20))
+		before.WriteString(line)
+		if i == 0 || i == 100 || i == 199 {
+			line = "a changed line\n"
+		}
+		after.WriteString(line)
+	}
+	// changed at both ends, nothing is set aside before counting the cells
+	if n := len(diffTokens(before.String())) * len(diffTokens(after.String())); n <= maxDiffCells {
+		t.Fatalf("%d cells are few enough to compare word by word", n)
+	}
+	got := wordDiff(before.String(), after.String())
+	var removed, added []string
+	for _, p := range got {
+		switch p.Kind {
+		case diffRemoved:
+			removed = append(removed, p.Text)
+		case diffAdded:
+			added = append(added, p.Text)
+		}
+	}
+	line := func(i int) string { return fmt.Sprintf("line %d %s\n", i, strings.Repeat("word ", 20)) }
+	if !reflect.DeepEqual(removed, []string{line(0), line(100), line(199)}) || !reflect.DeepEqual(added, []string{"a changed line\n", "a changed line\n", "a changed line\n"}) {
+		t.Errorf("wordDiff of long texts removed %q and added %q, want the changed lines", removed, added)
+	}
+}
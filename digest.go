@@ -0,0 +1,241 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+)
+
+// users can get a digest of the activity they care about by email, daily or weekly.
+// links in digests start with SITE_URL, since there is no request to take the host from
+
+const defaultSiteURL = "http://localhost:8080"
+
+// how often the digest job looks for users due a digest
+const digestInterval = time.Hour
+
+// most entries of each section of a digest
+const digestSectionSize = 20
+
+// digest frequencies, as stored in users.digest
+var digestPeriods = map[string]time.Duration{
+	"daily":  24 * time.Hour,
+	"weekly": 7 * 24 * time.Hour,
+}
+
+func init() {
+	jobHandlers["digest"] = sendDigestsJob
+}
+
+// siteURL is the public url of the site, for links outside of a request
+func siteURL() string {
+	if u := os.Getenv("SITE_URL"); u != "" {
+		return strings.TrimSuffix(u, "/")
+	}
+	return defaultSiteURL
+}
+
+// scheduleDigests queues the next run of the digest job, unless one is already waiting
+func scheduleDigests(ctx context.Context) error {
+	now := time.Now()
+	var n int
+	err := db.QueryRowContext(ctx, "select count(*) from jobs where kind = 'digest' and done_at is null and run_at > ?",
+		now.Format(timestampLayout)).Scan(&n)
+	if err != nil || n > 0 {
+		return err
+	}
+	return enqueueJobAt(ctx, "digest", struct{}{}, now.Add(digestInterval))
+}
+
+// digestUser is a user due a digest
+type digestUser struct {
+	id    int
+	name  string
+	email string
+	since string // activity after this timestamp goes in the digest
+}
+
+// sendDigestsJob sends the digests that are due, then schedules the next run
+func sendDigestsJob(ctx context.Context, payload []byte) error {
+	now := time.Now()
+	rows, err := db.QueryContext(ctx, `select id, username, email, digest, coalesce(digest_sent_at, '') from users
+		where digest in ('daily', 'weekly') and coalesce(email, '') != ''
+		and coalesce((select email_opt_in from user_preferences where user_id = users.id), true)`)
+	if err != nil {
+		return err
+	}
+	var due []digestUser
+	for rows.Next() {
+		var u digestUser
+		var frequency string
+		if err := rows.Scan(&u.id, &u.name, &u.email, &frequency, &u.since); err != nil {
+			rows.Close()
+			return err
+		}
+		start := now.Add(-digestPeriods[frequency]).Format(timestampLayout)
+		if u.since > start {
+			continue
+		}
+		if u.since == "" {
+			u.since = start
+		}
+		due = append(due, u)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, u := range due {
+		if err := sendDigest(ctx, u, now); err != nil {
+			return err
+		}
+	}
+	return scheduleDigests(ctx)
+}
+
+// sendDigest emails a digest to the user, unless nothing happened, and records it as sent
+func sendDigest(ctx context.Context, u digestUser, now time.Time) error {
+	base := siteURL()
+	var sections []string
+
+	questions, err := digestQuestions(ctx, u)
+	if err != nil {
+		return err
+	}
+	if len(questions) > 0 {
+		sections = append(sections, "New questions in the tags you follow:\n"+digestLines(questions, base))
+	}
+	answers, err := digestAnswers(ctx, u)
+	if err != nil {
+		return err
+	}
+	if len(answers) > 0 {
+		sections = append(sections, "New answers to your questions:\n"+digestLines(answers, base))
+	}
+	notes, err := digestNotifications(ctx, u)
+	if err != nil {
+		return err
+	}
+	if len(notes) > 0 {
+		sections = append(sections, "Unread notifications:\n"+digestLines(notes, base))
+	}
+
+	if len(sections) > 0 {
+		body := strings.Join(sections, "\n") + "\nChange how often you get this email: " + base + "/settings/email\n"
+		if err := queueEmail(ctx, u.email, "Your QA Learning digest", body); err != nil {
+			return err
+		}
+	}
+	_, err = db.ExecContext(ctx, "update users set digest_sent_at = ? where id = ?", now.Format(timestampLayout), u.id)
+	return err
+}
+
+// digestEntry is a line of a digest, linking to a page of the site
+type digestEntry struct {
+	text string
+	link string
+}
+
+func digestLines(entries []digestEntry, base string) string {
+	var b strings.Builder
+	for _, e := range entries {
+		fmt.Fprintf(&b, "- %s\n  %s%s\n", e.text, base, e.link)
+	}
+	return b.String()
+}
+
+// digestQuestions finds the questions asked by others in the tags the user follows
+func digestQuestions(ctx context.Context, u digestUser) ([]digestEntry, error) {
+	rows, err := db.QueryContext(ctx, "select target from subscriptions where user_id = ? and target_type = ?", u.id, followTag)
+	if err != nil {
+		return nil, err
+	}
+	filter, args, err := questionFilter(ctx, nil)
+	if err != nil {
+		rows.Close()
+		return nil, err
+	}
+	args = append(args, u.since, u.name)
+	var matches []string
+	for rows.Next() {
+		var tag string
+		if err := rows.Scan(&tag); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		matches = append(matches, taggedSQL)
+		args = append(args, strings.ToLower(tag))
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil || len(matches) == 0 {
+		return nil, err
+	}
+	args = append(args, digestSectionSize)
+	rows, err = db.QueryContext(ctx, `select id, heading from questions
+		where `+filter+` and date || ' ' || time > ? and user != ? and (`+strings.Join(matches, " or ")+`)
+		order by id desc limit ?`, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var entries []digestEntry
+	for rows.Next() {
+		var id int
+		var heading string
+		if err := rows.Scan(&id, &heading); err != nil {
+			return nil, err
+		}
+		entries = append(entries, digestEntry{heading, fmt.Sprintf("/questions/%d", id)})
+	}
+	return entries, rows.Err()
+}
+
+// digestAnswers finds the answers others gave to the questions of the user
+func digestAnswers(ctx context.Context, u digestUser) ([]digestEntry, error) {
+	rows, err := db.QueryContext(ctx, `select answers.id, answers.user, questions.id, questions.heading
+		from answers join questions on questions.id = answers.question_id
+		where questions.user = ? and answers.user != ? and answers.date || ' ' || answers.time > ?
+		order by answers.id desc limit ?`, u.name, u.name, u.since, digestSectionSize)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var entries []digestEntry
+	for rows.Next() {
+		var answerID, questionID int
+		var user, heading string
+		if err := rows.Scan(&answerID, &user, &questionID, &heading); err != nil {
+			return nil, err
+		}
+		entries = append(entries, digestEntry{
+			fmt.Sprintf("%s answered %s", user, heading),
+			fmt.Sprintf("/questions/%d#answer-%d", questionID, answerID),
+		})
+	}
+	return entries, rows.Err()
+}
+
+// digestNotifications lists the notifications the user hasn't read
+func digestNotifications(ctx context.Context, u digestUser) ([]digestEntry, error) {
+	rows, err := db.QueryContext(ctx, `select message, coalesce(link, '') from notifications
+		where user_id = ? and read_at is null order by id desc limit ?`, u.id, digestSectionSize)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var entries []digestEntry
+	for rows.Next() {
+		var e digestEntry
+		if err := rows.Scan(&e.text, &e.link); err != nil {
+			return nil, err
+		}
+		if e.link == "" {
+			e.link = "/notifications"
+		}
+		entries = append(entries, e)
+	}
+	return entries, rows.Err()
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// the ask page and the answer form save what is typed as a draft of the user, so a refresh
+// or an expired session doesn't lose a post. A user has one question draft, and one answer draft
+// per question. Drafts are deleted once the post is made
+
+// largest draft accepted, in bytes of JSON
+const maxDraftSize = 64 << 10
+
+// kinds of draft
+const (
+	draftQuestion = "question"
+	draftAnswer   = "answer"
+)
+
+// draft is a post being written
+type draft struct {
+	Kind       string `json:"kind"`
+	QuestionID int    `json:"question_id,omitempty"` // question answered, for answer drafts
+	Heading    string `json:"heading,omitempty"`
+	Body       string `json:"body"`
+	Tags       string `json:"tags,omitempty"`
+	UpdatedAt  string `json:"updated_at"`
+}
+
+// loadDraft loads a draft of the user, nil if there is none
+func loadDraft(ctx context.Context, userID int, kind string, questionID int) (*draft, error) {
+	d := draft{Kind: kind, QuestionID: questionID}
+	err := db.QueryRowContext(ctx, "select heading, body, tags, updated_at from drafts where user_id = ? and kind = ? and question_id = ?",
+		userID, kind, questionID).Scan(&d.Heading, &d.Body, &d.Tags, &d.UpdatedAt)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &d, nil
+}
+
+// saveDraft stores a draft of the user, replacing the previous one
+func saveDraft(ctx context.Context, userID int, d *draft) error {
+	d.UpdatedAt = time.Now().Format(timestampLayout)
+	_, err := db.ExecContext(ctx, `insert or replace into drafts (user_id, kind, question_id, heading, body, tags, updated_at)
+		values (?, ?, ?, ?, ?, ?, ?)`, userID, d.Kind, d.QuestionID, d.Heading, d.Body, d.Tags, d.UpdatedAt)
+	return err
+}
+
+// deleteDraft drops a draft of the user, once posted or discarded
+func deleteDraft(ctx context.Context, userID int, kind string, questionID int) error {
+	_, err := db.ExecContext(ctx, "delete from drafts where user_id = ? and kind = ? and question_id = ?", userID, kind, questionID)
+	return err
+}
+
+// draftsOf loads the drafts of the user, the latest first
+func draftsOf(ctx context.Context, userID int) ([]draft, error) {
+	rows, err := db.QueryContext(ctx, "select kind, question_id, heading, body, tags, updated_at from drafts where user_id = ? order by updated_at desc", userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	drafts := []draft{}
+	for rows.Next() {
+		var d draft
+		if err := rows.Scan(&d.Kind, &d.QuestionID, &d.Heading, &d.Body, &d.Tags, &d.UpdatedAt); err != nil {
+			return nil, err
+		}
+		drafts = append(drafts, d)
+	}
+	return drafts, rows.Err()
+}
+
+// draftList is the answer of /api/v1/drafts
+type draftList struct {
+	Drafts []draft `json:"drafts"`
+}
+
+// serve /api/v1/drafts, the drafts of the user, and /api/v1/drafts/question and /api/v1/drafts/answer/{id},
+// which are read with GET, saved with PUT and discarded with DELETE
+func serveDrafts(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	user := currentUser(r)
+	if user == nil {
+		writeJSONError(w, http.StatusUnauthorized, "log in to save drafts")
+		return
+	}
+	path := strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/v1/drafts"), "/")
+	if path == "" {
+		if r.Method != http.MethodGet {
+			writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
+			return
+		}
+		drafts, err := draftsOf(ctx, user.UniqueID)
+		if err != nil {
+			writeInternalError(w, r, err)
+			return
+		}
+		if drafts == nil {
+			drafts = []draft{}
+		}
+		writeJSON(w, http.StatusOK, draftList{Drafts: drafts})
+		return
+	}
+
+	kind, idPart, _ := strings.Cut(path, "/")
+	questionID := 0
+	switch {
+	case kind == draftQuestion && idPart == "":
+	case kind == draftAnswer:
+		id, err := strconv.Atoi(idPart)
+		if err != nil || id <= 0 {
+			writeJSONError(w, http.StatusNotFound, "not found")
+			return
+		}
+		questionID = id
+	default:
+		writeJSONError(w, http.StatusNotFound, "not found")
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		d, err := loadDraft(ctx, user.UniqueID, kind, questionID)
+		if err != nil {
+			writeInternalError(w, r, err)
+			return
+		}
+		if d == nil {
+			writeJSONError(w, http.StatusNotFound, "no draft")
+			return
+		}
+		writeJSON(w, http.StatusOK, d)
+	case http.MethodPut:
+		var d draft
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxDraftSize)).Decode(&d); err != nil {
+			writeJSONError(w, http.StatusBadRequest, "the draft isn't valid JSON or is too large")
+			return
+		}
+		d.Kind, d.QuestionID = kind, questionID
+		if kind == draftAnswer {
+			d.Heading, d.Tags = "", ""
+		}
+		var err error
+		if strings.TrimSpace(d.Heading+d.Body+d.Tags) == "" {
+			// emptying the form discards the draft
+			err = deleteDraft(ctx, user.UniqueID, kind, questionID)
+		} else {
+			err = saveDraft(ctx, user.UniqueID, &d)
+		}
+		if err != nil {
+			writeInternalError(w, r, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, d)
+	case http.MethodDelete:
+		if err := deleteDraft(ctx, user.UniqueID, kind, questionID); err != nil {
+			writeInternalError(w, r, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
+	}
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"time"
+)
+
+// opening the edit form of a post takes a short lease on it, so others see who is editing.
+// a lease ends when the post is saved, or expires on its own when the editor walks away
+
+// how long an edit lease lasts after the edit form was opened
+const editLeaseDuration = 10 * time.Minute
+
+// takeEditLease gives the user the lease on the post, unless someone else holds it.
+// it returns the name of that other editor, empty when the user got the lease
+func takeEditLease(ctx context.Context, user *User, postType string, postID int) (string, error) {
+	now := time.Now()
+	var name string
+	err := db.WithTx(ctx, func(ctx context.Context) error {
+		var holder int
+		err := db.QueryRowContext(ctx, `select edit_leases.user_id, users.username from edit_leases join users on users.id = edit_leases.user_id
+			where post_type = ? and post_id = ? and expires_at > ?`, postType, postID, now.Format(timestampLayout)).Scan(&holder, &name)
+		if err != nil && err != sql.ErrNoRows {
+			return err
+		}
+		if err == nil && holder != user.UniqueID {
+			return nil
+		}
+		name = ""
+		_, err = db.ExecContext(ctx, "insert or replace into edit_leases (post_type, post_id, user_id, expires_at) values (?, ?, ?, ?)",
+			postType, postID, user.UniqueID, now.Add(editLeaseDuration).Format(timestampLayout))
+		return err
+	})
+	return name, err
+}
+
+// releaseEditLease ends the lease of the user on the post, once saved
+func releaseEditLease(ctx context.Context, user *User, postType string, postID int) error {
+	_, err := db.ExecContext(ctx, "delete from edit_leases where post_type = ? and post_id = ? and user_id = ?", postType, postID, user.UniqueID)
+	return err
+}
+
+// postEditors are the users editing posts, by post type and id
+type postEditors map[string]map[int]string
+
+// threadEditors loads who is editing the question and its answers
+func threadEditors(ctx context.Context, questionID int) (postEditors, error) {
+	rows, err := db.QueryContext(ctx, `select post_type, post_id, users.username from edit_leases join users on users.id = edit_leases.user_id
+		where expires_at > ? and ((post_type = 'question' and post_id = ?) or
+			(post_type = 'answer' and post_id in (select id from answers where question_id = ?)))`,
+		time.Now().Format(timestampLayout), questionID, questionID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	editors := postEditors{postQuestion: {}, postAnswer: {}}
+	for rows.Next() {
+		var postType, name string
+		var postID int
+		if err := rows.Scan(&postType, &postID, &name); err != nil {
+			return nil, err
+		}
+		editors[postType][postID] = name
+	}
+	return editors, rows.Err()
+}
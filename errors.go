@@ -0,0 +1,113 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"runtime/debug"
+	"time"
+)
+
+// errors of handlers are logged as JSON lines on stderr, under a short id shown to the user,
+// so that an error reported as "error AB12CD" can be found in the logs with its request and stack
+
+// letters of the error ids, without those looking alike
+const errorIDAlphabet = "ABCDEFGHJKLMNPQRSTUVWXYZ23456789"
+
+// newErrorID makes a random id of 6 characters
+func newErrorID() string {
+	b := make([]byte, 6)
+	if _, err := rand.Read(b); err != nil {
+		return "XXXXXX"
+	}
+	for i := range b {
+		b[i] = errorIDAlphabet[int(b[i])%len(errorIDAlphabet)]
+	}
+	return string(b)
+}
+
+// errorRecord is the log line of an error
+type errorRecord struct {
+	Time    string `json:"time"`
+	Level   string `json:"level"`
+	ErrorID string `json:"error_id"`
+	Error   string `json:"error"`
+	Method  string `json:"method"`
+	URL     string `json:"url"`
+	User    string `json:"user,omitempty"`
+	IP      string `json:"ip"`
+	Agent   string `json:"user_agent,omitempty"`
+	Stack   string `json:"stack"`
+}
+
+// logError logs the error with its request and returns the id of the log line
+func logError(r *http.Request, err error) string {
+	ctx := r.Context()
+	rec := errorRecord{
+		Time:    time.Now().Format(time.RFC3339),
+		Level:   "error",
+		ErrorID: newErrorID(),
+		Error:   err.Error(),
+		Method:  r.Method,
+		URL:     r.URL.String(),
+		IP:      clientIP(r),
+		Agent:   r.UserAgent(),
+		Stack:   string(debug.Stack()),
+	}
+	// the user is only known from the session cookie, which needs a working database
+	if cookie, cookieErr := r.Cookie(sessionCookie); cookieErr == nil {
+		var name string
+		if userID, lookupErr := sessions.Lookup(ctx, cookie.Value); lookupErr == nil && userID != 0 &&
+			db.QueryRowContext(ctx, "select username from users where id = ?", userID).Scan(&name) == nil {
+			rec.User = name
+		}
+	}
+	line, jsonErr := json.Marshal(rec)
+	if jsonErr != nil {
+		fmt.Fprintf(os.Stderr, "error %s: %v\n", rec.ErrorID, err)
+		return rec.ErrorID
+	}
+	fmt.Fprintln(os.Stderr, string(line))
+	return rec.ErrorID
+}
+
+// serverError logs the error and answers with the error page, which only shows the id of the error
+func serverError(w http.ResponseWriter, r *http.Request, err error) {
+	// the client went away, canceling its queries, so there is no one to show the error to
+	if errors.Is(err, context.Canceled) && r.Context().Err() != nil {
+		return
+	}
+	id := logError(r, err)
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(http.StatusInternalServerError)
+	// the error page stands alone, since the header needs the database, which may be what failed
+	// executing a copy keeps the template clonable for render
+	tmpl, tmplErr := pageTemplate("error.html")
+	if tmplErr == nil && tmpl != nil {
+		tmpl, tmplErr = tmpl.Clone()
+	}
+	if tmplErr == nil && tmpl != nil && tmpl.Execute(w, id) == nil {
+		return
+	}
+	fmt.Fprintf(w, "Something went wrong. Please report error %s.\n", id)
+}
+
+// recoverErrors turns the panics of handlers into logged server errors
+func recoverErrors(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer func() {
+			if v := recover(); v != nil {
+				if v == http.ErrAbortHandler {
+					panic(v)
+				}
+				serverError(w, r, fmt.Errorf("panic: %v", v))
+			}
+		}()
+		h.ServeHTTP(w, r)
+	})
+}
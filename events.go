@@ -0,0 +1,145 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"time"
+)
+
+// events tell the parts of the app that something happened: a cache entry went stale, a user got
+// a notification. Handlers register by topic in init, like jobs do. They are published on an
+// EventBus: in memory by default, which reaches the instance publishing, or with PUBSUB=redis
+// through the Redis server of REDIS_URL, which reaches every instance of the app behind a load
+// balancer. Instances running without it don't hear of each other's writes, and keep serving
+// their cached data until it expires
+
+// eventHandlers handle the events of each topic
+var eventHandlers = map[string][]func(payload []byte){}
+
+// dispatchEvent runs the handlers of the topic on this instance
+func dispatchEvent(topic string, payload []byte) {
+	for _, handle := range eventHandlers[topic] {
+		handle(payload)
+	}
+}
+
+// EventBus carries the events to the instances of the app
+type EventBus interface {
+	// Publish runs the handlers of the topic on every instance, this one first
+	Publish(ctx context.Context, topic string, payload []byte) error
+}
+
+// events is the event bus of the app, set by openEvents
+var events EventBus = localEvents{}
+
+// openEvents sets the event bus of PUBSUB, and starts listening to the other instances
+func openEvents(ctx context.Context) error {
+	switch name := os.Getenv("PUBSUB"); name {
+	case "", "memory":
+		events = localEvents{}
+	case "redis":
+		client, err := newRedisClient(os.Getenv("REDIS_URL"))
+		if err != nil {
+			return err
+		}
+		bus := &redisEvents{client: client, instance: newToken()}
+		go bus.listen(ctx)
+		events = bus
+	default:
+		return fmt.Errorf("PUBSUB: unknown event bus %q, use memory or redis", name)
+	}
+	return nil
+}
+
+// publish publishes an event, printing the errors: the instance itself has handled it anyway
+func publish(topic string, payload []byte) {
+	if err := events.Publish(context.Background(), topic, payload); err != nil {
+		fmt.Println(err)
+	}
+}
+
+// localEvents handles the events on this instance only
+type localEvents struct{}
+
+func (localEvents) Publish(ctx context.Context, topic string, payload []byte) error {
+	dispatchEvent(topic, payload)
+	return nil
+}
+
+// redisEvents publishes the events on a Redis channel per topic, prefixed by the instance they
+// come from, so that an instance skips its own events, already handled
+type redisEvents struct {
+	client   *redisClient
+	instance string
+}
+
+// the channels of the topics
+const redisEventPrefix = "qaapp:events:"
+
+// how long the subscription stays silent before the server is pinged, and the wait before reconnecting
+const (
+	redisPingInterval  = time.Minute
+	redisRetryInterval = 5 * time.Second
+)
+
+func (b *redisEvents) Publish(ctx context.Context, topic string, payload []byte) error {
+	dispatchEvent(topic, payload)
+	_, err := b.client.do(ctx, "PUBLISH", redisEventPrefix+topic, b.instance+" "+string(payload))
+	return err
+}
+
+// listen handles the events of the other instances, subscribing again when the connection breaks
+func (b *redisEvents) listen(ctx context.Context) {
+	for {
+		err := b.subscribe(ctx)
+		if ctx.Err() != nil {
+			return
+		}
+		fmt.Println("redis events:", err)
+		time.Sleep(redisRetryInterval)
+	}
+}
+
+// subscribe handles the events of the other instances until the connection fails
+func (b *redisEvents) subscribe(ctx context.Context) error {
+	conn, err := b.client.conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if _, err := conn.do(ctx, []string{"PSUBSCRIBE", redisEventPrefix + "*"}); err != nil {
+		return err
+	}
+	pinged := false
+	for {
+		conn.SetDeadline(time.Now().Add(redisPingInterval))
+		reply, err := conn.readReply()
+		var netErr net.Error
+		if errors.As(err, &netErr) && netErr.Timeout() && !pinged {
+			// a silent connection may be dead, a ping tells
+			pinged = true
+			conn.SetDeadline(time.Now().Add(redisTimeout))
+			if err := conn.send([]string{"PING"}); err != nil {
+				return err
+			}
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		pinged = false
+		// pmessage, pattern, channel, payload
+		items := redisStrings(reply)
+		if len(items) != 4 || items[0] != "pmessage" {
+			continue
+		}
+		instance, payload, _ := strings.Cut(items[3], " ")
+		if instance != b.instance {
+			dispatchEvent(strings.TrimPrefix(items[2], redisEventPrefix), []byte(payload))
+		}
+	}
+}
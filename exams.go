@@ -0,0 +1,137 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// during an exam window, the questions in its scope are hidden from everyone but moderators,
+// and come back on their own once the window ends. A window without tags hides every question
+
+// layout of the datetime-local inputs of the exam form
+const examInputLayout = "2006-01-02T15:04"
+
+// examWindow is a scheduled period during which questions are hidden
+type examWindow struct {
+	ID     int
+	Title  string
+	Starts string
+	Ends   string
+	Tags   []string // empty for all the questions
+}
+
+// load the exam windows, the latest first. With active, only those going on now
+func examWindows(ctx context.Context, active bool) ([]examWindow, error) {
+	query := "select id, title, starts_at, ends_at, tags from exam_windows"
+	var args []interface{}
+	if active {
+		now := time.Now().Format(timestampLayout)
+		query += " where starts_at <= ? and ends_at > ?"
+		args = append(args, now, now)
+	}
+	rows, err := db.QueryContext(ctx, query+" order by starts_at desc", args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var windows []examWindow
+	for rows.Next() {
+		var e examWindow
+		var tags string
+		if err := rows.Scan(&e.ID, &e.Title, &e.Starts, &e.Ends, &tags); err != nil {
+			return nil, err
+		}
+		e.Tags = splitTags(tags)
+		windows = append(windows, e)
+	}
+	return windows, rows.Err()
+}
+
+// examFilter is a condition on the questions table keeping the questions outside of the exams going on,
+// with its arguments
+func examFilter(ctx context.Context) (string, []interface{}, error) {
+	windows, err := examWindows(ctx, true)
+	if err != nil {
+		return "", nil, err
+	}
+	var matches []string
+	var args []interface{}
+	for _, e := range windows {
+		if len(e.Tags) == 0 {
+			return "false", nil, nil
+		}
+		for _, t := range e.Tags {
+			matches = append(matches, taggedSQL)
+			args = append(args, strings.ToLower(t))
+		}
+	}
+	if len(matches) == 0 {
+		return "true", nil, nil
+	}
+	return "not (" + strings.Join(matches, " or ") + ")", args, nil
+}
+
+// examForm is the data of the exam admin page
+type examForm struct {
+	Windows []examWindow
+	Error   string
+}
+
+// serve /admin/exams, where moderators schedule exam windows
+func serveExamsAdmin(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	user := requireUser(w, r)
+	if user == nil {
+		return
+	}
+	if !isModerator(user) {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+	var form examForm
+	if r.Method == http.MethodPost {
+		form.Error = updateExams(r)
+		if form.Error == "" {
+			http.Redirect(w, r, "/admin/exams", http.StatusSeeOther)
+			return
+		}
+	}
+	var err error
+	if form.Windows, err = examWindows(ctx, false); err != nil {
+		serverError(w, r, err)
+		return
+	}
+	render(w, r, "exams-admin.html", form)
+}
+
+// updateExams adds or deletes an exam window from the admin form, returning what is wrong with it
+func updateExams(r *http.Request) string {
+	ctx := r.Context()
+	if id, err := strconv.Atoi(r.FormValue("delete")); err == nil {
+		if _, err := db.ExecContext(ctx, "delete from exam_windows where id = ?", id); err != nil {
+			return err.Error()
+		}
+		return ""
+	}
+	title := strings.TrimSpace(r.FormValue("title"))
+	starts, err1 := time.ParseInLocation(examInputLayout, r.FormValue("starts"), time.Local)
+	ends, err2 := time.ParseInLocation(examInputLayout, r.FormValue("ends"), time.Local)
+	switch {
+	case title == "":
+		return "the title can't be empty"
+	case err1 != nil || err2 != nil:
+		return "the start and the end must be dates and times"
+	case !ends.After(starts):
+		return "the exam must end after it starts"
+	}
+	_, err := db.ExecContext(ctx, "insert into exam_windows (title, starts_at, ends_at, tags, created_at) values (?, ?, ?, ?, ?)",
+		title, starts.Format(timestampLayout), ends.Format(timestampLayout),
+		strings.Join(splitTags(r.FormValue("tags")), ", "), time.Now().Format(timestampLayout))
+	if err != nil {
+		return err.Error()
+	}
+	return ""
+}
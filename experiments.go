@@ -0,0 +1,160 @@
+package main
+
+import (
+	"context"
+	"hash/fnv"
+	"net/http"
+	"sort"
+	"time"
+)
+
+// experiments compare ways of ranking answers. While its feature flag is on, each session is
+// assigned to an arm of the experiment. When the author of a question first sees its answers ranked
+// by an arm, the question is counted for that arm, and accepting an answer later is its outcome
+
+// experiment is a comparison between arms, turned on by the feature flag "experiment:" + Name
+type experiment struct {
+	Name string
+	Arms []string // the first arm is the control, which everyone gets while the experiment is off
+}
+
+// arms of the answer sorting experiment
+const (
+	sortByVotes  = "votes"
+	sortByWilson = "wilson"
+)
+
+var answerSortExperiment = experiment{Name: "answer-sort", Arms: []string{sortByVotes, sortByWilson}}
+
+// the experiments shown on the admin page
+var experiments = []experiment{answerSortExperiment}
+
+func (e experiment) flag() string {
+	return "experiment:" + e.Name
+}
+
+// arm assigns the session of the request to an arm, telling if it takes part in the experiment.
+// visitors and everyone while the experiment is off get the control arm
+func (e experiment) arm(r *http.Request) (string, bool, error) {
+	ctx := r.Context()
+	// a stale session cookie is a visitor's too
+	cookie, err := r.Cookie(sessionCookie)
+	if err != nil || currentUser(r) == nil {
+		return e.Arms[0], false, nil
+	}
+	on, err := featureEnabled(ctx, e.flag())
+	if err != nil || !on {
+		return e.Arms[0], false, err
+	}
+	h := fnv.New32a()
+	h.Write([]byte(e.Name + ":" + cookie.Value))
+	return e.Arms[h.Sum32()%uint32(len(e.Arms))], true, nil
+}
+
+// recordExposure counts the question for the arm its author saw it with. Only the first arm counts
+func (e experiment) recordExposure(ctx context.Context, questionID int, arm string) error {
+	_, err := db.ExecContext(ctx, "insert or ignore into experiment_exposures (experiment, question_id, arm, exposed_at) values (?, ?, ?, ?)",
+		e.Name, questionID, arm, time.Now().Format(timestampLayout))
+	return err
+}
+
+// recordAccept marks the outcome of the experiments the question was counted in.
+// only the first accept counts, even if the author changes their mind later
+func recordAccept(ctx context.Context, questionID int) error {
+	_, err := db.ExecContext(ctx, "update experiment_exposures set accepted_at = ? where question_id = ? and accepted_at is null",
+		time.Now().Format(timestampLayout), questionID)
+	return err
+}
+
+// sortAnswers ranks the answers of a question, loaded best scored first, for the arm.
+// the accepted answer comes first in every arm
+func sortAnswers(answers []Answer, accepted int, arm string) {
+	if arm == sortByWilson {
+		sort.SliceStable(answers, func(i, j int) bool { return answers[i].AnsWilson > answers[j].AnsWilson })
+	}
+	sort.SliceStable(answers, func(i, j int) bool {
+		return answers[i].AnsID == accepted && answers[j].AnsID != accepted
+	})
+}
+
+// armStats are the outcomes of an arm
+type armStats struct {
+	Arm           string
+	Questions     int     // questions whose author saw the answers ranked by the arm
+	Accepted      int     // questions of those with an accepted answer
+	AcceptRate    float64 // percentage of the questions with an accepted answer
+	HoursToAccept float64 // average time from the first view by the author to the accept
+}
+
+// experimentReport is an experiment on the admin page
+type experimentReport struct {
+	Name    string
+	Enabled bool
+	Arms    []armStats
+}
+
+// report loads the outcomes of the experiment, for every arm
+func (e experiment) report(ctx context.Context) (experimentReport, error) {
+	rep := experimentReport{Name: e.Name}
+	var err error
+	if rep.Enabled, err = featureEnabled(ctx, e.flag()); err != nil {
+		return rep, err
+	}
+	rows, err := db.QueryContext(ctx, `select arm, count(*), count(accepted_at),
+		coalesce(avg((julianday(accepted_at) - julianday(exposed_at)) * 24), 0)
+		from experiment_exposures where experiment = ? group by arm`, e.Name)
+	if err != nil {
+		return rep, err
+	}
+	defer rows.Close()
+	stats := map[string]armStats{}
+	for rows.Next() {
+		var s armStats
+		if err := rows.Scan(&s.Arm, &s.Questions, &s.Accepted, &s.HoursToAccept); err != nil {
+			return rep, err
+		}
+		if s.Questions > 0 {
+			s.AcceptRate = 100 * float64(s.Accepted) / float64(s.Questions)
+		}
+		stats[s.Arm] = s
+	}
+	if err := rows.Err(); err != nil {
+		return rep, err
+	}
+	for _, arm := range e.Arms {
+		s := stats[arm]
+		s.Arm = arm
+		rep.Arms = append(rep.Arms, s)
+	}
+	return rep, nil
+}
+
+// serve /admin/experiments, where super-users turn experiments on and compare their arms
+func serveExperimentsAdmin(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	if requireSuperUser(w, r) == nil {
+		return
+	}
+	if r.Method == http.MethodPost {
+		for _, e := range experiments {
+			if e.Name == r.FormValue("name") {
+				if err := setFeature(ctx, e.flag(), r.FormValue("action") == "start"); err != nil {
+					serverError(w, r, err)
+					return
+				}
+			}
+		}
+		http.Redirect(w, r, "/admin/experiments", http.StatusSeeOther)
+		return
+	}
+	var reports []experimentReport
+	for _, e := range experiments {
+		rep, err := e.report(ctx)
+		if err != nil {
+			serverError(w, r, err)
+			return
+		}
+		reports = append(reports, rep)
+	}
+	render(w, r, "experiments-admin.html", reports)
+}
@@ -0,0 +1,417 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// `qaapp export -out dump.json` writes the users, tags, questions, answers, votes and badges into
+// a JSON file, and `qaapp import dump.json` restores it into an empty database, keeping the ids.
+// super users download the same export on /admin/export. The format carries its version, and an
+// import refuses the versions it doesn't know. With -no-passwords, or passwords=0 on the endpoint,
+// the password hashes are left out: the imported users can't log in until their password is reset
+
+// version of the export format, raised when the meaning of a field changes
+const exportVersion = 1
+
+// exportDump is the content of an export
+type exportDump struct {
+	Version    int              `json:"version"`
+	ExportedAt string           `json:"exported_at"`
+	Users      []exportUser     `json:"users"`
+	Tags       []exportTag      `json:"tags"`
+	Questions  []exportQuestion `json:"questions"`
+	Answers    []exportAnswer   `json:"answers"`
+	Votes      []exportVote     `json:"votes"`
+	Badges     []exportBadge    `json:"badges"`
+}
+
+type exportUser struct {
+	ID        int           `json:"id"`
+	Username  string        `json:"username"`
+	FirstName string        `json:"first_name"`
+	LastName  string        `json:"last_name"`
+	Email     string        `json:"email,omitempty"`
+	Type      string        `json:"type"`
+	Image     string        `json:"image,omitempty"`
+	SuperUser bool          `json:"super_user"`
+	Language  string        `json:"language,omitempty"`
+	Password  string        `json:"password_hash,omitempty"` // bcrypt hash
+	Badges    []exportAward `json:"badges,omitempty"`
+}
+
+// exportAward is a badge a user earned
+type exportAward struct {
+	BadgeID   int    `json:"badge_id"`
+	AwardedAt string `json:"awarded_at"`
+}
+
+type exportTag struct {
+	Name           string `json:"name"`
+	Description    string `json:"description,omitempty"`
+	Wiki           string `json:"wiki,omitempty"`
+	AllowAnonymous bool   `json:"allow_anonymous,omitempty"` // students may ask anonymously with the tag
+}
+
+type exportQuestion struct {
+	ID         int      `json:"id"`
+	Heading    string   `json:"heading"`
+	Body       string   `json:"body"`
+	Images     []string `json:"images,omitempty"`
+	Tags       []string `json:"tags"` // names, in their order
+	User       string   `json:"user"`
+	Date       string   `json:"date"`
+	Time       string   `json:"time"`
+	Views      int      `json:"views"`
+	Open       bool     `json:"open"`
+	EditedAt   string   `json:"edited_at,omitempty"`
+	HiddenAt   string   `json:"hidden_at,omitempty"`
+	AcceptedID int      `json:"accepted_id,omitempty"`
+	AcceptedAt string   `json:"accepted_at,omitempty"`
+	Anonymous  bool     `json:"anonymous,omitempty"`
+}
+
+type exportAnswer struct {
+	ID         int    `json:"id"`
+	QuestionID int    `json:"question_id"`
+	Body       string `json:"body"`
+	User       string `json:"user"`
+	Date       string `json:"date"`
+	Time       string `json:"time"`
+	Views      int    `json:"views"`
+	EditedAt   string `json:"edited_at,omitempty"`
+	HiddenAt   string `json:"hidden_at,omitempty"`
+}
+
+type exportVote struct {
+	UserID   int    `json:"user_id"`
+	PostType string `json:"post_type"`
+	PostID   int    `json:"post_id"`
+	Value    int    `json:"value"`
+	VotedAt  string `json:"voted_at"`
+}
+
+type exportBadge struct {
+	ID          int    `json:"id"`
+	Name        string `json:"name"`
+	Description string `json:"description,omitempty"`
+}
+
+// exportData reads the content of the database, in one transaction so that it is consistent
+func exportData(ctx context.Context, passwords bool) (*exportDump, error) {
+	dump := &exportDump{Version: exportVersion, ExportedAt: time.Now().Format(timestampLayout)}
+	err := db.WithTx(ctx, func(ctx context.Context) error {
+		var err error
+		if dump.Users, err = exportUsers(ctx, passwords); err != nil {
+			return err
+		}
+		if dump.Tags, err = exportTags(ctx); err != nil {
+			return err
+		}
+		if dump.Questions, err = exportQuestions(ctx, "true"); err != nil {
+			return err
+		}
+		if dump.Answers, err = exportAnswers(ctx, "true"); err != nil {
+			return err
+		}
+		if dump.Votes, err = exportVotes(ctx, "true"); err != nil {
+			return err
+		}
+		dump.Badges, err = exportBadges(ctx)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return dump, nil
+}
+
+func exportUsers(ctx context.Context, passwords bool) ([]exportUser, error) {
+	rows, err := db.QueryContext(ctx, `select id, coalesce(username, ''), coalesce(first_name, ''), coalesce(last_name, ''), coalesce(email, ''),
+		coalesce(user_type, ''), coalesce(user_image, ''), coalesce(super_user, false), coalesce(language, ''), coalesce(password, '')
+		from users order by id`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	users := []exportUser{}
+	byID := map[int]int{}
+	for rows.Next() {
+		var u exportUser
+		if err := rows.Scan(&u.ID, &u.Username, &u.FirstName, &u.LastName, &u.Email, &u.Type, &u.Image, &u.SuperUser, &u.Language, &u.Password); err != nil {
+			return nil, err
+		}
+		if !passwords {
+			u.Password = ""
+		}
+		byID[u.ID] = len(users)
+		users = append(users, u)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	rows, err = db.QueryContext(ctx, "select user_id, badge_id, awarded_at from user_badges order by user_id, awarded_at")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var userID int
+		var a exportAward
+		if err := rows.Scan(&userID, &a.BadgeID, &a.AwardedAt); err != nil {
+			return nil, err
+		}
+		if i, ok := byID[userID]; ok {
+			users[i].Badges = append(users[i].Badges, a)
+		}
+	}
+	return users, rows.Err()
+}
+
+func exportTags(ctx context.Context) ([]exportTag, error) {
+	rows, err := db.QueryContext(ctx, "select name, coalesce(desc, ''), coalesce(wiki, ''), allow_anonymous from tags order by name")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	tags := []exportTag{}
+	for rows.Next() {
+		var t exportTag
+		if err := rows.Scan(&t.Name, &t.Description, &t.Wiki, &t.AllowAnonymous); err != nil {
+			return nil, err
+		}
+		tags = append(tags, t)
+	}
+	return tags, rows.Err()
+}
+
+// exportQuestions reads the questions of the condition, like "true" for all of them
+func exportQuestions(ctx context.Context, where string, args ...interface{}) ([]exportQuestion, error) {
+	rows, err := db.QueryContext(ctx, `select id, coalesce(heading, ''), coalesce(body, ''), coalesce(image, ''), coalesce(user, ''),
+		coalesce(date, ''), coalesce(time, ''), coalesce(views, 0), coalesce(open, false), coalesce(edited_at, ''),
+		coalesce(hidden_at, ''), coalesce(accepted_id, 0), coalesce(accepted_at, ''), coalesce(`+questionTagsSQL+`, ''), is_anonymous
+		from questions where `+where+` order by id`, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	questions := []exportQuestion{}
+	for rows.Next() {
+		var q exportQuestion
+		var images, tags string
+		err := rows.Scan(&q.ID, &q.Heading, &q.Body, &images, &q.User, &q.Date, &q.Time, &q.Views, &q.Open,
+			&q.EditedAt, &q.HiddenAt, &q.AcceptedID, &q.AcceptedAt, &tags, &q.Anonymous)
+		if err != nil {
+			return nil, err
+		}
+		q.Images = splitTags(images)
+		q.Tags = splitTags(tags)
+		questions = append(questions, q)
+	}
+	return questions, rows.Err()
+}
+
+// exportAnswers reads the answers of the condition
+func exportAnswers(ctx context.Context, where string, args ...interface{}) ([]exportAnswer, error) {
+	rows, err := db.QueryContext(ctx, `select id, coalesce(question_id, 0), coalesce(body, ''), coalesce(user, ''), coalesce(date, ''),
+		coalesce(time, ''), coalesce(views, 0), coalesce(edited_at, ''), coalesce(hidden_at, '')
+		from answers where `+where+` order by id`, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	answers := []exportAnswer{}
+	for rows.Next() {
+		var a exportAnswer
+		if err := rows.Scan(&a.ID, &a.QuestionID, &a.Body, &a.User, &a.Date, &a.Time, &a.Views, &a.EditedAt, &a.HiddenAt); err != nil {
+			return nil, err
+		}
+		answers = append(answers, a)
+	}
+	return answers, rows.Err()
+}
+
+// exportVotes reads the votes of the condition
+func exportVotes(ctx context.Context, where string, args ...interface{}) ([]exportVote, error) {
+	rows, err := db.QueryContext(ctx, "select user_id, post_type, post_id, value, voted_at from votes where "+where+" order by id", args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	votes := []exportVote{}
+	for rows.Next() {
+		var v exportVote
+		if err := rows.Scan(&v.UserID, &v.PostType, &v.PostID, &v.Value, &v.VotedAt); err != nil {
+			return nil, err
+		}
+		votes = append(votes, v)
+	}
+	return votes, rows.Err()
+}
+
+func exportBadges(ctx context.Context) ([]exportBadge, error) {
+	rows, err := db.QueryContext(ctx, "select id, coalesce(name, ''), coalesce(description, '') from badges order by id")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	badges := []exportBadge{}
+	for rows.Next() {
+		var b exportBadge
+		if err := rows.Scan(&b.ID, &b.Name, &b.Description); err != nil {
+			return nil, err
+		}
+		badges = append(badges, b)
+	}
+	return badges, rows.Err()
+}
+
+var errNotEmpty = errors.New("the database already has users or questions, import into a new database")
+
+// importData restores an export into an empty database, all of it or nothing
+func importData(ctx context.Context, dump *exportDump) error {
+	if dump.Version != exportVersion {
+		return fmt.Errorf("export version %d can't be imported, this version of the app reads version %d", dump.Version, exportVersion)
+	}
+	return db.WithTx(ctx, func(ctx context.Context) error {
+		var n int
+		if err := db.QueryRowContext(ctx, "select (select count(*) from users) + (select count(*) from questions)").Scan(&n); err != nil {
+			return err
+		}
+		if n > 0 {
+			return errNotEmpty
+		}
+		for _, b := range dump.Badges {
+			if _, err := db.ExecContext(ctx, "insert into badges (id, name, description) values (?, ?, ?)", b.ID, b.Name, b.Description); err != nil {
+				return fmt.Errorf("badge %d: %w", b.ID, err)
+			}
+		}
+		for _, u := range dump.Users {
+			_, err := db.ExecContext(ctx, `insert into users (id, username, first_name, last_name, email, user_type, user_image, super_user, language, password)
+				values (?, ?, ?, ?, nullif(?, ''), ?, ?, ?, nullif(?, ''), ?)`,
+				u.ID, u.Username, u.FirstName, u.LastName, u.Email, u.Type, u.Image, u.SuperUser, u.Language, u.Password)
+			if err != nil {
+				return fmt.Errorf("user %s: %w", u.Username, err)
+			}
+			for _, a := range u.Badges {
+				if _, err := db.ExecContext(ctx, "insert into user_badges (user_id, badge_id, awarded_at) values (?, ?, ?)", u.ID, a.BadgeID, a.AwardedAt); err != nil {
+					return fmt.Errorf("badge %d of user %s: %w", a.BadgeID, u.Username, err)
+				}
+			}
+		}
+		for _, t := range dump.Tags {
+			_, err := db.ExecContext(ctx, "insert into tags (name, desc, wiki, allow_anonymous) values (?, ?, nullif(?, ''), ?)",
+				strings.ToLower(t.Name), t.Description, t.Wiki, t.AllowAnonymous)
+			if err != nil {
+				return fmt.Errorf("tag %s: %w", t.Name, err)
+			}
+		}
+		for _, q := range dump.Questions {
+			_, err := db.ExecContext(ctx, `insert into questions (id, heading, body, image, user, date, time, views, open, edited_at, hidden_at, accepted_id, accepted_at, is_anonymous)
+				values (?, ?, ?, ?, ?, ?, ?, ?, ?, nullif(?, ''), nullif(?, ''), nullif(?, 0), nullif(?, ''), ?)`,
+				q.ID, q.Heading, q.Body, strings.Join(q.Images, ","), q.User, q.Date, q.Time, q.Views, q.Open,
+				q.EditedAt, q.HiddenAt, q.AcceptedID, q.AcceptedAt, q.Anonymous)
+			if err != nil {
+				return fmt.Errorf("question %d: %w", q.ID, err)
+			}
+			if err := setQuestionTags(ctx, q.ID, strings.Join(q.Tags, ", ")); err != nil {
+				return fmt.Errorf("tags of question %d: %w", q.ID, err)
+			}
+		}
+		for _, a := range dump.Answers {
+			_, err := db.ExecContext(ctx, `insert into answers (id, question_id, body, user, date, time, views, edited_at, hidden_at)
+				values (?, ?, ?, ?, ?, ?, ?, nullif(?, ''), nullif(?, ''))`,
+				a.ID, a.QuestionID, a.Body, a.User, a.Date, a.Time, a.Views, a.EditedAt, a.HiddenAt)
+			if err != nil {
+				return fmt.Errorf("answer %d: %w", a.ID, err)
+			}
+		}
+		for _, v := range dump.Votes {
+			_, err := db.ExecContext(ctx, "insert into votes (user_id, post_type, post_id, value, voted_at) values (?, ?, ?, ?, ?)",
+				v.UserID, v.PostType, v.PostID, v.Value, v.VotedAt)
+			if err != nil {
+				return fmt.Errorf("vote of user %d on %s %d: %w", v.UserID, v.PostType, v.PostID, err)
+			}
+		}
+		return nil
+	})
+}
+
+// runExport runs the export command with its arguments
+func runExport(ctx context.Context, args []string) error {
+	flags := flag.NewFlagSet("export", flag.ExitOnError)
+	out := flags.String("out", "", "file to write the export to, the standard output by default")
+	noPasswords := flags.Bool("no-passwords", false, "leave the password hashes out")
+	flags.Parse(args)
+	dump, err := exportData(ctx, !*noPasswords)
+	if err != nil {
+		return err
+	}
+	var w io.Writer = os.Stdout
+	if *out != "" {
+		f, err := os.Create(*out)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		w = f
+	}
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(dump); err != nil {
+		return err
+	}
+	if *out != "" {
+		fmt.Fprintf(os.Stderr, "exported %d users, %d questions and %d answers to %s\n", len(dump.Users), len(dump.Questions), len(dump.Answers), *out)
+	}
+	return nil
+}
+
+// runImport runs the import command with its arguments
+func runImport(ctx context.Context, args []string) error {
+	flags := flag.NewFlagSet("import", flag.ExitOnError)
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "usage: qaapp import dump.json")
+	}
+	flags.Parse(args)
+	if flags.NArg() != 1 {
+		flags.Usage()
+		os.Exit(2)
+	}
+	f, err := os.Open(flags.Arg(0))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	var dump exportDump
+	if err := json.NewDecoder(f).Decode(&dump); err != nil {
+		return fmt.Errorf("%s isn't an export: %w", flags.Arg(0), err)
+	}
+	if err := importData(ctx, &dump); err != nil {
+		return err
+	}
+	fmt.Printf("imported %d users, %d questions and %d answers\n", len(dump.Users), len(dump.Questions), len(dump.Answers))
+	return nil
+}
+
+// serve /admin/export, the export as a download. passwords=0 leaves the password hashes out
+func serveExport(w http.ResponseWriter, r *http.Request) {
+	if requireSuperUser(w, r) == nil {
+		return
+	}
+	dump, err := exportData(r.Context(), r.FormValue("passwords") != "0")
+	if err != nil {
+		serverError(w, r, err)
+		return
+	}
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="qaapp-%s.json"`, time.Now().Format(dateLayout)))
+	writeJSON(w, http.StatusOK, dump)
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"net/http"
+	"time"
+)
+
+// feature flags turn parts of the site on and off without a deploy.
+// a flag that was never set is off
+
+// featureEnabled tells if the named feature is on
+func featureEnabled(ctx context.Context, name string) (bool, error) {
+	var enabled bool
+	err := db.QueryRowContext(ctx, "select enabled from feature_flags where name = ?", name).Scan(&enabled)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	return enabled, err
+}
+
+// setFeature turns the named feature on or off
+func setFeature(ctx context.Context, name string, enabled bool) error {
+	_, err := db.ExecContext(ctx, "insert or replace into feature_flags (name, enabled, updated_at) values (?, ?, ?)",
+		name, enabled, time.Now().Format(timestampLayout))
+	return err
+}
+
+// flags of the features of the site
+const featureWilsonScores = "wilson-scores"
+
+// siteFeature is a feature super-users turn on and off
+type siteFeature struct {
+	Name        string
+	Description string
+	Enabled     bool
+}
+
+// the features shown on the admin page. Experiments have their own page
+var siteFeatures = []siteFeature{
+	{Name: featureInviteOnly, Description: "Only let people register with an invite code, generated by teachers on /invites for their class"},
+	{Name: featureStudentMessages, Description: "Let students send private messages to other students. They can always write to teachers and moderators"},
+	{Name: featureWilsonScores, Description: "Show a confidence-adjusted score next to the votes on answers, so answers with few votes don't look better than they are"},
+}
+
+// serve /admin/features, where super-users turn the features of the site on and off
+func serveFeaturesAdmin(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	if requireSuperUser(w, r) == nil {
+		return
+	}
+	if r.Method == http.MethodPost {
+		for _, f := range siteFeatures {
+			if f.Name == r.FormValue("name") {
+				if err := setFeature(ctx, f.Name, r.FormValue("action") == "on"); err != nil {
+					serverError(w, r, err)
+					return
+				}
+				// features change pages cached for visitors
+				questionCache.clear()
+			}
+		}
+		http.Redirect(w, r, "/admin/features", http.StatusSeeOther)
+		return
+	}
+	features := make([]siteFeature, len(siteFeatures))
+	for i, f := range siteFeatures {
+		var err error
+		if f.Enabled, err = featureEnabled(ctx, f.Name); err != nil {
+			serverError(w, r, err)
+			return
+		}
+		features[i] = f
+	}
+	render(w, r, "features-admin.html", features)
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"context"
+	"encoding/xml"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// number of questions listed in a feed
+const feedSize = 20
+
+// Atom feed document, see RFC 4287
+type atomFeed struct {
+	XMLName xml.Name    `xml:"http://www.w3.org/2005/Atom feed"`
+	Title   string      `xml:"title"`
+	ID      string      `xml:"id"`
+	Updated string      `xml:"updated"`
+	Links   []atomLink  `xml:"link"`
+	Entries []atomEntry `xml:"entry"`
+}
+
+type atomLink struct {
+	Href string `xml:"href,attr"`
+	Rel  string `xml:"rel,attr,omitempty"`
+	Type string `xml:"type,attr,omitempty"`
+}
+
+type atomEntry struct {
+	Title      string         `xml:"title"`
+	ID         string         `xml:"id"`
+	Updated    string         `xml:"updated"`
+	Author     atomAuthor     `xml:"author"`
+	Link       atomLink       `xml:"link"`
+	Categories []atomCategory `xml:"category"`
+	Content    atomText       `xml:"content"`
+}
+
+type atomAuthor struct {
+	Name string `xml:"name"`
+}
+
+type atomCategory struct {
+	Term string `xml:"term,attr"`
+}
+
+// text content is escaped by the xml encoder, so question bodies can't break the feed
+type atomText struct {
+	Type string `xml:"type,attr"`
+	Body string `xml:",chardata"`
+}
+
+// baseURL returns the scheme and host the request was made to, used for absolute links
+func baseURL(r *http.Request) string {
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	return scheme + "://" + r.Host
+}
+
+// load the newest questions the user can see, optionally only those tagged with tag
+func newestQuestions(ctx context.Context, user *User, tag string, limit int) ([]Question, error) {
+	filter, args, err := questionFilter(ctx, user)
+	if err != nil {
+		return nil, err
+	}
+	query := "select " + questionColumns + " from questions where " + filter
+	if tag != "" {
+		query += " and " + taggedSQL
+		args = append(args, strings.ToLower(tag))
+	}
+	query += " order by date desc, time desc, id desc limit ?"
+	args = append(args, limit)
+
+	rows, err := db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var questions []Question
+	for rows.Next() {
+		q, err := scanQuestion(rows)
+		if err != nil {
+			return nil, err
+		}
+		maskAuthor(&q, user)
+		questions = append(questions, q)
+	}
+	return questions, rows.Err()
+}
+
+// feedAuthor is the name of the author of a question in feeds
+func feedAuthor(q Question) string {
+	if q.QnUser == "" {
+		return anonymousName
+	}
+	return q.QnUser
+}
+
+// build the feed document for the questions
+func buildFeed(r *http.Request, title, self string, questions []Question) (atomFeed, time.Time) {
+	base := baseURL(r)
+	feed := atomFeed{
+		Title: title,
+		ID:    base + self,
+		Links: []atomLink{
+			{Href: base + self, Rel: "self", Type: "application/atom+xml"},
+			{Href: base + "/", Rel: "alternate", Type: "text/html"},
+		},
+	}
+	var updated time.Time
+	for _, q := range questions {
+		t := questionTime(q.QnDate, q.QnTime)
+		if t.After(updated) {
+			updated = t
+		}
+		link := fmt.Sprintf("%s/questions/%d", base, q.QnID)
+		entry := atomEntry{
+			Title:   q.QnHeading,
+			ID:      link,
+			Updated: t.UTC().Format(time.RFC3339),
+			Author:  atomAuthor{Name: feedAuthor(q)},
+			Link:    atomLink{Href: link, Rel: "alternate", Type: "text/html"},
+			Content: atomText{Type: "text", Body: q.QnBody},
+		}
+		for _, tag := range q.QnTags {
+			entry.Categories = append(entry.Categories, atomCategory{Term: tag})
+		}
+		feed.Entries = append(feed.Entries, entry)
+	}
+	// an empty feed still needs an updated timestamp
+	if updated.IsZero() {
+		updated = time.Now()
+	}
+	feed.Updated = updated.UTC().Format(time.RFC3339)
+	return feed, updated
+}
+
+// write the feed, answering conditional requests with 304 when nothing changed
+func writeFeed(w http.ResponseWriter, r *http.Request, feed atomFeed, updated time.Time) {
+	updated = updated.UTC().Truncate(time.Second)
+	if since, err := http.ParseTime(r.Header.Get("If-Modified-Since")); err == nil && !updated.After(since) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	out, err := xml.MarshalIndent(feed, "", "  ")
+	if err != nil {
+		serverError(w, r, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/atom+xml; charset=utf-8")
+	w.Header().Set("Last-Modified", updated.Format(http.TimeFormat))
+	w.Write([]byte(xml.Header))
+	w.Write(out)
+}
+
+// serve /feed.xml with the newest questions
+func serveFeed(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	questions, err := newestQuestions(ctx, nil, "", feedSize)
+	if err != nil {
+		serverError(w, r, err)
+		return
+	}
+	feed, updated := buildFeed(r, "QA Learning - newest questions", "/feed.xml", questions)
+	writeFeed(w, r, feed, updated)
+}
+
+// serve /tags/{name}/feed.xml with the newest questions of the tag
+func serveTagFeed(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	name, rest, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/tags/"), "/")
+	if name == "" || rest != "feed.xml" {
+		http.NotFound(w, r)
+		return
+	}
+	questions, err := newestQuestions(ctx, nil, name, feedSize)
+	if err != nil {
+		serverError(w, r, err)
+		return
+	}
+	feed, updated := buildFeed(r, "QA Learning - questions tagged "+name, "/tags/"+name+"/feed.xml", questions)
+	writeFeed(w, r, feed, updated)
+}
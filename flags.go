@@ -0,0 +1,290 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// users flag posts that break the rules, and moderators review the flags in a queue.
+// a post with FLAG_HIDE_THRESHOLD pending flags (3 by default) is hidden until a moderator reviews it
+
+const defaultFlagHideThreshold = 3
+
+var errOwnFlag = errors.New("you can't flag your own post")
+
+// reasons a post can be flagged for, as stored in flags.reason
+var flagReasons = []string{"spam", "offensive", "off-topic", "plagiarism", "other"}
+
+// flagHideThreshold is the number of pending flags hiding a post
+func flagHideThreshold() int {
+	if n, err := strconv.Atoi(os.Getenv("FLAG_HIDE_THRESHOLD")); err == nil && n > 0 {
+		return n
+	}
+	return defaultFlagHideThreshold
+}
+
+// flagPost records the flag of the user on a post, and hides the post once it has enough pending flags
+func flagPost(ctx context.Context, user *User, postType string, postID int, reason string) error {
+	table, ok := postTables[postType]
+	if !ok {
+		return errPostNotFound
+	}
+	var author string
+	err := db.QueryRowContext(ctx, "select user from "+table+" where id = ?", postID).Scan(&author)
+	if err == sql.ErrNoRows {
+		return errPostNotFound
+	}
+	if err != nil {
+		return err
+	}
+	if author == user.UserName {
+		return errOwnFlag
+	}
+	now := time.Now().Format(timestampLayout)
+	return db.WithTx(ctx, func(ctx context.Context) error {
+		// flagging again replaces the reason of the previous flag, which is pending again
+		_, err := db.ExecContext(ctx, `insert or replace into flags (user_id, post_type, post_id, reason, created_at) values (?, ?, ?, ?, ?)`,
+			user.UniqueID, postType, postID, reason, now)
+		if err != nil {
+			return err
+		}
+		var pending int
+		err = db.QueryRowContext(ctx, "select count(*) from flags where post_type = ? and post_id = ? and resolved_at is null", postType, postID).Scan(&pending)
+		if err != nil {
+			return err
+		}
+		if pending >= flagHideThreshold() {
+			_, err = db.ExecContext(ctx, "update "+table+" set hidden_at = ? where id = ? and hidden_at is null", now, postID)
+		}
+		return err
+	})
+}
+
+// handle POST /questions/{id}/flag, /answers/{id}/flag and /comments/{id}/flag
+func serveFlag(w http.ResponseWriter, r *http.Request, postType string, postID, questionID int) {
+	ctx := r.Context()
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	user := requireUser(w, r)
+	if user == nil {
+		return
+	}
+	if err := checkCaptcha(r); err == errCaptcha {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	} else if err != nil {
+		serverError(w, r, err)
+		return
+	}
+	reason := r.FormValue("reason")
+	valid := false
+	for _, f := range flagReasons {
+		valid = valid || f == reason
+	}
+	if !valid {
+		http.Error(w, "choose a reason among "+strings.Join(flagReasons, ", "), http.StatusBadRequest)
+		return
+	}
+	switch err := flagPost(ctx, user, postType, postID, reason); err {
+	case nil:
+	case errPostNotFound:
+		http.NotFound(w, r)
+		return
+	case errOwnFlag:
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	default:
+		serverError(w, r, err)
+		return
+	}
+	http.Redirect(w, r, fmt.Sprintf("/questions/%d#%s-%d", questionID, postType, postID), http.StatusSeeOther)
+}
+
+// flaggedPost is an entry of the moderation queue
+type flaggedPost struct {
+	PostType   string
+	PostID     int
+	QuestionID int
+	Author     string
+	Body       string
+	Flags      int
+	Reasons    string
+	Hidden     bool
+}
+
+// flaggedPosts loads the posts with pending flags, the most flagged first
+func flaggedPosts(ctx context.Context) ([]flaggedPost, error) {
+	rows, err := db.QueryContext(ctx, `select post_type, post_id, count(*), group_concat(distinct reason) from flags
+		where resolved_at is null group by post_type, post_id order by count(*) desc, min(created_at)`)
+	if err != nil {
+		return nil, err
+	}
+	var posts []flaggedPost
+	for rows.Next() {
+		var p flaggedPost
+		if err := rows.Scan(&p.PostType, &p.PostID, &p.Flags, &p.Reasons); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		posts = append(posts, p)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	// fill in the posts, leaving out those deleted since they were flagged
+	found := posts[:0]
+	for _, p := range posts {
+		switch p.PostType {
+		case postQuestion:
+			q, err := questionByID(ctx, p.PostID)
+			if err != nil {
+				return nil, err
+			}
+			if q == nil {
+				continue
+			}
+			p.QuestionID, p.Author, p.Body, p.Hidden = q.QnID, q.QnUser, q.QnHeading+"\n"+q.QnBody, q.QnHidden
+		case postAnswer:
+			a, err := answerByID(ctx, p.PostID)
+			if err != nil {
+				return nil, err
+			}
+			if a == nil {
+				continue
+			}
+			p.QuestionID, p.Author, p.Body, p.Hidden = a.AnsQn, a.AnsUser, a.AnsBody, a.AnsHidden
+		case postComment:
+			c, err := commentByID(ctx, p.PostID)
+			if err != nil {
+				return nil, err
+			}
+			if c == nil {
+				continue
+			}
+			p.QuestionID, p.Author, p.Body, p.Hidden = c.CmtPostID, c.CmtUser, c.CmtBody, c.CmtHidden
+			if c.CmtPostType == postAnswer {
+				a, err := answerByID(ctx, c.CmtPostID)
+				if err != nil {
+					return nil, err
+				}
+				if a == nil {
+					continue
+				}
+				p.QuestionID = a.AnsQn
+			}
+		default:
+			continue
+		}
+		found = append(found, p)
+	}
+	return found, nil
+}
+
+// resolveFlags closes the pending flags of a post. With hide, the post stays hidden, otherwise it is shown again
+func resolveFlags(ctx context.Context, moderator *User, postType string, postID int, hide bool) error {
+	table, ok := postTables[postType]
+	if !ok {
+		return errPostNotFound
+	}
+	now := time.Now().Format(timestampLayout)
+	return db.WithTx(ctx, func(ctx context.Context) error {
+		_, err := db.ExecContext(ctx, "update flags set resolved_at = ?, resolved_by = ? where post_type = ? and post_id = ? and resolved_at is null",
+			now, moderator.UniqueID, postType, postID)
+		if err != nil {
+			return err
+		}
+		if hide {
+			_, err = db.ExecContext(ctx, "update "+table+" set hidden_at = coalesce(hidden_at, ?) where id = ?", now, postID)
+		} else {
+			_, err = db.ExecContext(ctx, "update "+table+" set hidden_at = null where id = ?", postID)
+		}
+		return err
+	})
+}
+
+// serve /admin/flags, the moderation queue of the flagged posts and of the vote fraud reports
+func serveFlagsAdmin(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	user := requireUser(w, r)
+	if user == nil {
+		return
+	}
+	if !isModerator(user) {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+	if r.Method == http.MethodPost && r.FormValue("action") == "resolve-fraud" {
+		id, err := strconv.Atoi(r.FormValue("report_id"))
+		if err != nil {
+			http.Error(w, "Bad Request", http.StatusBadRequest)
+			return
+		}
+		if err := resolveVoteFraud(ctx, user, id); err != nil {
+			serverError(w, r, err)
+			return
+		}
+		http.Redirect(w, r, "/admin/flags", http.StatusSeeOther)
+		return
+	}
+	if r.Method == http.MethodPost {
+		postID, err := strconv.Atoi(r.FormValue("post_id"))
+		if err != nil {
+			http.Error(w, "Bad Request", http.StatusBadRequest)
+			return
+		}
+		postType, hide := r.FormValue("post_type"), r.FormValue("action") == "hide"
+		before, err := snapshotPost(ctx, postType, postID)
+		if err != nil && err != errPostNotFound {
+			serverError(w, r, err)
+			return
+		}
+		if err := resolveFlags(ctx, user, postType, postID, hide); err != nil {
+			serverError(w, r, err)
+			return
+		}
+		after, err := snapshotPost(ctx, postType, postID)
+		if err != nil {
+			serverError(w, r, err)
+			return
+		}
+		action := auditShowPost
+		if hide {
+			action = auditHidePost
+		}
+		if err := recordAudit(ctx, user, action, postType, strconv.Itoa(postID), before, after); err != nil {
+			serverError(w, r, err)
+			return
+		}
+		questionCache.clear()
+		http.Redirect(w, r, "/admin/flags", http.StatusSeeOther)
+		return
+	}
+	var p flagsAdmin
+	var err error
+	if p.Posts, err = flaggedPosts(ctx); err != nil {
+		serverError(w, r, err)
+		return
+	}
+	if p.Frauds, err = voteFraudReports(ctx); err != nil {
+		serverError(w, r, err)
+		return
+	}
+	render(w, r, "flags-admin.html", p)
+}
+
+// flagsAdmin is the data of the moderation queue
+type flagsAdmin struct {
+	Posts  []flaggedPost
+	Frauds []voteFraud // reversed by the vote-fraud task, to look at
+}
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// the For you tab, the default of the question list for logged-in users, ranks the latest questions
+// by the interests of the user: the tags of their profile, the tags they follow and those of the
+// questions they asked, answered or voted on lately. A question scores by the interest in its tags,
+// a little by how hot it is, and fades as it gets older. The ranking of a user is kept for a few
+// minutes, so scrolling through the pages doesn't rank again; following a tag drops it.
+// The Newest tab, or the preference of the list, brings back the plain chronological order
+
+// name of the personalized sort of the question list
+const forYouSort = "foryou"
+
+const (
+	feedCandidates = 500             // latest questions ranked
+	feedTTL        = 5 * time.Minute // how long a ranking is kept
+	feedHalfLife   = 48 * time.Hour  // the score of a question halves with this age
+	feedUsers      = 1000            // most rankings kept
+	// recent activity counts for this long, and for this much in a tag
+	feedActivityWindow = 90 * 24 * time.Hour
+	maxActivityWeight  = 5.0
+)
+
+// weights of the interests in a tag
+const (
+	interestProfile  = 3.0 // in the tags of the profile of the user
+	interestFollowed = 3.0
+	interestActivity = 1.0 // by question asked, answered or voted on
+)
+
+// feedCache keeps the ranked question ids of the users, by user id
+var feedCache = struct {
+	sync.Mutex
+	feeds map[int]cachedFeed
+}{feeds: map[int]cachedFeed{}}
+
+type cachedFeed struct {
+	ids     []int
+	expires time.Time
+}
+
+// forgetFeed drops the ranking of the user, after their interests change
+func forgetFeed(userID int) {
+	feedCache.Lock()
+	delete(feedCache.feeds, userID)
+	feedCache.Unlock()
+}
+
+// personalFeed is the ranking of the latest questions the user can see, the most interesting first
+func personalFeed(ctx context.Context, user *User) ([]int, error) {
+	now := time.Now()
+	feedCache.Lock()
+	feed, ok := feedCache.feeds[user.UniqueID]
+	feedCache.Unlock()
+	if ok && now.Before(feed.expires) {
+		return feed.ids, nil
+	}
+	ids, err := rankFeed(ctx, user, now)
+	if err != nil {
+		return nil, err
+	}
+	feedCache.Lock()
+	defer feedCache.Unlock()
+	if len(feedCache.feeds) >= feedUsers {
+		for id, f := range feedCache.feeds {
+			if now.After(f.expires) {
+				delete(feedCache.feeds, id)
+			}
+		}
+		if len(feedCache.feeds) >= feedUsers {
+			feedCache.feeds = map[int]cachedFeed{}
+		}
+	}
+	feedCache.feeds[user.UniqueID] = cachedFeed{ids: ids, expires: now.Add(feedTTL)}
+	return ids, nil
+}
+
+// interests weighs the tags the user cares about, by tag id
+func interests(ctx context.Context, user *User) (map[int]float64, error) {
+	weights := map[int]float64{}
+	add := func(weight float64) func(*sql.Rows) error {
+		return func(rows *sql.Rows) error {
+			var tag int
+			err := rows.Scan(&tag)
+			weights[tag] += weight
+			return err
+		}
+	}
+	var profile sql.NullString
+	if err := db.QueryRowContext(ctx, "select user_tags from users where id = ?", user.UniqueID).Scan(&profile); err != nil {
+		return nil, err
+	}
+	if tags := splitTags(strings.ToLower(profile.String)); len(tags) > 0 {
+		args := []interface{}{}
+		for _, t := range tags {
+			args = append(args, t)
+		}
+		in := strings.TrimSuffix(strings.Repeat("?, ", len(tags)), ", ")
+		if err := queryList(ctx, "select id from tags where name in ("+in+")", args, add(interestProfile)); err != nil {
+			return nil, err
+		}
+	}
+	err := queryList(ctx, "select tags.id from subscriptions join tags on tags.name = subscriptions.target where subscriptions.user_id = ? and subscriptions.target_type = ?",
+		[]interface{}{user.UniqueID, followTag}, add(interestFollowed))
+	if err != nil {
+		return nil, err
+	}
+	since := time.Now().Add(-feedActivityWindow)
+	activity := map[int]float64{}
+	err = queryList(ctx, `select tag_id from question_tags where question_id in (
+			select id from questions where user = ? and date >= ?
+			union select question_id from answers where user = ? and date >= ?
+			union select post_id from votes where user_id = ? and post_type = 'question' and voted_at >= ?)`,
+		[]interface{}{user.UserName, since.Format(dateLayout), user.UserName, since.Format(dateLayout), user.UniqueID, since.Format(timestampLayout)},
+		func(rows *sql.Rows) error {
+			var tag int
+			err := rows.Scan(&tag)
+			activity[tag] += interestActivity
+			return err
+		})
+	if err != nil {
+		return nil, err
+	}
+	for tag, w := range activity {
+		weights[tag] += math.Min(w, maxActivityWeight)
+	}
+	return weights, nil
+}
+
+// rankFeed scores the latest questions the user can see by their interests
+func rankFeed(ctx context.Context, user *User, now time.Time) ([]int, error) {
+	weights, err := interests(ctx, user)
+	if err != nil {
+		return nil, err
+	}
+	filter, args, err := questionFilter(ctx, user)
+	if err != nil {
+		return nil, err
+	}
+	muted, mutedArgs := mutedFilter(user)
+	type candidate struct {
+		id    int
+		score float64
+	}
+	var candidates []candidate
+	err = queryList(ctx, `select questions.id, questions.date, questions.time, questions.hot_score,
+			coalesce((select group_concat(tag_id) from question_tags where question_id = questions.id), '')
+		from questions where `+filter+" and "+muted+" order by questions.id desc limit ?",
+		append(append(args, mutedArgs...), feedCandidates), func(rows *sql.Rows) error {
+			var c candidate
+			var date, clock sql.NullString
+			var hot float64
+			var tags string
+			if err := rows.Scan(&c.id, &date, &clock, &hot, &tags); err != nil {
+				return err
+			}
+			interest := 0.0
+			for _, tag := range splitTags(tags) {
+				id, _ := strconv.Atoi(tag)
+				interest += weights[id]
+			}
+			age := now.Sub(questionTime(date.String, clock.String))
+			c.score = (1 + interest + math.Log1p(math.Max(hot, 0))) * math.Pow(0.5, float64(age)/float64(feedHalfLife))
+			candidates = append(candidates, c)
+			return nil
+		})
+	if err != nil {
+		return nil, err
+	}
+	sort.SliceStable(candidates, func(i, j int) bool { return candidates[i].score > candidates[j].score })
+	ids := make([]int, len(candidates))
+	for i, c := range candidates {
+		ids[i] = c.id
+	}
+	return ids, nil
+}
+
+// feedPage is the sort of listQuestions listing a page of a ranking, in its order
+func feedPage(ids []int) questionSort {
+	in := make([]string, len(ids))
+	order := "case questions.id"
+	for i, id := range ids {
+		in[i] = strconv.Itoa(id)
+		order += fmt.Sprintf(" when %d then %d", id, i)
+	}
+	return questionSort{Name: forYouSort, OrderBy: order + " end", Where: "questions.id in (" + strings.Join(in, ", ") + ")"}
+}
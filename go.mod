@@ -3,3 +3,16 @@ module learning-qa
 go 1.18
 
 require github.com/mattn/go-sqlite3 v1.14.12
+
+require github.com/lib/pq v1.10.9
+
+require github.com/go-sql-driver/mysql v1.7.1
+
+require golang.org/x/crypto v0.17.0
+
+require golang.org/x/image v0.14.0
+
+require (
+	golang.org/x/net v0.10.0 // indirect
+	golang.org/x/text v0.14.0 // indirect
+)
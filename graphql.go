@@ -0,0 +1,736 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"learning-qa/graphql"
+)
+
+// /graphql serves the questions, answers, users, tags and votes nested the way a dashboard
+// needs them, in a round trip:
+//
+//	{ questions(first: 5, tag: "go") { title score author { username } answers { score votes { up down } } } }
+//
+// a field is resolved for all the objects of a level at once, see package graphql, so the
+// authors of the questions above cost one query however many questions there are.
+// users see what the pages show them: neither hidden posts nor the questions of an exam going
+// on, unless they moderate
+
+// most objects of a list field, whatever first asks
+const maxGraphQLList = 100
+
+// the schema of /graphql
+var graphqlSchema = newGraphQLSchema()
+
+// graphqlViewer is who runs a query, with the conditions keeping what they can see
+type graphqlViewer struct {
+	r            *http.Request
+	user         *User
+	questions    string // condition on questions
+	questionArgs []interface{}
+	answers      string // condition on answers, with questionArgs
+}
+
+// the context key of the viewer of a query
+type graphqlViewerKey struct{}
+
+func viewerOf(ctx context.Context) *graphqlViewer {
+	return ctx.Value(graphqlViewerKey{}).(*graphqlViewer)
+}
+
+// userID is the id of the viewer, 0 for visitors
+func (v *graphqlViewer) userID() int {
+	if v.user == nil {
+		return 0
+	}
+	return v.user.UniqueID
+}
+
+// serve /graphql, queried with GET and the query in the url, or with POST and a JSON request
+func serveGraphQL(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	var req graphql.Request
+	switch r.Method {
+	case http.MethodGet:
+		q := r.URL.Query()
+		req.Query, req.OperationName = q.Get("query"), q.Get("operationName")
+		if vars := q.Get("variables"); vars != "" {
+			if err := json.Unmarshal([]byte(vars), &req.Variables); err != nil {
+				writeJSONError(w, http.StatusBadRequest, "the variables aren't a JSON object")
+				return
+			}
+		}
+	case http.MethodPost:
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<16)).Decode(&req); err != nil {
+			writeJSONError(w, http.StatusBadRequest, "the request isn't valid JSON or is too large")
+			return
+		}
+	default:
+		writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	if strings.TrimSpace(req.Query) == "" {
+		writeJSONError(w, http.StatusBadRequest, "no query")
+		return
+	}
+	user := currentUser(r)
+	v := &graphqlViewer{r: r, user: user}
+	filter, args, err := questionFilter(ctx, user)
+	if err != nil {
+		writeInternalError(w, r, err)
+		return
+	}
+	v.questions, v.questionArgs, v.answers = filter, args, "true"
+	if !isModerator(user) {
+		v.answers = "answers.hidden_at is null and answers.question_id in (select questions.id from questions where " + filter + ")"
+	}
+	resp := graphqlSchema.Execute(context.WithValue(ctx, graphqlViewerKey{}, v), req)
+	status := http.StatusOK
+	if resp.Data == nil {
+		// the query couldn't run
+		status = http.StatusBadRequest
+	}
+	writeJSON(w, status, resp)
+}
+
+// graphqlTag is a tag of the schema, its fields are resolved from the name
+type graphqlTag struct {
+	Name string
+}
+
+// graphqlVotes are the votes on a post
+type graphqlVotes struct {
+	Up, Down int
+	Mine     int // vote of the viewer, 1, -1 or 0
+}
+
+// newGraphQLSchema builds the schema of /graphql
+func newGraphQLSchema() *graphql.Schema {
+	question := &graphql.Object{Name: "Question"}
+	answer := &graphql.Object{Name: "Answer"}
+	user := &graphql.Object{Name: "User"}
+	tag := &graphql.Object{Name: "Tag"}
+	votes := &graphql.Object{Name: "Votes"}
+	first := func(n int) map[string]graphql.Arg {
+		return map[string]graphql.Arg{"first": {Type: graphql.Int, Default: n}}
+	}
+	byID := map[string]graphql.Arg{"id": {Type: graphql.ID}}
+
+	question.Fields = map[string]*graphql.Field{
+		"id":        {Type: graphql.ID, Resolve: graphql.Value(func(s interface{}) interface{} { return strconv.Itoa(s.(*Question).QnID) })},
+		"title":     {Type: graphql.String, Resolve: graphql.Value(func(s interface{}) interface{} { return s.(*Question).QnHeading })},
+		"body":      {Type: graphql.String, Resolve: graphql.Value(func(s interface{}) interface{} { return s.(*Question).QnBody })},
+		"url":       {Type: graphql.String, Resolve: graphql.Value(func(s interface{}) interface{} { return "/questions/" + strconv.Itoa(s.(*Question).QnID) })},
+		"createdAt": {Type: graphql.String, Resolve: graphql.Value(func(s interface{}) interface{} { return postTime(s.(*Question).QnDate, s.(*Question).QnTime) })},
+		"editedAt":  {Type: graphql.String, Resolve: graphql.Value(func(s interface{}) interface{} { return nullString(s.(*Question).QnEdited) })},
+		"views":     {Type: graphql.Int, Resolve: graphql.Value(func(s interface{}) interface{} { return s.(*Question).QnViews })},
+		"score":     {Type: graphql.Int, Resolve: graphql.Value(func(s interface{}) interface{} { return s.(*Question).QnScore })},
+		"open":      {Type: graphql.Boolean, Resolve: graphql.Value(func(s interface{}) interface{} { return s.(*Question).QnOpen })},
+		"anonymous": {Type: graphql.Boolean, Resolve: graphql.Value(func(s interface{}) interface{} { return s.(*Question).QnAnonymous })},
+		"tags": {Type: graphql.List{Of: tag}, Resolve: graphql.Value(func(s interface{}) interface{} {
+			tags := []*graphqlTag{}
+			for _, name := range s.(*Question).QnTags {
+				tags = append(tags, &graphqlTag{strings.ToLower(name)})
+			}
+			return tags
+		})},
+		"author":      {Type: user, Resolve: resolveAuthors(func(s interface{}) string { return s.(*Question).QnUser })},
+		"answerCount": {Type: graphql.Int, Resolve: resolveAnswerCounts},
+		"answers":     {Type: graphql.List{Of: answer}, Args: first(30), Resolve: resolveQuestionAnswers},
+		"votes":       {Type: votes, Resolve: resolveVotes("question", func(s interface{}) int { return s.(*Question).QnID })},
+	}
+	answer.Fields = map[string]*graphql.Field{
+		"id":        {Type: graphql.ID, Resolve: graphql.Value(func(s interface{}) interface{} { return strconv.Itoa(s.(*Answer).AnsID) })},
+		"body":      {Type: graphql.String, Resolve: graphql.Value(func(s interface{}) interface{} { return s.(*Answer).AnsBody })},
+		"createdAt": {Type: graphql.String, Resolve: graphql.Value(func(s interface{}) interface{} { return postTime(s.(*Answer).AnsDate, s.(*Answer).AnsTime) })},
+		"editedAt":  {Type: graphql.String, Resolve: graphql.Value(func(s interface{}) interface{} { return nullString(s.(*Answer).AnsEdited) })},
+		"score":     {Type: graphql.Int, Resolve: graphql.Value(func(s interface{}) interface{} { return s.(*Answer).AnsScore })},
+		"author":    {Type: user, Resolve: resolveAuthors(func(s interface{}) string { return s.(*Answer).AnsUser })},
+		"question":  {Type: question, Resolve: resolveAnswerQuestions},
+		"accepted":  {Type: graphql.Boolean, Resolve: resolveAccepted},
+		"votes":     {Type: votes, Resolve: resolveVotes("answer", func(s interface{}) int { return s.(*Answer).AnsID })},
+	}
+	user.Fields = map[string]*graphql.Field{
+		"id":        {Type: graphql.ID, Resolve: graphql.Value(func(s interface{}) interface{} { return strconv.Itoa(s.(*User).UniqueID) })},
+		"username":  {Type: graphql.String, Resolve: graphql.Value(func(s interface{}) interface{} { return s.(*User).UserName })},
+		"firstName": {Type: graphql.String, Resolve: graphql.Value(func(s interface{}) interface{} { return s.(*User).FirstName })},
+		"lastName":  {Type: graphql.String, Resolve: graphql.Value(func(s interface{}) interface{} { return s.(*User).LastName })},
+		"types":     {Type: graphql.List{Of: graphql.String}, Resolve: graphql.Value(func(s interface{}) interface{} { return s.(*User).UserType })},
+		"url":       {Type: graphql.String, Resolve: graphql.Value(func(s interface{}) interface{} { return "/users/" + s.(*User).UserName })},
+		"questions": {Type: graphql.List{Of: question}, Args: first(10), Resolve: resolveUserQuestions},
+		"answers":   {Type: graphql.List{Of: answer}, Args: first(10), Resolve: resolveUserAnswers},
+	}
+	tag.Fields = map[string]*graphql.Field{
+		"name":          {Type: graphql.String, Resolve: graphql.Value(func(s interface{}) interface{} { return s.(*graphqlTag).Name })},
+		"url":           {Type: graphql.String, Resolve: graphql.Value(func(s interface{}) interface{} { return "/tags/" + s.(*graphqlTag).Name })},
+		"excerpt":       {Type: graphql.String, Resolve: resolveTagExcerpts},
+		"questionCount": {Type: graphql.Int, Resolve: resolveTagCounts},
+		"questions":     {Type: graphql.List{Of: question}, Args: first(10), Resolve: resolveTagQuestions},
+	}
+	votes.Fields = map[string]*graphql.Field{
+		"up":    {Type: graphql.Int, Resolve: graphql.Value(func(s interface{}) interface{} { return s.(*graphqlVotes).Up })},
+		"down":  {Type: graphql.Int, Resolve: graphql.Value(func(s interface{}) interface{} { return s.(*graphqlVotes).Down })},
+		"score": {Type: graphql.Int, Resolve: graphql.Value(func(s interface{}) interface{} { return s.(*graphqlVotes).Up - s.(*graphqlVotes).Down })},
+		"mine":  {Type: graphql.Int, Resolve: graphql.Value(func(s interface{}) interface{} { return s.(*graphqlVotes).Mine })},
+	}
+	query := &graphql.Object{Name: "Query", Fields: map[string]*graphql.Field{
+		"question": {Type: question, Args: byID, Resolve: resolveQuestion},
+		"questions": {Type: graphql.List{Of: question}, Resolve: resolveQuestions, Args: map[string]graphql.Arg{
+			"first":  {Type: graphql.Int, Default: 20},
+			"offset": {Type: graphql.Int, Default: 0},
+			"sort":   {Type: graphql.String, Default: questionSorts[0].Name},
+			"tag":    {Type: graphql.String},
+		}},
+		"answer": {Type: answer, Args: byID, Resolve: resolveAnswer},
+		"user":   {Type: user, Args: map[string]graphql.Arg{"username": {Type: graphql.String}}, Resolve: resolveUser},
+		"viewer": {Type: user, Resolve: func(ctx context.Context, _ []interface{}, _ map[string]interface{}) ([]interface{}, error) {
+			return []interface{}{viewerOf(ctx).user}, nil
+		}},
+		"tag": {Type: tag, Args: map[string]graphql.Arg{"name": {Type: graphql.String}}, Resolve: resolveTag},
+		"tags": {Type: graphql.List{Of: tag}, Resolve: resolveTags, Args: map[string]graphql.Arg{
+			"first":  {Type: graphql.Int, Default: 50},
+			"offset": {Type: graphql.Int, Default: 0},
+		}},
+	}}
+	// the errors of the database are logged, the client gets the id of the log line
+	for _, obj := range []*graphql.Object{query, question, answer, user, tag, votes} {
+		for _, f := range obj.Fields {
+			f.Resolve = logGraphQLErrors(f.Resolve)
+		}
+	}
+	return &graphql.Schema{Query: query, MaxDepth: 8, MaxObjects: 5000}
+}
+
+// logGraphQLErrors logs the errors of a resolver
+func logGraphQLErrors(resolve graphql.ResolveFunc) graphql.ResolveFunc {
+	return func(ctx context.Context, sources []interface{}, args map[string]interface{}) ([]interface{}, error) {
+		values, err := resolve(ctx, sources, args)
+		if err != nil {
+			return nil, errors.New("internal error " + logError(viewerOf(ctx).r, err))
+		}
+		return values, nil
+	}
+}
+
+// postTime is the date and time of a post, in one string
+func postTime(date, clock string) string {
+	return strings.TrimSpace(date + " " + clock)
+}
+
+// nullString is nil for an empty string, so that it is null in responses
+func nullString(s string) interface{} {
+	if s == "" {
+		return nil
+	}
+	return s
+}
+
+// listArg is the first or offset argument, within the bounds of a list
+func listArg(args map[string]interface{}, name string) int {
+	n, _ := args[name].(int)
+	if n < 0 {
+		return 0
+	}
+	if name == "first" && n > maxGraphQLList {
+		return maxGraphQLList
+	}
+	return n
+}
+
+// placeholders returns n ? separated by commas, for a list of values
+func placeholders(n int) string {
+	if n == 0 {
+		return ""
+	}
+	return "?" + strings.Repeat(", ?", n-1)
+}
+
+// queryQuestions loads the questions of a query selecting questionColumns, hiding the
+// anonymous authors from the viewer
+func queryQuestions(ctx context.Context, query string, args ...interface{}) ([]*Question, error) {
+	rows, err := db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var questions []*Question
+	for rows.Next() {
+		q, err := scanQuestion(rows)
+		if err != nil {
+			return nil, err
+		}
+		maskAuthor(&q, viewerOf(ctx).user)
+		questions = append(questions, &q)
+	}
+	return questions, rows.Err()
+}
+
+// queryAnswers loads the answers of a query selecting answerColumns
+func queryAnswers(ctx context.Context, query string, args ...interface{}) ([]*Answer, error) {
+	rows, err := db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var answers []*Answer
+	for rows.Next() {
+		a, err := scanAnswer(rows)
+		if err != nil {
+			return nil, err
+		}
+		answers = append(answers, &a)
+	}
+	return answers, rows.Err()
+}
+
+// questionsByID loads the questions the viewer can see among the ids
+func questionsByID(ctx context.Context, ids []interface{}) (map[int]*Question, error) {
+	v := viewerOf(ctx)
+	questions, err := queryQuestions(ctx, "select "+questionColumns+" from questions where questions.id in ("+placeholders(len(ids))+") and "+v.questions,
+		append(ids, v.questionArgs...)...)
+	if err != nil {
+		return nil, err
+	}
+	byID := map[int]*Question{}
+	for _, q := range questions {
+		byID[q.QnID] = q
+	}
+	return byID, nil
+}
+
+// resolveQuestion resolves Query.question
+func resolveQuestion(ctx context.Context, _ []interface{}, args map[string]interface{}) ([]interface{}, error) {
+	id, err := strconv.Atoi(args["id"].(string))
+	if err != nil {
+		return []interface{}{nil}, nil
+	}
+	questions, err := questionsByID(ctx, []interface{}{id})
+	return []interface{}{questions[id]}, err
+}
+
+// resolveQuestions resolves Query.questions, a page of the question list
+func resolveQuestions(ctx context.Context, _ []interface{}, args map[string]interface{}) ([]interface{}, error) {
+	v := viewerOf(ctx)
+	sort := findQuestionSort(args["sort"].(string))
+	where, whereArgs := v.questions, append([]interface{}{}, v.questionArgs...)
+	if sort.Where != "" {
+		where += " and " + sort.Where
+	}
+	if tag, ok := args["tag"].(string); ok {
+		where += " and " + taggedSQL
+		whereArgs = append(whereArgs, strings.ToLower(tag))
+	}
+	questions, err := queryQuestions(ctx, "select "+questionColumns+" from questions where "+where+" order by "+sort.OrderBy+" limit ? offset ?",
+		append(whereArgs, listArg(args, "first"), listArg(args, "offset"))...)
+	if questions == nil {
+		questions = []*Question{}
+	}
+	return []interface{}{questions}, err
+}
+
+// resolveAnswer resolves Query.answer
+func resolveAnswer(ctx context.Context, _ []interface{}, args map[string]interface{}) ([]interface{}, error) {
+	v := viewerOf(ctx)
+	id, err := strconv.Atoi(args["id"].(string))
+	if err != nil {
+		return []interface{}{nil}, nil
+	}
+	answers, err := queryAnswers(ctx, "select "+answerColumns+" from answers where answers.id = ? and "+v.answers, append([]interface{}{id}, v.questionArgs...)...)
+	if err != nil || len(answers) == 0 {
+		return []interface{}{nil}, err
+	}
+	return []interface{}{answers[0]}, nil
+}
+
+// resolveUser resolves Query.user
+func resolveUser(ctx context.Context, _ []interface{}, args map[string]interface{}) ([]interface{}, error) {
+	name, _ := args["username"].(string)
+	users, err := usersByName(ctx, []string{name})
+	return []interface{}{users[strings.ToLower(name)]}, err
+}
+
+// resolveTag resolves Query.tag, following synonyms
+func resolveTag(ctx context.Context, _ []interface{}, args map[string]interface{}) ([]interface{}, error) {
+	name, _ := args["name"].(string)
+	name, err := canonicalTag(ctx, strings.ToLower(strings.TrimSpace(name)))
+	if err != nil {
+		return nil, err
+	}
+	var n int
+	if err := db.QueryRowContext(ctx, "select count(*) from tags where name = ?", name).Scan(&n); err != nil || n == 0 {
+		return []interface{}{nil}, err
+	}
+	return []interface{}{&graphqlTag{name}}, nil
+}
+
+// resolveTags resolves Query.tags, the most used first
+func resolveTags(ctx context.Context, _ []interface{}, args map[string]interface{}) ([]interface{}, error) {
+	rows, err := db.QueryContext(ctx, `select name from tags
+		order by (select count(*) from question_tags where question_tags.tag_id = tags.id) desc, name limit ? offset ?`,
+		listArg(args, "first"), listArg(args, "offset"))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	tags := []*graphqlTag{}
+	for rows.Next() {
+		var t graphqlTag
+		if err := rows.Scan(&t.Name); err != nil {
+			return nil, err
+		}
+		tags = append(tags, &t)
+	}
+	return []interface{}{tags}, rows.Err()
+}
+
+// usersByName loads the users of the names, by lowercase name
+func usersByName(ctx context.Context, names []string) (map[string]*User, error) {
+	args := make([]interface{}, len(names))
+	for i, name := range names {
+		args[i] = strings.ToLower(name)
+	}
+	rows, err := db.QueryContext(ctx, "select "+userColumns+" from users where lower(username) in ("+placeholders(len(args))+")", args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	users := map[string]*User{}
+	for rows.Next() {
+		u, err := scanUser(rows)
+		if err != nil {
+			return nil, err
+		}
+		users[strings.ToLower(u.UserName)] = u
+	}
+	return users, rows.Err()
+}
+
+// resolveAuthors resolves the author of posts, from their username
+func resolveAuthors(author func(s interface{}) string) graphql.ResolveFunc {
+	return func(ctx context.Context, sources []interface{}, _ map[string]interface{}) ([]interface{}, error) {
+		seen := map[string]bool{}
+		var names []string
+		for _, s := range sources {
+			// anonymous posts have no author
+			name := strings.ToLower(author(s))
+			if name != "" && !seen[name] {
+				seen[name] = true
+				names = append(names, name)
+			}
+		}
+		users, err := usersByName(ctx, names)
+		if err != nil {
+			return nil, err
+		}
+		values := make([]interface{}, len(sources))
+		for i, s := range sources {
+			if u, ok := users[strings.ToLower(author(s))]; ok {
+				values[i] = u
+			}
+		}
+		return values, nil
+	}
+}
+
+// questionIDs returns the ids of the question sources
+func questionIDs(sources []interface{}) []interface{} {
+	ids := make([]interface{}, len(sources))
+	for i, s := range sources {
+		ids[i] = s.(*Question).QnID
+	}
+	return ids
+}
+
+// resolveAnswerCounts resolves Question.answerCount, counting the answers the viewer can see
+func resolveAnswerCounts(ctx context.Context, sources []interface{}, _ map[string]interface{}) ([]interface{}, error) {
+	v := viewerOf(ctx)
+	ids := questionIDs(sources)
+	rows, err := db.QueryContext(ctx, "select answers.question_id, count(*) from answers where answers.question_id in ("+placeholders(len(ids))+") and "+v.answers+
+		" group by answers.question_id", append(ids, v.questionArgs...)...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	counts := map[int]int{}
+	for rows.Next() {
+		var id, n int
+		if err := rows.Scan(&id, &n); err != nil {
+			return nil, err
+		}
+		counts[id] = n
+	}
+	values := make([]interface{}, len(sources))
+	for i, s := range sources {
+		values[i] = counts[s.(*Question).QnID]
+	}
+	return values, rows.Err()
+}
+
+// resolveQuestionAnswers resolves Question.answers, the first ones of each question, best scored first
+func resolveQuestionAnswers(ctx context.Context, sources []interface{}, args map[string]interface{}) ([]interface{}, error) {
+	v := viewerOf(ctx)
+	ids := questionIDs(sources)
+	// row_number ranks the answers of each question, to keep the first of each in one query
+	answers, err := queryAnswers(ctx, "select "+answerColumns+" from answers where answers.id in (select id from (select answers.id, row_number() over (partition by answers.question_id order by "+
+		answerScoreSQL+" desc, answers.id) as n from answers where answers.question_id in ("+placeholders(len(ids))+") and "+v.answers+") where n <= ?) order by "+answerScoreSQL+" desc, answers.id",
+		append(append(ids, v.questionArgs...), listArg(args, "first"))...)
+	if err != nil {
+		return nil, err
+	}
+	byQuestion := map[int][]*Answer{}
+	for _, a := range answers {
+		byQuestion[a.AnsQn] = append(byQuestion[a.AnsQn], a)
+	}
+	values := make([]interface{}, len(sources))
+	for i, s := range sources {
+		list := byQuestion[s.(*Question).QnID]
+		if list == nil {
+			list = []*Answer{}
+		}
+		values[i] = list
+	}
+	return values, nil
+}
+
+// resolveAnswerQuestions resolves Answer.question
+func resolveAnswerQuestions(ctx context.Context, sources []interface{}, _ map[string]interface{}) ([]interface{}, error) {
+	ids := make([]interface{}, len(sources))
+	for i, s := range sources {
+		ids[i] = s.(*Answer).AnsQn
+	}
+	questions, err := questionsByID(ctx, ids)
+	if err != nil {
+		return nil, err
+	}
+	values := make([]interface{}, len(sources))
+	for i, s := range sources {
+		if q, ok := questions[s.(*Answer).AnsQn]; ok {
+			values[i] = q
+		}
+	}
+	return values, nil
+}
+
+// resolveAccepted resolves Answer.accepted, whether the author of the question accepted the answer
+func resolveAccepted(ctx context.Context, sources []interface{}, _ map[string]interface{}) ([]interface{}, error) {
+	ids := make([]interface{}, len(sources))
+	for i, s := range sources {
+		ids[i] = s.(*Answer).AnsID
+	}
+	rows, err := db.QueryContext(ctx, "select accepted_id from questions where accepted_id in ("+placeholders(len(ids))+")", ids...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	accepted := map[int]bool{}
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		accepted[id] = true
+	}
+	values := make([]interface{}, len(sources))
+	for i, s := range sources {
+		values[i] = accepted[s.(*Answer).AnsID]
+	}
+	return values, rows.Err()
+}
+
+// resolveVotes resolves the votes on posts of a type, with the vote of the viewer
+func resolveVotes(postType string, postID func(s interface{}) int) graphql.ResolveFunc {
+	return func(ctx context.Context, sources []interface{}, _ map[string]interface{}) ([]interface{}, error) {
+		ids := make([]interface{}, len(sources))
+		for i, s := range sources {
+			ids[i] = postID(s)
+		}
+		rows, err := db.QueryContext(ctx, `select post_id, coalesce(sum(value > 0), 0), coalesce(sum(value < 0), 0),
+			coalesce(sum(case when user_id = ? then value end), 0)
+			from votes where post_type = ? and post_id in (`+placeholders(len(ids))+`) group by post_id`,
+			append([]interface{}{viewerOf(ctx).userID(), postType}, ids...)...)
+		if err != nil {
+			return nil, err
+		}
+		defer rows.Close()
+		byPost := map[int]*graphqlVotes{}
+		for rows.Next() {
+			var id int
+			var v graphqlVotes
+			if err := rows.Scan(&id, &v.Up, &v.Down, &v.Mine); err != nil {
+				return nil, err
+			}
+			byPost[id] = &v
+		}
+		values := make([]interface{}, len(sources))
+		for i, s := range sources {
+			v, ok := byPost[postID(s)]
+			if !ok {
+				v = &graphqlVotes{}
+			}
+			values[i] = v
+		}
+		return values, rows.Err()
+	}
+}
+
+// userNames returns the lowercase names of the user sources
+func userNames(sources []interface{}) []interface{} {
+	names := make([]interface{}, len(sources))
+	for i, s := range sources {
+		names[i] = strings.ToLower(s.(*User).UserName)
+	}
+	return names
+}
+
+// resolveUserQuestions resolves User.questions, the latest first
+func resolveUserQuestions(ctx context.Context, sources []interface{}, args map[string]interface{}) ([]interface{}, error) {
+	v := viewerOf(ctx)
+	names := userNames(sources)
+	anonymous, anonymousArgs := anonymousFilter(v.user)
+	questions, err := queryQuestions(ctx, "select "+questionColumns+" from questions where questions.id in (select id from (select questions.id, row_number() over (partition by lower(questions.user) order by questions.id desc) as n from questions where lower(questions.user) in ("+
+		placeholders(len(names))+") and "+v.questions+" and "+anonymous+") where n <= ?) order by questions.id desc",
+		append(append(append(names, v.questionArgs...), anonymousArgs...), listArg(args, "first"))...)
+	if err != nil {
+		return nil, err
+	}
+	byUser := map[string][]*Question{}
+	for _, q := range questions {
+		name := strings.ToLower(q.QnUser)
+		byUser[name] = append(byUser[name], q)
+	}
+	values := make([]interface{}, len(sources))
+	for i, name := range names {
+		list := byUser[name.(string)]
+		if list == nil {
+			list = []*Question{}
+		}
+		values[i] = list
+	}
+	return values, nil
+}
+
+// resolveUserAnswers resolves User.answers, the latest first
+func resolveUserAnswers(ctx context.Context, sources []interface{}, args map[string]interface{}) ([]interface{}, error) {
+	v := viewerOf(ctx)
+	names := userNames(sources)
+	answers, err := queryAnswers(ctx, "select "+answerColumns+" from answers where answers.id in (select id from (select answers.id, row_number() over (partition by lower(answers.user) order by answers.id desc) as n from answers where lower(answers.user) in ("+
+		placeholders(len(names))+") and "+v.answers+") where n <= ?) order by answers.id desc",
+		append(append(names, v.questionArgs...), listArg(args, "first"))...)
+	if err != nil {
+		return nil, err
+	}
+	byUser := map[string][]*Answer{}
+	for _, a := range answers {
+		name := strings.ToLower(a.AnsUser)
+		byUser[name] = append(byUser[name], a)
+	}
+	values := make([]interface{}, len(sources))
+	for i, name := range names {
+		list := byUser[name.(string)]
+		if list == nil {
+			list = []*Answer{}
+		}
+		values[i] = list
+	}
+	return values, nil
+}
+
+// tagNames returns the names of the tag sources
+func tagNames(sources []interface{}) []interface{} {
+	names := make([]interface{}, len(sources))
+	for i, s := range sources {
+		names[i] = s.(*graphqlTag).Name
+	}
+	return names
+}
+
+// resolveTagExcerpts resolves Tag.excerpt, the start of the wiki of the tag
+func resolveTagExcerpts(ctx context.Context, sources []interface{}, _ map[string]interface{}) ([]interface{}, error) {
+	names := tagNames(sources)
+	rows, err := db.QueryContext(ctx, "select name, coalesce(desc, '') from tags where name in ("+placeholders(len(names))+")", names...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	excerpts := map[string]string{}
+	for rows.Next() {
+		var name, excerpt string
+		if err := rows.Scan(&name, &excerpt); err != nil {
+			return nil, err
+		}
+		excerpts[name] = excerpt
+	}
+	values := make([]interface{}, len(sources))
+	for i, name := range names {
+		values[i] = nullString(excerpts[name.(string)])
+	}
+	return values, rows.Err()
+}
+
+// resolveTagCounts resolves Tag.questionCount, counting the questions the viewer can see
+func resolveTagCounts(ctx context.Context, sources []interface{}, _ map[string]interface{}) ([]interface{}, error) {
+	v := viewerOf(ctx)
+	names := tagNames(sources)
+	rows, err := db.QueryContext(ctx, `select tags.name, count(*) from question_tags join tags on tags.id = question_tags.tag_id
+		join questions on questions.id = question_tags.question_id
+		where tags.name in (`+placeholders(len(names))+") and "+v.questions+" group by tags.name", append(names, v.questionArgs...)...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	counts := map[string]int{}
+	for rows.Next() {
+		var name string
+		var n int
+		if err := rows.Scan(&name, &n); err != nil {
+			return nil, err
+		}
+		counts[name] = n
+	}
+	values := make([]interface{}, len(sources))
+	for i, name := range names {
+		values[i] = counts[name.(string)]
+	}
+	return values, rows.Err()
+}
+
+// resolveTagQuestions resolves Tag.questions, the latest first
+func resolveTagQuestions(ctx context.Context, sources []interface{}, args map[string]interface{}) ([]interface{}, error) {
+	v := viewerOf(ctx)
+	names := tagNames(sources)
+	rows, err := db.QueryContext(ctx, "select ranked.tag, "+questionColumns+` from (select tags.name as tag, questions.id,
+		row_number() over (partition by tags.name order by questions.id desc) as n
+		from question_tags join tags on tags.id = question_tags.tag_id join questions on questions.id = question_tags.question_id
+		where tags.name in (`+placeholders(len(names))+") and "+v.questions+") as ranked join questions on questions.id = ranked.id where ranked.n <= ? order by questions.id desc",
+		append(append(names, v.questionArgs...), listArg(args, "first"))...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	byTag := map[string][]*Question{}
+	for rows.Next() {
+		var tag string
+		q, err := scanQuestion(scanFunc(func(dest ...interface{}) error {
+			return rows.Scan(append([]interface{}{&tag}, dest...)...)
+		}))
+		if err != nil {
+			return nil, err
+		}
+		maskAuthor(&q, v.user)
+		byTag[tag] = append(byTag[tag], &q)
+	}
+	values := make([]interface{}, len(sources))
+	for i, name := range names {
+		list := byTag[name.(string)]
+		if list == nil {
+			list = []*Question{}
+		}
+		values[i] = list
+	}
+	return values, rows.Err()
+}
@@ -0,0 +1,508 @@
+// Package graphql runs GraphQL queries on a schema of objects whose fields resolve in batches:
+// a field is resolved once for all the objects of a level of the result, like the authors of all
+// the questions of a list, so that a query costs a database query per field rather than per object.
+//
+// it implements what reading needs: queries with variables, aliases, arguments, fragments and
+// __typename. Mutations, subscriptions, directives and introspection aren't supported.
+package graphql
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"reflect"
+)
+
+// Type is the type of a field: a Scalar, a List or an *Object
+type Type interface {
+	String() string
+}
+
+// Scalar is a type whose values are sent as they are
+type Scalar string
+
+// the scalars of GraphQL
+const (
+	Int     Scalar = "Int"
+	Float   Scalar = "Float"
+	String  Scalar = "String"
+	Boolean Scalar = "Boolean"
+	ID      Scalar = "ID"
+)
+
+func (s Scalar) String() string { return string(s) }
+
+// List is a list of values of a type. Its values are slices
+type List struct {
+	Of Type
+}
+
+func (l List) String() string { return "[" + l.Of.String() + "]" }
+
+// Object is a type with fields, whose selection the query chooses
+type Object struct {
+	Name   string
+	Fields map[string]*Field
+}
+
+func (o *Object) String() string { return o.Name }
+
+// Field is a field of an object
+type Field struct {
+	Type    Type
+	Args    map[string]Arg
+	Resolve ResolveFunc
+}
+
+// Arg is an argument of a field, set to Default when the query leaves it out
+type Arg struct {
+	Type    Scalar
+	Default interface{}
+}
+
+// ResolveFunc resolves a field for a batch of objects, returning a value per object, in their
+// order. A nil value is null. Arguments are int, float64, string or bool, after their Scalar
+type ResolveFunc func(ctx context.Context, sources []interface{}, args map[string]interface{}) ([]interface{}, error)
+
+// Value resolves a field object by object, for the fields read from the object itself
+func Value(fn func(source interface{}) interface{}) ResolveFunc {
+	return func(ctx context.Context, sources []interface{}, args map[string]interface{}) ([]interface{}, error) {
+		values := make([]interface{}, len(sources))
+		for i, s := range sources {
+			values[i] = fn(s)
+		}
+		return values, nil
+	}
+}
+
+// Schema is what queries can ask for
+type Schema struct {
+	Query      *Object
+	MaxDepth   int // of the nested selections of a query, 0 for no limit
+	MaxObjects int // objects a query may return, 0 for no limit
+}
+
+// Request is a query with its variables, as clients post it
+type Request struct {
+	Query         string                 `json:"query"`
+	OperationName string                 `json:"operationName"`
+	Variables     map[string]interface{} `json:"variables"`
+}
+
+// Response is the result of a request. Data is left out when the request couldn't run
+type Response struct {
+	Data   interface{} `json:"data,omitempty"`
+	Errors []Error     `json:"errors,omitempty"`
+}
+
+// Error is an error of a request, with the path of the field that failed
+type Error struct {
+	Message string        `json:"message"`
+	Path    []interface{} `json:"path,omitempty"`
+}
+
+// fields is an object of a response, which keeps its fields in the order of the query
+type fields struct {
+	keys   []string
+	values map[string]interface{}
+}
+
+func (f *fields) set(key string, value interface{}) {
+	if _, ok := f.values[key]; !ok {
+		f.keys = append(f.keys, key)
+	}
+	f.values[key] = value
+}
+
+func (f *fields) MarshalJSON() ([]byte, error) {
+	var b bytes.Buffer
+	b.WriteByte('{')
+	for i, key := range f.keys {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		k, _ := json.Marshal(key)
+		v, err := json.Marshal(f.values[key])
+		if err != nil {
+			return nil, err
+		}
+		b.Write(k)
+		b.WriteByte(':')
+		b.Write(v)
+	}
+	b.WriteByte('}')
+	return b.Bytes(), nil
+}
+
+// Execute runs the request. Errors of resolvers leave their fields null and are listed in the
+// response, next to the rest of the data
+func (s *Schema) Execute(ctx context.Context, req Request) *Response {
+	doc, err := parse(req.Query)
+	if err != nil {
+		return failed(err)
+	}
+	op, err := doc.operation(req.OperationName)
+	if err != nil {
+		return failed(err)
+	}
+	vars, err := op.variables(req.Variables)
+	if err != nil {
+		return failed(err)
+	}
+	e := &executor{ctx: ctx, schema: s, doc: doc, vars: vars}
+	if err := e.validate(s.Query, op.selections, 1, map[string]bool{}); err != nil {
+		return failed(err)
+	}
+	data := e.object(s.Query, []interface{}{nil}, op.selections, nil)[0]
+	return &Response{Data: data, Errors: e.errors}
+}
+
+func failed(err error) *Response {
+	return &Response{Errors: []Error{{Message: err.Error()}}}
+}
+
+// operation finds the operation to run
+func (d *document) operation(name string) (*operation, error) {
+	if name == "" {
+		if len(d.operations) > 1 {
+			return nil, fmt.Errorf("the document has several operations, operationName must choose one")
+		}
+		return d.operations[0], nil
+	}
+	for _, op := range d.operations {
+		if op.name == name {
+			return op, nil
+		}
+	}
+	return nil, fmt.Errorf("no operation named %s", name)
+}
+
+// variables gives the variables of the operation their values, or their defaults
+func (op *operation) variables(given map[string]interface{}) (map[string]interface{}, error) {
+	vars := map[string]interface{}{}
+	for _, v := range op.vars {
+		if value, ok := given[v.name]; ok {
+			vars[v.name] = value
+		} else if v.hasDefault {
+			vars[v.name] = v.value
+		}
+	}
+	for name := range given {
+		if _, ok := vars[name]; !ok {
+			return nil, fmt.Errorf("variable $%s isn't declared by the operation", name)
+		}
+	}
+	return vars, nil
+}
+
+// executor runs an operation
+type executor struct {
+	ctx     context.Context
+	schema  *Schema
+	doc     *document
+	vars    map[string]interface{}
+	errors  []Error
+	objects int
+}
+
+// validate checks the selections on the object before anything runs
+func (e *executor) validate(obj *Object, sels []*selection, depth int, spreading map[string]bool) error {
+	if e.schema.MaxDepth > 0 && depth > e.schema.MaxDepth {
+		return fmt.Errorf("the query is nested deeper than %d levels", e.schema.MaxDepth)
+	}
+	for _, s := range sels {
+		switch {
+		case s.spread != "":
+			f, ok := e.doc.fragments[s.spread]
+			if !ok {
+				return fmt.Errorf("unknown fragment %s", s.spread)
+			}
+			if f.on != obj.Name {
+				return fmt.Errorf("fragment %s on %s can't be spread on %s", s.spread, f.on, obj.Name)
+			}
+			if spreading[s.spread] {
+				return fmt.Errorf("fragment %s spreads itself", s.spread)
+			}
+			spreading[s.spread] = true
+			err := e.validate(obj, f.selections, depth, spreading)
+			delete(spreading, s.spread)
+			if err != nil {
+				return err
+			}
+		case s.inline:
+			if s.on != "" && s.on != obj.Name {
+				return fmt.Errorf("a fragment on %s can't be spread on %s", s.on, obj.Name)
+			}
+			if err := e.validate(obj, s.selections, depth, spreading); err != nil {
+				return err
+			}
+		case s.name == "__typename":
+			if s.selections != nil {
+				return fmt.Errorf("__typename has no fields to select")
+			}
+		default:
+			field, ok := obj.Fields[s.name]
+			if !ok {
+				return fmt.Errorf("%s has no field %s", obj.Name, s.name)
+			}
+			if _, err := e.args(field, s); err != nil {
+				return err
+			}
+			t := field.Type
+			for {
+				l, ok := t.(List)
+				if !ok {
+					break
+				}
+				t = l.Of
+			}
+			child, isObject := t.(*Object)
+			switch {
+			case isObject && s.selections == nil:
+				return fmt.Errorf("%s.%s is a %s, select its fields", obj.Name, s.name, field.Type)
+			case !isObject && s.selections != nil:
+				return fmt.Errorf("%s.%s is a %s, it has no fields to select", obj.Name, s.name, field.Type)
+			case isObject:
+				if err := e.validate(child, s.selections, depth+1, spreading); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// args returns the arguments of a selection of the field, with variables replaced and defaults set
+func (e *executor) args(field *Field, s *selection) (map[string]interface{}, error) {
+	args := map[string]interface{}{}
+	for name, value := range s.args {
+		arg, ok := field.Args[name]
+		if !ok {
+			return nil, fmt.Errorf("%s has no argument %s", s.name, name)
+		}
+		if v, ok := value.(variable); ok {
+			if value, ok = e.vars[string(v)]; !ok {
+				// a variable without a value is left out
+				continue
+			}
+		}
+		if value == nil {
+			continue
+		}
+		coerced, err := coerce(arg.Type, value)
+		if err != nil {
+			return nil, fmt.Errorf("argument %s of %s: %w", name, s.name, err)
+		}
+		args[name] = coerced
+	}
+	for name, arg := range field.Args {
+		if _, ok := args[name]; !ok && arg.Default != nil {
+			args[name] = arg.Default
+		}
+	}
+	return args, nil
+}
+
+// coerce converts the value of an argument, from the query or from JSON variables, to its scalar
+func coerce(t Scalar, value interface{}) (interface{}, error) {
+	switch t {
+	case Int:
+		switch v := value.(type) {
+		case int64:
+			return int(v), nil
+		case float64:
+			if v == float64(int(v)) {
+				return int(v), nil
+			}
+		}
+	case Float:
+		switch v := value.(type) {
+		case int64:
+			return float64(v), nil
+		case float64:
+			return v, nil
+		}
+	case String:
+		if v, ok := value.(string); ok {
+			return v, nil
+		}
+	case Boolean:
+		if v, ok := value.(bool); ok {
+			return v, nil
+		}
+	case ID:
+		switch v := value.(type) {
+		case string:
+			return v, nil
+		case int64:
+			return fmt.Sprint(v), nil
+		case float64:
+			if v == float64(int(v)) {
+				return fmt.Sprint(int(v)), nil
+			}
+		}
+	}
+	return nil, fmt.Errorf("%v isn't a %s", value, t)
+}
+
+// collected is a field of the response, with the selections asking for it
+type collected struct {
+	key  string
+	sels []*selection
+}
+
+// collect lists the fields the selections ask of the object, spreading the fragments
+func (e *executor) collect(obj *Object, sels []*selection, out []collected) []collected {
+	for _, s := range sels {
+		switch {
+		case s.spread != "":
+			out = e.collect(obj, e.doc.fragments[s.spread].selections, out)
+		case s.inline:
+			out = e.collect(obj, s.selections, out)
+		default:
+			merged := false
+			for i := range out {
+				if out[i].key == s.key() {
+					out[i].sels = append(out[i].sels, s)
+					merged = true
+					break
+				}
+			}
+			if !merged {
+				out = append(out, collected{s.key(), []*selection{s}})
+			}
+		}
+	}
+	return out
+}
+
+// object resolves the selections on a batch of objects, a field at a time for all of them
+func (e *executor) object(obj *Object, sources []interface{}, sels []*selection, path []interface{}) []interface{} {
+	results := make([]*fields, len(sources))
+	for i := range results {
+		results[i] = &fields{values: map[string]interface{}{}}
+	}
+	out := make([]interface{}, len(sources))
+	for i, r := range results {
+		out[i] = r
+	}
+	e.objects += len(sources)
+	if e.schema.MaxObjects > 0 && e.objects > e.schema.MaxObjects {
+		e.fail(path, fmt.Errorf("the query asks for more than %d objects", e.schema.MaxObjects))
+		return make([]interface{}, len(sources))
+	}
+	for _, c := range e.collect(obj, sels, nil) {
+		s := c.sels[0]
+		fieldPath := append(append([]interface{}{}, path...), c.key)
+		if s.name == "__typename" {
+			for _, r := range results {
+				r.set(c.key, obj.Name)
+			}
+			continue
+		}
+		field := obj.Fields[s.name]
+		var children []*selection
+		for _, s := range c.sels {
+			children = append(children, s.selections...)
+		}
+		values, err := e.resolve(field, s, sources)
+		if err != nil {
+			e.fail(fieldPath, err)
+			values = make([]interface{}, len(sources))
+		} else {
+			values = e.complete(field.Type, values, children, fieldPath)
+		}
+		for i, r := range results {
+			r.set(c.key, values[i])
+		}
+	}
+	return out
+}
+
+// resolve runs the resolver of a field, checking that it returns a value per object
+func (e *executor) resolve(field *Field, s *selection, sources []interface{}) ([]interface{}, error) {
+	args, err := e.args(field, s)
+	if err != nil {
+		return nil, err
+	}
+	values, err := field.Resolve(e.ctx, sources, args)
+	if err != nil {
+		return nil, err
+	}
+	if len(values) != len(sources) {
+		return nil, fmt.Errorf("%s resolved %d values for %d objects", s.name, len(values), len(sources))
+	}
+	return values, nil
+}
+
+// complete turns the values of a field into the values of the response, resolving the selections
+// on the objects. The elements of all the lists are completed together
+func (e *executor) complete(t Type, values []interface{}, sels []*selection, path []interface{}) []interface{} {
+	out := make([]interface{}, len(values))
+	switch t := t.(type) {
+	case List:
+		var all []interface{}
+		lengths := make([]int, len(values))
+		for i, v := range values {
+			lengths[i] = -1
+			if isNil(v) {
+				continue
+			}
+			rv := reflect.ValueOf(v)
+			if rv.Kind() != reflect.Slice && rv.Kind() != reflect.Array {
+				e.fail(path, fmt.Errorf("a %T isn't a list", v))
+				continue
+			}
+			lengths[i] = rv.Len()
+			for j := 0; j < rv.Len(); j++ {
+				all = append(all, rv.Index(j).Interface())
+			}
+		}
+		all = e.complete(t.Of, all, sels, path)
+		for i, n := range lengths {
+			if n < 0 {
+				continue
+			}
+			out[i], all = all[:n:n], all[n:]
+		}
+	case *Object:
+		var sources []interface{}
+		var at []int
+		for i, v := range values {
+			if !isNil(v) {
+				sources = append(sources, v)
+				at = append(at, i)
+			}
+		}
+		if len(sources) == 0 {
+			return out
+		}
+		for i, r := range e.object(t, sources, sels, path) {
+			out[at[i]] = r
+		}
+	default:
+		for i, v := range values {
+			if !isNil(v) {
+				out[i] = v
+			}
+		}
+	}
+	return out
+}
+
+func (e *executor) fail(path []interface{}, err error) {
+	e.errors = append(e.errors, Error{Message: err.Error(), Path: path})
+}
+
+// isNil tells if a value is null, like a nil pointer
+func isNil(v interface{}) bool {
+	if v == nil {
+		return true
+	}
+	switch rv := reflect.ValueOf(v); rv.Kind() {
+	case reflect.Ptr, reflect.Map, reflect.Slice, reflect.Interface:
+		return rv.IsNil()
+	}
+	return false
+}
@@ -0,0 +1,475 @@
+package graphql
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// document is a parsed request: its operations and fragments
+type document struct {
+	operations []*operation
+	fragments  map[string]*fragment
+}
+
+// operation is a query of a document
+type operation struct {
+	name       string
+	vars       []varDef
+	selections []*selection
+}
+
+// varDef declares a variable of an operation
+type varDef struct {
+	name       string
+	value      interface{} // default value
+	hasDefault bool
+}
+
+// fragment is a named set of selections on a type
+type fragment struct {
+	on         string
+	selections []*selection
+}
+
+// selection is a field, a fragment spread when spread is set, or an inline fragment when inline is
+type selection struct {
+	alias, name string
+	args        map[string]interface{}
+	selections  []*selection
+	spread      string
+	inline      bool
+	on          string // type condition of an inline fragment, empty for any type
+}
+
+// key is the name of the field in the response
+func (s *selection) key() string {
+	if s.alias != "" {
+		return s.alias
+	}
+	return s.name
+}
+
+// values of arguments are decoded to int64, float64, string, bool, nil, []interface{},
+// map[string]interface{}, enum and variable
+type (
+	enum     string
+	variable string
+)
+
+// token kinds
+const (
+	tokEOF = iota
+	tokPunct
+	tokName
+	tokInt
+	tokFloat
+	tokString
+)
+
+type token struct {
+	kind int
+	text string
+	pos  int
+}
+
+// lex splits a request into tokens, dropping the whitespace, commas and comments
+func lex(src string) ([]token, error) {
+	var toks []token
+	i := 0
+	for i < len(src) {
+		c := src[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r' || c == ',':
+			i++
+		case c == '#':
+			for i < len(src) && src[i] != '\n' && src[i] != '\r' {
+				i++
+			}
+		case strings.HasPrefix(src[i:], "..."):
+			toks = append(toks, token{tokPunct, "...", i})
+			i += 3
+		case strings.IndexByte("!$():=@[]{}|", c) >= 0:
+			toks = append(toks, token{tokPunct, string(c), i})
+			i++
+		case c == '_' || isLetter(c):
+			start := i
+			for i < len(src) && (src[i] == '_' || isLetter(src[i]) || isDigit(src[i])) {
+				i++
+			}
+			toks = append(toks, token{tokName, src[start:i], start})
+		case c == '-' || isDigit(c):
+			start := i
+			i++
+			for i < len(src) && isDigit(src[i]) {
+				i++
+			}
+			kind := tokInt
+			if i < len(src) && src[i] == '.' {
+				kind = tokFloat
+				i++
+				for i < len(src) && isDigit(src[i]) {
+					i++
+				}
+			}
+			if i < len(src) && (src[i] == 'e' || src[i] == 'E') {
+				kind = tokFloat
+				i++
+				if i < len(src) && (src[i] == '+' || src[i] == '-') {
+					i++
+				}
+				for i < len(src) && isDigit(src[i]) {
+					i++
+				}
+			}
+			toks = append(toks, token{kind, src[start:i], start})
+		case c == '"':
+			start := i
+			i++
+			for i < len(src) && src[i] != '"' {
+				if src[i] == '\\' {
+					i++
+				}
+				if i < len(src) && (src[i] == '\n' || src[i] == '\r') {
+					return nil, fmt.Errorf("unterminated string at %d", start)
+				}
+				i++
+			}
+			if i >= len(src) {
+				return nil, fmt.Errorf("unterminated string at %d", start)
+			}
+			i++
+			// the escapes of GraphQL strings are those of JSON
+			var s string
+			if err := json.Unmarshal([]byte(src[start:i]), &s); err != nil {
+				return nil, fmt.Errorf("invalid string at %d", start)
+			}
+			toks = append(toks, token{tokString, s, start})
+		default:
+			return nil, fmt.Errorf("unexpected character %q at %d", c, i)
+		}
+	}
+	return append(toks, token{tokEOF, "", len(src)}), nil
+}
+
+func isLetter(c byte) bool { return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' }
+func isDigit(c byte) bool  { return c >= '0' && c <= '9' }
+
+// parser reads a document from its tokens
+type parser struct {
+	toks []token
+	i    int
+}
+
+// parse parses a request into a document
+func parse(src string) (*document, error) {
+	toks, err := lex(src)
+	if err != nil {
+		return nil, err
+	}
+	p := &parser{toks: toks}
+	doc := &document{fragments: map[string]*fragment{}}
+	for p.peek().kind != tokEOF {
+		t := p.peek()
+		switch {
+		case t.kind == tokPunct && t.text == "{":
+			sels, err := p.selectionSet()
+			if err != nil {
+				return nil, err
+			}
+			doc.operations = append(doc.operations, &operation{selections: sels})
+		case t.kind == tokName && t.text == "query":
+			op, err := p.operation()
+			if err != nil {
+				return nil, err
+			}
+			doc.operations = append(doc.operations, op)
+		case t.kind == tokName && t.text == "fragment":
+			p.i++
+			name, err := p.name()
+			if err != nil {
+				return nil, err
+			}
+			if _, ok := doc.fragments[name]; ok {
+				return nil, fmt.Errorf("fragment %s is defined twice", name)
+			}
+			if err := p.keyword("on"); err != nil {
+				return nil, err
+			}
+			on, err := p.name()
+			if err != nil {
+				return nil, err
+			}
+			sels, err := p.selectionSet()
+			if err != nil {
+				return nil, err
+			}
+			doc.fragments[name] = &fragment{on: on, selections: sels}
+		case t.kind == tokName && (t.text == "mutation" || t.text == "subscription"):
+			return nil, fmt.Errorf("%s operations aren't supported", t.text)
+		default:
+			return nil, p.unexpected()
+		}
+	}
+	if len(doc.operations) == 0 {
+		return nil, fmt.Errorf("the document has no operation")
+	}
+	return doc, nil
+}
+
+func (p *parser) peek() token { return p.toks[p.i] }
+
+func (p *parser) unexpected() error {
+	t := p.peek()
+	if t.kind == tokEOF {
+		return fmt.Errorf("unexpected end of the document")
+	}
+	return fmt.Errorf("unexpected %q at %d", t.text, t.pos)
+}
+
+// punct reads the punctuator
+func (p *parser) punct(s string) error {
+	if t := p.peek(); t.kind != tokPunct || t.text != s {
+		return p.unexpected()
+	}
+	p.i++
+	return nil
+}
+
+// skip reads the punctuator if it comes next
+func (p *parser) skip(s string) bool {
+	if t := p.peek(); t.kind == tokPunct && t.text == s {
+		p.i++
+		return true
+	}
+	return false
+}
+
+func (p *parser) keyword(s string) error {
+	if t := p.peek(); t.kind != tokName || t.text != s {
+		return p.unexpected()
+	}
+	p.i++
+	return nil
+}
+
+func (p *parser) name() (string, error) {
+	t := p.peek()
+	if t.kind != tokName {
+		return "", p.unexpected()
+	}
+	p.i++
+	return t.text, nil
+}
+
+// operation reads query Name($var: Type = default) { ... }
+func (p *parser) operation() (*operation, error) {
+	p.i++
+	op := &operation{}
+	if p.peek().kind == tokName {
+		op.name, _ = p.name()
+	}
+	if p.skip("(") {
+		for !p.skip(")") {
+			if err := p.punct("$"); err != nil {
+				return nil, err
+			}
+			name, err := p.name()
+			if err != nil {
+				return nil, err
+			}
+			if err := p.punct(":"); err != nil {
+				return nil, err
+			}
+			// variables take the type of the argument they are given to
+			if err := p.typeRef(); err != nil {
+				return nil, err
+			}
+			v := varDef{name: name}
+			if p.skip("=") {
+				if v.value, err = p.value(true); err != nil {
+					return nil, err
+				}
+				v.hasDefault = true
+			}
+			op.vars = append(op.vars, v)
+		}
+	}
+	if p.peek().text == "@" {
+		return nil, fmt.Errorf("directives aren't supported")
+	}
+	sels, err := p.selectionSet()
+	if err != nil {
+		return nil, err
+	}
+	op.selections = sels
+	return op, nil
+}
+
+// typeRef reads a type, like [Int!]!
+func (p *parser) typeRef() error {
+	if p.skip("[") {
+		if err := p.typeRef(); err != nil {
+			return err
+		}
+		if err := p.punct("]"); err != nil {
+			return err
+		}
+	} else if _, err := p.name(); err != nil {
+		return err
+	}
+	p.skip("!")
+	return nil
+}
+
+// selectionSet reads { ... }
+func (p *parser) selectionSet() ([]*selection, error) {
+	if err := p.punct("{"); err != nil {
+		return nil, err
+	}
+	var sels []*selection
+	for !p.skip("}") {
+		s, err := p.selection()
+		if err != nil {
+			return nil, err
+		}
+		sels = append(sels, s)
+	}
+	if len(sels) == 0 {
+		return nil, fmt.Errorf("empty selection at %d", p.toks[p.i-1].pos)
+	}
+	return sels, nil
+}
+
+func (p *parser) selection() (*selection, error) {
+	s := &selection{}
+	if p.skip("...") {
+		if t := p.peek(); t.kind == tokName && t.text != "on" {
+			s.spread, _ = p.name()
+		} else {
+			s.inline = true
+			if p.peek().text == "on" {
+				p.i++
+				on, err := p.name()
+				if err != nil {
+					return nil, err
+				}
+				s.on = on
+			}
+			sels, err := p.selectionSet()
+			if err != nil {
+				return nil, err
+			}
+			s.selections = sels
+		}
+		if p.peek().text == "@" {
+			return nil, fmt.Errorf("directives aren't supported")
+		}
+		return s, nil
+	}
+	name, err := p.name()
+	if err != nil {
+		return nil, err
+	}
+	s.name = name
+	if p.skip(":") {
+		s.alias = name
+		if s.name, err = p.name(); err != nil {
+			return nil, err
+		}
+	}
+	if p.skip("(") {
+		s.args = map[string]interface{}{}
+		for !p.skip(")") {
+			arg, err := p.name()
+			if err != nil {
+				return nil, err
+			}
+			if err := p.punct(":"); err != nil {
+				return nil, err
+			}
+			if s.args[arg], err = p.value(false); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if p.peek().text == "@" {
+		return nil, fmt.Errorf("directives aren't supported")
+	}
+	if t := p.peek(); t.kind == tokPunct && t.text == "{" {
+		if s.selections, err = p.selectionSet(); err != nil {
+			return nil, err
+		}
+	}
+	return s, nil
+}
+
+// value reads the value of an argument, constant ones have no variables
+func (p *parser) value(constant bool) (interface{}, error) {
+	t := p.peek()
+	switch t.kind {
+	case tokInt:
+		p.i++
+		n, err := strconv.ParseInt(t.text, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid integer %s", t.text)
+		}
+		return n, nil
+	case tokFloat:
+		p.i++
+		f, err := strconv.ParseFloat(t.text, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid number %s", t.text)
+		}
+		return f, nil
+	case tokString:
+		p.i++
+		return t.text, nil
+	case tokName:
+		p.i++
+		switch t.text {
+		case "true":
+			return true, nil
+		case "false":
+			return false, nil
+		case "null":
+			return nil, nil
+		}
+		return enum(t.text), nil
+	}
+	switch {
+	case t.text == "$" && !constant:
+		p.i++
+		name, err := p.name()
+		return variable(name), err
+	case t.text == "[":
+		p.i++
+		list := []interface{}{}
+		for !p.skip("]") {
+			v, err := p.value(constant)
+			if err != nil {
+				return nil, err
+			}
+			list = append(list, v)
+		}
+		return list, nil
+	case t.text == "{":
+		p.i++
+		obj := map[string]interface{}{}
+		for !p.skip("}") {
+			name, err := p.name()
+			if err != nil {
+				return nil, err
+			}
+			if err := p.punct(":"); err != nil {
+				return nil, err
+			}
+			if obj[name], err = p.value(constant); err != nil {
+				return nil, err
+			}
+		}
+		return obj, nil
+	}
+	return nil, p.unexpected()
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"math"
+	"time"
+)
+
+// the Hot tab of the question list shows what is going on now. Every question gets a hot score
+// from its activity of the last week: the votes on it and on its answers, its answers and its
+// views, each counting half as much for every day it is old. The hot-scores job recomputes the
+// scores into questions.hot_score every 15 minutes, so the list only reads a column
+
+// how often the scores are recomputed, how far back activity counts, and how fast it fades
+const (
+	hotInterval = 15 * time.Minute
+	hotWindow   = 7 * 24 * time.Hour
+	hotHalfLife = 24 * time.Hour
+)
+
+// weights of the kinds of activity in the hot score
+const (
+	hotQuestionVote = 1.0 // times the value of the vote
+	hotAnswerVote   = 0.5
+	hotAnswer       = 2.0
+	hotView         = 0.2 // per viewer and day
+)
+
+func init() {
+	jobHandlers["hot-scores"] = hotScoresJob
+}
+
+// scheduleHotScores queues a run of the hot-scores job now, unless one is already waiting
+func scheduleHotScores(ctx context.Context) error {
+	var n int
+	err := db.QueryRowContext(ctx, "select count(*) from jobs where kind = 'hot-scores' and done_at is null and attempts < ?",
+		maxJobAttempts).Scan(&n)
+	if err != nil || n > 0 {
+		return err
+	}
+	return enqueueJob(ctx, "hot-scores", struct{}{})
+}
+
+// hotDecay is what activity at the time still counts now
+func hotDecay(now time.Time, at string) float64 {
+	t, err := time.ParseInLocation(timestampLayout, at, time.Local)
+	if err != nil {
+		return 0
+	}
+	age := now.Sub(t)
+	if age < 0 {
+		age = 0
+	}
+	return math.Pow(0.5, float64(age)/float64(hotHalfLife))
+}
+
+// hotScores computes the hot scores of the questions with activity in the window, by question id
+func hotScores(ctx context.Context, now time.Time) (map[int]float64, error) {
+	since := now.Add(-hotWindow)
+	scores := map[int]float64{}
+	err := queryList(ctx, `select case votes.post_type when 'question' then votes.post_id else answers.question_id end,
+		votes.post_type, votes.value, votes.voted_at from votes
+		left join answers on votes.post_type = 'answer' and answers.id = votes.post_id
+		where votes.voted_at > ? and votes.post_type in ('question', 'answer')`, []interface{}{since.Format(timestampLayout)}, func(rows *sql.Rows) error {
+		var id sql.NullInt64
+		var postType, at string
+		var value int
+		if err := rows.Scan(&id, &postType, &value, &at); err != nil {
+			return err
+		}
+		weight := hotQuestionVote
+		if postType == "answer" {
+			weight = hotAnswerVote
+		}
+		if id.Valid {
+			scores[int(id.Int64)] += weight * float64(value) * hotDecay(now, at)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	err = queryList(ctx, "select question_id, date || ' ' || time from answers where date >= ? and question_id is not null and hidden_at is null",
+		[]interface{}{since.Format(dateLayout)}, func(rows *sql.Rows) error {
+			var id int
+			var at string
+			err := rows.Scan(&id, &at)
+			scores[id] += hotAnswer * hotDecay(now, at)
+			return err
+		})
+	if err != nil {
+		return nil, err
+	}
+	// views are kept by day, counted from its middle
+	err = queryList(ctx, "select question_id, day || ' 12:00:00' from question_views where day >= ?",
+		[]interface{}{since.Format(dateLayout)}, func(rows *sql.Rows) error {
+			var id int
+			var at string
+			err := rows.Scan(&id, &at)
+			scores[id] += hotView * hotDecay(now, at)
+			return err
+		})
+	return scores, err
+}
+
+// hotScoresJob recomputes the hot scores, then schedules the next run
+func hotScoresJob(ctx context.Context, payload []byte) error {
+	now := time.Now()
+	scores, err := hotScores(ctx, now)
+	if err != nil {
+		return err
+	}
+	err = db.WithTx(ctx, func(ctx context.Context) error {
+		// the questions without recent activity cool down to nothing
+		if _, err := db.ExecContext(ctx, "update questions set hot_score = 0 where hot_score != 0"); err != nil {
+			return err
+		}
+		for id, score := range scores {
+			if _, err := db.ExecContext(ctx, "update questions set hot_score = ? where id = ?", math.Round(score*1000)/1000, id); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	return enqueueJobAt(ctx, "hot-scores", struct{}{}, now.Add(hotInterval))
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// pages are translated with the T template function, which looks the English text up in the
+// catalog of the language of the page. Catalogs are JSON objects from English to the language,
+// one file per language in locales/, named by its code. A missing translation stays in English.
+// the language of a page is the one the user chose, or else the best of the browser's Accept-Language
+
+// the language the templates are written in, which needs no catalog
+const defaultLanguage = "en"
+
+// language is a language pages can be shown in
+type language struct {
+	Code string
+	Name string // in the language itself
+}
+
+var languages = []language{
+	{"en", "English"},
+	{"fi", "Suomi"},
+}
+
+// catalogs of the languages, by code
+var catalogs = map[string]map[string]string{}
+
+// loadCatalogs reads the catalogs of the languages. A language without one is shown in English
+func loadCatalogs() {
+	for _, l := range languages {
+		if l.Code == defaultLanguage {
+			continue
+		}
+		data, err := os.ReadFile(filepath.Join("locales", l.Code+".json"))
+		if err != nil {
+			fmt.Println(err)
+			continue
+		}
+		catalog := map[string]string{}
+		if err := json.Unmarshal(data, &catalog); err != nil {
+			fmt.Println(l.Code+".json:", err)
+			continue
+		}
+		catalogs[l.Code] = catalog
+	}
+}
+
+// supportedLanguage tells if pages can be shown in the language
+func supportedLanguage(code string) bool {
+	for _, l := range languages {
+		if l.Code == code {
+			return true
+		}
+	}
+	return false
+}
+
+// translate returns the text in the language, formatted with the args like fmt.Sprintf when there are any
+func translate(lang, text string, args ...interface{}) string {
+	if t, ok := catalogs[lang][text]; ok && t != "" {
+		text = t
+	}
+	if len(args) > 0 {
+		return fmt.Sprintf(text, args...)
+	}
+	return text
+}
+
+// requestLanguage is the language to show the page of the request in
+func requestLanguage(r *http.Request, user *User) string {
+	if user != nil && supportedLanguage(user.Language) {
+		return user.Language
+	}
+	for _, code := range acceptedLanguages(r.Header.Get("Accept-Language")) {
+		if supportedLanguage(code) {
+			return code
+		}
+	}
+	return defaultLanguage
+}
+
+// acceptedLanguages parses an Accept-Language header like "fi-FI,fi;q=0.9,en;q=0.8" into the
+// base codes of the languages, the preferred first
+func acceptedLanguages(header string) []string {
+	type accepted struct {
+		code    string
+		quality float64
+	}
+	var list []accepted
+	for _, part := range strings.Split(header, ",") {
+		tag, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		quality := 1.0
+		if params = strings.TrimSpace(params); strings.HasPrefix(params, "q=") {
+			var err error
+			if quality, err = strconv.ParseFloat(strings.TrimPrefix(params, "q="), 64); err != nil {
+				continue
+			}
+		}
+		base, _, _ := strings.Cut(strings.ToLower(tag), "-")
+		if base == "" || base == "*" || quality <= 0 {
+			continue
+		}
+		list = append(list, accepted{base, quality})
+	}
+	sort.SliceStable(list, func(i, j int) bool { return list[i].quality > list[j].quality })
+	codes := make([]string, len(list))
+	for i, a := range list {
+		codes[i] = a.code
+	}
+	return codes
+}
+
+// languageForm is the data of the language settings page
+type languageForm struct {
+	Languages []language
+	Language  string // empty to follow the browser
+	Saved     bool
+}
+
+// serve /settings/language, where users choose the language of the pages
+func serveLanguageSettings(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	user := requireUser(w, r)
+	if user == nil {
+		return
+	}
+	form := languageForm{Languages: languages, Language: user.Language}
+	if r.Method == http.MethodPost {
+		form.Language = r.FormValue("language")
+		if !supportedLanguage(form.Language) {
+			form.Language = ""
+		}
+		if _, err := db.ExecContext(ctx, "update users set language = ? where id = ?", form.Language, user.UniqueID); err != nil {
+			serverError(w, r, err)
+			return
+		}
+		// the page shows in the new language
+		user.Language = form.Language
+		form.Saved = true
+	}
+	render(w, r, "language.html", form)
+}
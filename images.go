@@ -0,0 +1,210 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html/template"
+	"image"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"golang.org/x/image/draw"
+)
+
+// uploaded images are stored in this directory, served under /static/uploads/
+const uploadDir = "public/uploads"
+
+// largest image that can be uploaded, in bytes
+const maxImageSize = 5 << 20
+
+// widths of the smaller copies made for every uploaded image
+var thumbnailWidths = []int{320, 640, 1024}
+
+// extensions of the image formats accepted for upload, by content type
+var imageTypes = map[string]string{
+	"image/jpeg": ".jpg",
+	"image/png":  ".png",
+	"image/gif":  ".gif",
+}
+
+var errNotAnImage = errors.New("only jpeg, png and gif images can be uploaded")
+
+func init() {
+	jobHandlers["thumbnails"] = makeThumbnails
+}
+
+// filePath converts the url of an uploaded file to its path on disk
+func filePath(url string) string {
+	return filepath.Join("public", filepath.FromSlash(strings.TrimPrefix(url, "/static/")))
+}
+
+// saveImage stores the image uploaded in the form field of the request and queues the
+// making of its thumbnails. It returns the url of the image, empty if nothing was uploaded
+func saveImage(r *http.Request, field string, user *User) (string, error) {
+	ctx := r.Context()
+	file, header, err := r.FormFile(field)
+	if err == http.ErrMissingFile || err == http.ErrNotMultipart {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+	if header.Size > maxImageSize {
+		return "", fmt.Errorf("images can't be larger than %d MB", maxImageSize>>20)
+	}
+
+	head := make([]byte, 512)
+	n, _ := io.ReadFull(file, head)
+	ext, ok := imageTypes[http.DetectContentType(head[:n])]
+	if !ok {
+		return "", errNotAnImage
+	}
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return "", err
+	}
+	config, _, err := image.DecodeConfig(file)
+	if err != nil {
+		return "", errNotAnImage
+	}
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return "", err
+	}
+
+	if err := os.MkdirAll(uploadDir, 0755); err != nil {
+		return "", err
+	}
+	name := newToken()[:24] + ext
+	out, err := os.Create(filepath.Join(uploadDir, name))
+	if err != nil {
+		return "", err
+	}
+	if _, err := io.Copy(out, file); err != nil {
+		out.Close()
+		return "", err
+	}
+	if err := out.Close(); err != nil {
+		return "", err
+	}
+
+	url := "/static/uploads/" + name
+	res, err := db.ExecContext(ctx, "insert into images (path, user_id, width, height, created_at) values (?, ?, ?, ?, ?)",
+		url, user.UniqueID, config.Width, config.Height, time.Now().Format(timestampLayout))
+	if err != nil {
+		return "", err
+	}
+	id, _ := res.LastInsertId()
+	return url, enqueueJob(ctx, "thumbnails", thumbnailJob{ImageID: int(id)})
+}
+
+// payload of the thumbnails job
+type thumbnailJob struct {
+	ImageID int
+}
+
+// makeThumbnails writes a scaled down copy of an image for every thumbnail width smaller than the image
+func makeThumbnails(ctx context.Context, payload []byte) error {
+	var job thumbnailJob
+	if err := json.Unmarshal(payload, &job); err != nil {
+		return err
+	}
+	var url string
+	err := db.QueryRowContext(ctx, "select path from images where id = ?", job.ImageID).Scan(&url)
+	if err == sql.ErrNoRows {
+		// the image was deleted since
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	in, err := os.Open(filePath(url))
+	if err != nil {
+		return err
+	}
+	src, format, err := image.Decode(in)
+	in.Close()
+	if err != nil {
+		return err
+	}
+
+	bounds := src.Bounds()
+	for _, width := range thumbnailWidths {
+		if width >= bounds.Dx() {
+			break
+		}
+		height := bounds.Dy() * width / bounds.Dx()
+		dst := image.NewRGBA(image.Rect(0, 0, width, height))
+		draw.CatmullRom.Scale(dst, dst.Bounds(), src, bounds, draw.Over, nil)
+
+		ext := filepath.Ext(url)
+		sizeURL := fmt.Sprintf("%s-%dw%s", strings.TrimSuffix(url, ext), width, ext)
+		if err := writeImage(filePath(sizeURL), dst, format); err != nil {
+			return err
+		}
+		_, err = db.ExecContext(ctx, "insert or replace into image_sizes (image_id, width, path) values (?, ?, ?)", job.ImageID, width, sizeURL)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// encode an image to a file in the given format
+func writeImage(path string, img image.Image, format string) error {
+	out, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	switch format {
+	case "jpeg":
+		err = jpeg.Encode(out, img, &jpeg.Options{Quality: 85})
+	case "gif":
+		err = gif.Encode(out, img, nil)
+	default:
+		err = png.Encode(out, img)
+	}
+	if err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+// imgTag renders an <img> for an uploaded image, with a srcset listing its thumbnails.
+// images whose thumbnails aren't ready yet get a plain src
+func imgTag(ctx context.Context, url, alt string) template.HTML {
+	var srcset []string
+	rows, err := db.QueryContext(ctx, `select image_sizes.width, image_sizes.path from image_sizes
+		join images on images.id = image_sizes.image_id where images.path = ? order by image_sizes.width`, url)
+	if err == nil {
+		for rows.Next() {
+			var width int
+			var path string
+			if rows.Scan(&width, &path) == nil {
+				srcset = append(srcset, fmt.Sprintf("%s %dw", path, width))
+			}
+		}
+		rows.Close()
+	}
+	var width int
+	db.QueryRowContext(ctx, "select width from images where path = ?", url).Scan(&width)
+
+	esc := template.HTMLEscapeString
+	tag := fmt.Sprintf(`<img src="%s" alt="%s" loading="lazy"`, esc(url), esc(alt))
+	if len(srcset) > 0 {
+		srcset = append(srcset, fmt.Sprintf("%s %dw", url, width))
+		tag += fmt.Sprintf(` srcset="%s" sizes="(max-width: 800px) 100vw, 800px"`, esc(strings.Join(srcset, ", ")))
+	}
+	return template.HTML(tag + ">")
+}
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+// search engines are told about new and edited questions when configured in the environment:
+// INDEXNOW_KEY enables IndexNow, with INDEXNOW_ENDPOINT to use another endpoint than api.indexnow.org.
+// SITEMAP_PING is a comma separated list of ping urls, the url of the sitemap is appended to each.
+// without them, nothing is sent, since most instances aren't public
+
+const defaultIndexNowEndpoint = "https://api.indexnow.org/indexnow"
+
+// most urls listed in a sitemap, see sitemaps.org
+const sitemapSize = 50000
+
+// client for the search engines, which shouldn't hold a job for long
+var indexingClient = &http.Client{Timeout: 30 * time.Second}
+
+func init() {
+	jobHandlers["indexing"] = sendIndexingJob
+}
+
+// indexingEnabled tells if any search engine is to be notified
+func indexingEnabled() bool {
+	return os.Getenv("INDEXNOW_KEY") != "" || os.Getenv("SITEMAP_PING") != ""
+}
+
+// payload of the indexing job
+type indexingJob struct {
+	Base string   // url of the site
+	URLs []string // pages that changed
+}
+
+// announceQuestion queues the notification of search engines about a new or changed question
+func announceQuestion(ctx context.Context, r *http.Request, id int) error {
+	if !indexingEnabled() {
+		return nil
+	}
+	// the questions of courses aren't public
+	var courseID sql.NullInt64
+	if err := db.QueryRowContext(ctx, "select course_id from questions where id = ?", id).Scan(&courseID); err != nil {
+		return err
+	}
+	if courseID.Valid {
+		return nil
+	}
+	base := baseURL(r)
+	return enqueueJob(ctx, "indexing", indexingJob{Base: base, URLs: []string{fmt.Sprintf("%s/questions/%d", base, id)}})
+}
+
+// substantialEdit tells if an edit changes a question enough for search engines to look at it again:
+// a new heading, or a body with at least a tenth of it rewritten
+func substantialEdit(oldHeading, oldBody, heading, body string) bool {
+	if oldHeading != heading {
+		return true
+	}
+	// the changed part is what is left once the common start and end are removed
+	prefix := 0
+	for prefix < len(oldBody) && prefix < len(body) && oldBody[prefix] == body[prefix] {
+		prefix++
+	}
+	suffix := 0
+	for suffix < len(oldBody)-prefix && suffix < len(body)-prefix && oldBody[len(oldBody)-1-suffix] == body[len(body)-1-suffix] {
+		suffix++
+	}
+	changed := len(body) - prefix - suffix
+	if removed := len(oldBody) - prefix - suffix; removed > changed {
+		changed = removed
+	}
+	return changed*10 >= len(oldBody)
+}
+
+func sendIndexingJob(ctx context.Context, payload []byte) error {
+	var job indexingJob
+	if err := json.Unmarshal(payload, &job); err != nil {
+		return err
+	}
+	if key := os.Getenv("INDEXNOW_KEY"); key != "" {
+		if err := sendIndexNow(ctx, key, job); err != nil {
+			return err
+		}
+	}
+	for _, ping := range strings.Split(os.Getenv("SITEMAP_PING"), ",") {
+		if ping = strings.TrimSpace(ping); ping == "" {
+			continue
+		}
+		if err := indexingRequest(ctx, http.MethodGet, ping+url.QueryEscape(job.Base+"/sitemap.xml"), nil); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// sendIndexNow submits the urls of the job, see indexnow.org
+func sendIndexNow(ctx context.Context, key string, job indexingJob) error {
+	endpoint := os.Getenv("INDEXNOW_ENDPOINT")
+	if endpoint == "" {
+		endpoint = defaultIndexNowEndpoint
+	}
+	u, err := url.Parse(job.Base)
+	if err != nil {
+		return err
+	}
+	body, err := json.Marshal(map[string]interface{}{
+		"host":        u.Host,
+		"key":         key,
+		"keyLocation": job.Base + "/indexnow.txt",
+		"urlList":     job.URLs,
+	})
+	if err != nil {
+		return err
+	}
+	return indexingRequest(ctx, http.MethodPost, endpoint, body)
+}
+
+// indexingRequest calls a search engine, failing when it doesn't accept the request
+func indexingRequest(ctx context.Context, method, target string, body []byte) error {
+	req, err := http.NewRequestWithContext(ctx, method, target, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json; charset=utf-8")
+	}
+	resp, err := indexingClient.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("%s %s: %s", method, target, resp.Status)
+	}
+	return nil
+}
+
+// serve /indexnow.txt, which proves to IndexNow that the key belongs to the site
+func serveIndexNowKey(w http.ResponseWriter, r *http.Request) {
+	key := os.Getenv("INDEXNOW_KEY")
+	if key == "" {
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	fmt.Fprint(w, key)
+}
+
+// sitemap document, see sitemaps.org
+type sitemapURLSet struct {
+	XMLName xml.Name     `xml:"http://www.sitemaps.org/schemas/sitemap/0.9 urlset"`
+	URLs    []sitemapURL `xml:"url"`
+}
+
+type sitemapURL struct {
+	Loc     string `xml:"loc"`
+	LastMod string `xml:"lastmod,omitempty"`
+}
+
+// serve /sitemap.xml, the questions with the date they last changed
+func serveSitemap(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	filter, args, err := questionFilter(ctx, nil)
+	if err != nil {
+		serverError(w, r, err)
+		return
+	}
+	rows, err := db.QueryContext(ctx, "select id, coalesce(substr(edited_at, 1, 10), date, '') from questions where "+filter+" order by id desc limit ?",
+		append(args, sitemapSize)...)
+	if err != nil {
+		serverError(w, r, err)
+		return
+	}
+	defer rows.Close()
+	base := baseURL(r)
+	var set sitemapURLSet
+	for rows.Next() {
+		var id int
+		var u sitemapURL
+		if err := rows.Scan(&id, &u.LastMod); err != nil {
+			serverError(w, r, err)
+			return
+		}
+		u.Loc = fmt.Sprintf("%s/questions/%d", base, id)
+		set.URLs = append(set.URLs, u)
+	}
+	if err := rows.Err(); err != nil {
+		serverError(w, r, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/xml; charset=utf-8")
+	fmt.Fprint(w, xml.Header)
+	if err := xml.NewEncoder(w).Encode(set); err != nil {
+		fmt.Println(err)
+	}
+}
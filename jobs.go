@@ -0,0 +1,117 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+// how often the worker looks for due jobs when it isn't woken up
+const jobPollInterval = 10 * time.Second
+
+// a failing job is retried until it has been attempted this many times
+const maxJobAttempts = 5
+
+// jobHandler runs a job from its JSON payload
+type jobHandler func(ctx context.Context, payload []byte) error
+
+// handlers of the kinds of job, by kind
+var jobHandlers = map[string]jobHandler{}
+
+// wakes the worker up when a job is enqueued
+var jobSignal = make(chan struct{}, 1)
+
+// enqueueJob stores a job to be run in the background by the worker
+func enqueueJob(ctx context.Context, kind string, payload interface{}) error {
+	return enqueueJobAt(ctx, kind, payload, time.Now())
+}
+
+// enqueueJobAt stores a job to be run in the background once runAt is reached
+func enqueueJobAt(ctx context.Context, kind string, payload interface{}, runAt time.Time) error {
+	if _, ok := jobHandlers[kind]; !ok {
+		return fmt.Errorf("unknown job kind %q", kind)
+	}
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	_, err = db.ExecContext(ctx, "insert into jobs (kind, payload, run_at, attempts) values (?, ?, ?, 0)",
+		kind, string(data), runAt.Format(timestampLayout))
+	if err != nil {
+		return err
+	}
+	// the worker only sees the job once its transaction commits
+	db.AfterCommit(ctx, func() {
+		select {
+		case jobSignal <- struct{}{}:
+		default:
+		}
+	})
+	return nil
+}
+
+type job struct {
+	id       int
+	kind     string
+	payload  string
+	attempts int
+}
+
+// run the jobs that are due, retrying failed ones later with an exponential backoff
+func runJobs(ctx context.Context) {
+	now := time.Now()
+	rows, err := db.QueryContext(ctx, `select id, kind, payload, attempts from jobs
+		where done_at is null and attempts < ? and run_at <= ? order by run_at, id limit 20`,
+		maxJobAttempts, now.Format(timestampLayout))
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	var due []job
+	for rows.Next() {
+		var j job
+		if err := rows.Scan(&j.id, &j.kind, &j.payload, &j.attempts); err != nil {
+			fmt.Println(err)
+			break
+		}
+		due = append(due, j)
+	}
+	rows.Close()
+
+	for _, j := range due {
+		handler, ok := jobHandlers[j.kind]
+		if !ok {
+			err = fmt.Errorf("unknown job kind %q", j.kind)
+		} else {
+			err = handler(ctx, []byte(j.payload))
+		}
+		if err == nil {
+			_, err = db.ExecContext(ctx, "update jobs set done_at = ?, attempts = attempts + 1 where id = ?", time.Now().Format(timestampLayout), j.id)
+			if err != nil {
+				fmt.Println(err)
+			}
+			continue
+		}
+		fmt.Printf("job %d (%s) failed: %v\n", j.id, j.kind, err)
+		retry := time.Now().Add(time.Duration(1<<j.attempts) * 30 * time.Second)
+		_, err = db.ExecContext(ctx, "update jobs set attempts = attempts + 1, last_error = ?, run_at = ? where id = ?",
+			err.Error(), retry.Format(timestampLayout), j.id)
+		if err != nil {
+			fmt.Println(err)
+		}
+	}
+}
+
+// startWorker runs the jobs in the background, one at a time
+func startWorker(ctx context.Context) {
+	go func() {
+		for {
+			runJobs(ctx)
+			select {
+			case <-jobSignal:
+			case <-time.After(jobPollInterval):
+			}
+		}
+	}()
+}
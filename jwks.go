@@ -0,0 +1,178 @@
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// the identity providers and learning platforms the app trusts sign their tokens, JWTs, with RSA
+// keys they publish as a JSON Web Key Set. The keys are fetched from the URL of the set and kept
+// for an hour; a token signed by a key not seen yet, after a rotation, fetches the set again
+
+// how long fetched keys are kept, and the least time between two fetches of a set
+const (
+	jwksTTL         = time.Hour
+	jwksMinInterval = time.Minute
+)
+
+var jwksClient = &http.Client{Timeout: 10 * time.Second}
+
+var errBadToken = errors.New("the token isn't valid")
+
+// keySets are the fetched key sets, by URL
+var keySets = struct {
+	sync.Mutex
+	sets map[string]*keySet
+}{sets: map[string]*keySet{}}
+
+// keySet are the RSA keys of a set, by id
+type keySet struct {
+	keys    map[string]*rsa.PublicKey
+	fetched time.Time
+}
+
+// fetchKeySet downloads the RSA keys of a key set
+func fetchKeySet(ctx context.Context, url string) (*keySet, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := jwksClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s: %s", url, resp.Status)
+	}
+	var set struct {
+		Keys []struct {
+			Kty string `json:"kty"`
+			Kid string `json:"kid"`
+			N   string `json:"n"`
+			E   string `json:"e"`
+		} `json:"keys"`
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(&set); err != nil {
+		return nil, fmt.Errorf("%s: %v", url, err)
+	}
+	ks := &keySet{keys: map[string]*rsa.PublicKey{}, fetched: time.Now()}
+	for _, k := range set.Keys {
+		if k.Kty != "RSA" {
+			continue
+		}
+		n, err1 := base64.RawURLEncoding.DecodeString(k.N)
+		e, err2 := base64.RawURLEncoding.DecodeString(k.E)
+		if err1 != nil || err2 != nil || len(e) > 4 {
+			continue
+		}
+		ks.keys[k.Kid] = &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}
+	}
+	return ks, nil
+}
+
+// publicKey finds the key of the id in the set of the URL, nil if the set has no such key
+func publicKey(ctx context.Context, url, kid string) (*rsa.PublicKey, error) {
+	keySets.Lock()
+	ks := keySets.sets[url]
+	keySets.Unlock()
+	if ks != nil && time.Since(ks.fetched) < jwksTTL {
+		if key := ks.keys[kid]; key != nil || time.Since(ks.fetched) < jwksMinInterval {
+			return key, nil
+		}
+	}
+	ks, err := fetchKeySet(ctx, url)
+	if err != nil {
+		return nil, err
+	}
+	keySets.Lock()
+	keySets.sets[url] = ks
+	keySets.Unlock()
+	return ks.keys[kid], nil
+}
+
+// verifyJWT checks the RS256 signature of the token with the key set of the URL, and decodes its
+// claims. The claims themselves, like the issuer and the expiry, are for the caller to check
+func verifyJWT(ctx context.Context, token, keySetURL string, claims interface{}) error {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return errBadToken
+	}
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	b, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil || json.Unmarshal(b, &header) != nil {
+		return errBadToken
+	}
+	// the algorithm is fixed, never taken from the token
+	if header.Alg != "RS256" {
+		return fmt.Errorf("tokens signed with %q aren't accepted", header.Alg)
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return errBadToken
+	}
+	key, err := publicKey(ctx, keySetURL, header.Kid)
+	if err != nil {
+		return err
+	}
+	if key == nil {
+		return fmt.Errorf("the token is signed with an unknown key %q", header.Kid)
+	}
+	hash := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	if err := rsa.VerifyPKCS1v15(key, crypto.SHA256, hash[:], signature); err != nil {
+		return errBadToken
+	}
+	if b, err = base64.RawURLEncoding.DecodeString(parts[1]); err != nil {
+		return errBadToken
+	}
+	if err := json.Unmarshal(b, claims); err != nil {
+		return errBadToken
+	}
+	return nil
+}
+
+// audience is the aud claim of a token, a string or a list of them
+type audience []string
+
+func (a *audience) UnmarshalJSON(b []byte) error {
+	var one string
+	if err := json.Unmarshal(b, &one); err == nil {
+		*a = audience{one}
+		return nil
+	}
+	return json.Unmarshal(b, (*[]string)(a))
+}
+
+// contains tells if the audience includes the client
+func (a audience) contains(client string) bool {
+	for _, aud := range a {
+		if aud == client {
+			return true
+		}
+	}
+	return false
+}
+
+// leeway for the clocks of the issuers of tokens
+const tokenLeeway = time.Minute
+
+// tokenTimely tells if a token issued and expiring at these Unix times can be used now
+func tokenTimely(issued, expires int64) bool {
+	now := time.Now()
+	return expires != 0 && now.Before(time.Unix(expires, 0).Add(tokenLeeway)) && now.After(time.Unix(issued, 0).Add(-tokenLeeway))
+}
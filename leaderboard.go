@@ -0,0 +1,118 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"time"
+)
+
+// the leaderboard ranks users by what they earned in a window of time: reputation from votes and
+// bounties, accepted answers and answers given. It is summed from the same tables as reputation,
+// using the indexes on the dates of votes, answers and accepts
+
+// most users on the leaderboard
+const leaderboardSize = 50
+
+// windows of the leaderboard, by name. The zero duration is all time
+var leaderboardWindows = map[string]time.Duration{
+	"week":  7 * 24 * time.Hour,
+	"month": 30 * 24 * time.Hour,
+	"all":   0,
+}
+
+// columns the leaderboard can be sorted by, by name
+var leaderboardSorts = map[string]string{
+	"reputation": "points",
+	"accepted":   "accepted",
+	"answers":    "answered",
+}
+
+// leader is a user on the leaderboard
+type leader struct {
+	Rank       int
+	User       string
+	Reputation int // reputation earned in the window
+	Accepted   int // answers accepted in the window
+	Answers    int // answers given in the window
+}
+
+// leaderboardPage is the data of the leaderboard page
+type leaderboardPage struct {
+	Window  string
+	Sort    string
+	Leaders []leader
+}
+
+// leaderboard ranks the users by the column, counting what happened since then. A zero since counts everything
+func leaderboard(ctx context.Context, column string, since time.Time) ([]leader, error) {
+	var from, day string
+	if !since.IsZero() {
+		from, day = since.Format(timestampLayout), since.Format(dateLayout)
+	}
+	rows, err := db.QueryContext(ctx, `with events (user, points, accepted, answered) as (
+			select questions.user, case when votes.value > 0 then cast(? as integer) else cast(? as integer) end, 0, 0 from votes
+				join questions on votes.post_type = 'question' and votes.post_id = questions.id where votes.voted_at >= ?
+			union all
+			select answers.user, case when votes.value > 0 then cast(? as integer) else cast(? as integer) end, 0, 0 from votes
+				join answers on votes.post_type = 'answer' and votes.post_id = answers.id where votes.voted_at >= ?
+			union all
+			select users.username, bounties.amount, 0, 0 from bounties
+				join users on users.id = bounties.awarded_to where bounties.closed_at >= ?
+			union all
+			select users.username, -bounties.amount, 0, 0 from bounties
+				join users on users.id = bounties.user_id where bounties.created_at >= ?
+			union all
+			select answers.user, 0, 1, 0 from questions
+				join answers on answers.id = questions.accepted_id where questions.accepted_at >= ?
+			union all
+			select answers.user, 0, 0, 1 from answers where answers.date >= ? and answers.hidden_at is null
+		)
+		select users.username, sum(points), sum(accepted), sum(answered) from events
+		join users on users.username = events.user
+		group by users.username having sum(points) != 0 or sum(accepted) > 0 or sum(answered) > 0
+		order by sum(`+column+`) desc, users.username limit ?`,
+		questionUpPoints, downVotePoints, from,
+		answerUpPoints, downVotePoints, from,
+		from, from, from, day, leaderboardSize)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var leaders []leader
+	for rows.Next() {
+		l := leader{Rank: len(leaders) + 1}
+		if err := rows.Scan(&l.User, &l.Reputation, &l.Accepted, &l.Answers); err != nil {
+			return nil, err
+		}
+		// all time, the reputation is the one on profiles
+		if since.IsZero() {
+			l.Reputation += baseReputation
+		}
+		leaders = append(leaders, l)
+	}
+	return leaders, rows.Err()
+}
+
+// serve /leaderboard?window={week,month,all}&sort={reputation,accepted,answers}
+func serveLeaderboard(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	p := leaderboardPage{Window: r.FormValue("window"), Sort: r.FormValue("sort")}
+	window, ok := leaderboardWindows[p.Window]
+	if !ok {
+		p.Window, window = "week", leaderboardWindows["week"]
+	}
+	column, ok := leaderboardSorts[p.Sort]
+	if !ok {
+		p.Sort, column = "reputation", leaderboardSorts["reputation"]
+	}
+	var since time.Time
+	if window > 0 {
+		since = time.Now().Add(-window)
+	}
+	var err error
+	if p.Leaders, err = leaderboard(ctx, column, since); err != nil {
+		serverError(w, r, err)
+		return
+	}
+	render(w, r, "leaderboard.html", p)
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// the migrations converting the comma separated columns of the first versions of the app drop
+// the entries they can't carry: voters, badges and questions that don't exist, authors voting on
+// their own posts, answers listed under a question that doesn't exist. Before the migration
+// dropping a column, or the table, those entries are listed on the standard output, one line each.
+// `qaapp migrate -dry-run` runs the pending migrations in a transaction rolled back at the end,
+// listing what they would drop without writing
+
+// legacyDrops are the queries listing the entries lost by a migration, by migration. Each selects
+// a line of text per entry
+var legacyDrops = map[string][]string{
+	"alter table questions drop column answers": {
+		splitList("questions", "answers") + `
+		select 'question ' || split.id || ': answer ' || quote(split.item) || ', there is no such answer'
+			from split where split.item != '' and split.item not in (select cast(id as text) from answers)`,
+	},
+	"alter table questions drop column votes": {legacyVotesDropped("questions", "question")},
+	// the votes of answers go with the old table
+	"drop table answers": {
+		legacyVotesDropped("answers", "answer"),
+		`select 'answer ' || id || ': question ' || quote(qn) || ', there is no such question, the answer is kept without one'
+			from answers where coalesce(qn, 0) != 0 and qn not in (select id from questions)`,
+	},
+	"drop table votes": {
+		`select post_type || ' ' || post_id || ': vote of user ' || user_id || ', there is no such user'
+			from votes where user_id not in (select id from users)`,
+	},
+	"alter table badges drop column users": {
+		splitList("badges", "users") + `
+		select 'badge ' || split.id || ': user ' || quote(split.item) || ', there is no such user'
+			from split where split.item != '' and lower(split.item) not in (select lower(username) from users)`,
+	},
+	"alter table users drop column badges": {
+		splitList("users", "badges") + `
+		select 'user ' || split.id || ': badge ' || quote(split.item) || ', there is no such badge'
+			from split where split.item != '' and lower(split.item) not in (select lower(name) from badges)`,
+	},
+	"alter table users drop column mod_questions": {
+		splitList("users", "mod_questions") + `
+		select 'user ' || split.id || ': moderated question ' || quote(split.item) || ', there is no such question'
+			from split where split.item != '' and split.item not in (select cast(id as text) from questions)`,
+	},
+}
+
+// legacyVotesDropped lists the entries of the votes column of the posts that name no user, or their author
+func legacyVotesDropped(table, postType string) string {
+	return splitList(table, "votes") + `
+		select '` + postType + ` ' || split.id || ': vote ' || quote(split.item) || case when users.id is null
+			then ', there is no such user' else ', the author can''t vote on their post' end
+		from split left join users on lower(users.username) = lower(trim(ltrim(split.item, '+-')))
+		where split.item != '' and (users.id is null or lower(users.username) is (select lower(user) from ` + table + ` where ` + table + `.id = split.id))`
+}
+
+// reportLegacyDrops writes the entries the migration drops, in the transaction of the context about to run it
+func reportLegacyDrops(ctx context.Context, version int, out io.Writer) error {
+	migration, err := db.backend.migration(version)
+	if err != nil {
+		return err
+	}
+	for _, query := range legacyDrops[migration] {
+		rows, err := db.queryOnce(ctx, query)
+		if err != nil {
+			return err
+		}
+		for rows.Next() {
+			var line string
+			if err := rows.Scan(&line); err != nil {
+				rows.Close()
+				return err
+			}
+			fmt.Fprintf(out, "migration %d drops %s\n", version+1, line)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// errDryRun rolls the transaction of a dry run back
+var errDryRun = errors.New("dry run")
+
+// dryRunMigrations runs the tables and the pending migrations in a transaction rolled back at the
+// end, writing what the migrations would drop. It returns the version the database would reach
+func dryRunMigrations(ctx context.Context, out io.Writer) (int, error) {
+	if !db.backend.transactionalDDL() {
+		return 0, fmt.Errorf("%s can't roll the changes of the schema back, there is no dry run on it", db.backend.name())
+	}
+	var version int
+	err := db.WithTx(unbounded(ctx), func(ctx context.Context) error {
+		for _, stmt := range db.backend.schema() {
+			if _, err := db.execOnce(ctx, stmt); err != nil {
+				return err
+			}
+		}
+		var err error
+		if version, err = db.schemaVersion(ctx); err != nil {
+			return err
+		}
+		for ; version < len(migrations); version++ {
+			if err := reportLegacyDrops(ctx, version, out); err != nil {
+				return err
+			}
+			migration, err := db.backend.migration(version)
+			if err != nil {
+				return err
+			}
+			if _, err := db.execOnce(ctx, migration); err != nil {
+				return fmt.Errorf("migration %d: %w", version+1, err)
+			}
+		}
+		return errDryRun
+	})
+	if err == errDryRun {
+		err = nil
+	}
+	return version, err
+}
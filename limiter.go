@@ -0,0 +1,106 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"path"
+	"strconv"
+	"time"
+
+	"learning-qa/middleware"
+)
+
+// routeLimiter bounds how many requests of a group of expensive routes run at once,
+// so a traffic spike can't pile up work on the single sqlite writer.
+// requests over the limit wait briefly for a slot, then are shed with 503
+type routeLimiter struct {
+	name       string
+	slots      chan struct{}
+	wait       time.Duration // how long a request waits for a slot
+	retryAfter time.Duration // sent to shed clients in the Retry-After header
+}
+
+func newRouteLimiter(name string, inFlight int, wait, retryAfter time.Duration) *routeLimiter {
+	return &routeLimiter{
+		name:       name,
+		slots:      make(chan struct{}, inFlight),
+		wait:       wait,
+		retryAfter: retryAfter,
+	}
+}
+
+// limiters of the expensive routes
+var (
+	searchLimiter    = newRouteLimiter("search", 4, 2*time.Second, 5*time.Second)
+	feedLimiter      = newRouteLimiter("feeds", 2, 2*time.Second, 30*time.Second)
+	exportLimiter    = newRouteLimiter("exports", 2, 5*time.Second, time.Minute)
+	analyticsLimiter = newRouteLimiter("analytics", 2, 2*time.Second, 10*time.Second)
+)
+
+// routeLimit puts the paths matching the pattern, in the syntax of path.Match, under the limiter
+type routeLimit struct {
+	pattern string
+	limiter *routeLimiter
+}
+
+// limiters of the routes, the first pattern matching the path applies
+var routeLimits = []routeLimit{
+	{"/api/v1/questions/similar", searchLimiter},
+	{"/api/v1/quickfind", searchLimiter},
+	{"/api/quickfind", searchLimiter},
+	{"/search", searchLimiter},
+	{"/graphql", searchLimiter},
+	{"/feed.xml", feedLimiter},
+	{"/tags/*/feed.xml", feedLimiter},
+	{"/calendar.ics", feedLimiter},
+	{"/sitemap.xml", feedLimiter},
+	{"/admin/export", exportLimiter},
+	{"/admin/audit.csv", exportLimiter},
+	{"/settings/account/export", exportLimiter},
+	{"/dashboard/participation.csv", exportLimiter},
+	{"/dashboard", analyticsLimiter},
+}
+
+// limiterFor returns the limiter of the path, nil if it has none
+func limiterFor(limits []routeLimit, urlPath string) *routeLimiter {
+	for _, l := range limits {
+		if ok, _ := path.Match(l.pattern, urlPath); ok {
+			return l.limiter
+		}
+	}
+	return nil
+}
+
+// limitRoutes runs the requests of the routes with a limiter under it
+func limitRoutes(limits []routeLimit) middleware.Middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if l := limiterFor(limits, r.URL.Path); l != nil {
+				l.wrap(next.ServeHTTP)(w, r)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// wrap makes the handler run under the limiter
+func (l *routeLimiter) wrap(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		timer := time.NewTimer(l.wait)
+		defer timer.Stop()
+		select {
+		case l.slots <- struct{}{}:
+		case <-timer.C:
+			fmt.Printf("shedding %s request %s: %d in flight\n", l.name, r.URL.Path, cap(l.slots))
+			w.Header().Set("Retry-After", strconv.Itoa(int(l.retryAfter.Seconds())))
+			http.Error(w, "The server is busy, please try again in a moment", http.StatusServiceUnavailable)
+			return
+		case <-r.Context().Done():
+			// the client went away while waiting
+			return
+		}
+		defer func() { <-l.slots }()
+		next(w, r)
+	}
+}
@@ -0,0 +1,29 @@
+package main
+
+import "testing"
+
+func TestLimiterFor(t *testing.T) {
+	tests := []struct {
+		path string
+		want *routeLimiter
+	}{
+		{"/search", searchLimiter},
+		{"/feed.xml", feedLimiter},
+		{"/tags/go/feed.xml", feedLimiter},
+		{"/tags/c#/feed.xml", feedLimiter},
+		{"/tags/go", nil},
+		{"/tags/go/follow", nil},
+		{"/admin/export", exportLimiter},
+		{"/admin/audit.csv", exportLimiter},
+		{"/admin/audit", nil},
+		{"/settings/account/export", exportLimiter},
+		{"/dashboard", analyticsLimiter},
+		{"/dashboard/participation.csv", exportLimiter},
+		{"/questions", nil},
+	}
+	for _, tt := range tests {
+		if got := limiterFor(routeLimits, tt.path); got != tt.want {
+			t.Errorf("limiterFor(%q) = %v, want %v", tt.path, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,466 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// the app is an LTI 1.3 tool, launched from learning platforms like Moodle or Canvas. Super-users
+// register each platform on /admin/lti with the issuer, client id and endpoints the platform
+// gives. A launch starts on /lti/login, the OIDC login initiation: the app sends the browser to
+// the platform with a state and a nonce. The platform posts back a signed id token to /lti/launch,
+// checked against its key set. The LMS user gets an account the first time, a teacher when the
+// platform says they are an instructor, and the LMS course becomes a course of the app, which
+// they join. Only resource link launches are supported, not deep linking or the LTI services.
+// Browsers block cookies in the iframes of other sites, so platforms launch the tool in a new window
+
+// how long a launch can take between the login initiation and the id token
+const ltiStateTTL = 10 * time.Minute
+
+// cookie of the state of a launch, tying it to the browser that started it. The platform posts the
+// launch from its own site, so the cookie goes cross-site
+const ltiCookie = "lti_state"
+
+// claims of the LTI specification
+const (
+	ltiClaim            = "https://purl.imsglobal.org/spec/lti/claim/"
+	ltiRoleInstructor   = "http://purl.imsglobal.org/vocab/lis/v2/membership#Instructor"
+	ltiRoleAdmin        = "http://purl.imsglobal.org/vocab/lis/v2/institution/person#Administrator"
+	ltiRoleTA           = "http://purl.imsglobal.org/vocab/lis/v2/membership/Instructor#TeachingAssistant"
+	ltiResourceLink     = "LtiResourceLinkRequest"
+	ltiSupportedVersion = "1.3.0"
+)
+
+// ltiPlatform is a learning platform the app is registered in
+type ltiPlatform struct {
+	ID           int
+	Name         string
+	Issuer       string
+	ClientID     string
+	DeploymentID string // empty to accept all the deployments of the client
+	AuthURL      string // the OIDC authorization endpoint of the platform
+	KeySetURL    string
+}
+
+// ltiClaims are the claims of a launch
+type ltiClaims struct {
+	Issuer          string   `json:"iss"`
+	Subject         string   `json:"sub"`
+	Audience        audience `json:"aud"`
+	AuthorizedParty string   `json:"azp"`
+	Expires         int64    `json:"exp"`
+	IssuedAt        int64    `json:"iat"`
+	Nonce           string   `json:"nonce"`
+	Name            string   `json:"name"`
+	GivenName       string   `json:"given_name"`
+	FamilyName      string   `json:"family_name"`
+	Email           string   `json:"email"`
+	MessageType     string   `json:"https://purl.imsglobal.org/spec/lti/claim/message_type"`
+	Version         string   `json:"https://purl.imsglobal.org/spec/lti/claim/version"`
+	DeploymentID    string   `json:"https://purl.imsglobal.org/spec/lti/claim/deployment_id"`
+	TargetLinkURI   string   `json:"https://purl.imsglobal.org/spec/lti/claim/target_link_uri"`
+	Roles           []string `json:"https://purl.imsglobal.org/spec/lti/claim/roles"`
+	Context         *struct {
+		ID    string `json:"id"`
+		Label string `json:"label"`
+		Title string `json:"title"`
+	} `json:"https://purl.imsglobal.org/spec/lti/claim/context"`
+}
+
+// instructor tells if the roles of the launch make the user a teacher
+func (c *ltiClaims) instructor() bool {
+	for _, role := range c.Roles {
+		if role == ltiRoleInstructor || role == ltiRoleAdmin || role == ltiRoleTA {
+			return true
+		}
+	}
+	return false
+}
+
+// check checks the claims of a launch on the platform, with the nonce of its login initiation
+func (c *ltiClaims) check(p *ltiPlatform, nonce string) error {
+	switch {
+	case c.Issuer != p.Issuer || !c.Audience.contains(p.ClientID):
+		return fmt.Errorf("the token isn't for this tool")
+	case len(c.Audience) > 1 && c.AuthorizedParty != p.ClientID:
+		return fmt.Errorf("the token isn't for this tool")
+	case !tokenTimely(c.IssuedAt, c.Expires):
+		return fmt.Errorf("the token has expired")
+	case c.Nonce != nonce:
+		return fmt.Errorf("the token isn't of this launch")
+	case p.DeploymentID != "" && c.DeploymentID != p.DeploymentID:
+		return fmt.Errorf("the deployment %q isn't registered", c.DeploymentID)
+	case c.Version != ltiSupportedVersion:
+		return fmt.Errorf("LTI %s isn't supported", c.Version)
+	case c.MessageType != ltiResourceLink:
+		return fmt.Errorf("%s messages aren't supported", c.MessageType)
+	case c.Subject == "":
+		return fmt.Errorf("launches take a user")
+	}
+	return nil
+}
+
+// ltiPlatformColumns are the columns scanned by scanPlatform
+const ltiPlatformColumns = "id, name, issuer, client_id, deployment_id, auth_url, keyset_url"
+
+// scanPlatform scans a platform
+func scanPlatform(row scanner) (ltiPlatform, error) {
+	var p ltiPlatform
+	err := row.Scan(&p.ID, &p.Name, &p.Issuer, &p.ClientID, &p.DeploymentID, &p.AuthURL, &p.KeySetURL)
+	return p, err
+}
+
+// ltiPlatformOf finds the platform of an issuer and a client, nil if there is none. Without a
+// client id, the issuer must only have one
+func ltiPlatformOf(ctx context.Context, issuer, clientID string) (*ltiPlatform, error) {
+	var platforms []ltiPlatform
+	err := queryList(ctx, "select "+ltiPlatformColumns+" from lti_platforms where issuer = ? and (client_id = ? or ? = '')",
+		[]interface{}{issuer, clientID, clientID}, func(rows *sql.Rows) error {
+			p, err := scanPlatform(rows)
+			platforms = append(platforms, p)
+			return err
+		})
+	if err != nil || len(platforms) != 1 {
+		return nil, err
+	}
+	return &platforms[0], nil
+}
+
+// serve /lti/login, where platforms start a launch: the browser is sent to the platform to
+// authenticate, and comes back to /lti/launch
+func serveLTILogin(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	platform, err := ltiPlatformOf(ctx, r.FormValue("iss"), r.FormValue("client_id"))
+	if err != nil {
+		serverError(w, r, err)
+		return
+	}
+	if platform == nil {
+		http.Error(w, "this platform isn't registered, or more than one of its clients are", http.StatusBadRequest)
+		return
+	}
+	if r.FormValue("login_hint") == "" {
+		http.Error(w, "the login hint is missing", http.StatusBadRequest)
+		return
+	}
+	state, nonce := newToken(), newToken()
+	now := time.Now()
+	err = db.WithTx(ctx, func(ctx context.Context) error {
+		if _, err := db.ExecContext(ctx, "delete from lti_states where created_at < ?", now.Add(-ltiStateTTL).Format(timestampLayout)); err != nil {
+			return err
+		}
+		_, err := db.ExecContext(ctx, "insert into lti_states (state, nonce, platform_id, created_at) values (?, ?, ?, ?)",
+			state, nonce, platform.ID, now.Format(timestampLayout))
+		return err
+	})
+	if err != nil {
+		serverError(w, r, err)
+		return
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     ltiCookie,
+		Value:    state,
+		Path:     "/lti/",
+		MaxAge:   int(ltiStateTTL / time.Second),
+		HttpOnly: true,
+		Secure:   true,
+		SameSite: http.SameSiteNoneMode,
+	})
+	query := url.Values{
+		"scope":         {"openid"},
+		"response_type": {"id_token"},
+		"response_mode": {"form_post"},
+		"prompt":        {"none"},
+		"client_id":     {platform.ClientID},
+		"redirect_uri":  {siteURL() + "/lti/launch"},
+		"login_hint":    {r.FormValue("login_hint")},
+		"state":         {state},
+		"nonce":         {nonce},
+	}
+	if hint := r.FormValue("lti_message_hint"); hint != "" {
+		query.Set("lti_message_hint", hint)
+	}
+	http.Redirect(w, r, platform.AuthURL+"?"+query.Encode(), http.StatusFound)
+}
+
+// serve /lti/launch, where the platform posts the id token of a launch. The user is logged in,
+// provisioned the first time, and sent to the course of the launch
+func serveLTILaunch(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if e := r.FormValue("error"); e != "" {
+		http.Error(w, "the platform refused the launch: "+e+" "+r.FormValue("error_description"), http.StatusBadRequest)
+		return
+	}
+	// a launch posted to another browser than the one that started it would log that one in
+	state := r.FormValue("state")
+	if cookie, err := r.Cookie(ltiCookie); err != nil || cookie.Value != state {
+		http.Error(w, "this launch wasn't started in this browser, start it again from your course", http.StatusBadRequest)
+		return
+	}
+	http.SetCookie(w, &http.Cookie{Name: ltiCookie, Value: "", Path: "/lti/", MaxAge: -1, HttpOnly: true, Secure: true, SameSite: http.SameSiteNoneMode})
+	// each state is used once
+	var platformID int
+	var nonce string
+	err := db.WithTx(ctx, func(ctx context.Context) error {
+		err := db.QueryRowContext(ctx, "select platform_id, nonce from lti_states where state = ? and created_at > ?",
+			state, time.Now().Add(-ltiStateTTL).Format(timestampLayout)).Scan(&platformID, &nonce)
+		if err != nil {
+			return err
+		}
+		_, err = db.ExecContext(ctx, "delete from lti_states where state = ?", state)
+		return err
+	})
+	if err == sql.ErrNoRows {
+		http.Error(w, "this launch has expired, start it again from your course", http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		serverError(w, r, err)
+		return
+	}
+	platform, err := scanPlatform(db.QueryRowContext(ctx, "select "+ltiPlatformColumns+" from lti_platforms where id = ?", platformID))
+	if err != nil {
+		serverError(w, r, err)
+		return
+	}
+	var claims ltiClaims
+	if err := verifyJWT(ctx, r.FormValue("id_token"), platform.KeySetURL, &claims); err != nil {
+		fmt.Println("lti launch:", platform.Issuer, err)
+		http.Error(w, "the launch couldn't be verified: "+err.Error(), http.StatusUnauthorized)
+		return
+	}
+	if err := claims.check(&platform, nonce); err != nil {
+		http.Error(w, "the launch couldn't be verified: "+err.Error(), http.StatusUnauthorized)
+		return
+	}
+	userID, err := ltiUser(ctx, &platform, &claims)
+	if err != nil {
+		serverError(w, r, err)
+		return
+	}
+	target := "/courses"
+	if claims.Context != nil && claims.Context.ID != "" {
+		courseID, err := ltiCourse(ctx, &platform, &claims, userID)
+		if err != nil {
+			serverError(w, r, err)
+			return
+		}
+		target = "/courses/" + strconv.Itoa(courseID)
+	}
+	if err := startSession(ctx, w, userID); err != nil {
+		serverError(w, r, err)
+		return
+	}
+	http.Redirect(w, r, target, http.StatusSeeOther)
+}
+
+// ltiUser finds the account of the user of a launch, made on their first launch. Instructors
+// become teachers, and stay so
+func ltiUser(ctx context.Context, p *ltiPlatform, c *ltiClaims) (int, error) {
+	var id int
+	err := db.QueryRowContext(ctx, "select user_id from lti_users where platform_id = ? and subject = ?", p.ID, c.Subject).Scan(&id)
+	if err == nil {
+		if c.instructor() {
+			_, err = db.ExecContext(ctx, "update users set user_type = 'teacher' where id = ? and user_type = 'student'", id)
+		}
+		return id, err
+	}
+	if err != sql.ErrNoRows {
+		return 0, err
+	}
+	role := "student"
+	if c.instructor() {
+		role = "teacher"
+	}
+	first, last := c.GivenName, c.FamilyName
+	if first == "" && last == "" {
+		first, last, _ = strings.Cut(c.Name, " ")
+	}
+	localPart, _, _ := strings.Cut(c.Email, "@")
+	return provisionUser(ctx, first, last, c.Email, role, []string{localPart, first + "." + last, first, "lti-user"},
+		"insert into lti_users (platform_id, subject, user_id) values (?, ?, ?)", p.ID, c.Subject)
+}
+
+// usernameCleaner drops what usernames can't have
+var usernameCleaner = regexp.MustCompile(`[^a-z0-9_.-]+`)
+
+// provisionUser creates an account on the first login through an external system, without a
+// password. It is named after the first free of the candidate usernames, numbered when they are
+// all taken. The link statement ties the external identity to the account, its arguments followed
+// by the id of the account
+func provisionUser(ctx context.Context, first, last, email, role string, candidates []string, link string, args ...interface{}) (int, error) {
+	if email != "" && !validEmail(email) {
+		email = ""
+	}
+	var names []string
+	for _, c := range candidates {
+		c = strings.Trim(usernameCleaner.ReplaceAllString(strings.ToLower(c), ""), ".-_")
+		if len(c) > 24 {
+			c = c[:24]
+		}
+		if len(c) >= 3 {
+			names = append(names, c)
+		}
+	}
+	names = append(names, "user")
+	name := ""
+	for i := 0; name == "" && i < 1000; i++ {
+		for _, candidate := range names {
+			if i > 0 {
+				candidate += strconv.Itoa(i + 1)
+			}
+			if validateUsername(ctx, candidate, 0) == nil {
+				name = candidate
+				break
+			}
+		}
+	}
+	if name == "" {
+		return 0, fmt.Errorf("no free username for %s %s", first, last)
+	}
+	var id int64
+	err := db.WithTx(ctx, func(ctx context.Context) error {
+		res, err := db.ExecContext(ctx, `insert into users (first_name, last_name, username, password, user_type, super_user, email)
+			values (?, ?, ?, '', ?, false, ?)`, first, last, name, role, email)
+		if err != nil {
+			return err
+		}
+		id, _ = res.LastInsertId()
+		if _, err := db.ExecContext(ctx, link, append(args, id)...); err != nil {
+			return err
+		}
+		return emitUserRegistered(ctx, int(id), name)
+	})
+	return int(id), err
+}
+
+// ltiCourse finds the course of the LMS course of a launch, made on its first launch, and makes
+// the user a member of it
+func ltiCourse(ctx context.Context, p *ltiPlatform, c *ltiClaims, userID int) (int, error) {
+	role := courseStudent
+	if c.instructor() {
+		role = courseTeacher
+	}
+	var id int64
+	err := db.WithTx(ctx, func(ctx context.Context) error {
+		now := time.Now().Format(timestampLayout)
+		err := db.QueryRowContext(ctx, "select course_id from lti_contexts where platform_id = ? and context_id = ?", p.ID, c.Context.ID).Scan(&id)
+		if err == sql.ErrNoRows {
+			name := c.Context.Title
+			if name == "" {
+				name = c.Context.Label
+			}
+			if name == "" {
+				name = p.Name
+			}
+			if len(name) > maxCourseName {
+				name = name[:maxCourseName]
+			}
+			// the course belongs to whoever launched it first
+			res, err := db.ExecContext(ctx, "insert into courses (name, code, user_id, created_at) values (?, ?, ?, ?)",
+				name, strings.ToUpper(newToken()[:8]), userID, now)
+			if err != nil {
+				return err
+			}
+			id, _ = res.LastInsertId()
+			_, err = db.ExecContext(ctx, "insert into lti_contexts (platform_id, context_id, course_id) values (?, ?, ?)", p.ID, c.Context.ID, id)
+			if err != nil {
+				return err
+			}
+		} else if err != nil {
+			return err
+		}
+		if _, err := db.ExecContext(ctx, "insert or ignore into course_members (course_id, user_id, role, joined_at) values (?, ?, ?, ?)",
+			id, userID, role, now); err != nil {
+			return err
+		}
+		if role == courseTeacher {
+			_, err = db.ExecContext(ctx, "update course_members set role = ? where course_id = ? and user_id = ?", courseTeacher, id, userID)
+		}
+		return err
+	})
+	return int(id), err
+}
+
+// ltiAdminPage is the data of the LTI admin page
+type ltiAdminPage struct {
+	Platforms []ltiPlatform
+	LoginURL  string
+	LaunchURL string
+	Form      ltiPlatform
+	Error     string
+}
+
+// serve /admin/lti, where super-users register the platforms the tool is launched from
+func serveLTIAdmin(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	if requireSuperUser(w, r) == nil {
+		return
+	}
+	p := ltiAdminPage{LoginURL: siteURL() + "/lti/login", LaunchURL: siteURL() + "/lti/launch"}
+	if r.Method == http.MethodPost {
+		switch r.FormValue("action") {
+		case "remove":
+			if _, err := db.ExecContext(ctx, "delete from lti_platforms where id = ?", r.FormValue("id")); err != nil {
+				serverError(w, r, err)
+				return
+			}
+			http.Redirect(w, r, "/admin/lti", http.StatusSeeOther)
+			return
+		case "add":
+			f := ltiPlatform{
+				Name:         strings.TrimSpace(r.FormValue("name")),
+				Issuer:       strings.TrimSpace(r.FormValue("issuer")),
+				ClientID:     strings.TrimSpace(r.FormValue("client_id")),
+				DeploymentID: strings.TrimSpace(r.FormValue("deployment_id")),
+				AuthURL:      strings.TrimSpace(r.FormValue("auth_url")),
+				KeySetURL:    strings.TrimSpace(r.FormValue("keyset_url")),
+			}
+			p.Form = f
+			switch {
+			case f.Name == "" || f.Issuer == "" || f.ClientID == "":
+				p.Error = "a platform has a name, an issuer and a client id"
+			case !httpsURL(f.AuthURL) || !httpsURL(f.KeySetURL):
+				p.Error = "the authentication and key set URLs are https URLs"
+			default:
+				_, err := db.ExecContext(ctx, `insert or ignore into lti_platforms (name, issuer, client_id, deployment_id, auth_url, keyset_url, created_at)
+					values (?, ?, ?, ?, ?, ?, ?)`, f.Name, f.Issuer, f.ClientID, f.DeploymentID, f.AuthURL, f.KeySetURL, time.Now().Format(timestampLayout))
+				if err != nil {
+					serverError(w, r, err)
+					return
+				}
+				http.Redirect(w, r, "/admin/lti", http.StatusSeeOther)
+				return
+			}
+		default:
+			http.Error(w, "Bad Request", http.StatusBadRequest)
+			return
+		}
+	}
+	if err := queryList(ctx, "select "+ltiPlatformColumns+" from lti_platforms order by name, id", nil, func(rows *sql.Rows) error {
+		platform, err := scanPlatform(rows)
+		p.Platforms = append(p.Platforms, platform)
+		return err
+	}); err != nil {
+		serverError(w, r, err)
+		return
+	}
+	render(w, r, "lti-admin.html", p)
+}
+
+// httpsURL tells if the address is an https URL, or http on the local host for development
+func httpsURL(address string) bool {
+	u, err := url.Parse(address)
+	return err == nil && u.Host != "" && (u.Scheme == "https" || (u.Scheme == "http" && u.Hostname() == "localhost"))
+}
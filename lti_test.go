@@ -0,0 +1,66 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+// TestLTILaunchState checks that a launch is only accepted in the browser that started its login,
+// so the id token of another's launch can't log a victim in
+func TestLTILaunchState(t *testing.T) {
+	srv := newTestServer(t)
+	handler := srv.Routes()
+	testExec(t, `insert into lti_platforms (name, issuer, client_id, auth_url, keyset_url, created_at)
+		values ('LMS', 'https://lms.example.com', 'qaapp', 'https://lms.example.com/auth', 'https://lms.example.com/keys', '2026-01-01 00:00:00')`)
+
+	req := httptest.NewRequest(http.MethodGet, "/lti/login?"+url.Values{
+		"iss": {"https://lms.example.com"}, "client_id": {"qaapp"}, "login_hint": {"42"},
+	}.Encode(), nil)
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	if rec.Code != http.StatusFound {
+		t.Fatalf("GET /lti/login: %d %s", rec.Code, rec.Body)
+	}
+	var cookie *http.Cookie
+	for _, c := range rec.Result().Cookies() {
+		if c.Name == ltiCookie {
+			cookie = c
+		}
+	}
+	if cookie == nil || !cookie.Secure || !cookie.HttpOnly || cookie.SameSite != http.SameSiteNoneMode {
+		t.Fatalf("the login sets no state cookie going cross-site: %+v", cookie)
+	}
+	location, err := url.Parse(rec.Header().Get("Location"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	state := location.Query().Get("state")
+	if state != cookie.Value {
+		t.Fatalf("the state %q sent to the platform isn't the one of the cookie %q", state, cookie.Value)
+	}
+
+	launch := func(c *http.Cookie) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/lti/launch", strings.NewReader(url.Values{
+			"state": {state}, "id_token": {"not.a.token"},
+		}.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		if c != nil {
+			req.AddCookie(c)
+		}
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		return rec
+	}
+	for _, c := range []*http.Cookie{nil, {Name: ltiCookie, Value: newToken()}} {
+		if rec := launch(c); rec.Code != http.StatusBadRequest || !strings.Contains(rec.Body.String(), "wasn't started in this browser") {
+			t.Errorf("launch with the cookie %v: %d %s", c, rec.Code, rec.Body)
+		}
+	}
+	// the browser that started the login gets past the state, to the check of the token
+	if rec := launch(cookie); rec.Code != http.StatusUnauthorized {
+		t.Errorf("launch with the state cookie: %d %s", rec.Code, rec.Body)
+	}
+}
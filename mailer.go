@@ -0,0 +1,180 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/mail"
+	"net/smtp"
+	"os"
+	"strings"
+	"time"
+)
+
+// emails are sent through the SMTP server configured in the environment:
+// SMTP_ADDR (host:port), SMTP_USER, SMTP_PASSWORD and SMTP_FROM.
+// without SMTP_ADDR, emails are only printed, which is enough for development
+
+func init() {
+	jobHandlers["email"] = sendEmailJob
+}
+
+// validEmail tells if the address is a plain email address
+func validEmail(address string) bool {
+	parsed, err := mail.ParseAddress(address)
+	return err == nil && parsed.Address == address
+}
+
+// payload of the email job
+type emailJob struct {
+	To      string
+	Subject string
+	Body    string
+}
+
+// queueEmail sends an email in the background, retried by the job worker when the server fails
+func queueEmail(ctx context.Context, to, subject, body string) error {
+	return enqueueJob(ctx, "email", emailJob{To: to, Subject: subject, Body: body})
+}
+
+func sendEmailJob(ctx context.Context, payload []byte) error {
+	var job emailJob
+	if err := json.Unmarshal(payload, &job); err != nil {
+		return err
+	}
+	// the address may have bounced since the email was queued
+	suppressed, err := suppressionOf(ctx, job.To)
+	if err != nil || suppressed != nil {
+		return err
+	}
+	err = sendEmail(ctx, job.To, job.Subject, job.Body)
+	if permanentFailure(err) {
+		return suppressEmail(ctx, job.To, suppressBounce, err.Error())
+	}
+	return err
+}
+
+// sendEmail sends a plain text email right away
+func sendEmail(ctx context.Context, to, subject, body string) error {
+	addr := os.Getenv("SMTP_ADDR")
+	from := os.Getenv("SMTP_FROM")
+	if from == "" {
+		from = "qaapp@localhost"
+	}
+	unsubscribe, err := unsubscribeURL(ctx, to)
+	if err != nil {
+		return err
+	}
+	// headers can't contain line breaks, or the subject could add its own headers
+	subject = strings.NewReplacer("\r", " ", "\n", " ").Replace(subject)
+	msg := "From: " + from + "\r\n" +
+		"To: " + to + "\r\n" +
+		"Subject: " + subject + "\r\n" +
+		"Date: " + time.Now().Format(time.RFC1123Z) + "\r\n" +
+		"List-Unsubscribe: <" + unsubscribe + ">\r\n" +
+		"List-Unsubscribe-Post: List-Unsubscribe=One-Click\r\n" +
+		"Content-Type: text/plain; charset=utf-8\r\n" +
+		"\r\n" + body
+
+	if addr == "" {
+		fmt.Printf("email to %s: %s\n%s\n", to, subject, body)
+		return nil
+	}
+	var auth smtp.Auth
+	if user := os.Getenv("SMTP_USER"); user != "" {
+		host := addr
+		if i := strings.LastIndex(addr, ":"); i >= 0 {
+			host = addr[:i]
+		}
+		auth = smtp.PlainAuth("", user, os.Getenv("SMTP_PASSWORD"), host)
+	}
+	return smtp.SendMail(addr, auth, from, []string{to}, []byte(msg))
+}
+
+// emailForm is the data of the email settings page
+type emailForm struct {
+	Email  string
+	Digest string // "", "daily" or "weekly"
+	Quiet  quietHours
+	Saved  bool
+	Error  string
+
+	Suppressed *emailSuppression // why emails to the address stopped, nil when they are sent
+}
+
+// serve /settings/email, where users set the address notifications are emailed to
+func serveEmailSettings(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	user := requireUser(w, r)
+	if user == nil {
+		return
+	}
+	form := emailForm{Email: user.Email}
+	if err := db.QueryRowContext(ctx, "select coalesce(digest, '') from users where id = ?", user.UniqueID).Scan(&form.Digest); err != nil {
+		serverError(w, r, err)
+		return
+	}
+	var err error
+	if form.Quiet, err = userQuietHours(ctx, user.UniqueID); err != nil {
+		serverError(w, r, err)
+		return
+	}
+	if form.Suppressed, err = suppressionOf(ctx, form.Email); err != nil {
+		serverError(w, r, err)
+		return
+	}
+	if r.Method != http.MethodPost {
+		render(w, r, "email.html", form)
+		return
+	}
+	form.Email = strings.TrimSpace(r.FormValue("email"))
+	form.Digest = r.FormValue("digest")
+	if _, ok := digestPeriods[form.Digest]; !ok {
+		form.Digest = ""
+	}
+	form.Quiet = quietHours{
+		Start: r.FormValue("quiet_start"),
+		End:   r.FormValue("quiet_end"),
+		Zone:  strings.TrimSpace(r.FormValue("timezone")),
+	}
+	if form.Email != "" && !validEmail(form.Email) {
+		form.Error = "the email address is not valid"
+		render(w, r, "email.html", form)
+		return
+	}
+	if form.Quiet.Start != "" || form.Quiet.End != "" {
+		_, err1 := time.Parse(quietLayout, form.Quiet.Start)
+		_, err2 := time.Parse(quietLayout, form.Quiet.End)
+		if err1 != nil || err2 != nil {
+			form.Error = "quiet hours need a start and an end"
+			render(w, r, "email.html", form)
+			return
+		}
+	}
+	if _, err := time.LoadLocation(form.Quiet.Zone); err != nil {
+		form.Error = "unknown time zone, use a name like Europe/Helsinki"
+		render(w, r, "email.html", form)
+		return
+	}
+	_, err = db.ExecContext(ctx, "update users set email = ?, digest = ?, quiet_start = ?, quiet_end = ?, timezone = ? where id = ?",
+		form.Email, form.Digest, form.Quiet.Start, form.Quiet.End, form.Quiet.Zone, user.UniqueID)
+	if err != nil {
+		serverError(w, r, err)
+		return
+	}
+	// saving the address asks for emails again after using the unsubscribe link, but not after bounces
+	if form.Suppressed, err = suppressionOf(ctx, form.Email); err != nil {
+		serverError(w, r, err)
+		return
+	}
+	if form.Suppressed != nil && form.Suppressed.Reason == suppressUnsubscribe {
+		if err := liftSuppression(ctx, form.Email); err != nil {
+			serverError(w, r, err)
+			return
+		}
+		form.Suppressed = nil
+	}
+	form.Saved = true
+	render(w, r, "email.html", form)
+}
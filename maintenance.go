@@ -0,0 +1,406 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// maintenance tasks run in the background on cron-like schedules, minute hour day month weekday:
+// deleting the expired sessions, closing the bounties whose award was missed, pruning the old read
+// notifications, optimizing the search index, backing up the database, pruning the delivery
+// log of the webhooks, expiring the old close votes, see closing.go, and reversing fraudulent
+// votes, see votefraud.go. MAINTENANCE_<TASK>
+// changes the schedule of a task, like MAINTENANCE_BACKUP="30 1 * * *", or turns it off with off.
+// Each run is a job, see jobs.go, so a failing run is retried, and a run missed while the app was
+// down happens once it starts. Read notifications are kept for NOTIFICATION_RETENTION, like 720h;
+// backups are written to BACKUP_DIR, backups by default, which keeps the latest BACKUP_KEEP;
+// postgres and mysql are backed up with their own tools instead.
+// The maintenance command lists the tasks, or runs one right away
+
+// maintenanceTask is a recurring task
+type maintenanceTask struct {
+	Name     string
+	Schedule string // default cron schedule
+	Summary  string
+	Run      func(ctx context.Context) error
+}
+
+var maintenanceTasks = []maintenanceTask{
+	{"sessions", "15 * * * *", "delete the expired sessions", cleanupSessions},
+	{"bounties", "45 * * * *", "close the expired bounties still open", closeExpiredBounties},
+	{"notifications", "30 3 * * *", "delete the read notifications older than the retention", pruneNotifications},
+	{"search-index", "0 4 * * 0", "merge the segments of the search index", optimizeSearchIndex},
+	{"backup", "0 2 * * *", "copy the database to the backup directory", backupDatabase},
+	{"webhooks", "15 3 * * *", "delete the old deliveries of the webhooks", pruneWebhookDeliveries},
+	{"close-votes", "30 * * * *", "delete the close and reopen votes older than CLOSE_VOTE_LIFETIME", expireCloseVotes},
+	{"vote-fraud", "0 5 * * *", "reverse and report the serial votes and the vote bursts of the last day", detectVoteFraud},
+}
+
+const (
+	defaultNotificationRetention = 90 * 24 * time.Hour
+	defaultBackupDir             = "backups"
+	defaultBackupKeep            = 7
+)
+
+func init() {
+	jobHandlers["maintenance"] = maintenanceJob
+}
+
+// findMaintenanceTask finds a task by name, nil if there is none
+func findMaintenanceTask(name string) *maintenanceTask {
+	for i := range maintenanceTasks {
+		if maintenanceTasks[i].Name == name {
+			return &maintenanceTasks[i]
+		}
+	}
+	return nil
+}
+
+// schedule is the schedule of the task, nil when it is turned off
+func (t *maintenanceTask) schedule() (*cronSchedule, error) {
+	env := "MAINTENANCE_" + strings.ToUpper(strings.ReplaceAll(t.Name, "-", "_"))
+	spec := strings.TrimSpace(os.Getenv(env))
+	if spec == "" {
+		spec = t.Schedule
+	}
+	if spec == "off" {
+		return nil, nil
+	}
+	s, err := parseCron(spec)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", env, err)
+	}
+	return s, nil
+}
+
+// scheduleMaintenance makes sure every task that isn't off has its next run pending, keeping the
+// runs already due or due before the schedule says
+func scheduleMaintenance(ctx context.Context) error {
+	now := time.Now()
+	for i := range maintenanceTasks {
+		task := &maintenanceTasks[i]
+		s, err := task.schedule()
+		if err != nil {
+			return err
+		}
+		payload, _ := json.Marshal(task.Name)
+		if s == nil {
+			_, err := db.ExecContext(ctx, "delete from jobs where kind = 'maintenance' and payload = ? and done_at is null", string(payload))
+			if err != nil {
+				return err
+			}
+			continue
+		}
+		next := s.next(now)
+		var pending sql.NullString
+		err = db.QueryRowContext(ctx, "select min(run_at) from jobs where kind = 'maintenance' and payload = ? and done_at is null and attempts < ?",
+			string(payload), maxJobAttempts).Scan(&pending)
+		if err != nil {
+			return err
+		}
+		if pending.Valid && pending.String <= next.Format(timestampLayout) {
+			continue
+		}
+		if _, err := db.ExecContext(ctx, "delete from jobs where kind = 'maintenance' and payload = ? and done_at is null", string(payload)); err != nil {
+			return err
+		}
+		if err := enqueueJobAt(ctx, "maintenance", task.Name, next); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// maintenanceJob runs the task named by the payload, after scheduling its next run: a failing run
+// is retried by the worker without holding up the next ones
+func maintenanceJob(ctx context.Context, payload []byte) error {
+	var name string
+	if err := json.Unmarshal(payload, &name); err != nil {
+		return err
+	}
+	task := findMaintenanceTask(name)
+	if task == nil {
+		return nil
+	}
+	s, err := task.schedule()
+	if err != nil || s == nil {
+		// turned off since it was scheduled
+		return err
+	}
+	// the job being run is due, a retry doesn't schedule the next run again
+	now := time.Now()
+	var n int
+	err = db.QueryRowContext(ctx, "select count(*) from jobs where kind = 'maintenance' and payload = ? and done_at is null and run_at > ?",
+		string(payload), now.Format(timestampLayout)).Scan(&n)
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		if err := enqueueJobAt(ctx, "maintenance", name, s.next(now)); err != nil {
+			return err
+		}
+	}
+	return task.Run(ctx)
+}
+
+// cleanupSessions deletes the expired sessions of the session store
+func cleanupSessions(ctx context.Context) error {
+	return sessions.Cleanup(ctx)
+}
+
+// closeExpiredBounties awards the expired bounties still open, whose job failed for good or was lost
+func closeExpiredBounties(ctx context.Context) error {
+	var ids []int
+	err := queryList(ctx, "select id from bounties where closed_at is null and expires_at <= ?",
+		[]interface{}{time.Now().Format(timestampLayout)}, func(rows *sql.Rows) error {
+			var id int
+			err := rows.Scan(&id)
+			ids = append(ids, id)
+			return err
+		})
+	if err != nil {
+		return err
+	}
+	for _, id := range ids {
+		if err := awardBounty(ctx, id); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// pruneNotifications deletes the read notifications older than NOTIFICATION_RETENTION
+func pruneNotifications(ctx context.Context) error {
+	retention := defaultNotificationRetention
+	if v := os.Getenv("NOTIFICATION_RETENTION"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d <= 0 {
+			return fmt.Errorf("NOTIFICATION_RETENTION: %q isn't a duration like 720h", v)
+		}
+		retention = d
+	}
+	_, err := db.ExecContext(ctx, "delete from notifications where read_at is not null and created_at < ?",
+		time.Now().Add(-retention).Format(timestampLayout))
+	return err
+}
+
+// optimizeSearchIndex merges the index of the full text search into a single segment, on the
+// backends whose index has segments. It runs unbounded, as it can take longer than the query timeout
+func optimizeSearchIndex(ctx context.Context) error {
+	optimize := db.backend.optimizeSearch()
+	if optimize == "" {
+		return nil
+	}
+	_, err := db.execOnce(unbounded(ctx), optimize)
+	return err
+}
+
+// backupDatabase writes a consistent copy of the database to BACKUP_DIR, named by the time of the
+// backup, then deletes the oldest copies beyond BACKUP_KEEP
+func backupDatabase(ctx context.Context) error {
+	backup := db.backend.backup()
+	if backup == "" {
+		fmt.Printf("the %s database is backed up with its own tools, there is no backup to make\n", db.backend.name())
+		return nil
+	}
+	dir := os.Getenv("BACKUP_DIR")
+	if dir == "" {
+		dir = defaultBackupDir
+	}
+	keep := defaultBackupKeep
+	if v := os.Getenv("BACKUP_KEEP"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			return fmt.Errorf("BACKUP_KEEP: %q isn't a positive number", v)
+		}
+		keep = n
+	}
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return err
+	}
+	path := filepath.Join(dir, "qaApp-"+time.Now().Format("20060102-150405")+".db")
+	if _, err := os.Stat(path); err == nil {
+		return fmt.Errorf("backup %s already exists", path)
+	}
+	// like the search index, a backup can take longer than the query timeout
+	if _, err := db.execOnce(unbounded(ctx), backup, path); err != nil {
+		return err
+	}
+	backups, err := filepath.Glob(filepath.Join(dir, "qaApp-*.db"))
+	if err != nil {
+		return err
+	}
+	// the names sort by time
+	sort.Strings(backups)
+	for len(backups) > keep {
+		if err := os.Remove(backups[0]); err != nil {
+			return err
+		}
+		backups = backups[1:]
+	}
+	return nil
+}
+
+// runMaintenance runs the maintenance command: it lists the tasks with their schedule, or runs the
+// tasks named in the arguments
+func runMaintenance(ctx context.Context, args []string) error {
+	flags := flag.NewFlagSet("maintenance", flag.ExitOnError)
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "usage: qaapp maintenance [task ...]")
+	}
+	flags.Parse(args)
+	if flags.NArg() == 0 {
+		for i := range maintenanceTasks {
+			task := &maintenanceTasks[i]
+			s, err := task.schedule()
+			if err != nil {
+				return err
+			}
+			when := "off"
+			if s != nil {
+				when = "next " + s.next(time.Now()).Format(timestampLayout)
+			}
+			fmt.Printf("%-14s %-26s %s\n", task.Name, when, task.Summary)
+		}
+		return nil
+	}
+	for _, name := range flags.Args() {
+		task := findMaintenanceTask(name)
+		if task == nil {
+			return fmt.Errorf("unknown maintenance task %q", name)
+		}
+		if err := task.Run(ctx); err != nil {
+			return fmt.Errorf("%s: %w", name, err)
+		}
+		fmt.Println(name, "done")
+	}
+	return nil
+}
+
+// cronSchedule is a cron schedule: the minutes, hours, days of the month, months and weekdays
+// it matches, as bit sets
+type cronSchedule struct {
+	minute, hour, day, month, weekday uint64
+	// with both restricted, a day matches either the day of the month or the weekday, as in cron
+	anyDay, anyWeekday bool
+}
+
+// shorthands of schedules
+var cronShorthands = map[string]string{
+	"@hourly":  "0 * * * *",
+	"@daily":   "0 0 * * *",
+	"@weekly":  "0 0 * * 0",
+	"@monthly": "0 0 1 * *",
+}
+
+// parseCron parses five fields, each a list of *, a value or a range a-b, optionally with a step /n
+func parseCron(spec string) (*cronSchedule, error) {
+	if s, ok := cronShorthands[spec]; ok {
+		spec = s
+	}
+	fields := strings.Fields(spec)
+	if len(fields) != 5 {
+		return nil, fmt.Errorf("%q isn't a schedule like \"0 2 * * *\", minute hour day month weekday", spec)
+	}
+	var s cronSchedule
+	bounds := []struct {
+		set      *uint64
+		min, max int
+	}{{&s.minute, 0, 59}, {&s.hour, 0, 23}, {&s.day, 1, 31}, {&s.month, 1, 12}, {&s.weekday, 0, 7}}
+	for i, b := range bounds {
+		set, err := parseCronField(fields[i], b.min, b.max)
+		if err != nil {
+			return nil, fmt.Errorf("%q: %w", spec, err)
+		}
+		*b.set = set
+	}
+	// 7 is sunday too
+	if s.weekday&(1<<7) != 0 {
+		s.weekday = s.weekday&^(1<<7) | 1
+	}
+	s.anyDay = fields[2] == "*"
+	s.anyWeekday = fields[4] == "*"
+	if s.next(time.Now()).IsZero() {
+		return nil, fmt.Errorf("%q never runs", spec)
+	}
+	return &s, nil
+}
+
+// parseCronField parses a field into the set of its values
+func parseCronField(field string, min, max int) (uint64, error) {
+	var set uint64
+	for _, part := range strings.Split(field, ",") {
+		rng, step := part, 1
+		if r, s, ok := strings.Cut(part, "/"); ok {
+			n, err := strconv.Atoi(s)
+			if err != nil || n < 1 {
+				return 0, fmt.Errorf("bad step in %q", part)
+			}
+			rng, step = r, n
+		}
+		lo, hi := min, max
+		if rng != "*" {
+			a, b, isRange := strings.Cut(rng, "-")
+			var err error
+			if lo, err = strconv.Atoi(a); err != nil {
+				return 0, fmt.Errorf("bad value in %q", part)
+			}
+			hi = lo
+			if isRange {
+				if hi, err = strconv.Atoi(b); err != nil {
+					return 0, fmt.Errorf("bad range in %q", part)
+				}
+			} else if step > 1 {
+				// a/n runs from a to the end
+				hi = max
+			}
+		}
+		if lo < min || hi > max || lo > hi {
+			return 0, fmt.Errorf("%q is out of %d-%d", part, min, max)
+		}
+		for v := lo; v <= hi; v += step {
+			set |= 1 << v
+		}
+	}
+	return set, nil
+}
+
+// matchesDay tells if the schedule runs on the day of t
+func (s *cronSchedule) matchesDay(t time.Time) bool {
+	day := s.day&(1<<t.Day()) != 0
+	weekday := s.weekday&(1<<t.Weekday()) != 0
+	if s.anyDay || s.anyWeekday {
+		return day && weekday
+	}
+	return day || weekday
+}
+
+// next is the first time the schedule matches after t, zero if it doesn't within five years
+func (s *cronSchedule) next(t time.Time) time.Time {
+	t = t.Truncate(time.Minute).Add(time.Minute)
+	limit := t.AddDate(5, 0, 0)
+	for t.Before(limit) {
+		switch {
+		case s.month&(1<<t.Month()) == 0:
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, t.Location())
+		case !s.matchesDay(t):
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, t.Location())
+		case s.hour&(1<<t.Hour()) == 0:
+			t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, t.Location())
+		case s.minute&(1<<t.Minute()) == 0:
+			t = t.Add(time.Minute)
+		default:
+			return t
+		}
+	}
+	return time.Time{}
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"html"
+	"html/template"
+	"regexp"
+	"strings"
+)
+
+// the Markdown of tag wikis knows a common subset: paragraphs, # headings, - lists,
+// ``` code blocks, `code`, **bold**, *italic* and [links](https://...).
+// the source is escaped first, so any HTML in it shows as text
+
+var (
+	markdownHeading = regexp.MustCompile(`^(#{1,4})\s+(.*)$`)
+	markdownLink    = regexp.MustCompile(`\[([^\]]+)\]\((https?://[^\s)]+)\)`)
+	markdownBold    = regexp.MustCompile(`\*\*([^*]+)\*\*`)
+	markdownItalic  = regexp.MustCompile(`\*([^*]+)\*`)
+)
+
+// renderMarkdown turns Markdown into HTML
+func renderMarkdown(src string) template.HTML {
+	var b strings.Builder
+	var para, list, code []string
+	inCode := false
+	flush := func() {
+		if len(para) > 0 {
+			b.WriteString("<p>" + markdownInline(strings.Join(para, " ")) + "</p>\n")
+			para = nil
+		}
+		if len(list) > 0 {
+			b.WriteString("<ul>\n")
+			for _, item := range list {
+				b.WriteString("<li>" + markdownInline(item) + "</li>\n")
+			}
+			b.WriteString("</ul>\n")
+			list = nil
+		}
+	}
+	for _, line := range strings.Split(strings.ReplaceAll(src, "\r\n", "\n"), "\n") {
+		trimmed := strings.TrimSpace(line)
+		if strings.HasPrefix(trimmed, "```") {
+			if inCode {
+				b.WriteString("<pre><code>" + html.EscapeString(strings.Join(code, "\n")) + "</code></pre>\n")
+				code = nil
+			} else {
+				flush()
+			}
+			inCode = !inCode
+			continue
+		}
+		if inCode {
+			code = append(code, line)
+			continue
+		}
+		if trimmed == "" {
+			flush()
+			continue
+		}
+		// headings are one level below the title of the page
+		if m := markdownHeading.FindStringSubmatch(trimmed); m != nil {
+			flush()
+			level := string(rune('1' + len(m[1])))
+			b.WriteString("<h" + level + ">" + markdownInline(m[2]) + "</h" + level + ">\n")
+			continue
+		}
+		if strings.HasPrefix(trimmed, "- ") || strings.HasPrefix(trimmed, "* ") {
+			if len(para) > 0 {
+				flush()
+			}
+			list = append(list, trimmed[2:])
+			continue
+		}
+		if len(list) > 0 {
+			flush()
+		}
+		para = append(para, trimmed)
+	}
+	// an unclosed code block runs to the end
+	if inCode {
+		b.WriteString("<pre><code>" + html.EscapeString(strings.Join(code, "\n")) + "</code></pre>\n")
+	}
+	flush()
+	return template.HTML(b.String())
+}
+
+// markdownInline renders the formatting inside a line. Nothing is formatted inside `code`
+func markdownInline(s string) string {
+	parts := strings.Split(s, "`")
+	for i, part := range parts {
+		part = html.EscapeString(part)
+		// the last part of an odd number of backticks isn't code
+		if i%2 == 1 && i < len(parts)-1 {
+			parts[i] = "<code>" + part + "</code>"
+			continue
+		}
+		part = markdownLink.ReplaceAllString(part, `<a href="$2" rel="nofollow">$1</a>`)
+		part = markdownBold.ReplaceAllString(part, "<strong>$1</strong>")
+		parts[i] = markdownItalic.ReplaceAllString(part, "<em>$1</em>")
+		if i%2 == 1 {
+			parts[i] = "`" + parts[i]
+		}
+	}
+	return strings.Join(parts, "")
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"html"
+	"html/template"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// writing @username in a question, an answer or a comment mentions the user: the mention is
+// recorded when the post is saved, if the user exists, and they are notified, unless they muted
+// the author. Editing a post only notifies the users it newly mentions. Pages link mentions to
+// the profiles. Names in `code` don't mention anyone
+
+// mentionRe matches @name at the start of a word, the name in the second group. Dots and dashes
+// ending the name are punctuation, like in "thanks @sagaryadav."
+var mentionRe = regexp.MustCompile(`(^|[\s(])@([A-Za-z0-9_.-]*[A-Za-z0-9_])`)
+
+// inlineCode matches `code` and ```blocks```
+var inlineCode = regexp.MustCompile("(?s)```.*?(```|$)|`[^`\n]*`")
+
+// mentionedNames lists the lowercase names mentioned in a body, once each
+func mentionedNames(body string) []string {
+	seen := map[string]bool{}
+	var names []string
+	for _, m := range mentionRe.FindAllStringSubmatch(inlineCode.ReplaceAllString(body, " "), -1) {
+		name := strings.ToLower(m[2])
+		if !seen[name] && usernamePattern.MatchString(name) {
+			seen[name] = true
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// recordMentions records the users the body of a post mentions, replacing what an older version
+// of the post mentioned, and notifies those it didn't mention before. quiet posts, held for
+// review, notify no one. It runs in the transaction saving the post, see db.WithTx
+func recordMentions(ctx context.Context, author *User, postType string, postID int, link, body string, quiet bool) error {
+	names := mentionedNames(body)
+	var users []int
+	if len(names) > 0 {
+		args := make([]interface{}, len(names))
+		for i, name := range names {
+			args[i] = name
+		}
+		rows, err := db.QueryContext(ctx, "select id from users where lower(username) in ("+placeholders(len(args))+")", args...)
+		if err != nil {
+			return err
+		}
+		for rows.Next() {
+			var id int
+			if err := rows.Scan(&id); err != nil {
+				rows.Close()
+				return err
+			}
+			if id != author.UniqueID {
+				users = append(users, id)
+			}
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return err
+		}
+	}
+	before := map[int]bool{}
+	rows, err := db.QueryContext(ctx, "select user_id from mentions where post_type = ? and post_id = ?", postType, postID)
+	if err != nil {
+		return err
+	}
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return err
+		}
+		before[id] = true
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	if _, err := db.ExecContext(ctx, "delete from mentions where post_type = ? and post_id = ?", postType, postID); err != nil {
+		return err
+	}
+	// the author of an anonymous question stays unnamed
+	name := author.UserName
+	if postType == postQuestion {
+		var anonymous bool
+		if err := db.QueryRowContext(ctx, "select is_anonymous from questions where id = ?", postID).Scan(&anonymous); err != nil {
+			return err
+		}
+		name = authorName(author, anonymous)
+	}
+	now := time.Now().Format(timestampLayout)
+	for _, id := range users {
+		_, err := db.ExecContext(ctx, "insert into mentions (post_type, post_id, user_id, created_at) values (?, ?, ?, ?)", postType, postID, id, now)
+		if err != nil {
+			return err
+		}
+		if quiet || before[id] {
+			continue
+		}
+		var muted int
+		if err := db.QueryRowContext(ctx, "select count(*) from user_mutes where user_id = ? and muted_id = ?", id, author.UniqueID).Scan(&muted); err != nil {
+			return err
+		}
+		if muted > 0 {
+			continue
+		}
+		if err := notify(ctx, id, fmt.Sprintf("%s mentioned you in %s %s", name, article(postType), postType), link); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// article is the indefinite article of a word
+func article(word string) string {
+	if strings.ContainsAny(word[:1], "aeiou") {
+		return "an"
+	}
+	return "a"
+}
+
+// linkMentions escapes the text of a post and links its mentions to the profiles
+func linkMentions(text string) template.HTML {
+	var b strings.Builder
+	last := 0
+	for _, code := range inlineCode.FindAllStringIndex(text, -1) {
+		b.WriteString(linkMentionsIn(text[last:code[0]]))
+		b.WriteString(html.EscapeString(text[code[0]:code[1]]))
+		last = code[1]
+	}
+	b.WriteString(linkMentionsIn(text[last:]))
+	return template.HTML(b.String())
+}
+
+// linkMentionsIn escapes text without code and links its mentions
+func linkMentionsIn(text string) string {
+	var b strings.Builder
+	last := 0
+	for _, m := range mentionRe.FindAllStringSubmatchIndex(text, -1) {
+		// m[4]:m[5] is the name, after the @ at m[4]-1
+		name := text[m[4]:m[5]]
+		if !usernamePattern.MatchString(strings.ToLower(name)) {
+			continue
+		}
+		b.WriteString(html.EscapeString(text[last : m[4]-1]))
+		b.WriteString(`<a class="mention" href="/users/` + html.EscapeString(strings.ToLower(name)) + `">@` + html.EscapeString(name) + `</a>`)
+		last = m[5]
+	}
+	b.WriteString(html.EscapeString(text[last:]))
+	return b.String()
+}
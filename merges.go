@@ -0,0 +1,197 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// moderators merge a duplicate question into the canonical one from the page of the duplicate.
+// its answers, comments, votes, bookmarks and followers move to the canonical question, a user
+// who voted on both keeping their vote on the canonical one, and the duplicate is deleted. Its
+// url then answers with a permanent redirect, kept in question_merges, to the canonical question
+
+var (
+	errMergeSame   = errors.New("a question can't be merged into itself")
+	errMergeTarget = errors.New("there is no question with this id to merge into")
+	errMergeCourse = errors.New("questions of different courses can't be merged")
+	errMergeBounty = errors.New("the question has an open bounty, merge it once the bounty is awarded")
+)
+
+// mergedInto is the question a merged question redirects to, 0 for a question that wasn't merged
+func mergedInto(ctx context.Context, questionID int) (int, error) {
+	var target int
+	err := db.QueryRowContext(ctx, "select target_id from question_merges where question_id = ?", questionID).Scan(&target)
+	if err == sql.ErrNoRows {
+		return 0, nil
+	}
+	return target, err
+}
+
+// mergeQuestion moves the answers, comments, votes and followers of the question from to into,
+// then deletes from. It returns the authors of the two questions, whose reputation changed
+func mergeQuestion(ctx context.Context, user *User, from, into int) (fromAuthor, intoAuthor string, err error) {
+	if from == into {
+		return "", "", errMergeSame
+	}
+	err = db.WithTx(ctx, func(ctx context.Context) error {
+		var fromCourse, intoCourse sql.NullInt64
+		err := db.QueryRowContext(ctx, "select user, course_id from questions where id = ?", from).Scan(&fromAuthor, &fromCourse)
+		if err != nil {
+			return err
+		}
+		err = db.QueryRowContext(ctx, "select user, course_id from questions where id = ?", into).Scan(&intoAuthor, &intoCourse)
+		if err == sql.ErrNoRows {
+			return errMergeTarget
+		}
+		if err != nil {
+			return err
+		}
+		if fromCourse != intoCourse {
+			return errMergeCourse
+		}
+		var bounties int
+		if err := db.QueryRowContext(ctx, "select count(*) from bounties where question_id = ? and closed_at is null", from).Scan(&bounties); err != nil {
+			return err
+		}
+		if bounties > 0 {
+			return errMergeBounty
+		}
+		var views int
+		if err := db.QueryRowContext(ctx, "select coalesce(views, 0) from questions where id = ?", from).Scan(&views); err != nil {
+			return err
+		}
+		// a user keeps one vote on the canonical question, the one they gave it if any, and its
+		// author none. The accepted answer of the duplicate was the choice of another author, and
+		// isn't carried
+		statements := []struct {
+			query string
+			args  []interface{}
+		}{
+			{"update answers set question_id = ? where question_id = ?", []interface{}{into, from}},
+			{"update comments set post_id = ? where post_type = ? and post_id = ?", []interface{}{into, postQuestion, from}},
+			{`delete from votes where post_type = ? and post_id = ? and (user_id in (select user_id from votes where post_type = ?1 and post_id = ?)
+				or user_id in (select id from users where lower(username) = lower(?)))`, []interface{}{postQuestion, from, into, intoAuthor}},
+			{"update votes set post_id = ? where post_type = ? and post_id = ?", []interface{}{into, postQuestion, from}},
+			{"update or ignore bookmarks set question_id = ? where question_id = ?", []interface{}{into, from}},
+			{"delete from bookmarks where question_id = ?", []interface{}{from}},
+			{"update or ignore subscriptions set target = ? where target_type = ? and target = ?", []interface{}{strconv.Itoa(into), followQuestion, strconv.Itoa(from)}},
+			{"delete from subscriptions where target_type = ? and target = ?", []interface{}{followQuestion, strconv.Itoa(from)}},
+			{"update or ignore drafts set question_id = ? where kind = ? and question_id = ?", []interface{}{into, draftAnswer, from}},
+			{"delete from drafts where kind = ? and question_id = ?", []interface{}{draftAnswer, from}},
+			{"update or ignore question_views set question_id = ? where question_id = ?", []interface{}{into, from}},
+			{"delete from question_views where question_id = ?", []interface{}{from}},
+			{"update questions set views = coalesce(views, 0) + ? where id = ?", []interface{}{views, into}},
+			{"update bounties set question_id = ? where question_id = ?", []interface{}{into, from}},
+			{"update activity set question_id = ? where question_id = ?", []interface{}{into, from}},
+			{"delete from flags where post_type = ? and post_id = ?", []interface{}{postQuestion, from}},
+			{"delete from mentions where post_type = ? and post_id = ?", []interface{}{postQuestion, from}},
+			{"delete from edit_leases where post_type = ? and post_id = ?", []interface{}{postQuestion, from}},
+			{"delete from experiment_exposures where question_id = ?", []interface{}{from}},
+			// the questions merged into from before now redirect to into
+			{"update question_merges set target_id = ? where target_id = ?", []interface{}{into, from}},
+			{"insert into question_merges (question_id, target_id, user_id, merged_at) values (?, ?, ?, ?)",
+				[]interface{}{from, into, user.UniqueID, time.Now().Format(timestampLayout)}},
+		}
+		for _, s := range statements {
+			if _, err := db.ExecContext(ctx, s.query, s.args...); err != nil {
+				return err
+			}
+		}
+		// the files attached to the duplicate go with it
+		var files []Attachment
+		err = queryList(ctx, "select id, name, path, content_type, size from attachments where post_type = ? and post_id = ?",
+			[]interface{}{postQuestion, from}, func(rows *sql.Rows) error {
+				var a Attachment
+				err := rows.Scan(&a.ID, &a.Name, &a.Path, &a.Type, &a.Size)
+				files = append(files, a)
+				return err
+			})
+		if err != nil {
+			return err
+		}
+		if _, err := db.ExecContext(ctx, "delete from attachments where post_type = ? and post_id = ?", postQuestion, from); err != nil {
+			return err
+		}
+		if _, err := db.ExecContext(ctx, "delete from questions where id = ?", from); err != nil {
+			return err
+		}
+		db.AfterCommit(ctx, func() { removeAttachments(files) })
+		return nil
+	})
+	return fromAuthor, intoAuthor, err
+}
+
+// parseMergeTarget reads the question to merge into, given by its id or its url
+func parseMergeTarget(s string) (int, bool) {
+	s = strings.TrimSpace(s)
+	if i := strings.Index(s, "/questions/"); i >= 0 {
+		s, _, _ = strings.Cut(s[i+len("/questions/"):], "/")
+		s, _, _ = strings.Cut(s, "#")
+	}
+	id, err := strconv.Atoi(s)
+	return id, err == nil && id > 0
+}
+
+// handle POST /questions/{id}/merge, where moderators merge a duplicate into the question of the
+// into field, and are taken to it
+func serveMergeQuestion(w http.ResponseWriter, r *http.Request, id int) {
+	ctx := r.Context()
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	user := requireUser(w, r)
+	if user == nil {
+		return
+	}
+	if !isModerator(user) {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+	into, ok := parseMergeTarget(r.FormValue("into"))
+	if !ok {
+		http.Error(w, "give the id or the link of the question to merge into", http.StatusBadRequest)
+		return
+	}
+	before, err := snapshotPost(ctx, postQuestion, id)
+	if err != nil {
+		serverError(w, r, err)
+		return
+	}
+	if before == nil {
+		http.NotFound(w, r)
+		return
+	}
+	fromAuthor, intoAuthor, err := mergeQuestion(ctx, user, id, into)
+	switch err {
+	case nil:
+	case errMergeSame, errMergeTarget, errMergeCourse, errMergeBounty:
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	default:
+		serverError(w, r, err)
+		return
+	}
+	questionCache.invalidate(into)
+	forgetData("reputation:"+strings.ToLower(fromAuthor), "reputation:"+strings.ToLower(intoAuthor))
+	if err := recordAudit(ctx, user, auditMergeQuestion, postQuestion, strconv.Itoa(id), before, map[string]int{"merged_into": into}); err != nil {
+		serverError(w, r, err)
+		return
+	}
+	var authorID int
+	err = db.QueryRowContext(ctx, "select id from users where lower(username) = lower(?)", fromAuthor).Scan(&authorID)
+	if err == nil && authorID != user.UniqueID {
+		err = notify(ctx, authorID, "Your question \""+before.Heading+"\" was merged into a question asked before", fmt.Sprintf("/questions/%d", into))
+	}
+	if err != nil && err != sql.ErrNoRows {
+		serverError(w, r, err)
+		return
+	}
+	http.Redirect(w, r, fmt.Sprintf("/questions/%d", into), http.StatusSeeOther)
+}
@@ -0,0 +1,256 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// users write private messages to each other on /messages/{name}, and read their conversations
+// on /messages. Who can write to whom follows the roles: teachers and moderators write to anyone,
+// and anyone writes to them. Students write to other students only with the student-messages
+// feature on. A new message notifies its recipient, unless they muted the sender
+
+// flag letting students write to other students
+const featureStudentMessages = "student-messages"
+
+// longest message, in bytes
+const maxMessageLength = 5000
+
+// most messages a user sends in an hour, against spam
+const maxMessagesPerHour = 30
+
+// messages of a conversation shown at once, the latest ones
+const messagesPerPage = 100
+
+// staff tells if the user is a teacher or a moderator, who can message and be messaged by anyone
+func staff(user *User) bool {
+	return isModerator(user) || hasUserType(user, "teacher")
+}
+
+// canMessage tells if from can write to to
+func canMessage(ctx context.Context, from, to *User) (bool, error) {
+	if from == nil || to == nil || from.UniqueID == to.UniqueID || to.Banned || to.UserName == deletedUserName {
+		return false, nil
+	}
+	if staff(from) || staff(to) {
+		return true, nil
+	}
+	return featureEnabled(ctx, featureStudentMessages)
+}
+
+// conversationWith finds the conversation of two users, creating it when create is set. The
+// users are kept in order, so a pair only has one. 0 when there is none
+func conversationWith(ctx context.Context, userID, otherID int, create bool) (int, error) {
+	a, b := userID, otherID
+	if a > b {
+		a, b = b, a
+	}
+	if create {
+		now := time.Now().Format(timestampLayout)
+		_, err := db.ExecContext(ctx, "insert or ignore into conversations (user_a, user_b, created_at, updated_at) values (?, ?, ?, ?)", a, b, now, now)
+		if err != nil {
+			return 0, err
+		}
+	}
+	var id int
+	err := db.QueryRowContext(ctx, "select id from conversations where user_a = ? and user_b = ?", a, b).Scan(&id)
+	if err == sql.ErrNoRows {
+		return 0, nil
+	}
+	return id, err
+}
+
+// sendMessage adds a message to the conversation of the users, and notifies the recipient
+func sendMessage(ctx context.Context, from, to *User, body string) error {
+	return db.WithTx(ctx, func(ctx context.Context) error {
+		id, err := conversationWith(ctx, from.UniqueID, to.UniqueID, true)
+		if err != nil {
+			return err
+		}
+		now := time.Now().Format(timestampLayout)
+		_, err = db.ExecContext(ctx, "insert into messages (conversation_id, sender_id, body, created_at) values (?, ?, ?, ?)", id, from.UniqueID, body, now)
+		if err != nil {
+			return err
+		}
+		if _, err := db.ExecContext(ctx, "update conversations set updated_at = ? where id = ?", now, id); err != nil {
+			return err
+		}
+		var muted int
+		if err := db.QueryRowContext(ctx, "select count(*) from user_mutes where user_id = ? and muted_id = ?", to.UniqueID, from.UniqueID).Scan(&muted); err != nil {
+			return err
+		}
+		if muted > 0 {
+			return nil
+		}
+		return notify(ctx, to.UniqueID, "New message from "+from.UserName, "/messages/"+url.PathEscape(from.UserName))
+	})
+}
+
+// unreadMessages counts the messages sent to the user they haven't read yet
+func unreadMessages(ctx context.Context, user *User) int {
+	if user == nil {
+		return 0
+	}
+	var n int
+	err := db.QueryRowContext(ctx, `select count(*) from messages join conversations on conversations.id = messages.conversation_id
+		where ? in (conversations.user_a, conversations.user_b) and messages.sender_id != ? and messages.read_at is null`,
+		user.UniqueID, user.UniqueID).Scan(&n)
+	if err != nil {
+		return 0
+	}
+	return n
+}
+
+// conversationSummary is a conversation of the inbox
+type conversationSummary struct {
+	With    string // username of the other user
+	Last    string // start of the latest message
+	Updated string
+	Unread  int
+}
+
+// message is a message of a conversation
+type message struct {
+	Sender  string
+	Body    string
+	Created string
+	Mine    bool // sent by the user reading it
+}
+
+// serve /messages, the conversations of the user, the latest first
+func serveInbox(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	user := requireUser(w, r)
+	if user == nil {
+		return
+	}
+	rows, err := db.QueryContext(ctx, `select users.username, conversations.updated_at,
+			coalesce((select substr(body, 1, 100) from messages where conversation_id = conversations.id order by id desc limit 1), ''),
+			(select count(*) from messages where conversation_id = conversations.id and sender_id != ? and read_at is null)
+		from conversations join users on users.id = case conversations.user_a when ? then conversations.user_b else conversations.user_a end
+		where ? in (conversations.user_a, conversations.user_b)
+		order by conversations.updated_at desc, conversations.id desc`, user.UniqueID, user.UniqueID, user.UniqueID)
+	if err != nil {
+		serverError(w, r, err)
+		return
+	}
+	defer rows.Close()
+	var inbox []conversationSummary
+	for rows.Next() {
+		var c conversationSummary
+		if err := rows.Scan(&c.With, &c.Updated, &c.Last, &c.Unread); err != nil {
+			serverError(w, r, err)
+			return
+		}
+		inbox = append(inbox, c)
+	}
+	if err := rows.Err(); err != nil {
+		serverError(w, r, err)
+		return
+	}
+	render(w, r, "inbox.html", inbox)
+}
+
+// conversationPage is the data of the page of a conversation
+type conversationPage struct {
+	With     *User
+	Messages []message
+	CanWrite bool // the user can write to the other user
+	Body     string
+	Error    string
+}
+
+// serve /messages/{name}, the conversation of the user with another user. Reading it marks the
+// messages read, and posting writes a message
+func serveConversation(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	user := requireUser(w, r)
+	if user == nil {
+		return
+	}
+	other, err := userByName(ctx, strings.TrimPrefix(r.URL.Path, "/messages/"))
+	if err != nil {
+		serverError(w, r, err)
+		return
+	}
+	if other == nil || other.UniqueID == user.UniqueID {
+		http.NotFound(w, r)
+		return
+	}
+	p := conversationPage{With: other}
+	if p.CanWrite, err = canMessage(ctx, user, other); err != nil {
+		serverError(w, r, err)
+		return
+	}
+
+	if r.Method == http.MethodPost {
+		p.Body = strings.TrimSpace(r.FormValue("body"))
+		var sent int
+		err := db.QueryRowContext(ctx, "select count(*) from messages where sender_id = ? and created_at > ?",
+			user.UniqueID, time.Now().Add(-time.Hour).Format(timestampLayout)).Scan(&sent)
+		if err != nil {
+			serverError(w, r, err)
+			return
+		}
+		switch {
+		case !p.CanWrite:
+			p.Error = "you can't write to this user"
+		case sanctionError(ctx, user) != "":
+			p.Error = sanctionError(ctx, user)
+		case p.Body == "":
+			p.Error = "the message is empty"
+		case len(p.Body) > maxMessageLength:
+			p.Error = fmt.Sprintf("messages are at most %d characters", maxMessageLength)
+		case sent >= maxMessagesPerHour:
+			p.Error = "you sent too many messages, try again later"
+		default:
+			if err := sendMessage(ctx, user, other, p.Body); err != nil {
+				serverError(w, r, err)
+				return
+			}
+			http.Redirect(w, r, "/messages/"+url.PathEscape(other.UserName)+"#latest", http.StatusSeeOther)
+			return
+		}
+	}
+
+	id, err := conversationWith(ctx, user.UniqueID, other.UniqueID, false)
+	if err != nil {
+		serverError(w, r, err)
+		return
+	}
+	if id != 0 {
+		rows, err := db.QueryContext(ctx, `select username, body, created_at, mine from (select messages.id, users.username, messages.body,
+				messages.created_at, messages.sender_id = ? as mine
+			from messages join users on users.id = messages.sender_id where messages.conversation_id = ? order by messages.id desc limit ?)
+			order by id`, user.UniqueID, id, messagesPerPage)
+		if err != nil {
+			serverError(w, r, err)
+			return
+		}
+		defer rows.Close()
+		for rows.Next() {
+			var m message
+			if err := rows.Scan(&m.Sender, &m.Body, &m.Created, &m.Mine); err != nil {
+				serverError(w, r, err)
+				return
+			}
+			p.Messages = append(p.Messages, m)
+		}
+		if err := rows.Err(); err != nil {
+			serverError(w, r, err)
+			return
+		}
+		_, err = db.ExecContext(ctx, "update messages set read_at = ? where conversation_id = ? and sender_id != ? and read_at is null",
+			time.Now().Format(timestampLayout), id, user.UniqueID)
+		if err != nil {
+			serverError(w, r, err)
+			return
+		}
+	}
+	render(w, r, "conversation.html", p)
+}
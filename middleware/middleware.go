@@ -0,0 +1,149 @@
+// Package middleware composes the wrappers that add to every route of the site what isn't
+// specific to it, like logging, sessions or CSRF checks:
+//
+//	handler := middleware.Chain(logging, recover, session, csrf, ratelimit)(mux)
+//
+// the first middleware of a chain is the outermost, seeing the request first and the response last.
+package middleware
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// Middleware wraps a handler with work of its own, before or after it
+type Middleware func(http.Handler) http.Handler
+
+// Chain composes the middlewares into one: Chain(a, b)(h) is a(b(h))
+func Chain(middlewares ...Middleware) Middleware {
+	return func(h http.Handler) http.Handler {
+		for i := len(middlewares) - 1; i >= 0; i-- {
+			h = middlewares[i](h)
+		}
+		return h
+	}
+}
+
+// statusRecorder remembers the status and the size of a response
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+	bytes  int
+}
+
+func (s *statusRecorder) WriteHeader(status int) {
+	if s.status == 0 {
+		s.status = status
+	}
+	s.ResponseWriter.WriteHeader(status)
+}
+
+func (s *statusRecorder) Write(b []byte) (int, error) {
+	if s.status == 0 {
+		s.status = http.StatusOK
+	}
+	n, err := s.ResponseWriter.Write(b)
+	s.bytes += n
+	return n, err
+}
+
+// Flush lets streamed responses through
+func (s *statusRecorder) Flush() {
+	if f, ok := s.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// accessRecord is the log line of a request
+type accessRecord struct {
+	Time     string `json:"time"`
+	Level    string `json:"level"`
+	Method   string `json:"method"`
+	URL      string `json:"url"`
+	Status   int    `json:"status"`
+	Bytes    int    `json:"bytes"`
+	Duration int64  `json:"duration_ms"`
+	IP       string `json:"ip"`
+}
+
+// Logging writes a JSON line to out for every request, once it is answered
+func Logging(out io.Writer) Middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			start := time.Now()
+			rec := &statusRecorder{ResponseWriter: w}
+			defer func() {
+				ip, _, err := net.SplitHostPort(r.RemoteAddr)
+				if err != nil {
+					ip = r.RemoteAddr
+				}
+				if rec.status == 0 {
+					rec.status = http.StatusOK
+				}
+				line, err := json.Marshal(accessRecord{
+					Time:     start.Format(time.RFC3339),
+					Level:    "info",
+					Method:   r.Method,
+					URL:      r.URL.String(),
+					Status:   rec.status,
+					Bytes:    rec.bytes,
+					Duration: time.Since(start).Milliseconds(),
+					IP:       ip,
+				})
+				if err == nil {
+					fmt.Fprintln(out, string(line))
+				}
+			}()
+			next.ServeHTTP(rec, r)
+		})
+	}
+}
+
+// CSRF refuses the requests changing something, those other than GET, HEAD and OPTIONS,
+// that a page of another site makes the browser send. Browsers tell where a request comes
+// from in Sec-Fetch-Site, or in Origin for older ones; requests with neither don't come
+// from a browser, like those of curl, and pass. The exempt paths take requests from
+// other sites on purpose, like webhooks
+func CSRF(exempt ...string) Middleware {
+	skip := map[string]bool{}
+	for _, path := range exempt {
+		skip[path] = true
+	}
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if safeMethod(r.Method) || skip[r.URL.Path] || sameOrigin(r) {
+				next.ServeHTTP(w, r)
+				return
+			}
+			http.Error(w, "Forbidden: the request comes from another site", http.StatusForbidden)
+		})
+	}
+}
+
+func safeMethod(method string) bool {
+	return method == http.MethodGet || method == http.MethodHead || method == http.MethodOptions
+}
+
+// sameOrigin tells if the request comes from a page of the site, or not from a browser
+func sameOrigin(r *http.Request) bool {
+	switch r.Header.Get("Sec-Fetch-Site") {
+	case "same-origin", "none":
+		// "none" is a request the user made, like typing the url
+		return true
+	case "":
+	default:
+		return false
+	}
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	u, err := url.Parse(origin)
+	return err == nil && strings.EqualFold(u.Host, r.Host)
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// users can mute other users, whose posts then collapse behind a placeholder for them. Their
+// questions are left out of the lists and their activity out of the site activity, and what they
+// do, like mentioning the user or answering a question they follow, doesn't notify them.
+// mutes are private: only moderators see how many users muted someone
+
+// mute hides the posts of muted from user, or shows them again when on is false
+func mute(ctx context.Context, userID, mutedID int, on bool) error {
+	var err error
+	if on {
+		_, err = db.ExecContext(ctx, "insert or ignore into user_mutes (user_id, muted_id, created_at) values (?, ?, ?)",
+			userID, mutedID, time.Now().Format(timestampLayout))
+	} else {
+		_, err = db.ExecContext(ctx, "delete from user_mutes where user_id = ? and muted_id = ?", userID, mutedID)
+	}
+	return err
+}
+
+// mutedNames loads the current usernames of the users muted by user
+func mutedNames(ctx context.Context, user *User) (map[string]bool, error) {
+	muted := map[string]bool{}
+	if user == nil {
+		return muted, nil
+	}
+	rows, err := db.QueryContext(ctx, "select users.username from user_mutes join users on users.id = user_mutes.muted_id where user_mutes.user_id = ?", user.UniqueID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return nil, err
+		}
+		muted[name] = true
+	}
+	return muted, rows.Err()
+}
+
+// mutedFilter is a condition on questions leaving out those whose author the user muted.
+// anonymous questions stay, so that leaving them out doesn't tell who asked them
+func mutedFilter(user *User) (string, []interface{}) {
+	if user == nil {
+		return "true", nil
+	}
+	return `(questions.is_anonymous or not exists (select 1 from user_mutes join users on users.id = user_mutes.muted_id
+		where user_mutes.user_id = ? and users.username = questions.user))`, []interface{}{user.UniqueID}
+}
+
+// muteCount counts the users who muted the user
+func muteCount(ctx context.Context, userID int) (int, error) {
+	var n int
+	err := db.QueryRowContext(ctx, "select count(*) from user_mutes where muted_id = ?", userID).Scan(&n)
+	return n, err
+}
+
+// handle POST /users/{name}/mute, which mutes the member, or unmutes them with action=unmute
+func serveMute(w http.ResponseWriter, r *http.Request, member *User) {
+	ctx := r.Context()
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	user := requireUser(w, r)
+	if user == nil {
+		return
+	}
+	if user.UniqueID == member.UniqueID {
+		http.Error(w, "you can't mute yourself", http.StatusBadRequest)
+		return
+	}
+	if err := mute(ctx, user.UniqueID, member.UniqueID, r.FormValue("action") != "unmute"); err != nil {
+		serverError(w, r, err)
+		return
+	}
+	http.Redirect(w, r, "/users/"+url.PathEscape(member.UserName), http.StatusSeeOther)
+}
+
+// mutedUser is a row of the mutes admin page
+type mutedUser struct {
+	UserName string
+	Mutes    int
+}
+
+// serve /admin/mutes, the users muted by the most other users
+func serveMutesAdmin(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	if requireSuperUser(w, r) == nil {
+		return
+	}
+	rows, err := db.QueryContext(ctx, `select users.username, count(*) from user_mutes join users on users.id = user_mutes.muted_id
+		group by users.id order by count(*) desc, users.username limit 100`)
+	if err != nil {
+		serverError(w, r, err)
+		return
+	}
+	defer rows.Close()
+	var muted []mutedUser
+	for rows.Next() {
+		var m mutedUser
+		if err := rows.Scan(&m.UserName, &m.Mutes); err != nil {
+			serverError(w, r, err)
+			return
+		}
+		muted = append(muted, m)
+	}
+	render(w, r, "mutes-admin.html", muted)
+}
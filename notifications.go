@@ -0,0 +1,171 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// most notifications shown on the notifications page
+const notificationsPerPage = 50
+
+// notification is a message for a user about activity they care about
+type notification struct {
+	ID      int
+	Message string
+	Link    string
+	Created string
+	Read    bool
+}
+
+// notify adds a notification for the user
+func notify(ctx context.Context, userID int, message, link string) error {
+	_, err := db.ExecContext(ctx, "insert into notifications (user_id, message, link, created_at) values (?, ?, ?, ?)",
+		userID, message, link, time.Now().Format(timestampLayout))
+	if err != nil {
+		return err
+	}
+	db.AfterCommit(ctx, func() { publish("notification", []byte(strconv.Itoa(userID))) })
+	return nil
+}
+
+// the pages of a user follow their unread notifications live: each page keeps a stream of
+// server-sent events open, told the count whenever a notification event for the user comes,
+// from any instance, see events.go
+
+// notificationStreams are the channels of the open streams, by user id
+var notificationStreams = struct {
+	sync.Mutex
+	streams map[int]map[chan struct{}]bool
+}{streams: map[int]map[chan struct{}]bool{}}
+
+// how often an idle stream sends a comment, so proxies don't close it
+const streamKeepAlive = 30 * time.Second
+
+func init() {
+	eventHandlers["notification"] = append(eventHandlers["notification"], func(payload []byte) {
+		userID, err := strconv.Atoi(string(payload))
+		if err != nil {
+			return
+		}
+		notificationStreams.Lock()
+		defer notificationStreams.Unlock()
+		for ch := range notificationStreams.streams[userID] {
+			select {
+			case ch <- struct{}{}:
+			default:
+			}
+		}
+	})
+}
+
+// serve /notifications/stream, the count of unread notifications of the user as server-sent events
+func serveNotificationStream(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	user := currentUser(r)
+	if user == nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+	ch := make(chan struct{}, 1)
+	notificationStreams.Lock()
+	if notificationStreams.streams[user.UniqueID] == nil {
+		notificationStreams.streams[user.UniqueID] = map[chan struct{}]bool{}
+	}
+	notificationStreams.streams[user.UniqueID][ch] = true
+	notificationStreams.Unlock()
+	defer func() {
+		notificationStreams.Lock()
+		delete(notificationStreams.streams[user.UniqueID], ch)
+		if len(notificationStreams.streams[user.UniqueID]) == 0 {
+			delete(notificationStreams.streams, user.UniqueID)
+		}
+		notificationStreams.Unlock()
+	}()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	fmt.Fprintf(w, "data: %d\n\n", unreadNotifications(ctx, user))
+	flusher.Flush()
+	keepAlive := time.NewTicker(streamKeepAlive)
+	defer keepAlive.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ch:
+			fmt.Fprintf(w, "data: %d\n\n", unreadNotifications(ctx, user))
+		case <-keepAlive.C:
+			fmt.Fprint(w, ": keep-alive\n\n")
+		}
+		flusher.Flush()
+	}
+}
+
+// unreadNotifications counts the notifications the user hasn't read yet
+func unreadNotifications(ctx context.Context, user *User) int {
+	if user == nil {
+		return 0
+	}
+	var n int
+	if err := db.QueryRowContext(ctx, "select count(*) from notifications where user_id = ? and read_at is null", user.UniqueID).Scan(&n); err != nil {
+		return 0
+	}
+	return n
+}
+
+// notificationsPage is the data of the notifications page
+type notificationsPage struct {
+	Notes    []notification
+	Calendar string // url of the calendar of the user
+}
+
+// serve /notifications, the latest notifications of the user, which become read
+func serveNotifications(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	user := requireUser(w, r)
+	if user == nil {
+		return
+	}
+	rows, err := db.QueryContext(ctx, `select id, message, coalesce(link, ''), created_at, read_at from notifications
+		where user_id = ? order by id desc limit ?`, user.UniqueID, notificationsPerPage)
+	if err != nil {
+		serverError(w, r, err)
+		return
+	}
+	defer rows.Close()
+	var p notificationsPage
+	for rows.Next() {
+		var n notification
+		var read sql.NullString
+		if err := rows.Scan(&n.ID, &n.Message, &n.Link, &n.Created, &read); err != nil {
+			serverError(w, r, err)
+			return
+		}
+		n.Read = read.Valid
+		p.Notes = append(p.Notes, n)
+	}
+	rows.Close()
+	_, err = db.ExecContext(ctx, "update notifications set read_at = ? where user_id = ? and read_at is null",
+		time.Now().Format(timestampLayout), user.UniqueID)
+	if err != nil {
+		serverError(w, r, err)
+		return
+	}
+	// the other pages of the user drop their count
+	publish("notification", []byte(strconv.Itoa(user.UniqueID)))
+	if p.Calendar, err = calendarURL(ctx, user); err != nil {
+		serverError(w, r, err)
+		return
+	}
+	render(w, r, "notifications.html", p)
+}
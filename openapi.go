@@ -0,0 +1,314 @@
+package main
+
+import (
+	"net/http"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// the endpoints of /api/v1/ are declared once, in apiEndpoints: apiRoutes routes them and
+// /api/v1/openapi.json describes them from the same table, with the schemas of the requests
+// and responses read from the Go types the handlers encode. /api/docs shows the description
+// in Swagger UI, where requests can be tried with the session of the user
+
+// apiEndpoint is a path of the API, with the handler of the mux pattern it falls under
+type apiEndpoint struct {
+	Path       string // in the OpenAPI form, like /api/v1/drafts/answer/{question_id}
+	Pattern    string // of the mux, shared by the paths a handler parses itself
+	Handler    http.HandlerFunc
+	Operations []apiOperation
+}
+
+// apiOperation is a method of an endpoint
+type apiOperation struct {
+	Method   string
+	Summary  string
+	Params   []apiParam
+	Body     interface{} // a value of the type of the request body, nil without a body
+	Response interface{} // a value of the type of the response, nil without content
+	Status   int         // of a success, 200 when unset
+	Errors   []int       // statuses of the errors specific to the operation
+	Login    bool        // the user must be logged in
+}
+
+// apiParam is a parameter in the path or the query of an operation
+type apiParam struct {
+	Name        string
+	In          string // path or query
+	Description string
+}
+
+// the endpoints of /api/v1/
+var apiEndpoints = []apiEndpoint{
+	{"/api/v1/questions", "/api/v1/questions", serveQuestionsAPI, []apiOperation{{
+		Method:  http.MethodGet,
+		Summary: "A page of the questions, in the order of the tabs of the question list",
+		Params: []apiParam{
+			{"sort", "query", "newest, foryou, active, hot, votes, answers, views or featured, newest by default"},
+			{"page", "query", "number of the page, from 1"},
+			{"cursor", "query", "the next_cursor of the previous page, instead of a page number; it keeps its place as questions are asked"},
+		},
+		Response: apiQuestionList{},
+		Errors:   []int{http.StatusUnprocessableEntity},
+	}}},
+	{"/api/v1/search", "/api/v1/search", serveSearchAPI, []apiOperation{{
+		Method:  http.MethodGet,
+		Summary: "A page of the questions matching a search, newest first, with snippets of their text highlighting the words searched",
+		Params: []apiParam{
+			{"q", "query", `the search, with the syntax of the search page: words, "phrases", tag:, user:, is:, answers: and score:`},
+			{"page", "query", "number of the page, from 1"},
+		},
+		Response: apiSearchResults{},
+		Errors:   []int{http.StatusUnprocessableEntity},
+	}}},
+	{"/api/v1/questions/similar", "/api/v1/questions/similar", serveSimilarQuestions, []apiOperation{{
+		Method:   http.MethodGet,
+		Summary:  "Questions whose heading looks like a title, to find duplicates while asking",
+		Params:   []apiParam{{"title", "query", "the heading being written"}},
+		Response: similarResults{},
+	}}},
+	{"/api/v1/quickfind", "/api/v1/quickfind", serveQuickfind, []apiOperation{{
+		Method:   http.MethodGet,
+		Summary:  "Questions, tags, users and pages matching a few letters, for the quick switcher",
+		Params:   []apiParam{{"q", "query", "what was typed"}},
+		Response: quickfindResults{},
+	}}},
+	{"/api/v1/autocomplete", "/api/v1/autocomplete", serveAutocomplete, []apiOperation{{
+		Method:   http.MethodGet,
+		Summary:  "Titles, tags and usernames starting with what was typed, the most popular first, for the search box",
+		Params:   []apiParam{{"q", "query", "what was typed"}},
+		Response: suggestions{},
+	}}},
+	{"/api/v1/related-tags", "/api/v1/related-tags", serveRelatedTags, []apiOperation{{
+		Method:   http.MethodGet,
+		Summary:  "The tags most often on questions with the given ones, to suggest more tags while asking",
+		Params:   []apiParam{{"tags", "query", "comma separated tags"}},
+		Response: relatedTags{},
+	}}},
+	{"/api/v1/drafts", "/api/v1/drafts", serveDrafts, []apiOperation{{
+		Method:   http.MethodGet,
+		Summary:  "The drafts of the user, the latest first",
+		Response: draftList{},
+		Login:    true,
+	}}},
+	{"/api/v1/drafts/question", "/api/v1/drafts/", serveDrafts, []apiOperation{
+		{Method: http.MethodGet, Summary: "The draft of a question", Response: draft{}, Errors: []int{http.StatusNotFound}, Login: true},
+		{Method: http.MethodPut, Summary: "Save the draft of a question, an empty one discards it", Body: draft{}, Response: draft{}, Login: true},
+		{Method: http.MethodDelete, Summary: "Discard the draft of a question", Status: http.StatusNoContent, Login: true},
+	}},
+	{"/api/v1/drafts/answer/{question_id}", "/api/v1/drafts/", serveDrafts, []apiOperation{
+		{Method: http.MethodGet, Summary: "The draft of an answer to a question", Params: questionIDParam, Response: draft{}, Errors: []int{http.StatusNotFound}, Login: true},
+		{Method: http.MethodPut, Summary: "Save the draft of an answer, an empty one discards it", Params: questionIDParam, Body: draft{}, Response: draft{}, Errors: []int{http.StatusNotFound}, Login: true},
+		{Method: http.MethodDelete, Summary: "Discard the draft of an answer", Params: questionIDParam, Status: http.StatusNoContent, Errors: []int{http.StatusNotFound}, Login: true},
+	}},
+	{"/api/v1/preferences", "/api/v1/preferences", servePreferencesAPI, []apiOperation{
+		{Method: http.MethodGet, Summary: "The preferences of the user", Response: preferences{}, Login: true},
+		{Method: http.MethodPut, Summary: "Change the preferences of the user, the fields left out keep their value", Body: preferences{}, Response: preferences{}, Errors: []int{http.StatusUnprocessableEntity}, Login: true},
+	}},
+	{"/api/v1/courses", "/api/v1/courses", serveCoursesAPI, []apiOperation{{
+		Method:   http.MethodGet,
+		Summary:  "The courses of the user, with their codes for those they teach",
+		Response: courseList{},
+		Login:    true,
+	}}},
+	{"/api/v1/tags/{name}", "/api/v1/tags/", serveTagExcerpt, []apiOperation{{
+		Method:   http.MethodGet,
+		Summary:  "The excerpt of the wiki of a tag, following synonyms",
+		Params:   []apiParam{{"name", "path", "name of the tag"}},
+		Response: tagExcerpt{},
+		Errors:   []int{http.StatusNotFound},
+	}}},
+	{"/api/v1/users/{name}/reputation", "/api/v1/users/", serveReputationAPI, []apiOperation{{
+		Method:   http.MethodGet,
+		Summary:  "Where the reputation of a user came from, by day and by post, for the user and moderators",
+		Params:   []apiParam{{"name", "path", "username"}},
+		Response: reputationHistory{},
+		Errors:   []int{http.StatusForbidden, http.StatusNotFound},
+		Login:    true,
+	}}},
+}
+
+var questionIDParam = []apiParam{{"question_id", "path", "id of the question answered"}}
+
+// apiErrorResponse is the body of the errors of the API
+type apiErrorResponse struct {
+	Error apiError `json:"error"`
+}
+
+// the description of the API, built on its first request
+var (
+	openAPIOnce sync.Once
+	openAPIDoc  map[string]interface{}
+)
+
+// serve /api/v1/openapi.json, the OpenAPI 3 description of the API
+func serveOpenAPI(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	openAPIOnce.Do(func() {
+		openAPIDoc = openAPIDocument(apiEndpoints)
+	})
+	writeJSON(w, http.StatusOK, openAPIDoc)
+}
+
+// serve /api/docs, the page trying the API in Swagger UI
+func serveAPIDocs(w http.ResponseWriter, r *http.Request) {
+	render(w, r, "api-docs.html", nil)
+}
+
+// openAPIDocument describes the endpoints in OpenAPI 3
+func openAPIDocument(endpoints []apiEndpoint) map[string]interface{} {
+	schemas := map[string]interface{}{}
+	errorSchema := jsonSchema(reflect.TypeOf(apiErrorResponse{}), schemas)
+	paths := map[string]interface{}{}
+	for _, e := range endpoints {
+		item := map[string]interface{}{}
+		for _, op := range e.Operations {
+			item[strings.ToLower(op.Method)] = openAPIOperation(op, errorSchema, schemas)
+		}
+		paths[e.Path] = item
+	}
+	return map[string]interface{}{
+		"openapi": "3.0.3",
+		"info": map[string]interface{}{
+			"title":       "QA Learning API",
+			"version":     apiVersion,
+			"description": "Changes to v1 are additive: clients ignore the fields they don't know.",
+		},
+		"paths": paths,
+		"components": map[string]interface{}{
+			"schemas": schemas,
+			"securitySchemes": map[string]interface{}{
+				"session": map[string]interface{}{"type": "apiKey", "in": "cookie", "name": sessionCookie},
+				"apiKey": map[string]interface{}{"type": "http", "scheme": "bearer",
+					"description": "an API key made at /settings/api-keys; read keys only make GET requests"},
+			},
+		},
+	}
+}
+
+// openAPIOperation describes an operation, with the errors every operation can answer
+func openAPIOperation(op apiOperation, errorSchema interface{}, schemas map[string]interface{}) map[string]interface{} {
+	o := map[string]interface{}{"summary": op.Summary}
+	var params []interface{}
+	for _, p := range op.Params {
+		params = append(params, map[string]interface{}{
+			"name":        p.Name,
+			"in":          p.In,
+			"description": p.Description,
+			"required":    p.In == "path",
+			"schema":      map[string]interface{}{"type": "string"},
+		})
+	}
+	if params != nil {
+		o["parameters"] = params
+	}
+	if op.Body != nil {
+		o["requestBody"] = map[string]interface{}{
+			"required": true,
+			"content":  jsonContent(jsonSchema(reflect.TypeOf(op.Body), schemas)),
+		}
+	}
+	status := op.Status
+	if status == 0 {
+		status = http.StatusOK
+	}
+	success := map[string]interface{}{"description": http.StatusText(status)}
+	if op.Response != nil {
+		success["content"] = jsonContent(jsonSchema(reflect.TypeOf(op.Response), schemas))
+	}
+	responses := map[string]interface{}{strconv.Itoa(status): success}
+	errors := append([]int{http.StatusMethodNotAllowed, http.StatusNotAcceptable, http.StatusInternalServerError}, op.Errors...)
+	if op.Body != nil {
+		errors = append(errors, http.StatusBadRequest, http.StatusUnsupportedMediaType)
+	}
+	if op.Login {
+		errors = append(errors, http.StatusUnauthorized)
+		o["security"] = []interface{}{map[string]interface{}{"session": []string{}}, map[string]interface{}{"apiKey": []string{}}}
+	}
+	for _, status := range errors {
+		responses[strconv.Itoa(status)] = map[string]interface{}{
+			"description": http.StatusText(status) + ", error code " + apiErrorCodes[status],
+			"content":     jsonContent(errorSchema),
+		}
+	}
+	o["responses"] = responses
+	return o
+}
+
+func jsonContent(schema interface{}) map[string]interface{} {
+	return map[string]interface{}{"application/json": map[string]interface{}{"schema": schema}}
+}
+
+// jsonSchema returns the schema of the JSON encoding of the type. Structs are added to
+// schemas, by the name of their type, and referred to
+func jsonSchema(t reflect.Type, schemas map[string]interface{}) map[string]interface{} {
+	switch t.Kind() {
+	case reflect.Ptr:
+		return jsonSchema(t.Elem(), schemas)
+	case reflect.Bool:
+		return map[string]interface{}{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return map[string]interface{}{"type": "integer"}
+	case reflect.Float32, reflect.Float64:
+		return map[string]interface{}{"type": "number"}
+	case reflect.String:
+		return map[string]interface{}{"type": "string"}
+	case reflect.Slice, reflect.Array:
+		return map[string]interface{}{"type": "array", "items": jsonSchema(t.Elem(), schemas)}
+	case reflect.Map:
+		return map[string]interface{}{"type": "object", "additionalProperties": jsonSchema(t.Elem(), schemas)}
+	case reflect.Struct:
+		name := schemaName(t)
+		ref := map[string]interface{}{"$ref": "#/components/schemas/" + name}
+		if _, ok := schemas[name]; ok {
+			return ref
+		}
+		// set before the fields, for the types that contain themselves
+		schemas[name] = nil
+		properties := map[string]interface{}{}
+		var required []string
+		for i := 0; i < t.NumField(); i++ {
+			f := t.Field(i)
+			if f.PkgPath != "" {
+				continue
+			}
+			tag := f.Tag.Get("json")
+			if tag == "-" {
+				continue
+			}
+			fieldName, options, _ := strings.Cut(tag, ",")
+			if fieldName == "" {
+				fieldName = f.Name
+			}
+			properties[fieldName] = jsonSchema(f.Type, schemas)
+			if !strings.Contains(","+options+",", ",omitempty,") {
+				required = append(required, fieldName)
+			}
+		}
+		schema := map[string]interface{}{"type": "object", "properties": properties}
+		if required != nil {
+			sort.Strings(required)
+			schema["required"] = required
+		}
+		schemas[name] = schema
+		return ref
+	}
+	// interfaces, and what JSON can't encode, may be anything
+	return map[string]interface{}{}
+}
+
+// schemaName names the schema of a struct after its type, like similarQuestion is SimilarQuestion
+func schemaName(t reflect.Type) string {
+	name := t.Name()
+	if name == "" {
+		return "Object"
+	}
+	return strings.ToUpper(name[:1]) + name[1:]
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// question pages are the same for every visitor who isn't logged in, so they are kept rendered
+// for them, in the CacheStore of CACHE_STORE. Any write to a thread bumps the revision of its
+// question, which drops the page. view counts on cached pages lag behind, as counting a view
+// doesn't change the revision. A page rendered while another instance wrote to the thread may be
+// cached before that instance's event arrives, which the expiry of pages bounds
+
+// most question pages kept in memory, and longest a page is kept
+const (
+	pageCacheSize = 500
+	pageCacheTTL  = 10 * time.Minute
+)
+
+// pageCache caches rendered pages by question id
+type pageCache struct {
+	store CacheStore
+
+	mu        sync.Mutex
+	revisions map[int]int // revision of the questions written to since startup
+	cleared   int         // times the whole cache was cleared
+}
+
+var questionCache = newPageCache(memoryCache{newLRUCache(pageCacheSize, pageCacheTTL)})
+
+func newPageCache(store CacheStore) *pageCache {
+	return &pageCache{store: store, revisions: map[int]int{}}
+}
+
+// pageKey is the key of the page of a question in the store
+func pageKey(questionID int) string {
+	return "page:" + strconv.Itoa(questionID)
+}
+
+// revision is the current revision of the question, to be given back to put.
+// both counts only grow, so their sum changes with any of them
+func (c *pageCache) revision(questionID int) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.cleared + c.revisions[questionID]
+}
+
+// get returns the page of the question, if it is cached
+func (c *pageCache) get(ctx context.Context, questionID int) ([]byte, bool) {
+	body, ok, err := c.store.Get(ctx, pageKey(questionID))
+	if err != nil {
+		fmt.Println(err)
+	}
+	return body, ok
+}
+
+// put caches the page of the question rendered at revision, unless the thread changed since
+func (c *pageCache) put(ctx context.Context, questionID, revision int, body []byte) {
+	if c.revision(questionID) != revision {
+		return
+	}
+	if err := c.store.Set(ctx, pageKey(questionID), body, pageCacheTTL); err != nil {
+		fmt.Println(err)
+	}
+}
+
+// invalidate drops the page of the question after a write to its thread, on every instance
+func (c *pageCache) invalidate(questionID int) {
+	publishCacheEvent(cacheEvent{Cache: "pages", Thread: questionID})
+}
+
+// clear drops every page, after writes touching many threads like a rename, on every instance
+func (c *pageCache) clear() {
+	publishCacheEvent(cacheEvent{Cache: "pages", Clear: true})
+}
+
+// apply handles an event of the page cache on this instance. The data of the threads goes with
+// their pages. Each instance drops the pages from the store, which is shared or its own
+func (c *pageCache) apply(e cacheEvent) {
+	c.mu.Lock()
+	if e.Clear {
+		c.cleared++
+	} else {
+		c.revisions[e.Thread]++
+	}
+	c.mu.Unlock()
+	ctx := context.Background()
+	var err error
+	if e.Clear {
+		dataCache.clear()
+		err = c.store.Clear(ctx)
+	} else {
+		dataCache.remove(threadKeys(e.Thread)...)
+		err = c.store.Delete(ctx, pageKey(e.Thread))
+	}
+	if err != nil {
+		fmt.Println(err)
+	}
+}
+
+// captureWriter keeps a copy of a successful response while writing it
+type captureWriter struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+func (w *captureWriter) WriteHeader(status int) {
+	w.status = status
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *captureWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	if w.status == http.StatusOK {
+		w.body.Write(b)
+	}
+	return w.ResponseWriter.Write(b)
+}
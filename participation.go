@@ -0,0 +1,177 @@
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// the participation of the students of a course is downloaded as CSV from
+// /dashboard/participation.csv, or written by qaapp participation, for gradebooks. Both take the
+// course, the period and the columns, which are all of participationColumns by default. The
+// username always comes first, to match the rows with the students
+
+// participationColumn is a column of the CSV
+type participationColumn struct {
+	Name  string
+	Value func(p participation) string
+}
+
+// participationColumns are the columns the CSV can have, in their order
+var participationColumns = []participationColumn{
+	{"name", func(p participation) string { return p.Name }},
+	{"email", func(p participation) string { return p.Email }},
+	{"questions", func(p participation) string { return strconv.Itoa(p.Questions) }},
+	{"answers", func(p participation) string { return strconv.Itoa(p.Answers) }},
+	{"comments", func(p participation) string { return strconv.Itoa(p.Comments) }},
+	{"upvotes", func(p participation) string { return strconv.Itoa(p.Upvotes) }},
+	{"accepted", func(p participation) string { return strconv.Itoa(p.Accepted) }},
+	{"last_active", func(p participation) string { return p.LastActive }},
+}
+
+// parseParticipationColumns reads a comma-separated list of columns, all of them when empty
+func parseParticipationColumns(list string) ([]participationColumn, error) {
+	if strings.TrimSpace(list) == "" {
+		return participationColumns, nil
+	}
+	chosen := map[string]bool{}
+	for _, name := range strings.Split(list, ",") {
+		name = strings.ToLower(strings.TrimSpace(name))
+		if name == "" || name == "username" {
+			continue
+		}
+		found := false
+		for _, c := range participationColumns {
+			found = found || c.Name == name
+		}
+		if !found {
+			return nil, fmt.Errorf("unknown column %q, the columns are %s", name, participationColumnNames())
+		}
+		chosen[name] = true
+	}
+	var columns []participationColumn
+	for _, c := range participationColumns {
+		if chosen[c.Name] {
+			columns = append(columns, c)
+		}
+	}
+	return columns, nil
+}
+
+// participationColumnNames lists the names of the columns, for errors and help
+func participationColumnNames() string {
+	names := make([]string, len(participationColumns))
+	for i, c := range participationColumns {
+		names[i] = c.Name
+	}
+	return strings.Join(names, ", ")
+}
+
+// writeParticipationCSV writes the participation of the scope with the columns
+func writeParticipationCSV(ctx context.Context, w io.Writer, s analyticsScope, columns []participationColumn) error {
+	students, err := participationOf(ctx, s)
+	if err != nil {
+		return err
+	}
+	out := csv.NewWriter(w)
+	header := []string{"username"}
+	for _, c := range columns {
+		header = append(header, c.Name)
+	}
+	out.Write(header)
+	for _, p := range students {
+		row := []string{p.UserName}
+		for _, c := range columns {
+			row = append(row, c.Value(p))
+		}
+		out.Write(row)
+	}
+	out.Flush()
+	return out.Error()
+}
+
+// serve /dashboard/participation.csv, the participation of the students of a course as CSV, with
+// the course, from, to and columns parameters
+func serveParticipationCSV(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	user := requireUser(w, r)
+	if user == nil {
+		return
+	}
+	if !staff(user) {
+		http.Error(w, "the dashboard is for teachers", http.StatusForbidden)
+		return
+	}
+	s, _, ok, err := dashboardScope(ctx, r, user)
+	if err != nil {
+		serverError(w, r, err)
+		return
+	}
+	if !ok {
+		http.Error(w, "you don't teach this course", http.StatusForbidden)
+		return
+	}
+	// the checkboxes of the dashboard send a column each, the command line a list
+	r.ParseForm()
+	columns, err := parseParticipationColumns(strings.Join(r.Form["columns"], ","))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="participation-%d-%s-%s.csv"`, s.Course, s.From, s.To))
+	if err := writeParticipationCSV(ctx, w, s, columns); err != nil {
+		fmt.Println(err)
+	}
+}
+
+// runParticipation runs the participation command
+func runParticipation(ctx context.Context, args []string) error {
+	flags := flag.NewFlagSet("participation", flag.ExitOnError)
+	courseID := flags.Int("course", 0, "id of the course, 0 for all the students of the site")
+	from := flags.String("from", time.Now().AddDate(0, 0, -29).Format(dateLayout), "first day counted")
+	to := flags.String("to", time.Now().Format(dateLayout), "last day counted")
+	list := flags.String("columns", "", "columns after the username, among "+participationColumnNames()+", all by default")
+	out := flags.String("out", "", "file to write the CSV to, the standard output by default")
+	flags.Parse(args)
+
+	for _, day := range []string{*from, *to} {
+		if _, err := time.Parse(dateLayout, day); err != nil {
+			return fmt.Errorf("%q isn't a date like 2024-09-01", day)
+		}
+	}
+	if *to < *from {
+		return errors.New("-to is before -from")
+	}
+	if *courseID != 0 {
+		c, err := courseByID(ctx, nil, *courseID)
+		if err != nil {
+			return err
+		}
+		if c == nil {
+			return fmt.Errorf("there is no course %d", *courseID)
+		}
+	}
+	columns, err := parseParticipationColumns(*list)
+	if err != nil {
+		return err
+	}
+	var w io.Writer = os.Stdout
+	if *out != "" {
+		f, err := os.Create(*out)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		w = f
+	}
+	return writeParticipationCSV(ctx, w, analyticsScope{Course: *courseID, From: *from, To: *to}, columns)
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// users set their preferences on /settings/preferences or through /api/v1/preferences.
+// every page gets the preferences of its user, or the defaults for visitors
+
+// preferences are the settings of a user that change how the site looks and mails them
+type preferences struct {
+	EmailOptIn     bool   `json:"email_opt_in"`     // notification and digest emails are sent
+	Digest         string `json:"digest"`           // "", "daily" or "weekly", kept in users.digest
+	QuestionSort   string `json:"question_sort"`    // name of the sort of the question list
+	AnswersPerPage int    `json:"answers_per_page"` // answers shown at once on a question page
+	Theme          string `json:"theme"`
+}
+
+var defaultPreferences = preferences{EmailOptIn: true, QuestionSort: forYouSort, AnswersPerPage: 30, Theme: "light"}
+
+// themes of the pages
+var themes = []string{"light", "dark"}
+
+// bounds of the answers per page
+const (
+	minAnswersPerPage = 5
+	maxAnswersPerPage = 100
+)
+
+var errBadPreferences = errors.New("invalid preferences")
+
+// loadPreferences loads the preferences of the user, the defaults for visitors
+func loadPreferences(ctx context.Context, user *User) (preferences, error) {
+	p := defaultPreferences
+	if user == nil {
+		return p, nil
+	}
+	err := db.QueryRowContext(ctx, "select coalesce(digest, '') from users where id = ?", user.UniqueID).Scan(&p.Digest)
+	if err != nil {
+		return p, err
+	}
+	err = db.QueryRowContext(ctx, "select email_opt_in, question_sort, answers_per_page, theme from user_preferences where user_id = ?",
+		user.UniqueID).Scan(&p.EmailOptIn, &p.QuestionSort, &p.AnswersPerPage, &p.Theme)
+	if err == sql.ErrNoRows {
+		return p, nil
+	}
+	return p, err
+}
+
+// validate checks the preferences, telling what is wrong with each of their fields
+func (p preferences) validate() error {
+	errs := fieldErrors{}
+	if _, ok := digestPeriods[p.Digest]; !ok && p.Digest != "" {
+		errs["digest"] = "the digest is daily, weekly or empty"
+	}
+	if findQuestionSort(p.QuestionSort).Name != p.QuestionSort {
+		errs["question_sort"] = "unknown question sort"
+	}
+	if p.AnswersPerPage < minAnswersPerPage || p.AnswersPerPage > maxAnswersPerPage {
+		errs["answers_per_page"] = "answers per page go from " + strconv.Itoa(minAnswersPerPage) + " to " + strconv.Itoa(maxAnswersPerPage)
+	}
+	errs["theme"] = "unknown theme"
+	for _, t := range themes {
+		if t == p.Theme {
+			delete(errs, "theme")
+		}
+	}
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+// savePreferences stores valid preferences of the user
+func savePreferences(ctx context.Context, userID int, p preferences) error {
+	return db.WithTx(ctx, func(ctx context.Context) error {
+		_, err := db.ExecContext(ctx, `insert or replace into user_preferences (user_id, email_opt_in, question_sort, answers_per_page, theme, updated_at)
+			values (?, ?, ?, ?, ?, ?)`, userID, p.EmailOptIn, p.QuestionSort, p.AnswersPerPage, p.Theme, time.Now().Format(timestampLayout))
+		if err != nil {
+			return err
+		}
+		_, err = db.ExecContext(ctx, "update users set digest = ? where id = ?", p.Digest, userID)
+		return err
+	})
+}
+
+// emailOptedIn tells if the user accepts notification emails
+func emailOptedIn(ctx context.Context, userID int) (bool, error) {
+	optIn := defaultPreferences.EmailOptIn
+	err := db.QueryRowContext(ctx, "select email_opt_in from user_preferences where user_id = ?", userID).Scan(&optIn)
+	if err == sql.ErrNoRows {
+		return optIn, nil
+	}
+	return optIn, err
+}
+
+// preferencesForm is the data of the preferences page
+type preferencesForm struct {
+	Prefs  preferences
+	Sorts  []questionSort
+	Themes []string
+	Saved  bool
+	Error  string
+}
+
+// serve /settings/preferences
+func servePreferences(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	user := requireUser(w, r)
+	if user == nil {
+		return
+	}
+	form := preferencesForm{Sorts: questionSorts, Themes: themes}
+	var err error
+	if form.Prefs, err = loadPreferences(ctx, user); err != nil {
+		serverError(w, r, err)
+		return
+	}
+	if r.Method == http.MethodPost {
+		perPage, _ := strconv.Atoi(r.FormValue("answers_per_page"))
+		form.Prefs = preferences{
+			EmailOptIn:     r.FormValue("email_opt_in") == "1",
+			Digest:         r.FormValue("digest"),
+			QuestionSort:   r.FormValue("question_sort"),
+			AnswersPerPage: perPage,
+			Theme:          r.FormValue("theme"),
+		}
+		if err := form.Prefs.validate(); err != nil {
+			form.Error = err.Error()
+			render(w, r, "preferences.html", form)
+			return
+		}
+		if err := savePreferences(ctx, user.UniqueID, form.Prefs); err != nil {
+			serverError(w, r, err)
+			return
+		}
+		form.Saved = true
+	}
+	render(w, r, "preferences.html", form)
+}
+
+// serve /api/v1/preferences, the preferences of the user, read with GET and replaced with PUT
+func servePreferencesAPI(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	user := currentUser(r)
+	if user == nil {
+		writeJSONError(w, http.StatusUnauthorized, "log in to have preferences")
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+		p, err := loadPreferences(ctx, user)
+		if err != nil {
+			writeInternalError(w, r, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, p)
+	case http.MethodPut:
+		// fields left out keep their current value
+		p, err := loadPreferences(ctx, user)
+		if err != nil {
+			writeInternalError(w, r, err)
+			return
+		}
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<16)).Decode(&p); err != nil {
+			writeJSONError(w, http.StatusBadRequest, errBadPreferences.Error()+": not valid JSON")
+			return
+		}
+		if err := p.validate(); err != nil {
+			fields, _ := err.(fieldErrors)
+			writeAPIError(w, http.StatusUnprocessableEntity, apiError{Message: errBadPreferences.Error(), Fields: fields})
+			return
+		}
+		if err := savePreferences(ctx, user.UniqueID, p); err != nil {
+			writeInternalError(w, r, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, p)
+	default:
+		writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
+	}
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+)
+
+// moderators protect the questions drawing answers that aren't, like "thanks" or "me too" on a
+// popular question: only the users with PROTECTED_ANSWER_REPUTATION reputation, 10 by default,
+// and moderators may then answer them. The question page tells the others why they can't
+
+const defaultProtectedAnswerReputation = 10
+
+// protectedAnswerReputation is the reputation needed to answer protected questions
+func protectedAnswerReputation() int {
+	if n, err := strconv.Atoi(os.Getenv("PROTECTED_ANSWER_REPUTATION")); err == nil && n >= 0 {
+		return n
+	}
+	return defaultProtectedAnswerReputation
+}
+
+// protection is the protection of a question
+type protection struct {
+	At         string
+	By         string // moderator who protected the question
+	Reputation int    // needed to answer
+}
+
+// questionProtection is the protection of the question, nil if it isn't protected
+func questionProtection(ctx context.Context, questionID int) (*protection, error) {
+	var at, by sql.NullString
+	err := db.QueryRowContext(ctx, `select protected_at, users.username from questions
+		left join users on users.id = questions.protected_by where questions.id = ?`, questionID).Scan(&at, &by)
+	if err == sql.ErrNoRows || (err == nil && !at.Valid) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &protection{At: at.String, By: by.String, Reputation: protectedAnswerReputation()}, nil
+}
+
+// canAnswer tells if the user may answer the question, which they can't when it is protected
+// and they lack the reputation
+func canAnswer(ctx context.Context, user *User, questionID int) (bool, error) {
+	if user == nil {
+		return false, nil
+	}
+	if isModerator(user) {
+		return true, nil
+	}
+	p, err := questionProtection(ctx, questionID)
+	if err != nil || p == nil {
+		return err == nil, err
+	}
+	rep, err := reputation(ctx, user)
+	return rep >= p.Reputation, err
+}
+
+// requireAnswerable answers 403 and returns false when the user may not answer the protected question
+func requireAnswerable(w http.ResponseWriter, r *http.Request, user *User, questionID int) bool {
+	ok, err := canAnswer(r.Context(), user, questionID)
+	if err != nil {
+		serverError(w, r, err)
+		return false
+	}
+	if !ok {
+		http.Error(w, fmt.Sprintf("this question is protected, answering it takes %d reputation", protectedAnswerReputation()), http.StatusForbidden)
+		return false
+	}
+	return true
+}
+
+// handle POST /questions/{id}/protect, where moderators protect a question, or with action=unprotect
+// lift its protection
+func serveProtect(w http.ResponseWriter, r *http.Request, questionID int) {
+	ctx := r.Context()
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	user := requireUser(w, r)
+	if user == nil {
+		return
+	}
+	if !isModerator(user) {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+	protect := r.FormValue("action") != "unprotect"
+	var err error
+	if protect {
+		_, err = db.ExecContext(ctx, "update questions set protected_at = ?, protected_by = ? where id = ? and protected_at is null",
+			time.Now().Format(timestampLayout), user.UniqueID, questionID)
+	} else {
+		_, err = db.ExecContext(ctx, "update questions set protected_at = null, protected_by = null where id = ?", questionID)
+	}
+	if err == nil {
+		err = recordAudit(ctx, user, auditProtectQuestion, postQuestion, strconv.Itoa(questionID),
+			map[string]bool{"protected": !protect}, map[string]bool{"protected": protect})
+	}
+	if err != nil {
+		serverError(w, r, err)
+		return
+	}
+	http.Redirect(w, r, fmt.Sprintf("/questions/%d", questionID), http.StatusSeeOther)
+}
@@ -0,0 +1,54 @@
+// show the answers of a question a page at a time, as many as the user's preferences say.
+// the page holding the answer or comment linked in the URL is shown first
+(function () {
+    var list = document.getElementById('answers');
+    if (!list) {
+        return;
+    }
+    var perPage = parseInt(list.dataset.perPage, 10);
+    var answers = Array.prototype.slice.call(list.querySelectorAll(':scope > .answer-thread'));
+    if (!perPage || answers.length <= perPage) {
+        return;
+    }
+    var pages = Math.ceil(answers.length / perPage);
+    var nav = document.createElement('p');
+    nav.className = 'answers-pages';
+    list.appendChild(nav);
+
+    function show(page) {
+        answers.forEach(function (answer, i) {
+            answer.hidden = Math.floor(i / perPage) !== page;
+        });
+        nav.textContent = '';
+        for (var p = 0; p < pages; p++) {
+            var button = document.createElement('button');
+            button.type = 'button';
+            button.textContent = p + 1;
+            button.disabled = p === page;
+            button.addEventListener('click', show.bind(null, p));
+            nav.appendChild(button);
+        }
+    }
+
+    function pageOfHash() {
+        var target = location.hash && document.getElementById(location.hash.slice(1));
+        for (var i = 0; target && i < answers.length; i++) {
+            if (answers[i].contains(target)) {
+                return Math.floor(i / perPage);
+            }
+        }
+        return 0;
+    }
+
+    // the browser can't scroll to a hidden answer, so it's done once its page is shown
+    function showHash() {
+        show(pageOfHash());
+        var target = location.hash && document.getElementById(location.hash.slice(1));
+        if (target) {
+            target.scrollIntoView();
+        }
+    }
+
+    window.addEventListener('hashchange', showHash);
+    showHash();
+})();
@@ -0,0 +1,89 @@
+// warn while typing a question title that it may already have been asked
+(function () {
+    var title = document.querySelector('#ask input[name="heading"]');
+    var box = document.getElementById('similar');
+    if (!title || !box) {
+        return;
+    }
+    var timer;
+    title.addEventListener('input', function () {
+        clearTimeout(timer);
+        timer = setTimeout(lookup, 400);
+    });
+
+    function lookup() {
+        if (title.value.trim().length < 10) {
+            box.hidden = true;
+            return;
+        }
+        fetch('/api/v1/questions/similar?title=' + encodeURIComponent(title.value))
+            .then(function (res) { return res.json(); })
+            .then(function (data) {
+                var list = box.querySelector('ul');
+                list.textContent = '';
+                (data.questions || []).forEach(function (q) {
+                    var item = document.createElement('li');
+                    var link = document.createElement('a');
+                    link.href = q.url;
+                    link.target = '_blank';
+                    link.textContent = q.title;
+                    item.appendChild(link);
+                    item.appendChild(document.createTextNode(' (' + q.answers + ' answers)'));
+                    list.appendChild(item);
+                });
+                box.hidden = list.children.length === 0;
+            })
+            .catch(function () {
+                box.hidden = true;
+            });
+    }
+})();
+
+// suggest the tags often used with those chosen, adding one when it is clicked
+(function () {
+    var input = document.querySelector('#ask input[name="tags"]');
+    var box = document.getElementById('related-tags');
+    if (!input || !box) {
+        return;
+    }
+    var timer;
+    input.addEventListener('input', function () {
+        clearTimeout(timer);
+        timer = setTimeout(lookup, 400);
+    });
+    lookup();
+
+    function chosen() {
+        return input.value.split(',').map(function (t) { return t.trim().toLowerCase(); })
+            .filter(function (t) { return t !== ''; });
+    }
+
+    function lookup() {
+        var tags = chosen();
+        if (tags.length === 0) {
+            box.hidden = true;
+            return;
+        }
+        fetch('/api/v1/related-tags?tags=' + encodeURIComponent(tags.join(',')))
+            .then(function (res) { return res.json(); })
+            .then(function (data) {
+                var list = box.querySelector('span');
+                list.textContent = '';
+                (data.tags || []).forEach(function (tag) {
+                    var button = document.createElement('button');
+                    button.type = 'button';
+                    button.className = 'related-tag';
+                    button.textContent = tag.name;
+                    button.addEventListener('click', function () {
+                        input.value = chosen().concat(tag.name).join(', ');
+                        lookup();
+                    });
+                    list.appendChild(button);
+                });
+                box.hidden = list.children.length === 0;
+            })
+            .catch(function () {
+                box.hidden = true;
+            });
+    }
+})();
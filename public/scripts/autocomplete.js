@@ -0,0 +1,77 @@
+// suggest titles, tags and users under the search box as the user types.
+// answers to earlier letters arriving late are dropped
+(function () {
+    var form = document.getElementById('search');
+    if (!form) {
+        return;
+    }
+    var input = form.querySelector('input[name=q]');
+    var list = document.createElement('ul');
+    list.className = 'search-suggestions';
+    list.hidden = true;
+    form.appendChild(list);
+    input.setAttribute('autocomplete', 'off');
+
+    var timer = null;
+    var latest = '';
+
+    function show(suggestions) {
+        list.textContent = '';
+        suggestions.forEach(function (s) {
+            var item = document.createElement('li');
+            var link = document.createElement('a');
+            link.href = s.url;
+            link.textContent = s.text;
+            link.className = 'suggestion-' + s.type;
+            item.appendChild(link);
+            list.appendChild(item);
+        });
+        list.hidden = suggestions.length === 0;
+    }
+
+    input.addEventListener('input', function () {
+        clearTimeout(timer);
+        var q = input.value.trim();
+        latest = q;
+        if (q === '') {
+            show([]);
+            return;
+        }
+        timer = setTimeout(function () {
+            fetch('/api/v1/autocomplete?q=' + encodeURIComponent(q))
+                .then(function (res) { return res.ok ? res.json() : { suggestions: [] }; })
+                .then(function (data) {
+                    if (q === latest) {
+                        show(data.suggestions);
+                    }
+                })
+                .catch(function () {});
+        }, 100);
+    });
+    input.addEventListener('keydown', function (e) {
+        if (e.key === 'Escape') {
+            show([]);
+        } else if (e.key === 'ArrowDown' && !list.hidden) {
+            e.preventDefault();
+            list.querySelector('a').focus();
+        }
+    });
+    list.addEventListener('keydown', function (e) {
+        var item = document.activeElement.parentNode;
+        if (e.key === 'ArrowDown' && item.nextSibling) {
+            e.preventDefault();
+            item.nextSibling.firstChild.focus();
+        } else if (e.key === 'ArrowUp') {
+            e.preventDefault();
+            (item.previousSibling ? item.previousSibling.firstChild : input).focus();
+        } else if (e.key === 'Escape') {
+            show([]);
+            input.focus();
+        }
+    });
+    document.addEventListener('click', function (e) {
+        if (!form.contains(e.target)) {
+            list.hidden = true;
+        }
+    });
+})();
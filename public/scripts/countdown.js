@@ -0,0 +1,35 @@
+// count down to the deadlines of the threads, once a minute. the page tells when it closes,
+// this tells how long is left
+(function () {
+    var counters = document.querySelectorAll('.countdown[data-deadline]');
+    if (!counters.length) {
+        return;
+    }
+
+    function left(ms) {
+        var minutes = Math.floor(ms / 60000);
+        var days = Math.floor(minutes / 1440);
+        var hours = Math.floor(minutes % 1440 / 60);
+        if (days > 0) {
+            return days + 'd ' + hours + 'h left';
+        }
+        if (hours > 0) {
+            return hours + 'h ' + minutes % 60 + 'min left';
+        }
+        return Math.max(minutes, 1) + 'min left';
+    }
+
+    function update() {
+        var now = Date.now();
+        counters.forEach(function (counter) {
+            var ms = Date.parse(counter.dataset.deadline) - now;
+            counter.textContent = ms > 0 ? '(' + left(ms) + ')' : '';
+            if (ms <= 0) {
+                counter.parentNode.classList.add('passed');
+            }
+        });
+    }
+
+    update();
+    setInterval(update, 60000);
+})();
@@ -0,0 +1,50 @@
+// save what is typed in forms with a data-draft attribute, on the server and in the browser.
+// the browser copy outlives an expired session and is sent again once logged in
+(function () {
+    document.querySelectorAll('form[data-draft]').forEach(function (form) {
+        var url = form.dataset.draft;
+        var key = 'draft:' + url;
+        var fields = ['heading', 'body', 'tags'].map(function (name) {
+            return form.elements[name];
+        }).filter(Boolean);
+        var timer;
+
+        function values() {
+            var draft = {};
+            fields.forEach(function (field) {
+                draft[field.name] = field.value;
+            });
+            return draft;
+        }
+
+        function save() {
+            var draft = values();
+            localStorage.setItem(key, JSON.stringify(draft));
+            fetch(url, {
+                method: 'PUT',
+                headers: {'Content-Type': 'application/json'},
+                body: JSON.stringify(draft)
+            }).catch(function () {});
+        }
+
+        // an empty form gets the copy left in the browser, when the server didn't have it
+        var local = localStorage.getItem(key);
+        var empty = fields.every(function (field) { return field.value.trim() === ''; });
+        if (local && empty && !form.dataset.hasDraft) {
+            var draft = JSON.parse(local);
+            fields.forEach(function (field) {
+                field.value = draft[field.name] || '';
+            });
+            save();
+        }
+
+        form.addEventListener('input', function () {
+            clearTimeout(timer);
+            timer = setTimeout(save, 1000);
+        });
+        form.addEventListener('submit', function () {
+            clearTimeout(timer);
+            localStorage.removeItem(key);
+        });
+    });
+})();
@@ -0,0 +1,25 @@
+// keep the count of unread notifications up to date while the page is open
+(function () {
+    var link = document.querySelector('#notify');
+    if (!link || !window.EventSource) {
+        return;
+    }
+    var stream = new EventSource('/notifications/stream');
+    stream.onmessage = function (event) {
+        var count = parseInt(event.data, 10);
+        var badge = link.querySelector('.unread');
+        if (!count) {
+            if (badge) {
+                badge.remove();
+            }
+            return;
+        }
+        if (!badge) {
+            badge = document.createElement('span');
+            badge.className = 'unread';
+            link.appendChild(document.createTextNode(' '));
+            link.appendChild(badge);
+        }
+        badge.textContent = count;
+    };
+})();
@@ -0,0 +1,49 @@
+// load the next page of the question list when its "More questions" link scrolls into view
+(function () {
+    var list = document.getElementById('question-list');
+    if (!list || !('IntersectionObserver' in window)) {
+        return;
+    }
+    var loading = false;
+    var observer = new IntersectionObserver(function (entries) {
+        entries.forEach(function (entry) {
+            if (entry.isIntersecting) {
+                load(entry.target);
+            }
+        });
+    });
+    watch();
+
+    function watch() {
+        var next = list.querySelector('.next-page');
+        if (next) {
+            observer.observe(next);
+        }
+    }
+
+    function load(next) {
+        if (loading) {
+            return;
+        }
+        loading = true;
+        observer.unobserve(next);
+        var url = next.querySelector('a').getAttribute('href') + '&partial=1';
+        fetch(url)
+            .then(function (res) {
+                if (!res.ok) {
+                    throw new Error(res.statusText);
+                }
+                return res.text();
+            })
+            .then(function (html) {
+                next.insertAdjacentHTML('afterend', html);
+                next.remove();
+                loading = false;
+                watch();
+            })
+            .catch(function () {
+                // leave the link for a normal page load
+                loading = false;
+            });
+    }
+})();
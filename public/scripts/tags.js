@@ -0,0 +1,40 @@
+// show the excerpt of a tag in a popover while its link is hovered.
+// excerpts are fetched once per page
+(function () {
+    var excerpts = {};
+    var popover = document.createElement('div');
+    popover.className = 'tag-popover';
+    popover.hidden = true;
+    document.body.appendChild(popover);
+
+    function excerpt(name) {
+        if (!excerpts[name]) {
+            excerpts[name] = fetch('/api/v1/tags/' + encodeURIComponent(name))
+                .then(function (res) { return res.ok ? res.json() : {}; })
+                .then(function (tag) { return tag.excerpt || ''; })
+                .catch(function () { return ''; });
+        }
+        return excerpts[name];
+    }
+
+    document.querySelectorAll('a.tag').forEach(function (link) {
+        var hovered = false;
+        link.addEventListener('mouseenter', function () {
+            hovered = true;
+            excerpt(link.textContent.trim()).then(function (text) {
+                if (!hovered || text === '') {
+                    return;
+                }
+                var rect = link.getBoundingClientRect();
+                popover.textContent = text;
+                popover.style.left = (rect.left + window.scrollX) + 'px';
+                popover.style.top = (rect.bottom + window.scrollY + 4) + 'px';
+                popover.hidden = false;
+            });
+        });
+        link.addEventListener('mouseleave', function () {
+            hovered = false;
+            popover.hidden = true;
+        });
+    });
+})();
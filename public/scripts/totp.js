@@ -0,0 +1,15 @@
+// draw the provisioning uri of the two-factor settings as a QR code.
+// the key is shown next to it for apps that can't scan
+(function () {
+    var box = document.getElementById('totp-qr');
+    if (!box || typeof qrcode === 'undefined') {
+        return;
+    }
+    var qr = qrcode(0, 'M');
+    qr.addData(box.dataset.otpauth);
+    qr.make();
+    box.innerHTML = qr.createSvgTag({ cellSize: 4, margin: 4, scalable: true });
+    box.firstChild.setAttribute('role', 'img');
+    box.firstChild.setAttribute('aria-label', 'QR code');
+    box.style.maxWidth = '220px';
+})();
@@ -0,0 +1,1290 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// layouts of the date and time columns of questions and answers
+const (
+	dateLayout = "2006-01-02"
+	timeLayout = "15:04:05"
+)
+
+// layout of the timestamp columns of the other tables
+const timestampLayout = dateLayout + " " + timeLayout
+
+// columns selected for a question, in the order expected by scanQuestion
+const questionColumns = "questions.id, heading, body, " + questionTagsSQL + ", image, date, time, user, views, open, edited_at, " +
+	questionScoreSQL + ", " + bookmarkCountSQL + ", questions.hidden_at is not null, questions.is_anonymous"
+
+// columns selected for a question of a list, in the order expected by scanQuestion. The tags, the
+// score and the bookmarks are left empty, for countQuestionList to look up for the whole page
+const questionListColumns = "questions.id, heading, body, null, image, date, time, user, views, open, edited_at, 0, 0, " +
+	"questions.hidden_at is not null, questions.is_anonymous"
+
+// tags of a question, as a comma separated list in the order they were given
+const questionTagsSQL = `(select group_concat(name, ', ') from (select tags.name from question_tags
+	join tags on tags.id = question_tags.tag_id where question_tags.question_id = questions.id order by question_tags.position))`
+
+// condition on questions tagged with a tag, given as an argument in lowercase
+const taggedSQL = `exists (select 1 from question_tags join tags on tags.id = question_tags.tag_id
+	where question_tags.question_id = questions.id and tags.name = ?)`
+
+// score of a question, from the votes table
+const questionScoreSQL = "(select coalesce(sum(value), 0) from votes where votes.post_type = 'question' and votes.post_id = questions.id)"
+
+// scanner is implemented by *sql.Row and *sql.Rows
+type scanner interface {
+	Scan(dest ...interface{}) error
+}
+
+// scan a row selected with questionColumns into a Question
+func scanQuestion(row scanner) (Question, error) {
+	var q Question
+	var tags, image, date, clock, user, edited sql.NullString
+	var views sql.NullInt64
+	var open sql.NullBool
+	err := row.Scan(&q.QnID, &q.QnHeading, &q.QnBody, &tags, &image, &date, &clock, &user, &views, &open, &edited, &q.QnScore, &q.QnBookmarks, &q.QnHidden, &q.QnAnonymous)
+	if err != nil {
+		return q, err
+	}
+	q.QnTags = splitTags(tags.String)
+	if image.String != "" {
+		q.QnImage = strings.Split(image.String, ",")
+	}
+	q.QnDate = date.String
+	q.QnTime = clock.String
+	q.QnUser = user.String
+	q.QnViews = int(views.Int64)
+	q.QnOpen = open.Bool
+	q.QnEdited = edited.String
+	return q, nil
+}
+
+// split a comma separated list of tags
+func splitTags(s string) []string {
+	var tags []string
+	for _, tag := range strings.Split(s, ",") {
+		tag = strings.TrimSpace(tag)
+		if tag != "" {
+			tags = append(tags, tag)
+		}
+	}
+	return tags
+}
+
+// setQuestionTags replaces the tags of the question with a comma separated list, adding the tags
+// that don't exist yet. It is run in the transaction saving the question, see db.WithTx
+func setQuestionTags(ctx context.Context, questionID int, tags string) error {
+	if _, err := db.ExecContext(ctx, "delete from question_tags where question_id = ?", questionID); err != nil {
+		return err
+	}
+	for i, tag := range splitTags(tags) {
+		tag = strings.ToLower(tag)
+		if _, err := db.ExecContext(ctx, "insert or ignore into tags (name, desc) values (?, '')", tag); err != nil {
+			return err
+		}
+		_, err := db.ExecContext(ctx, `insert or ignore into question_tags (question_id, tag_id, position)
+			select ?, id, ? from tags where name = ?`, questionID, i+1, tag)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// tagPattern returns a LIKE pattern matching the tag in a comma separated tags column
+// once spaces are removed and the column is wrapped in commas
+func tagPattern(tag string) string {
+	tag = strings.ToLower(strings.ReplaceAll(tag, " ", ""))
+	r := strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`)
+	return "%," + r.Replace(tag) + ",%"
+}
+
+// questionTime combines the date and time columns of a question or answer.
+// it returns the zero time when the date is missing or malformed
+func questionTime(date, clock string) time.Time {
+	if clock == "" {
+		clock = "00:00:00"
+	}
+	t, err := time.ParseInLocation(dateLayout+" "+timeLayout, date+" "+clock, time.Local)
+	if err != nil {
+		return time.Time{}
+	}
+	return t
+}
+
+// number of questions on a page of the question list
+const questionsPerPage = 30
+
+// SQL expressions computed for every question of a list
+const (
+	answerCountSQL = "(select count(*) from answers where answers.question_id = questions.id)"
+	// last time the question or one of its answers was posted
+	lastActivitySQL = "max(questions.date || ' ' || questions.time, coalesce((select max(answers.date || ' ' || answers.time) from answers where answers.question_id = questions.id), ''))"
+)
+
+// a sort order of the question list
+type questionSort struct {
+	Name    string // value of the sort query parameter
+	Label   string
+	OrderBy string
+	Where   string // condition on the questions listed, empty for all of them
+	// the value the questions are ordered by, descending and then by id, which cursors point at
+	Key string
+}
+
+// sort orders of the question list, the first one is the default
+var questionSorts = []questionSort{
+	{"newest", "Newest", "questions.date desc, questions.time desc, questions.id desc", "", createdSQL},
+	// ranked by the interests of the user in listQuestions, the newest first for visitors
+	{forYouSort, "For you", "questions.date desc, questions.time desc, questions.id desc", "", createdSQL},
+	{"active", "Recently active", lastActivitySQL + " desc, questions.id desc", "", lastActivitySQL},
+	{"hot", "Hot", "questions.hot_score desc, questions.id desc", "", "questions.hot_score"},
+	{"votes", "Most votes", questionScoreSQL + " desc, questions.id desc", "", questionScoreSQL},
+	{"answers", "Most answers", answerCountSQL + " desc, questions.id desc", "", answerCountSQL},
+	{"views", "Most views", "coalesce(questions.views, 0) desc, questions.id desc", "", "coalesce(questions.views, 0)"},
+	{"featured", "Featured", bountySQL + " desc, questions.id desc", bountySQL + " > 0", bountySQL},
+}
+
+// createdSQL is when a question was asked, ordered like its date and then its time
+const createdSQL = "questions.date || ' ' || coalesce(questions.time, '')"
+
+// find the sort order with the given name, falling back to the default one
+func findQuestionSort(name string) questionSort {
+	for _, s := range questionSorts {
+		if s.Name == name {
+			return s
+		}
+	}
+	return questionSorts[0]
+}
+
+// questionFilter is a condition on the questions table keeping the questions the user can see, with its arguments.
+// moderators see everything, others neither the questions hidden by flags, those of the exams going on
+// nor those of the courses they aren't in
+func questionFilter(ctx context.Context, user *User) (string, []interface{}, error) {
+	if isModerator(user) {
+		return "true", nil, nil
+	}
+	filter, args, err := examFilter(ctx)
+	if err != nil {
+		return "", nil, err
+	}
+	course, courseArgs := courseFilter(user)
+	return "questions.hidden_at is null and " + filter + " and " + course, append(args, courseArgs...), nil
+}
+
+// questionHidden tells if the question is hidden from the user
+func questionHidden(ctx context.Context, user *User, questionID int) (bool, error) {
+	filter, args, err := questionFilter(ctx, user)
+	if err != nil || filter == "1" {
+		return false, err
+	}
+	var n int
+	err = db.QueryRowContext(ctx, "select count(*) from questions where id = ? and "+filter, append([]interface{}{questionID}, args...)...).Scan(&n)
+	return n == 0, err
+}
+
+// questionSummary is a question of a list, with its number of answers
+type questionSummary struct {
+	Question
+	AnswerCount int
+	Bounty      int // amount of the open bounty, 0 if there is none
+}
+
+// list a page of the questions the user can see, in the given order
+func listQuestions(ctx context.Context, user *User, sort questionSort, limit, offset int) ([]questionSummary, error) {
+	list, _, err := listQuestionsAfter(ctx, user, sort, limit, offset, nil)
+	return list, err
+}
+
+// listQuestionsAfter lists like listQuestions, only the questions past the cursor when there is one,
+// with the cursor of each question listed. The For you tab of a user has no cursors
+func listQuestionsAfter(ctx context.Context, user *User, sort questionSort, limit, offset int, after *questionCursor) ([]questionSummary, []questionCursor, error) {
+	// the For you tab is ranked for each user, see foryou.go
+	if sort.Name == forYouSort && user != nil {
+		ids, err := personalFeed(ctx, user)
+		if err != nil {
+			return nil, nil, err
+		}
+		if offset >= len(ids) {
+			return nil, nil, nil
+		}
+		ids = ids[offset:]
+		if len(ids) > limit {
+			ids = ids[:limit]
+		}
+		sort, offset = feedPage(ids), 0
+	}
+	filter, args, err := questionFilter(ctx, user)
+	if err != nil {
+		return nil, nil, err
+	}
+	if sort.Where != "" {
+		filter += " and " + sort.Where
+	}
+	muted, mutedArgs := mutedFilter(user)
+	filter += " and " + muted
+	args = append(args, mutedArgs...)
+	columns := "select " + questionListColumns
+	if sort.Key != "" {
+		columns += ", " + sort.Key
+		if after != nil {
+			filter += " and (" + sort.Key + " < ? or (" + sort.Key + " = ? and questions.id < ?))"
+			args = append(args, after.Key, after.Key, after.ID)
+		}
+	}
+	query := columns + " from questions where " + filter + " order by " + sort.OrderBy + " limit ? offset ?"
+	rows, err := db.QueryContext(ctx, query, append(args, limit, offset)...)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer rows.Close()
+	var list []questionSummary
+	var cursors []questionCursor
+	for rows.Next() {
+		var key interface{}
+		q, err := scanQuestion(scanFunc(func(dest ...interface{}) error {
+			if sort.Key != "" {
+				dest = append(dest, &key)
+			}
+			return rows.Scan(dest...)
+		}))
+		if err != nil {
+			return nil, nil, err
+		}
+		maskAuthor(&q, user)
+		list = append(list, questionSummary{Question: q})
+		if sort.Key != "" {
+			cursors = append(cursors, newQuestionCursor(sort.Name, key, q.QnID))
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, nil, err
+	}
+	return list, cursors, countQuestionList(ctx, list)
+}
+
+// countQuestionList fills in the tags, scores, bookmarks, answers and open bounties of the questions
+// of a list selected with questionListColumns, with a query for each over the whole page rather
+// than subqueries on every row
+func countQuestionList(ctx context.Context, list []questionSummary) error {
+	if len(list) == 0 {
+		return nil
+	}
+	byID := map[int]*questionSummary{}
+	ids := make([]interface{}, len(list))
+	for i := range list {
+		byID[list[i].QnID] = &list[i]
+		ids[i] = list[i].QnID
+	}
+	in := "(" + placeholders(len(ids)) + ")"
+	err := queryList(ctx, `select question_tags.question_id, tags.name from question_tags join tags on tags.id = question_tags.tag_id
+		where question_tags.question_id in `+in+` order by question_tags.question_id, question_tags.position`, ids, func(rows *sql.Rows) error {
+		var id int
+		var tag string
+		err := rows.Scan(&id, &tag)
+		if q := byID[id]; q != nil {
+			q.QnTags = append(q.QnTags, tag)
+		}
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	counts := []struct {
+		query string
+		field func(q *questionSummary) *int
+	}{
+		{"select post_id, sum(value) from votes where post_type = 'question' and post_id in " + in + " group by post_id",
+			func(q *questionSummary) *int { return &q.QnScore }},
+		{"select question_id, count(*) from bookmarks where question_id in " + in + " group by question_id",
+			func(q *questionSummary) *int { return &q.QnBookmarks }},
+		{"select question_id, count(*) from answers where question_id in " + in + " group by question_id",
+			func(q *questionSummary) *int { return &q.AnswerCount }},
+		{"select question_id, sum(amount) from bounties where closed_at is null and question_id in " + in + " group by question_id",
+			func(q *questionSummary) *int { return &q.Bounty }},
+	}
+	for _, c := range counts {
+		err := queryList(ctx, c.query, ids, func(rows *sql.Rows) error {
+			var id, n int
+			err := rows.Scan(&id, &n)
+			if q := byID[id]; q != nil {
+				*c.field(q) = n
+			}
+			return err
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// scanFunc adapts a function to the scanner interface, to scan extra columns after a known set
+type scanFunc func(dest ...interface{}) error
+
+func (f scanFunc) Scan(dest ...interface{}) error { return f(dest...) }
+
+// questionList is the data of the question list page
+type questionList struct {
+	Sorts     []questionSort
+	Sort      string
+	Page      int
+	NextPage  int // 0 on the last page
+	Questions []questionSummary
+	// pinned on top of the first page
+	Announcements []announcement
+	CanAnnounce   bool // the user can post announcements
+}
+
+// serve /questions, the list of questions sorted with the sort query parameter and
+// paginated with the page parameter. With partial=1, only the items of the list are
+// rendered, for the script loading the next pages as the user scrolls
+func serveQuestions(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	query := r.URL.Query()
+	name := query.Get("sort")
+	if name == "" {
+		prefs, err := loadPreferences(ctx, currentUser(r))
+		if err != nil {
+			serverError(w, r, err)
+			return
+		}
+		name = prefs.QuestionSort
+	}
+	sort := findQuestionSort(name)
+	// visitors have no interests to rank by
+	sorts := questionSorts
+	if currentUser(r) == nil {
+		sorts = nil
+		for _, s := range questionSorts {
+			if s.Name != forYouSort {
+				sorts = append(sorts, s)
+			}
+		}
+		if sort.Name == forYouSort {
+			sort = questionSorts[0]
+		}
+	}
+	pageNum, err := strconv.Atoi(query.Get("page"))
+	if err != nil || pageNum < 1 {
+		pageNum = 1
+	}
+	// one more question than shown tells if there is a next page
+	questions, err := listQuestions(ctx, currentUser(r), sort, questionsPerPage+1, (pageNum-1)*questionsPerPage)
+	if err != nil {
+		serverError(w, r, err)
+		return
+	}
+	list := questionList{Sorts: sorts, Sort: sort.Name, Page: pageNum, Questions: questions}
+	if len(questions) > questionsPerPage {
+		list.Questions = questions[:questionsPerPage]
+		list.NextPage = pageNum + 1
+	}
+	list.CanAnnounce = staff(currentUser(r))
+	if pageNum == 1 {
+		if list.Announcements, err = activeAnnouncements(ctx, currentUser(r), ""); err != nil {
+			serverError(w, r, err)
+			return
+		}
+	}
+	if query.Get("partial") == "1" {
+		renderBlock(w, r, "questions.html", "question-items", list)
+		return
+	}
+	render(w, r, "questions.html", list)
+}
+
+// apiQuestion is a question of /api/v1/questions
+type apiQuestion struct {
+	ID        int      `json:"id"`
+	Title     string   `json:"title"`
+	URL       string   `json:"url"`
+	Tags      []string `json:"tags"`
+	Author    string   `json:"author"`
+	CreatedAt string   `json:"created_at"`
+	Score     int      `json:"score"`
+	Answers   int      `json:"answers"`
+	Views     int      `json:"views"`
+	Bounty    int      `json:"bounty"`
+	Snippet   string   `json:"snippet,omitempty"` // in search results, HTML of the text around the words searched, in <mark>
+}
+
+func newAPIQuestion(q questionSummary) apiQuestion {
+	tags := q.QnTags
+	if tags == nil {
+		tags = []string{}
+	}
+	return apiQuestion{
+		ID:        q.QnID,
+		Title:     q.QnHeading,
+		URL:       fmt.Sprintf("/questions/%d", q.QnID),
+		Tags:      tags,
+		Author:    q.QnUser,
+		CreatedAt: q.QnDate + " " + q.QnTime,
+		Score:     q.QnScore,
+		Answers:   q.AnswerCount,
+		Views:     q.QnViews,
+		Bounty:    q.Bounty,
+	}
+}
+
+// apiQuestionList is the answer of /api/v1/questions
+type apiQuestionList struct {
+	Questions  []apiQuestion `json:"questions"`
+	Sort       string        `json:"sort"`
+	Page       int           `json:"page"`                  // 0 when paging with cursors
+	NextPage   int           `json:"next_page,omitempty"`   // left out on the last page, and with cursors
+	NextCursor string        `json:"next_cursor,omitempty"` // left out on the last page, and in the For you order
+}
+
+// questionCursor points at a question of a list, to go on after it. Unlike a page number, it
+// doesn't shift as questions are asked. Clients get it encoded, as an opaque string
+type questionCursor struct {
+	Sort string      `json:"s"`
+	Key  interface{} `json:"k"` // the value of the key of the sort for the question
+	ID   int         `json:"i"`
+}
+
+func newQuestionCursor(sort string, key interface{}, id int) questionCursor {
+	// text comes out of the driver as bytes, which JSON would encode as base64
+	if b, ok := key.([]byte); ok {
+		key = string(b)
+	}
+	return questionCursor{Sort: sort, Key: key, ID: id}
+}
+
+func (c questionCursor) String() string {
+	data, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+// parseQuestionCursor decodes a cursor a client sent back
+func parseQuestionCursor(s string) (*questionCursor, error) {
+	data, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, err
+	}
+	var c questionCursor
+	if err := json.Unmarshal(data, &c); err != nil {
+		return nil, err
+	}
+	switch c.Key.(type) {
+	case string, float64:
+	default:
+		return nil, errors.New("bad cursor key")
+	}
+	return &c, nil
+}
+
+// serve /api/v1/questions, a page of the questions the user can see in the order of the
+// sort query parameter, newest by default. Pages are numbered, or follow the cursor of the
+// previous one, the sort of the cursor then being the sort of the list
+func serveQuestionsAPI(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	if r.Method != http.MethodGet {
+		writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	query := r.URL.Query()
+	user := currentUser(r)
+	var after *questionCursor
+	if c := query.Get("cursor"); c != "" {
+		var err error
+		if after, err = parseQuestionCursor(c); err != nil || query.Get("page") != "" {
+			writeAPIError(w, http.StatusUnprocessableEntity, apiError{
+				Message: "invalid cursor",
+				Fields:  map[string]string{"cursor": "the next_cursor of a previous page, without a page number"},
+			})
+			return
+		}
+		if name := query.Get("sort"); name != "" && name != after.Sort {
+			writeAPIError(w, http.StatusUnprocessableEntity, apiError{
+				Message: "the cursor is of another sort order",
+				Fields:  map[string]string{"sort": "the sort of the cursor, " + after.Sort + ", or none"},
+			})
+			return
+		}
+		query.Set("sort", after.Sort)
+	}
+	sort := findQuestionSort(query.Get("sort"))
+	if name := query.Get("sort"); name != "" && name != sort.Name {
+		names := make([]string, len(questionSorts))
+		for i, s := range questionSorts {
+			names[i] = s.Name
+		}
+		writeAPIError(w, http.StatusUnprocessableEntity, apiError{
+			Message: "unknown sort order",
+			Fields:  map[string]string{"sort": "one of " + strings.Join(names, ", ")},
+		})
+		return
+	}
+	// the For you order is ranked anew for the user, by position
+	if after != nil && sort.Name == forYouSort && user != nil {
+		writeAPIError(w, http.StatusUnprocessableEntity, apiError{
+			Message: "the For you order has no cursors",
+			Fields:  map[string]string{"cursor": "page through the For you order by number"},
+		})
+		return
+	}
+	pageNum, err := strconv.Atoi(query.Get("page"))
+	if err != nil || pageNum < 1 {
+		pageNum = 1
+	}
+	offset := (pageNum - 1) * questionsPerPage
+	if after != nil {
+		pageNum, offset = 0, 0
+	}
+	questions, cursors, err := listQuestionsAfter(ctx, user, sort, questionsPerPage+1, offset, after)
+	if err != nil {
+		writeInternalError(w, r, err)
+		return
+	}
+	list := apiQuestionList{Questions: []apiQuestion{}, Sort: sort.Name, Page: pageNum}
+	if len(questions) > questionsPerPage {
+		questions = questions[:questionsPerPage]
+		if after == nil {
+			list.NextPage = pageNum + 1
+		}
+		if len(cursors) > 0 {
+			list.NextCursor = cursors[questionsPerPage-1].String()
+		}
+	}
+	for _, q := range questions {
+		list.Questions = append(list.Questions, newAPIQuestion(q))
+	}
+	writeJSON(w, http.StatusOK, list)
+}
+
+// askForm is the data of the ask page
+type askForm struct {
+	Error   string
+	Notice  string
+	Heading string
+	Body    string
+	Tags    string
+	Draft   *draft // saved draft of the user, offered to resume
+	// students may ask anonymously, see anonymous.go
+	Anonymous         bool
+	CanAskAnonymously bool
+	// questions with a near-identical heading, to confirm the new one is different
+	Similar []similarQuestion
+	// courses of the user, the question is asked in one of them or in none, see courses.go
+	Courses []course
+	Course  int
+	// templates to start from, and the one chosen, see questiontemplates.go
+	Templates   []questionTemplate
+	Template    *questionTemplate
+	CanTemplate bool // the user manages the templates
+}
+
+// serve /ask, where users post a new question
+func serveAsk(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	user := requireUser(w, r)
+	if user == nil {
+		return
+	}
+	if r.Method != http.MethodPost {
+		d, err := loadDraft(ctx, user.UniqueID, draftQuestion, 0)
+		if err != nil {
+			serverError(w, r, err)
+			return
+		}
+		form := askForm{Draft: d, CanAskAnonymously: hasUserType(user, "student")}
+		form.Course, _ = strconv.Atoi(r.FormValue("course"))
+		if form.Courses, err = userCourses(ctx, user); err != nil {
+			serverError(w, r, err)
+			return
+		}
+		if !form.loadTemplates(w, r, user) {
+			return
+		}
+		if form.Template != nil {
+			form.Body = form.Template.Skeleton()
+		}
+		if d != nil && r.FormValue("draft") == "resume" {
+			form.Heading, form.Body, form.Tags = d.Heading, d.Body, d.Tags
+		}
+		render(w, r, "ask.html", form)
+		return
+	}
+	tags, err := cleanTags(ctx, r.FormValue("tags"))
+	if err != nil {
+		serverError(w, r, err)
+		return
+	}
+	form := askForm{
+		Heading:           strings.TrimSpace(r.FormValue("heading")),
+		Body:              strings.TrimSpace(r.FormValue("body")),
+		Tags:              tags,
+		CanAskAnonymously: hasUserType(user, "student"),
+	}
+	form.Anonymous = form.CanAskAnonymously && r.FormValue("anonymous") == "1"
+	if form.Courses, err = userCourses(ctx, user); err != nil {
+		serverError(w, r, err)
+		return
+	}
+	// the course must be one of the user's
+	var courseID interface{}
+	form.Course, _ = strconv.Atoi(r.FormValue("course"))
+	for _, c := range form.Courses {
+		if c.ID == form.Course {
+			courseID = c.ID
+		}
+	}
+	if courseID == nil {
+		form.Course = 0
+	}
+	if !form.loadTemplates(w, r, user) {
+		return
+	}
+	if form.Heading == "" || form.Body == "" {
+		form.Error = "the heading and the body can't be empty"
+		render(w, r, "ask.html", form)
+		return
+	}
+	if form.Template != nil {
+		if form.Error = form.Template.check(form.Body); form.Error != "" {
+			render(w, r, "ask.html", form)
+			return
+		}
+	}
+	if form.Anonymous {
+		allowed, err := anonymousAllowed(ctx, splitTags(form.Tags))
+		if err != nil {
+			serverError(w, r, err)
+			return
+		}
+		if !allowed {
+			form.Error = "none of the tags of the question allow anonymous questions"
+			render(w, r, "ask.html", form)
+			return
+		}
+	}
+	check, err := checkContent(ctx, draftPost{Type: postQuestion, User: user, Heading: form.Heading, Body: form.Body})
+	if err != nil {
+		serverError(w, r, err)
+		return
+	}
+	if check.Verdict == filterReject {
+		form.Error = "your question was rejected: " + check.Reason
+		render(w, r, "ask.html", form)
+		return
+	}
+	// a near-identical heading takes a second submit, choosing to post anyway
+	different, _ := strconv.Atoi(r.FormValue("different"))
+	if different == 0 {
+		similar, err := similarQuestions(ctx, user, form.Heading)
+		if err != nil {
+			serverError(w, r, err)
+			return
+		}
+		for _, q := range similar {
+			if q.Similarity >= duplicateTitleSimilarity {
+				form.Similar = append(form.Similar, q)
+			}
+		}
+		if len(form.Similar) > 0 {
+			render(w, r, "ask.html", form)
+			return
+		}
+	}
+	image, err := saveImage(r, "image", user)
+	if err != nil {
+		form.Error = err.Error()
+		render(w, r, "ask.html", form)
+		return
+	}
+	files, err := saveAttachments(r, "attachments")
+	if _, ok := err.(uploadError); ok {
+		form.Error = err.Error()
+		render(w, r, "ask.html", form)
+		return
+	}
+	if err != nil {
+		serverError(w, r, err)
+		return
+	}
+	now := time.Now()
+	var id int64
+	// the question is saved with its tags, its activity and its notifications, or not at all
+	err = db.WithTx(ctx, func(ctx context.Context) error {
+		res, err := db.ExecContext(ctx, `insert into questions (heading, body, image, date, time, user, views, open, is_anonymous, course_id)
+			values (?, ?, ?, ?, ?, ?, 0, true, ?, ?)`,
+			form.Heading, form.Body, image, now.Format(dateLayout), now.Format(timeLayout), user.UserName, form.Anonymous, courseID)
+		if err != nil {
+			return err
+		}
+		id, _ = res.LastInsertId()
+		if err := setQuestionTags(ctx, int(id), form.Tags); err != nil {
+			return err
+		}
+		if err := attachFiles(ctx, user, postQuestion, int(id), files); err != nil {
+			return err
+		}
+		if err := deleteDraft(ctx, user.UniqueID, draftQuestion, 0); err != nil {
+			return err
+		}
+		if check.Verdict == filterReview {
+			if err := holdForReview(ctx, postQuestion, int(id), check.Reason); err != nil {
+				return err
+			}
+		}
+		if different > 0 {
+			if err := recordDuplicateOverride(ctx, int(id), different); err != nil {
+				return err
+			}
+		}
+		if err := recordActivity(ctx, user.UniqueID, activityAsked, postQuestion, int(id), int(id), ""); err != nil {
+			return err
+		}
+		if err := recordMentions(ctx, user, postQuestion, int(id), fmt.Sprintf("/questions/%d", id), form.Body, check.Verdict == filterReview); err != nil {
+			return err
+		}
+		// the author follows their question, to hear about its answers
+		if err := autoFollow(ctx, user.UniqueID, followQuestion, strconv.FormatInt(id, 10)); err != nil {
+			return err
+		}
+		// a question held for review stays quiet until a moderator shows it
+		if check.Verdict == filterReview {
+			return nil
+		}
+		if err := notifyNewQuestion(ctx, r, user, form.Anonymous, int(id), form.Heading, splitTags(form.Tags)); err != nil {
+			return err
+		}
+		if err := emitQuestionCreated(ctx, user, form.Anonymous, int(id), form.Heading, splitTags(form.Tags)); err != nil {
+			return err
+		}
+		if err := postToChannels(ctx, user, form.Anonymous, int(id), form.Heading, splitTags(form.Tags)); err != nil {
+			return err
+		}
+		return announceQuestion(ctx, r, int(id))
+	})
+	if err != nil {
+		removeAttachments(files)
+		serverError(w, r, err)
+		return
+	}
+	if check.Verdict == filterReview && !isModerator(user) {
+		// the author couldn't open the hidden question, so they stay on the form
+		render(w, r, "ask.html", askForm{Notice: "your question was saved and will be shown once a moderator reviews it"})
+		return
+	}
+	http.Redirect(w, r, fmt.Sprintf("/questions/%d", id), http.StatusSeeOther)
+}
+
+// parse paths like /questions/12/vote into 12 and "vote"
+func parseIDPath(path, prefix string) (int, string, bool) {
+	idPart, rest, _ := strings.Cut(strings.TrimPrefix(path, prefix), "/")
+	id, err := strconv.Atoi(idPart)
+	if err != nil || id <= 0 {
+		return 0, "", false
+	}
+	return id, rest, true
+}
+
+// load a question by id, nil if there is none
+func questionByID(ctx context.Context, id int) (*Question, error) {
+	q, err := scanQuestion(db.QueryRowContext(ctx, "select "+questionColumns+" from questions where questions.id = ?", id))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &q, nil
+}
+
+// questionPage is the data of the question page
+type questionPage struct {
+	Question     Question
+	Answers      []Answer
+	QuestionVote int         // vote of the user on the question
+	AnswerVotes  map[int]int // votes of the user on the answers, by answer id
+
+	QuestionComments []Comment
+	AnswerComments   map[int][]Comment // comments on the answers, by answer id
+	CommentVotes     map[int]int       // votes of the user on the comments, by comment id
+	AnswerInComment  map[int]bool      // comments that look like an answer, by comment id
+	Bookmarked       bool              // the user bookmarked the question
+	Following        bool              // the user follows the question
+	Muted            map[string]bool   // authors muted by the user, by username
+	Moderator        bool              // the user sees the hidden posts
+	Accepted         int               // id of the answer accepted by the author, 0 if none
+	Bounty           *bounty           // open bounty on the question, nil if there is none
+	AnswerDraft      string            // answer the user was writing
+	Editors          postEditors       // who is editing the posts, by post type and id
+	Attachments      postAttachments   // files attached to the posts, by post type and id
+	ShowWilson       bool              // show the confidence-adjusted score of the answers
+	Course           *course           // course the question was asked in, nil if none
+	Courses          []course          // every course, for the moderators moving the question
+	Deadline         *deadline         // after which the thread is read-only for students, nil if none
+	Closed           bool              // the deadline passed and the user is a student
+	CanSetDeadline   bool              // the user teaches or moderates
+	Protection       *protection       // nil if the question isn't protected
+	Closure          *closure          // nil if the question is open
+	CloseVoting      closeVoting       // votes to close the question, or to reopen it
+	CanAnswer        bool              // the user is logged in, and has the reputation to answer a protected question
+}
+
+// serve /questions/{id} and its actions
+func serveQuestion(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	id, action, ok := parseIDPath(r.URL.Path, "/questions/")
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	// the url of a merged question stays valid
+	if target, err := mergedInto(ctx, id); err != nil {
+		serverError(w, r, err)
+		return
+	} else if target != 0 {
+		u := *r.URL
+		u.Path = fmt.Sprintf("/questions/%d", target)
+		if action != "" {
+			u.Path += "/" + action
+		}
+		http.Redirect(w, r, u.String(), http.StatusMovedPermanently)
+		return
+	}
+	user := currentUser(r)
+	if hidden, err := questionHidden(ctx, user, id); err != nil {
+		serverError(w, r, err)
+		return
+	} else if hidden {
+		http.NotFound(w, r)
+		return
+	}
+	if r.Method == http.MethodPost {
+		defer questionCache.invalidate(id)
+	}
+	switch action {
+	case "":
+	case "vote":
+		serveVote(w, r, postQuestion, id, id)
+		return
+	case "flag":
+		serveFlag(w, r, postQuestion, id, id)
+		return
+	case "edit":
+		serveEditQuestion(w, r, id)
+		return
+	case "comment":
+		serveNewComment(w, r, postQuestion, id, id)
+		return
+	case "bookmark":
+		serveBookmark(w, r, id)
+		return
+	case "answer":
+		serveNewAnswer(w, r, id)
+		return
+	case "follow":
+		serveFollow(w, r, followQuestion, strconv.Itoa(id), fmt.Sprintf("/questions/%d", id))
+		return
+	case "bounty":
+		serveBounty(w, r, id)
+		return
+	case "deadline":
+		serveDeadline(w, r, id, "")
+		return
+	case "merge":
+		serveMergeQuestion(w, r, id)
+		return
+	case "move":
+		serveMoveQuestion(w, r, id)
+		return
+	case "protect":
+		serveProtect(w, r, id)
+		return
+	case voteClose, voteReopen:
+		serveCloseVote(w, r, id, action)
+		return
+	default:
+		http.NotFound(w, r)
+		return
+	}
+
+	// visitors get the cached page when there is one, otherwise the page is cached as it is rendered.
+	// the revision is read before the thread is, so a write while rendering keeps the page out.
+	// only pages in the default language are cached
+	if user == nil && requestLanguage(r, nil) == defaultLanguage {
+		if body, ok := questionCache.get(ctx, id); ok {
+			if _, err := countView(r, user, id); err != nil {
+				serverError(w, r, err)
+				return
+			}
+			w.Header().Set("Content-Type", "text/html; charset=utf-8")
+			w.Header().Set("X-Cache", "hit")
+			w.Write(body)
+			return
+		}
+		revision := questionCache.revision(id)
+		cw := &captureWriter{ResponseWriter: w}
+		defer func() {
+			if cw.status == http.StatusOK {
+				questionCache.put(ctx, id, revision, cw.body.Bytes())
+			}
+		}()
+		w = cw
+	}
+
+	q, err := cachedQuestion(ctx, id)
+	if err != nil {
+		serverError(w, r, err)
+		return
+	}
+	if q == nil {
+		http.NotFound(w, r)
+		return
+	}
+	maskAuthor(q, user)
+	counted, err := countView(r, user, id)
+	if err != nil {
+		serverError(w, r, err)
+		return
+	}
+	if counted {
+		q.QnViews++
+	}
+
+	p := questionPage{
+		Question:        *q,
+		Moderator:       isModerator(user),
+		AnswerComments:  map[int][]Comment{},
+		AnswerInComment: map[int]bool{},
+	}
+	if p.Answers, err = cachedAnswers(ctx, id); err != nil {
+		serverError(w, r, err)
+		return
+	}
+	if p.ShowWilson, err = featureEnabled(ctx, featureWilsonScores); err != nil {
+		serverError(w, r, err)
+		return
+	}
+	if p.Accepted, err = acceptedAnswer(ctx, id); err != nil {
+		serverError(w, r, err)
+		return
+	}
+	if p.Bounty, err = openBounty(ctx, id); err != nil {
+		serverError(w, r, err)
+		return
+	}
+	if p.Attachments, err = threadAttachments(ctx, id); err != nil {
+		serverError(w, r, err)
+		return
+	}
+	// visitors get cached pages, which can't tell who is editing
+	if user != nil {
+		d, err := loadDraft(ctx, user.UniqueID, draftAnswer, id)
+		if err != nil {
+			serverError(w, r, err)
+			return
+		}
+		if d != nil {
+			p.AnswerDraft = d.Body
+		}
+		if p.Editors, err = threadEditors(ctx, id); err != nil {
+			serverError(w, r, err)
+			return
+		}
+	}
+	arm, enrolled, err := answerSortExperiment.arm(r)
+	if err != nil {
+		serverError(w, r, err)
+		return
+	}
+	sortAnswers(p.Answers, p.Accepted, arm)
+	// the ranking only matters to the author once there are answers to choose from
+	if enrolled && user.UserName == q.QnUser && len(p.Answers) > 1 {
+		if err := answerSortExperiment.recordExposure(ctx, id, arm); err != nil {
+			fmt.Println(err)
+		}
+	}
+	if p.Bookmarked, err = isBookmarked(ctx, user, id); err != nil {
+		serverError(w, r, err)
+		return
+	}
+	if p.Muted, err = mutedNames(ctx, user); err != nil {
+		serverError(w, r, err)
+		return
+	}
+	if p.Course, err = questionCourse(ctx, user, id); err != nil {
+		serverError(w, r, err)
+		return
+	}
+	if p.Moderator {
+		if p.Courses, err = allCourses(ctx); err != nil {
+			serverError(w, r, err)
+			return
+		}
+	}
+	if p.Deadline, err = questionDeadline(ctx, id); err != nil {
+		serverError(w, r, err)
+		return
+	}
+	p.Closed = p.Deadline != nil && p.Deadline.Passed && !staff(user)
+	if p.Protection, err = questionProtection(ctx, id); err != nil {
+		serverError(w, r, err)
+		return
+	}
+	if p.CanAnswer, err = canAnswer(ctx, user, id); err != nil {
+		serverError(w, r, err)
+		return
+	}
+	if p.Closure, err = questionClosure(ctx, id); err != nil {
+		serverError(w, r, err)
+		return
+	}
+	if p.CloseVoting, err = questionCloseVoting(ctx, user, id, p.Closure != nil); err != nil {
+		serverError(w, r, err)
+		return
+	}
+	p.CanSetDeadline = staff(user)
+	if p.Following, err = following(ctx, user, followQuestion, strconv.Itoa(id)); err != nil {
+		serverError(w, r, err)
+		return
+	}
+	if p.QuestionVote, err = userVote(ctx, user, postQuestion, id); err != nil {
+		serverError(w, r, err)
+		return
+	}
+	answerIDs := make([]int, len(p.Answers))
+	for i, a := range p.Answers {
+		answerIDs[i] = a.AnsID
+	}
+	if p.AnswerVotes, err = userVotes(ctx, user, postAnswer, answerIDs); err != nil {
+		serverError(w, r, err)
+		return
+	}
+	comments, err := cachedComments(ctx, id)
+	if err != nil {
+		serverError(w, r, err)
+		return
+	}
+	commentIDs := make([]int, len(comments))
+	for i, c := range comments {
+		if c.CmtPostType == postQuestion {
+			p.QuestionComments = append(p.QuestionComments, c)
+			p.AnswerInComment[c.CmtID] = answeredInComment(c, p.Answers)
+		} else {
+			p.AnswerComments[c.CmtPostID] = append(p.AnswerComments[c.CmtPostID], c)
+		}
+		commentIDs[i] = c.CmtID
+	}
+	if p.CommentVotes, err = userVotes(ctx, user, postComment, commentIDs); err != nil {
+		serverError(w, r, err)
+		return
+	}
+	render(w, r, "question.html", p)
+}
+
+// editForm is the data of the edit page of a question or an answer
+type editForm struct {
+	Action  string // url the form is posted to
+	Cancel  string // url to go back to
+	IsQn    bool   // questions also have a heading and tags
+	Heading string
+	Tags    string
+	Body    string
+	Editor  string // someone else editing the post, empty if none
+}
+
+// serve /questions/{id}/edit, where the author edits their question
+func serveEditQuestion(w http.ResponseWriter, r *http.Request, id int) {
+	ctx := r.Context()
+	user := requireUser(w, r)
+	if user == nil {
+		return
+	}
+	q, err := questionByID(ctx, id)
+	if err != nil {
+		serverError(w, r, err)
+		return
+	}
+	if q == nil {
+		http.NotFound(w, r)
+		return
+	}
+	if q.QnUser != user.UserName {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+	if !requireOpenThread(w, r, user, id) {
+		return
+	}
+	if r.Method != http.MethodPost {
+		editor, err := takeEditLease(ctx, user, postQuestion, id)
+		if err != nil {
+			serverError(w, r, err)
+			return
+		}
+		render(w, r, "edit.html", editForm{
+			Action:  fmt.Sprintf("/questions/%d/edit", id),
+			Cancel:  fmt.Sprintf("/questions/%d", id),
+			IsQn:    true,
+			Heading: q.QnHeading,
+			Tags:    strings.Join(q.QnTags, ", "),
+			Body:    q.QnBody,
+			Editor:  editor,
+		})
+		return
+	}
+	heading := strings.TrimSpace(r.FormValue("heading"))
+	body := strings.TrimSpace(r.FormValue("body"))
+	if heading == "" || body == "" {
+		http.Error(w, "the heading and the body can't be empty", http.StatusBadRequest)
+		return
+	}
+	tags, err := cleanTags(ctx, r.FormValue("tags"))
+	if err != nil {
+		serverError(w, r, err)
+		return
+	}
+	image, err := saveImage(r, "image", user)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	images := q.QnImage
+	if image != "" {
+		images = append(images, image)
+	}
+	err = db.WithTx(ctx, func(ctx context.Context) error {
+		_, err := db.ExecContext(ctx, "update questions set heading = ?, body = ?, image = ?, edited_at = ? where id = ?",
+			heading, body, strings.Join(images, ","), time.Now().Format(timestampLayout), id)
+		if err != nil {
+			return err
+		}
+		if err := setQuestionTags(ctx, id, tags); err != nil {
+			return err
+		}
+		if err := recordActivity(ctx, user.UniqueID, activityEdited, postQuestion, id, id, ""); err != nil {
+			return err
+		}
+		if err := recordMentions(ctx, user, postQuestion, id, fmt.Sprintf("/questions/%d", id), body, q.QnHidden); err != nil {
+			return err
+		}
+		if substantialEdit(q.QnHeading, q.QnBody, heading, body) {
+			return announceQuestion(ctx, r, id)
+		}
+		return nil
+	})
+	if err != nil {
+		serverError(w, r, err)
+		return
+	}
+	if err := releaseEditLease(ctx, user, postQuestion, id); err != nil {
+		fmt.Println(err)
+	}
+	http.Redirect(w, r, fmt.Sprintf("/questions/%d", id), http.StatusSeeOther)
+}
+
+// serve /answers/{id}/vote, /answers/{id}/edit, /answers/{id}/comment and /answers/{id}/convert
+func serveAnswer(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	id, action, ok := parseIDPath(r.URL.Path, "/answers/")
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	a, err := answerByID(ctx, id)
+	if err != nil {
+		serverError(w, r, err)
+		return
+	}
+	if a == nil {
+		http.NotFound(w, r)
+		return
+	}
+	if hidden, err := questionHidden(ctx, currentUser(r), a.AnsQn); err != nil {
+		serverError(w, r, err)
+		return
+	} else if hidden {
+		http.NotFound(w, r)
+		return
+	}
+	if r.Method == http.MethodPost {
+		defer questionCache.invalidate(a.AnsQn)
+	}
+	switch action {
+	case "":
+		http.Redirect(w, r, fmt.Sprintf("/questions/%d#answer-%d", a.AnsQn, id), http.StatusMovedPermanently)
+	case "vote":
+		serveVote(w, r, postAnswer, id, a.AnsQn)
+	case "flag":
+		serveFlag(w, r, postAnswer, id, a.AnsQn)
+	case "edit":
+		serveEditAnswer(w, r, a)
+	case "accept":
+		serveAcceptAnswer(w, r, a)
+	case "convert":
+		serveConvertAnswer(w, r, a)
+	case "comment":
+		serveNewComment(w, r, postAnswer, id, a.AnsQn)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// serve /answers/{id}/edit, where the author edits their answer
+func serveEditAnswer(w http.ResponseWriter, r *http.Request, a *Answer) {
+	ctx := r.Context()
+	user := requireUser(w, r)
+	if user == nil {
+		return
+	}
+	if a.AnsUser != user.UserName {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+	if !requireOpenThread(w, r, user, a.AnsQn) {
+		return
+	}
+	if r.Method != http.MethodPost {
+		editor, err := takeEditLease(ctx, user, postAnswer, a.AnsID)
+		if err != nil {
+			serverError(w, r, err)
+			return
+		}
+		render(w, r, "edit.html", editForm{
+			Action: fmt.Sprintf("/answers/%d/edit", a.AnsID),
+			Cancel: fmt.Sprintf("/questions/%d#answer-%d", a.AnsQn, a.AnsID),
+			Body:   a.AnsBody,
+			Editor: editor,
+		})
+		return
+	}
+	body := strings.TrimSpace(r.FormValue("body"))
+	if body == "" {
+		http.Error(w, "the body can't be empty", http.StatusBadRequest)
+		return
+	}
+	_, err := db.ExecContext(ctx, "update answers set body = ?, edited_at = ? where id = ?", body, time.Now().Format(timestampLayout), a.AnsID)
+	if err != nil {
+		serverError(w, r, err)
+		return
+	}
+	if err := releaseEditLease(ctx, user, postAnswer, a.AnsID); err != nil {
+		fmt.Println(err)
+	}
+	if err := recordActivity(ctx, user.UniqueID, activityEdited, postAnswer, a.AnsID, a.AnsQn, ""); err != nil {
+		fmt.Println(err)
+	}
+	if err := recordMentions(ctx, user, postAnswer, a.AnsID, fmt.Sprintf("/questions/%d#answer-%d", a.AnsQn, a.AnsID), body, a.AnsHidden); err != nil {
+		fmt.Println(err)
+	}
+	http.Redirect(w, r, fmt.Sprintf("/questions/%d#answer-%d", a.AnsQn, a.AnsID), http.StatusSeeOther)
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+)
+
+// sizes of the site the pages are benchmarked on
+const (
+	benchQuestions       = 300
+	benchVoters          = 10
+	benchThreadAnswers   = 30 // on the first question, with two comments each
+	benchTagsPerQuestion = 3
+)
+
+// seedBenchmark fills a test server with questions, tagged, answered, voted on and bookmarked,
+// the first one being a long thread, and returns the cookie of a voter
+func seedBenchmark(b *testing.B) (*Server, *http.Cookie) {
+	b.Helper()
+	srv := newTestServer(b)
+	ctx := context.Background()
+	var cookie *http.Cookie
+	for i := 1; i <= benchVoters; i++ {
+		_, c := testUser(b, fmt.Sprintf("voter%d", i))
+		if cookie == nil {
+			cookie = c
+		}
+	}
+	for q := 1; q <= benchQuestions; q++ {
+		testExec(b, `insert into questions (id, heading, body, date, time, user, views, open) values (?, ?, 'body', '2026-01-01', ?, ?, 0, 1)`,
+			q, fmt.Sprintf("Question %d", q), fmt.Sprintf("%02d:%02d:%02d", q/3600, q/60%60, q%60), fmt.Sprintf("voter%d", q%benchVoters+1))
+		tags := ""
+		for t := 0; t < benchTagsPerQuestion; t++ {
+			tags += fmt.Sprintf("tag%d, ", (q+t)%20)
+		}
+		if err := setQuestionTags(ctx, q, tags); err != nil {
+			b.Fatal(err)
+		}
+		answers := q % 5
+		if q == 1 {
+			answers = benchThreadAnswers
+		}
+		for a := 0; a < answers; a++ {
+			testExec(b, "insert into answers (body, date, time, user, views, question_id) values ('an answer', '2026-01-02', '10:00:00', ?, 0, ?)",
+				fmt.Sprintf("voter%d", a%benchVoters+1), q)
+		}
+		for v := 1; v <= q%benchVoters; v++ {
+			testExec(b, "insert into votes (user_id, post_type, post_id, value, voted_at) values (?, 'question', ?, 1, '2026-01-02 10:00:00')", v, q)
+		}
+		if q%7 == 0 {
+			testExec(b, "insert into bookmarks (user_id, question_id, created_at) values (1, ?, '2026-01-02 10:00:00')", q)
+		}
+		if q%50 == 0 {
+			testExec(b, `insert into bounties (question_id, user_id, amount, created_at, expires_at) values (?, 1, 50, '2026-01-02 10:00:00', '2099-01-01 00:00:00')`, q)
+		}
+	}
+	testExec(b, `insert into comments (post_type, post_id, body, date, time, user)
+		select 'answer', answers.id, 'a comment', '2026-01-03', '10:00:00', 'voter2' from answers, (select 1 union all select 2) where answers.question_id = 1`)
+	testExec(b, `insert into votes (user_id, post_type, post_id, value, voted_at)
+		select 1, post_type, post_id, 1, '2026-01-03 10:00:00' from (select 'answer' post_type, id post_id from answers where question_id = 1
+			union all select 'comment', id from comments where id % 2 = 0)`)
+	return srv, cookie
+}
+
+// benchmarkPage requests the page as the user of the cookie, reporting the queries made per request
+func benchmarkPage(b *testing.B, srv *Server, cookie *http.Cookie, url string) {
+	handler := srv.Routes()
+	get := func() {
+		req := httptest.NewRequest(http.MethodGet, url, nil)
+		req.AddCookie(cookie)
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		if rec.Code != http.StatusOK {
+			b.Fatalf("GET %s: %d %s", url, rec.Code, rec.Body)
+		}
+	}
+	// the first request warms the prepared statements and the caches
+	get()
+	queries := atomic.LoadInt64(&srv.store.queries)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		get()
+	}
+	b.StopTimer()
+	b.ReportMetric(float64(atomic.LoadInt64(&srv.store.queries)-queries)/float64(b.N), "queries/op")
+}
+
+func BenchmarkQuestionListPage(b *testing.B) {
+	srv, cookie := seedBenchmark(b)
+	benchmarkPage(b, srv, cookie, "/questions?sort=newest")
+}
+
+func BenchmarkQuestionPage(b *testing.B) {
+	srv, cookie := seedBenchmark(b)
+	benchmarkPage(b, srv, cookie, "/questions/1")
+}
+
+// BenchmarkThreadVotes compares looking up the votes of the user on the answers and comments of
+// a thread one by one, as the question page did, with a batched query per type of post
+func BenchmarkThreadVotes(b *testing.B) {
+	seedBenchmark(b)
+	ctx := context.Background()
+	user, err := userByName(ctx, "voter1")
+	if err != nil || user == nil {
+		b.Fatal(user, err)
+	}
+	answers, err := cachedAnswers(ctx, 1)
+	if err != nil {
+		b.Fatal(err)
+	}
+	comments, err := cachedComments(ctx, 1)
+	if err != nil {
+		b.Fatal(err)
+	}
+	var answerIDs, commentIDs []int
+	for _, a := range answers {
+		answerIDs = append(answerIDs, a.AnsID)
+	}
+	for _, c := range comments {
+		commentIDs = append(commentIDs, c.CmtID)
+	}
+	b.Run("per-post", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			for _, id := range answerIDs {
+				if _, err := userVote(ctx, user, postAnswer, id); err != nil {
+					b.Fatal(err)
+				}
+			}
+			for _, id := range commentIDs {
+				if _, err := userVote(ctx, user, postComment, id); err != nil {
+					b.Fatal(err)
+				}
+			}
+		}
+	})
+	b.Run("batched", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			if _, err := userVotes(ctx, user, postAnswer, answerIDs); err != nil {
+				b.Fatal(err)
+			}
+			if _, err := userVotes(ctx, user, postComment, commentIDs); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+// BenchmarkQuestionListCounts compares loading a page of the question list with the tags, scores,
+// bookmarks, answers and bounties computed by subqueries on each row, as the list did, with the
+// page loaded first and those looked up for all its questions at once
+func BenchmarkQuestionListCounts(b *testing.B) {
+	seedBenchmark(b)
+	ctx := context.Background()
+	const page = " from questions order by questions.date desc, questions.time desc, questions.id desc limit ?"
+	b.Run("subqueries", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			err := queryList(ctx, "select "+questionColumns+", "+answerCountSQL+", "+bountySQL+page, []interface{}{questionsPerPage}, func(rows *sql.Rows) error {
+				var answers, bounty int
+				_, err := scanQuestion(scanFunc(func(dest ...interface{}) error {
+					return rows.Scan(append(dest, &answers, &bounty)...)
+				}))
+				return err
+			})
+			if err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+	b.Run("batched", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			var list []questionSummary
+			err := queryList(ctx, "select "+questionListColumns+page, []interface{}{questionsPerPage}, func(rows *sql.Rows) error {
+				q, err := scanQuestion(rows)
+				list = append(list, questionSummary{Question: q})
+				return err
+			})
+			if err == nil {
+				err = countQuestionList(ctx, list)
+			}
+			if err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
@@ -0,0 +1,262 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// teachers define question templates on /question-templates: the sections a question should
+// have, like "What I tried", "Expected" and "Actual", and whether it needs a code block. Choosing
+// a template on /ask fills the body with the headings of its sections, and the question is only
+// posted once each required section has something under its heading
+
+// longest name and description of a template, and most sections, against mistakes
+const (
+	maxTemplateName        = 100
+	maxTemplateDescription = 1000
+	maxTemplateSections    = 20
+)
+
+// questionTemplate is a template of questions
+type questionTemplate struct {
+	ID          int
+	Name        string
+	Description string
+	Sections    []templateSection
+	RequireCode bool // the question needs a code block
+	Author      string
+	CanEdit     bool // the user can delete it
+}
+
+// templateSection is a section of a template, a level 2 heading in the body of the question
+type templateSection struct {
+	Title    string
+	Optional bool
+}
+
+// parseSections reads the sections of a template, one per line, optional ones starting with ?
+func parseSections(text string) []templateSection {
+	var sections []templateSection
+	for _, line := range strings.Split(text, "\n") {
+		line = strings.TrimSpace(line)
+		optional := strings.HasPrefix(line, "?")
+		line = strings.TrimSpace(strings.TrimPrefix(line, "?"))
+		if line != "" {
+			sections = append(sections, templateSection{Title: line, Optional: optional})
+		}
+	}
+	return sections
+}
+
+// formatSections writes the sections the way parseSections reads them
+func formatSections(sections []templateSection) string {
+	lines := make([]string, len(sections))
+	for i, s := range sections {
+		lines[i] = s.Title
+		if s.Optional {
+			lines[i] = "? " + s.Title
+		}
+	}
+	return strings.Join(lines, "\n")
+}
+
+// Skeleton is the body a question of the template starts with
+func (t questionTemplate) Skeleton() string {
+	var b strings.Builder
+	for _, s := range t.Sections {
+		b.WriteString("## " + s.Title + "\n\n\n")
+	}
+	if t.RequireCode {
+		b.WriteString("```\n\n```\n")
+	}
+	return b.String()
+}
+
+var (
+	sectionHeading = regexp.MustCompile(`(?m)^##[ \t]+(.+?)[ \t#]*$`)
+	codeBlock      = regexp.MustCompile("(?s)```[^\n]*\n.*?\\S.*?\n```")
+)
+
+// check tells what the body of a question lacks to follow the template, empty when nothing
+func (t questionTemplate) check(body string) string {
+	// what is under each heading, up to the next one
+	content := map[string]string{}
+	matches := sectionHeading.FindAllStringSubmatchIndex(body, -1)
+	for i, m := range matches {
+		end := len(body)
+		if i+1 < len(matches) {
+			end = matches[i+1][0]
+		}
+		title := strings.ToLower(strings.TrimSpace(body[m[2]:m[3]]))
+		content[title] += strings.TrimSpace(body[m[1]:end])
+	}
+	var missing []string
+	for _, s := range t.Sections {
+		if !s.Optional && content[strings.ToLower(s.Title)] == "" {
+			missing = append(missing, `"`+s.Title+`"`)
+		}
+	}
+	if len(missing) == 1 {
+		return "fill in the section " + missing[0] + " of the template"
+	}
+	if len(missing) > 1 {
+		return "fill in the sections " + strings.Join(missing, ", ") + " of the template"
+	}
+	if t.RequireCode && !codeBlock.MatchString(body) {
+		return "the template asks for your code, in a block between ``` lines"
+	}
+	return ""
+}
+
+// templateColumns are the columns scanned by scanTemplate
+const templateColumns = `question_templates.id, question_templates.name, question_templates.description,
+	question_templates.sections, question_templates.require_code, users.username, question_templates.user_id`
+
+// scanTemplate scans a template, which the user can delete if they wrote it or moderate
+func scanTemplate(row scanner, user *User) (questionTemplate, error) {
+	var t questionTemplate
+	var sections string
+	var authorID int
+	err := row.Scan(&t.ID, &t.Name, &t.Description, &sections, &t.RequireCode, &t.Author, &authorID)
+	t.Sections = parseSections(sections)
+	t.CanEdit = user != nil && (user.UniqueID == authorID || isModerator(user))
+	return t, err
+}
+
+// questionTemplates loads the templates, by name
+func questionTemplates(ctx context.Context, user *User) ([]questionTemplate, error) {
+	rows, err := db.QueryContext(ctx, `select `+templateColumns+`
+		from question_templates join users on users.id = question_templates.user_id order by question_templates.name, question_templates.id`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var templates []questionTemplate
+	for rows.Next() {
+		t, err := scanTemplate(rows, user)
+		if err != nil {
+			return nil, err
+		}
+		templates = append(templates, t)
+	}
+	return templates, rows.Err()
+}
+
+// questionTemplateByID loads a template, nil if there is none
+func questionTemplateByID(ctx context.Context, user *User, id int) (*questionTemplate, error) {
+	t, err := scanTemplate(db.QueryRowContext(ctx, `select `+templateColumns+`
+		from question_templates join users on users.id = question_templates.user_id where question_templates.id = ?`, id), user)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &t, nil
+}
+
+// templatesPage is the data of the question templates page
+type templatesPage struct {
+	Templates   []questionTemplate
+	Name        string
+	Description string
+	Sections    string
+	RequireCode bool
+	Error       string
+}
+
+// serve /question-templates, where teachers and moderators add and delete question templates
+func serveQuestionTemplates(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	user := requireUser(w, r)
+	if user == nil {
+		return
+	}
+	if !staff(user) {
+		http.Error(w, "only teachers and moderators manage question templates", http.StatusForbidden)
+		return
+	}
+	p := templatesPage{Sections: "What I tried\nExpected\nActual\n? Notes"}
+
+	if r.Method == http.MethodPost {
+		switch r.FormValue("action") {
+		case "delete":
+			id, _ := strconv.Atoi(r.FormValue("id"))
+			t, err := questionTemplateByID(ctx, user, id)
+			if err != nil {
+				serverError(w, r, err)
+				return
+			}
+			if t == nil || !t.CanEdit {
+				http.Error(w, "Forbidden", http.StatusForbidden)
+				return
+			}
+			if _, err := db.ExecContext(ctx, "delete from question_templates where id = ?", id); err != nil {
+				serverError(w, r, err)
+				return
+			}
+			http.Redirect(w, r, "/question-templates", http.StatusSeeOther)
+			return
+		case "create":
+			p.Name = strings.TrimSpace(r.FormValue("name"))
+			p.Description = strings.TrimSpace(r.FormValue("description"))
+			p.RequireCode = r.FormValue("require_code") == "1"
+			sections := parseSections(r.FormValue("sections"))
+			p.Sections = formatSections(sections)
+			switch {
+			case p.Name == "" || len(p.Name) > maxTemplateName:
+				p.Error = "the name of a template is 1 to 100 characters"
+			case len(p.Description) > maxTemplateDescription:
+				p.Error = "the description is too long"
+			case len(sections) == 0 && !p.RequireCode:
+				p.Error = "a template has sections, or asks for code"
+			case len(sections) > maxTemplateSections:
+				p.Error = "a template has at most 20 sections"
+			default:
+				_, err := db.ExecContext(ctx, "insert into question_templates (name, description, sections, require_code, user_id, created_at) values (?, ?, ?, ?, ?, ?)",
+					p.Name, p.Description, p.Sections, p.RequireCode, user.UniqueID, time.Now().Format(timestampLayout))
+				if err != nil {
+					serverError(w, r, err)
+					return
+				}
+				http.Redirect(w, r, "/question-templates", http.StatusSeeOther)
+				return
+			}
+		default:
+			http.Error(w, "Bad Request", http.StatusBadRequest)
+			return
+		}
+	}
+
+	var err error
+	if p.Templates, err = questionTemplates(ctx, user); err != nil {
+		serverError(w, r, err)
+		return
+	}
+	render(w, r, "question-templates.html", p)
+}
+
+// loadTemplates sets the templates of the ask form, and the one chosen with the template
+// parameter. It answers with an error and returns false when they can't be loaded
+func (form *askForm) loadTemplates(w http.ResponseWriter, r *http.Request, user *User) bool {
+	ctx := r.Context()
+	var err error
+	if form.Templates, err = questionTemplates(ctx, user); err != nil {
+		serverError(w, r, err)
+		return false
+	}
+	form.CanTemplate = staff(user)
+	if id, _ := strconv.Atoi(r.FormValue("template")); id != 0 {
+		for i := range form.Templates {
+			if form.Templates[i].ID == id {
+				form.Template = &form.Templates[i]
+			}
+		}
+	}
+	return true
+}
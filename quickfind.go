@@ -0,0 +1,142 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// the quick-switcher finds questions, tags, users and admin pages by name as the user types.
+// results are filtered for the caller here, so it never learns about what it can't open
+
+// most results of each type
+const quickfindPerType = 5
+
+// quickResult is a result of the quick-switcher
+type quickResult struct {
+	Type  string `json:"type"` // question, tag, user or page
+	Title string `json:"title"`
+	URL   string `json:"url"`
+}
+
+// adminPage is a page of the admin area, with who can open it
+type adminPage struct {
+	Title     string
+	URL       string
+	Moderator bool // moderators can open it, otherwise only super-users
+}
+
+var adminPages = []adminPage{
+	{"Admin", "/admin", false},
+	{"Changelog", "/admin/changelog", false},
+	{"Flagged posts", "/admin/flags", true},
+	{"Tags", "/admin/tags", true},
+	{"Exams", "/admin/exams", true},
+	{"Muted users", "/admin/mutes", false},
+	{"Suspensions and bans", "/admin/sanctions", false},
+	{"Reserved names", "/admin/reserved-names", false},
+	{"Blocked words", "/admin/blocked-words", false},
+	{"Experiments", "/admin/experiments", false},
+	{"Features", "/admin/features", false},
+}
+
+// quickfind finds what the user can open matching the text
+func quickfind(ctx context.Context, user *User, text string) ([]quickResult, error) {
+	text = strings.ToLower(strings.TrimSpace(text))
+	results := []quickResult{}
+	if text == "" {
+		return results, nil
+	}
+	filter, args, err := questionFilter(ctx, user)
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := db.QueryContext(ctx, "select questions.id, questions.heading from questions where instr(lower(questions.heading), ?) > 0 and "+filter+
+		" order by questions.id desc limit ?", append(append([]interface{}{text}, args...), quickfindPerType)...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var id int
+		var heading string
+		if err := rows.Scan(&id, &heading); err != nil {
+			return nil, err
+		}
+		results = append(results, quickResult{"question", heading, fmt.Sprintf("/questions/%d", id)})
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	// the most used matching tags, counting the questions the user can see
+	tagRows, err := db.QueryContext(ctx, `select tags.name from tags join question_tags on question_tags.tag_id = tags.id
+		join questions on questions.id = question_tags.question_id where instr(tags.name, ?) > 0 and `+filter+`
+		group by tags.name order by count(*) desc, tags.name limit ?`, append(append([]interface{}{text}, args...), quickfindPerType)...)
+	if err != nil {
+		return nil, err
+	}
+	defer tagRows.Close()
+	for tagRows.Next() {
+		var t string
+		if err := tagRows.Scan(&t); err != nil {
+			return nil, err
+		}
+		results = append(results, quickResult{"tag", t, "/tags/" + url.PathEscape(t)})
+	}
+	if err := tagRows.Err(); err != nil {
+		return nil, err
+	}
+
+	userRows, err := db.QueryContext(ctx, "select username from users where instr(lower(username), ?) > 0 order by length(username), username limit ?",
+		text, quickfindPerType)
+	if err != nil {
+		return nil, err
+	}
+	defer userRows.Close()
+	for userRows.Next() {
+		var name string
+		if err := userRows.Scan(&name); err != nil {
+			return nil, err
+		}
+		results = append(results, quickResult{"user", name, "/users/" + url.PathEscape(name)})
+	}
+	if err := userRows.Err(); err != nil {
+		return nil, err
+	}
+
+	if isModerator(user) {
+		for _, p := range adminPages {
+			if (p.Moderator || user.SuperUser) && strings.Contains(strings.ToLower(p.Title), text) {
+				results = append(results, quickResult{"page", p.Title, p.URL})
+			}
+		}
+	}
+	return results, nil
+}
+
+// serve /api/v1/quickfind?q=..., the results of the quick-switcher for the caller
+func serveQuickfind(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	if r.Method != http.MethodGet {
+		writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	results, err := quickfind(ctx, currentUser(r), r.URL.Query().Get("q"))
+	if err != nil {
+		writeInternalError(w, r, err)
+		return
+	}
+	if results == nil {
+		results = []quickResult{}
+	}
+	writeJSON(w, http.StatusOK, quickfindResults{Results: results})
+}
+
+// quickfindResults is the answer of /api/v1/quickfind
+type quickfindResults struct {
+	Results []quickResult `json:"results"`
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// users can set quiet hours in their time zone. Notification emails during those hours
+// are held, and sent together in one summary once the quiet hours are over
+
+// layout of the start and end of quiet hours
+const quietLayout = "15:04"
+
+func init() {
+	jobHandlers["quiet-summary"] = sendQuietSummaryJob
+}
+
+// quietHours are the hours a user doesn't want emails, from Start to End in Zone.
+// they run over midnight when End is before Start
+type quietHours struct {
+	Start string // empty when the user has no quiet hours
+	End   string
+	Zone  string // IANA time zone, the server's when empty
+}
+
+// location is the time zone of the quiet hours
+func (q quietHours) location() *time.Location {
+	if loc, err := time.LoadLocation(q.Zone); err == nil && q.Zone != "" {
+		return loc
+	}
+	return time.Local
+}
+
+// until tells if t falls in the quiet hours, and when they end
+func (q quietHours) until(t time.Time) (time.Time, bool) {
+	start, err1 := time.Parse(quietLayout, q.Start)
+	end, err2 := time.Parse(quietLayout, q.End)
+	if err1 != nil || err2 != nil || q.Start == q.End {
+		return time.Time{}, false
+	}
+	lt := t.In(q.location())
+	minute := lt.Hour()*60 + lt.Minute()
+	s := start.Hour()*60 + start.Minute()
+	e := end.Hour()*60 + end.Minute()
+	ends := time.Date(lt.Year(), lt.Month(), lt.Day(), end.Hour(), end.Minute(), 0, 0, lt.Location())
+	switch {
+	case s < e && minute >= s && minute < e:
+		return ends, true
+	case s > e && minute >= s:
+		return ends.AddDate(0, 0, 1), true
+	case s > e && minute < e:
+		return ends, true
+	}
+	return time.Time{}, false
+}
+
+// userQuietHours loads the quiet hours of the user
+func userQuietHours(ctx context.Context, userID int) (quietHours, error) {
+	var q quietHours
+	err := db.QueryRowContext(ctx, "select coalesce(quiet_start, ''), coalesce(quiet_end, ''), coalesce(timezone, '') from users where id = ?",
+		userID).Scan(&q.Start, &q.End, &q.Zone)
+	return q, err
+}
+
+// sendOrHoldEmail queues an email to the user, or holds it for the summary during their quiet hours.
+// nothing is sent to users who opted out of emails
+func sendOrHoldEmail(ctx context.Context, userID int, to, subject, body string) error {
+	optIn, err := emailOptedIn(ctx, userID)
+	if err != nil || !optIn {
+		return err
+	}
+	q, err := userQuietHours(ctx, userID)
+	if err != nil {
+		return err
+	}
+	ends, quiet := q.until(time.Now())
+	if !quiet {
+		return queueEmail(ctx, to, subject, body)
+	}
+	_, err = db.ExecContext(ctx, "insert into held_emails (user_id, subject, body, created_at) values (?, ?, ?, ?)",
+		userID, subject, body, time.Now().Format(timestampLayout))
+	if err != nil {
+		return err
+	}
+	return scheduleQuietSummary(ctx, userID, ends)
+}
+
+// scheduleQuietSummary queues the summary of the user for the end of their quiet hours, unless one is waiting
+func scheduleQuietSummary(ctx context.Context, userID int, at time.Time) error {
+	var n int
+	err := db.QueryRowContext(ctx, "select count(*) from jobs where kind = 'quiet-summary' and payload = ? and done_at is null",
+		strconv.Itoa(userID)).Scan(&n)
+	if err != nil || n > 0 {
+		return err
+	}
+	return enqueueJobAt(ctx, "quiet-summary", userID, at)
+}
+
+// sendQuietSummaryJob sends the emails held for the user whose id is the payload
+func sendQuietSummaryJob(ctx context.Context, payload []byte) error {
+	var userID int
+	if err := json.Unmarshal(payload, &userID); err != nil {
+		return err
+	}
+	// the user may have moved their quiet hours since the summary was scheduled
+	q, err := userQuietHours(ctx, userID)
+	if err == sql.ErrNoRows {
+		_, err = db.ExecContext(ctx, "delete from held_emails where user_id = ?", userID)
+		return err
+	}
+	if err != nil {
+		return err
+	}
+	if ends, quiet := q.until(time.Now()); quiet {
+		// this job is still running, so the next summary gets its own job
+		return enqueueJobAt(ctx, "quiet-summary", userID, ends)
+	}
+
+	rows, err := db.QueryContext(ctx, "select id, subject, body from held_emails where user_id = ? order by id", userID)
+	if err != nil {
+		return err
+	}
+	var count, last int
+	var b strings.Builder
+	for rows.Next() {
+		var subject, body string
+		if err := rows.Scan(&last, &subject, &body); err != nil {
+			rows.Close()
+			return err
+		}
+		count++
+		b.WriteString("* " + strings.TrimSpace(body) + "\n\n")
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil || count == 0 {
+		return err
+	}
+
+	var email string
+	if err := db.QueryRowContext(ctx, "select coalesce(email, '') from users where id = ?", userID).Scan(&email); err != nil {
+		return err
+	}
+	if email != "" {
+		subject := fmt.Sprintf("%d notifications during your quiet hours", count)
+		if err := queueEmail(ctx, email, subject, b.String()); err != nil {
+			return err
+		}
+	}
+	// emails held while the summary was written wait for the next one
+	_, err = db.ExecContext(ctx, "delete from held_emails where user_id = ? and id <= ?", userID, last)
+	return err
+}
@@ -0,0 +1,247 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// registration is guarded against abuse: an address can only register a few accounts a day,
+// email addresses of disposable providers are refused, and with the invite-only feature on,
+// registering takes a code a teacher generated for their class on /invites
+
+// most accounts registered from an address in a day, unless SIGNUP_LIMIT says otherwise
+const defaultSignupLimit = 3
+
+// signupLimit is the most accounts registered from an address in a day
+func signupLimit() int {
+	if n, err := strconv.Atoi(os.Getenv("SIGNUP_LIMIT")); err == nil && n > 0 {
+		return n
+	}
+	return defaultSignupLimit
+}
+
+// signupsFrom counts the accounts registered from the address in the last day
+func signupsFrom(ctx context.Context, ip string) (int, error) {
+	var n int
+	err := db.QueryRowContext(ctx, "select count(*) from signups where ip = ? and created_at > ?",
+		ip, time.Now().Add(-24*time.Hour).Format(timestampLayout)).Scan(&n)
+	return n, err
+}
+
+// recordSignup keeps where an account was registered from, and with which invite code
+func recordSignup(ctx context.Context, userID int, ip, code string) error {
+	_, err := db.ExecContext(ctx, "insert into signups (user_id, ip, invite_code, created_at) values (?, ?, nullif(?, ''), ?)",
+		userID, ip, code, time.Now().Format(timestampLayout))
+	return err
+}
+
+// providers of throwaway addresses, on top of the domains blocked on /admin/email-domains
+var builtinDisposableDomains = map[string]bool{
+	"10minutemail.com":  true,
+	"dispostable.com":   true,
+	"fakeinbox.com":     true,
+	"getnada.com":       true,
+	"guerrillamail.com": true,
+	"maildrop.cc":       true,
+	"mailinator.com":    true,
+	"mintemail.com":     true,
+	"sharklasers.com":   true,
+	"temp-mail.org":     true,
+	"tempmail.com":      true,
+	"throwawaymail.com": true,
+	"trashmail.com":     true,
+	"yopmail.com":       true,
+}
+
+// disposableEmail tells if the address is at a blocked domain, or a subdomain of one
+func disposableEmail(ctx context.Context, address string) (bool, error) {
+	_, domain, _ := strings.Cut(strings.ToLower(address), "@")
+	var domains []interface{}
+	for domain != "" {
+		if builtinDisposableDomains[domain] {
+			return true, nil
+		}
+		domains = append(domains, domain)
+		_, domain, _ = strings.Cut(domain, ".")
+	}
+	if len(domains) == 0 {
+		return false, nil
+	}
+	var n int
+	err := db.QueryRowContext(ctx, "select count(*) from blocked_email_domains where domain in ("+placeholders(len(domains))+")", domains...).Scan(&n)
+	return n > 0, err
+}
+
+// blockedDomain is a domain of the email domains admin page
+type blockedDomain struct {
+	Domain  string
+	Builtin bool
+}
+
+// serve /admin/email-domains, where super-users block the domains of disposable addresses
+func serveEmailDomains(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	if requireSuperUser(w, r) == nil {
+		return
+	}
+	if r.Method == http.MethodPost {
+		domain := strings.ToLower(strings.TrimPrefix(strings.TrimSpace(r.FormValue("domain")), "@"))
+		var err error
+		switch {
+		case domain == "":
+		case r.FormValue("action") == "remove":
+			_, err = db.ExecContext(ctx, "delete from blocked_email_domains where domain = ?", domain)
+		default:
+			_, err = db.ExecContext(ctx, "insert or ignore into blocked_email_domains (domain) values (?)", domain)
+		}
+		if err != nil {
+			serverError(w, r, err)
+			return
+		}
+		http.Redirect(w, r, "/admin/email-domains", http.StatusSeeOther)
+		return
+	}
+
+	var domains []blockedDomain
+	for domain := range builtinDisposableDomains {
+		domains = append(domains, blockedDomain{Domain: domain, Builtin: true})
+	}
+	rows, err := db.QueryContext(ctx, "select domain from blocked_email_domains")
+	if err != nil {
+		serverError(w, r, err)
+		return
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var d blockedDomain
+		if err := rows.Scan(&d.Domain); err != nil {
+			serverError(w, r, err)
+			return
+		}
+		domains = append(domains, d)
+	}
+	sort.Slice(domains, func(i, j int) bool { return domains[i].Domain < domains[j].Domain })
+	render(w, r, "email-domains.html", domains)
+}
+
+// flag of the invite-only registration
+const featureInviteOnly = "invite-only"
+
+// inviteCode is a code a teacher generated for registering
+type inviteCode struct {
+	Code    string
+	Label   string // what the code is for, like the name of the class
+	MaxUses int
+	Uses    int
+	Expires string // empty for never
+	Revoked bool
+}
+
+// Usable tells if the code can still be used to register
+func (c inviteCode) Usable() bool {
+	return !c.Revoked && c.Uses < c.MaxUses && (c.Expires == "" || c.Expires > time.Now().Format(timestampLayout))
+}
+
+var errInvalidInvite = errors.New("this invite code isn't valid, or was used up")
+
+// useInvite counts a registration with the code, in the transaction creating the account
+func useInvite(ctx context.Context, code string) error {
+	res, err := db.ExecContext(ctx, `update invite_codes set uses = uses + 1 where code = ? and not revoked and uses < max_uses
+		and (expires_at is null or expires_at > ?)`, code, time.Now().Format(timestampLayout))
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return errInvalidInvite
+	}
+	return nil
+}
+
+// longest an invite code lasts, and most registrations it allows
+const (
+	maxInviteDays = 365
+	maxInviteUses = 500
+)
+
+// invitesPage is the data of the invites page
+type invitesPage struct {
+	Codes      []inviteCode
+	InviteOnly bool // registering takes a code
+	Error      string
+}
+
+// serve /invites, where teachers and moderators generate and revoke the codes to register with
+func serveInvites(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	user := requireUser(w, r)
+	if user == nil {
+		return
+	}
+	if !isModerator(user) && !hasUserType(user, "teacher") {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+	p := invitesPage{}
+	if r.Method == http.MethodPost {
+		var err error
+		if r.FormValue("action") == "revoke" {
+			_, err = db.ExecContext(ctx, "update invite_codes set revoked = true where code = ? and created_by = ?", r.FormValue("code"), user.UniqueID)
+		} else {
+			uses, _ := strconv.Atoi(r.FormValue("uses"))
+			days, _ := strconv.Atoi(r.FormValue("days"))
+			switch {
+			case uses < 1 || uses > maxInviteUses:
+				p.Error = "a code is for 1 to " + strconv.Itoa(maxInviteUses) + " registrations"
+			case days < 0 || days > maxInviteDays:
+				p.Error = "a code lasts up to " + strconv.Itoa(maxInviteDays) + " days"
+			default:
+				now := time.Now()
+				var expires sql.NullString
+				if days > 0 {
+					expires = sql.NullString{String: now.AddDate(0, 0, days).Format(timestampLayout), Valid: true}
+				}
+				_, err = db.ExecContext(ctx, `insert into invite_codes (code, label, created_by, max_uses, uses, expires_at, revoked, created_at)
+					values (?, ?, ?, ?, 0, ?, false, ?)`, strings.ToUpper(newToken()[:10]), strings.TrimSpace(r.FormValue("label")),
+					user.UniqueID, uses, expires, now.Format(timestampLayout))
+			}
+		}
+		if err != nil {
+			serverError(w, r, err)
+			return
+		}
+		if p.Error == "" {
+			http.Redirect(w, r, "/invites", http.StatusSeeOther)
+			return
+		}
+	}
+	var err error
+	if p.InviteOnly, err = featureEnabled(ctx, featureInviteOnly); err != nil {
+		serverError(w, r, err)
+		return
+	}
+	rows, err := db.QueryContext(ctx, `select code, label, max_uses, uses, coalesce(expires_at, ''), revoked from invite_codes
+		where created_by = ? order by created_at desc`, user.UniqueID)
+	if err != nil {
+		serverError(w, r, err)
+		return
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var c inviteCode
+		if err := rows.Scan(&c.Code, &c.Label, &c.MaxUses, &c.Uses, &c.Expires, &c.Revoked); err != nil {
+			serverError(w, r, err)
+			return
+		}
+		p.Codes = append(p.Codes, c)
+	}
+	render(w, r, "invites.html", p)
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"net/http"
+	"strings"
+)
+
+// tags are related by the questions they tag together. tag_pairs counts these questions for each
+// pair of tags, once in each direction so the tags related to one are read from the primary key.
+// Triggers on question_tags keep the counts as questions are asked, retagged, merged and deleted,
+// see the migrations in code.go
+
+// most related tags shown on the page of a tag and suggested while asking, and tags looked up at once
+const (
+	maxRelatedTags = 10
+	maxTagsLookup  = 10
+)
+
+// relatedTag is a tag found on questions with other tags
+type relatedTag struct {
+	Name      string `json:"name"`
+	Questions int    `json:"questions"` // tagged with it and the other tags
+}
+
+// relatedTags is the answer of /api/v1/related-tags
+type relatedTags struct {
+	Tags []relatedTag `json:"tags"`
+}
+
+// findRelatedTags lists the tags most often on questions with any of the given ones, the given ones aside
+func findRelatedTags(ctx context.Context, tags []string, limit int) ([]relatedTag, error) {
+	related := []relatedTag{}
+	if len(tags) == 0 {
+		return related, nil
+	}
+	in := strings.TrimSuffix(strings.Repeat("?, ", len(tags)), ", ")
+	var args []interface{}
+	for _, t := range tags {
+		args = append(args, t)
+	}
+	err := queryList(ctx, `select tags.name, sum(tag_pairs.questions) from tag_pairs cross join tags on tags.id = tag_pairs.related_id
+		where tag_pairs.tag_id in (select id from tags where name in (`+in+`)) and tags.name not in (`+in+`)
+		group by tags.id order by sum(tag_pairs.questions) desc, tags.name limit ?`,
+		append(append(args, args...), limit), func(rows *sql.Rows) error {
+			var t relatedTag
+			err := rows.Scan(&t.Name, &t.Questions)
+			related = append(related, t)
+			return err
+		})
+	if err != nil {
+		return nil, err
+	}
+	return related, nil
+}
+
+// serve /api/v1/related-tags?tags=..., the tags to suggest with a comma separated list of tags
+func serveRelatedTags(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	if r.Method != http.MethodGet {
+		writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	list, err := cleanTags(ctx, r.URL.Query().Get("tags"))
+	if err != nil {
+		writeInternalError(w, r, err)
+		return
+	}
+	tags := splitTags(strings.ToLower(list))
+	if len(tags) > maxTagsLookup {
+		tags = tags[:maxTagsLookup]
+	}
+	related, err := findRelatedTags(ctx, tags, maxRelatedTags)
+	if err != nil {
+		writeInternalError(w, r, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, relatedTags{Tags: related})
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/hex"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// logging in with "remember me" also sets a long-lived token, so that a new session starts when
+// the last one ended, like between classes. Tokens follow the selector/validator pattern: the
+// selector finds the token, the validator is only kept hashed. Each use replaces the token, and
+// changing the password or banning the user revokes them all
+
+// name of the cookie holding the remember-me token, as selector:validator
+const rememberCookie = "remember"
+
+// how long a remember-me token lasts unused
+const rememberDuration = 180 * 24 * time.Hour
+
+// hashValidator is the hash of the validator of a token, kept instead of it
+func hashValidator(validator string) string {
+	sum := sha256.Sum256([]byte(validator))
+	return hex.EncodeToString(sum[:])
+}
+
+// rememberUser makes a remember-me token for the user and sets its cookie
+func rememberUser(ctx context.Context, w http.ResponseWriter, userID int) error {
+	selector, validator := newToken()[:24], newToken()
+	expires := time.Now().Add(rememberDuration)
+	_, err := db.ExecContext(ctx, "insert into remember_tokens (selector, validator_hash, user_id, expires) values (?, ?, ?, ?)",
+		selector, hashValidator(validator), userID, expires.Format(timestampLayout))
+	if err != nil {
+		return err
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     rememberCookie,
+		Value:    selector + ":" + validator,
+		Path:     "/",
+		Expires:  expires,
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+	return nil
+}
+
+// forgetUser deletes the remember-me token of the request and its cookie, when logging out
+func forgetUser(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+	http.SetCookie(w, &http.Cookie{Name: rememberCookie, Value: "", Path: "/", MaxAge: -1})
+	cookie, err := r.Cookie(rememberCookie)
+	if err != nil {
+		return nil
+	}
+	selector, _, _ := strings.Cut(cookie.Value, ":")
+	_, err = db.ExecContext(ctx, "delete from remember_tokens where selector = ?", selector)
+	return err
+}
+
+// revokeRememberTokens deletes all the remember-me tokens of the user
+func revokeRememberTokens(ctx context.Context, userID int) error {
+	_, err := db.ExecContext(ctx, "delete from remember_tokens where user_id = ?", userID)
+	return err
+}
+
+// restoreSession starts a new session from the remember-me cookie of a request without one,
+// replacing the token. It returns the user logged in, nil when the cookie is missing or no
+// longer valid
+func restoreSession(w http.ResponseWriter, r *http.Request) (*User, error) {
+	ctx := r.Context()
+	cookie, err := r.Cookie(rememberCookie)
+	if err != nil {
+		return nil, nil
+	}
+	selector, validator, _ := strings.Cut(cookie.Value, ":")
+	var hash string
+	var userID int
+	err = db.QueryRowContext(ctx, "select validator_hash, user_id from remember_tokens where selector = ? and expires > ?",
+		selector, time.Now().Format(timestampLayout)).Scan(&hash, &userID)
+	// the cookie is kept: a request racing this one may just have replaced the token
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if subtle.ConstantTimeCompare([]byte(hashValidator(validator)), []byte(hash)) != 1 {
+		// a known selector with a wrong validator means the cookie was copied and used already:
+		// none of the tokens of the user can be trusted
+		http.SetCookie(w, &http.Cookie{Name: rememberCookie, Value: "", Path: "/", MaxAge: -1})
+		return nil, revokeRememberTokens(ctx, userID)
+	}
+	// the token is used once, whoever deletes it first gets the session
+	res, err := db.ExecContext(ctx, "delete from remember_tokens where selector = ?", selector)
+	if err != nil {
+		return nil, err
+	}
+	if n, err := res.RowsAffected(); err != nil || n == 0 {
+		return nil, err
+	}
+	user, err := scanUser(db.QueryRowContext(ctx, "select "+userColumns+" from users where id = ?", userID))
+	if err == sql.ErrNoRows || (err == nil && user.Banned) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := rememberUser(ctx, w, userID); err != nil {
+		return nil, err
+	}
+	if err := startSession(ctx, w, userID); err != nil {
+		return nil, err
+	}
+	return user, nil
+}
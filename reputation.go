@@ -0,0 +1,199 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// reputation is earned from the votes on the posts of a user and from bounties won,
+// and spent on bounties. It is computed from those tables rather than stored: the events of
+// reputationEventsSQL are summed, and listed on /users/{name}/reputation and by
+// /api/v1/users/{name}/reputation, grouped by day and by post. Only the user and moderators see
+// the history, which tells the anonymous questions and the course questions of the user
+
+// points of the votes, by type of post voted on
+const (
+	questionUpPoints = 5
+	answerUpPoints   = 10
+	downVotePoints   = -2
+)
+
+// reputation every user starts with
+const baseReputation = 1
+
+// kinds of reputation events
+const (
+	reputationUpvote        = "upvote"
+	reputationDownvote      = "downvote"
+	reputationBountyWon     = "bounty won"
+	reputationBountyOffered = "bounty offered"
+)
+
+// reputationEventsSQL selects the reputation events of a user, as rows of kind, points, post_type,
+// post_id, question_id, heading and at, from the arguments username, username, user id and user id
+var reputationEventsSQL = fmt.Sprintf(`select case when votes.value > 0 then '%[1]s' else '%[2]s' end as kind,
+		case when votes.value > 0 then %[5]d else %[7]d end as points, 'question' as post_type, questions.id as post_id,
+		questions.id as question_id, questions.heading, votes.voted_at as at
+		from votes join questions on votes.post_type = 'question' and votes.post_id = questions.id where questions.user = ?
+	union all
+	select case when votes.value > 0 then '%[1]s' else '%[2]s' end, case when votes.value > 0 then %[6]d else %[7]d end,
+		'answer', answers.id, answers.question_id, coalesce(questions.heading, ''), votes.voted_at
+		from votes join answers on votes.post_type = 'answer' and votes.post_id = answers.id
+		left join questions on questions.id = answers.question_id where answers.user = ?
+	union all
+	select '%[3]s', bounties.amount, 'answer', coalesce(bounties.answer_id, 0), bounties.question_id, coalesce(questions.heading, ''),
+		coalesce(bounties.closed_at, bounties.created_at)
+		from bounties left join questions on questions.id = bounties.question_id where bounties.awarded_to = ?
+	union all
+	select '%[4]s', -bounties.amount, 'question', bounties.question_id, bounties.question_id, coalesce(questions.heading, ''),
+		bounties.created_at
+		from bounties left join questions on questions.id = bounties.question_id where bounties.user_id = ?`,
+	reputationUpvote, reputationDownvote, reputationBountyWon, reputationBountyOffered,
+	questionUpPoints, answerUpPoints, downVotePoints)
+
+// reputationEventsArgs are the arguments of reputationEventsSQL for the user
+func reputationEventsArgs(user *User) []interface{} {
+	return []interface{}{user.UserName, user.UserName, user.UniqueID, user.UniqueID}
+}
+
+// reputation computes the reputation of the user
+func reputation(ctx context.Context, user *User) (int, error) {
+	var rep int
+	err := db.QueryRowContext(ctx, "select coalesce(sum(points), 0) from ("+reputationEventsSQL+")", reputationEventsArgs(user)...).Scan(&rep)
+	return baseReputation + rep, err
+}
+
+// reputationPost is the reputation a post earned, in all or on a day
+type reputationPost struct {
+	PostType   string `json:"post_type"`
+	PostID     int    `json:"post_id"` // 0 for a bounty awarded without an answer
+	QuestionID int    `json:"question_id"`
+	Heading    string `json:"heading"` // of the question
+	Points     int    `json:"points"`
+	Upvotes    int    `json:"upvotes"`
+	Downvotes  int    `json:"downvotes"`
+	Bounties   int    `json:"bounties"` // won by an answer, or offered on a question
+}
+
+// reputationDay is the reputation earned on a day, by post
+type reputationDay struct {
+	Day    string           `json:"day"`
+	Points int              `json:"points"`
+	Posts  []reputationPost `json:"posts"`
+}
+
+// reputationHistory is where the reputation of a user came from
+type reputationHistory struct {
+	User       string           `json:"user"`
+	Reputation int              `json:"reputation"`
+	Base       int              `json:"base"`  // every user starts with
+	Days       []reputationDay  `json:"days"`  // the latest first
+	Posts      []reputationPost `json:"posts"` // the most rewarding first
+}
+
+// reputationPostColumns aggregates the events of a post
+const reputationPostColumns = "post_type, post_id, question_id, heading, sum(points), sum(kind = ?), sum(kind = ?), sum(kind in (?, ?))"
+
+// reputationPostArgs are the arguments of reputationPostColumns
+var reputationPostArgs = []interface{}{reputationUpvote, reputationDownvote, reputationBountyWon, reputationBountyOffered}
+
+// scanReputationPost scans a row selected with reputationPostColumns
+func scanReputationPost(row scanner) (reputationPost, error) {
+	var p reputationPost
+	err := row.Scan(&p.PostType, &p.PostID, &p.QuestionID, &p.Heading, &p.Points, &p.Upvotes, &p.Downvotes, &p.Bounties)
+	return p, err
+}
+
+// loadReputationHistory loads the reputation events of the user grouped by day and by post
+func loadReputationHistory(ctx context.Context, user *User) (reputationHistory, error) {
+	h := reputationHistory{User: user.UserName, Base: baseReputation, Reputation: baseReputation, Days: []reputationDay{}, Posts: []reputationPost{}}
+	args := append(append([]interface{}{}, reputationPostArgs...), reputationEventsArgs(user)...)
+	err := queryList(ctx, "select substr(at, 1, 10) as day, "+reputationPostColumns+" from ("+reputationEventsSQL+`)
+		group by day, post_type, post_id, question_id, heading order by day desc, min(at)`, args, func(rows *sql.Rows) error {
+		var day string
+		var p reputationPost
+		err := rows.Scan(&day, &p.PostType, &p.PostID, &p.QuestionID, &p.Heading, &p.Points, &p.Upvotes, &p.Downvotes, &p.Bounties)
+		if n := len(h.Days); n == 0 || h.Days[n-1].Day != day {
+			h.Days = append(h.Days, reputationDay{Day: day})
+		}
+		d := &h.Days[len(h.Days)-1]
+		d.Points += p.Points
+		d.Posts = append(d.Posts, p)
+		h.Reputation += p.Points
+		return err
+	})
+	if err != nil {
+		return h, err
+	}
+	err = queryList(ctx, "select "+reputationPostColumns+" from ("+reputationEventsSQL+`)
+		group by post_type, post_id, question_id, heading order by sum(points) desc, post_type, post_id`, args, func(rows *sql.Rows) error {
+		p, err := scanReputationPost(rows)
+		h.Posts = append(h.Posts, p)
+		return err
+	})
+	return h, err
+}
+
+// canSeeReputationHistory tells if the user may see the reputation history of the member
+func canSeeReputationHistory(user, member *User) bool {
+	return user != nil && (user.UniqueID == member.UniqueID || isModerator(user))
+}
+
+// serveReputationPage renders /users/{name}/reputation, the reputation history of the member
+func serveReputationPage(w http.ResponseWriter, r *http.Request, member *User) {
+	user := requireUser(w, r)
+	if user == nil {
+		return
+	}
+	if !canSeeReputationHistory(user, member) {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+	h, err := loadReputationHistory(r.Context(), member)
+	if err != nil {
+		serverError(w, r, err)
+		return
+	}
+	render(w, r, "reputation.html", h)
+}
+
+// serve /api/v1/users/{name}/reputation, the reputation history of a user for themselves and moderators
+func serveReputationAPI(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	if r.Method != http.MethodGet {
+		writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	user := currentUser(r)
+	if user == nil {
+		writeJSONError(w, http.StatusUnauthorized, "log in to see a reputation history")
+		return
+	}
+	name, rest, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/api/v1/users/"), "/")
+	if name == "" || rest != "reputation" {
+		writeJSONError(w, http.StatusNotFound, "not found")
+		return
+	}
+	member, err := userByName(ctx, name)
+	if err != nil {
+		writeInternalError(w, r, err)
+		return
+	}
+	if member == nil {
+		writeJSONError(w, http.StatusNotFound, "there is no user "+name)
+		return
+	}
+	if !canSeeReputationHistory(user, member) {
+		writeJSONError(w, http.StatusForbidden, "only the user and moderators see a reputation history")
+		return
+	}
+	h, err := loadReputationHistory(ctx, member)
+	if err != nil {
+		writeInternalError(w, r, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, h)
+}
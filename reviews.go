@@ -0,0 +1,341 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// trusted users, moderators and those with reviewReputation, work through review queues at
+// /review: the first questions and the first answers of new users, and the posts that look low
+// quality, down voted or very short. Each post is shown to a reviewer once, whichever the queue,
+// and leaves its queue after reviewsToComplete reviews. Reviewers approve a post, edit it or flag
+// it, and who reviewed what is kept in the reviews table
+
+// reputation needed to review, for users who aren't moderators
+const reviewReputation = 500
+
+// reviews taking a post out of its queue, skips not counted
+const reviewsToComplete = 2
+
+// posts older than this aren't reviewed anymore
+const reviewWindow = 30 * 24 * time.Hour
+
+// posts shorter than this are low quality
+const lowQualityLength = 30
+
+// review actions
+const (
+	reviewApprove = "approve"
+	reviewEdit    = "edit"
+	reviewFlag    = "flag"
+	reviewSkip    = "skip"
+)
+
+// reviewQueue is a queue of posts to review
+type reviewQueue struct {
+	Name    string // in the url of the queue
+	Title   string
+	Summary string
+	// posts of the queue, as rows of post_type, post_id, user, date and question_id
+	posts string
+}
+
+var reviewQueues = []reviewQueue{
+	{
+		Name:    "first-questions",
+		Title:   "First questions",
+		Summary: "The first question of each user, to welcome them and help them ask well",
+		posts: `select 'question' post_type, questions.id post_id, questions.user, questions.date, questions.id question_id from questions
+			where questions.hidden_at is null and not exists (select 1 from questions earlier where lower(earlier.user) = lower(questions.user) and earlier.id < questions.id)`,
+	},
+	{
+		Name:    "first-answers",
+		Title:   "First answers",
+		Summary: "The first answer of each user, to check it answers the question",
+		posts: `select 'answer' post_type, answers.id post_id, answers.user, answers.date, answers.question_id from answers
+			where answers.hidden_at is null and not exists (select 1 from answers earlier where lower(earlier.user) = lower(answers.user) and earlier.id < answers.id)`,
+	},
+	{
+		Name:    "low-quality",
+		Title:   "Low quality",
+		Summary: fmt.Sprintf("Questions and answers voted down, or shorter than %d characters", lowQualityLength),
+		posts: fmt.Sprintf(`select 'question' post_type, questions.id post_id, questions.user, questions.date, questions.id question_id from questions
+			where questions.hidden_at is null and (%s < 0 or length(trim(questions.body)) < %d)
+			union all
+			select 'answer', answers.id, answers.user, answers.date, answers.question_id from answers
+			where answers.hidden_at is null and (%s < 0 or length(trim(answers.body)) < %d)`, questionScoreSQL, lowQualityLength, answerScoreSQL, lowQualityLength),
+	},
+}
+
+// findReviewQueue finds a queue by name, nil if there is none
+func findReviewQueue(name string) *reviewQueue {
+	for i := range reviewQueues {
+		if reviewQueues[i].Name == name {
+			return &reviewQueues[i]
+		}
+	}
+	return nil
+}
+
+// canReview tells if the user may work through the review queues
+func canReview(ctx context.Context, user *User) (bool, error) {
+	if user == nil {
+		return false, nil
+	}
+	if isModerator(user) {
+		return true, nil
+	}
+	rep, err := reputation(ctx, user)
+	return rep >= reviewReputation, err
+}
+
+// pending is the query of the posts of the queue left for the reviewer, the oldest first: recent
+// posts of others the reviewer can see and never reviewed, still short of their reviews
+func (q *reviewQueue) pending(ctx context.Context, reviewer *User, columns string) (string, []interface{}, error) {
+	filter, args, err := questionFilter(ctx, reviewer)
+	if err != nil {
+		return "", nil, err
+	}
+	query := "select " + columns + " from (" + q.posts + `) posts join questions on questions.id = posts.question_id
+		where ` + filter + ` and posts.date >= ? and lower(posts.user) != lower(?)
+		and not exists (select 1 from reviews where reviews.post_type = posts.post_type and reviews.post_id = posts.post_id and reviews.user_id = ?)
+		and (select count(*) from reviews where reviews.queue = ? and reviews.post_type = posts.post_type and reviews.post_id = posts.post_id
+			and reviews.action != ?) < ?`
+	args = append(args, time.Now().Add(-reviewWindow).Format(dateLayout), reviewer.UserName, reviewer.UniqueID,
+		q.Name, reviewSkip, reviewsToComplete)
+	return query, args, nil
+}
+
+// pendingCount is the number of posts of the queue left for the reviewer
+func (q *reviewQueue) pendingCount(ctx context.Context, reviewer *User) (int, error) {
+	query, args, err := q.pending(ctx, reviewer, "count(*)")
+	if err != nil {
+		return 0, err
+	}
+	var n int
+	err = db.QueryRowContext(ctx, query, args...).Scan(&n)
+	return n, err
+}
+
+// reviewItem is a post to review
+type reviewItem struct {
+	PostType   string
+	PostID     int
+	QuestionID int
+	Author     string // empty for an anonymous question
+	Heading    string // of the question, the post being an answer or the question itself
+	Body       string
+	Date       string
+	Reviews    int // of the post in the queue so far
+}
+
+// next loads the next post of the queue for the reviewer, nil when the queue is done
+func (q *reviewQueue) next(ctx context.Context, reviewer *User) (*reviewItem, error) {
+	query, args, err := q.pending(ctx, reviewer, "posts.post_type, posts.post_id")
+	if err != nil {
+		return nil, err
+	}
+	var item reviewItem
+	err = db.QueryRowContext(ctx, query+" order by posts.date, posts.post_id limit 1", args...).Scan(&item.PostType, &item.PostID)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	switch item.PostType {
+	case postQuestion:
+		qn, err := questionByID(ctx, item.PostID)
+		if err != nil || qn == nil {
+			return nil, err
+		}
+		maskAuthor(qn, reviewer)
+		item.QuestionID, item.Author, item.Heading, item.Body, item.Date = qn.QnID, qn.QnUser, qn.QnHeading, qn.QnBody, qn.QnDate
+	case postAnswer:
+		a, err := answerByID(ctx, item.PostID)
+		if err != nil || a == nil {
+			return nil, err
+		}
+		item.QuestionID, item.Author, item.Body, item.Date = a.AnsQn, a.AnsUser, a.AnsBody, a.AnsDate
+		if err := db.QueryRowContext(ctx, "select heading from questions where id = ?", a.AnsQn).Scan(&item.Heading); err != nil {
+			return nil, err
+		}
+	}
+	err = db.QueryRowContext(ctx, "select count(*) from reviews where queue = ? and post_type = ? and post_id = ? and action != ?",
+		q.Name, item.PostType, item.PostID, reviewSkip).Scan(&item.Reviews)
+	return &item, err
+}
+
+// recordReview keeps the review of a post by the reviewer
+func recordReview(ctx context.Context, reviewer *User, queue, postType string, postID int, action string) error {
+	_, err := db.ExecContext(ctx, "insert or ignore into reviews (queue, post_type, post_id, user_id, action, created_at) values (?, ?, ?, ?, ?, ?)",
+		queue, postType, postID, reviewer.UniqueID, action, time.Now().Format(timestampLayout))
+	return err
+}
+
+// reviewEditPost saves the edit of a post by a reviewer
+func reviewEditPost(ctx context.Context, reviewer *User, postType string, postID int, heading, body string) (questionID int, err error) {
+	now := time.Now().Format(timestampLayout)
+	err = db.WithTx(ctx, func(ctx context.Context) error {
+		var res sql.Result
+		var err error
+		switch postType {
+		case postQuestion:
+			questionID = postID
+			res, err = db.ExecContext(ctx, "update questions set heading = ?, body = ?, edited_at = ? where id = ?", heading, body, now, postID)
+		case postAnswer:
+			if err := db.QueryRowContext(ctx, "select question_id from answers where id = ?", postID).Scan(&questionID); err != nil {
+				return err
+			}
+			res, err = db.ExecContext(ctx, "update answers set body = ?, edited_at = ? where id = ?", body, now, postID)
+		default:
+			return errPostNotFound
+		}
+		if err != nil {
+			return err
+		}
+		if n, err := res.RowsAffected(); err != nil {
+			return err
+		} else if n == 0 {
+			return errPostNotFound
+		}
+		return recordActivity(ctx, reviewer.UniqueID, activityEdited, postType, postID, questionID, "")
+	})
+	if err == sql.ErrNoRows {
+		err = errPostNotFound
+	}
+	return questionID, err
+}
+
+// reviewQueueCount is a queue with the number of posts left in it for the reviewer
+type reviewQueueCount struct {
+	reviewQueue
+	Pending int
+}
+
+// reviewPage is the data of the review pages: the list of the queues, or a post of a queue
+type reviewPage struct {
+	Queues     []reviewQueueCount
+	Queue      *reviewQueue
+	Item       *reviewItem
+	Reasons    []string
+	Reputation int // needed to review
+	Allowed    bool
+}
+
+// serve /review, the list of the review queues, and /review/{queue}, where the posts of a
+// queue are reviewed one by one
+func serveReview(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	// reviewing edits and flags posts, which refuseSuspended keeps suspended users from
+	user := requireUser(w, r)
+	if user == nil {
+		return
+	}
+	p := reviewPage{Reasons: flagReasons, Reputation: reviewReputation}
+	var err error
+	if p.Allowed, err = canReview(ctx, user); err != nil {
+		serverError(w, r, err)
+		return
+	}
+	name := strings.Trim(strings.TrimPrefix(r.URL.Path, "/review"), "/")
+	if !p.Allowed {
+		if name != "" {
+			http.Error(w, "Reviewing takes "+strconv.Itoa(reviewReputation)+" reputation", http.StatusForbidden)
+			return
+		}
+		render(w, r, "review.html", p)
+		return
+	}
+	if name == "" {
+		for _, q := range reviewQueues {
+			n, err := q.pendingCount(ctx, user)
+			if err != nil {
+				serverError(w, r, err)
+				return
+			}
+			p.Queues = append(p.Queues, reviewQueueCount{reviewQueue: q, Pending: n})
+		}
+		render(w, r, "review.html", p)
+		return
+	}
+	if p.Queue = findReviewQueue(name); p.Queue == nil {
+		http.NotFound(w, r)
+		return
+	}
+	if r.Method == http.MethodPost {
+		serveReviewAction(w, r, user, p.Queue)
+		return
+	}
+	if p.Item, err = p.Queue.next(ctx, user); err != nil {
+		serverError(w, r, err)
+		return
+	}
+	render(w, r, "review.html", p)
+}
+
+// serveReviewAction handles the review of a post of the queue, then goes on to the next one
+func serveReviewAction(w http.ResponseWriter, r *http.Request, user *User, queue *reviewQueue) {
+	ctx := r.Context()
+	postType := r.FormValue("post_type")
+	postID, err := strconv.Atoi(r.FormValue("post_id"))
+	if err != nil || (postType != postQuestion && postType != postAnswer) {
+		http.Error(w, "Bad Request", http.StatusBadRequest)
+		return
+	}
+	action := r.FormValue("action")
+	switch action {
+	case reviewApprove, reviewSkip:
+	case reviewEdit:
+		heading, body := strings.TrimSpace(r.FormValue("heading")), strings.TrimSpace(r.FormValue("body"))
+		if body == "" || (postType == postQuestion && heading == "") {
+			http.Error(w, "the heading and the body can't be empty", http.StatusBadRequest)
+			return
+		}
+		questionID, err := reviewEditPost(ctx, user, postType, postID, heading, body)
+		if err == errPostNotFound {
+			http.NotFound(w, r)
+			return
+		}
+		if err != nil {
+			serverError(w, r, err)
+			return
+		}
+		questionCache.invalidate(questionID)
+	case reviewFlag:
+		reason := r.FormValue("reason")
+		valid := false
+		for _, f := range flagReasons {
+			valid = valid || f == reason
+		}
+		if !valid {
+			http.Error(w, "choose a reason among "+strings.Join(flagReasons, ", "), http.StatusBadRequest)
+			return
+		}
+		switch err := flagPost(ctx, user, postType, postID, reason); err {
+		case nil:
+		case errPostNotFound:
+			http.NotFound(w, r)
+			return
+		case errOwnFlag:
+			http.Error(w, err.Error(), http.StatusForbidden)
+			return
+		default:
+			serverError(w, r, err)
+			return
+		}
+	default:
+		http.Error(w, "Bad Request", http.StatusBadRequest)
+		return
+	}
+	if err := recordReview(ctx, user, queue.Name, postType, postID, action); err != nil {
+		serverError(w, r, err)
+		return
+	}
+	http.Redirect(w, r, "/review/"+queue.Name, http.StatusSeeOther)
+}
@@ -0,0 +1,230 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"learning-qa/middleware"
+)
+
+// super-users can suspend a user for some days or ban them for good, with a reason.
+// suspended users can still read but not post, banned users can't log in at all
+
+// longest suspension, banning is for longer
+const maxSuspensionDays = 365
+
+// columns of users giving the sanctions in force, selected by userColumns
+const sanctionColumns = `exists (select 1 from sanctions where sanctions.user_id = users.id and kind = 'ban' and lifted_at is null),
+	(select coalesce(max(until), '') from sanctions where sanctions.user_id = users.id and kind = 'suspend' and lifted_at is null)`
+
+// sanction is a suspension or a ban of a user
+type sanction struct {
+	ID       int
+	UserName string
+	Kind     string // "suspend" or "ban"
+	Reason   string
+	Until    string // end of a suspension
+	By       string
+	Created  string
+	Lifted   string
+}
+
+// sanctionError tells the user why they can't post, empty when they can
+func sanctionError(ctx context.Context, user *User) string {
+	if user.Suspension == "" {
+		return ""
+	}
+	var reason string
+	err := db.QueryRowContext(ctx, `select reason from sanctions where user_id = ? and kind = 'suspend' and lifted_at is null
+		order by until desc limit 1`, user.UniqueID).Scan(&reason)
+	if err != nil {
+		reason = ""
+	}
+	msg := "your account is suspended until " + user.Suspension
+	if reason != "" {
+		msg += ": " + reason
+	}
+	return msg
+}
+
+// the routes where users post, matched like the routes of routeLimits, which suspended users
+// can still read but not write to. Following, bookmarking and their settings stay open to them
+var postingRoutes = []string{
+	"/ask",
+	"/questions/*/answer",
+	"/questions/*/edit",
+	"/questions/*/comment",
+	"/questions/*/vote",
+	"/questions/*/flag",
+	"/questions/*/bounty",
+	"/questions/*/" + voteClose,
+	"/questions/*/" + voteReopen,
+	"/answers/*/edit",
+	"/answers/*/comment",
+	"/answers/*/vote",
+	"/answers/*/flag",
+	"/answers/*/accept",
+	"/comments/*/vote",
+	"/comments/*/flag",
+	"/comments/*/convert",
+	"/tags/*/edit",
+	"/review/*",
+}
+
+// postingRoute tells whether the path is one of the routes
+func postingRoute(routes []string, urlPath string) bool {
+	for _, pattern := range routes {
+		if ok, _ := path.Match(pattern, urlPath); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// refuseSuspended answers the writes of suspended users to the routes with why they can't post,
+// so that the handlers behind them don't each have to check
+func refuseSuspended(routes []string) middleware.Middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.Method != http.MethodGet && r.Method != http.MethodHead && postingRoute(routes, r.URL.Path) {
+				if user := currentUser(r); user != nil {
+					if msg := sanctionError(r.Context(), user); msg != "" {
+						http.Error(w, msg, http.StatusForbidden)
+						return
+					}
+				}
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// load the sanctions of a user, or of everyone when userID is 0, the latest first
+func sanctionsOf(ctx context.Context, userID int) ([]sanction, error) {
+	query := `select sanctions.id, users.username, kind, reason, coalesce(until, ''), coalesce(by.username, ''), created_at, coalesce(lifted_at, '')
+		from sanctions join users on users.id = sanctions.user_id left join users as by on by.id = sanctions.created_by`
+	var args []interface{}
+	if userID != 0 {
+		query += " where sanctions.user_id = ?"
+		args = append(args, userID)
+	}
+	rows, err := db.QueryContext(ctx, query+" order by sanctions.id desc limit 200", args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var list []sanction
+	for rows.Next() {
+		var s sanction
+		if err := rows.Scan(&s.ID, &s.UserName, &s.Kind, &s.Reason, &s.Until, &s.By, &s.Created, &s.Lifted); err != nil {
+			return nil, err
+		}
+		list = append(list, s)
+	}
+	return list, rows.Err()
+}
+
+// handle POST /users/{name}/sanction, where super-users suspend, ban, or lift the sanctions of the member
+func serveSanction(w http.ResponseWriter, r *http.Request, member *User) {
+	ctx := r.Context()
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	admin := requireSuperUser(w, r)
+	if admin == nil {
+		return
+	}
+	if member.UniqueID == admin.UniqueID || member.SuperUser {
+		http.Error(w, "super-users can't be sanctioned", http.StatusBadRequest)
+		return
+	}
+	now := time.Now()
+	reason := strings.TrimSpace(r.FormValue("reason"))
+	before := sanctionSnapshot{Banned: member.Banned, Suspension: member.Suspension}
+	after := sanctionSnapshot{Banned: member.Banned, Suspension: member.Suspension, Reason: reason}
+	// the sanction and its audit entry are written together
+	var action string
+	var apply func(ctx context.Context) error
+	switch r.FormValue("action") {
+	case "suspend":
+		days, err := strconv.Atoi(r.FormValue("days"))
+		if err != nil || days < 1 || days > maxSuspensionDays {
+			http.Error(w, fmt.Sprintf("a suspension lasts from 1 to %d days", maxSuspensionDays), http.StatusBadRequest)
+			return
+		}
+		action, after.Suspension = auditSuspend, now.AddDate(0, 0, days).Format(timestampLayout)
+		apply = func(ctx context.Context) error {
+			_, err := db.ExecContext(ctx, "insert into sanctions (user_id, kind, reason, until, created_by, created_at) values (?, 'suspend', ?, ?, ?, ?)",
+				member.UniqueID, reason, after.Suspension, admin.UniqueID, now.Format(timestampLayout))
+			return err
+		}
+	case "ban":
+		action, after.Banned = auditBan, true
+		apply = func(ctx context.Context) error {
+			return banUser(ctx, member.UniqueID, admin.UniqueID, reason, now)
+		}
+	case "lift":
+		action, after = auditLiftSanctions, sanctionSnapshot{Reason: reason}
+		apply = func(ctx context.Context) error {
+			_, err := db.ExecContext(ctx, "update sanctions set lifted_at = ? where user_id = ? and lifted_at is null", now.Format(timestampLayout), member.UniqueID)
+			return err
+		}
+	default:
+		http.Error(w, "unknown action", http.StatusBadRequest)
+		return
+	}
+	err := db.WithTx(ctx, func(ctx context.Context) error {
+		if err := apply(ctx); err != nil {
+			return err
+		}
+		return recordAudit(ctx, admin, action, "user", member.UserName, before, after)
+	})
+	if err != nil {
+		serverError(w, r, err)
+		return
+	}
+	http.Redirect(w, r, "/users/"+url.PathEscape(member.UserName), http.StatusSeeOther)
+}
+
+// banUser records the ban and forgets the remembered logins of the user, in the transaction of
+// the context. The sessions, which may be kept outside of the database, end once it commits
+func banUser(ctx context.Context, userID, adminID int, reason string, now time.Time) error {
+	return db.WithTx(ctx, func(ctx context.Context) error {
+		_, err := db.ExecContext(ctx, "insert into sanctions (user_id, kind, reason, created_by, created_at) values (?, 'ban', ?, ?, ?)",
+			userID, reason, adminID, now.Format(timestampLayout))
+		if err != nil {
+			return err
+		}
+		if _, err := db.ExecContext(ctx, "delete from remember_tokens where user_id = ?", userID); err != nil {
+			return err
+		}
+		// the transaction is over by then, and the sessions must end even if the request was canceled
+		db.AfterCommit(ctx, func() {
+			if err := sessions.DeleteUser(context.Background(), userID); err != nil {
+				fmt.Println(err)
+			}
+		})
+		return nil
+	})
+}
+
+// serve /admin/sanctions, the latest suspensions and bans
+func serveSanctionsAdmin(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	if requireSuperUser(w, r) == nil {
+		return
+	}
+	list, err := sanctionsOf(ctx, 0)
+	if err != nil {
+		serverError(w, r, err)
+		return
+	}
+	render(w, r, "sanctions-admin.html", list)
+}
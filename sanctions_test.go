@@ -0,0 +1,47 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestSuspendedCantPost checks that suspended users can read but are refused on every posting
+// route, whatever its handler checks
+func TestSuspendedCantPost(t *testing.T) {
+	srv := newTestServer(t)
+	handler := srv.Routes()
+	suspendedID, suspended := testUser(t, "student1")
+	_, other := testUser(t, "student2")
+	testExec(t, "insert into sanctions (user_id, kind, reason, until, created_at) values (?, 'suspend', 'spam', ?, ?)",
+		suspendedID, time.Now().Add(24*time.Hour).Format(timestampLayout), time.Now().Format(timestampLayout))
+	testExec(t, "insert into questions (id, heading, body, date, time, user, views, open) values (1, 'A question', 'body', '2026-01-01', '10:00:00', 'student2', 0, 1)")
+
+	serve := func(method, target string, cookie *http.Cookie) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, target, strings.NewReader("body=text"))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.AddCookie(cookie)
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		return rec
+	}
+
+	for _, route := range postingRoutes {
+		target := strings.ReplaceAll(route, "*", "1")
+		rec := serve(http.MethodPost, target, suspended)
+		if rec.Code != http.StatusForbidden || !strings.Contains(rec.Body.String(), "suspended") {
+			t.Errorf("POST %s by a suspended user: %d %s", target, rec.Code, rec.Body)
+		}
+		if rec := serve(http.MethodPost, target, other); strings.Contains(rec.Body.String(), "suspended") {
+			t.Errorf("POST %s by a user in good standing: %d %s", target, rec.Code, rec.Body)
+		}
+	}
+	if rec := serve(http.MethodGet, "/questions/1", suspended); rec.Code != http.StatusOK {
+		t.Errorf("GET /questions/1 by a suspended user: %d", rec.Code)
+	}
+	if rec := serve(http.MethodPost, "/questions/1/follow", suspended); rec.Code == http.StatusForbidden {
+		t.Errorf("POST /questions/1/follow by a suspended user: %d %s", rec.Code, rec.Body)
+	}
+}
@@ -0,0 +1,387 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"html"
+	"html/template"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"learning-qa/searchquery"
+)
+
+// most questions returned as possible duplicates
+const maxSimilarQuestions = 5
+
+// questions whose title is less similar than this aren't proposed as duplicates
+const minTitleSimilarity = 0.25
+
+// asking a question whose title is at least this similar to another one takes a confirmation
+const duplicateTitleSimilarity = 0.8
+
+// common words that don't tell questions apart
+var stopWords = map[string]bool{
+	"a": true, "an": true, "and": true, "are": true, "as": true, "at": true, "be": true,
+	"by": true, "can": true, "do": true, "does": true, "for": true, "from": true, "how": true,
+	"i": true, "in": true, "is": true, "it": true, "my": true, "of": true, "on": true,
+	"or": true, "the": true, "to": true, "use": true, "what": true, "when": true,
+	"why": true, "with": true,
+}
+
+// titleWords splits a title into its lowercase words, without stop words and duplicates
+func titleWords(title string) []string {
+	var words []string
+	seen := map[string]bool{}
+	for _, w := range strings.FieldsFunc(strings.ToLower(title), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	}) {
+		if stopWords[w] || seen[w] {
+			continue
+		}
+		seen[w] = true
+		words = append(words, w)
+	}
+	return words
+}
+
+// titleSimilarity is the share of distinct words two titles have in common (Jaccard index)
+func titleSimilarity(a, b []string) float64 {
+	if len(a) == 0 || len(b) == 0 {
+		return 0
+	}
+	in := map[string]bool{}
+	for _, w := range a {
+		in[w] = true
+	}
+	common := 0
+	for _, w := range b {
+		if in[w] {
+			common++
+		}
+	}
+	return float64(common) / float64(len(a)+len(b)-common)
+}
+
+// similarQuestion is a possible duplicate of a question being asked
+type similarQuestion struct {
+	ID         int     `json:"id"`
+	Title      string  `json:"title"`
+	URL        string  `json:"url"`
+	Answers    int     `json:"answers"`
+	Similarity float64 `json:"similarity"`
+}
+
+// similarQuestions finds the questions the user can see whose heading is the most similar to title.
+// candidates sharing a word with the title come from the full text index
+func similarQuestions(ctx context.Context, user *User, title string) ([]similarQuestion, error) {
+	words := titleWords(title)
+	if len(words) == 0 {
+		return nil, nil
+	}
+	terms := make([]string, len(words))
+	for i, w := range words {
+		// words are only letters and digits, so they can't be read as query syntax
+		terms[i] = "heading:" + w
+	}
+	filter, args, err := questionFilter(ctx, user)
+	if err != nil {
+		return nil, err
+	}
+	rows, err := db.QueryContext(ctx, `select questions.id, questions.heading, `+answerCountSQL+`
+		from questions_fts join questions on questions.id = questions_fts.docid
+		where questions_fts match ? and `+filter+` limit 100`, append([]interface{}{strings.Join(terms, " OR ")}, args...)...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var similar []similarQuestion
+	for rows.Next() {
+		var q similarQuestion
+		if err := rows.Scan(&q.ID, &q.Title, &q.Answers); err != nil {
+			return nil, err
+		}
+		q.Similarity = titleSimilarity(words, titleWords(q.Title))
+		if q.Similarity < minTitleSimilarity {
+			continue
+		}
+		q.URL = fmt.Sprintf("/questions/%d", q.ID)
+		similar = append(similar, q)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	sort.SliceStable(similar, func(i, j int) bool { return similar[i].Similarity > similar[j].Similarity })
+	if len(similar) > maxSimilarQuestions {
+		similar = similar[:maxSimilarQuestions]
+	}
+	return similar, nil
+}
+
+// serve /api/v1/questions/similar?title=..., the questions that may already answer a new one
+func serveSimilarQuestions(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	if r.Method != http.MethodGet {
+		writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	similar, err := similarQuestions(ctx, currentUser(r), r.URL.Query().Get("title"))
+	if err != nil {
+		writeInternalError(w, r, err)
+		return
+	}
+	if similar == nil {
+		similar = []similarQuestion{}
+	}
+	writeJSON(w, http.StatusOK, similarResults{Questions: similar})
+}
+
+// similarResults is the answer of /api/v1/questions/similar
+type similarResults struct {
+	Questions []similarQuestion `json:"questions"`
+}
+
+// ftsWords splits text into lowercase words, so nothing typed can be read as full text query syntax
+func ftsWords(text string) []string {
+	return strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+}
+
+// searchMatch is the full text query of the words and phrases of a search, empty when it has none
+func searchMatch(q searchquery.Query) string {
+	var terms []string
+	for _, w := range q.Words {
+		terms = append(terms, ftsWords(w)...)
+	}
+	for _, p := range q.Phrases {
+		if words := ftsWords(p); len(words) > 0 {
+			terms = append(terms, `"`+strings.Join(words, " ")+`"`)
+		}
+	}
+	return strings.Join(terms, " ")
+}
+
+// searchCondition translates a search by the user into a condition on the questions table, with its arguments
+func searchCondition(q searchquery.Query, user *User) (string, []interface{}) {
+	var conds []string
+	var args []interface{}
+
+	if match := searchMatch(q); match != "" {
+		conds = append(conds, "questions.id in (select docid from questions_fts where questions_fts match ?)")
+		args = append(args, match)
+	}
+	for _, tag := range q.Tags {
+		conds = append(conds, taggedSQL)
+		args = append(args, strings.ToLower(tag))
+	}
+	for _, u := range q.Users {
+		// searching by author leaves out the questions asked anonymously, see anonymous.go
+		anonymous, anonymousArgs := anonymousFilter(user)
+		conds = append(conds, "lower(questions.user) = lower(?) and "+anonymous)
+		args = append(append(args, u), anonymousArgs...)
+	}
+	for _, s := range q.States {
+		switch s {
+		case "unanswered":
+			conds = append(conds, "questions.accepted_id is null and not exists (select 1 from answers where answers.question_id = questions.id and "+answerScoreSQL+" > 0)")
+		case "answered":
+			conds = append(conds, "(questions.accepted_id is not null or exists (select 1 from answers where answers.question_id = questions.id and "+answerScoreSQL+" > 0))")
+		case "accepted":
+			conds = append(conds, "questions.accepted_id is not null")
+		case "bounty":
+			conds = append(conds, bountySQL+" > 0")
+		}
+	}
+	// operators come from the parser, which only accepts =, <, <=, > and >=
+	if c := q.Answers; c != nil {
+		conds = append(conds, answerCountSQL+" "+c.Op+" ?")
+		args = append(args, c.Value)
+	}
+	if c := q.Score; c != nil {
+		conds = append(conds, questionScoreSQL+" "+c.Op+" ?")
+		args = append(args, c.Value)
+	}
+	if len(conds) == 0 {
+		return "true", nil
+	}
+	return strings.Join(conds, " and "), args
+}
+
+// searchResult is a question matching a search, with an excerpt of its text around the words searched
+type searchResult struct {
+	questionSummary
+	Snippet template.HTML // empty when the search has no words
+}
+
+// the snippets of the full text index come with the matches between these control characters,
+// which questions have no use for, replaced by <mark> tags once the text around them is escaped
+const (
+	snippetStart = "\x02"
+	snippetEnd   = "\x03"
+)
+
+// words of text in a snippet, about two lines of the search page
+const snippetTokens = 24
+
+var snippetMarks = strings.NewReplacer(snippetStart, "<mark>", snippetEnd, "</mark>")
+
+// highlightSnippet makes HTML of a snippet, the matches in <mark>
+func highlightSnippet(snippet string) template.HTML {
+	return template.HTML(snippetMarks.Replace(html.EscapeString(snippet)))
+}
+
+// searchQuestions finds a page of the questions the user can see matching the search, newest first
+func searchQuestions(ctx context.Context, user *User, q searchquery.Query, limit, offset int) ([]searchResult, error) {
+	filter, args, err := questionFilter(ctx, user)
+	if err != nil {
+		return nil, err
+	}
+	cond, condArgs := searchCondition(q, user)
+	muted, mutedArgs := mutedFilter(user)
+	rows, err := db.QueryContext(ctx, "select "+questionListColumns+
+		" from questions where "+filter+" and "+cond+" and "+muted+" order by questions.id desc limit ? offset ?",
+		append(append(append(args, condArgs...), mutedArgs...), limit, offset)...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var summaries []questionSummary
+	for rows.Next() {
+		q, err := scanQuestion(rows)
+		if err != nil {
+			return nil, err
+		}
+		maskAuthor(&q, user)
+		summaries = append(summaries, questionSummary{Question: q})
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	if err := countQuestionList(ctx, summaries); err != nil {
+		return nil, err
+	}
+	var list []searchResult
+	for _, s := range summaries {
+		list = append(list, searchResult{questionSummary: s})
+	}
+	match := searchMatch(q)
+	if match == "" || len(list) == 0 {
+		return list, nil
+	}
+	// snippets only come from the query matching the index, made again for the page found
+	snippetArgs := []interface{}{snippetStart, snippetEnd, "…", snippetTokens, match}
+	for _, r := range list {
+		snippetArgs = append(snippetArgs, r.QnID)
+	}
+	snippets := map[int]string{}
+	err = queryList(ctx, `select docid, snippet(questions_fts, ?, ?, ?, -1, ?) from questions_fts
+		where questions_fts match ? and docid in (`+placeholders(len(list))+`)`, snippetArgs, func(rows *sql.Rows) error {
+		var id int
+		var snippet string
+		err := rows.Scan(&id, &snippet)
+		snippets[id] = snippet
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	for i := range list {
+		list[i].Snippet = highlightSnippet(snippets[list[i].QnID])
+	}
+	return list, nil
+}
+
+// searchPage is the data of the search page
+type searchPage struct {
+	Query     string
+	Error     string
+	Page      int
+	NextPage  int // 0 on the last page
+	Questions []searchResult
+}
+
+// serve /search?q=..., the questions matching a search written with the syntax of searchquery
+func serveSearch(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	p := searchPage{Query: r.URL.Query().Get("q")}
+	p.Page, _ = strconv.Atoi(r.URL.Query().Get("page"))
+	if p.Page < 1 {
+		p.Page = 1
+	}
+	q, err := searchquery.Parse(p.Query)
+	if err != nil {
+		p.Error = err.Error()
+		render(w, r, "search.html", p)
+		return
+	}
+	if q.Empty() {
+		render(w, r, "search.html", p)
+		return
+	}
+	// one more question than shown tells if there is a next page
+	questions, err := searchQuestions(ctx, currentUser(r), q, questionsPerPage+1, (p.Page-1)*questionsPerPage)
+	if err != nil {
+		serverError(w, r, err)
+		return
+	}
+	p.Questions = questions
+	if len(questions) > questionsPerPage {
+		p.Questions = questions[:questionsPerPage]
+		p.NextPage = p.Page + 1
+	}
+	render(w, r, "search.html", p)
+}
+
+// apiSearchResults is the answer of /api/v1/search
+type apiSearchResults struct {
+	Questions []apiQuestion `json:"questions"`
+	Page      int           `json:"page"`
+	NextPage  int           `json:"next_page,omitempty"` // left out on the last page
+}
+
+// serve /api/v1/search?q=..., a page of the questions matching a search, like /search, each with
+// a snippet of its text where the words searched are highlighted
+func serveSearchAPI(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	if r.Method != http.MethodGet {
+		writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	q, err := searchquery.Parse(r.URL.Query().Get("q"))
+	if err != nil {
+		writeAPIError(w, http.StatusUnprocessableEntity, apiError{
+			Message: "invalid search",
+			Fields:  map[string]string{"q": err.Error()},
+		})
+		return
+	}
+	pageNum, err := strconv.Atoi(r.URL.Query().Get("page"))
+	if err != nil || pageNum < 1 {
+		pageNum = 1
+	}
+	results := apiSearchResults{Questions: []apiQuestion{}, Page: pageNum}
+	if q.Empty() {
+		writeJSON(w, http.StatusOK, results)
+		return
+	}
+	found, err := searchQuestions(ctx, currentUser(r), q, questionsPerPage+1, (pageNum-1)*questionsPerPage)
+	if err != nil {
+		writeInternalError(w, r, err)
+		return
+	}
+	if len(found) > questionsPerPage {
+		found = found[:questionsPerPage]
+		results.NextPage = pageNum + 1
+	}
+	for _, f := range found {
+		aq := newAPIQuestion(f.questionSummary)
+		aq.Snippet = string(f.Snippet)
+		results.Questions = append(results.Questions, aq)
+	}
+	writeJSON(w, http.StatusOK, results)
+}
@@ -0,0 +1,139 @@
+// Package searchquery parses the search syntax of the site: words, "quoted phrases" and operators
+// like tag:go, user:sagaryadav, is:unanswered, answers:0 and score:>5.
+//
+// Words with a colon that isn't a known operator are searched as words.
+package searchquery
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// states of questions that is: filters on
+var states = map[string]bool{
+	"unanswered": true, // no accepted answer and no answer with a positive score
+	"answered":   true,
+	"accepted":   true, // an answer was accepted by the author
+	"bounty":     true, // an open bounty
+}
+
+// Comparison compares a number with Value
+type Comparison struct {
+	Op    string // =, <, <=, > or >=
+	Value int
+}
+
+// Query is a parsed search
+type Query struct {
+	Words   []string // words the text contains
+	Phrases []string // phrases the text contains, without their quotes
+	Tags    []string
+	Users   []string
+	States  []string // values of is:
+	Answers *Comparison
+	Score   *Comparison
+}
+
+// Empty tells if the query has nothing to search for
+func (q Query) Empty() bool {
+	return len(q.Words) == 0 && len(q.Phrases) == 0 && len(q.Tags) == 0 && len(q.Users) == 0 &&
+		len(q.States) == 0 && q.Answers == nil && q.Score == nil
+}
+
+// Parse parses a search. It fails on operators with an invalid value, like score:many
+func Parse(s string) (Query, error) {
+	var q Query
+	for _, tok := range tokenize(s) {
+		if tok.quoted {
+			if tok.text != "" {
+				q.Phrases = append(q.Phrases, tok.text)
+			}
+			continue
+		}
+		name, value, ok := strings.Cut(tok.text, ":")
+		if !ok || value == "" {
+			q.Words = append(q.Words, tok.text)
+			continue
+		}
+		var err error
+		switch strings.ToLower(name) {
+		case "tag":
+			q.Tags = append(q.Tags, strings.ToLower(value))
+		case "user":
+			q.Users = append(q.Users, value)
+		case "is":
+			value = strings.ToLower(value)
+			if !states[value] {
+				return q, fmt.Errorf("unknown is:%s, use is:unanswered, is:answered, is:accepted or is:bounty", value)
+			}
+			q.States = append(q.States, value)
+		case "answers":
+			q.Answers, err = parseComparison(name, value)
+		case "score":
+			q.Score, err = parseComparison(name, value)
+		default:
+			q.Words = append(q.Words, tok.text)
+		}
+		if err != nil {
+			return q, err
+		}
+	}
+	return q, nil
+}
+
+// parseComparison parses values like 5, >5 or <=2
+func parseComparison(name, value string) (*Comparison, error) {
+	c := Comparison{Op: "="}
+	for _, op := range []string{">=", "<=", ">", "<", "="} {
+		if strings.HasPrefix(value, op) {
+			c.Op, value = op, value[len(op):]
+			break
+		}
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil {
+		return nil, fmt.Errorf("%s: needs a number, like %s:3 or %s:>3", name, name, name)
+	}
+	c.Value = n
+	return &c, nil
+}
+
+type token struct {
+	text   string
+	quoted bool // the token was a "quoted phrase"
+}
+
+// tokenize splits the search on spaces, keeping quoted phrases together.
+// an operator value can be quoted too, as in tag:"c sharp". An unclosed quote runs to the end
+func tokenize(s string) []token {
+	var tokens []token
+	var cur strings.Builder
+	quoted, inQuote := false, false
+	flush := func() {
+		if cur.Len() > 0 || quoted {
+			tokens = append(tokens, token{strings.TrimSpace(cur.String()), quoted})
+		}
+		cur.Reset()
+		quoted = false
+	}
+	for _, r := range s {
+		switch {
+		case r == '"':
+			if inQuote {
+				inQuote = false
+			} else {
+				inQuote = true
+				// a quote starting a token makes a phrase, after an operator it only groups its value
+				quoted = cur.Len() == 0
+			}
+		case unicode.IsSpace(r) && !inQuote:
+			flush()
+		default:
+			cur.WriteRune(r)
+		}
+	}
+	flush()
+	return tokens
+}
@@ -0,0 +1,78 @@
+package searchquery
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		search string
+		want   Query
+	}{
+		{"", Query{}},
+		{"goroutine leak", Query{Words: []string{"goroutine", "leak"}}},
+		{"tag:Go", Query{Tags: []string{"go"}}},
+		{`tag:"c sharp" tag:go`, Query{Tags: []string{"c sharp", "go"}}},
+		{"user:SagarYadav", Query{Users: []string{"SagarYadav"}}},
+		{"is:unanswered", Query{States: []string{"unanswered"}}},
+		{"IS:Accepted is:bounty", Query{States: []string{"accepted", "bounty"}}},
+		{"answers:0", Query{Answers: &Comparison{Op: "=", Value: 0}}},
+		{"answers:<=2", Query{Answers: &Comparison{Op: "<=", Value: 2}}},
+		{"score:>5", Query{Score: &Comparison{Op: ">", Value: 5}}},
+		{"score:>=-1", Query{Score: &Comparison{Op: ">=", Value: -1}}},
+		{`"race condition" mutex`, Query{Words: []string{"mutex"}, Phrases: []string{"race condition"}}},
+		{`"  spaced  phrase "`, Query{Phrases: []string{"spaced  phrase"}}},
+		{`"" empty`, Query{Words: []string{"empty"}}},
+		// an unclosed quote runs to the end
+		{`channels "buffered or not`, Query{Words: []string{"channels"}, Phrases: []string{"buffered or not"}}},
+		{`tag:"c sharp`, Query{Tags: []string{"c sharp"}}},
+		// unknown operators, and operators without a value, are words
+		{"lang:go", Query{Words: []string{"lang:go"}}},
+		{"tag: http://example.com", Query{Words: []string{"tag:", "http://example.com"}}},
+		{"tag:go user:bob is:unanswered answers:0 score:>5 select",
+			Query{Words: []string{"select"}, Tags: []string{"go"}, Users: []string{"bob"}, States: []string{"unanswered"},
+				Answers: &Comparison{Op: "=", Value: 0}, Score: &Comparison{Op: ">", Value: 5}}},
+	}
+	for _, tt := range tests {
+		got, err := Parse(tt.search)
+		if err != nil {
+			t.Errorf("Parse(%q): %v", tt.search, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("Parse(%q) = %+v, want %+v", tt.search, got, tt.want)
+		}
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	for _, search := range []string{"is:closed", "score:many", "score:>", "answers:>x", "answers:1.5"} {
+		if _, err := Parse(search); err == nil {
+			t.Errorf("Parse(%q) succeeded, want an error", search)
+		}
+	}
+}
+
+func TestEmpty(t *testing.T) {
+	tests := []struct {
+		search string
+		empty  bool
+	}{
+		{"", true},
+		{"   ", true},
+		{`""`, true},
+		{"go", false},
+		{"answers:0", false},
+		{`"a phrase"`, false},
+	}
+	for _, tt := range tests {
+		q, err := Parse(tt.search)
+		if err != nil {
+			t.Fatalf("Parse(%q): %v", tt.search, err)
+		}
+		if q.Empty() != tt.empty {
+			t.Errorf("Parse(%q).Empty() = %v, want %v", tt.search, q.Empty(), tt.empty)
+		}
+	}
+}
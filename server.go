@@ -0,0 +1,187 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"time"
+
+	"golang.org/x/crypto/acme/autocert"
+
+	"learning-qa/middleware"
+)
+
+// Server is the web app: the store it works on, the templates of its pages and its routes.
+// newServer makes one and Routes returns its handler, so the app runs on any listener, like
+// an httptest server on an in-memory database:
+//
+//	st, err := openStore("sqlite3::memory:")
+//	srv, err := newServer(ctx, st, false)
+//	ts := httptest.NewServer(srv.Routes())
+//
+// a Server doesn't hold its state on its own: the handlers, the jobs and the commands reach the
+// store through db, the session store through sessions, and the templates and static files
+// through siteTemplates and siteAssets, which newServer points at those of the server. Making
+// a server replaces the one before, so a process runs one at a time, and the tests making
+// servers share these and can't run in parallel
+type Server struct {
+	store     *store
+	templates *templateSet
+	assets    *assetManifest
+	logs      io.Writer // where requests are logged, the standard error by default
+}
+
+// newServer makes the app on the store: the database is brought up to date, the templates
+// are parsed and the static files hashed. With dev, templates are parsed on every request
+// and static files aren't hashed. It sets the globals of the process, see Server
+func newServer(ctx context.Context, st *store, dev bool) (*Server, error) {
+	db = st
+	createDatabase(ctx)
+	loadCatalogs()
+	templates, err := loadTemplates(dev)
+	if err != nil {
+		return nil, err
+	}
+	siteTemplates = templates
+	assets, err := loadAssets("public", dev)
+	if err != nil {
+		return nil, err
+	}
+	siteAssets = assets
+	return &Server{store: st, templates: templates, assets: assets, logs: os.Stderr}, nil
+}
+
+// Routes returns the handler of the app, on a mux of its own
+func (s *Server) Routes() http.Handler {
+	mux := http.NewServeMux()
+	mux.Handle("/static/", http.StripPrefix("/static/", s.assets.serve("public")))
+
+	mux.HandleFunc("/register", serveRegister)
+	mux.HandleFunc("/login", serveLogin)
+	mux.HandleFunc("/welcome/", serveWelcome)
+	mux.HandleFunc("/sso/login", serveSSOLogin)
+	mux.HandleFunc("/sso/callback", serveSSOCallback)
+	mux.HandleFunc("/lti/login", serveLTILogin)
+	mux.HandleFunc("/lti/launch", serveLTILaunch)
+	mux.HandleFunc("/login/2fa", serveLoginCode)
+	mux.HandleFunc("/logout", serveLogout)
+	mux.HandleFunc("/invites", serveInvites)
+	mux.HandleFunc("/captcha/challenge", serveCaptchaChallenge)
+	mux.HandleFunc("/users/", serveProfile)
+	mux.HandleFunc("/messages", serveInbox)
+	mux.HandleFunc("/messages/", serveConversation)
+	mux.HandleFunc("/question-templates", serveQuestionTemplates)
+	mux.HandleFunc("/courses", serveCourses)
+	mux.HandleFunc("/dashboard", serveDashboard)
+	mux.HandleFunc("/dashboard/participation.csv", serveParticipationCSV)
+	mux.HandleFunc("/courses/", serveCourse)
+	mux.HandleFunc("/announcements", serveAnnouncements)
+	mux.HandleFunc("/announcements/", serveAnnouncementAction)
+	mux.HandleFunc("/settings/username", serveUsernameSettings)
+	mux.HandleFunc("/settings/email", serveEmailSettings)
+	mux.HandleFunc("/settings/2fa", serveTwoFactorSettings)
+	mux.HandleFunc("/settings/api-keys", serveAPIKeySettings)
+	mux.HandleFunc("/settings/account", serveAccountSettings)
+	mux.HandleFunc("/settings/account/export", serveAccountExport)
+	mux.HandleFunc("/settings/language", serveLanguageSettings)
+	mux.HandleFunc("/settings/preferences", servePreferences)
+	mux.HandleFunc("/notifications", serveNotifications)
+	mux.HandleFunc("/notifications/stream", serveNotificationStream)
+	mux.HandleFunc("/leaderboard", serveLeaderboard)
+	mux.HandleFunc("/activity", serveActivity)
+	mux.HandleFunc("/calendar.ics", serveCalendar)
+	mux.HandleFunc("/unsubscribe", serveUnsubscribe)
+	mux.HandleFunc("/webhooks/email", serveEmailWebhook)
+	mux.HandleFunc("/whats-new", serveWhatsNew)
+	mux.HandleFunc("/admin", serveAdmin)
+	mux.HandleFunc("/admin/reserved-names", serveReservedNames)
+	mux.HandleFunc("/admin/email-domains", serveEmailDomains)
+	mux.HandleFunc("/admin/blocked-words", serveBlockedWords)
+	mux.HandleFunc("/admin/experiments", serveExperimentsAdmin)
+	mux.HandleFunc("/admin/features", serveFeaturesAdmin)
+	mux.HandleFunc("/admin/changelog", serveChangelogAdmin)
+	mux.HandleFunc("/admin/exams", serveExamsAdmin)
+	mux.HandleFunc("/admin/mutes", serveMutesAdmin)
+	mux.HandleFunc("/admin/sanctions", serveSanctionsAdmin)
+	mux.HandleFunc("/admin/flags", serveFlagsAdmin)
+	mux.HandleFunc("/admin/tags", serveTagsAdmin)
+	mux.HandleFunc("/admin/export", serveExport)
+	mux.HandleFunc("/admin/import-users", serveImportUsers)
+	mux.HandleFunc("/admin/lti", serveLTIAdmin)
+	mux.HandleFunc("/admin/webhooks", serveWebhooksAdmin)
+	mux.HandleFunc("/admin/channels", serveChannelsAdmin)
+	mux.HandleFunc("/admin/audit", serveAuditLog)
+	mux.HandleFunc("/admin/audit.csv", serveAuditLog)
+	mux.HandleFunc("/ask", serveAsk)
+	mux.HandleFunc("/search", serveSearch)
+	mux.Handle("/api/v1/", negotiateAPI(authenticateAPIKeys(apiRoutes())))
+	// the quick-switcher was answered here before the API had versions
+	mux.HandleFunc("/api/docs", serveAPIDocs)
+	mux.HandleFunc("/graphql", serveGraphQL)
+	mux.Handle("/api/quickfind", negotiateAPI(http.HandlerFunc(serveQuickfind)))
+	mux.HandleFunc("/bookmarks", serveBookmarks)
+	mux.HandleFunc("/review", serveReview)
+	mux.HandleFunc("/review/", serveReview)
+	mux.HandleFunc("/questions", serveQuestions)
+	mux.HandleFunc("/questions/", serveQuestion)
+	mux.HandleFunc("/answers/", serveAnswer)
+	mux.HandleFunc("/attachments/", serveAttachment)
+	mux.HandleFunc("/comments/", serveComment)
+	mux.HandleFunc("/feed.xml", serveFeed)
+	mux.HandleFunc("/tags/", serveTag)
+	mux.HandleFunc("/sitemap.xml", serveSitemap)
+	mux.HandleFunc("/indexnow.txt", serveIndexNowKey)
+	mux.HandleFunc("/", serveTemplate)
+	// what every route goes through, the outermost first
+	return middleware.Chain(
+		middleware.Logging(s.logs),
+		recoverErrors,
+		loadSession,
+		// emails and their providers post to these from elsewhere, with tokens of their own, and so do
+		// the LTI platforms, whose launches are checked by their signed id token, nonce, and a state
+		// matching the cookie of the browser that started them
+		middleware.CSRF("/webhooks/email", "/unsubscribe", "/lti/login", "/lti/launch"),
+		refuseSuspended(postingRoutes),
+		limitRoutes(routeLimits),
+	)(mux)
+}
+
+// apiRoutes routes the endpoints of /api/v1/, see api.go and openapi.go
+func apiRoutes() *http.ServeMux {
+	api := http.NewServeMux()
+	routed := map[string]bool{}
+	for _, e := range apiEndpoints {
+		if !routed[e.Pattern] {
+			api.HandleFunc(e.Pattern, e.Handler)
+			routed[e.Pattern] = true
+		}
+	}
+	api.HandleFunc("/api/v1/openapi.json", serveOpenAPI)
+	api.HandleFunc("/api/v1/", serveAPINotFound)
+	return api
+}
+
+// serveTLS serves the handler over HTTPS on :443 for the domains, with certificates Let's Encrypt
+// issues when they are first needed and renews before they expire. They are kept in the cache
+// directory, so a restart doesn't ask for new ones. :80 answers the challenges of Let's Encrypt
+// and redirects the rest to HTTPS. Both ports must be reachable from the internet
+func serveTLS(h http.Handler, domains []string, cacheDir, email string) error {
+	m := &autocert.Manager{
+		Prompt:     autocert.AcceptTOS,
+		HostPolicy: autocert.HostWhitelist(domains...),
+		Cache:      autocert.DirCache(cacheDir),
+		Email:      email,
+	}
+	redirect := &http.Server{Addr: ":80", Handler: m.HTTPHandler(nil), ReadHeaderTimeout: 10 * time.Second}
+	go func() {
+		// without the challenges, certificates can still be issued over TLS on :443
+		if err := redirect.ListenAndServe(); err != nil {
+			fmt.Println(err)
+		}
+	}()
+	server := &http.Server{Addr: ":443", Handler: h, TLSConfig: m.TLSConfig(), ReadHeaderTimeout: 10 * time.Second}
+	fmt.Println("Click on https://" + domains[0])
+	return server.ListenAndServeTLS("", "")
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newTestServer makes the app on a fresh in-memory database, closed at the end of the test.
+// The server sets the globals of the process, see Server, so the tests calling this can't
+// call t.Parallel. The caches are emptied and the sessions put back in the database, as they
+// outlive the server of the previous test
+func newTestServer(tb testing.TB) *Server {
+	tb.Helper()
+	st, err := openStore("sqlite3::memory:")
+	if err != nil {
+		tb.Fatal(err)
+	}
+	tb.Cleanup(func() { st.Close() })
+	srv, err := newServer(context.Background(), st, false)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	dataCache.clear()
+	questionCache.clear()
+	sessions = sqliteSessions{}
+	srv.logs = io.Discard
+	return srv
+}
+
+// testUser adds a user and returns the cookie of a session of theirs
+func testUser(tb testing.TB, name string) (int, *http.Cookie) {
+	tb.Helper()
+	ctx := context.Background()
+	res, err := db.ExecContext(ctx, "insert into users (first_name, last_name, username, password, user_type) values (?, ?, ?, '', 'student')",
+		name, name, name)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	id, err := res.LastInsertId()
+	if err != nil {
+		tb.Fatal(err)
+	}
+	token := newToken()
+	if err := sessions.Create(ctx, token, int(id), time.Now().Add(time.Hour)); err != nil {
+		tb.Fatal(err)
+	}
+	return int(id), &http.Cookie{Name: sessionCookie, Value: token}
+}
+
+// testExec runs the statement, failing the test on an error
+func testExec(tb testing.TB, query string, args ...interface{}) {
+	tb.Helper()
+	if _, err := db.ExecContext(context.Background(), query, args...); err != nil {
+		tb.Fatalf("%s: %v", query, err)
+	}
+}
+
+// TestServer builds the app on a fresh in-memory database and serves the question list on it,
+// to a visitor and to a signed in user
+func TestServer(t *testing.T) {
+	srv := newTestServer(t)
+	version, err := db.schemaVersion(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if version != len(migrations) {
+		t.Fatalf("schema version %d, want %d: a migration failed on a fresh database", version, len(migrations))
+	}
+	_, cookie := testUser(t, "student1")
+	testExec(t, "insert into questions (heading, body, date, time, user, views, open) values ('A first question', 'body', '2026-01-01', '10:00:00', 'student1', 0, 1)")
+
+	ts := httptest.NewServer(srv.Routes())
+	defer ts.Close()
+	for _, c := range []*http.Cookie{nil, cookie} {
+		req, err := http.NewRequest(http.MethodGet, ts.URL+"/questions", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if c != nil {
+			req.AddCookie(c)
+		}
+		res, err := ts.Client().Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, err := io.ReadAll(res.Body)
+		res.Body.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if res.StatusCode != http.StatusOK {
+			t.Fatalf("GET /questions: %d %s", res.StatusCode, body)
+		}
+		if !strings.Contains(string(body), "A first question") {
+			t.Errorf("GET /questions doesn't list the question:\n%s", body)
+		}
+	}
+}
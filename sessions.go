@@ -0,0 +1,369 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"database/sql"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// sessions are kept in a SessionStore: the database by default, or with
+// SESSION_STORE=redis the Redis server of REDIS_URL, like redis://:password@host:6379/0, so that
+// instances of the app behind a load balancer share them. Expired sessions are deleted by
+// the sessions maintenance task in the database, see maintenance.go, and by Redis itself from their TTL
+
+// SessionStore keeps the sessions, by token
+type SessionStore interface {
+	// Create saves a session of the user, lasting until expires
+	Create(ctx context.Context, token string, userID int, expires time.Time) error
+	// Lookup finds the user of a session, 0 when it doesn't exist or expired
+	Lookup(ctx context.Context, token string) (int, error)
+	// Delete ends a session
+	Delete(ctx context.Context, token string) error
+	// DeleteUser ends all the sessions of the user
+	DeleteUser(ctx context.Context, userID int) error
+	// Cleanup deletes the expired sessions
+	Cleanup(ctx context.Context) error
+}
+
+// sessions is the session store of the app, set by openSessions
+var sessions SessionStore = sqliteSessions{}
+
+// openSessions sets the session store of SESSION_STORE
+func openSessions() error {
+	switch name := os.Getenv("SESSION_STORE"); name {
+	case "", "sqlite":
+		sessions = sqliteSessions{}
+	case "redis":
+		client, err := newRedisClient(os.Getenv("REDIS_URL"))
+		if err != nil {
+			return err
+		}
+		sessions = redisSessions{client}
+	default:
+		return fmt.Errorf("SESSION_STORE: unknown session store %q, use sqlite or redis", name)
+	}
+	return nil
+}
+
+// sqliteSessions keeps the sessions in the sessions table
+type sqliteSessions struct{}
+
+func (sqliteSessions) Create(ctx context.Context, token string, userID int, expires time.Time) error {
+	_, err := db.ExecContext(ctx, "insert into sessions (token, user_id, expires) values (?, ?, ?)",
+		token, userID, expires.Format(timestampLayout))
+	return err
+}
+
+func (sqliteSessions) Lookup(ctx context.Context, token string) (int, error) {
+	var userID int
+	err := db.QueryRowContext(ctx, "select user_id from sessions where token = ? and expires > ?",
+		token, time.Now().Format(timestampLayout)).Scan(&userID)
+	if err == sql.ErrNoRows {
+		return 0, nil
+	}
+	return userID, err
+}
+
+func (sqliteSessions) Delete(ctx context.Context, token string) error {
+	_, err := db.ExecContext(ctx, "delete from sessions where token = ?", token)
+	return err
+}
+
+func (sqliteSessions) DeleteUser(ctx context.Context, userID int) error {
+	_, err := db.ExecContext(ctx, "delete from sessions where user_id = ?", userID)
+	return err
+}
+
+func (sqliteSessions) Cleanup(ctx context.Context) error {
+	_, err := db.ExecContext(ctx, "delete from sessions where expires <= ?", time.Now().Format(timestampLayout))
+	return err
+}
+
+// redisSessions keeps each session in a key expiring with it, and the tokens of each user in a
+// set, to end them all
+type redisSessions struct {
+	client *redisClient
+}
+
+// keys of the sessions and of the sets of tokens of the users
+const (
+	redisSessionPrefix     = "qaapp:session:"
+	redisUserSessionPrefix = "qaapp:user-sessions:"
+)
+
+func (s redisSessions) Create(ctx context.Context, token string, userID int, expires time.Time) error {
+	ttl := strconv.Itoa(int(time.Until(expires).Seconds()) + 1)
+	set := redisUserSessionPrefix + strconv.Itoa(userID)
+	if _, err := s.client.do(ctx, "SET", redisSessionPrefix+token, strconv.Itoa(userID), "EX", ttl); err != nil {
+		return err
+	}
+	if _, err := s.client.do(ctx, "SADD", set, token); err != nil {
+		return err
+	}
+	// the set lasts as long as the latest session, its expired tokens are dropped by Cleanup
+	_, err := s.client.do(ctx, "EXPIRE", set, ttl)
+	return err
+}
+
+func (s redisSessions) Lookup(ctx context.Context, token string) (int, error) {
+	reply, err := s.client.do(ctx, "GET", redisSessionPrefix+token)
+	if err != nil || reply == nil {
+		return 0, err
+	}
+	v, _ := reply.(string)
+	return strconv.Atoi(v)
+}
+
+func (s redisSessions) Delete(ctx context.Context, token string) error {
+	reply, err := s.client.do(ctx, "GET", redisSessionPrefix+token)
+	if err != nil {
+		return err
+	}
+	if v, ok := reply.(string); ok {
+		if _, err := s.client.do(ctx, "SREM", redisUserSessionPrefix+v, token); err != nil {
+			return err
+		}
+	}
+	_, err = s.client.do(ctx, "DEL", redisSessionPrefix+token)
+	return err
+}
+
+func (s redisSessions) DeleteUser(ctx context.Context, userID int) error {
+	set := redisUserSessionPrefix + strconv.Itoa(userID)
+	reply, err := s.client.do(ctx, "SMEMBERS", set)
+	if err != nil {
+		return err
+	}
+	keys := []string{"DEL", set}
+	for _, token := range redisStrings(reply) {
+		keys = append(keys, redisSessionPrefix+token)
+	}
+	_, err = s.client.do(ctx, keys...)
+	return err
+}
+
+// Cleanup drops the tokens of expired sessions from the sets of the users, the sessions
+// themselves expire on their own
+func (s redisSessions) Cleanup(ctx context.Context) error {
+	cursor := "0"
+	for {
+		reply, err := s.client.do(ctx, "SCAN", cursor, "MATCH", redisUserSessionPrefix+"*", "COUNT", "100")
+		if err != nil {
+			return err
+		}
+		page, _ := reply.([]interface{})
+		if len(page) != 2 {
+			return errors.New("redis: unexpected reply to SCAN")
+		}
+		for _, set := range redisStrings(page[1]) {
+			tokens, err := s.client.do(ctx, "SMEMBERS", set)
+			if err != nil {
+				return err
+			}
+			for _, token := range redisStrings(tokens) {
+				n, err := s.client.do(ctx, "EXISTS", redisSessionPrefix+token)
+				if err != nil {
+					return err
+				}
+				if n == int64(0) {
+					if _, err := s.client.do(ctx, "SREM", set, token); err != nil {
+						return err
+					}
+				}
+			}
+		}
+		if cursor, _ = page[0].(string); cursor == "0" || cursor == "" {
+			return nil
+		}
+	}
+}
+
+// redisClient sends commands to a Redis server, over a few connections kept open
+type redisClient struct {
+	addr     string
+	password string
+	database string
+	tls      bool
+	idle     chan *redisConn
+}
+
+type redisConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+// most connections kept open, and longest wait for a reply without a deadline in the context
+const (
+	redisIdleConns = 8
+	redisTimeout   = 5 * time.Second
+)
+
+// newRedisClient makes a client of the url, like redis://:password@localhost:6379/0, or
+// rediss:// for TLS
+func newRedisClient(rawURL string) (*redisClient, error) {
+	if rawURL == "" {
+		rawURL = "redis://localhost:6379"
+	}
+	u, err := url.Parse(rawURL)
+	if err != nil || (u.Scheme != "redis" && u.Scheme != "rediss") {
+		return nil, fmt.Errorf("REDIS_URL: %q isn't a redis:// url", rawURL)
+	}
+	c := &redisClient{addr: u.Host, database: strings.TrimPrefix(u.Path, "/"), tls: u.Scheme == "rediss", idle: make(chan *redisConn, redisIdleConns)}
+	if u.Port() == "" {
+		c.addr = net.JoinHostPort(u.Hostname(), "6379")
+	}
+	if password, ok := u.User.Password(); ok {
+		c.password = password
+	}
+	return c, nil
+}
+
+// conn takes an idle connection, or opens one
+func (c *redisClient) conn(ctx context.Context) (*redisConn, error) {
+	select {
+	case conn := <-c.idle:
+		return conn, nil
+	default:
+	}
+	dialer := &net.Dialer{Timeout: redisTimeout}
+	var nc net.Conn
+	var err error
+	if c.tls {
+		nc, err = (&tls.Dialer{NetDialer: dialer}).DialContext(ctx, "tcp", c.addr)
+	} else {
+		nc, err = dialer.DialContext(ctx, "tcp", c.addr)
+	}
+	if err != nil {
+		return nil, err
+	}
+	conn := &redisConn{Conn: nc, r: bufio.NewReader(nc)}
+	setup := [][]string{}
+	if c.password != "" {
+		setup = append(setup, []string{"AUTH", c.password})
+	}
+	if c.database != "" && c.database != "0" {
+		setup = append(setup, []string{"SELECT", c.database})
+	}
+	for _, args := range setup {
+		if _, err := conn.do(ctx, args); err != nil {
+			nc.Close()
+			return nil, err
+		}
+	}
+	return conn, nil
+}
+
+// do sends a command, and returns its reply: a string, an int64, a []interface{} or nil
+func (c *redisClient) do(ctx context.Context, args ...string) (interface{}, error) {
+	conn, err := c.conn(ctx)
+	if err != nil {
+		return nil, err
+	}
+	reply, err := conn.do(ctx, args)
+	var replyErr redisError
+	if err != nil && !errors.As(err, &replyErr) {
+		// the connection is in an unknown state
+		conn.Close()
+		return nil, err
+	}
+	select {
+	case c.idle <- conn:
+	default:
+		conn.Close()
+	}
+	return reply, err
+}
+
+// redisError is an error replied by the server
+type redisError string
+
+func (e redisError) Error() string { return "redis: " + string(e) }
+
+// do writes a command on the connection and reads its reply
+func (conn *redisConn) do(ctx context.Context, args []string) (interface{}, error) {
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		deadline = time.Now().Add(redisTimeout)
+	}
+	conn.SetDeadline(deadline)
+	if err := conn.send(args); err != nil {
+		return nil, err
+	}
+	return conn.readReply()
+}
+
+// send writes a command on the connection, without reading its reply
+func (conn *redisConn) send(args []string) error {
+	var b strings.Builder
+	fmt.Fprintf(&b, "*%d\r\n", len(args))
+	for _, arg := range args {
+		fmt.Fprintf(&b, "$%d\r\n%s\r\n", len(arg), arg)
+	}
+	_, err := io.WriteString(conn, b.String())
+	return err
+}
+
+// readReply reads a reply of the RESP protocol
+func (conn *redisConn) readReply() (interface{}, error) {
+	line, err := conn.r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	line = strings.TrimSuffix(line, "\r\n")
+	if line == "" {
+		return nil, errors.New("redis: empty reply")
+	}
+	switch kind, rest := line[0], line[1:]; kind {
+	case '+':
+		return rest, nil
+	case '-':
+		return nil, redisError(rest)
+	case ':':
+		return strconv.ParseInt(rest, 10, 64)
+	case '$':
+		n, err := strconv.Atoi(rest)
+		if err != nil || n < 0 {
+			return nil, err
+		}
+		buf := make([]byte, n+2)
+		if _, err := io.ReadFull(conn.r, buf); err != nil {
+			return nil, err
+		}
+		return string(buf[:n]), nil
+	case '*':
+		n, err := strconv.Atoi(rest)
+		if err != nil || n < 0 {
+			return nil, err
+		}
+		items := make([]interface{}, n)
+		for i := range items {
+			if items[i], err = conn.readReply(); err != nil {
+				return nil, err
+			}
+		}
+		return items, nil
+	}
+	return nil, fmt.Errorf("redis: unexpected reply %q", line)
+}
+
+// redisStrings are the strings of an array reply
+func redisStrings(reply interface{}) []string {
+	items, _ := reply.([]interface{})
+	var s []string
+	for _, item := range items {
+		if v, ok := item.(string); ok {
+			s = append(s, v)
+		}
+	}
+	return s
+}
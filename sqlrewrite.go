@@ -0,0 +1,601 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// the app writes its queries in the SQL of sqlite. The postgres and mysql backends rewrite each
+// query once, before it is prepared, see store_postgres.go and store_mysql.go. They work on the
+// tokens of the query, so the strings and the quoted names in it are left as they are
+
+// the kinds of tokens of a query
+const (
+	tokenSpace  = iota // spaces and comments
+	tokenWord          // a keyword, a function or a name
+	tokenQuoted        // a name in double quotes
+	tokenString        // a string in single quotes
+	tokenNumber
+	tokenParam  // a ? or ?NNN placeholder
+	tokenSymbol // an operator or a punctuation sign
+)
+
+// sqlToken is a token of a query
+type sqlToken struct {
+	kind    int
+	text    string
+	arg     int                           // the argument a placeholder takes, from 0
+	convert func(interface{}) interface{} // changes the argument of a placeholder for the backend, nil to keep it
+}
+
+// sqlTokens are the tokens of a query, or of a part of it
+type sqlTokens []sqlToken
+
+// the operators of two characters
+var twoCharOperators = map[string]bool{"||": true, "<=": true, ">=": true, "!=": true, "<>": true, "==": true}
+
+// tokenizeSQL splits the query into its tokens. A ? placeholder takes the argument after the
+// largest one taken so far, like in sqlite, and ?NNN takes argument NNN
+func tokenizeSQL(query string) sqlTokens {
+	var tokens sqlTokens
+	last := -1
+	for i := 0; i < len(query); {
+		start, c := i, query[i]
+		t := sqlToken{kind: tokenSymbol}
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			for i < len(query) && strings.IndexByte(" \t\n\r", query[i]) >= 0 {
+				i++
+			}
+			t.kind = tokenSpace
+		case strings.HasPrefix(query[i:], "--"):
+			for i < len(query) && query[i] != '\n' {
+				i++
+			}
+			t.kind = tokenSpace
+		case c == '\'' || c == '"':
+			// a doubled quote stands for itself
+			for i++; i < len(query); i++ {
+				if query[i] == c {
+					if i+1 < len(query) && query[i+1] == c {
+						i++
+						continue
+					}
+					i++
+					break
+				}
+			}
+			t.kind = tokenString
+			if c == '"' {
+				t.kind = tokenQuoted
+			}
+		case isWordByte(c) && !isDigit(c):
+			for i < len(query) && isWordByte(query[i]) {
+				i++
+			}
+			t.kind = tokenWord
+		case isDigit(c):
+			for i < len(query) && (isDigit(query[i]) || query[i] == '.') {
+				i++
+			}
+			t.kind = tokenNumber
+		case c == '?':
+			for i++; i < len(query) && isDigit(query[i]); i++ {
+			}
+			t.kind = tokenParam
+			t.arg = last + 1
+			if i > start+1 {
+				n, _ := strconv.Atoi(query[start+1 : i])
+				t.arg = n - 1
+			}
+			if t.arg > last {
+				last = t.arg
+			}
+		case i+1 < len(query) && twoCharOperators[query[i:i+2]]:
+			i += 2
+		default:
+			i++
+		}
+		t.text = query[start:i]
+		tokens = append(tokens, t)
+	}
+	return tokens
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
+
+func isWordByte(c byte) bool {
+	return c == '_' || isDigit(c) || (c|0x20 >= 'a' && c|0x20 <= 'z')
+}
+
+// sqlText makes the tokens of a piece of SQL without placeholders
+func sqlText(text string) sqlTokens {
+	return tokenizeSQL(text)
+}
+
+// param makes a placeholder taking the argument, changed by convert unless it is nil
+func param(arg int, convert func(interface{}) interface{}) sqlToken {
+	return sqlToken{kind: tokenParam, text: "?", arg: arg, convert: convert}
+}
+
+// concatSQL makes one piece of SQL of the pieces
+func concatSQL(parts ...sqlTokens) sqlTokens {
+	var out sqlTokens
+	for _, p := range parts {
+		out = append(out, p...)
+	}
+	return out
+}
+
+// joinSQL joins the parts with the separator
+func joinSQL(parts []sqlTokens, sep string) sqlTokens {
+	var out sqlTokens
+	for i, p := range parts {
+		if i > 0 {
+			out = append(out, sqlText(sep)...)
+		}
+		out = append(out, p...)
+	}
+	return out
+}
+
+// bindParams writes the tokens back, with placeholder writing the nth placeholder, from 1.
+// It returns the placeholders in order, each binding the argument it takes
+func bindParams(ts sqlTokens, placeholder func(n int) string) (string, []sqlToken) {
+	var b strings.Builder
+	params := []sqlToken{}
+	for _, t := range ts {
+		if t.kind == tokenParam {
+			params = append(params, t)
+			b.WriteString(placeholder(len(params)))
+		} else {
+			b.WriteString(t.text)
+		}
+	}
+	return b.String(), params
+}
+
+// text writes the tokens back, as they are
+func (ts sqlTokens) text() string {
+	var b strings.Builder
+	for _, t := range ts {
+		b.WriteString(t.text)
+	}
+	return b.String()
+}
+
+// is tells whether token i is the word, whatever its case
+func (ts sqlTokens) is(i int, word string) bool {
+	return i >= 0 && i < len(ts) && ts[i].kind == tokenWord && strings.EqualFold(ts[i].text, word)
+}
+
+// symbol tells whether token i is the symbol
+func (ts sqlTokens) symbol(i int, s string) bool {
+	return i >= 0 && i < len(ts) && ts[i].kind == tokenSymbol && ts[i].text == s
+}
+
+// next returns the first token after i that isn't a space, len(ts) if there is none
+func (ts sqlTokens) next(i int) int {
+	for i++; i < len(ts) && ts[i].kind == tokenSpace; i++ {
+	}
+	return i
+}
+
+// prev returns the last token before i that isn't a space, -1 if there is none
+func (ts sqlTokens) prev(i int) int {
+	for i--; i >= 0 && ts[i].kind == tokenSpace; i-- {
+	}
+	return i
+}
+
+// words tells whether the tokens from i are the words, with spaces between them, and returns the
+// last of them
+func (ts sqlTokens) words(i int, words ...string) (int, bool) {
+	for n, w := range words {
+		if n > 0 {
+			i = ts.next(i)
+		}
+		if !ts.is(i, w) {
+			return i, false
+		}
+	}
+	return i, true
+}
+
+// find returns the first of the words from i outside of parentheses, len(ts) if there is none
+func (ts sqlTokens) find(i int, words ...string) int {
+	for ; i < len(ts); i++ {
+		if ts.symbol(i, "(") {
+			i = ts.closing(i)
+			continue
+		}
+		for _, w := range words {
+			if ts.is(i, w) {
+				return i
+			}
+		}
+	}
+	return len(ts)
+}
+
+// closing returns the parenthesis closing the one at i, len(ts) if it isn't closed
+func (ts sqlTokens) closing(i int) int {
+	depth := 0
+	for ; i < len(ts); i++ {
+		switch {
+		case ts.symbol(i, "("):
+			depth++
+		case ts.symbol(i, ")"):
+			depth--
+			if depth == 0 {
+				return i
+			}
+		}
+	}
+	return len(ts)
+}
+
+// split splits the tokens at the commas outside of parentheses
+func (ts sqlTokens) split() []sqlTokens {
+	var parts []sqlTokens
+	depth, start := 0, 0
+	for i := range ts {
+		switch {
+		case ts.symbol(i, "("):
+			depth++
+		case ts.symbol(i, ")"):
+			depth--
+		case ts.symbol(i, ",") && depth == 0:
+			parts = append(parts, ts[start:i])
+			start = i + 1
+		}
+	}
+	return append(parts, ts[start:])
+}
+
+// trim drops the spaces around the tokens
+func (ts sqlTokens) trim() sqlTokens {
+	for len(ts) > 0 && ts[0].kind == tokenSpace {
+		ts = ts[1:]
+	}
+	for len(ts) > 0 && ts[len(ts)-1].kind == tokenSpace {
+		ts = ts[:len(ts)-1]
+	}
+	return ts
+}
+
+// name returns the table or column named by token i, in lower case and without quotes
+func (ts sqlTokens) name(i int) string {
+	if i < 0 || i >= len(ts) {
+		return ""
+	}
+	return strings.ToLower(strings.Trim(ts[i].text, `"`))
+}
+
+// names returns the names listed in the parentheses at i, in lower case
+func (ts sqlTokens) names(i int) []string {
+	var names []string
+	for _, part := range ts[i+1 : ts.closing(i)].split() {
+		names = append(names, part.trim().name(0))
+	}
+	return names
+}
+
+// splice returns the tokens with those from i to j, j excluded, replaced by the others
+func (ts sqlTokens) splice(i, j int, with sqlTokens) sqlTokens {
+	return concatSQL(ts[:i:i], with, ts[j:])
+}
+
+// rewriteCalls rewrites the calls of functions, innermost first. fn returns the SQL replacing the
+// call of name with the arguments, nil to keep it
+func rewriteCalls(ts sqlTokens, fn func(name string, args []sqlTokens) sqlTokens) sqlTokens {
+	var out sqlTokens
+	for i := 0; i < len(ts); i++ {
+		if ts[i].kind != tokenWord || !ts.symbol(i+1, "(") {
+			out = append(out, ts[i])
+			continue
+		}
+		end := ts.closing(i + 1)
+		if end == len(ts) {
+			return append(out, ts[i:]...)
+		}
+		args := ts[i+2 : end].split()
+		for n := range args {
+			args[n] = rewriteCalls(args[n], fn)
+		}
+		if call := fn(strings.ToLower(ts[i].text), args); call != nil {
+			out = append(out, call...)
+		} else {
+			out = append(out, ts[i], ts[i+1])
+			out = append(out, joinSQL(args, ",")...)
+			out = append(out, ts[end])
+		}
+		i = end
+	}
+	return out
+}
+
+// the names the app gives its columns and aliases that are keywords of postgres or mysql, and
+// when they are names: the user column, the desc column of tags, the before column of the audit
+// log, the until column of sanctions, and by, the alias of the user who made a sanction
+var keywordNames = map[string]func(ts sqlTokens, prev, next int) bool{
+	"user":   func(ts sqlTokens, prev, next int) bool { return true },
+	"before": func(ts sqlTokens, prev, next int) bool { return true },
+	"until":  func(ts sqlTokens, prev, next int) bool { return true },
+	"desc": func(ts sqlTokens, prev, next int) bool {
+		return ts.symbol(prev, "(") || ts.symbol(prev, ",") || ts.symbol(prev, ".") || ts.is(prev, "select") || ts.is(prev, "set")
+	},
+	"by": func(ts sqlTokens, prev, next int) bool { return ts.is(prev, "as") || ts.symbol(next, ".") },
+}
+
+// quoteNames puts the names that are keywords of the backends in double quotes, which sqlite,
+// postgres and mysql in ANSI_QUOTES mode all read as names
+func quoteNames(ts sqlTokens) sqlTokens {
+	out := make(sqlTokens, len(ts))
+	copy(out, ts)
+	for i, t := range ts {
+		if t.kind != tokenWord {
+			continue
+		}
+		if isName, ok := keywordNames[strings.ToLower(t.text)]; ok && isName(ts, ts.prev(i), ts.next(i)) {
+			out[i] = sqlToken{kind: tokenQuoted, text: `"` + strings.ToLower(t.text) + `"`}
+		}
+	}
+	return out
+}
+
+// aliasDerivedTables names the subqueries in from and join clauses that have no name, which
+// sqlite allows and postgres and mysql don't
+func aliasDerivedTables(ts sqlTokens) sqlTokens {
+	n := 0
+	var alias func(ts sqlTokens) sqlTokens
+	alias = func(ts sqlTokens) sqlTokens {
+		var out sqlTokens
+		for i := 0; i < len(ts); i++ {
+			if !ts.symbol(i, "(") {
+				out = append(out, ts[i])
+				continue
+			}
+			end := ts.closing(i)
+			if end == len(ts) {
+				return append(out, ts[i:]...)
+			}
+			out = append(out, ts[i])
+			out = append(out, alias(ts[i+1:end])...)
+			out = append(out, ts[end])
+			prev, next := ts.prev(i), ts.next(end)
+			subquery := ts.is(ts.next(i), "select")
+			named := next < len(ts) && (ts[next].kind == tokenQuoted || ts[next].kind == tokenWord && !clauseWords[strings.ToLower(ts[next].text)])
+			if subquery && (ts.is(prev, "from") || ts.is(prev, "join")) && !named {
+				n++
+				out = append(out, sqlText(" as derived"+strconv.Itoa(n))...)
+			}
+			i = end
+		}
+		return out
+	}
+	return alias(ts)
+}
+
+// the words that can follow a table in a from clause without naming it
+var clauseWords = map[string]bool{
+	"where": true, "join": true, "left": true, "inner": true, "cross": true, "on": true, "group": true,
+	"order": true, "limit": true, "union": true, "having": true, "window": true, "except": true, "intersect": true,
+}
+
+// statementKind returns the first word of the query, in lower case
+func (ts sqlTokens) statementKind() string {
+	i := ts.next(-1)
+	if i < len(ts) && ts[i].kind == tokenWord {
+		return strings.ToLower(ts[i].text)
+	}
+	return ""
+}
+
+// orConflict finds the conflict clause of an insert or an update, insert or ignore: it returns the
+// tokens of the verb to the clause, and ignore or replace, empty when the statement has none
+func (ts sqlTokens) orConflict() (int, int, string) {
+	verb := ts.next(-1)
+	or := ts.next(verb)
+	if !ts.is(or, "or") {
+		return verb, verb + 1, ""
+	}
+	action := ts.next(or)
+	return verb, action + 1, ts.name(action)
+}
+
+// isCondition tells whether the expression is a comparison or a condition, which sqlite counts
+// as 1 or 0 and postgres doesn't sum
+func isCondition(ts sqlTokens) bool {
+	ts = ts.trim()
+	if ts.is(0, "case") {
+		return false
+	}
+	for i := 0; i < len(ts); i++ {
+		switch {
+		case ts.symbol(i, "("):
+			i = ts.closing(i)
+		case ts[i].kind == tokenSymbol && strings.Contains("= != <> < > <= >= ==", ts[i].text):
+			return true
+		case ts.is(i, "not") || ts.is(i, "exists") || ts.is(i, "in") || ts.is(i, "like") || ts.is(i, "is") ||
+			ts.is(i, "between") || ts.is(i, "and") || ts.is(i, "or") || ts.is(i, "glob"):
+			return true
+		}
+	}
+	return false
+}
+
+// globToLike converts the GLOB pattern argument of a placeholder to a LIKE pattern escaped with
+// backslashes, for the backends without GLOB. Like GLOB, LIKE is case sensitive on them
+func globToLike(arg interface{}) interface{} {
+	pattern, ok := arg.(string)
+	if !ok {
+		return arg
+	}
+	var b strings.Builder
+	for i := 0; i < len(pattern); i++ {
+		switch c := pattern[i]; c {
+		case '*':
+			b.WriteByte('%')
+		case '?':
+			b.WriteByte('_')
+		case '%', '_', '\\':
+			b.WriteByte('\\')
+			b.WriteByte(c)
+		case '[':
+			// a class of one character, like globPrefix makes of * and ?
+			if i+2 < len(pattern) && pattern[i+2] == ']' {
+				if strings.IndexByte("%_\\", pattern[i+1]) >= 0 {
+					b.WriteByte('\\')
+				}
+				b.WriteByte(pattern[i+1])
+				i += 2
+				continue
+			}
+			b.WriteByte(c)
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return b.String()
+}
+
+// ftsTerm is a term of a full-text query in the syntax of the fts4 search index of sqlite: a
+// word, or the words of a phrase in double quotes
+type ftsTerm struct {
+	words   []string
+	prefix  bool // the last word is a prefix, it ended with *
+	heading bool // only the heading is searched, after heading:
+	or      bool // the term is an alternative to the one before it, after OR
+}
+
+// parseFTSQuery reads the terms of a full-text query. It reads the queries the app makes: words,
+// phrases, prefixes, the heading: column filter and OR, which binds closer than the implicit AND
+func parseFTSQuery(query string) []ftsTerm {
+	var terms []ftsTerm
+	or := false
+	for rest := strings.TrimSpace(query); rest != ""; rest = strings.TrimSpace(rest) {
+		var term ftsTerm
+		if strings.HasPrefix(rest, "heading:") {
+			term.heading, rest = true, rest[len("heading:"):]
+		}
+		var text string
+		if strings.HasPrefix(rest, `"`) {
+			end := strings.IndexByte(rest[1:], '"') + 1
+			if end == 0 {
+				end = len(rest)
+			}
+			text, rest = rest[1:end], strings.TrimPrefix(rest[end:], `"`)
+		} else {
+			end := strings.IndexAny(rest, " \t\n")
+			if end < 0 {
+				end = len(rest)
+			}
+			text, rest = rest[:end], rest[end:]
+			if text == "OR" && !term.heading {
+				or = true
+				continue
+			}
+		}
+		term.prefix = strings.HasSuffix(text, "*")
+		term.words = strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+			return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+		})
+		if len(term.words) == 0 {
+			continue
+		}
+		term.or, or = or && len(terms) > 0, false
+		terms = append(terms, term)
+	}
+	return terms
+}
+
+// ftsGroups groups the terms the implicit AND joins, each made of the terms OR joins
+func ftsGroups(terms []ftsTerm) [][]ftsTerm {
+	var groups [][]ftsTerm
+	for _, t := range terms {
+		if t.or && len(groups) > 0 {
+			groups[len(groups)-1] = append(groups[len(groups)-1], t)
+			continue
+		}
+		groups = append(groups, []ftsTerm{t})
+	}
+	return groups
+}
+
+// schemaTable is what the rewrites need to know of a table of the schema of a backend
+type schemaTable struct {
+	columns  []string
+	keys     [][]string // the primary key and the unique ones, in the order of the schema
+	identity bool       // the id of the rows is made by the database
+}
+
+// parseSchemaTables reads the tables of the statements of a schema: their columns, their keys
+// and whether their id is made by the database, which the definition of the column says with
+// the identity words
+func parseSchemaTables(statements []string, identity string) map[string]*schemaTable {
+	tables := map[string]*schemaTable{}
+	for _, stmt := range statements {
+		ts := tokenizeSQL(stmt)
+		if i, ok := ts.words(ts.next(-1), "create", "table", "if", "not", "exists"); ok {
+			name := ts.next(i)
+			open := ts.next(name)
+			t := &schemaTable{}
+			tables[ts.name(name)] = t
+			for _, def := range ts[open+1 : ts.closing(open)].split() {
+				def = def.trim()
+				switch {
+				case def.is(0, "primary") || def.is(0, "unique"):
+					open := 0
+					for open < len(def) && !def.symbol(open, "(") {
+						open++
+					}
+					if open < len(def) {
+						t.keys = append(t.keys, def.names(open))
+					}
+				case def.is(0, "foreign") || def.is(0, "constraint") || def.is(0, "key") || def.is(0, "index") || def.is(0, "fulltext"):
+				default:
+					column := def.name(0)
+					t.columns = append(t.columns, column)
+					text := strings.ToLower(def.text())
+					if strings.Contains(text, "primary key") || strings.Contains(text, " unique") {
+						t.keys = append(t.keys, []string{column})
+					}
+					if strings.Contains(text, identity) {
+						t.identity = true
+					}
+				}
+			}
+			continue
+		}
+		if i, ok := ts.words(ts.next(-1), "create", "unique", "index"); ok {
+			on := ts.find(i, "on")
+			table := ts.next(on)
+			open := ts.next(table)
+			if t := tables[ts.name(table)]; t != nil && ts.symbol(open, "(") && !ts.symbol(ts.next(ts.next(open)), "(") {
+				t.keys = append(t.keys, ts.names(open))
+			}
+		}
+	}
+	return tables
+}
+
+// keysOf returns the keys of the table with one of the columns
+func (t *schemaTable) keysOf(columns map[string]sqlTokens) [][]string {
+	if t == nil {
+		return nil
+	}
+	var keys [][]string
+	for _, key := range t.keys {
+		for _, c := range key {
+			if _, ok := columns[c]; ok {
+				keys = append(keys, key)
+				break
+			}
+		}
+	}
+	return keys
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestPostgresRewrite(t *testing.T) {
+	tests := []struct {
+		query, want string
+		returning   bool
+	}{
+		{"insert or ignore into bookmarks (user_id, question_id, created_at) values (?, ?, ?)",
+			"insert into bookmarks (user_id, question_id, created_at) values ($1, $2, $3) on conflict do nothing", false},
+		{"insert or replace into flags (user_id, post_type, post_id, reason) values (?, ?, ?, ?)",
+			`insert into flags (user_id, post_type, post_id, reason) values ($1, $2, $3, $4) on conflict ("user_id", "post_type", "post_id") do update set "reason" = excluded."reason", "created_at" = default, "resolved_at" = default, "resolved_by" = default returning id`, true},
+		{"insert into questions (heading, body, user) values (?, ?, ?)",
+			`insert into questions (heading, body, "user") values ($1, $2, $3) returning id`, true},
+		{"update or ignore question_tags set tag_id = ? where tag_id = ?",
+			`update question_tags set tag_id = $1 where (tag_id = $2) and not exists (select 1 from question_tags as ignored where ignored."question_id" = (question_tags."question_id") and ignored."tag_id" = ($3) and ignored.ctid != question_tags.ctid)`, false},
+		{"select id from tags where name glob ?", "select id from tags where name like $1", false},
+		{"select count(*) from questions where user like ?", `select count(*) from questions where "user" ilike $1`, false},
+		{"select docid from questions_fts where questions_fts match ?",
+			"select docid from questions_fts where questions_fts.document @@ to_tsquery('english', $1)", false},
+		{"select max(a, b) from votes", "select greatest(a, b) from votes", false},
+	}
+	b := postgresBackend{tables: postgresTables}
+	for _, tt := range tests {
+		if got := b.rewrite(tt.query); got.query != tt.want || got.returning != tt.returning {
+			t.Errorf("postgres rewrite of %q = %q, %v, want %q, %v", tt.query, got.query, got.returning, tt.want, tt.returning)
+		}
+	}
+}
+
+func TestMysqlRewrite(t *testing.T) {
+	tests := []struct {
+		query, want string
+	}{
+		{"insert or ignore into bookmarks (user_id, question_id, created_at) values (?, ?, ?)",
+			"insert ignore into bookmarks (user_id, question_id, created_at) values (?, ?, ?)"},
+		{"insert or replace into flags (user_id, post_type, post_id, reason) values (?, ?, ?, ?)",
+			"replace into flags (user_id, post_type, post_id, reason) values (?, ?, ?, ?)"},
+		{"update or ignore question_tags set tag_id = ? where tag_id = ?",
+			"update ignore question_tags set tag_id = ? where tag_id = ?"},
+		{"select group_concat(name, ',') from tags", "select group_concat(name separator ',') from tags"},
+		{"select id from tags where name glob ?", "select id from tags where name like ?"},
+		{"select docid from questions_fts where questions_fts match ?",
+			"select docid from questions_fts where (match (questions_fts.heading, questions_fts.body) against (? in boolean mode) and (? = '' or match (questions_fts.heading) against (? in boolean mode)))"},
+		{"select julianday(?) - julianday(created_at) from votes",
+			"select (unix_timestamp(?) / 86400) - (unix_timestamp(created_at) / 86400) from votes"},
+	}
+	for _, tt := range tests {
+		if got := (mysqlBackend{}).rewrite(tt.query); got.query != tt.want {
+			t.Errorf("mysql rewrite of %q = %q, want %q", tt.query, got.query, tt.want)
+		}
+	}
+}
+
+// TestFTSQueries checks the conversions of the fts4 queries of the search to the other databases
+func TestFTSQueries(t *testing.T) {
+	tests := []struct {
+		query, postgres, mysql, mysqlHeading string
+	}{
+		{`go "sort arrays" heading:slice prefix*`, "go & sort <-> arrays & slice:A & prefix:*", `+go +"sort arrays" +slice +prefix*`, "+slice"},
+		{"a OR b c", "(a | b) & c", "+(a b) +c", ""},
+	}
+	for _, tt := range tests {
+		if got := postgresFTSQuery(tt.query); got != tt.postgres {
+			t.Errorf("postgresFTSQuery(%q) = %q, want %q", tt.query, got, tt.postgres)
+		}
+		if got := mysqlFTSQuery(false)(tt.query); got != tt.mysql {
+			t.Errorf("mysqlFTSQuery(false)(%q) = %q, want %q", tt.query, got, tt.mysql)
+		}
+		if got := mysqlFTSQuery(true)(tt.query); got != tt.mysqlHeading {
+			t.Errorf("mysqlFTSQuery(true)(%q) = %q, want %q", tt.query, got, tt.mysqlHeading)
+		}
+	}
+}
+
+// TestBackendMigrations checks that postgres and mysql have their version of each migration
+// added after their schema
+func TestBackendMigrations(t *testing.T) {
+	if schemaBaseline > len(migrations) {
+		t.Fatalf("schema baseline %d is past the %d migrations", schemaBaseline, len(migrations))
+	}
+	for _, b := range []backend{postgresBackend{tables: postgresTables}, mysqlBackend{}} {
+		for version := schemaBaseline; version < len(migrations); version++ {
+			if _, err := b.migration(version); err != nil {
+				t.Error(err)
+			}
+		}
+	}
+	if got := postgresTables["flags"].keys; !reflect.DeepEqual(got, [][]string{{"id"}, {"user_id", "post_type", "post_id"}}) {
+		t.Errorf("keys of flags %v, want the id and the user, post_type and post_id", got)
+	}
+}
@@ -0,0 +1,377 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// schools log their users in with their own identity provider, over OpenID Connect. SSO_ISSUER is
+// the URL of the provider, SSO_CLIENT_ID and SSO_CLIENT_SECRET the credentials of the app in it,
+// whose redirect URL is SITE_URL/sso/callback, and SSO_NAME names the provider on the login page.
+// Users get an account on their first login, without a password. Their claims map to the app:
+// given_name, family_name and email to their name and address; SSO_ROLE_CLAIM (groups by default)
+// makes teachers of those with one of the values of SSO_TEACHER_VALUES; SSO_COURSE_CLAIM lists
+// the codes of the courses they join. With SSO_REQUIRED=1, only super-users log in with a
+// password, and nobody registers. The provider enforces its own second factor.
+// SAML isn't supported, the providers of schools mostly speak OpenID Connect too
+
+// how long a login can take at the provider
+const ssoStateTTL = 10 * time.Minute
+
+// cookie tying a login to the browser that started it
+const ssoCookie = "sso_state"
+
+// ssoConfig is the configuration of single sign-on
+type ssoConfig struct {
+	Issuer, ClientID, ClientSecret string
+	Name                           string
+	RoleClaim, CourseClaim         string
+	TeacherValues                  map[string]bool
+	Required                       bool
+}
+
+// ssoSettings reads the configuration of single sign-on, nil when it is off
+func ssoSettings() *ssoConfig {
+	issuer := strings.TrimSuffix(os.Getenv("SSO_ISSUER"), "/")
+	if issuer == "" || os.Getenv("SSO_CLIENT_ID") == "" {
+		return nil
+	}
+	c := &ssoConfig{
+		Issuer:        issuer,
+		ClientID:      os.Getenv("SSO_CLIENT_ID"),
+		ClientSecret:  os.Getenv("SSO_CLIENT_SECRET"),
+		Name:          os.Getenv("SSO_NAME"),
+		RoleClaim:     os.Getenv("SSO_ROLE_CLAIM"),
+		CourseClaim:   os.Getenv("SSO_COURSE_CLAIM"),
+		TeacherValues: map[string]bool{},
+		Required:      os.Getenv("SSO_REQUIRED") == "1",
+	}
+	if c.Name == "" {
+		c.Name = "your school account"
+	}
+	if c.RoleClaim == "" {
+		c.RoleClaim = "groups"
+	}
+	values := os.Getenv("SSO_TEACHER_VALUES")
+	if values == "" {
+		values = "teacher,faculty,staff"
+	}
+	for _, v := range strings.Split(values, ",") {
+		if v = strings.ToLower(strings.TrimSpace(v)); v != "" {
+			c.TeacherValues[v] = true
+		}
+	}
+	return c
+}
+
+// ssoProvider are the endpoints of the provider, from its discovery document
+type ssoProvider struct {
+	Issuer        string `json:"issuer"`
+	AuthURL       string `json:"authorization_endpoint"`
+	TokenURL      string `json:"token_endpoint"`
+	KeySetURL     string `json:"jwks_uri"`
+	fetched       time.Time
+	discoveryFrom string
+}
+
+// the discovery document, fetched again every hour
+var ssoDiscovery struct {
+	sync.Mutex
+	provider *ssoProvider
+}
+
+// discoverProvider loads the endpoints of the provider of the issuer
+func discoverProvider(ctx context.Context, issuer string) (*ssoProvider, error) {
+	ssoDiscovery.Lock()
+	p := ssoDiscovery.provider
+	ssoDiscovery.Unlock()
+	if p != nil && p.discoveryFrom == issuer && time.Since(p.fetched) < jwksTTL {
+		return p, nil
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, issuer+"/.well-known/openid-configuration", nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := jwksClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s: %s", req.URL, resp.Status)
+	}
+	p = &ssoProvider{fetched: time.Now(), discoveryFrom: issuer}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(p); err != nil {
+		return nil, fmt.Errorf("%s: %v", req.URL, err)
+	}
+	if p.Issuer != issuer || p.AuthURL == "" || p.TokenURL == "" || p.KeySetURL == "" {
+		return nil, fmt.Errorf("%s: the discovery document doesn't match the issuer", req.URL)
+	}
+	ssoDiscovery.Lock()
+	ssoDiscovery.provider = p
+	ssoDiscovery.Unlock()
+	return p, nil
+}
+
+// serve /sso/login, sending the browser to the identity provider. next is where the user goes back
+func serveSSOLogin(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	config := ssoSettings()
+	if config == nil {
+		http.NotFound(w, r)
+		return
+	}
+	provider, err := discoverProvider(ctx, config.Issuer)
+	if err != nil {
+		serverError(w, r, err)
+		return
+	}
+	next := r.FormValue("next")
+	if !strings.HasPrefix(next, "/") || strings.HasPrefix(next, "//") {
+		next = "/"
+	}
+	// the verifier of PKCE stays here, the provider only gets its hash
+	state, nonce, verifier := newToken(), newToken(), newToken()
+	now := time.Now()
+	err = db.WithTx(ctx, func(ctx context.Context) error {
+		if _, err := db.ExecContext(ctx, "delete from sso_states where created_at < ?", now.Add(-ssoStateTTL).Format(timestampLayout)); err != nil {
+			return err
+		}
+		_, err := db.ExecContext(ctx, "insert into sso_states (state, nonce, verifier, next, created_at) values (?, ?, ?, ?, ?)",
+			state, nonce, verifier, next, now.Format(timestampLayout))
+		return err
+	})
+	if err != nil {
+		serverError(w, r, err)
+		return
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     ssoCookie,
+		Value:    state,
+		Path:     "/sso/",
+		MaxAge:   int(ssoStateTTL / time.Second),
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+	challenge := sha256.Sum256([]byte(verifier))
+	query := url.Values{
+		"response_type":         {"code"},
+		"scope":                 {"openid profile email"},
+		"client_id":             {config.ClientID},
+		"redirect_uri":          {siteURL() + "/sso/callback"},
+		"state":                 {state},
+		"nonce":                 {nonce},
+		"code_challenge":        {base64.RawURLEncoding.EncodeToString(challenge[:])},
+		"code_challenge_method": {"S256"},
+	}
+	http.Redirect(w, r, provider.AuthURL+"?"+query.Encode(), http.StatusFound)
+}
+
+// ssoClaims are the claims of the id token of a login
+type ssoClaims map[string]interface{}
+
+// str is a claim holding a string, empty when missing
+func (c ssoClaims) str(name string) string {
+	s, _ := c[name].(string)
+	return s
+}
+
+// list is a claim holding a string or a list of them
+func (c ssoClaims) list(name string) []string {
+	switch v := c[name].(type) {
+	case string:
+		return strings.FieldsFunc(v, func(r rune) bool { return r == ',' || r == ' ' })
+	case []interface{}:
+		var values []string
+		for _, item := range v {
+			if s, ok := item.(string); ok {
+				values = append(values, s)
+			}
+		}
+		return values
+	}
+	return nil
+}
+
+// check checks the claims of the id token of a login
+func (c ssoClaims) check(config *ssoConfig, nonce string) error {
+	var aud audience
+	b, _ := json.Marshal(c["aud"])
+	json.Unmarshal(b, &aud)
+	issued, _ := c["iat"].(float64)
+	expires, _ := c["exp"].(float64)
+	switch {
+	case c.str("iss") != config.Issuer || !aud.contains(config.ClientID):
+		return fmt.Errorf("the token isn't for this site")
+	case len(aud) > 1 && c.str("azp") != config.ClientID:
+		return fmt.Errorf("the token isn't for this site")
+	case !tokenTimely(int64(issued), int64(expires)):
+		return fmt.Errorf("the token has expired")
+	case c.str("nonce") != nonce:
+		return fmt.Errorf("the token isn't of this login")
+	case c.str("sub") == "":
+		return fmt.Errorf("the token has no user")
+	}
+	return nil
+}
+
+// teacher tells if the role claim makes the user a teacher
+func (c ssoClaims) teacher(config *ssoConfig) bool {
+	for _, v := range c.list(config.RoleClaim) {
+		if config.TeacherValues[strings.ToLower(v)] {
+			return true
+		}
+	}
+	return false
+}
+
+// exchangeCode trades the code of a login for its id token
+func exchangeCode(ctx context.Context, config *ssoConfig, provider *ssoProvider, code, verifier string) (string, error) {
+	form := url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"redirect_uri":  {siteURL() + "/sso/callback"},
+		"code_verifier": {verifier},
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, provider.TokenURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.SetBasicAuth(url.QueryEscape(config.ClientID), url.QueryEscape(config.ClientSecret))
+	resp, err := jwksClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	var result struct {
+		IDToken     string `json:"id_token"`
+		Error       string `json:"error"`
+		Description string `json:"error_description"`
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(&result); err != nil {
+		return "", fmt.Errorf("%s: %v", provider.TokenURL, err)
+	}
+	if result.IDToken == "" {
+		return "", fmt.Errorf("%s: %s %s %s", provider.TokenURL, resp.Status, result.Error, result.Description)
+	}
+	return result.IDToken, nil
+}
+
+// serve /sso/callback, where the identity provider sends the browser back with a code, traded
+// for the id token of the user. They are logged in, provisioned the first time
+func serveSSOCallback(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	config := ssoSettings()
+	if config == nil {
+		http.NotFound(w, r)
+		return
+	}
+	if e := r.FormValue("error"); e != "" {
+		http.Error(w, "the identity provider refused the login: "+e+" "+r.FormValue("error_description"), http.StatusUnauthorized)
+		return
+	}
+	state := r.FormValue("state")
+	if cookie, err := r.Cookie(ssoCookie); err != nil || cookie.Value != state {
+		http.Error(w, "this login wasn't started in this browser, try again", http.StatusBadRequest)
+		return
+	}
+	http.SetCookie(w, &http.Cookie{Name: ssoCookie, Value: "", Path: "/sso/", MaxAge: -1})
+	var nonce, verifier, next string
+	err := db.WithTx(ctx, func(ctx context.Context) error {
+		err := db.QueryRowContext(ctx, "select nonce, verifier, next from sso_states where state = ? and created_at > ?",
+			state, time.Now().Add(-ssoStateTTL).Format(timestampLayout)).Scan(&nonce, &verifier, &next)
+		if err != nil {
+			return err
+		}
+		_, err = db.ExecContext(ctx, "delete from sso_states where state = ?", state)
+		return err
+	})
+	if err == sql.ErrNoRows {
+		http.Error(w, "this login has expired, try again", http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		serverError(w, r, err)
+		return
+	}
+	provider, err := discoverProvider(ctx, config.Issuer)
+	if err != nil {
+		serverError(w, r, err)
+		return
+	}
+	token, err := exchangeCode(ctx, config, provider, r.FormValue("code"), verifier)
+	if err != nil {
+		fmt.Println("sso:", err)
+		http.Error(w, "the identity provider didn't confirm the login, try again", http.StatusBadGateway)
+		return
+	}
+	claims := ssoClaims{}
+	if err := verifyJWT(ctx, token, provider.KeySetURL, &claims); err != nil {
+		fmt.Println("sso:", err)
+		http.Error(w, "the login couldn't be verified: "+err.Error(), http.StatusUnauthorized)
+		return
+	}
+	if err := claims.check(config, nonce); err != nil {
+		http.Error(w, "the login couldn't be verified: "+err.Error(), http.StatusUnauthorized)
+		return
+	}
+	user, err := ssoUser(ctx, config, claims)
+	if err != nil {
+		serverError(w, r, err)
+		return
+	}
+	if user.Banned {
+		http.Error(w, "this account is banned", http.StatusForbidden)
+		return
+	}
+	for _, code := range claims.list(config.CourseClaim) {
+		if _, err := joinCourse(ctx, user, code); err != nil {
+			serverError(w, r, err)
+			return
+		}
+	}
+	if err := startSession(ctx, w, user.UniqueID); err != nil {
+		serverError(w, r, err)
+		return
+	}
+	http.Redirect(w, r, next, http.StatusSeeOther)
+}
+
+// ssoUser finds the account of the user of a login, made on their first login. Those the role
+// claim makes teachers become teachers, and stay so
+func ssoUser(ctx context.Context, config *ssoConfig, claims ssoClaims) (*User, error) {
+	var id int
+	err := db.QueryRowContext(ctx, "select user_id from sso_users where subject = ?", claims.str("sub")).Scan(&id)
+	if err == sql.ErrNoRows {
+		role := "student"
+		if claims.teacher(config) {
+			role = "teacher"
+		}
+		first, last := claims.str("given_name"), claims.str("family_name")
+		if first == "" && last == "" {
+			first, last, _ = strings.Cut(claims.str("name"), " ")
+		}
+		localPart, _, _ := strings.Cut(claims.str("email"), "@")
+		id, err = provisionUser(ctx, first, last, claims.str("email"), role,
+			[]string{claims.str("preferred_username"), localPart, first + "." + last, first},
+			"insert into sso_users (subject, user_id) values (?, ?)", claims.str("sub"))
+	} else if err == nil && claims.teacher(config) {
+		_, err = db.ExecContext(ctx, "update users set user_type = 'teacher' where id = ? and user_type = 'student'", id)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return scanUser(db.QueryRowContext(ctx, "select "+userColumns+" from users where id = ?", id))
+}
@@ -0,0 +1,513 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// the database is chosen with DATABASE_URL: sqlite, like sqlite3:qaApp.db, the default, or
+// sqlite3:///var/lib/qaapp/qa.db, postgres, like postgres://qa:secret@db/qa?sslmode=disable, or
+// mysql, like mysql://qa:secret@db:3306/qa. Query parameters are passed on to the driver.
+// each backend, see store_sqlite.go, store_postgres.go and store_mysql.go, brings its schema, the
+// migrations from it, and the SQL it speaks: the queries of the app are written for sqlite, the
+// others rewrite them once, before they are prepared, see sqlrewrite.go.
+// every query gets a context, canceled when the request it serves is, and runs for at most
+// QUERY_TIMEOUT, like 5s, unless the context was made by unbounded, like for the migrations.
+// the store only runs queries as prepared statements, with the values bound to ? placeholders:
+// a query is prepared the first time it runs and its statement kept for the next times, but
+// for those running once, like the schema, which execOnce runs straight, in the SQL of the backend.
+// WithTx runs a function in a transaction: the queries made with the context it gets join it.
+// SLOW_QUERY_LOG, like 100ms, logs the queries running longer, with their plan, to find those
+// missing an index
+
+// the database used when DATABASE_URL isn't set
+const defaultDatabaseURL = "sqlite3:qaApp.db"
+
+// the longest a query runs when QUERY_TIMEOUT isn't set
+const defaultQueryTimeout = 10 * time.Second
+
+// prepared statements kept at most. Queries are built from constant parts, so there are few
+// of them, but a list of placeholders makes a query per length of the list
+const maxPreparedStatements = 500
+
+// the version of the migrations the schemas of postgres and mysql are written at. A database
+// of theirs is made at this version, and the migrations after it have versions of their own
+const schemaBaseline = 105
+
+// store is the database of the app, on the backend DATABASE_URL chose
+type store struct {
+	conn    *sql.DB
+	backend backend
+	timeout time.Duration // longest a query, or a transaction, may run
+	slow    time.Duration // queries running longer are logged with their plan, 0 to log none
+	queries int64         // run so far, counted atomically, for the benchmarks of the pages
+
+	mu       sync.Mutex
+	stmts    map[string]*sql.Stmt      // prepared statements, by query
+	rewrites map[string]rewrittenQuery // queries in the SQL of the backend, by query
+}
+
+// backend is a database the store runs on
+type backend interface {
+	// name is the name of the database, for the messages
+	name() string
+	// rewrite translates a query of the app, written for sqlite, into the SQL of the backend
+	rewrite(query string) rewrittenQuery
+	// schema are the statements creating the tables of a new database, leaving those that exist
+	schema() []string
+	// migration is the statement of migration version, which brings the schema to version+1
+	migration(version int) (string, error)
+	// version reads the version of the schema, 0 before it is created, and setVersion writes it
+	version(ctx context.Context, q querier) (int, error)
+	setVersion(ctx context.Context, q querier, version int) error
+	// explain returns the steps of the plan of a query, for the slow query log
+	explain(ctx context.Context, q querier, query string, args []interface{}) ([]string, error)
+	// transactionalDDL tells whether changes of the schema roll back with their transaction,
+	// which the dry run of the migrations needs
+	transactionalDDL() bool
+	// optimizeSearch is the statement merging the segments of the search index, empty if it has none
+	optimizeSearch() string
+	// backup is the statement writing a copy of the database to the file named by its argument,
+	// empty when the database is backed up with its own tools
+	backup() string
+}
+
+// rewrittenQuery is a query in the SQL of the backend
+type rewrittenQuery struct {
+	query     string
+	params    []sqlToken // the placeholders of the query, in order, nil when it takes the arguments as they are
+	returning bool       // the query is an insert returning the id of its rows, see insertResult
+}
+
+// bind returns the arguments of the placeholders of the query, from those of the app
+func (r rewrittenQuery) bind(args []interface{}) []interface{} {
+	if r.params == nil {
+		return args
+	}
+	bound := make([]interface{}, len(r.params))
+	for i, p := range r.params {
+		if p.arg < len(args) {
+			bound[i] = args[p.arg]
+		}
+		if p.convert != nil {
+			bound[i] = p.convert(bound[i])
+		}
+	}
+	return bound
+}
+
+// insertResult is the result of an insert run as a query returning the ids of its rows, for the
+// drivers that can't tell the id of the last row
+type insertResult struct {
+	id, rows int64
+}
+
+func (r insertResult) LastInsertId() (int64, error) { return r.id, nil }
+func (r insertResult) RowsAffected() (int64, error) { return r.rows, nil }
+
+// readInsertResult reads the ids returned by an insert and closes its rows
+func readInsertResult(rows *sql.Rows) (sql.Result, error) {
+	defer rows.Close()
+	var r insertResult
+	for rows.Next() {
+		if err := rows.Scan(&r.id); err != nil {
+			return nil, err
+		}
+		r.rows++
+	}
+	return r, rows.Err()
+}
+
+// querier runs queries, on the database or in a transaction
+type querier interface {
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+	QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error)
+	QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row
+}
+
+// the context key of the transaction started by WithTx
+type txKey struct{}
+
+// ExecContext runs a statement for at most the query timeout
+func (s *store) ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error) {
+	atomic.AddInt64(&s.queries, 1)
+	ctx, cancel := s.bound(ctx)
+	defer cancel()
+	defer s.logSlow(ctx, query, args, time.Now())
+	r := s.rewrite(query)
+	if r.returning {
+		rows, err := s.query(ctx, query, args)
+		if err != nil {
+			return nil, err
+		}
+		return readInsertResult(rows)
+	}
+	stmt, err := s.statement(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	if stmt == nil {
+		return s.querier(ctx).ExecContext(ctx, r.query, r.bind(args)...)
+	}
+	return stmt.ExecContext(ctx, r.bind(args)...)
+}
+
+// QueryContext runs a query whose rows can be read for at most the query timeout
+func (s *store) QueryContext(ctx context.Context, query string, args ...interface{}) (*boundedRows, error) {
+	atomic.AddInt64(&s.queries, 1)
+	ctx, cancel := s.bound(ctx)
+	start := time.Now()
+	rows, err := s.query(ctx, query, args)
+	// logged before a failed query releases the context, which explains it
+	s.logSlow(ctx, query, args, start)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	return &boundedRows{Rows: rows, cancel: cancel}, nil
+}
+
+// query runs the query on its prepared statement
+func (s *store) query(ctx context.Context, query string, args []interface{}) (*sql.Rows, error) {
+	r := s.rewrite(query)
+	stmt, err := s.statement(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	if stmt == nil {
+		return s.querier(ctx).QueryContext(ctx, r.query, r.bind(args)...)
+	}
+	return stmt.QueryContext(ctx, r.bind(args)...)
+}
+
+// QueryRowContext runs a query for a row, for at most the query timeout
+func (s *store) QueryRowContext(ctx context.Context, query string, args ...interface{}) *boundedRow {
+	atomic.AddInt64(&s.queries, 1)
+	ctx, cancel := s.bound(ctx)
+	defer s.logSlow(ctx, query, args, time.Now())
+	r := s.rewrite(query)
+	stmt, err := s.statement(ctx, query)
+	if err != nil || stmt == nil {
+		// a row can't be made from the error, querying again returns it in the row
+		return &boundedRow{Row: s.querier(ctx).QueryRowContext(ctx, r.query, r.bind(args)...), cancel: cancel}
+	}
+	return &boundedRow{Row: stmt.QueryRowContext(ctx, r.bind(args)...), cancel: cancel}
+}
+
+// boundedRows are the rows of a query, whose timeout is released once they are read or closed
+type boundedRows struct {
+	*sql.Rows
+	cancel context.CancelFunc
+}
+
+// Next prepares the next row, releasing the timeout after the last one
+func (r *boundedRows) Next() bool {
+	if r.Rows.Next() {
+		return true
+	}
+	r.cancel()
+	return false
+}
+
+// Close closes the rows and releases their timeout
+func (r *boundedRows) Close() error {
+	defer r.cancel()
+	return r.Rows.Close()
+}
+
+// boundedRow is the row of a query, whose timeout is released once it is scanned
+type boundedRow struct {
+	*sql.Row
+	cancel context.CancelFunc
+}
+
+// Scan copies the columns of the row into dest and releases the timeout
+func (r *boundedRow) Scan(dest ...interface{}) error {
+	defer r.cancel()
+	return r.Row.Scan(dest...)
+}
+
+// boundedTx is a transaction, whose timeout is released once it commits or rolls back
+type boundedTx struct {
+	*sql.Tx
+	cancel context.CancelFunc
+}
+
+// Commit commits the transaction and releases its timeout
+func (t *boundedTx) Commit() error {
+	defer t.cancel()
+	return t.Tx.Commit()
+}
+
+// Rollback rolls the transaction back and releases its timeout
+func (t *boundedTx) Rollback() error {
+	defer t.cancel()
+	return t.Tx.Rollback()
+}
+
+// WithTx runs fn in a transaction, committed when fn returns nil and rolled back otherwise.
+// the queries fn makes on the store with the context it gets are part of the transaction,
+// so the helpers it calls write in it too. Inside another WithTx, fn joins the running transaction
+func (s *store) WithTx(ctx context.Context, fn func(ctx context.Context) error) error {
+	if _, ok := ctx.Value(txKey{}).(*sql.Tx); ok {
+		return fn(ctx)
+	}
+	tx, err := s.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	var hooks []func()
+	if err := fn(context.WithValue(context.WithValue(ctx, txKey{}, tx.Tx), commitHooksKey{}, &hooks)); err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	for _, hook := range hooks {
+		hook()
+	}
+	return nil
+}
+
+// the context key of the functions run once the transaction of WithTx commits
+type commitHooksKey struct{}
+
+// AfterCommit runs fn once the transaction of the context commits, or right away outside of
+// transactions: what others are told of a write must be there when they look
+func (s *store) AfterCommit(ctx context.Context, fn func()) {
+	if hooks, ok := ctx.Value(commitHooksKey{}).(*[]func()); ok {
+		*hooks = append(*hooks, fn)
+		return
+	}
+	fn()
+}
+
+// the context key marking the queries and transactions that may run past the query timeout
+type unboundedKey struct{}
+
+// unbounded makes a context whose queries and transactions run for as long as they take, like
+// the migrations rebuilding big tables
+func unbounded(ctx context.Context) context.Context {
+	return context.WithValue(ctx, unboundedKey{}, true)
+}
+
+// bound gives the context the query timeout, unless it was made by unbounded
+func (s *store) bound(ctx context.Context) (context.Context, context.CancelFunc) {
+	if ctx.Value(unboundedKey{}) != nil {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, s.timeout)
+}
+
+// execOnce runs a statement that only runs once, like those of the schema and the migrations,
+// without keeping it prepared. It is in the SQL of the backend, and runs in the transaction of
+// the context if any
+func (s *store) execOnce(ctx context.Context, query string, args ...interface{}) (sql.Result, error) {
+	atomic.AddInt64(&s.queries, 1)
+	ctx, cancel := s.bound(ctx)
+	defer cancel()
+	return s.querier(ctx).ExecContext(ctx, query, args...)
+}
+
+// queryOnce runs a query that only runs once, like those listing what a migration drops, without
+// keeping it prepared. It runs in the transaction of the context if any, so it sees the tables
+// the transaction made
+func (s *store) queryOnce(ctx context.Context, query string, args ...interface{}) (*boundedRows, error) {
+	atomic.AddInt64(&s.queries, 1)
+	ctx, cancel := s.bound(ctx)
+	rows, err := s.querier(ctx).QueryContext(ctx, query, args...)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	return &boundedRows{Rows: rows, cancel: cancel}, nil
+}
+
+// querier returns the transaction of the context, or the database outside of transactions
+func (s *store) querier(ctx context.Context) querier {
+	if tx, ok := ctx.Value(txKey{}).(*sql.Tx); ok {
+		return tx
+	}
+	return s.conn
+}
+
+// statement returns the prepared statement of the query, in the transaction of the context if any
+func (s *store) statement(ctx context.Context, query string) (*sql.Stmt, error) {
+	stmt, err := s.prepare(ctx, query)
+	if err != nil || stmt == nil {
+		return nil, err
+	}
+	if tx, ok := ctx.Value(txKey{}).(*sql.Tx); ok {
+		// closed by the transaction when it ends
+		return tx.StmtContext(ctx, stmt), nil
+	}
+	return stmt, nil
+}
+
+// BeginTx starts a transaction, rolled back unless it commits within the query timeout
+func (s *store) BeginTx(ctx context.Context, opts *sql.TxOptions) (*boundedTx, error) {
+	ctx, cancel := s.bound(ctx)
+	tx, err := s.conn.BeginTx(ctx, opts)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	return &boundedTx{Tx: tx, cancel: cancel}, nil
+}
+
+// Close closes the prepared statements and the database
+func (s *store) Close() error {
+	s.mu.Lock()
+	for query, stmt := range s.stmts {
+		stmt.Close()
+		delete(s.stmts, query)
+	}
+	s.mu.Unlock()
+	return s.conn.Close()
+}
+
+// prepare returns the prepared statement of the query, preparing it the first time.
+// once the store keeps as many statements as it can, it returns nil for new queries,
+// which then run prepared by the driver just for this time
+func (s *store) prepare(ctx context.Context, query string) (*sql.Stmt, error) {
+	s.mu.Lock()
+	stmt, ok := s.stmts[query]
+	full := len(s.stmts) >= maxPreparedStatements
+	s.mu.Unlock()
+	if ok {
+		return stmt, nil
+	}
+	if full {
+		return nil, nil
+	}
+	// prepared outside of the lock, so a slow query doesn't hold up the others
+	stmt, err := s.conn.PrepareContext(ctx, s.rewrite(query).query)
+	if err != nil {
+		return nil, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if kept, ok := s.stmts[query]; ok {
+		stmt.Close()
+		return kept, nil
+	}
+	s.stmts[query] = stmt
+	return stmt, nil
+}
+
+// rewrite returns the query in the SQL of the backend, rewritten the first time it runs
+func (s *store) rewrite(query string) rewrittenQuery {
+	s.mu.Lock()
+	r, ok := s.rewrites[query]
+	s.mu.Unlock()
+	if ok {
+		return r
+	}
+	r = s.backend.rewrite(query)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	// bounded like the statements, the queries beyond are rewritten each time
+	if len(s.rewrites) < maxPreparedStatements {
+		s.rewrites[query] = r
+	}
+	return r
+}
+
+// schemaVersion is the number of migrations the database has seen, 0 for a new database
+func (s *store) schemaVersion(ctx context.Context) (int, error) {
+	ctx, cancel := s.bound(ctx)
+	defer cancel()
+	return s.backend.version(ctx, s.querier(ctx))
+}
+
+// setSchemaVersion records the number of migrations the database has seen, in the transaction
+// of the context if any
+func (s *store) setSchemaVersion(ctx context.Context, version int) error {
+	ctx, cancel := s.bound(ctx)
+	defer cancel()
+	return s.backend.setVersion(ctx, s.querier(ctx), version)
+}
+
+// slowQueryRecord is the log line of a slow query
+type slowQueryRecord struct {
+	Time     string   `json:"time"`
+	Level    string   `json:"level"`
+	Query    string   `json:"query"`
+	Duration int64    `json:"duration_ms"`
+	Plan     []string `json:"plan"` // the steps of the plan, indented under their parent
+}
+
+// logSlow logs the query started at start when it ran for longer than SLOW_QUERY_LOG, with its plan.
+// The rows of a query are read after it returns, so only the time to the first row counts
+func (s *store) logSlow(ctx context.Context, query string, args []interface{}, start time.Time) {
+	took := time.Since(start)
+	if s.slow <= 0 || took < s.slow {
+		return
+	}
+	rec := slowQueryRecord{Time: start.Format(time.RFC3339), Level: "warn", Query: query, Duration: took.Milliseconds()}
+	// explained in the transaction of the query if any, which may have created the tables it reads
+	r := s.rewrite(query)
+	plan, err := s.backend.explain(ctx, s.querier(ctx), r.query, r.bind(args))
+	if err != nil {
+		plan = append(plan, "no plan: "+err.Error())
+	}
+	rec.Plan = plan
+	line, err := json.Marshal(rec)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	fmt.Fprintln(os.Stderr, string(line))
+}
+
+// openStore opens the database of the URL
+func openStore(rawURL string) (*store, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, fmt.Errorf("DATABASE_URL: %w", err)
+	}
+	timeout := defaultQueryTimeout
+	if t := os.Getenv("QUERY_TIMEOUT"); t != "" {
+		if timeout, err = time.ParseDuration(t); err != nil || timeout <= 0 {
+			return nil, fmt.Errorf("QUERY_TIMEOUT: %q isn't a duration like 5s", t)
+		}
+	}
+	var slow time.Duration
+	if t := os.Getenv("SLOW_QUERY_LOG"); t != "" {
+		if slow, err = time.ParseDuration(t); err != nil || slow < 0 {
+			return nil, fmt.Errorf("SLOW_QUERY_LOG: %q isn't a duration like 100ms", t)
+		}
+	}
+	var conn *sql.DB
+	var b backend
+	switch u.Scheme {
+	case "sqlite3", "sqlite", "file":
+		conn, b, err = openSqlite(u)
+	case "postgres", "postgresql":
+		conn, b, err = openPostgres(u)
+	case "mysql":
+		conn, b, err = openMysql(u)
+	default:
+		return nil, fmt.Errorf("DATABASE_URL: unknown database %q, use sqlite3:file.db, postgres://host/database or mysql://host/database", rawURL)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &store{conn: conn, backend: b, timeout: timeout, slow: slow, stmts: map[string]*sql.Stmt{}, rewrites: map[string]rewrittenQuery{}}, nil
+}
+
+// databaseURL is the DATABASE_URL of the environment, or the default database
+func databaseURL() string {
+	if u := os.Getenv("DATABASE_URL"); u != "" {
+		return u
+	}
+	return defaultDatabaseURL
+}
@@ -0,0 +1,1205 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+
+	"github.com/go-sql-driver/mysql"
+)
+
+// mysql, from 8.0.29 on, runs on a schema of its own, written at version schemaBaseline of the
+// migrations like the one of postgres: the migrations after it each have a mysql version in
+// mysqlMigrations, and the version of the schema is kept in the schema_version table.
+// the connections read double quotes as names and || as concatenation, like sqlite. The full
+// text index is a table of the headings and bodies of the questions with fulltext indexes, kept
+// by triggers, see mysqlFTSQuery. Changes of the schema commit as they run, which the dry run of
+// the migrations refuses
+
+// openMysql opens the mysql database of the URL, like mysql://qa:secret@db:3306/qa. Its query
+// parameters are those of the DSN of go-sql-driver/mysql
+func openMysql(u *url.URL) (*sql.DB, backend, error) {
+	cfg, err := mysql.ParseDSN("/?" + u.RawQuery)
+	if err != nil {
+		return nil, nil, fmt.Errorf("DATABASE_URL: %w", err)
+	}
+	cfg.User = u.User.Username()
+	cfg.Passwd, _ = u.User.Password()
+	cfg.Net = "tcp"
+	cfg.Addr = u.Host
+	if u.Port() == "" {
+		cfg.Addr = net.JoinHostPort(u.Hostname(), "3306")
+	}
+	cfg.DBName = strings.TrimPrefix(u.Path, "/")
+	if cfg.Params == nil {
+		cfg.Params = map[string]string{}
+	}
+	// the strings and the names quoted and concatenated the way of sqlite, escape '\' included
+	cfg.Params["sql_mode"] = "'ANSI_QUOTES,PIPES_AS_CONCAT,NO_BACKSLASH_ESCAPES,STRICT_TRANS_TABLES,NO_ENGINE_SUBSTITUTION'"
+	// a list of tags or flag reasons can be longer than the 1024 bytes by default
+	cfg.Params["group_concat_max_len"] = "1048576"
+	// the rows an update matched, not only those it changed, like sqlite counts them
+	cfg.ClientFoundRows = true
+	conn, err := sql.Open("mysql", cfg.FormatDSN())
+	if err != nil {
+		return nil, nil, err
+	}
+	return conn, mysqlBackend{}, nil
+}
+
+// mysqlSchema creates the tables of the app on mysql, at version schemaBaseline. Indexes are
+// made with their tables, as mysql can't create an index if it doesn't exist
+var mysqlSchema = []string{
+	`
+	create table if not exists users (
+		id integer not null auto_increment primary key,
+		first_name text,
+		last_name text,
+		username varchar(255),
+		unique_id integer,
+		password text,
+		user_tags text,
+		user_type text,
+		user_image text,
+		super_user boolean,
+		mod_tags text,
+		email text,
+		digest text,
+		digest_sent_at text,
+		quiet_start text,
+		quiet_end text,
+		timezone text,
+		language text,
+		index users_username (username)
+	);
+	`,
+	`
+	create table if not exists sessions (
+		token varchar(255) not null primary key,
+		user_id integer not null,
+		expires text not null
+	);
+	`,
+	`
+	create table if not exists reserved_names (
+		name varchar(255) not null primary key,
+		reason text
+	);
+	`,
+	`
+	create table if not exists username_history (
+		id integer not null auto_increment primary key,
+		user_id integer not null,
+		old_name text not null,
+		new_name text not null,
+		changed_at text not null
+	);
+	`,
+	`
+	create table if not exists jobs (
+		id integer not null auto_increment primary key,
+		kind text not null,
+		payload text not null,
+		run_at text not null,
+		attempts integer not null default 0,
+		last_error text,
+		done_at text
+	);
+	`,
+	`
+	create table if not exists images (
+		id integer not null auto_increment primary key,
+		path varchar(255) not null unique,
+		user_id integer not null,
+		width integer not null,
+		height integer not null,
+		created_at text not null
+	);
+	`,
+	`
+	create table if not exists image_sizes (
+		image_id integer not null,
+		width integer not null,
+		path text not null,
+		primary key (image_id, width)
+	);
+	`,
+	`
+	create table if not exists comments (
+		id integer not null auto_increment primary key,
+		post_type varchar(255) not null,
+		post_id integer not null,
+		body text not null,
+		date text,
+		time text,
+		"user" text,
+		edited_at text,
+		hidden_at text,
+		index comments_post (post_type, post_id)
+	);
+	`,
+	`
+	create table if not exists changelog (
+		id integer not null auto_increment primary key,
+		title text not null,
+		body text,
+		published_at text not null,
+		user_id integer
+	);
+	`,
+	`
+	create table if not exists changelog_reads (
+		user_id integer not null primary key,
+		last_entry_id integer not null
+	);
+	`,
+	`
+	create table if not exists question_views (
+		question_id integer not null,
+		viewer varchar(255) not null,
+		day varchar(255) not null,
+		primary key (question_id, viewer, day),
+		index question_views_day (day)
+	);
+	`,
+	`
+	create table if not exists bookmarks (
+		user_id integer not null,
+		question_id integer not null,
+		created_at text not null,
+		primary key (user_id, question_id)
+	);
+	`,
+	`
+	create table if not exists courses (
+		id integer not null auto_increment primary key,
+		name text not null,
+		code varchar(255) not null unique,
+		user_id integer not null,
+		created_at text not null,
+		foreign key (user_id) references users (id)
+	);
+	`,
+	`
+	create table if not exists questions (
+		id integer not null auto_increment primary key,
+		heading text,
+		body text,
+		image text,
+		date text,
+		time text,
+		"user" varchar(255),
+		views integer,
+		open boolean,
+		edited_at text,
+		hidden_at text,
+		accepted_id integer,
+		accepted_at varchar(255),
+		is_anonymous boolean not null default false,
+		course_id integer,
+		deadline text,
+		hot_score double not null default 0,
+		protected_at text,
+		protected_by integer,
+		closed_at text,
+		close_reason text,
+		index questions_accepted_at (accepted_at),
+		index questions_course (course_id),
+		index questions_hot (hot_score),
+		index questions_user ("user"),
+		foreign key (course_id) references courses (id) on delete set null,
+		foreign key (protected_by) references users (id) on delete set null
+	);
+	`,
+	`
+	create table if not exists tags (
+		id integer not null auto_increment primary key,
+		name varchar(255),
+		"desc" text,
+		wiki text,
+		allow_anonymous boolean not null default false,
+		deadline text,
+		unique key tags_name (name)
+	);
+	`,
+	`
+	create table if not exists badges (
+		id integer not null auto_increment primary key,
+		name text,
+		description text
+	);
+	`,
+	`
+	create table if not exists notifications (
+		id integer not null auto_increment primary key,
+		user_id integer not null,
+		message text not null,
+		link text,
+		created_at text not null,
+		read_at text,
+		index notifications_user (user_id, id)
+	);
+	`,
+	`
+	create table if not exists subscriptions (
+		user_id integer not null,
+		target_type varchar(255) not null,
+		target varchar(255) not null,
+		email boolean not null default false,
+		created_at text not null,
+		primary key (user_id, target_type, target)
+	);
+	`,
+	`
+	create table if not exists exam_windows (
+		id integer not null auto_increment primary key,
+		title text not null,
+		starts_at text not null,
+		ends_at text not null,
+		tags text not null default (''),
+		created_at text not null
+	);
+	`,
+	`
+	create table if not exists user_mutes (
+		user_id integer not null,
+		muted_id integer not null,
+		created_at text not null,
+		primary key (user_id, muted_id)
+	);
+	`,
+	`
+	create table if not exists sanctions (
+		id integer not null auto_increment primary key,
+		user_id integer not null,
+		kind text not null,
+		reason text not null,
+		"until" text,
+		created_by integer,
+		created_at text not null,
+		lifted_at text
+	);
+	`,
+	`
+	create table if not exists flags (
+		id integer not null auto_increment primary key,
+		user_id integer not null,
+		post_type varchar(255) not null,
+		post_id integer not null,
+		reason text not null,
+		created_at text not null,
+		resolved_at text,
+		resolved_by integer,
+		unique (user_id, post_type, post_id),
+		index flags_post (post_type, post_id)
+	);
+	`,
+	`
+	create table if not exists blocked_words (
+		word varchar(255) not null primary key,
+		severity text not null
+	);
+	`,
+	`
+	create table if not exists app_secrets (
+		name varchar(255) not null primary key,
+		value text not null
+	);
+	`,
+	`
+	create table if not exists feature_flags (
+		name varchar(255) not null primary key,
+		enabled integer not null default 0,
+		updated_at text
+	);
+	`,
+	`
+	create table if not exists experiment_exposures (
+		experiment varchar(255) not null,
+		question_id integer not null,
+		arm text not null,
+		exposed_at text not null,
+		accepted_at text,
+		primary key (experiment, question_id)
+	);
+	`,
+	`
+	create table if not exists bounties (
+		id integer not null auto_increment primary key,
+		question_id integer not null,
+		user_id integer not null,
+		amount integer not null,
+		created_at text not null,
+		expires_at text not null,
+		closed_at text,
+		answer_id integer,
+		awarded_to integer
+	);
+	`,
+	`
+	create table if not exists drafts (
+		user_id integer not null,
+		kind varchar(255) not null,
+		question_id integer not null default 0,
+		heading text not null default (''),
+		body text not null default (''),
+		tags text not null default (''),
+		updated_at text not null,
+		primary key (user_id, kind, question_id)
+	);
+	`,
+	`
+	create table if not exists edit_leases (
+		post_type varchar(255) not null,
+		post_id integer not null,
+		user_id integer not null,
+		expires_at text not null,
+		primary key (post_type, post_id)
+	);
+	`,
+	`
+	create table if not exists held_emails (
+		id integer not null auto_increment primary key,
+		user_id integer not null,
+		subject text not null,
+		body text not null,
+		created_at text not null
+	);
+	`,
+	`
+	create table if not exists tag_synonyms (
+		synonym varchar(255) not null primary key,
+		tag text not null
+	);
+	`,
+	`
+	create table if not exists tag_revisions (
+		id integer not null auto_increment primary key,
+		tag text not null,
+		user_id integer not null,
+		excerpt text not null,
+		body text not null,
+		created_at text not null
+	);
+	`,
+	`
+	create table if not exists email_suppressions (
+		email varchar(255) not null primary key,
+		reason text not null,
+		detail text not null,
+		created_at text not null
+	);
+	`,
+	`
+	create table if not exists activity (
+		id integer not null auto_increment primary key,
+		user_id integer not null,
+		kind text not null,
+		post_type text not null,
+		post_id integer not null,
+		question_id integer not null,
+		detail text not null,
+		created_at text not null,
+		index activity_user (user_id, id)
+	);
+	`,
+	`
+	create table if not exists user_preferences (
+		user_id integer not null primary key,
+		email_opt_in boolean not null,
+		question_sort text not null,
+		answers_per_page integer not null,
+		theme text not null,
+		updated_at text not null
+	);
+	`,
+	`
+	create table if not exists question_tags (
+		question_id integer not null,
+		tag_id integer not null,
+		position integer not null,
+		primary key (question_id, tag_id),
+		index question_tags_tag (tag_id, question_id),
+		foreign key (question_id) references questions (id) on delete cascade,
+		foreign key (tag_id) references tags (id) on delete cascade
+	);
+	`,
+	`
+	create table if not exists user_badges (
+		user_id integer not null,
+		badge_id integer not null,
+		awarded_at text not null,
+		primary key (user_id, badge_id),
+		foreign key (user_id) references users (id) on delete cascade,
+		foreign key (badge_id) references badges (id) on delete cascade
+	);
+	`,
+	`
+	create table if not exists question_moderators (
+		user_id integer not null,
+		question_id integer not null,
+		primary key (user_id, question_id),
+		foreign key (user_id) references users (id) on delete cascade,
+		foreign key (question_id) references questions (id) on delete cascade
+	);
+	`,
+	`
+	create table if not exists mentions (
+		post_type varchar(255) not null,
+		post_id integer not null,
+		user_id integer not null,
+		created_at text not null,
+		primary key (post_type, post_id, user_id),
+		index mentions_user (user_id),
+		foreign key (user_id) references users (id) on delete cascade
+	);
+	`,
+	`
+	create table if not exists attachments (
+		id integer not null auto_increment primary key,
+		post_type varchar(255) not null,
+		post_id integer not null,
+		user_id integer not null,
+		name text not null,
+		path varchar(255) not null unique,
+		content_type text not null,
+		size integer not null,
+		created_at text not null,
+		index attachments_post (post_type, post_id),
+		foreign key (user_id) references users (id) on delete cascade
+	);
+	`,
+	`
+	create table if not exists audit_log (
+		id integer not null auto_increment primary key,
+		actor_id integer not null,
+		actor varchar(255) not null,
+		action text not null,
+		target_type text not null,
+		target text not null,
+		"before" text,
+		after text,
+		created_at text not null,
+		index audit_log_actor ((lower(actor)))
+	);
+	`,
+	`
+	create table if not exists signups (
+		user_id integer not null primary key,
+		ip varchar(255) not null,
+		invite_code text,
+		created_at varchar(255) not null,
+		index signups_ip (ip, created_at),
+		foreign key (user_id) references users (id) on delete cascade
+	);
+	`,
+	`
+	create table if not exists blocked_email_domains (
+		domain varchar(255) not null primary key
+	);
+	`,
+	`
+	create table if not exists user_totp (
+		user_id integer not null primary key,
+		secret text not null,
+		last_step integer not null,
+		enabled_at text,
+		failed_attempts integer not null default 0,
+		locked_until text,
+		foreign key (user_id) references users (id) on delete cascade
+	);
+	`,
+	`
+	create table if not exists recovery_codes (
+		id integer not null auto_increment primary key,
+		user_id integer not null,
+		code_hash text not null,
+		used_at text,
+		foreign key (user_id) references users (id) on delete cascade
+	);
+	`,
+	`
+	create table if not exists remember_tokens (
+		selector varchar(255) not null primary key,
+		validator_hash text not null,
+		user_id integer not null,
+		expires text not null,
+		foreign key (user_id) references users (id) on delete cascade
+	);
+	`,
+	`
+	create table if not exists pending_logins (
+		token varchar(255) not null primary key,
+		user_id integer not null,
+		attempts integer not null,
+		expires text not null,
+		remember boolean not null default false,
+		foreign key (user_id) references users (id) on delete cascade
+	);
+	`,
+	`
+	create table if not exists account_deletions (
+		user_id integer not null primary key,
+		requested_at text not null,
+		delete_at text not null,
+		foreign key (user_id) references users (id) on delete cascade
+	);
+	`,
+	`
+	create table if not exists conversations (
+		id integer not null auto_increment primary key,
+		user_a integer not null,
+		user_b integer not null,
+		created_at text not null,
+		updated_at text not null,
+		unique (user_a, user_b),
+		index conversations_user_b (user_b),
+		foreign key (user_a) references users (id) on delete cascade,
+		foreign key (user_b) references users (id) on delete cascade
+	);
+	`,
+	`
+	create table if not exists messages (
+		id integer not null auto_increment primary key,
+		conversation_id integer not null,
+		sender_id integer not null,
+		body text not null,
+		created_at varchar(255) not null,
+		read_at text,
+		index messages_conversation (conversation_id, id),
+		index messages_sender (sender_id, created_at),
+		foreign key (conversation_id) references conversations (id) on delete cascade,
+		foreign key (sender_id) references users (id) on delete cascade
+	);
+	`,
+	`
+	create table if not exists announcements (
+		id integer not null auto_increment primary key,
+		title text not null,
+		body text not null,
+		tag text not null default (''),
+		user_id integer not null,
+		created_at text not null,
+		expires_at varchar(255) not null,
+		index announcements_expires (expires_at),
+		foreign key (user_id) references users (id) on delete cascade
+	);
+	`,
+	`
+	create table if not exists announcement_dismissals (
+		announcement_id integer not null,
+		user_id integer not null,
+		primary key (announcement_id, user_id),
+		foreign key (announcement_id) references announcements (id) on delete cascade,
+		foreign key (user_id) references users (id) on delete cascade
+	);
+	`,
+	`
+	create table if not exists course_members (
+		course_id integer not null,
+		user_id integer not null,
+		role text not null,
+		joined_at text not null,
+		primary key (course_id, user_id),
+		index course_members_user (user_id),
+		foreign key (course_id) references courses (id) on delete cascade,
+		foreign key (user_id) references users (id) on delete cascade
+	);
+	`,
+	`
+	create table if not exists question_templates (
+		id integer not null auto_increment primary key,
+		name text not null,
+		description text not null,
+		sections text not null,
+		require_code boolean not null default false,
+		user_id integer not null,
+		created_at text not null,
+		foreign key (user_id) references users (id)
+	);
+	`,
+	`
+	create table if not exists welcome_links (
+		token varchar(255) not null primary key,
+		user_id integer not null,
+		expires_at text not null,
+		foreign key (user_id) references users (id) on delete cascade
+	);
+	`,
+	`
+	create table if not exists lti_platforms (
+		id integer not null auto_increment primary key,
+		name text not null,
+		issuer varchar(255) not null,
+		client_id varchar(255) not null,
+		deployment_id text not null default (''),
+		auth_url text not null,
+		keyset_url text not null,
+		created_at text not null,
+		unique (issuer, client_id)
+	);
+	`,
+	`
+	create table if not exists lti_states (
+		state varchar(255) not null primary key,
+		nonce text not null,
+		platform_id integer not null,
+		created_at text not null,
+		foreign key (platform_id) references lti_platforms (id) on delete cascade
+	);
+	`,
+	`
+	create table if not exists lti_users (
+		platform_id integer not null,
+		subject varchar(255) not null,
+		user_id integer not null,
+		primary key (platform_id, subject),
+		foreign key (platform_id) references lti_platforms (id) on delete cascade,
+		foreign key (user_id) references users (id) on delete cascade
+	);
+	`,
+	`
+	create table if not exists lti_contexts (
+		platform_id integer not null,
+		context_id varchar(255) not null,
+		course_id integer not null,
+		primary key (platform_id, context_id),
+		foreign key (platform_id) references lti_platforms (id) on delete cascade,
+		foreign key (course_id) references courses (id) on delete cascade
+	);
+	`,
+	`
+	create table if not exists sso_states (
+		state varchar(255) not null primary key,
+		nonce text not null,
+		verifier text not null,
+		next text not null,
+		created_at text not null
+	);
+	`,
+	`
+	create table if not exists sso_users (
+		subject varchar(255) not null primary key,
+		user_id integer not null,
+		foreign key (user_id) references users (id) on delete cascade
+	);
+	`,
+	`
+	create table if not exists invite_codes (
+		code varchar(255) not null primary key,
+		label text not null,
+		created_by integer not null,
+		max_uses integer not null,
+		uses integer not null,
+		expires_at text,
+		revoked boolean not null,
+		created_at text not null,
+		foreign key (created_by) references users (id) on delete cascade
+	);
+	`,
+	`
+	create table if not exists answers (
+		id integer not null auto_increment primary key,
+		body text,
+		date varchar(255),
+		time text,
+		"user" varchar(255),
+		views integer,
+		question_id integer,
+		edited_at text,
+		hidden_at text,
+		index answers_date (date),
+		index answers_question (question_id),
+		index answers_user ("user"),
+		foreign key (question_id) references questions (id) on delete cascade
+	);
+	`,
+	`
+	create table if not exists votes (
+		id integer not null auto_increment primary key,
+		user_id integer not null,
+		post_type varchar(255) not null,
+		post_id integer not null,
+		value integer not null,
+		voted_at varchar(255) not null,
+		ip text,
+		unique (user_id, post_type, post_id),
+		index votes_voted_at (voted_at),
+		index votes_post (post_type, post_id, value),
+		foreign key (user_id) references users (id) on delete cascade
+	);
+	`,
+	`
+	create table if not exists tag_pairs (
+		tag_id integer not null,
+		related_id integer not null,
+		questions integer not null,
+		primary key (tag_id, related_id),
+		foreign key (tag_id) references tags (id) on delete cascade,
+		foreign key (related_id) references tags (id) on delete cascade
+	);
+	`,
+	`
+	create table if not exists webhooks (
+		id integer not null auto_increment primary key,
+		url text not null,
+		secret text not null,
+		events text not null,
+		active boolean not null,
+		created_at text not null
+	);
+	`,
+	`
+	create table if not exists webhook_deliveries (
+		id integer not null auto_increment primary key,
+		webhook_id integer not null,
+		event text not null,
+		payload text not null,
+		status text not null,
+		attempts integer not null default 0,
+		response_code integer,
+		last_error text,
+		created_at text not null,
+		delivered_at text,
+		index webhook_deliveries_webhook (webhook_id),
+		foreign key (webhook_id) references webhooks (id) on delete cascade
+	);
+	`,
+	`
+	create table if not exists chat_channels (
+		id integer not null auto_increment primary key,
+		kind text not null,
+		url text not null,
+		tags text not null,
+		course_id integer,
+		user_id integer not null,
+		created_at text not null,
+		foreign key (course_id) references courses (id) on delete cascade,
+		foreign key (user_id) references users (id)
+	);
+	`,
+	`
+	create table if not exists api_keys (
+		id integer not null auto_increment primary key,
+		user_id integer not null,
+		name text not null,
+		selector varchar(255) not null unique,
+		validator_hash text not null,
+		scope text not null,
+		quota integer not null,
+		created_at text not null,
+		last_used_at text,
+		revoked_at text,
+		index api_keys_user (user_id),
+		foreign key (user_id) references users (id) on delete cascade
+	);
+	`,
+	`
+	create table if not exists question_merges (
+		question_id integer not null primary key,
+		target_id integer not null,
+		user_id integer not null,
+		merged_at text not null,
+		index question_merges_target (target_id),
+		foreign key (target_id) references questions (id) on delete cascade
+	);
+	`,
+	`
+	create table if not exists reviews (
+		id integer not null auto_increment primary key,
+		queue varchar(255) not null,
+		post_type varchar(255) not null,
+		post_id integer not null,
+		user_id integer not null,
+		action text not null,
+		created_at text not null,
+		unique (queue, post_type, post_id, user_id),
+		index reviews_post (post_type, post_id),
+		foreign key (user_id) references users (id) on delete cascade
+	);
+	`,
+	`
+	create table if not exists close_votes (
+		id integer not null auto_increment primary key,
+		question_id integer not null,
+		user_id integer not null,
+		kind varchar(255) not null,
+		reason text not null,
+		created_at varchar(255) not null,
+		unique (question_id, user_id, kind),
+		index close_votes_created (created_at),
+		foreign key (question_id) references questions (id) on delete cascade,
+		foreign key (user_id) references users (id) on delete cascade
+	);
+	`,
+	`
+	create table if not exists vote_fraud_reports (
+		id integer not null auto_increment primary key,
+		kind text not null,
+		voter_id integer,
+		ip text,
+		author text not null,
+		votes integer not null,
+		points integer not null,
+		first_at text not null,
+		last_at text not null,
+		created_at text not null,
+		resolved_at text,
+		resolved_by integer,
+		foreign key (voter_id) references users (id) on delete set null,
+		foreign key (resolved_by) references users (id) on delete set null
+	);
+	`,
+
+	// the full text index of the questions, kept by the triggers below. Deleting a question
+	// deletes its entry
+	`
+	create table if not exists questions_fts (
+		docid integer not null primary key,
+		heading text,
+		body text,
+		fulltext index questions_fts_text (heading, body),
+		fulltext index questions_fts_heading (heading),
+		foreign key (docid) references questions (id) on delete cascade
+	);
+	`,
+	`
+	create trigger if not exists questions_fts_after_insert after insert on questions for each row
+		insert into questions_fts (docid, heading, body) values (new.id, new.heading, new.body);
+	`,
+	`
+	create trigger if not exists questions_fts_after_update after update on questions for each row begin
+		if not (old.heading <=> new.heading and old.body <=> new.body) then
+			update questions_fts set heading = new.heading, body = new.body where docid = new.id;
+		end if;
+	end;
+	`,
+	// the tags of a question are deleted by a trigger rather than by their foreign key, as
+	// cascades don't run the triggers counting the pairs of tags
+	`
+	create trigger if not exists questions_before_delete before delete on questions for each row
+		delete from question_tags where question_id = old.id;
+	`,
+	// the pairs of tags on the same questions, counted as the tags of the questions change
+	`
+	create trigger if not exists tag_pairs_after_insert after insert on question_tags for each row
+		insert into tag_pairs (tag_id, related_id, questions)
+			select * from (select new.tag_id, tag_id, 1 from question_tags where question_id = new.question_id and tag_id != new.tag_id
+				union all select tag_id, new.tag_id, 1 from question_tags where question_id = new.question_id and tag_id != new.tag_id) as pairs
+			on duplicate key update questions = tag_pairs.questions + 1;
+	`,
+	`
+	create trigger if not exists tag_pairs_after_delete after delete on question_tags for each row begin
+		update tag_pairs set questions = questions - 1
+			where tag_id = old.tag_id and related_id in (select tag_id from question_tags where question_id = old.question_id);
+		update tag_pairs set questions = questions - 1
+			where tag_id in (select tag_id from question_tags where question_id = old.question_id) and related_id = old.tag_id;
+		delete from tag_pairs where questions <= 0 and (tag_id = old.tag_id or related_id = old.tag_id);
+	end;
+	`,
+	`
+	create trigger if not exists tag_pairs_after_update after update on question_tags for each row begin
+		if old.tag_id != new.tag_id then
+			update tag_pairs set questions = questions - 1
+				where tag_id = old.tag_id and related_id in (select tag_id from question_tags where question_id = old.question_id and tag_id != new.tag_id);
+			update tag_pairs set questions = questions - 1
+				where tag_id in (select tag_id from question_tags where question_id = old.question_id and tag_id != new.tag_id) and related_id = old.tag_id;
+			delete from tag_pairs where questions <= 0 and (tag_id = old.tag_id or related_id = old.tag_id);
+			insert into tag_pairs (tag_id, related_id, questions)
+				select * from (select new.tag_id, tag_id, 1 from question_tags where question_id = new.question_id and tag_id != new.tag_id
+					union all select tag_id, new.tag_id, 1 from question_tags where question_id = new.question_id and tag_id != new.tag_id) as pairs
+				on duplicate key update questions = tag_pairs.questions + 1;
+		end if;
+	end;
+	`,
+	`
+	create trigger if not exists audit_log_no_update before update on audit_log for each row begin
+		signal sqlstate '45000' set message_text = 'the audit log is append-only';
+	end;
+	`,
+	`
+	create trigger if not exists audit_log_no_delete before delete on audit_log for each row begin
+		signal sqlstate '45000' set message_text = 'the audit log is append-only';
+	end;
+	`,
+	// wilson(up, down) ranks by votes, see wilsonScore
+	`
+	create function if not exists wilson(up bigint, down bigint) returns double deterministic begin
+		declare n double default up + down;
+		declare p double;
+		if n = 0 then
+			return 0;
+		end if;
+		set p = up / n;
+		return (p + 1.96 * 1.96 / (2 * n) - 1.96 * sqrt((p * (1 - p) + 1.96 * 1.96 / (4 * n)) / n)) / (1 + 1.96 * 1.96 / n);
+	end;
+	`,
+	"create table if not exists schema_version (version integer not null);",
+	fmt.Sprintf("insert into schema_version (version) select %d from dual where not exists (select 1 from schema_version);", schemaBaseline),
+}
+
+// mysqlMigrations are the mysql versions of the migrations after schemaBaseline, by version
+var mysqlMigrations = map[int]string{}
+
+// mysqlBackend is a mysql database
+type mysqlBackend struct{}
+
+func (mysqlBackend) name() string {
+	return "mysql"
+}
+
+func (mysqlBackend) schema() []string {
+	return mysqlSchema
+}
+
+func (mysqlBackend) migration(version int) (string, error) {
+	if version < schemaBaseline {
+		return "", fmt.Errorf("the mysql schema starts at version %d, the database is at version %d", schemaBaseline, version)
+	}
+	m, ok := mysqlMigrations[version]
+	if !ok {
+		return "", fmt.Errorf("migration %d has no mysql version", version)
+	}
+	return m, nil
+}
+
+func (mysqlBackend) version(ctx context.Context, q querier) (int, error) {
+	var tables int
+	err := q.QueryRowContext(ctx, "select count(*) from information_schema.tables where table_schema = database() and table_name = 'schema_version'").Scan(&tables)
+	if err != nil || tables == 0 {
+		return 0, err
+	}
+	var version int
+	err = q.QueryRowContext(ctx, "select version from schema_version").Scan(&version)
+	return version, err
+}
+
+func (mysqlBackend) setVersion(ctx context.Context, q querier, version int) error {
+	_, err := q.ExecContext(ctx, "update schema_version set version = ?", version)
+	return err
+}
+
+// explain returns the lines of the plan of EXPLAIN, as a tree
+func (mysqlBackend) explain(ctx context.Context, q querier, query string, args []interface{}) ([]string, error) {
+	var plan string
+	if err := q.QueryRowContext(ctx, "explain format=tree "+query, args...).Scan(&plan); err != nil {
+		return nil, err
+	}
+	return strings.Split(strings.TrimRight(plan, "\n"), "\n"), nil
+}
+
+func (mysqlBackend) transactionalDDL() bool {
+	return false
+}
+
+func (mysqlBackend) optimizeSearch() string {
+	return "optimize table questions_fts"
+}
+
+// backup is empty, mysql is backed up with mysqldump
+func (mysqlBackend) backup() string {
+	return ""
+}
+
+// rewrite translates a query of the app to mysql
+func (mysqlBackend) rewrite(query string) rewrittenQuery {
+	ts := aliasDerivedTables(quoteNames(tokenizeSQL(query)))
+	ts = rewriteCalls(ts, mysqlCall)
+	ts = mysqlOperators(ts)
+	switch ts.statementKind() {
+	case "insert":
+		ts = mysqlInsert(ts)
+	case "update":
+		ts = mysqlTargetSubqueries(mysqlUpdateOrIgnore(ts))
+	case "delete":
+		ts = mysqlTargetSubqueries(ts)
+	}
+	text, params := bindParams(ts, func(int) string { return "?" })
+	return rewrittenQuery{query: text, params: params}
+}
+
+// the types of cast of mysql, by those of sqlite
+var mysqlCastTypes = map[string]string{"text": "char", "integer": "signed", "int": "signed", "real": "double"}
+
+// mysqlCall rewrites the calls of the functions of sqlite mysql doesn't have or has differently
+func mysqlCall(name string, args []sqlTokens) sqlTokens {
+	switch {
+	case name == "group_concat":
+		sep := sqlText("','")
+		if len(args) > 1 {
+			sep = args[1]
+		}
+		return concatSQL(sqlText("group_concat("), args[0], sqlText(" separator "), sep.trim(), sqlText(")"))
+	case (name == "max" || name == "min") && len(args) > 1:
+		// the scalar max and min of sqlite
+		f := map[string]string{"max": "greatest(", "min": "least("}[name]
+		return concatSQL(sqlText(f), joinSQL(args, ","), sqlText(")"))
+	case name == "julianday":
+		return concatSQL(sqlText("(unix_timestamp("), args[0], sqlText(") / 86400)"))
+	case name == "length":
+		return concatSQL(sqlText("char_length("), args[0], sqlText(")"))
+	case name == "cast":
+		x := args[0].trim()
+		as := x.prev(len(x))
+		if t, ok := mysqlCastTypes[x.name(as)]; ok {
+			return concatSQL(sqlText("cast("), x[:as], sqlText(t+")"))
+		}
+	case name == "snippet":
+		// mysql has no snippets of the matches, the beginning of the body stands for them
+		return sqlText("substring(questions_fts.body, 1, 200)")
+	}
+	return nil
+}
+
+// mysqlOperators rewrites the operators of sqlite: glob and the full-text match. like ignores
+// case on mysql, like on sqlite
+func mysqlOperators(ts sqlTokens) sqlTokens {
+	var out sqlTokens
+	for i := 0; i < len(ts); i++ {
+		switch next := ts.next(i); {
+		case ts.is(i, "glob") && next < len(ts) && ts[next].kind == tokenParam:
+			out = append(out, sqlText("like ")...)
+			out = append(out, param(ts[next].arg, globToLike))
+			i = next
+		case ts.is(i, "match") && next < len(ts) && ts[next].kind == tokenParam && len(out) > 0 && out.name(out.prev(len(out))) == "questions_fts":
+			// the match of the headings and bodies, and of the headings for the terms limited to them
+			arg := ts[next].arg
+			out = append(out[:out.prev(len(out))], sqlText("(match (questions_fts.heading, questions_fts.body) against (")...)
+			out = append(out, param(arg, mysqlFTSQuery(false)))
+			out = append(out, sqlText(" in boolean mode) and (")...)
+			out = append(out, param(arg, mysqlFTSQuery(true)))
+			out = append(out, sqlText(" = '' or match (questions_fts.heading) against (")...)
+			out = append(out, param(arg, mysqlFTSQuery(true)))
+			out = append(out, sqlText(" in boolean mode)))")...)
+			i = next
+		default:
+			out = append(out, ts[i])
+		}
+	}
+	return out
+}
+
+// mysqlFTSQuery returns the conversion of a full-text query in the syntax of fts4 to a query of
+// the boolean mode of mysql, of the terms limited to the headings if heading is true
+func mysqlFTSQuery(heading bool) func(interface{}) interface{} {
+	return func(arg interface{}) interface{} {
+		query, ok := arg.(string)
+		if !ok {
+			return arg
+		}
+		var groups []string
+		for _, group := range ftsGroups(parseFTSQuery(query)) {
+			var alternatives []string
+			for _, t := range group {
+				if heading && !t.heading {
+					continue
+				}
+				term := strings.Join(t.words, " ")
+				if len(t.words) > 1 {
+					term = `"` + term + `"`
+				} else if t.prefix {
+					term += "*"
+				}
+				alternatives = append(alternatives, term)
+			}
+			switch len(alternatives) {
+			case 0:
+			case 1:
+				groups = append(groups, "+"+alternatives[0])
+			default:
+				groups = append(groups, "+("+strings.Join(alternatives, " ")+")")
+			}
+		}
+		return strings.Join(groups, " ")
+	}
+}
+
+// mysqlInsert rewrites the conflict clauses of an insert: insert or ignore and or replace, and
+// on conflict, to insert ignore, replace and on duplicate key update
+func mysqlInsert(ts sqlTokens) sqlTokens {
+	verb, after, action := ts.orConflict()
+	switch action {
+	case "ignore":
+		return ts.splice(verb, after, sqlText("insert ignore"))
+	case "replace":
+		return ts.splice(verb, after, sqlText("replace"))
+	}
+	on := -1
+	for i := ts.find(0, "on"); i < len(ts); i = ts.find(i+1, "on") {
+		if ts.is(ts.next(i), "conflict") {
+			on = i
+			break
+		}
+	}
+	if on < 0 {
+		return ts
+	}
+	do := ts.find(on, "do")
+	if nothing := ts.next(do); ts.is(nothing, "nothing") {
+		return concatSQL(ts[:on].splice(verb, verb+1, sqlText("insert ignore")), ts[nothing+1:])
+	}
+	set := ts.next(ts.next(do))
+	var update sqlTokens
+	for i := set + 1; i < len(ts); i++ {
+		if ts.is(i, "excluded") && ts.symbol(i+1, ".") {
+			update = append(update, sqlText("values(")...)
+			update = append(update, ts[i+2], sqlToken{kind: tokenSymbol, text: ")"})
+			i += 2
+			continue
+		}
+		update = append(update, ts[i])
+	}
+	return concatSQL(ts[:on], sqlText("on duplicate key update"), update)
+}
+
+// mysqlUpdateOrIgnore rewrites update or ignore to update ignore
+func mysqlUpdateOrIgnore(ts sqlTokens) sqlTokens {
+	verb, after, action := ts.orConflict()
+	if action != "ignore" {
+		return ts
+	}
+	return ts.splice(verb, after, sqlText("update ignore"))
+}
+
+// mysqlTargetSubqueries copies the rows of the subqueries of an update or a delete reading the
+// table it changes into a derived table, as mysql can't read the table a statement changes
+func mysqlTargetSubqueries(ts sqlTokens) sqlTokens {
+	table := ts.next(ts.next(-1))
+	if ts.is(table, "from") || ts.is(table, "ignore") {
+		table = ts.next(table)
+	}
+	target := ts.name(table)
+	n := 0
+	var copySubqueries func(ts sqlTokens) sqlTokens
+	copySubqueries = func(ts sqlTokens) sqlTokens {
+		var out sqlTokens
+		for i := 0; i < len(ts); i++ {
+			if !ts.symbol(i, "(") {
+				out = append(out, ts[i])
+				continue
+			}
+			end := ts.closing(i)
+			if end == len(ts) {
+				return append(out, ts[i:]...)
+			}
+			inner := ts[i+1 : end]
+			from := inner.find(0, "from")
+			if inner.is(inner.next(-1), "select") && inner.name(inner.next(from)) == target {
+				n++
+				out = append(out, sqlText("(select * from (")...)
+				out = append(out, inner...)
+				out = append(out, sqlText(fmt.Sprintf(") as copy%d)", n))...)
+			} else {
+				out = append(out, ts[i])
+				out = append(out, copySubqueries(inner)...)
+				out = append(out, ts[end])
+			}
+			i = end
+		}
+		return out
+	}
+	return copySubqueries(ts)
+}
@@ -0,0 +1,1192 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+
+	_ "github.com/lib/pq"
+)
+
+// postgres, from 14 on, runs on a schema of its own, written at version schemaBaseline of the
+// migrations: the migrations after it each have a postgres version in postgresMigrations, and
+// the version of the schema is kept in the schema_version table.
+// the full text index is a table of the headings and bodies of the questions with a tsvector of
+// their words, the heading weighted A, kept by triggers; the queries of the app matching it, in
+// the syntax of fts4, are rewritten to match the tsvector, see postgresFTSQuery
+
+// openPostgres opens the postgres database of the URL, which lib/pq reads as it is
+func openPostgres(u *url.URL) (*sql.DB, backend, error) {
+	conn, err := sql.Open("postgres", u.String())
+	if err != nil {
+		return nil, nil, err
+	}
+	return conn, postgresBackend{tables: postgresTables}, nil
+}
+
+// postgresSchema creates the tables of the app on postgres, at version schemaBaseline
+var postgresSchema = []string{
+	`
+	create table if not exists users (
+		id integer generated by default as identity primary key,
+		first_name text,
+		last_name text,
+		username text,
+		unique_id integer,
+		password text,
+		user_tags text,
+		user_type text,
+		user_image text,
+		super_user boolean,
+		mod_tags text,
+		email text,
+		digest text,
+		digest_sent_at text,
+		quiet_start text,
+		quiet_end text,
+		timezone text,
+		language text
+	);
+	`,
+	`
+	create table if not exists sessions (
+		token text not null primary key,
+		user_id integer not null,
+		expires text not null
+	);
+	`,
+	`
+	create table if not exists reserved_names (
+		name text not null primary key,
+		reason text
+	);
+	`,
+	`
+	create table if not exists username_history (
+		id integer generated by default as identity primary key,
+		user_id integer not null,
+		old_name text not null,
+		new_name text not null,
+		changed_at text not null
+	);
+	`,
+	`
+	create table if not exists jobs (
+		id integer generated by default as identity primary key,
+		kind text not null,
+		payload text not null,
+		run_at text not null,
+		attempts integer not null default 0,
+		last_error text,
+		done_at text
+	);
+	`,
+	`
+	create table if not exists images (
+		id integer generated by default as identity primary key,
+		path text not null unique,
+		user_id integer not null,
+		width integer not null,
+		height integer not null,
+		created_at text not null
+	);
+	`,
+	`
+	create table if not exists image_sizes (
+		image_id integer not null,
+		width integer not null,
+		path text not null,
+		primary key (image_id, width)
+	);
+	`,
+	`
+	create table if not exists comments (
+		id integer generated by default as identity primary key,
+		post_type text not null,
+		post_id integer not null,
+		body text not null,
+		date text,
+		time text,
+		"user" text,
+		edited_at text,
+		hidden_at text
+	);
+	`,
+	`
+	create table if not exists changelog (
+		id integer generated by default as identity primary key,
+		title text not null,
+		body text,
+		published_at text not null,
+		user_id integer
+	);
+	`,
+	`
+	create table if not exists changelog_reads (
+		user_id integer not null primary key,
+		last_entry_id integer not null
+	);
+	`,
+	`
+	create table if not exists question_views (
+		question_id integer not null,
+		viewer text not null,
+		day text not null,
+		primary key (question_id, viewer, day)
+	);
+	`,
+	`
+	create table if not exists bookmarks (
+		user_id integer not null,
+		question_id integer not null,
+		created_at text not null,
+		primary key (user_id, question_id)
+	);
+	`,
+	`
+	create table if not exists courses (
+		id integer generated by default as identity primary key,
+		name text not null,
+		code text not null unique,
+		user_id integer not null references users (id),
+		created_at text not null
+	);
+	`,
+	`
+	create table if not exists questions (
+		id integer generated by default as identity primary key,
+		heading text,
+		body text,
+		image text,
+		date text,
+		time text,
+		"user" text,
+		views integer,
+		open boolean,
+		edited_at text,
+		hidden_at text,
+		accepted_id integer,
+		accepted_at text,
+		is_anonymous boolean not null default false,
+		course_id integer references courses (id) on delete set null,
+		deadline text,
+		hot_score double precision not null default 0,
+		protected_at text,
+		protected_by integer references users (id) on delete set null,
+		closed_at text,
+		close_reason text
+	);
+	`,
+	`
+	create table if not exists tags (
+		id integer generated by default as identity primary key,
+		name text,
+		"desc" text,
+		wiki text,
+		allow_anonymous boolean not null default false,
+		deadline text
+	);
+	`,
+	`
+	create table if not exists badges (
+		id integer generated by default as identity primary key,
+		name text,
+		description text
+	);
+	`,
+	`
+	create table if not exists notifications (
+		id integer generated by default as identity primary key,
+		user_id integer not null,
+		message text not null,
+		link text,
+		created_at text not null,
+		read_at text
+	);
+	`,
+	`
+	create table if not exists subscriptions (
+		user_id integer not null,
+		target_type text not null,
+		target text not null,
+		email boolean not null default false,
+		created_at text not null,
+		primary key (user_id, target_type, target)
+	);
+	`,
+	`
+	create table if not exists exam_windows (
+		id integer generated by default as identity primary key,
+		title text not null,
+		starts_at text not null,
+		ends_at text not null,
+		tags text not null default '',
+		created_at text not null
+	);
+	`,
+	`
+	create table if not exists user_mutes (
+		user_id integer not null,
+		muted_id integer not null,
+		created_at text not null,
+		primary key (user_id, muted_id)
+	);
+	`,
+	`
+	create table if not exists sanctions (
+		id integer generated by default as identity primary key,
+		user_id integer not null,
+		kind text not null,
+		reason text not null,
+		"until" text,
+		created_by integer,
+		created_at text not null,
+		lifted_at text
+	);
+	`,
+	`
+	create table if not exists flags (
+		id integer generated by default as identity primary key,
+		user_id integer not null,
+		post_type text not null,
+		post_id integer not null,
+		reason text not null,
+		created_at text not null,
+		resolved_at text,
+		resolved_by integer,
+		unique (user_id, post_type, post_id)
+	);
+	`,
+	`
+	create table if not exists blocked_words (
+		word text not null primary key,
+		severity text not null
+	);
+	`,
+	`
+	create table if not exists app_secrets (
+		name text not null primary key,
+		value text not null
+	);
+	`,
+	`
+	create table if not exists feature_flags (
+		name text not null primary key,
+		enabled integer not null default 0,
+		updated_at text
+	);
+	`,
+	`
+	create table if not exists experiment_exposures (
+		experiment text not null,
+		question_id integer not null,
+		arm text not null,
+		exposed_at text not null,
+		accepted_at text,
+		primary key (experiment, question_id)
+	);
+	`,
+	`
+	create table if not exists bounties (
+		id integer generated by default as identity primary key,
+		question_id integer not null,
+		user_id integer not null,
+		amount integer not null,
+		created_at text not null,
+		expires_at text not null,
+		closed_at text,
+		answer_id integer,
+		awarded_to integer
+	);
+	`,
+	`
+	create table if not exists drafts (
+		user_id integer not null,
+		kind text not null,
+		question_id integer not null default 0,
+		heading text not null default '',
+		body text not null default '',
+		tags text not null default '',
+		updated_at text not null,
+		primary key (user_id, kind, question_id)
+	);
+	`,
+	`
+	create table if not exists edit_leases (
+		post_type text not null,
+		post_id integer not null,
+		user_id integer not null,
+		expires_at text not null,
+		primary key (post_type, post_id)
+	);
+	`,
+	`
+	create table if not exists held_emails (
+		id integer generated by default as identity primary key,
+		user_id integer not null,
+		subject text not null,
+		body text not null,
+		created_at text not null
+	);
+	`,
+	`
+	create table if not exists tag_synonyms (
+		synonym text not null primary key,
+		tag text not null
+	);
+	`,
+	`
+	create table if not exists tag_revisions (
+		id integer generated by default as identity primary key,
+		tag text not null,
+		user_id integer not null,
+		excerpt text not null,
+		body text not null,
+		created_at text not null
+	);
+	`,
+	`
+	create table if not exists email_suppressions (
+		email text not null primary key,
+		reason text not null,
+		detail text not null,
+		created_at text not null
+	);
+	`,
+	`
+	create table if not exists activity (
+		id integer generated by default as identity primary key,
+		user_id integer not null,
+		kind text not null,
+		post_type text not null,
+		post_id integer not null,
+		question_id integer not null,
+		detail text not null,
+		created_at text not null
+	);
+	`,
+	`
+	create table if not exists user_preferences (
+		user_id integer not null primary key,
+		email_opt_in boolean not null,
+		question_sort text not null,
+		answers_per_page integer not null,
+		theme text not null,
+		updated_at text not null
+	);
+	`,
+	`
+	create table if not exists question_tags (
+		question_id integer not null references questions (id) on delete cascade,
+		tag_id integer not null references tags (id) on delete cascade,
+		position integer not null,
+		primary key (question_id, tag_id)
+	);
+	`,
+	`
+	create table if not exists user_badges (
+		user_id integer not null references users (id) on delete cascade,
+		badge_id integer not null references badges (id) on delete cascade,
+		awarded_at text not null,
+		primary key (user_id, badge_id)
+	);
+	`,
+	`
+	create table if not exists question_moderators (
+		user_id integer not null references users (id) on delete cascade,
+		question_id integer not null references questions (id) on delete cascade,
+		primary key (user_id, question_id)
+	);
+	`,
+	`
+	create table if not exists mentions (
+		post_type text not null,
+		post_id integer not null,
+		user_id integer not null references users (id) on delete cascade,
+		created_at text not null,
+		primary key (post_type, post_id, user_id)
+	);
+	`,
+	`
+	create table if not exists attachments (
+		id integer generated by default as identity primary key,
+		post_type text not null,
+		post_id integer not null,
+		user_id integer not null references users (id) on delete cascade,
+		name text not null,
+		path text not null unique,
+		content_type text not null,
+		size integer not null,
+		created_at text not null
+	);
+	`,
+	`
+	create table if not exists audit_log (
+		id integer generated by default as identity primary key,
+		actor_id integer not null,
+		actor text not null,
+		action text not null,
+		target_type text not null,
+		target text not null,
+		"before" text,
+		after text,
+		created_at text not null
+	);
+	`,
+	`
+	create table if not exists signups (
+		user_id integer not null primary key references users (id) on delete cascade,
+		ip text not null,
+		invite_code text,
+		created_at text not null
+	);
+	`,
+	`
+	create table if not exists blocked_email_domains (
+		domain text not null primary key
+	);
+	`,
+	`
+	create table if not exists user_totp (
+		user_id integer not null primary key references users (id) on delete cascade,
+		secret text not null,
+		last_step integer not null,
+		enabled_at text,
+		failed_attempts integer not null default 0,
+		locked_until text
+	);
+	`,
+	`
+	create table if not exists recovery_codes (
+		id integer generated by default as identity primary key,
+		user_id integer not null references users (id) on delete cascade,
+		code_hash text not null,
+		used_at text
+	);
+	`,
+	`
+	create table if not exists remember_tokens (
+		selector text not null primary key,
+		validator_hash text not null,
+		user_id integer not null references users (id) on delete cascade,
+		expires text not null
+	);
+	`,
+	`
+	create table if not exists pending_logins (
+		token text not null primary key,
+		user_id integer not null references users (id) on delete cascade,
+		attempts integer not null,
+		expires text not null,
+		remember boolean not null default false
+	);
+	`,
+	`
+	create table if not exists account_deletions (
+		user_id integer not null primary key references users (id) on delete cascade,
+		requested_at text not null,
+		delete_at text not null
+	);
+	`,
+	`
+	create table if not exists conversations (
+		id integer generated by default as identity primary key,
+		user_a integer not null references users (id) on delete cascade,
+		user_b integer not null references users (id) on delete cascade,
+		created_at text not null,
+		updated_at text not null,
+		unique (user_a, user_b)
+	);
+	`,
+	`
+	create table if not exists messages (
+		id integer generated by default as identity primary key,
+		conversation_id integer not null references conversations (id) on delete cascade,
+		sender_id integer not null references users (id) on delete cascade,
+		body text not null,
+		created_at text not null,
+		read_at text
+	);
+	`,
+	`
+	create table if not exists announcements (
+		id integer generated by default as identity primary key,
+		title text not null,
+		body text not null,
+		tag text not null default '',
+		user_id integer not null references users (id) on delete cascade,
+		created_at text not null,
+		expires_at text not null
+	);
+	`,
+	`
+	create table if not exists announcement_dismissals (
+		announcement_id integer not null references announcements (id) on delete cascade,
+		user_id integer not null references users (id) on delete cascade,
+		primary key (announcement_id, user_id)
+	);
+	`,
+	`
+	create table if not exists course_members (
+		course_id integer not null references courses (id) on delete cascade,
+		user_id integer not null references users (id) on delete cascade,
+		role text not null,
+		joined_at text not null,
+		primary key (course_id, user_id)
+	);
+	`,
+	`
+	create table if not exists question_templates (
+		id integer generated by default as identity primary key,
+		name text not null,
+		description text not null,
+		sections text not null,
+		require_code boolean not null default false,
+		user_id integer not null references users (id),
+		created_at text not null
+	);
+	`,
+	`
+	create table if not exists welcome_links (
+		token text not null primary key,
+		user_id integer not null references users (id) on delete cascade,
+		expires_at text not null
+	);
+	`,
+	`
+	create table if not exists lti_platforms (
+		id integer generated by default as identity primary key,
+		name text not null,
+		issuer text not null,
+		client_id text not null,
+		deployment_id text not null default '',
+		auth_url text not null,
+		keyset_url text not null,
+		created_at text not null,
+		unique (issuer, client_id)
+	);
+	`,
+	`
+	create table if not exists lti_states (
+		state text not null primary key,
+		nonce text not null,
+		platform_id integer not null references lti_platforms (id) on delete cascade,
+		created_at text not null
+	);
+	`,
+	`
+	create table if not exists lti_users (
+		platform_id integer not null references lti_platforms (id) on delete cascade,
+		subject text not null,
+		user_id integer not null references users (id) on delete cascade,
+		primary key (platform_id, subject)
+	);
+	`,
+	`
+	create table if not exists lti_contexts (
+		platform_id integer not null references lti_platforms (id) on delete cascade,
+		context_id text not null,
+		course_id integer not null references courses (id) on delete cascade,
+		primary key (platform_id, context_id)
+	);
+	`,
+	`
+	create table if not exists sso_states (
+		state text not null primary key,
+		nonce text not null,
+		verifier text not null,
+		next text not null,
+		created_at text not null
+	);
+	`,
+	`
+	create table if not exists sso_users (
+		subject text not null primary key,
+		user_id integer not null references users (id) on delete cascade
+	);
+	`,
+	`
+	create table if not exists invite_codes (
+		code text not null primary key,
+		label text not null,
+		created_by integer not null references users (id) on delete cascade,
+		max_uses integer not null,
+		uses integer not null,
+		expires_at text,
+		revoked boolean not null,
+		created_at text not null
+	);
+	`,
+	`
+	create table if not exists answers (
+		id integer generated by default as identity primary key,
+		body text,
+		date text,
+		time text,
+		"user" text,
+		views integer,
+		question_id integer references questions (id) on delete cascade,
+		edited_at text,
+		hidden_at text
+	);
+	`,
+	`
+	create table if not exists votes (
+		id integer generated by default as identity primary key,
+		user_id integer not null references users (id) on delete cascade,
+		post_type text not null,
+		post_id integer not null,
+		value integer not null,
+		voted_at text not null,
+		ip text,
+		unique (user_id, post_type, post_id)
+	);
+	`,
+	`
+	create table if not exists tag_pairs (
+		tag_id integer not null references tags (id) on delete cascade,
+		related_id integer not null references tags (id) on delete cascade,
+		questions integer not null,
+		primary key (tag_id, related_id)
+	);
+	`,
+	`
+	create table if not exists webhooks (
+		id integer generated by default as identity primary key,
+		url text not null,
+		secret text not null,
+		events text not null,
+		active boolean not null,
+		created_at text not null
+	);
+	`,
+	`
+	create table if not exists webhook_deliveries (
+		id integer generated by default as identity primary key,
+		webhook_id integer not null references webhooks (id) on delete cascade,
+		event text not null,
+		payload text not null,
+		status text not null,
+		attempts integer not null default 0,
+		response_code integer,
+		last_error text,
+		created_at text not null,
+		delivered_at text
+	);
+	`,
+	`
+	create table if not exists chat_channels (
+		id integer generated by default as identity primary key,
+		kind text not null,
+		url text not null,
+		tags text not null,
+		course_id integer references courses (id) on delete cascade,
+		user_id integer not null references users (id),
+		created_at text not null
+	);
+	`,
+	`
+	create table if not exists api_keys (
+		id integer generated by default as identity primary key,
+		user_id integer not null references users (id) on delete cascade,
+		name text not null,
+		selector text not null unique,
+		validator_hash text not null,
+		scope text not null,
+		quota integer not null,
+		created_at text not null,
+		last_used_at text,
+		revoked_at text
+	);
+	`,
+	`
+	create table if not exists question_merges (
+		question_id integer not null primary key,
+		target_id integer not null references questions (id) on delete cascade,
+		user_id integer not null,
+		merged_at text not null
+	);
+	`,
+	`
+	create table if not exists reviews (
+		id integer generated by default as identity primary key,
+		queue text not null,
+		post_type text not null,
+		post_id integer not null,
+		user_id integer not null references users (id) on delete cascade,
+		action text not null,
+		created_at text not null,
+		unique (queue, post_type, post_id, user_id)
+	);
+	`,
+	`
+	create table if not exists close_votes (
+		id integer generated by default as identity primary key,
+		question_id integer not null references questions (id) on delete cascade,
+		user_id integer not null references users (id) on delete cascade,
+		kind text not null,
+		reason text not null,
+		created_at text not null,
+		unique (question_id, user_id, kind)
+	);
+	`,
+	`
+	create table if not exists vote_fraud_reports (
+		id integer generated by default as identity primary key,
+		kind text not null,
+		voter_id integer references users (id) on delete set null,
+		ip text,
+		author text not null,
+		votes integer not null,
+		points integer not null,
+		first_at text not null,
+		last_at text not null,
+		created_at text not null,
+		resolved_at text,
+		resolved_by integer references users (id) on delete set null
+	);
+	`,
+	"create index if not exists mentions_user on mentions (user_id);",
+	"create index if not exists attachments_post on attachments (post_type, post_id);",
+	"create index if not exists audit_log_actor on audit_log (lower(actor));",
+	"create index if not exists signups_ip on signups (ip, created_at);",
+	"create index if not exists conversations_user_b on conversations (user_b);",
+	"create index if not exists messages_conversation on messages (conversation_id, id);",
+	"create index if not exists messages_sender on messages (sender_id, created_at);",
+	"create index if not exists announcements_expires on announcements (expires_at);",
+	"create index if not exists course_members_user on course_members (user_id);",
+	"create index if not exists questions_accepted_at on questions (accepted_at);",
+	"create index if not exists activity_user on activity (user_id, id);",
+	"create unique index if not exists tags_name on tags (name);",
+	"create index if not exists answers_date on answers (date);",
+	"create index if not exists answers_question on answers (question_id);",
+	"create index if not exists votes_voted_at on votes (voted_at);",
+	"create index if not exists questions_course on questions (course_id);",
+	"create index if not exists users_username on users (username);",
+	`create index if not exists answers_user on answers ("user");`,
+	"create index if not exists questions_hot on questions (hot_score);",
+	"create index if not exists question_views_day on question_views (day);",
+	"create index if not exists webhook_deliveries_webhook on webhook_deliveries (webhook_id);",
+	"create index if not exists api_keys_user on api_keys (user_id);",
+	"create index if not exists question_merges_target on question_merges (target_id);",
+	"create index if not exists reviews_post on reviews (post_type, post_id);",
+	"create index if not exists close_votes_created on close_votes (created_at);",
+	"create index if not exists question_tags_tag on question_tags (tag_id, question_id);",
+	"create index if not exists votes_post on votes (post_type, post_id, value);",
+	"create index if not exists notifications_user on notifications (user_id, id);",
+	"create index if not exists notifications_unread on notifications (user_id, id) where read_at is null;",
+	"create index if not exists comments_post on comments (post_type, post_id);",
+	"create index if not exists flags_post on flags (post_type, post_id);",
+	`create index if not exists questions_user on questions ("user");`,
+
+	// the full text index of the questions, kept by the triggers below. Deleting a question
+	// deletes its entry
+	`
+	create table if not exists questions_fts (
+		docid integer not null primary key references questions (id) on delete cascade,
+		heading text,
+		body text,
+		document tsvector generated always as (setweight(to_tsvector('english', coalesce(heading, '')), 'A') ||
+			setweight(to_tsvector('english', coalesce(body, '')), 'B')) stored
+	);
+	`,
+	"create index if not exists questions_fts_document on questions_fts using gin (document);",
+	`
+	create or replace function questions_fts_index() returns trigger as $$
+	begin
+		insert into questions_fts (docid, heading, body) values (new.id, new.heading, new.body)
+			on conflict (docid) do update set heading = excluded.heading, body = excluded.body;
+		return null;
+	end
+	$$ language plpgsql;
+	`,
+	`
+	create or replace trigger questions_fts_after_insert after insert on questions
+		for each row execute function questions_fts_index();
+	`,
+	`
+	create or replace trigger questions_fts_after_update after update of heading, body on questions
+		for each row execute function questions_fts_index();
+	`,
+	// the pairs of tags on the same questions, counted as the tags of the questions change
+	`
+	create or replace function tag_pairs_count() returns trigger as $$
+	declare
+		kept integer; -- the tag of the row after an update, which isn't paired with the one before
+	begin
+		if tg_op in ('UPDATE', 'DELETE') then
+			if tg_op = 'UPDATE' then
+				kept := new.tag_id;
+			end if;
+			update tag_pairs set questions = questions - 1
+				where tag_id = old.tag_id and related_id in (select tag_id from question_tags where question_id = old.question_id and tag_id is distinct from kept);
+			update tag_pairs set questions = questions - 1
+				where tag_id in (select tag_id from question_tags where question_id = old.question_id and tag_id is distinct from kept) and related_id = old.tag_id;
+			delete from tag_pairs where questions <= 0 and (tag_id = old.tag_id or related_id = old.tag_id);
+		end if;
+		if tg_op in ('INSERT', 'UPDATE') then
+			insert into tag_pairs (tag_id, related_id, questions)
+				select new.tag_id, tag_id, 1 from question_tags where question_id = new.question_id and tag_id != new.tag_id
+				union all select tag_id, new.tag_id, 1 from question_tags where question_id = new.question_id and tag_id != new.tag_id
+				on conflict (tag_id, related_id) do update set questions = tag_pairs.questions + 1;
+		end if;
+		return null;
+	end
+	$$ language plpgsql;
+	`,
+	`
+	create or replace trigger tag_pairs_count after insert or delete or update of tag_id on question_tags
+		for each row execute function tag_pairs_count();
+	`,
+	`
+	create or replace function audit_log_append_only() returns trigger as $$
+	begin
+		raise exception 'the audit log is append-only';
+	end
+	$$ language plpgsql;
+	`,
+	`
+	create or replace trigger audit_log_no_change before update or delete on audit_log
+		for each row execute function audit_log_append_only();
+	`,
+	// wilson(up, down) ranks by votes, see wilsonScore
+	`
+	create or replace function wilson(up bigint, down bigint) returns double precision as $$
+		select case when n = 0 then 0 else (p + 1.96 * 1.96 / (2 * n) - 1.96 * sqrt((p * (1 - p) + 1.96 * 1.96 / (4 * n)) / n)) / (1 + 1.96 * 1.96 / n) end
+		from (select cast(up + down as double precision) as n, cast(up as double precision) / greatest(up + down, 1) as p) as counts
+	$$ language sql immutable;
+	`,
+	"create table if not exists schema_version (version integer not null);",
+	fmt.Sprintf("insert into schema_version (version) select %d where not exists (select 1 from schema_version);", schemaBaseline),
+}
+
+// postgresMigrations are the postgres versions of the migrations after schemaBaseline, by version
+var postgresMigrations = map[int]string{}
+
+// the tables of postgresSchema, for the rewrites
+var postgresTables = parseSchemaTables(postgresSchema, "identity")
+
+// postgresBackend is a postgres database
+type postgresBackend struct {
+	tables map[string]*schemaTable
+}
+
+func (postgresBackend) name() string {
+	return "postgres"
+}
+
+func (postgresBackend) schema() []string {
+	return postgresSchema
+}
+
+func (postgresBackend) migration(version int) (string, error) {
+	if version < schemaBaseline {
+		return "", fmt.Errorf("the postgres schema starts at version %d, the database is at version %d", schemaBaseline, version)
+	}
+	m, ok := postgresMigrations[version]
+	if !ok {
+		return "", fmt.Errorf("migration %d has no postgres version", version)
+	}
+	return m, nil
+}
+
+func (postgresBackend) version(ctx context.Context, q querier) (int, error) {
+	var exists bool
+	if err := q.QueryRowContext(ctx, "select to_regclass('schema_version') is not null").Scan(&exists); err != nil || !exists {
+		return 0, err
+	}
+	var version int
+	err := q.QueryRowContext(ctx, "select version from schema_version").Scan(&version)
+	return version, err
+}
+
+func (postgresBackend) setVersion(ctx context.Context, q querier, version int) error {
+	_, err := q.ExecContext(ctx, "update schema_version set version = $1", version)
+	return err
+}
+
+// explain returns the lines of EXPLAIN, indented by postgres
+func (postgresBackend) explain(ctx context.Context, q querier, query string, args []interface{}) ([]string, error) {
+	rows, err := q.QueryContext(ctx, "explain "+query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var plan []string
+	for rows.Next() {
+		var line string
+		if err := rows.Scan(&line); err != nil {
+			return plan, err
+		}
+		plan = append(plan, line)
+	}
+	return plan, rows.Err()
+}
+
+func (postgresBackend) transactionalDDL() bool {
+	return true
+}
+
+// optimizeSearch is empty: autovacuum keeps the index
+func (postgresBackend) optimizeSearch() string {
+	return ""
+}
+
+// backup is empty, postgres is backed up with pg_dump
+func (postgresBackend) backup() string {
+	return ""
+}
+
+// rewrite translates a query of the app to postgres
+func (b postgresBackend) rewrite(query string) rewrittenQuery {
+	ts := aliasDerivedTables(quoteNames(tokenizeSQL(query)))
+	ts = rewriteCalls(ts, postgresCall(ts))
+	ts = postgresOperators(ts)
+	returning := false
+	switch ts.statementKind() {
+	case "insert":
+		ts, returning = b.insert(ts)
+	case "update":
+		ts = b.updateOrIgnore(ts)
+	}
+	text, params := bindParams(ts, func(n int) string { return "$" + strconv.Itoa(n) })
+	return rewrittenQuery{query: text, params: params, returning: returning}
+}
+
+// postgresCall rewrites the calls of the functions of sqlite postgres doesn't have, in a query
+// of which ts are the tokens
+func postgresCall(ts sqlTokens) func(name string, args []sqlTokens) sqlTokens {
+	return func(name string, args []sqlTokens) sqlTokens {
+		switch {
+		case name == "group_concat":
+			x, distinct := args[0].trim(), sqlTokens{}
+			if x.is(0, "distinct") {
+				x, distinct = x[1:], sqlText("distinct ")
+			}
+			sep := sqlText("','")
+			if len(args) > 1 {
+				sep = args[1]
+			}
+			return concatSQL(sqlText("string_agg("), distinct, sqlText("cast("), x, sqlText(" as text), "), sep, sqlText(")"))
+		case name == "instr":
+			return concatSQL(sqlText("strpos("), joinSQL(args, ","), sqlText(")"))
+		case (name == "max" || name == "min") && len(args) > 1:
+			// the scalar max and min of sqlite
+			f := map[string]string{"max": "greatest(", "min": "least("}[name]
+			return concatSQL(sqlText(f), joinSQL(args, ","), sqlText(")"))
+		case name == "julianday":
+			return concatSQL(sqlText("(extract(epoch from cast("), args[0], sqlText(" as timestamp)) / 86400)"))
+		case name == "sum" && isCondition(args[0]):
+			// sqlite counts a true condition as 1
+			return concatSQL(sqlText("sum(case when "), args[0], sqlText(" then 1 else 0 end)"))
+		case name == "snippet" && len(args) == 6:
+			// the heading and body of the question matching the query of the match of the
+			// query, between the start and end marks, in about as many words
+			match := postgresMatchParam(ts)
+			if match.kind != tokenParam {
+				return nil
+			}
+			return concatSQL(sqlText("ts_headline('english', coalesce(questions_fts.body, ''), to_tsquery('english', "), sqlTokens{match},
+				sqlText(`), 'StartSel="' || `), args[1], sqlText(` || '", StopSel="' || `), args[2],
+				sqlText(` || '", MaxWords=' || `), args[5], sqlText(" || ', MinWords=' || (cast("), args[5], sqlText(" as integer) / 2))"))
+		}
+		return nil
+	}
+}
+
+// postgresMatchParam returns the placeholder of the full-text query a query matches, as a
+// placeholder converting it to a tsquery
+func postgresMatchParam(ts sqlTokens) sqlToken {
+	for i := range ts {
+		if p := ts.next(i); ts.is(i, "match") && p < len(ts) && ts[p].kind == tokenParam {
+			return param(ts[p].arg, postgresFTSQuery)
+		}
+	}
+	return sqlToken{}
+}
+
+// postgresOperators rewrites the operators of sqlite: like, which ignores case, glob, the full
+// text match, and cross joins on a condition
+func postgresOperators(ts sqlTokens) sqlTokens {
+	var out sqlTokens
+	for i := 0; i < len(ts); i++ {
+		switch next := ts.next(i); {
+		case ts.is(i, "like"):
+			out = append(out, sqlText("ilike")...)
+		case ts.is(i, "glob") && next < len(ts) && ts[next].kind == tokenParam:
+			out = append(out, sqlText("like ")...)
+			out = append(out, param(ts[next].arg, globToLike))
+			i = next
+		case ts.is(i, "match") && next < len(ts) && ts[next].kind == tokenParam && len(out) > 0 && out.name(out.prev(len(out))) == "questions_fts":
+			out = append(out[:out.prev(len(out))], sqlText("questions_fts.document @@ to_tsquery('english', ")...)
+			out = append(out, param(ts[next].arg, postgresFTSQuery))
+			out = append(out, sqlText(")")...)
+			i = next
+		case ts.is(i, "cross") && ts.is(next, "join") && ts.is(ts.find(next+1, "on", "join", "where", "group", "order", "limit", "union"), "on"):
+			i = next - 1
+		default:
+			out = append(out, ts[i])
+		}
+	}
+	return out
+}
+
+// postgresFTSQuery converts a full-text query in the syntax of fts4 to a tsquery
+func postgresFTSQuery(arg interface{}) interface{} {
+	query, ok := arg.(string)
+	if !ok {
+		return arg
+	}
+	var groups []string
+	for _, group := range ftsGroups(parseFTSQuery(query)) {
+		var alternatives []string
+		for _, t := range group {
+			words := make([]string, len(t.words))
+			for i, w := range t.words {
+				words[i] = w
+				if t.prefix && i == len(t.words)-1 {
+					words[i] += ":*"
+				} else if t.heading {
+					words[i] += ":"
+				}
+				if t.heading {
+					words[i] += "A"
+				}
+			}
+			alternatives = append(alternatives, strings.Join(words, " <-> "))
+		}
+		if len(alternatives) > 1 {
+			groups = append(groups, "("+strings.Join(alternatives, " | ")+")")
+		} else {
+			groups = append(groups, alternatives[0])
+		}
+	}
+	return strings.Join(groups, " & ")
+}
+
+// insert rewrites the conflict clause of an insert and makes inserts into a table whose ids the
+// database makes return them. It tells whether the insert returns the ids
+func (b postgresBackend) insert(ts sqlTokens) (sqlTokens, bool) {
+	verb, after, action := ts.orConflict()
+	into := ts.next(after - 1)
+	table := ts.next(into)
+	name := ts.name(table)
+	var columns []string
+	if open := ts.next(table); ts.symbol(open, "(") {
+		columns = ts.names(open)
+	}
+	end := ts.prev(len(ts)) + 1
+	if ts.symbol(end-1, ";") {
+		end--
+	}
+	body := ts[:end]
+	switch action {
+	case "ignore":
+		body = concatSQL(body.splice(verb+1, after, nil), sqlText(" on conflict do nothing"))
+	case "replace":
+		body = body.splice(verb+1, after, nil)
+		if conflict := b.replaceClause(name, columns); conflict != nil {
+			body = concatSQL(body, conflict)
+		}
+	}
+	t := b.tables[name]
+	if t == nil || !t.identity {
+		return body, false
+	}
+	body = concatSQL(body, sqlText(" returning id"))
+	for _, c := range columns {
+		if c == "id" {
+			// the sequence of the ids goes past the id given, for the next rows
+			seq := fmt.Sprintf("pg_get_serial_sequence('%s', 'id')", name)
+			return concatSQL(sqlText("with inserted as ("), body, sqlText(fmt.Sprintf(
+				") select inserted.id from inserted where setval(%s, greatest(inserted.id, nextval(%s) - 1)) is not null", seq, seq))), true
+		}
+	}
+	return body, true
+}
+
+// replaceClause is the conflict clause doing what insert or replace does in sqlite, on the
+// first key of the table the insert gives all the columns of: the row gets the columns inserted,
+// and the others are reset to their default
+func (b postgresBackend) replaceClause(table string, columns []string) sqlTokens {
+	t := b.tables[table]
+	if t == nil {
+		return nil
+	}
+	listed := map[string]bool{}
+	for _, c := range columns {
+		listed[c] = true
+	}
+	for _, key := range t.keys {
+		complete := true
+		for _, c := range key {
+			complete = complete && listed[c]
+		}
+		if !complete {
+			continue
+		}
+		inKey := map[string]bool{}
+		for _, c := range key {
+			inKey[c] = true
+		}
+		var sets []string
+		for _, c := range t.columns {
+			switch {
+			case inKey[c] || c == "id" && t.identity:
+			case listed[c]:
+				sets = append(sets, fmt.Sprintf(`"%s" = excluded."%s"`, c, c))
+			default:
+				sets = append(sets, fmt.Sprintf(`"%s" = default`, c))
+			}
+		}
+		if len(sets) == 0 {
+			return sqlText(fmt.Sprintf(` on conflict ("%s") do nothing`, strings.Join(key, `", "`)))
+		}
+		return sqlText(fmt.Sprintf(` on conflict ("%s") do update set %s`, strings.Join(key, `", "`), strings.Join(sets, ", ")))
+	}
+	return nil
+}
+
+// updateOrIgnore rewrites update or ignore, which skips the rows the update would make collide
+// with another on a key, to an update of the rows for which no other row has the key they would
+// get
+func (b postgresBackend) updateOrIgnore(ts sqlTokens) sqlTokens {
+	verb, after, action := ts.orConflict()
+	if action != "ignore" {
+		return ts
+	}
+	table := ts.next(after - 1)
+	name := ts.name(table)
+	set := ts.next(table)
+	where := ts.find(set, "where", "returning")
+	assigned := map[string]sqlTokens{}
+	for _, a := range ts[set+1 : where].split() {
+		a = a.trim()
+		assigned[a.name(0)] = a[a.next(a.next(0)):]
+	}
+	var conds []sqlTokens
+	for _, key := range b.tables[name].keysOf(assigned) {
+		var eqs []sqlTokens
+		for _, c := range key {
+			value, ok := assigned[c]
+			if !ok {
+				value = sqlText(fmt.Sprintf(`%s."%s"`, name, c))
+			}
+			eqs = append(eqs, concatSQL(sqlText(fmt.Sprintf(`ignored."%s" = (`, c)), value, sqlText(")")))
+		}
+		conds = append(conds, concatSQL(sqlText(fmt.Sprintf("not exists (select 1 from %s as ignored where ", name)),
+			joinSQL(eqs, " and "), sqlText(fmt.Sprintf(" and ignored.ctid != %s.ctid)", name))))
+	}
+	out := ts[:where].splice(verb+1, after, nil)
+	if len(conds) == 0 {
+		return concatSQL(out, ts[where:])
+	}
+	if where == len(ts) || !ts.is(where, "where") {
+		return concatSQL(out, sqlText(" where "), joinSQL(conds, " and "), ts[where:])
+	}
+	end := ts.find(where+1, "returning")
+	return concatSQL(out, sqlText("where ("), ts[where+1:end].trim(), sqlText(") and "), joinSQL(conds, " and "), ts[end:])
+}
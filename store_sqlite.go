@@ -0,0 +1,125 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+	"sync/atomic"
+
+	"github.com/mattn/go-sqlite3"
+)
+
+// sqlite is the default backend, the one the queries of the app are written for. Its schema
+// is the first one of the app, see schema in code.go, brought up to date by the migrations, and
+// its version is the user_version pragma
+
+func init() {
+	// the sqlite driver with the functions of the site, like wilson(up, down) which ranks by votes
+	sql.Register("sqlite3_qa", &sqlite3.SQLiteDriver{
+		ConnectHook: func(conn *sqlite3.SQLiteConn) error {
+			return conn.RegisterFunc("wilson", wilsonScore, true)
+		},
+	})
+}
+
+// in-memory databases opened so far, to name the next one
+var memoryDatabases int64
+
+// openSqlite opens the sqlite database of the URL
+func openSqlite(u *url.URL) (*sql.DB, backend, error) {
+	// a relative path is opaque, like sqlite3:qa.db; an absolute one is the path of sqlite3:///qa.db
+	path := u.Opaque
+	if path == "" {
+		path = u.Host + u.Path
+	}
+	if path == "" {
+		return nil, nil, errors.New("DATABASE_URL: the sqlite database has no file name")
+	}
+	// wait for locks instead of failing, as the job worker writes concurrently with the handlers.
+	// sqlite only enforces foreign keys when asked to, on each connection
+	params := u.Query()
+	if params.Get("_busy_timeout") == "" {
+		params.Set("_busy_timeout", "5000")
+	}
+	params.Set("_foreign_keys", "1")
+	if path == ":memory:" {
+		// each connection would have a database of its own, they share a named one instead.
+		// it lasts while the store is open, like for a test
+		path = fmt.Sprintf("file:qaapp-memory-%d", atomic.AddInt64(&memoryDatabases, 1))
+		params.Set("mode", "memory")
+		params.Set("cache", "shared")
+	}
+	conn, err := sql.Open("sqlite3_qa", path+"?"+params.Encode())
+	if err != nil {
+		return nil, nil, err
+	}
+	return conn, sqliteBackend{}, nil
+}
+
+// sqliteBackend is the sqlite database
+type sqliteBackend struct{}
+
+func (sqliteBackend) name() string {
+	return "sqlite"
+}
+
+// rewrite keeps the query, written for sqlite
+func (sqliteBackend) rewrite(query string) rewrittenQuery {
+	return rewrittenQuery{query: query}
+}
+
+func (sqliteBackend) schema() []string {
+	return schema
+}
+
+func (sqliteBackend) migration(version int) (string, error) {
+	return migrations[version], nil
+}
+
+func (sqliteBackend) version(ctx context.Context, q querier) (int, error) {
+	var version int
+	err := q.QueryRowContext(ctx, "pragma user_version").Scan(&version)
+	return version, err
+}
+
+func (sqliteBackend) setVersion(ctx context.Context, q querier, version int) error {
+	// pragmas can't take arguments
+	_, err := q.ExecContext(ctx, fmt.Sprintf("pragma user_version = %d", version))
+	return err
+}
+
+// explain returns the steps of EXPLAIN QUERY PLAN, indented under their parent
+func (sqliteBackend) explain(ctx context.Context, q querier, query string, args []interface{}) ([]string, error) {
+	rows, err := q.QueryContext(ctx, "explain query plan "+query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var plan []string
+	depth := map[int]int{}
+	for rows.Next() {
+		var id, parent, unused int
+		var detail string
+		if err := rows.Scan(&id, &parent, &unused, &detail); err != nil {
+			return plan, err
+		}
+		depth[id] = depth[parent] + 1
+		plan = append(plan, strings.Repeat("  ", depth[id]-1)+detail)
+	}
+	return plan, rows.Err()
+}
+
+func (sqliteBackend) transactionalDDL() bool {
+	return true
+}
+
+func (sqliteBackend) optimizeSearch() string {
+	return "insert into questions_fts (questions_fts) values ('optimize')"
+}
+
+func (sqliteBackend) backup() string {
+	return "vacuum into ?"
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// what can be followed, as stored in subscriptions.target_type
+const (
+	followQuestion = "question"
+	followTag      = "tag"
+)
+
+// follow subscribes the user to a question or a tag. With email, notifications are also emailed
+func follow(ctx context.Context, userID int, targetType, target string, email bool) error {
+	_, err := db.ExecContext(ctx, "insert or replace into subscriptions (user_id, target_type, target, email, created_at) values (?, ?, ?, ?, ?)",
+		userID, targetType, target, email, time.Now().Format(timestampLayout))
+	return err
+}
+
+// autoFollow subscribes the user without emails, unless they already follow the target
+func autoFollow(ctx context.Context, userID int, targetType, target string) error {
+	_, err := db.ExecContext(ctx, "insert or ignore into subscriptions (user_id, target_type, target, email, created_at) values (?, ?, ?, false, ?)",
+		userID, targetType, target, time.Now().Format(timestampLayout))
+	return err
+}
+
+// unfollow removes the subscription of the user to a question or a tag
+func unfollow(ctx context.Context, userID int, targetType, target string) error {
+	_, err := db.ExecContext(ctx, "delete from subscriptions where user_id = ? and target_type = ? and target = ?", userID, targetType, target)
+	return err
+}
+
+// following tells if the user follows a question or a tag
+func following(ctx context.Context, user *User, targetType, target string) (bool, error) {
+	if user == nil {
+		return false, nil
+	}
+	var n int
+	err := db.QueryRowContext(ctx, "select count(*) from subscriptions where user_id = ? and target_type = ? and target = ?",
+		user.UniqueID, targetType, target).Scan(&n)
+	return n > 0, err
+}
+
+// subscriber is a user to notify about some activity
+type subscriber struct {
+	userID int
+	email  string // empty unless the user wants emails and has an address
+}
+
+// subscribers finds the users following any of the targets, except the one causing the activity,
+// and with skipMuters those who muted them
+func subscribers(ctx context.Context, targetType string, targets []string, except int, skipMuters bool) ([]subscriber, error) {
+	if len(targets) == 0 {
+		return nil, nil
+	}
+	args := []interface{}{targetType}
+	for _, t := range targets {
+		args = append(args, t)
+	}
+	args = append(args, except, skipMuters, except)
+	rows, err := db.QueryContext(ctx, `select subscriptions.user_id, case when max(cast(subscriptions.email as integer)) = 1 then coalesce(users.email, '') else '' end
+		from subscriptions join users on users.id = subscriptions.user_id
+		where target_type = ? and target in (?`+strings.Repeat(", ?", len(targets)-1)+`) and subscriptions.user_id != ?
+		and not (? and subscriptions.user_id in (select user_id from user_mutes where muted_id = ?))
+		group by subscriptions.user_id, users.email`, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var subs []subscriber
+	for rows.Next() {
+		var s subscriber
+		if err := rows.Scan(&s.userID, &s.email); err != nil {
+			return nil, err
+		}
+		subs = append(subs, s)
+	}
+	return subs, rows.Err()
+}
+
+// notifySubscribers sends a notification to every subscriber, and an email to those who asked for it
+func notifySubscribers(ctx context.Context, subs []subscriber, message, link, base string) error {
+	for _, s := range subs {
+		if err := notify(ctx, s.userID, message, link); err != nil {
+			return err
+		}
+		if s.email != "" {
+			if err := sendOrHoldEmail(ctx, s.userID, s.email, message, message+"\n\n"+base+link+"\n"); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// notifyNewQuestion tells the followers of the tags of a new question about it, without the name of an anonymous author
+func notifyNewQuestion(ctx context.Context, r *http.Request, author *User, anonymous bool, questionID int, heading string, tags []string) error {
+	for i, t := range tags {
+		tags[i] = strings.ToLower(t)
+	}
+	// muting the author of an anonymous question can't leave anyone out, that would tell who asked it
+	subs, err := subscribers(ctx, followTag, tags, author.UniqueID, !anonymous)
+	if err != nil {
+		return err
+	}
+	// a question of a course only reaches its members
+	var courseID sql.NullInt64
+	if err := db.QueryRowContext(ctx, "select course_id from questions where id = ?", questionID).Scan(&courseID); err != nil {
+		return err
+	}
+	if courseID.Valid {
+		members, err := courseMembers(ctx, int(courseID.Int64))
+		if err != nil {
+			return err
+		}
+		kept := subs[:0]
+		for _, s := range subs {
+			if members[s.userID] {
+				kept = append(kept, s)
+			}
+		}
+		subs = kept
+	}
+	message := fmt.Sprintf("New question by %s in %s: %s", authorName(author, anonymous), strings.Join(tags, ", "), heading)
+	return notifySubscribers(ctx, subs, message, fmt.Sprintf("/questions/%d", questionID), baseURL(r))
+}
+
+// notifyNewAnswer tells the followers of a question about a new answer to it
+func notifyNewAnswer(ctx context.Context, r *http.Request, author *User, questionID, answerID int, heading string) error {
+	subs, err := subscribers(ctx, followQuestion, []string{strconv.Itoa(questionID)}, author.UniqueID, true)
+	if err != nil {
+		return err
+	}
+	message := fmt.Sprintf("%s answered %s", author.UserName, heading)
+	return notifySubscribers(ctx, subs, message, fmt.Sprintf("/questions/%d#answer-%d", questionID, answerID), baseURL(r))
+}
+
+// handle a follow button: follows the target, or unfollows it when the form says so.
+// back is where the user is sent afterwards
+func serveFollow(w http.ResponseWriter, r *http.Request, targetType, target, back string) {
+	ctx := r.Context()
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	user := requireUser(w, r)
+	if user == nil {
+		return
+	}
+	var err error
+	if r.FormValue("action") == "unfollow" {
+		err = unfollow(ctx, user.UniqueID, targetType, target)
+	} else {
+		err = follow(ctx, user.UniqueID, targetType, target, r.FormValue("email") == "1")
+	}
+	if err != nil {
+		serverError(w, r, err)
+		return
+	}
+	// followed tags weigh in the For you tab
+	forgetFeed(user.UniqueID)
+	http.Redirect(w, r, back, http.StatusSeeOther)
+}
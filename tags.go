@@ -0,0 +1,109 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// tagPage is the data of the page of a tag
+type tagPage struct {
+	Name      string
+	Following bool
+	Followers int
+	Questions []Question
+	Wiki      tagWiki
+	CanEdit   bool // the user may edit the wiki of the tag
+	// students may ask anonymously in the tag, set by teachers and moderators
+	AllowAnonymous  bool
+	CanSetAnonymous bool
+	Announcements   []announcement // pinned on top of the page
+	// after the deadline the threads of the tag are read-only for students, set by teachers and moderators
+	Deadline       *deadline
+	CanSetDeadline bool
+	Related        []relatedTag // most often on questions with the tag, see relatedtags.go
+}
+
+// serve /tags/{name}, /tags/{name}/feed.xml, /tags/{name}/follow, /tags/{name}/edit, /tags/{name}/anonymous
+// and /tags/{name}/deadline
+func serveTag(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	name, action, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/tags/"), "/")
+	name = strings.ToLower(name)
+	if name == "" {
+		http.NotFound(w, r)
+		return
+	}
+	switch action {
+	case "":
+	case "feed.xml":
+		feedLimiter.wrap(serveTagFeed)(w, r)
+		return
+	case "follow":
+		serveFollow(w, r, followTag, name, "/tags/"+url.PathEscape(name))
+		return
+	case "edit":
+		serveTagEdit(w, r, name)
+		return
+	case "anonymous":
+		serveTagAnonymous(w, r, name)
+		return
+	case "deadline":
+		serveDeadline(w, r, 0, name)
+		return
+	default:
+		http.NotFound(w, r)
+		return
+	}
+
+	canonical, err := canonicalTag(ctx, name)
+	if err != nil {
+		serverError(w, r, err)
+		return
+	}
+	if canonical != name {
+		http.Redirect(w, r, "/tags/"+url.PathEscape(canonical), http.StatusMovedPermanently)
+		return
+	}
+	p := tagPage{Name: name}
+	if p.Questions, err = newestQuestions(ctx, currentUser(r), name, questionsPerPage); err != nil {
+		serverError(w, r, err)
+		return
+	}
+	if p.Following, err = following(ctx, currentUser(r), followTag, name); err != nil {
+		serverError(w, r, err)
+		return
+	}
+	err = db.QueryRowContext(ctx, "select count(*) from subscriptions where target_type = ? and target = ?", followTag, name).Scan(&p.Followers)
+	if err != nil {
+		serverError(w, r, err)
+		return
+	}
+	if p.Wiki, err = cachedTagWiki(ctx, name); err != nil {
+		serverError(w, r, err)
+		return
+	}
+	if p.CanEdit, err = canEditTagWiki(ctx, currentUser(r)); err != nil {
+		serverError(w, r, err)
+		return
+	}
+	if p.AllowAnonymous, err = tagAllowsAnonymous(ctx, name); err != nil {
+		serverError(w, r, err)
+		return
+	}
+	if p.Announcements, err = activeAnnouncements(ctx, currentUser(r), name); err != nil {
+		serverError(w, r, err)
+		return
+	}
+	if p.Deadline, err = tagDeadline(ctx, name); err != nil {
+		serverError(w, r, err)
+		return
+	}
+	if p.Related, err = cachedRelatedTags(ctx, name); err != nil {
+		serverError(w, r, err)
+		return
+	}
+	p.CanSetAnonymous = seesAnonymousAuthors(currentUser(r))
+	p.CanSetDeadline = staff(currentUser(r))
+	render(w, r, "tag.html", p)
+}
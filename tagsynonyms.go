@@ -0,0 +1,397 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"net/http"
+	"strings"
+)
+
+// moderators declare synonyms of tags, like golang for go. Tagging a question with a synonym
+// tags it with the canonical tag instead. Merging a tag into another rewrites the questions
+// and the follows of the first, and keeps it as a synonym. Renaming a tag keeps its wiki and
+// settings under the new name, the old one becoming a synonym. Each change runs in one transaction
+// with its audit entry, and moderators preview the questions they retag first
+
+var errSameTag = errors.New("a tag can't be a synonym of itself")
+
+// tagSynonym maps a tag onto its canonical tag
+type tagSynonym struct {
+	Synonym string
+	Tag     string
+}
+
+// canonicalTag returns the tag a synonym stands for, or the tag itself
+func canonicalTag(ctx context.Context, tag string) (string, error) {
+	var canonical string
+	err := db.QueryRowContext(ctx, "select tag from tag_synonyms where synonym = ?", strings.ToLower(tag)).Scan(&canonical)
+	if err == sql.ErrNoRows {
+		return tag, nil
+	}
+	return canonical, err
+}
+
+// cleanTags splits a comma separated list of tags, replacing synonyms and dropping duplicates
+func cleanTags(ctx context.Context, s string) (string, error) {
+	var tags []string
+	seen := map[string]bool{}
+	for _, t := range splitTags(s) {
+		t, err := canonicalTag(ctx, t)
+		if err != nil {
+			return "", err
+		}
+		if !seen[strings.ToLower(t)] {
+			seen[strings.ToLower(t)] = true
+			tags = append(tags, t)
+		}
+	}
+	return strings.Join(tags, ", "), nil
+}
+
+// tagSynonyms loads the synonyms, by canonical tag
+func tagSynonyms(ctx context.Context) ([]tagSynonym, error) {
+	rows, err := db.QueryContext(ctx, "select synonym, tag from tag_synonyms order by tag, synonym")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var synonyms []tagSynonym
+	for rows.Next() {
+		var s tagSynonym
+		if err := rows.Scan(&s.Synonym, &s.Tag); err != nil {
+			return nil, err
+		}
+		synonyms = append(synonyms, s)
+	}
+	return synonyms, rows.Err()
+}
+
+// addTagSynonym makes synonym stand for tag. Synonyms don't chain: when tag is itself a synonym,
+// its canonical tag is used, and the synonyms of synonym now stand for tag too
+func addTagSynonym(ctx context.Context, synonym, tag string) error {
+	synonym, tag = strings.ToLower(synonym), strings.ToLower(tag)
+	var canonical string
+	err := db.QueryRowContext(ctx, "select tag from tag_synonyms where synonym = ?", tag).Scan(&canonical)
+	if err == nil {
+		tag = canonical
+	} else if err != sql.ErrNoRows {
+		return err
+	}
+	if synonym == tag {
+		return errSameTag
+	}
+	if _, err := db.ExecContext(ctx, "insert or replace into tag_synonyms (synonym, tag) values (?, ?)", synonym, tag); err != nil {
+		return err
+	}
+	_, err = db.ExecContext(ctx, "update tag_synonyms set tag = ? where tag = ?", tag, synonym)
+	return err
+}
+
+// declareTagSynonym makes synonym stand for tag on the questions tagged from now on
+func declareTagSynonym(ctx context.Context, synonym, tag string) error {
+	return db.WithTx(ctx, func(ctx context.Context) error {
+		return addTagSynonym(ctx, synonym, tag)
+	})
+}
+
+// retagReferences replaces the tag from with into where tags are kept by name: the comma separated
+// lists of the exams, the chat channels and the interests of the users, the follows of the tag and
+// the announcements pinned on it. Users who followed both keep their follow of into
+func retagReferences(ctx context.Context, from, into string) error {
+	lists := []struct{ table, column string }{{"exam_windows", "tags"}, {"chat_channels", "tags"}, {"users", "user_tags"}}
+	for _, l := range lists {
+		if err := retagList(ctx, l.table, l.column, from, into); err != nil {
+			return err
+		}
+	}
+	statements := []struct {
+		query string
+		args  []interface{}
+	}{
+		{"update or ignore subscriptions set target = ? where target_type = ? and target = ?", []interface{}{into, followTag, from}},
+		{"delete from subscriptions where target_type = ? and target = ?", []interface{}{followTag, from}},
+		{"update announcements set tag = ? where lower(tag) = ?", []interface{}{into, from}},
+	}
+	for _, st := range statements {
+		if _, err := db.ExecContext(ctx, st.query, st.args...); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// retagList replaces the tag from with into in a column holding comma separated tags, keeping its
+// place among the tags and dropping the duplicate when the list already had into
+func retagList(ctx context.Context, table, column, from, into string) error {
+	rows, err := db.QueryContext(ctx, "select id, "+column+" from "+table+" where ',' || replace(lower("+column+`), ' ', '') || ',' like ? escape '\'`, tagPattern(from))
+	if err != nil {
+		return err
+	}
+	retagged := map[int]string{}
+	for rows.Next() {
+		var id int
+		var tags string
+		if err := rows.Scan(&id, &tags); err != nil {
+			rows.Close()
+			return err
+		}
+		var kept []string
+		seen := map[string]bool{}
+		for _, t := range splitTags(tags) {
+			if strings.EqualFold(t, from) {
+				t = into
+			}
+			if !seen[strings.ToLower(t)] {
+				seen[strings.ToLower(t)] = true
+				kept = append(kept, t)
+			}
+		}
+		retagged[id] = strings.Join(kept, ", ")
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	for id, tags := range retagged {
+		if _, err := db.ExecContext(ctx, "update "+table+" set "+column+" = ? where id = ?", tags, id); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// taggedCount is the number of questions tagged with the tag
+func taggedCount(ctx context.Context, tag string) (int, error) {
+	var n int
+	err := db.QueryRowContext(ctx, "select count(*) from question_tags where tag_id = (select id from tags where name = ?)", strings.ToLower(tag)).Scan(&n)
+	return n, err
+}
+
+// mergeTags replaces the tag from with into on every question, moves its followers and exams to into,
+// and keeps from as a synonym of into. It returns the number of questions retagged
+func mergeTags(ctx context.Context, from, into string) (int, error) {
+	from, into = strings.ToLower(from), strings.ToLower(into)
+	var n int
+	err := db.WithTx(ctx, func(ctx context.Context) error {
+		if err := addTagSynonym(ctx, from, into); err != nil {
+			return err
+		}
+		// into may have been a synonym itself
+		if err := db.QueryRowContext(ctx, "select tag from tag_synonyms where synonym = ?", from).Scan(&into); err != nil {
+			return err
+		}
+		// questions tagged from are tagged into instead, keeping their place among the tags;
+		// those that already had both keep into
+		var err error
+		if n, err = taggedCount(ctx, from); err != nil {
+			return err
+		}
+		if _, err := db.ExecContext(ctx, "insert or ignore into tags (name, desc) values (?, '')", into); err != nil {
+			return err
+		}
+		_, err = db.ExecContext(ctx, `update or ignore question_tags set tag_id = (select id from tags where name = ?)
+			where tag_id = (select id from tags where name = ?)`, into, from)
+		if err != nil {
+			return err
+		}
+		if _, err := db.ExecContext(ctx, "delete from question_tags where tag_id = (select id from tags where name = ?)", from); err != nil {
+			return err
+		}
+		return retagReferences(ctx, from, into)
+	})
+	return n, err
+}
+
+var (
+	errNoTag        = errors.New("there is no such tag")
+	errRenameExists = errors.New("a tag with the new name exists, merge into it instead")
+	errRenameTaken  = errors.New("the new name is a synonym of another tag, remove the synonym first")
+)
+
+// renameTag gives the tag from the name to, with its questions, wiki, revisions, settings and
+// followers, and keeps from as a synonym of to. It returns the number of questions of the tag
+func renameTag(ctx context.Context, from, to string) (int, error) {
+	from, to = strings.ToLower(from), strings.ToLower(to)
+	if from == to {
+		return 0, errSameTag
+	}
+	var n int
+	err := db.WithTx(ctx, func(ctx context.Context) error {
+		var exists int
+		if err := db.QueryRowContext(ctx, "select count(*) from tags where name = ?", from).Scan(&exists); err != nil {
+			return err
+		}
+		if exists == 0 {
+			return errNoTag
+		}
+		if err := db.QueryRowContext(ctx, "select count(*) from tags where name = ?", to).Scan(&exists); err != nil {
+			return err
+		}
+		if exists > 0 {
+			return errRenameExists
+		}
+		// the new name may only stand for the renamed tag, which it no longer needs to
+		var canonical string
+		err := db.QueryRowContext(ctx, "select tag from tag_synonyms where synonym = ?", to).Scan(&canonical)
+		if err == nil && canonical != from {
+			return errRenameTaken
+		} else if err != nil && err != sql.ErrNoRows {
+			return err
+		}
+		if n, err = taggedCount(ctx, from); err != nil {
+			return err
+		}
+		statements := []struct {
+			query string
+			args  []interface{}
+		}{
+			{"delete from tag_synonyms where synonym = ?", []interface{}{to}},
+			{"update tags set name = ? where name = ?", []interface{}{to, from}},
+			{"update tag_revisions set tag = ? where tag = ?", []interface{}{to, from}},
+			{"update tag_synonyms set tag = ? where tag = ?", []interface{}{to, from}},
+			{"insert into tag_synonyms (synonym, tag) values (?, ?)", []interface{}{from, to}},
+		}
+		for _, st := range statements {
+			if _, err := db.ExecContext(ctx, st.query, st.args...); err != nil {
+				return err
+			}
+		}
+		return retagReferences(ctx, from, to)
+	})
+	return n, err
+}
+
+// retagPreview is what renaming or merging a tag would change
+type retagPreview struct {
+	From      string
+	Into      string
+	Action    string // rename when into is a new tag, merge when it exists
+	Total     int    // questions of the tag
+	Questions []Question
+}
+
+// questions listed in the preview of a retag
+const retagPreviewQuestions = 50
+
+// previewRetag loads what renaming from into, or merging it into into when that tag exists, would change
+func previewRetag(ctx context.Context, user *User, from, into string) (*retagPreview, error) {
+	p := &retagPreview{From: strings.ToLower(from), Into: strings.ToLower(into), Action: "rename"}
+	canonical, err := canonicalTag(ctx, p.Into)
+	if err != nil {
+		return nil, err
+	}
+	var exists int
+	if err := db.QueryRowContext(ctx, "select count(*) from tags where name = ?", p.Into).Scan(&exists); err != nil {
+		return nil, err
+	}
+	if exists > 0 || canonical != p.Into {
+		p.Action = "merge"
+	}
+	if p.Total, err = taggedCount(ctx, p.From); err != nil {
+		return nil, err
+	}
+	p.Questions, err = newestQuestions(ctx, user, p.From, retagPreviewQuestions)
+	return p, err
+}
+
+// tagsAdmin is the data of the tags admin page
+type tagsAdmin struct {
+	Synonyms []tagSynonym
+	Merged   int           // questions retagged by the last merge or rename, -1 when there was none
+	Preview  *retagPreview // of the rename or merge to confirm, nil if none
+	Error    string
+}
+
+// serve /admin/tags, where moderators declare synonyms, and preview then rename or merge tags
+func serveTagsAdmin(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	user := requireUser(w, r)
+	if user == nil {
+		return
+	}
+	if !isModerator(user) {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+	p := tagsAdmin{Merged: -1}
+	if r.Method == http.MethodPost {
+		from := strings.TrimSpace(r.FormValue("from"))
+		into := strings.TrimSpace(r.FormValue("into"))
+		// the change and its audit entry are written together
+		var err error
+		switch {
+		case r.FormValue("action") == "remove":
+			err = db.WithTx(ctx, func(ctx context.Context) error {
+				tag, err := canonicalTag(ctx, from)
+				if err != nil {
+					return err
+				}
+				if _, err := db.ExecContext(ctx, "delete from tag_synonyms where synonym = ?", strings.ToLower(from)); err != nil {
+					return err
+				}
+				return recordAudit(ctx, user, auditRemoveSynonym, "tag", strings.ToLower(from), map[string]string{"synonym_of": tag}, nil)
+			})
+		case from == "" || into == "" || strings.Contains(from+into, ","):
+			p.Error = "give one tag and the tag it stands for"
+		case r.FormValue("action") == "synonym":
+			err = db.WithTx(ctx, func(ctx context.Context) error {
+				if err := declareTagSynonym(ctx, from, into); err != nil {
+					return err
+				}
+				return recordAudit(ctx, user, auditTagSynonym, "tag", strings.ToLower(from), nil, map[string]string{"synonym_of": strings.ToLower(into)})
+			})
+		case r.FormValue("action") == "rename":
+			err = db.WithTx(ctx, func(ctx context.Context) error {
+				n, err := renameTag(ctx, from, into)
+				if err != nil {
+					return err
+				}
+				p.Merged = n
+				return recordAudit(ctx, user, auditRenameTag, "tag", strings.ToLower(from), map[string]string{"name": strings.ToLower(from)},
+					map[string]interface{}{"name": strings.ToLower(into), "questions_retagged": n})
+			})
+		default:
+			err = db.WithTx(ctx, func(ctx context.Context) error {
+				n, err := mergeTags(ctx, from, into)
+				if err != nil {
+					return err
+				}
+				p.Merged = n
+				return recordAudit(ctx, user, auditMergeTags, "tag", strings.ToLower(from), nil,
+					map[string]interface{}{"merged_into": strings.ToLower(into), "questions_retagged": n})
+			})
+		}
+		switch err {
+		case nil:
+			if p.Merged >= 0 {
+				// the pages and caches holding the tags by name
+				questionCache.clear()
+				forgetData("tag-wiki:"+strings.ToLower(from), "tag-wiki:"+strings.ToLower(into))
+				forgetDataPrefix("related-tags:")
+			}
+		case errSameTag, errNoTag, errRenameExists, errRenameTaken:
+			p.Error, err = err.Error(), nil
+		}
+		if err != nil {
+			serverError(w, r, err)
+			return
+		}
+	} else if r.FormValue("action") == "preview" {
+		from := strings.TrimSpace(r.FormValue("from"))
+		into := strings.TrimSpace(r.FormValue("into"))
+		var err error
+		if from == "" || into == "" || strings.Contains(from+into, ",") {
+			p.Error = "give one tag and the tag it stands for"
+		} else if p.Preview, err = previewRetag(ctx, user, from, into); err != nil {
+			serverError(w, r, err)
+			return
+		}
+	}
+	var err error
+	if p.Synonyms, err = tagSynonyms(ctx); err != nil {
+		serverError(w, r, err)
+		return
+	}
+	render(w, r, "tags-admin.html", p)
+}
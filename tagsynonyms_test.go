@@ -0,0 +1,72 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+// TestTagsAdminAudit checks that the changes of the tags admin page are written with their audit
+// entry or not at all
+func TestTagsAdminAudit(t *testing.T) {
+	srv := newTestServer(t)
+	handler := srv.Routes()
+	ctx := context.Background()
+	moderatorID, cookie := testUser(t, "moderator1")
+	testExec(t, "update users set super_user = 1 where id = ?", moderatorID)
+	testExec(t, "insert into questions (id, heading, body, date, time, user, views, open) values (1, 'A question', 'body', '2026-01-01', '10:00:00', 'moderator1', 0, 1)")
+	if err := setQuestionTags(ctx, 1, "golang"); err != nil {
+		t.Fatal(err)
+	}
+
+	post := func(form url.Values) int {
+		req := httptest.NewRequest(http.MethodPost, "/admin/tags", strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.AddCookie(cookie)
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		return rec.Code
+	}
+	count := func(query string, args ...interface{}) int {
+		var n int
+		if err := db.QueryRowContext(ctx, query, args...).Scan(&n); err != nil {
+			t.Fatal(err)
+		}
+		return n
+	}
+
+	// with the audit log failing, nothing changes
+	testExec(t, "create trigger audit_down before insert on audit_log begin select raise(abort, 'the audit log is down'); end")
+	changes := []url.Values{
+		{"action": {"rename"}, "from": {"golang"}, "into": {"go"}},
+		{"action": {"merge"}, "from": {"golang"}, "into": {"go"}},
+		{"action": {"synonym"}, "from": {"go-lang"}, "into": {"golang"}},
+	}
+	for _, form := range changes {
+		if code := post(form); code != http.StatusInternalServerError {
+			t.Errorf("%s without an audit log: %d", form.Get("action"), code)
+		}
+	}
+	if n := count("select count(*) from tags where name = 'golang'"); n != 1 {
+		t.Errorf("the tag was changed without its audit entry")
+	}
+	if n := count("select count(*) from tag_synonyms"); n != 0 {
+		t.Errorf("%d synonyms were added without their audit entry", n)
+	}
+
+	testExec(t, "drop trigger audit_down")
+	for _, form := range changes[:1] {
+		if code := post(form); code != http.StatusOK {
+			t.Fatalf("%s: %d", form.Get("action"), code)
+		}
+	}
+	if n := count("select count(*) from tags where name = 'go'"); n != 1 {
+		t.Errorf("the tag wasn't renamed")
+	}
+	if n := count("select count(*) from audit_log where action = ?", auditRenameTag); n != 1 {
+		t.Errorf("%d audit entries of the rename, want 1", n)
+	}
+}
@@ -0,0 +1,274 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// each tag has a wiki: a short plain excerpt, shown when hovering the tag, and a Markdown body
+// shown on its page. Moderators and users with enough reputation edit them, and every edit is
+// kept as a revision
+
+// reputation needed to edit tag wikis, for users who aren't moderators
+const tagWikiReputation = 200
+
+// longest excerpt of a tag, in characters
+const maxTagExcerpt = 300
+
+// revisions listed at once on the edit page of a tag, with their changes
+const tagRevisionsPerPage = 20
+
+// tagWiki is the description of a tag
+type tagWiki struct {
+	Excerpt string
+	Body    string // Markdown
+}
+
+// tagRevision is a version of the wiki of a tag
+type tagRevision struct {
+	ID        int
+	User      string
+	Excerpt   string
+	Body      string
+	CreatedAt string
+
+	// changes from the revision before, word by word
+	ExcerptDiff []diffPart
+	BodyDiff    []diffPart
+}
+
+// loadTagWiki loads the wiki of the tag, empty when it has none
+func loadTagWiki(ctx context.Context, tag string) (tagWiki, error) {
+	var w tagWiki
+	err := db.QueryRowContext(ctx, "select coalesce(desc, ''), coalesce(wiki, '') from tags where lower(name) = ? order by id limit 1",
+		strings.ToLower(tag)).Scan(&w.Excerpt, &w.Body)
+	if err == sql.ErrNoRows {
+		return w, nil
+	}
+	return w, err
+}
+
+// tagRevisions loads a page of the revisions of the wiki of the tag, newest first
+func tagRevisions(ctx context.Context, tag string, limit, offset int) ([]tagRevision, error) {
+	rows, err := db.QueryContext(ctx, `select tag_revisions.id, coalesce(users.username, ''), excerpt, body, created_at
+		from tag_revisions left join users on users.id = tag_revisions.user_id
+		where tag = ? order by tag_revisions.id desc limit ? offset ?`, strings.ToLower(tag), limit, offset)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var revisions []tagRevision
+	for rows.Next() {
+		var rev tagRevision
+		if err := rows.Scan(&rev.ID, &rev.User, &rev.Excerpt, &rev.Body, &rev.CreatedAt); err != nil {
+			return nil, err
+		}
+		revisions = append(revisions, rev)
+	}
+	return revisions, rows.Err()
+}
+
+// canEditTagWiki tells if the user may edit the wikis of tags
+func canEditTagWiki(ctx context.Context, user *User) (bool, error) {
+	if user == nil {
+		return false, nil
+	}
+	if isModerator(user) {
+		return true, nil
+	}
+	rep, err := reputation(ctx, user)
+	return rep >= tagWikiReputation, err
+}
+
+// saveTagWiki replaces the wiki of the tag, keeping the edit as a revision
+func saveTagWiki(ctx context.Context, user *User, tag string, w tagWiki) error {
+	tag = strings.ToLower(tag)
+	return db.WithTx(ctx, func(ctx context.Context) error {
+		res, err := db.ExecContext(ctx, "update tags set desc = ?, wiki = ? where lower(name) = ?", w.Excerpt, w.Body, tag)
+		if err != nil {
+			return err
+		}
+		// most tags only exist on their questions until their wiki is first written
+		if n, err := res.RowsAffected(); err != nil {
+			return err
+		} else if n == 0 {
+			if _, err := db.ExecContext(ctx, "insert into tags (name, desc, wiki) values (?, ?, ?)", tag, w.Excerpt, w.Body); err != nil {
+				return err
+			}
+		}
+		_, err = db.ExecContext(ctx, "insert into tag_revisions (tag, user_id, excerpt, body, created_at) values (?, ?, ?, ?, ?)",
+			tag, user.UniqueID, w.Excerpt, w.Body, time.Now().Format(timestampLayout))
+		if err != nil {
+			return err
+		}
+		db.AfterCommit(ctx, func() { forgetData("tag-wiki:" + tag) })
+		return nil
+	})
+}
+
+// rollbackTagWiki makes a revision of the wiki of the tag the current one again, as a new revision,
+// written with its audit entry
+func rollbackTagWiki(ctx context.Context, user *User, tag string, revision int) error {
+	return db.WithTx(ctx, func(ctx context.Context) error {
+		var after tagWiki
+		err := db.QueryRowContext(ctx, "select excerpt, body from tag_revisions where id = ? and tag = ?", revision, strings.ToLower(tag)).
+			Scan(&after.Excerpt, &after.Body)
+		if err != nil {
+			return err
+		}
+		before, err := loadTagWiki(ctx, tag)
+		if err != nil {
+			return err
+		}
+		if err := saveTagWiki(ctx, user, tag, after); err != nil {
+			return err
+		}
+		return recordAudit(ctx, user, auditRollbackTagWiki, "tag", strings.ToLower(tag),
+			map[string]string{"excerpt": before.Excerpt, "body": before.Body},
+			map[string]interface{}{"revision": revision, "excerpt": after.Excerpt, "body": after.Body})
+	})
+}
+
+// tagEditPage is the data of the page editing the wiki of a tag
+type tagEditPage struct {
+	Name      string
+	Wiki      tagWiki
+	Revisions []tagRevision // a page of them
+	Restoring int           // revision loaded in the form, 0 for the current wiki
+	Moderator bool
+	Error     string
+
+	PrevPage, NextPage int // of the revisions, 0 when there is none
+}
+
+// diffRevisions sets the changes of each revision from the one before, the revisions being newest
+// first. The last one is only the one before the others, it isn't compared
+func diffRevisions(revisions []tagRevision) {
+	for i := 0; i+1 < len(revisions); i++ {
+		prev := revisions[i+1]
+		revisions[i].ExcerptDiff = wordDiff(prev.Excerpt, revisions[i].Excerpt)
+		revisions[i].BodyDiff = wordDiff(prev.Body, revisions[i].Body)
+	}
+}
+
+// serve /tags/{name}/edit, where the wiki of the tag is edited. ?revision={id} loads an older revision in the form,
+// and moderators roll the wiki back to a revision at once
+func serveTagEdit(w http.ResponseWriter, r *http.Request, name string) {
+	ctx := r.Context()
+	user := requireUser(w, r)
+	if user == nil {
+		return
+	}
+	allowed, err := canEditTagWiki(ctx, user)
+	if err != nil {
+		serverError(w, r, err)
+		return
+	}
+	if !allowed {
+		http.Error(w, "Editing tag wikis takes "+strconv.Itoa(tagWikiReputation)+" reputation", http.StatusForbidden)
+		return
+	}
+	p := tagEditPage{Name: name, Moderator: isModerator(user)}
+	if r.Method == http.MethodPost && r.FormValue("action") == "rollback" {
+		if !p.Moderator {
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+		revision, _ := strconv.Atoi(r.FormValue("revision"))
+		if err := rollbackTagWiki(ctx, user, name, revision); err == sql.ErrNoRows {
+			http.NotFound(w, r)
+			return
+		} else if err != nil {
+			serverError(w, r, err)
+			return
+		}
+		http.Redirect(w, r, "/tags/"+url.PathEscape(name)+"/edit", http.StatusSeeOther)
+		return
+	}
+	if r.Method == http.MethodPost {
+		p.Wiki = tagWiki{
+			Excerpt: strings.Join(strings.Fields(r.FormValue("excerpt")), " "),
+			Body:    strings.TrimSpace(r.FormValue("body")),
+		}
+		if utf8.RuneCountInString(p.Wiki.Excerpt) > maxTagExcerpt {
+			p.Error = "the excerpt is longer than " + strconv.Itoa(maxTagExcerpt) + " characters"
+		} else {
+			if err := saveTagWiki(ctx, user, name, p.Wiki); err != nil {
+				serverError(w, r, err)
+				return
+			}
+			http.Redirect(w, r, "/tags/"+url.PathEscape(name), http.StatusSeeOther)
+			return
+		}
+	} else if p.Wiki, err = loadTagWiki(ctx, name); err != nil {
+		serverError(w, r, err)
+		return
+	}
+	// the revisions of the page are compared with the one before each, the first of the next page
+	// for the last, which also tells if there is a next page
+	page := 1
+	if n, err := strconv.Atoi(r.URL.Query().Get("page")); err == nil && n > 1 {
+		page = n
+	}
+	revisions, err := tagRevisions(ctx, name, tagRevisionsPerPage+1, (page-1)*tagRevisionsPerPage)
+	if err != nil {
+		serverError(w, r, err)
+		return
+	}
+	if len(revisions) > tagRevisionsPerPage {
+		p.NextPage = page + 1
+	} else {
+		// the first revision is compared with no wiki
+		revisions = append(revisions, tagRevision{})
+	}
+	diffRevisions(revisions)
+	p.Revisions, p.PrevPage = revisions[:len(revisions)-1], page-1
+	if id, _ := strconv.Atoi(r.URL.Query().Get("revision")); id > 0 && r.Method != http.MethodPost {
+		err := db.QueryRowContext(ctx, "select excerpt, body from tag_revisions where id = ? and tag = ?", id, strings.ToLower(name)).
+			Scan(&p.Wiki.Excerpt, &p.Wiki.Body)
+		if err == nil {
+			p.Restoring = id
+		} else if err != sql.ErrNoRows {
+			serverError(w, r, err)
+			return
+		}
+	}
+	render(w, r, "tag-edit.html", p)
+}
+
+// serve /api/v1/tags/{name}, the excerpt of a tag for the popovers of tag links
+func serveTagExcerpt(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	if r.Method != http.MethodGet {
+		writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	name := strings.ToLower(strings.TrimPrefix(r.URL.Path, "/api/v1/tags/"))
+	if name == "" || strings.Contains(name, "/") {
+		writeJSONError(w, http.StatusNotFound, "not found")
+		return
+	}
+	name, err := canonicalTag(ctx, name)
+	if err != nil {
+		writeInternalError(w, r, err)
+		return
+	}
+	wiki, err := loadTagWiki(ctx, name)
+	if err != nil {
+		writeInternalError(w, r, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, tagExcerpt{Name: name, Excerpt: wiki.Excerpt})
+}
+
+// tagExcerpt is the answer of /api/v1/tags/{name}
+type tagExcerpt struct {
+	Name    string `json:"name"` // the tag the name leads to, once synonyms are followed
+	Excerpt string `json:"excerpt"`
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// TestTagWikiRollbackAudit checks that a rollback of a tag wiki is written with its audit entry or
+// not at all
+func TestTagWikiRollbackAudit(t *testing.T) {
+	srv := newTestServer(t)
+	handler := srv.Routes()
+	ctx := context.Background()
+	moderatorID, cookie := testUser(t, "moderator1")
+	testExec(t, "update users set super_user = 1 where id = ?", moderatorID)
+	moderator, err := userByName(ctx, "moderator1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, body := range []string{"first", "second"} {
+		if err := saveTagWiki(ctx, moderator, "go", tagWiki{Excerpt: body, Body: body}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var first int
+	if err := db.QueryRowContext(ctx, "select min(id) from tag_revisions").Scan(&first); err != nil {
+		t.Fatal(err)
+	}
+	rollback := func() int {
+		form := url.Values{"action": {"rollback"}, "revision": {strconv.Itoa(first)}}
+		req := httptest.NewRequest(http.MethodPost, "/tags/go/edit", strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.AddCookie(cookie)
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		return rec.Code
+	}
+	wiki := func() string {
+		w, err := loadTagWiki(ctx, "go")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return w.Body
+	}
+
+	testExec(t, "create trigger audit_down before insert on audit_log begin select raise(abort, 'the audit log is down'); end")
+	if code := rollback(); code != http.StatusInternalServerError {
+		t.Errorf("rollback without an audit log: %d", code)
+	}
+	if body := wiki(); body != "second" {
+		t.Errorf("the wiki was rolled back to %q without its audit entry", body)
+	}
+	testExec(t, "drop trigger audit_down")
+	if code := rollback(); code != http.StatusSeeOther {
+		t.Fatalf("rollback: %d", code)
+	}
+	if body := wiki(); body != "first" {
+		t.Errorf("the wiki is %q after the rollback, want %q", body, "first")
+	}
+	var audits int
+	if err := db.QueryRowContext(ctx, "select count(*) from audit_log where action = ?", auditRollbackTagWiki).Scan(&audits); err != nil {
+		t.Fatal(err)
+	}
+	if audits != 1 {
+		t.Errorf("%d audit entries of the rollback, want 1", audits)
+	}
+}
+
+// TestTagEditPages checks that the edit page of a tag lists its revisions a page at a time
+func TestTagEditPages(t *testing.T) {
+	srv := newTestServer(t)
+	handler := srv.Routes()
+	ctx := context.Background()
+	moderatorID, cookie := testUser(t, "moderator1")
+	testExec(t, "update users set super_user = 1 where id = ?", moderatorID)
+	moderator, err := userByName(ctx, "moderator1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	const revisions = tagRevisionsPerPage + 5
+	for i := 1; i <= revisions; i++ {
+		if err := saveTagWiki(ctx, moderator, "go", tagWiki{Excerpt: "excerpt", Body: "version " + strconv.Itoa(i)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	get := func(page int) string {
+		req := httptest.NewRequest(http.MethodGet, "/tags/go/edit?page="+strconv.Itoa(page), nil)
+		req.AddCookie(cookie)
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		if rec.Code != http.StatusOK {
+			t.Fatalf("GET page %d: %d", page, rec.Code)
+		}
+		return rec.Body.String()
+	}
+	first, second := get(1), get(2)
+	if n := strings.Count(first, `class="revision"`); n != tagRevisionsPerPage {
+		t.Errorf("the first page lists %d revisions, want %d", n, tagRevisionsPerPage)
+	}
+	if !strings.Contains(first, "?page=2") {
+		t.Errorf("the first page doesn't link to the next one")
+	}
+	if n := strings.Count(second, `class="revision"`); n != revisions-tagRevisionsPerPage {
+		t.Errorf("the second page lists %d revisions, want %d", n, revisions-tagRevisionsPerPage)
+	}
+	// the last revision of the first page is compared with the first of the second
+	if !strings.Contains(first, "<del>"+strconv.Itoa(revisions-tagRevisionsPerPage)+"</del><ins>"+strconv.Itoa(revisions-tagRevisionsPerPage+1)+"</ins>") {
+		t.Errorf("the last revision of the first page isn't compared with the one before it")
+	}
+	// the first revision is all added
+	if !strings.Contains(second, "<ins>version 1</ins>") {
+		t.Errorf("the first revision isn't compared with no wiki")
+	}
+}
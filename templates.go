@@ -0,0 +1,94 @@
+package main
+
+import (
+	"fmt"
+	"html/template"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// the pages are parsed once, when the server starts, each with the header and the footer.
+// with the -dev flag they are parsed again on every request instead, so that edits to the
+// templates show without a restart
+
+// devTemplates makes pages parse their template on every request
+var devTemplates bool
+
+// templateSet holds the templates of the pages
+type templateSet struct {
+	dev   bool                          // pages are parsed on every request
+	pages map[string]*template.Template // by file name
+}
+
+// the templates of the running server, set by newServer, see Server
+var siteTemplates = &templateSet{pages: map[string]*template.Template{}}
+
+// parsePage parses the template of a page with the header and the footer
+func parsePage(name string) (*template.Template, error) {
+	return template.New(name).Funcs(templateFuncs).ParseFiles(filepath.Join("templates", name), "templates/footer.gohtml", "templates/header.gohtml")
+}
+
+// loadTemplates parses the templates of all the pages, or none with dev as they are parsed when used
+func loadTemplates(dev bool) (*templateSet, error) {
+	set := &templateSet{dev: dev, pages: map[string]*template.Template{}}
+	if dev {
+		return set, nil
+	}
+	paths, err := filepath.Glob(filepath.Join("templates", "*.html"))
+	if err != nil {
+		return nil, err
+	}
+	for _, path := range paths {
+		name := filepath.Base(path)
+		tmpl, err := parsePage(name)
+		if err != nil {
+			return nil, err
+		}
+		set.pages[name] = tmpl
+	}
+	return set, nil
+}
+
+// page returns the template of the named page, nil if there is no such page
+func (set *templateSet) page(name string) (*template.Template, error) {
+	if set.dev {
+		if _, err := os.Stat(filepath.Join("templates", name)); os.IsNotExist(err) || !strings.HasSuffix(name, ".html") {
+			return nil, nil
+		}
+		return parsePage(name)
+	}
+	return set.pages[name], nil
+}
+
+// pageTemplate returns the template of the named page of the running server
+func pageTemplate(name string) (*template.Template, error) {
+	return siteTemplates.page(name)
+}
+
+// formatDate shows a timestamp or a date of the database like "2 Jan 2006 15:04"
+func formatDate(s string) string {
+	if t, err := time.Parse(timestampLayout, s); err == nil {
+		return t.Format("2 Jan 2006 15:04")
+	}
+	if t, err := time.Parse(dateLayout, s); err == nil {
+		return t.Format("2 Jan 2006")
+	}
+	return s
+}
+
+// pluralize writes the count with the singular or the plural of the noun, like "1 answer" or "3 answers".
+// without a plural, an s is added to the singular
+func pluralize(n int, singular string, plural ...string) string {
+	if n == 1 || n == -1 {
+		return fmt.Sprintf("%d %s", n, singular)
+	}
+	if len(plural) > 0 {
+		return fmt.Sprintf("%d %s", n, plural[0])
+	}
+	if strings.HasSuffix(singular, "s") {
+		return fmt.Sprintf("%d %ses", n, singular)
+	}
+	return fmt.Sprintf("%d %ss", n, singular)
+}
@@ -0,0 +1,455 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"database/sql"
+	"encoding/base32"
+	"encoding/binary"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// users can turn on two-factor authentication with an authenticator app (TOTP, RFC 6238):
+// logging in then takes a code of the app after the password, or one of the recovery codes given
+// when it was turned on, each usable once and stored hashed. With REQUIRE_2FA_FOR_ADMINS set,
+// super-users can't reach the admin pages before turning it on
+
+// parameters of the codes, those authenticator apps expect by default
+const (
+	totpDigits = 6
+	totpPeriod = 30 // seconds
+	totpSkew   = 1  // periods accepted before and after the current one
+	totpIssuer = "QA Learning"
+)
+
+// recovery codes given when two-factor authentication is turned on
+const recoveryCodeCount = 10
+
+// a password accepted for an account with two-factor authentication waits this long for the code,
+// and for at most this many wrong codes
+const (
+	pendingLoginDuration = 5 * time.Minute
+	maxTOTPAttempts      = 5
+)
+
+// every maxTOTPAttempts wrong codes in a row lock the codes of the user out, across their pending
+// logins, for totpLockout, twice as long as the lockout before, up to maxTOTPLockout
+const (
+	totpLockout    = 15 * time.Minute
+	maxTOTPLockout = 24 * time.Hour
+)
+
+// cookie of a login waiting for its code
+const pendingLoginCookie = "pending_login"
+
+// newTOTPSecret makes a secret of 160 bits, in the base32 authenticator apps take
+func newTOTPSecret() string {
+	b := make([]byte, 20)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(b)
+}
+
+// totpCode is the code of the secret for a period
+func totpCode(secret string, step int64) (string, error) {
+	key, err := base32.StdEncoding.WithPadding(base32.NoPadding).DecodeString(strings.ToUpper(secret))
+	if err != nil {
+		return "", err
+	}
+	var msg [8]byte
+	binary.BigEndian.PutUint64(msg[:], uint64(step))
+	mac := hmac.New(sha1.New, key)
+	mac.Write(msg[:])
+	sum := mac.Sum(nil)
+	offset := sum[len(sum)-1] & 0xf
+	n := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+	return fmt.Sprintf("%0*d", totpDigits, n%1000000), nil
+}
+
+// matchTOTP finds the period of the code around now, 0 if it matches none
+func matchTOTP(secret, code string, now time.Time) (int64, error) {
+	code = strings.ReplaceAll(code, " ", "")
+	current := now.Unix() / totpPeriod
+	for step := current - totpSkew; step <= current+totpSkew; step++ {
+		want, err := totpCode(secret, step)
+		if err != nil {
+			return 0, err
+		}
+		if hmac.Equal([]byte(want), []byte(code)) {
+			return step, nil
+		}
+	}
+	return 0, nil
+}
+
+// provisioningURI is the otpauth:// uri authenticator apps read from the QR code
+func provisioningURI(user *User, secret string) string {
+	q := url.Values{
+		"secret":    {secret},
+		"issuer":    {totpIssuer},
+		"algorithm": {"SHA1"},
+		"digits":    {fmt.Sprint(totpDigits)},
+		"period":    {fmt.Sprint(totpPeriod)},
+	}
+	return "otpauth://totp/" + url.PathEscape(totpIssuer+":"+user.UserName) + "?" + q.Encode()
+}
+
+// twoFactorEnabled tells if logging in the user takes a code
+func twoFactorEnabled(ctx context.Context, userID int) (bool, error) {
+	var n int
+	err := db.QueryRowContext(ctx, "select count(*) from user_totp where user_id = ? and enabled_at is not null", userID).Scan(&n)
+	return n > 0, err
+}
+
+// checkSecondFactor checks a code of the app of the user, or one of their recovery codes, using
+// it up. Codes of the app are only accepted once too
+func checkSecondFactor(ctx context.Context, userID int, code string) (bool, error) {
+	code = strings.TrimSpace(code)
+	var secret string
+	var lastStep int64
+	err := db.QueryRowContext(ctx, "select secret, last_step from user_totp where user_id = ? and enabled_at is not null", userID).Scan(&secret, &lastStep)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	step, err := matchTOTP(secret, code, time.Now())
+	if err != nil {
+		return false, err
+	}
+	if step > 0 {
+		if step <= lastStep {
+			return false, nil
+		}
+		res, err := db.ExecContext(ctx, "update user_totp set last_step = ? where user_id = ? and last_step < ?", step, userID, step)
+		if err != nil {
+			return false, err
+		}
+		n, err := res.RowsAffected()
+		return n > 0, err
+	}
+	return useRecoveryCode(ctx, userID, code)
+}
+
+// newRecoveryCodes replaces the recovery codes of the user, returning the new ones. Only their
+// hashes are kept
+func newRecoveryCodes(ctx context.Context, userID int) ([]string, error) {
+	codes := make([]string, recoveryCodeCount)
+	err := db.WithTx(ctx, func(ctx context.Context) error {
+		if _, err := db.ExecContext(ctx, "delete from recovery_codes where user_id = ?", userID); err != nil {
+			return err
+		}
+		for i := range codes {
+			token := newToken()
+			codes[i] = token[:5] + "-" + token[5:10]
+			hash, err := bcrypt.GenerateFromPassword([]byte(codes[i]), bcrypt.DefaultCost)
+			if err != nil {
+				return err
+			}
+			if _, err := db.ExecContext(ctx, "insert into recovery_codes (user_id, code_hash) values (?, ?)", userID, string(hash)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	return codes, err
+}
+
+// useRecoveryCode checks a recovery code of the user, using it up
+func useRecoveryCode(ctx context.Context, userID int, code string) (bool, error) {
+	code = strings.ToLower(code)
+	rows, err := db.QueryContext(ctx, "select id, code_hash from recovery_codes where user_id = ? and used_at is null", userID)
+	if err != nil {
+		return false, err
+	}
+	found := 0
+	for rows.Next() {
+		var id int
+		var hash string
+		if err := rows.Scan(&id, &hash); err != nil {
+			rows.Close()
+			return false, err
+		}
+		if bcrypt.CompareHashAndPassword([]byte(hash), []byte(code)) == nil {
+			found = id
+			break
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil || found == 0 {
+		return false, err
+	}
+	res, err := db.ExecContext(ctx, "update recovery_codes set used_at = ? where id = ? and used_at is null", time.Now().Format(timestampLayout), found)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
+
+// totpLockedUntil is when the user may try codes again after too many wrong ones, zero if they may now
+func totpLockedUntil(ctx context.Context, userID int, now time.Time) (time.Time, error) {
+	var until sql.NullString
+	err := db.QueryRowContext(ctx, "select locked_until from user_totp where user_id = ?", userID).Scan(&until)
+	if err == sql.ErrNoRows || err == nil && !until.Valid {
+		return time.Time{}, nil
+	}
+	if err != nil {
+		return time.Time{}, err
+	}
+	t, err := time.ParseInLocation(timestampLayout, until.String, time.Local)
+	if err != nil || !t.After(now) {
+		return time.Time{}, err
+	}
+	return t, nil
+}
+
+// countTOTPFailure counts a wrong code of the user, returning until when it locked their codes out,
+// zero if it didn't
+func countTOTPFailure(ctx context.Context, userID int, now time.Time) (time.Time, error) {
+	var until time.Time
+	err := db.WithTx(ctx, func(ctx context.Context) error {
+		var failed int
+		err := db.QueryRowContext(ctx, "select failed_attempts + 1 from user_totp where user_id = ?", userID).Scan(&failed)
+		if err == sql.ErrNoRows {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if failed%maxTOTPAttempts != 0 {
+			_, err = db.ExecContext(ctx, "update user_totp set failed_attempts = ? where user_id = ?", failed, userID)
+			return err
+		}
+		lockout := totpLockout
+		for n := maxTOTPAttempts; n < failed && lockout < maxTOTPLockout; n += maxTOTPAttempts {
+			lockout *= 2
+		}
+		if lockout > maxTOTPLockout {
+			lockout = maxTOTPLockout
+		}
+		until = now.Add(lockout)
+		_, err = db.ExecContext(ctx, "update user_totp set failed_attempts = ?, locked_until = ? where user_id = ?",
+			failed, until.Format(timestampLayout), userID)
+		return err
+	})
+	return until, err
+}
+
+// totpLockedError is the error shown to a user whose codes are locked out until then
+func totpLockedError(until time.Time) string {
+	return fmt.Sprintf("too many wrong codes, try again after %s", until.Format("15:04"))
+}
+
+// startPendingLogin keeps a login whose password was right until its code comes
+func startPendingLogin(ctx context.Context, w http.ResponseWriter, userID int, remember bool) error {
+	token := newToken()
+	expires := time.Now().Add(pendingLoginDuration)
+	_, err := db.ExecContext(ctx, "insert into pending_logins (token, user_id, attempts, remember, expires) values (?, ?, 0, ?, ?)",
+		token, userID, remember, expires.Format(timestampLayout))
+	if err != nil {
+		return err
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     pendingLoginCookie,
+		Value:    token,
+		Path:     "/login/2fa",
+		Expires:  expires,
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+	return nil
+}
+
+// serve /login/2fa, the second step of logging in an account with two-factor authentication
+func serveLoginCode(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	cookie, err := r.Cookie(pendingLoginCookie)
+	if err != nil {
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return
+	}
+	var userID, attempts int
+	var remember bool
+	err = db.QueryRowContext(ctx, "select user_id, attempts, remember from pending_logins where token = ? and expires > ?",
+		cookie.Value, time.Now().Format(timestampLayout)).Scan(&userID, &attempts, &remember)
+	if err == sql.ErrNoRows || attempts >= maxTOTPAttempts {
+		render(w, r, "login.html", authForm{Error: "the login expired, log in again"})
+		return
+	}
+	if err != nil {
+		serverError(w, r, err)
+		return
+	}
+	if r.Method != http.MethodPost {
+		render(w, r, "login-code.html", authForm{})
+		return
+	}
+	// the wrong codes are counted by login, and by user, so new logins don't get new tries
+	now := time.Now()
+	until, err := totpLockedUntil(ctx, userID, now)
+	if err != nil {
+		serverError(w, r, err)
+		return
+	}
+	if !until.IsZero() {
+		render(w, r, "login-code.html", authForm{Error: totpLockedError(until)})
+		return
+	}
+	ok, err := checkSecondFactor(ctx, userID, r.FormValue("code"))
+	if err != nil {
+		serverError(w, r, err)
+		return
+	}
+	if !ok {
+		if _, err := db.ExecContext(ctx, "update pending_logins set attempts = attempts + 1 where token = ?", cookie.Value); err != nil {
+			serverError(w, r, err)
+			return
+		}
+		until, err := countTOTPFailure(ctx, userID, now)
+		if err != nil {
+			serverError(w, r, err)
+			return
+		}
+		if !until.IsZero() {
+			render(w, r, "login-code.html", authForm{Error: totpLockedError(until)})
+			return
+		}
+		render(w, r, "login-code.html", authForm{Error: "wrong code"})
+		return
+	}
+	if _, err := db.ExecContext(ctx, "update user_totp set failed_attempts = 0, locked_until = null where user_id = ?", userID); err != nil {
+		serverError(w, r, err)
+		return
+	}
+	if _, err := db.ExecContext(ctx, "delete from pending_logins where token = ? or expires <= ?", cookie.Value, time.Now().Format(timestampLayout)); err != nil {
+		serverError(w, r, err)
+		return
+	}
+	http.SetCookie(w, &http.Cookie{Name: pendingLoginCookie, Value: "", Path: "/login/2fa", MaxAge: -1})
+	if remember {
+		if err := rememberUser(ctx, w, userID); err != nil {
+			serverError(w, r, err)
+			return
+		}
+	}
+	if err := startSession(ctx, w, userID); err != nil {
+		serverError(w, r, err)
+		return
+	}
+	http.Redirect(w, r, "/", http.StatusSeeOther)
+}
+
+// twoFactorRequired tells if the user must turn on two-factor authentication before reaching
+// the admin pages, with REQUIRE_2FA_FOR_ADMINS
+func twoFactorRequired(ctx context.Context, user *User) (bool, error) {
+	if !user.SuperUser || os.Getenv("REQUIRE_2FA_FOR_ADMINS") == "" {
+		return false, nil
+	}
+	enabled, err := twoFactorEnabled(ctx, user.UniqueID)
+	return !enabled, err
+}
+
+// twoFactorForm is the data of the two-factor settings page
+type twoFactorForm struct {
+	Enabled       bool
+	Required      bool     // the user must turn it on to reach the admin pages
+	Secret        string   // secret being set up, to type in the app
+	URI           string   // provisioning uri of the secret, shown as a QR code
+	RecoveryCodes []string // codes just made, shown once
+	Error         string
+}
+
+// serve /settings/2fa, where users turn two-factor authentication on and off
+func serveTwoFactorSettings(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	user := requireUser(w, r)
+	if user == nil {
+		return
+	}
+	var form twoFactorForm
+	var err error
+	if form.Enabled, err = twoFactorEnabled(ctx, user.UniqueID); err != nil {
+		serverError(w, r, err)
+		return
+	}
+	if form.Required, err = twoFactorRequired(ctx, user); err != nil {
+		serverError(w, r, err)
+		return
+	}
+
+	switch r.FormValue("action") {
+	case "setup":
+		// a new secret waits for a code of the app before it counts
+		if r.Method != http.MethodPost || form.Enabled {
+			break
+		}
+		form.Secret = newTOTPSecret()
+		_, err = db.ExecContext(ctx, "insert or replace into user_totp (user_id, secret, last_step, enabled_at) values (?, ?, 0, null)", user.UniqueID, form.Secret)
+	case "enable":
+		if r.Method != http.MethodPost || form.Enabled {
+			break
+		}
+		var secret string
+		if err = db.QueryRowContext(ctx, "select secret from user_totp where user_id = ?", user.UniqueID).Scan(&secret); err == sql.ErrNoRows {
+			err = nil
+			break
+		} else if err != nil {
+			break
+		}
+		var step int64
+		if step, err = matchTOTP(secret, r.FormValue("code"), time.Now()); err != nil {
+			break
+		}
+		if step == 0 {
+			form.Secret, form.Error = secret, "wrong code, check the time of your device"
+			break
+		}
+		if _, err = db.ExecContext(ctx, "update user_totp set enabled_at = ?, last_step = ? where user_id = ?", time.Now().Format(timestampLayout), step, user.UniqueID); err != nil {
+			break
+		}
+		form.Enabled, form.Required = true, false
+		form.RecoveryCodes, err = newRecoveryCodes(ctx, user.UniqueID)
+	case "recovery-codes", "disable":
+		if r.Method != http.MethodPost || !form.Enabled {
+			break
+		}
+		var ok bool
+		if ok, err = checkSecondFactor(ctx, user.UniqueID, r.FormValue("code")); err != nil || !ok {
+			form.Error = "wrong code"
+			break
+		}
+		if r.FormValue("action") == "recovery-codes" {
+			form.RecoveryCodes, err = newRecoveryCodes(ctx, user.UniqueID)
+			break
+		}
+		err = db.WithTx(ctx, func(ctx context.Context) error {
+			if _, err := db.ExecContext(ctx, "delete from user_totp where user_id = ?", user.UniqueID); err != nil {
+				return err
+			}
+			_, err := db.ExecContext(ctx, "delete from recovery_codes where user_id = ?", user.UniqueID)
+			return err
+		})
+		form.Enabled = false
+		form.Required, _ = twoFactorRequired(ctx, user)
+	}
+	if err != nil {
+		serverError(w, r, err)
+		return
+	}
+	if form.Secret != "" {
+		form.URI = provisioningURI(user, form.Secret)
+	}
+	render(w, r, "two-factor.html", form)
+}
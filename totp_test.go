@@ -0,0 +1,77 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestTOTPLockout checks that the wrong codes of a user are counted across their pending logins:
+// logging in again doesn't give new tries once the codes are locked out
+func TestTOTPLockout(t *testing.T) {
+	srv := newTestServer(t)
+	handler := srv.Routes()
+	ctx := context.Background()
+	userID, _ := testUser(t, "student1")
+	testExec(t, "insert into user_totp (user_id, secret, last_step, enabled_at) values (?, ?, 0, '2026-01-01 00:00:00')", userID, newTOTPSecret())
+
+	// tryCode starts a login if there is none and sends a wrong code, returning the page
+	var pending *http.Cookie
+	tryCode := func() string {
+		t.Helper()
+		if pending == nil {
+			rec := httptest.NewRecorder()
+			if err := startPendingLogin(ctx, rec, userID, false); err != nil {
+				t.Fatal(err)
+			}
+			pending = rec.Result().Cookies()[0]
+		}
+		req := httptest.NewRequest(http.MethodPost, "/login/2fa", strings.NewReader(url.Values{"code": {"000000"}}.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.AddCookie(pending)
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		if rec.Code != http.StatusOK {
+			t.Fatalf("POST /login/2fa: %d", rec.Code)
+		}
+		return rec.Body.String()
+	}
+
+	for i := 1; i < maxTOTPAttempts; i++ {
+		if page := tryCode(); !strings.Contains(page, "wrong code") {
+			t.Fatalf("wrong code %d isn't refused:\n%s", i, page)
+		}
+	}
+	if page := tryCode(); !strings.Contains(page, "too many wrong codes") {
+		t.Fatalf("wrong code %d doesn't lock the codes out:\n%s", maxTOTPAttempts, page)
+	}
+	// a new login of the user is locked out too
+	pending = nil
+	if page := tryCode(); !strings.Contains(page, "too many wrong codes") {
+		t.Fatalf("a new login isn't locked out:\n%s", page)
+	}
+	until, err := totpLockedUntil(ctx, userID, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d := time.Until(until); d <= totpLockout-time.Minute || d > totpLockout {
+		t.Errorf("locked out for %v, want %v", d, totpLockout)
+	}
+
+	// once the lockout ends, the next wrong codes lock them out for twice as long
+	testExec(t, "update user_totp set locked_until = '2026-01-01 00:00:00' where user_id = ?", userID)
+	for i := 0; i < maxTOTPAttempts; i++ {
+		pending = nil
+		tryCode()
+	}
+	if until, err = totpLockedUntil(ctx, userID, time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	if d := time.Until(until); d <= 2*totpLockout-time.Minute || d > 2*totpLockout {
+		t.Errorf("locked out again for %v, want %v", d, 2*totpLockout)
+	}
+}
@@ -0,0 +1,377 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// super-users create accounts in bulk on /admin/import-users, from a CSV with the columns name,
+// email, username, role and course, in any order after a header line. Each account either gets a
+// generated password, shown in the report, or is emailed a welcome link to choose its own on
+// /welcome/{token}. A dry run checks the rows without creating anything. Either way the report
+// tells, row by row, what was or would be done, or why the row was refused
+
+// largest CSV, most rows and how long a welcome link lasts
+const (
+	maxImportSize = 1 << 20
+	maxImportRows = 500
+	welcomeDays   = 14
+)
+
+// length of the generated passwords
+const generatedPasswordLength = 12
+
+// ways of giving the imported users their password
+const (
+	importPasswords = "passwords"
+	importInvites   = "invites"
+)
+
+// importRoles are the roles of imported users
+var importRoles = map[string]bool{"student": true, "teacher": true, "moderator": true}
+
+// importRow is a row of the CSV and what became of it
+type importRow struct {
+	Line     int
+	Name     string
+	Email    string
+	UserName string
+	Role     string
+	Course   string // code or id of the course to add the user to, empty for none
+	Password string // generated, empty when invited
+	Error    string
+	courseID int
+	first    string
+	last     string
+}
+
+// Status is what became of the row, for the report
+func (row importRow) Status(dryRun bool) string {
+	switch {
+	case row.Error != "":
+		return "error"
+	case dryRun:
+		return "ok"
+	default:
+		return "created"
+	}
+}
+
+// readImportCSV reads the rows of the CSV, erroring when the header lacks a column
+func readImportCSV(r io.Reader) ([]importRow, error) {
+	in := csv.NewReader(r)
+	in.FieldsPerRecord = -1
+	in.TrimLeadingSpace = true
+	header, err := in.Read()
+	if err == io.EOF {
+		return nil, errors.New("the file is empty")
+	}
+	if err != nil {
+		return nil, err
+	}
+	index := map[string]int{}
+	for i, name := range header {
+		index[strings.ToLower(strings.TrimSpace(strings.TrimPrefix(name, "\ufeff")))] = i
+	}
+	for _, name := range []string{"name", "email", "username", "role", "course"} {
+		if _, ok := index[name]; !ok {
+			return nil, fmt.Errorf("the header has no %s column, it takes name, email, username, role and course", name)
+		}
+	}
+	var rows []importRow
+	for {
+		record, err := in.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		line, _ := in.FieldPos(0)
+		field := func(name string) string {
+			if i := index[name]; i < len(record) {
+				return strings.TrimSpace(record[i])
+			}
+			return ""
+		}
+		row := importRow{
+			Line:     line,
+			Name:     field("name"),
+			Email:    field("email"),
+			UserName: strings.ToLower(field("username")),
+			Role:     strings.ToLower(field("role")),
+			Course:   field("course"),
+		}
+		if row.Name == "" && row.Email == "" && row.UserName == "" && row.Role == "" && row.Course == "" {
+			continue
+		}
+		rows = append(rows, row)
+		if len(rows) > maxImportRows {
+			return nil, fmt.Errorf("a file has at most %d rows, split it", maxImportRows)
+		}
+	}
+	if len(rows) == 0 {
+		return nil, errors.New("the file has no rows under its header")
+	}
+	return rows, nil
+}
+
+// importCourse finds the course of a code or an id, 0 if there is none
+func importCourse(ctx context.Context, course string) (int, error) {
+	var id int
+	err := db.QueryRowContext(ctx, "select id from courses where code = ? or id = ?", strings.ToUpper(course), course).Scan(&id)
+	if err == sql.ErrNoRows {
+		return 0, nil
+	}
+	return id, err
+}
+
+// checkImportRow sets the error of a row that can't be imported, the usernames of the earlier
+// rows of the file being taken
+func checkImportRow(ctx context.Context, row *importRow, mode string, taken map[string]bool) error {
+	if row.Role == "" {
+		row.Role = "student"
+	}
+	row.first, row.last, _ = strings.Cut(row.Name, " ")
+	row.last = strings.TrimSpace(row.last)
+	switch {
+	case row.Name == "":
+		row.Error = "the name is missing"
+	case !importRoles[row.Role]:
+		row.Error = "the role is student, teacher or moderator"
+	case row.Email != "" && !validEmail(row.Email):
+		row.Error = "the email address isn't valid"
+	case row.Email == "" && mode == importInvites:
+		row.Error = "inviting takes an email address"
+	case taken[row.UserName]:
+		row.Error = "the username is on an earlier row"
+	}
+	if row.Error != "" {
+		return nil
+	}
+	if err := validateUsername(ctx, row.UserName, 0); err != nil {
+		row.Error = err.Error()
+		return nil
+	}
+	if row.Course != "" {
+		var err error
+		if row.courseID, err = importCourse(ctx, row.Course); err != nil {
+			return err
+		}
+		if row.courseID == 0 {
+			row.Error = "there is no course " + row.Course
+			return nil
+		}
+	}
+	taken[row.UserName] = true
+	return nil
+}
+
+// importUser creates the account of a checked row, with a generated password or a welcome link
+// emailed to it, and adds it to its course
+func importUser(ctx context.Context, admin *User, row *importRow, mode string) error {
+	hash := ""
+	token := newToken()
+	if mode == importPasswords {
+		row.Password = newToken()[:generatedPasswordLength]
+		var err error
+		if hash, err = hashPassword(row.Password); err != nil {
+			return err
+		}
+	}
+	return db.WithTx(ctx, func(ctx context.Context) error {
+		now := time.Now()
+		res, err := db.ExecContext(ctx, `insert into users (first_name, last_name, username, password, user_type, super_user, email)
+			values (?, ?, ?, ?, ?, false, ?)`, row.first, row.last, row.UserName, hash, row.Role, row.Email)
+		if err != nil {
+			return err
+		}
+		id, _ := res.LastInsertId()
+		if row.courseID != 0 {
+			role := courseStudent
+			if row.Role != "student" {
+				role = courseTeacher
+			}
+			if _, err := db.ExecContext(ctx, "insert into course_members (course_id, user_id, role, joined_at) values (?, ?, ?, ?)",
+				row.courseID, id, role, now.Format(timestampLayout)); err != nil {
+				return err
+			}
+		}
+		if mode == importInvites {
+			if _, err := db.ExecContext(ctx, "insert into welcome_links (token, user_id, expires_at) values (?, ?, ?)",
+				token, id, now.AddDate(0, 0, welcomeDays).Format(timestampLayout)); err != nil {
+				return err
+			}
+			body := fmt.Sprintf("Hello %s,\n\nAn account was made for you on QA Learning, with the username %s.\n"+
+				"Choose its password within %d days at\n\n%s\n", row.first, row.UserName, welcomeDays, siteURL()+"/welcome/"+token)
+			if err := queueEmail(ctx, row.Email, "Your QA Learning account", body); err != nil {
+				return err
+			}
+		}
+		if err := emitUserRegistered(ctx, int(id), row.UserName); err != nil {
+			return err
+		}
+		return recordAudit(ctx, admin, auditImportUser, "user", row.UserName, nil, map[string]string{"role": row.Role, "course": row.Course})
+	})
+}
+
+// importUsers checks the rows, then creates the accounts of those without errors unless it is a dry run
+func importUsers(ctx context.Context, admin *User, rows []importRow, mode string, dryRun bool) error {
+	taken := map[string]bool{}
+	for i := range rows {
+		if err := checkImportRow(ctx, &rows[i], mode, taken); err != nil {
+			return err
+		}
+	}
+	if dryRun {
+		return nil
+	}
+	for i := range rows {
+		if rows[i].Error == "" {
+			if err := importUser(ctx, admin, &rows[i], mode); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// importPage is the data of the import page
+type importPage struct {
+	Mode   string
+	DryRun bool
+	Done   bool // the report is shown
+	Rows   []importRow
+	Errors int
+	Error  string
+}
+
+// serve /admin/import-users, where super-users create accounts from a CSV. With report=csv, the
+// report is downloaded as CSV instead of shown, to hand out the generated passwords
+func serveImportUsers(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	admin := requireSuperUser(w, r)
+	if admin == nil {
+		return
+	}
+	p := importPage{Mode: importPasswords, DryRun: true}
+	if r.Method != http.MethodPost {
+		render(w, r, "import-users.html", p)
+		return
+	}
+	r.Body = http.MaxBytesReader(w, r.Body, maxImportSize+1<<16)
+	if err := r.ParseMultipartForm(maxImportSize); err != nil {
+		http.Error(w, "the file is too large", http.StatusRequestEntityTooLarge)
+		return
+	}
+	p.Mode = r.FormValue("mode")
+	if p.Mode != importInvites {
+		p.Mode = importPasswords
+	}
+	p.DryRun = r.FormValue("dry_run") == "1"
+	file, _, err := r.FormFile("file")
+	if err != nil {
+		p.Error = "choose a CSV file"
+		render(w, r, "import-users.html", p)
+		return
+	}
+	defer file.Close()
+	if p.Rows, err = readImportCSV(file); err != nil {
+		p.Error = err.Error()
+		render(w, r, "import-users.html", p)
+		return
+	}
+	if err := importUsers(ctx, admin, p.Rows, p.Mode, p.DryRun); err != nil {
+		serverError(w, r, err)
+		return
+	}
+	p.Done = true
+	for _, row := range p.Rows {
+		if row.Error != "" {
+			p.Errors++
+		}
+	}
+	if r.FormValue("report") != "csv" {
+		render(w, r, "import-users.html", p)
+		return
+	}
+	w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="import-%s.csv"`, time.Now().Format(dateLayout)))
+	out := csv.NewWriter(w)
+	out.Write([]string{"line", "username", "name", "email", "role", "course", "status", "password", "error"})
+	for _, row := range p.Rows {
+		out.Write([]string{strconv.Itoa(row.Line), row.UserName, row.Name, row.Email, row.Role, row.Course, row.Status(p.DryRun), row.Password, row.Error})
+	}
+	out.Flush()
+	if err := out.Error(); err != nil {
+		fmt.Println(err)
+	}
+}
+
+// welcomePage is the data of the welcome page
+type welcomePage struct {
+	UserName string
+	Error    string
+}
+
+// serve /welcome/{token}, where an imported user chooses their password and logs in
+func serveWelcome(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	token := strings.TrimPrefix(r.URL.Path, "/welcome/")
+	var userID int
+	var p welcomePage
+	err := db.QueryRowContext(ctx, `select users.id, users.username from welcome_links join users on users.id = welcome_links.user_id
+		where welcome_links.token = ? and welcome_links.expires_at > ?`, token, time.Now().Format(timestampLayout)).Scan(&userID, &p.UserName)
+	if err == sql.ErrNoRows {
+		http.Error(w, "this link is no longer valid, ask an administrator for a new one", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		serverError(w, r, err)
+		return
+	}
+	if r.Method != http.MethodPost {
+		render(w, r, "welcome.html", p)
+		return
+	}
+	password := r.FormValue("password")
+	if len(password) < minPasswordLength {
+		p.Error = "the password must have at least 8 characters"
+		render(w, r, "welcome.html", p)
+		return
+	}
+	if password != r.FormValue("again") {
+		p.Error = "the passwords don't match"
+		render(w, r, "welcome.html", p)
+		return
+	}
+	hash, err := hashPassword(password)
+	if err != nil {
+		serverError(w, r, err)
+		return
+	}
+	err = db.WithTx(ctx, func(ctx context.Context) error {
+		if _, err := db.ExecContext(ctx, "update users set password = ? where id = ?", hash, userID); err != nil {
+			return err
+		}
+		_, err := db.ExecContext(ctx, "delete from welcome_links where user_id = ?", userID)
+		return err
+	})
+	if err != nil {
+		serverError(w, r, err)
+		return
+	}
+	if err := startSession(ctx, w, userID); err != nil {
+		serverError(w, r, err)
+		return
+	}
+	http.Redirect(w, r, "/", http.StatusSeeOther)
+}
@@ -0,0 +1,387 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"net/http"
+	"net/url"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+// a user can change their username once in this interval
+const renameInterval = 90 * 24 * time.Hour
+
+// usernames are lowercase letters, digits, dots, dashes and underscores
+var usernamePattern = regexp.MustCompile(`^[a-z0-9_.-]{3,30}$`)
+
+// names that can never be taken, whatever is in the reserved_names table.
+// admins add other names, like course codes, from /admin/reserved-names
+var builtinReservedNames = map[string]bool{
+	"admin":         true,
+	"administrator": true,
+	"moderator":     true,
+	"mod":           true,
+	"root":          true,
+	"superuser":     true,
+	"teacher":       true,
+	"student":       true,
+	"staff":         true,
+	"support":       true,
+	"system":        true,
+	"anonymous":     true,
+	"deleted":       true,
+	"api":           true,
+	"static":        true,
+	"login":         true,
+	"logout":        true,
+	"register":      true,
+	"settings":      true,
+}
+
+// check if the name is reserved, either built in or by an admin
+func isReservedName(ctx context.Context, name string) (bool, error) {
+	name = strings.ToLower(name)
+	if builtinReservedNames[name] {
+		return true, nil
+	}
+	var n int
+	err := db.QueryRowContext(ctx, "select count(*) from reserved_names where name = ?", name).Scan(&n)
+	return n > 0, err
+}
+
+// validateUsername checks that the name is well formed, not reserved and free.
+// userID is the user wanting the name, 0 for a new account
+func validateUsername(ctx context.Context, name string, userID int) error {
+	if !usernamePattern.MatchString(name) {
+		return errors.New("usernames have 3 to 30 lowercase letters, digits, dots, dashes or underscores")
+	}
+	reserved, err := isReservedName(ctx, name)
+	if err != nil {
+		return err
+	}
+	if reserved {
+		return errors.New("this username is reserved")
+	}
+	var n int
+	err = db.QueryRowContext(ctx, "select count(*) from users where lower(username) = ? and id != ?", name, userID).Scan(&n)
+	if err != nil {
+		return err
+	}
+	if n > 0 {
+		return errors.New("this username is already taken")
+	}
+	// old names keep redirecting to their owner, so nobody else can take them
+	err = db.QueryRowContext(ctx, "select count(*) from username_history where old_name = ? and user_id != ?", name, userID).Scan(&n)
+	if err != nil {
+		return err
+	}
+	if n > 0 {
+		return errors.New("this username is already taken")
+	}
+	return nil
+}
+
+// nextRename returns when the user may change their username again, zero if they may now
+func nextRename(ctx context.Context, userID int) (time.Time, error) {
+	var last sql.NullString
+	err := db.QueryRowContext(ctx, "select max(changed_at) from username_history where user_id = ?", userID).Scan(&last)
+	if err != nil || !last.Valid {
+		return time.Time{}, err
+	}
+	t, err := time.ParseInLocation(timestampLayout, last.String, time.Local)
+	if err != nil {
+		return time.Time{}, err
+	}
+	if next := t.Add(renameInterval); next.After(time.Now()) {
+		return next, nil
+	}
+	return time.Time{}, nil
+}
+
+// mentionPattern matches @name in a post, not followed by more username characters
+func mentionPattern(name string) *regexp.Regexp {
+	return regexp.MustCompile(`(?i)(^|[^a-z0-9_])@` + regexp.QuoteMeta(name) + `($|[^a-z0-9_.-])`)
+}
+
+// renameUser changes the username everywhere it is referenced, in a single transaction
+func renameUser(ctx context.Context, userID int, oldName, newName string) error {
+	return db.WithTx(ctx, func(ctx context.Context) error {
+		stmts := []string{
+			"update users set username = ? where id = ?",
+			"update questions set user = ? where user = ?",
+			"update answers set user = ? where user = ?",
+			"update comments set user = ? where user = ?",
+		}
+		if _, err := db.ExecContext(ctx, stmts[0], newName, userID); err != nil {
+			return err
+		}
+		for _, stmt := range stmts[1:] {
+			if _, err := db.ExecContext(ctx, stmt, newName, oldName); err != nil {
+				return err
+			}
+		}
+
+		// rewrite @mentions of the old name in questions, answers and comments
+		mention := mentionPattern(oldName)
+		for _, table := range []string{"questions", "answers", "comments"} {
+			rows, err := db.QueryContext(ctx, "select id, body from "+table+" where body like ?", "%@"+oldName+"%")
+			if err != nil {
+				return err
+			}
+			bodies := map[int]string{}
+			for rows.Next() {
+				var id int
+				var body string
+				if err := rows.Scan(&id, &body); err != nil {
+					rows.Close()
+					return err
+				}
+				// matches can share the separating character, so replace until nothing is left
+				for {
+					replaced := mention.ReplaceAllString(body, "${1}@"+newName+"${2}")
+					if replaced == body {
+						break
+					}
+					body = replaced
+				}
+				bodies[id] = body
+			}
+			rows.Close()
+			for id, body := range bodies {
+				if _, err := db.ExecContext(ctx, "update "+table+" set body = ? where id = ?", body, id); err != nil {
+					return err
+				}
+			}
+		}
+
+		_, err := db.ExecContext(ctx, "insert into username_history (user_id, old_name, new_name, changed_at) values (?, ?, ?, ?)",
+			userID, oldName, newName, time.Now().Format(timestampLayout))
+		return err
+	})
+}
+
+// profile is the data of the profile page
+type profile struct {
+	Member    *User
+	Questions []Question
+	Muted     bool       // the user muted the member
+	CanWrite  bool       // the user can send a message to the member
+	MuteCount int        // users who muted the member, only shown to moderators
+	Sanctions []sanction // suspensions and bans of the member, only shown to super-users
+
+	Reputation     int
+	SeesReputation bool              // the user may see where the reputation of the member came from
+	Suppressed     *emailSuppression // why emails to the member stopped, only shown to super-users
+}
+
+// serve /users/{name}, /users/{name}/activity, /users/{name}/reputation, /users/{name}/mute, /users/{name}/sanction and /users/{name}/email.
+// former names redirect to the current profile
+func serveProfile(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	name, action, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/users/"), "/")
+	if name == "" || (action != "" && action != "activity" && action != "reputation" && action != "mute" && action != "sanction" && action != "email") {
+		http.NotFound(w, r)
+		return
+	}
+	member, err := userByName(ctx, name)
+	if err != nil {
+		serverError(w, r, err)
+		return
+	}
+	if member == nil {
+		var current string
+		err := db.QueryRowContext(ctx, `select users.username from username_history join users on users.id = username_history.user_id
+			where old_name = ? order by changed_at desc limit 1`, strings.ToLower(name)).Scan(&current)
+		if err == sql.ErrNoRows {
+			http.NotFound(w, r)
+			return
+		}
+		if err != nil {
+			serverError(w, r, err)
+			return
+		}
+		http.Redirect(w, r, "/users/"+url.PathEscape(current), http.StatusMovedPermanently)
+		return
+	}
+	switch action {
+	case "activity":
+		serveActivityPage(w, r, member)
+		return
+	case "reputation":
+		serveReputationPage(w, r, member)
+		return
+	case "mute":
+		serveMute(w, r, member)
+		return
+	case "sanction":
+		serveSanction(w, r, member)
+		return
+	case "email":
+		serveEmailSuppression(w, r, member)
+		return
+	}
+
+	user := currentUser(r)
+	p := profile{Member: member}
+	if p.Reputation, err = cachedReputation(ctx, member); err != nil {
+		serverError(w, r, err)
+		return
+	}
+	p.SeesReputation = canSeeReputationHistory(user, member)
+	if user != nil {
+		muted, err := mutedNames(ctx, user)
+		if err != nil {
+			serverError(w, r, err)
+			return
+		}
+		p.Muted = muted[member.UserName]
+		if p.CanWrite, err = canMessage(ctx, user, member); err != nil {
+			serverError(w, r, err)
+			return
+		}
+		if isModerator(user) {
+			if p.MuteCount, err = muteCount(ctx, member.UniqueID); err != nil {
+				serverError(w, r, err)
+				return
+			}
+		}
+		if user.SuperUser {
+			if p.Sanctions, err = sanctionsOf(ctx, member.UniqueID); err != nil {
+				serverError(w, r, err)
+				return
+			}
+			if member.Email != "" {
+				if p.Suppressed, err = suppressionOf(ctx, member.Email); err != nil {
+					serverError(w, r, err)
+					return
+				}
+			}
+		}
+	}
+	filter, args, err := questionFilter(ctx, user)
+	if err != nil {
+		serverError(w, r, err)
+		return
+	}
+	anonymous, anonymousArgs := anonymousFilter(user)
+	rows, err := db.QueryContext(ctx, "select "+questionColumns+" from questions where user = ? and "+filter+" and "+anonymous+" order by date desc, time desc, id desc",
+		append(append([]interface{}{member.UserName}, args...), anonymousArgs...)...)
+	if err != nil {
+		serverError(w, r, err)
+		return
+	}
+	defer rows.Close()
+	for rows.Next() {
+		q, err := scanQuestion(rows)
+		if err != nil {
+			serverError(w, r, err)
+			return
+		}
+		p.Questions = append(p.Questions, q)
+	}
+	render(w, r, "profile.html", p)
+}
+
+// usernameForm is the data of the username settings page
+type usernameForm struct {
+	Error      string
+	NextRename time.Time
+}
+
+// serve /settings/username, letting the user rename themselves once per renameInterval
+func serveUsernameSettings(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	user := requireUser(w, r)
+	if user == nil {
+		return
+	}
+	next, err := nextRename(ctx, user.UniqueID)
+	if err != nil {
+		serverError(w, r, err)
+		return
+	}
+	form := usernameForm{NextRename: next}
+	if r.Method != http.MethodPost {
+		render(w, r, "username.html", form)
+		return
+	}
+	if !next.IsZero() {
+		form.Error = "you have changed your username recently"
+		render(w, r, "username.html", form)
+		return
+	}
+	name := strings.ToLower(strings.TrimSpace(r.FormValue("username")))
+	if name == strings.ToLower(user.UserName) {
+		http.Redirect(w, r, "/users/"+url.PathEscape(name), http.StatusSeeOther)
+		return
+	}
+	if err := validateUsername(ctx, name, user.UniqueID); err != nil {
+		form.Error = err.Error()
+		render(w, r, "username.html", form)
+		return
+	}
+	if err := renameUser(ctx, user.UniqueID, user.UserName, name); err != nil {
+		serverError(w, r, err)
+		return
+	}
+	// the old name is on the pages of every thread the user took part in
+	questionCache.clear()
+	http.Redirect(w, r, "/users/"+url.PathEscape(name), http.StatusSeeOther)
+}
+
+// reservedName is a row of the reserved names page
+type reservedName struct {
+	Name    string
+	Reason  string
+	Builtin bool
+}
+
+// serve /admin/reserved-names, where super-users add and remove reserved names
+func serveReservedNames(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	if requireSuperUser(w, r) == nil {
+		return
+	}
+	if r.Method == http.MethodPost {
+		name := strings.ToLower(strings.TrimSpace(r.FormValue("name")))
+		var err error
+		switch {
+		case name == "":
+		case r.FormValue("action") == "remove":
+			_, err = db.ExecContext(ctx, "delete from reserved_names where name = ?", name)
+		default:
+			_, err = db.ExecContext(ctx, "insert or replace into reserved_names (name, reason) values (?, ?)", name, r.FormValue("reason"))
+		}
+		if err != nil {
+			serverError(w, r, err)
+			return
+		}
+		http.Redirect(w, r, "/admin/reserved-names", http.StatusSeeOther)
+		return
+	}
+
+	var names []reservedName
+	for name := range builtinReservedNames {
+		names = append(names, reservedName{Name: name, Builtin: true})
+	}
+	rows, err := db.QueryContext(ctx, "select name, coalesce(reason, '') from reserved_names")
+	if err != nil {
+		serverError(w, r, err)
+		return
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var n reservedName
+		if err := rows.Scan(&n.Name, &n.Reason); err != nil {
+			serverError(w, r, err)
+			return
+		}
+		names = append(names, n)
+	}
+	sort.Slice(names, func(i, j int) bool { return names[i].Name < names[j].Name })
+	render(w, r, "reserved-names.html", names)
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"time"
+)
+
+// clientIP returns the address of the client of the request, without the port
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// viewerKey identifies who views a page: the user when logged in, the address otherwise
+func viewerKey(r *http.Request, user *User) string {
+	if user != nil {
+		return fmt.Sprintf("user:%d", user.UniqueID)
+	}
+	return "ip:" + clientIP(r)
+}
+
+// countView adds a view to the question, at most once per viewer and per day.
+// it tells if the view was counted
+func countView(r *http.Request, user *User, questionID int) (bool, error) {
+	ctx := r.Context()
+	res, err := db.ExecContext(ctx, "insert or ignore into question_views (question_id, viewer, day) values (?, ?, ?)",
+		questionID, viewerKey(r, user), time.Now().Format(dateLayout))
+	if err != nil {
+		return false, err
+	}
+	if n, err := res.RowsAffected(); err != nil || n == 0 {
+		return false, err
+	}
+	_, err = db.ExecContext(ctx, "update questions set views = coalesce(views, 0) + 1 where id = ?", questionID)
+	return err == nil, err
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// the vote-fraud maintenance task looks every night at the up votes of the last day for two
+// anomalies: serial voting, one user up voting SERIAL_VOTE_LIMIT posts of the same author or more,
+// 5 by default, and bursts, VOTE_BURST_LIMIT up votes or more, 10 by default, cast on the posts of
+// one author within an hour from one address by several accounts. Such votes are deleted, which
+// takes back the reputation they gave as it is computed from the votes, and a report goes to the
+// moderation queue at /admin/flags. The addresses of the votes are erased after voteIPRetention
+
+const (
+	defaultSerialVoteLimit = 5
+	defaultVoteBurstLimit  = 10
+	voteFraudWindow        = 24 * time.Hour
+	voteIPRetention        = 30 * 24 * time.Hour
+)
+
+// kinds of vote fraud
+const (
+	fraudSerialVoting = "serial voting"
+	fraudVoteBurst    = "vote burst"
+)
+
+// serialVoteLimit is the number of up votes of a user on the posts of an author in a day that is serial voting
+func serialVoteLimit() int {
+	if n, err := strconv.Atoi(os.Getenv("SERIAL_VOTE_LIMIT")); err == nil && n > 1 {
+		return n
+	}
+	return defaultSerialVoteLimit
+}
+
+// voteBurstLimit is the number of up votes from an address on the posts of an author in an hour that is a burst
+func voteBurstLimit() int {
+	if n, err := strconv.Atoi(os.Getenv("VOTE_BURST_LIMIT")); err == nil && n > 1 {
+		return n
+	}
+	return defaultVoteBurstLimit
+}
+
+// upVotesSQL selects the up votes on questions and answers cast since the argument, as rows of id,
+// user_id, ip, author, points and voted_at
+var upVotesSQL = fmt.Sprintf(`select votes.id, votes.user_id, coalesce(votes.ip, '') ip, questions.user author, %d points, votes.voted_at
+		from votes join questions on votes.post_type = 'question' and votes.post_id = questions.id where votes.value > 0 and votes.voted_at >= ?1
+	union all
+	select votes.id, votes.user_id, coalesce(votes.ip, ''), answers.user, %d, votes.voted_at
+		from votes join answers on votes.post_type = 'answer' and votes.post_id = answers.id where votes.value > 0 and votes.voted_at >= ?1`,
+	questionUpPoints, answerUpPoints)
+
+// voteFraud is a group of votes found fraudulent, and reversed
+type voteFraud struct {
+	ID      int
+	Kind    string
+	Voter   string // of serial voting, empty for a burst
+	IP      string // of a burst, empty for serial voting
+	Author  string // whose posts got the votes
+	Votes   int
+	Points  int // of reputation taken back from the author
+	FirstAt string
+	LastAt  string
+	Created string
+}
+
+// detectVoteFraud reverses the serial votes and the vote bursts of the last day, and reports them
+func detectVoteFraud(ctx context.Context) error {
+	since := time.Now().Add(-voteFraudWindow).Format(timestampLayout)
+	// the votes of a user on an author, then those from an address on an author in an hour
+	groups := []struct {
+		kind, query string
+		limit       int
+	}{
+		{fraudSerialVoting, `select cast(user_id as text), lower(author), '' from (` + upVotesSQL + `)
+			group by user_id, lower(author) having count(*) >= ?2`, serialVoteLimit()},
+		{fraudVoteBurst, `select ip, lower(author), substr(voted_at, 1, 13) from (` + upVotesSQL + `)
+			where ip != '' group by ip, lower(author), substr(voted_at, 1, 13) having count(*) >= ?2 and count(distinct user_id) > 1`, voteBurstLimit()},
+	}
+	var authors []string
+	for _, g := range groups {
+		type found struct{ key, author, hour string }
+		var frauds []found
+		err := queryList(ctx, g.query, []interface{}{since, g.limit}, func(rows *sql.Rows) error {
+			var f found
+			err := rows.Scan(&f.key, &f.author, &f.hour)
+			frauds = append(frauds, f)
+			return err
+		})
+		if err != nil {
+			return err
+		}
+		for _, f := range frauds {
+			err := db.WithTx(ctx, func(ctx context.Context) error {
+				return reverseVotes(ctx, g.kind, since, f.key, f.author, f.hour)
+			})
+			if err != nil {
+				return err
+			}
+			authors = append(authors, f.author)
+		}
+	}
+	if len(authors) > 0 {
+		keys := make([]string, len(authors))
+		for i, a := range authors {
+			keys[i] = "reputation:" + a
+		}
+		forgetData(keys...)
+		// the scores on the cached pages changed
+		questionCache.clear()
+	}
+	_, err := db.ExecContext(ctx, "update votes set ip = null where ip is not null and voted_at < ?",
+		time.Now().Add(-voteIPRetention).Format(timestampLayout))
+	return err
+}
+
+// reverseVotes deletes the up votes of a fraud on the posts of author, those of the user of id key
+// for serial voting, or those from the address key in the hour for a burst, and reports them
+func reverseVotes(ctx context.Context, kind, since, key, author, hour string) error {
+	query := "select id, points, voted_at from (" + upVotesSQL + ") where lower(author) = ?2"
+	args := []interface{}{since, author}
+	var voterID sql.NullInt64
+	var ip sql.NullString
+	if kind == fraudSerialVoting {
+		id, err := strconv.Atoi(key)
+		if err != nil {
+			return err
+		}
+		voterID = sql.NullInt64{Int64: int64(id), Valid: true}
+		query += " and user_id = ?3"
+		args = append(args, id)
+	} else {
+		ip = sql.NullString{String: key, Valid: true}
+		query += " and ip = ?3 and substr(voted_at, 1, 13) = ?4"
+		args = append(args, key, hour)
+	}
+	var ids []int
+	var points int
+	var first, last string
+	err := queryList(ctx, query+" order by voted_at", args, func(rows *sql.Rows) error {
+		var id, p int
+		var at string
+		err := rows.Scan(&id, &p, &at)
+		ids = append(ids, id)
+		points += p
+		if first == "" {
+			first = at
+		}
+		last = at
+		return err
+	})
+	if err != nil || len(ids) == 0 {
+		return err
+	}
+	vals := make([]interface{}, len(ids))
+	for i, id := range ids {
+		vals[i] = id
+	}
+	if _, err := db.ExecContext(ctx, "delete from votes where id in ("+placeholders(len(ids))+")", vals...); err != nil {
+		return err
+	}
+	_, err = db.ExecContext(ctx, `insert into vote_fraud_reports (kind, voter_id, ip, author, votes, points, first_at, last_at, created_at)
+		values (?, ?, ?, ?, ?, ?, ?, ?, ?)`, kind, voterID, ip, author, len(ids), points, first, last, time.Now().Format(timestampLayout))
+	return err
+}
+
+// voteFraudReports loads the reports of vote fraud no moderator resolved yet, the latest first
+func voteFraudReports(ctx context.Context) ([]voteFraud, error) {
+	var reports []voteFraud
+	err := queryList(ctx, `select vote_fraud_reports.id, kind, coalesce(users.username, ''), coalesce(ip, ''), author, votes, points,
+		first_at, last_at, created_at from vote_fraud_reports left join users on users.id = vote_fraud_reports.voter_id
+		where resolved_at is null order by vote_fraud_reports.id desc`, nil, func(rows *sql.Rows) error {
+		var f voteFraud
+		err := rows.Scan(&f.ID, &f.Kind, &f.Voter, &f.IP, &f.Author, &f.Votes, &f.Points, &f.FirstAt, &f.LastAt, &f.Created)
+		reports = append(reports, f)
+		return err
+	})
+	return reports, err
+}
+
+// resolveVoteFraud closes a report of vote fraud once a moderator looked at it
+func resolveVoteFraud(ctx context.Context, moderator *User, id int) error {
+	_, err := db.ExecContext(ctx, "update vote_fraud_reports set resolved_at = ?, resolved_by = ? where id = ? and resolved_at is null",
+		time.Now().Format(timestampLayout), moderator.UniqueID, id)
+	return err
+}
+
+// voteIP is the address a vote is cast from, kept to find the bursts of votes
+func voteIP(ip string) interface{} {
+	if ip = strings.TrimSpace(ip); ip == "" {
+		return nil
+	}
+	return ip
+}
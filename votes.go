@@ -0,0 +1,209 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// a vote can be changed or retracted freely for this long after it was cast.
+// after that, it is locked until the post is edited
+const voteChangeWindow = 5 * time.Minute
+
+// types of post that can be voted on, as stored in votes.post_type
+const (
+	postQuestion = "question"
+	postAnswer   = "answer"
+	postComment  = "comment"
+)
+
+var (
+	errPostNotFound = errors.New("this post doesn't exist")
+	errOwnPost      = errors.New("you can't vote on your own post")
+	errVoteLocked   = errors.New("your vote is locked in until the post is edited")
+)
+
+// tables of the post types
+var postTables = map[string]string{
+	postQuestion: "questions",
+	postAnswer:   "answers",
+	postComment:  "comments",
+}
+
+// voteLocked tells if a vote cast at votedAt can no longer be changed,
+// for a post last edited at edited (empty if never edited)
+func voteLocked(votedAt, edited string, now time.Time) bool {
+	cast, err := time.ParseInLocation(timestampLayout, votedAt, time.Local)
+	if err != nil {
+		return false
+	}
+	if now.Sub(cast) <= voteChangeWindow {
+		return false
+	}
+	// both are formatted with timestampLayout, so they compare as strings
+	return edited == "" || edited <= votedAt
+}
+
+// wilsonScore is the lower bound of the 95% confidence interval of the share of up votes,
+// which ranks a post with few votes below one as good with many
+func wilsonScore(up, down int) float64 {
+	n := float64(up + down)
+	if n == 0 {
+		return 0
+	}
+	const z = 1.96
+	p := float64(up) / n
+	return (p + z*z/(2*n) - z*math.Sqrt((p*(1-p)+z*z/(4*n))/n)) / (1 + z*z/n)
+}
+
+// castVote sets the vote of the user, from the address ip, on a post to value: 1 up, -1 down, 0 retracts the vote
+func castVote(ctx context.Context, user *User, postType string, postID, value int, ip string) error {
+	table, ok := postTables[postType]
+	if !ok {
+		return errPostNotFound
+	}
+	var author string
+	var edited sql.NullString
+	err := db.QueryRowContext(ctx, "select user, edited_at from "+table+" where id = ?", postID).Scan(&author, &edited)
+	if err == sql.ErrNoRows {
+		return errPostNotFound
+	}
+	if err != nil {
+		return err
+	}
+	if author == user.UserName {
+		return errOwnPost
+	}
+
+	// the reputation of the author changes with the vote
+	defer forgetData("reputation:" + strings.ToLower(author))
+
+	now := time.Now()
+	var current int
+	var votedAt string
+	err = db.QueryRowContext(ctx, "select value, voted_at from votes where user_id = ? and post_type = ? and post_id = ?",
+		user.UniqueID, postType, postID).Scan(&current, &votedAt)
+	if err == sql.ErrNoRows {
+		if value == 0 {
+			return nil
+		}
+		_, err = db.ExecContext(ctx, "insert into votes (user_id, post_type, post_id, value, voted_at, ip) values (?, ?, ?, ?, ?, ?)",
+			user.UniqueID, postType, postID, value, now.Format(timestampLayout), voteIP(ip))
+		return err
+	}
+	if err != nil {
+		return err
+	}
+	if current == value {
+		return nil
+	}
+	if voteLocked(votedAt, edited.String, now) {
+		return errVoteLocked
+	}
+	if value == 0 {
+		_, err = db.ExecContext(ctx, "delete from votes where user_id = ? and post_type = ? and post_id = ?", user.UniqueID, postType, postID)
+		return err
+	}
+	_, err = db.ExecContext(ctx, "update votes set value = ?, voted_at = ?, ip = ? where user_id = ? and post_type = ? and post_id = ?",
+		value, now.Format(timestampLayout), voteIP(ip), user.UniqueID, postType, postID)
+	return err
+}
+
+// userVote returns the vote of the user on a post, 0 if there is none
+func userVote(ctx context.Context, user *User, postType string, postID int) (int, error) {
+	if user == nil {
+		return 0, nil
+	}
+	var value int
+	err := db.QueryRowContext(ctx, "select value from votes where user_id = ? and post_type = ? and post_id = ?",
+		user.UniqueID, postType, postID).Scan(&value)
+	if err == sql.ErrNoRows {
+		return 0, nil
+	}
+	return value, err
+}
+
+// userVotes returns the votes of the user on posts of a type, by post id, in one query rather than
+// one per post. The posts the user didn't vote on are left out, so their vote reads as 0
+func userVotes(ctx context.Context, user *User, postType string, postIDs []int) (map[int]int, error) {
+	votes := map[int]int{}
+	if user == nil || len(postIDs) == 0 {
+		return votes, nil
+	}
+	args := []interface{}{user.UniqueID, postType}
+	for _, id := range postIDs {
+		args = append(args, id)
+	}
+	err := queryList(ctx, "select post_id, value from votes where user_id = ? and post_type = ? and post_id in ("+placeholders(len(postIDs))+")",
+		args, func(rows *sql.Rows) error {
+			var id, value int
+			err := rows.Scan(&id, &value)
+			votes[id] = value
+			return err
+		})
+	return votes, err
+}
+
+// handle a vote form posted on a post. Voting the same way twice retracts the vote
+func serveVote(w http.ResponseWriter, r *http.Request, postType string, postID, questionID int) {
+	ctx := r.Context()
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	user := requireUser(w, r)
+	if user == nil {
+		return
+	}
+	current, err := userVote(ctx, user, postType, postID)
+	if err != nil {
+		serverError(w, r, err)
+		return
+	}
+	var value int
+	switch r.FormValue("vote") {
+	case "up":
+		value = 1
+	case "down":
+		// comments can only be up voted
+		if postType == postComment {
+			http.Error(w, "Bad Request", http.StatusBadRequest)
+			return
+		}
+		value = -1
+	case "retract":
+	default:
+		http.Error(w, "Bad Request", http.StatusBadRequest)
+		return
+	}
+	if value == current {
+		value = 0
+	}
+	switch err := castVote(ctx, user, postType, postID, value, clientIP(r)); err {
+	case nil:
+	case errPostNotFound:
+		http.NotFound(w, r)
+		return
+	case errOwnPost, errVoteLocked:
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	default:
+		serverError(w, r, err)
+		return
+	}
+	if value != 0 {
+		detail := "up"
+		if value < 0 {
+			detail = "down"
+		}
+		if err := recordActivity(ctx, user.UniqueID, activityVoted, postType, postID, questionID, detail); err != nil {
+			fmt.Println(err)
+		}
+	}
+	http.Redirect(w, r, fmt.Sprintf("/questions/%d#%s-%d", questionID, postType, postID), http.StatusSeeOther)
+}
@@ -0,0 +1,389 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// super-users register webhooks at /admin/webhooks: URLs that get a POST for the events they
+// subscribe to. The body is JSON, {"event": ..., "created_at": ..., "data": {...}}, and the request
+// carries the headers X-QA-Event, X-QA-Delivery, the id of the delivery, the same for its retries,
+// and X-QA-Signature, t=<unix time>,sha256=<hex>: the HMAC-SHA256 of "<unix time>.<body>" with the
+// secret of the webhook. A receiver checks it, and that the time is recent. Each delivery is a job,
+// retried with the backoff of the jobs until the receiver answers with a 2xx status, and kept in a
+// delivery log, which the webhooks maintenance task prunes. Questions of courses send no events
+
+// the events webhooks subscribe to
+const (
+	eventQuestionCreated = "question.created"
+	eventAnswerCreated   = "answer.created"
+	eventAnswerAccepted  = "answer.accepted"
+	eventUserRegistered  = "user.registered"
+	// sent to one webhook from the admin page, to try it
+	eventPing = "ping"
+)
+
+var webhookEvents = []string{eventQuestionCreated, eventAnswerCreated, eventAnswerAccepted, eventUserRegistered}
+
+// states of a delivery
+const (
+	deliveryPending   = "pending"
+	deliveryDelivered = "delivered"
+	deliveryFailed    = "failed"
+)
+
+// deliveries shown on the admin page, and how long they are kept
+const (
+	webhookLogSize   = 50
+	webhookRetention = 30 * 24 * time.Hour
+)
+
+// client for the webhooks, which shouldn't hold a job for long
+var webhookClient = &http.Client{Timeout: 10 * time.Second}
+
+func init() {
+	jobHandlers["webhook"] = deliverWebhookJob
+}
+
+// webhook is a registered webhook
+type webhook struct {
+	ID      int
+	URL     string
+	Secret  string
+	Events  []string // empty for all
+	Active  bool
+	Created string
+}
+
+// subscribes tells if the webhook wants the event
+func (h webhook) subscribes(event string) bool {
+	if len(h.Events) == 0 {
+		return true
+	}
+	for _, e := range h.Events {
+		if e == event {
+			return true
+		}
+	}
+	return false
+}
+
+const webhookColumns = "id, url, secret, events, active, created_at"
+
+func scanWebhook(rows *sql.Rows) (webhook, error) {
+	var h webhook
+	var events string
+	err := rows.Scan(&h.ID, &h.URL, &h.Secret, &events, &h.Active, &h.Created)
+	h.Events = splitTags(events)
+	return h, err
+}
+
+// webhookPayload is the body of a delivery
+type webhookPayload struct {
+	Event   string      `json:"event"`
+	Created string      `json:"created_at"`
+	Data    interface{} `json:"data"`
+}
+
+// the data of the events
+type (
+	webhookQuestion struct {
+		ID      int      `json:"id"`
+		Heading string   `json:"heading"`
+		Tags    []string `json:"tags"`
+		Author  string   `json:"author,omitempty"` // empty for an anonymous question
+		URL     string   `json:"url"`
+	}
+	webhookAnswer struct {
+		ID         int    `json:"id"`
+		QuestionID int    `json:"question_id"`
+		Author     string `json:"author,omitempty"`
+		URL        string `json:"url"`
+	}
+	webhookUser struct {
+		ID       int    `json:"id"`
+		Username string `json:"username"`
+	}
+)
+
+// emitWebhook queues a delivery of the event to each active webhook subscribed to it
+func emitWebhook(ctx context.Context, event string, data interface{}) error {
+	var hooks []webhook
+	err := queryList(ctx, "select "+webhookColumns+" from webhooks where active", nil, func(rows *sql.Rows) error {
+		h, err := scanWebhook(rows)
+		if h.subscribes(event) {
+			hooks = append(hooks, h)
+		}
+		return err
+	})
+	if err != nil || len(hooks) == 0 {
+		return err
+	}
+	now := time.Now()
+	body, err := json.Marshal(webhookPayload{Event: event, Created: now.UTC().Format(time.RFC3339), Data: data})
+	if err != nil {
+		return err
+	}
+	for _, h := range hooks {
+		if err := queueDelivery(ctx, h.ID, event, body, now); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// queueDelivery logs a delivery to the webhook and queues its job
+func queueDelivery(ctx context.Context, webhookID int, event string, body []byte, now time.Time) error {
+	res, err := db.ExecContext(ctx, `insert into webhook_deliveries (webhook_id, event, payload, status, created_at)
+		values (?, ?, ?, ?, ?)`, webhookID, event, string(body), deliveryPending, now.Format(timestampLayout))
+	if err != nil {
+		return err
+	}
+	id, _ := res.LastInsertId()
+	return enqueueJob(ctx, "webhook", id)
+}
+
+// publicQuestion tells if the question is outside of courses, so its events can leave the app
+func publicQuestion(ctx context.Context, id int) (bool, error) {
+	var courseID sql.NullInt64
+	err := db.QueryRowContext(ctx, "select course_id from questions where id = ?", id).Scan(&courseID)
+	return !courseID.Valid, err
+}
+
+// emitQuestionCreated sends question.created for a question outside of courses
+func emitQuestionCreated(ctx context.Context, author *User, anonymous bool, id int, heading string, tags []string) error {
+	if public, err := publicQuestion(ctx, id); err != nil || !public {
+		return err
+	}
+	q := webhookQuestion{ID: id, Heading: heading, Tags: tags, URL: fmt.Sprintf("%s/questions/%d", siteURL(), id)}
+	if !anonymous {
+		q.Author = author.UserName
+	}
+	return emitWebhook(ctx, eventQuestionCreated, q)
+}
+
+// emitAnswer sends an event about an answer to a question outside of courses
+func emitAnswer(ctx context.Context, event string, author string, questionID, answerID int) error {
+	if public, err := publicQuestion(ctx, questionID); err != nil || !public {
+		return err
+	}
+	return emitWebhook(ctx, event, webhookAnswer{ID: answerID, QuestionID: questionID, Author: author,
+		URL: fmt.Sprintf("%s/questions/%d#answer-%d", siteURL(), questionID, answerID)})
+}
+
+// emitUserRegistered sends user.registered for a new account
+func emitUserRegistered(ctx context.Context, id int, username string) error {
+	return emitWebhook(ctx, eventUserRegistered, webhookUser{ID: id, Username: username})
+}
+
+// deliverWebhookJob posts the delivery whose id is the payload, logging the outcome of the attempt
+func deliverWebhookJob(ctx context.Context, payload []byte) error {
+	var id int
+	if err := json.Unmarshal(payload, &id); err != nil {
+		return err
+	}
+	var event, body, status, url, secret string
+	var active bool
+	var attempts int
+	err := db.QueryRowContext(ctx, `select d.event, d.payload, d.status, d.attempts, w.url, w.secret, w.active
+		from webhook_deliveries d join webhooks w on w.id = d.webhook_id where d.id = ?`, id).
+		Scan(&event, &body, &status, &attempts, &url, &secret, &active)
+	if err == sql.ErrNoRows || (err == nil && status != deliveryPending) {
+		// the webhook was removed, or the delivery is done
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if !active {
+		_, err := db.ExecContext(ctx, "update webhook_deliveries set status = ?, last_error = ? where id = ?",
+			deliveryFailed, "the webhook was turned off", id)
+		return err
+	}
+	code, sendErr := postWebhook(ctx, url, secret, event, id, []byte(body))
+	attempts++
+	status, lastError := deliveryDelivered, sql.NullString{}
+	var delivered sql.NullString
+	if sendErr == nil {
+		delivered = sql.NullString{String: time.Now().Format(timestampLayout), Valid: true}
+	} else {
+		lastError = sql.NullString{String: sendErr.Error(), Valid: true}
+		status = deliveryPending
+		if attempts >= maxJobAttempts {
+			status = deliveryFailed
+		}
+	}
+	_, err = db.ExecContext(ctx, `update webhook_deliveries set status = ?, attempts = ?, response_code = ?, last_error = ?, delivered_at = ?
+		where id = ?`, status, attempts, sql.NullInt64{Int64: int64(code), Valid: code != 0}, lastError, delivered, id)
+	if err != nil {
+		return err
+	}
+	return sendErr
+}
+
+// postWebhook sends a signed delivery, returning the status of the response, 0 without one
+func postWebhook(ctx context.Context, url, secret, event string, deliveryID int, body []byte) (int, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "QA-Learning-Webhooks")
+	req.Header.Set("X-QA-Event", event)
+	req.Header.Set("X-QA-Delivery", strconv.Itoa(deliveryID))
+	req.Header.Set("X-QA-Signature", signWebhook(secret, time.Now(), body))
+	resp, err := webhookClient.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return resp.StatusCode, fmt.Errorf("the webhook answered %s", resp.Status)
+	}
+	return resp.StatusCode, nil
+}
+
+// signWebhook is the X-QA-Signature of a body sent at t
+func signWebhook(secret string, t time.Time, body []byte) string {
+	stamp := strconv.FormatInt(t.Unix(), 10)
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(stamp + "."))
+	mac.Write(body)
+	return "t=" + stamp + ",sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// pruneWebhookDeliveries deletes the deliveries older than the retention, except those still pending
+func pruneWebhookDeliveries(ctx context.Context) error {
+	_, err := db.ExecContext(ctx, "delete from webhook_deliveries where status != ? and created_at < ?",
+		deliveryPending, time.Now().Add(-webhookRetention).Format(timestampLayout))
+	return err
+}
+
+// webhookDelivery is a line of the delivery log
+type webhookDelivery struct {
+	ID        int
+	URL       string // of the webhook
+	Event     string
+	Status    string
+	Attempts  int
+	Code      int
+	Error     string
+	Created   string
+	Delivered string
+}
+
+type webhooksPage struct {
+	Webhooks   []webhook
+	Deliveries []webhookDelivery
+	Events     []string
+	Form       webhook
+	Error      string
+}
+
+// serve /admin/webhooks, where super-users register webhooks and look at their deliveries
+func serveWebhooksAdmin(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	if requireSuperUser(w, r) == nil {
+		return
+	}
+	p := webhooksPage{Events: webhookEvents}
+	if r.Method == http.MethodPost {
+		var err error
+		switch r.FormValue("action") {
+		case "add":
+			p.Form = webhook{URL: strings.TrimSpace(r.FormValue("url"))}
+			for _, e := range webhookEvents {
+				for _, chosen := range r.Form["events"] {
+					if chosen == e {
+						p.Form.Events = append(p.Form.Events, e)
+					}
+				}
+			}
+			if !httpsURL(p.Form.URL) {
+				p.Error = "a webhook URL is an https URL"
+				break
+			}
+			_, err = db.ExecContext(ctx, "insert into webhooks (url, secret, events, active, created_at) values (?, ?, ?, true, ?)",
+				p.Form.URL, newToken(), strings.Join(p.Form.Events, ","), time.Now().Format(timestampLayout))
+		case "remove":
+			_, err = db.ExecContext(ctx, "delete from webhooks where id = ?", r.FormValue("id"))
+		case "on", "off":
+			_, err = db.ExecContext(ctx, "update webhooks set active = ? where id = ?", r.FormValue("action") == "on", r.FormValue("id"))
+		case "ping":
+			var id int
+			if id, err = strconv.Atoi(r.FormValue("id")); err != nil {
+				http.Error(w, "Bad Request", http.StatusBadRequest)
+				return
+			}
+			now := time.Now()
+			var body []byte
+			body, err = json.Marshal(webhookPayload{Event: eventPing, Created: now.UTC().Format(time.RFC3339), Data: struct{}{}})
+			if err == nil {
+				err = queueDelivery(ctx, id, eventPing, body, now)
+			}
+		case "redeliver":
+			var id int
+			if id, err = strconv.Atoi(r.FormValue("id")); err != nil {
+				http.Error(w, "Bad Request", http.StatusBadRequest)
+				return
+			}
+			err = db.WithTx(ctx, func(ctx context.Context) error {
+				res, err := db.ExecContext(ctx, "update webhook_deliveries set status = ?, attempts = 0 where id = ? and status = ?",
+					deliveryPending, id, deliveryFailed)
+				if err != nil {
+					return err
+				}
+				if n, _ := res.RowsAffected(); n == 0 {
+					return nil
+				}
+				return enqueueJob(ctx, "webhook", id)
+			})
+		default:
+			http.Error(w, "Bad Request", http.StatusBadRequest)
+			return
+		}
+		if err != nil {
+			serverError(w, r, err)
+			return
+		}
+		if p.Error == "" {
+			http.Redirect(w, r, "/admin/webhooks", http.StatusSeeOther)
+			return
+		}
+	}
+	err := queryList(ctx, "select "+webhookColumns+" from webhooks order by id", nil, func(rows *sql.Rows) error {
+		h, err := scanWebhook(rows)
+		p.Webhooks = append(p.Webhooks, h)
+		return err
+	})
+	if err != nil {
+		serverError(w, r, err)
+		return
+	}
+	err = queryList(ctx, `select d.id, w.url, d.event, d.status, d.attempts, coalesce(d.response_code, 0), coalesce(d.last_error, ''),
+			d.created_at, coalesce(d.delivered_at, '')
+		from webhook_deliveries d join webhooks w on w.id = d.webhook_id order by d.id desc limit ?`,
+		[]interface{}{webhookLogSize}, func(rows *sql.Rows) error {
+			var d webhookDelivery
+			err := rows.Scan(&d.ID, &d.URL, &d.Event, &d.Status, &d.Attempts, &d.Code, &d.Error, &d.Created, &d.Delivered)
+			p.Deliveries = append(p.Deliveries, d)
+			return err
+		})
+	if err != nil {
+		serverError(w, r, err)
+		return
+	}
+	render(w, r, "webhooks-admin.html", p)
+}